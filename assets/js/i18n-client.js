@@ -12,9 +12,8 @@ class I18nClient {
         const cookieLang = this.getCookie('lang');
         if (cookieLang) return cookieLang;
 
-        // Check browser language
-        const browserLang = navigator.language || navigator.userLanguage;
-        return browserLang.startsWith('ja') ? 'ja' : 'en';
+        // Check browser language; the server picks the closest registered one
+        return navigator.language || navigator.userLanguage || 'en';
     }
 
     getCookie(name) {
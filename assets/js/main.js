@@ -1,7 +1,11 @@
 // Theme Manager
 class ThemeManager {
     constructor() {
-        this.theme = localStorage.getItem('theme') || this.getSystemTheme();
+        // A theme saved in the user's settings wins; "auto" follows the system
+        const userTheme = document.documentElement.dataset.userTheme;
+        this.theme = (userTheme && userTheme !== 'auto')
+            ? userTheme
+            : localStorage.getItem('theme') || this.getSystemTheme();
         this.init();
     }
 
@@ -235,6 +239,35 @@ const EmailActions = {
         this.fetchAndOpenCompose(`/api/reply/${emailId}`, folder);
     },
 
+    // Reply with a suggested text above the quoted message
+    replyWith: function (emailId, folder, text) {
+        this.fetchAndOpenCompose(`/api/reply/${emailId}`, folder, (data) => {
+            if (data.format === 'html') {
+                const p = document.createElement('p');
+                p.textContent = text;
+                data.body = p.outerHTML + '<br>' + data.body;
+            } else {
+                data.body = text + '\n\n' + data.body;
+            }
+        });
+    },
+
+    // Ask the server's language model for reply suggestions or, with kind
+    // 'summary', a summary of the conversation
+    suggest: function (emailId, folder, kind) {
+        return fetch(`/api/email/${emailId}/suggest?kind=${kind}`, {
+            headers: {
+                'Authorization': `Bearer ${this.getToken()}`,
+                'X-Folder': folder
+            }
+        })
+            .then(res => res.json())
+            .catch(err => {
+                console.error('Suggest error:', err);
+                return { error: window.i18n ? window.i18n.t('message_error', 'エラーが発生しました') : 'エラーが発生しました' };
+            });
+    },
+
     replyAll: function (emailId, folder) {
         this.fetchAndOpenCompose(`/api/reply-all/${emailId}`, folder);
     },
@@ -250,7 +283,128 @@ const EmailActions = {
         }));
     },
 
-    fetchAndOpenCompose: function (url, folder) {
+    // Mark a message as spam or not spam, which trains the spam filter and
+    // moves the message to Junk or back to INBOX
+    markSpam: function (emailId, folder, spam) {
+        fetch(`/api/email/${emailId}/${spam ? 'spam' : 'not-spam'}`, {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${this.getToken()}`,
+                'X-CSRF-Token': this.getCSRFToken(),
+                'X-Folder': folder
+            }
+        })
+            .then(res => res.json())
+            .then(data => {
+                if (data.success) {
+                    const msg = spam
+                        ? (window.i18n ? window.i18n.t('message_marked_spam', '迷惑メールとして報告しました') : '迷惑メールとして報告しました')
+                        : (window.i18n ? window.i18n.t('message_marked_not_spam', '迷惑メールではないと報告しました') : '迷惑メールではないと報告しました');
+                    toastManager.show(msg, 'success');
+                    if (data.moved) {
+                        document.querySelector(`[data-email-id="${emailId}"]`)?.remove();
+                    }
+                } else {
+                    toastManager.show(data.error || 'Failed to update', 'error');
+                }
+            })
+            .catch(err => {
+                console.error('Spam report error:', err);
+                const msg = window.i18n ? window.i18n.t('message_error', 'エラーが発生しました') : 'エラーが発生しました';
+                toastManager.show(msg, 'error');
+            });
+    },
+
+    // Block the sender of a message, or their whole domain, so their new
+    // mail is junked or deleted; the message itself goes the same way
+    blockSender: function (emailId, folder, scope, action) {
+        fetch(`/api/email/${emailId}/block`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+                'Authorization': `Bearer ${this.getToken()}`,
+                'X-CSRF-Token': this.getCSRFToken(),
+                'X-Folder': folder
+            },
+            body: JSON.stringify({ scope: scope, action: action })
+        })
+            .then(res => res.json())
+            .then(data => {
+                if (data.success) {
+                    const msg = window.i18n ? window.i18n.t('message_sender_blocked', '送信者を受信拒否しました') : '送信者を受信拒否しました';
+                    toastManager.show(msg, 'success');
+                    if (data.moved) {
+                        document.querySelector(`[data-email-id="${emailId}"]`)?.remove();
+                    }
+                } else {
+                    toastManager.show(data.error || 'Failed to block sender', 'error');
+                }
+            })
+            .catch(err => {
+                console.error('Block sender error:', err);
+                const msg = window.i18n ? window.i18n.t('message_error', 'エラーが発生しました') : 'エラーが発生しました';
+                toastManager.show(msg, 'error');
+            });
+    },
+
+    // Reload the message body with the remote images the server held back
+    loadImages: function (container) {
+        const frame = container.querySelector('iframe[data-email-body]');
+        if (!frame) return;
+        const url = new URL(frame.getAttribute('src'), window.location.origin);
+        url.searchParams.set('images', '1');
+        frame.setAttribute('src', url.pathname + url.search);
+    },
+
+    // Open the print view, with remote images if the viewer loaded them
+    print: function (emailId, folder, container) {
+        const frame = container && container.querySelector('iframe[data-email-body]');
+        const images = frame && new URL(frame.getAttribute('src'), window.location.origin).searchParams.get('images') === '1';
+        const url = `/email/${emailId}/print?folder=${encodeURIComponent(folder)}` + (images ? '&images=1' : '');
+        const win = window.open(url, '_blank');
+        if (win) win.addEventListener('load', () => win.print());
+    },
+
+    // Size the sandboxed message body frame to its content
+    fitBody: function (frame) {
+        try {
+            const doc = frame.contentDocument;
+            if (!doc) return;
+            const fit = () => { frame.style.height = doc.documentElement.scrollHeight + 'px'; };
+            fit();
+            // Images change the height as they load
+            doc.querySelectorAll('img').forEach(img => img.addEventListener('load', fit));
+        } catch (err) {
+            console.error('Failed to size message body:', err);
+        }
+    },
+
+    // Always load remote images from the sender, then load them now
+    allowImages: function (sender, container) {
+        fetch('/api/settings/image-senders', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': this.getCSRFToken()
+            },
+            body: JSON.stringify({ sender })
+        })
+            .then(res => res.json())
+            .then(data => {
+                if (data.success) {
+                    this.loadImages(container);
+                    toastManager.show(data.message, 'success');
+                } else {
+                    toastManager.show(data.error || 'Failed to save', 'error');
+                }
+            })
+            .catch(err => {
+                console.error(err);
+                toastManager.show('Network error', 'error');
+            });
+    },
+
+    fetchAndOpenCompose: function (url, folder, prepare) {
         fetch(url, {
             headers: {
                 'Authorization': `Bearer ${this.getToken()}`,
@@ -261,6 +415,7 @@ const EmailActions = {
             .then(res => res.json())
             .then(data => {
                 if (data.success) {
+                    if (prepare) prepare(data.data);
                     window.dispatchEvent(new CustomEvent('open-compose-with-data', { detail: data.data }));
                 } else {
                     toastManager.show(data.error || 'Failed to load data', 'error');
@@ -282,6 +437,115 @@ const EmailActions = {
     }
 };
 
+// Keyboard Shortcuts
+class ShortcutManager {
+    constructor() {
+        this.bindings = {};
+        this.current = -1;
+        this.load();
+        document.addEventListener('keydown', (e) => this.handleKey(e));
+    }
+
+    // Bindings come from the user's settings via /api/config
+    async load() {
+        try {
+            const response = await fetch('/api/config');
+            if (!response.ok) return;
+            const data = await response.json();
+            this.bindings = {};
+            for (const [action, key] of Object.entries(data.config.shortcuts || {})) {
+                this.bindings[key] = action;
+            }
+        } catch (e) {
+            console.error('Failed to load shortcuts', e);
+        }
+    }
+
+    // keyName turns an event into the "ctrl+enter" form used in settings
+    keyName(e) {
+        const parts = [];
+        if (e.ctrlKey) parts.push('ctrl');
+        if (e.altKey) parts.push('alt');
+        if (e.metaKey) parts.push('meta');
+        // Shift is part of symbols like "?", so only count it for letters
+        if (e.shiftKey && /^[a-z]$/i.test(e.key)) parts.push('shift');
+        parts.push(e.key.toLowerCase());
+        return parts.join('+');
+    }
+
+    handleKey(e) {
+        const target = e.target;
+        if (target.isContentEditable || ['INPUT', 'TEXTAREA', 'SELECT'].includes(target.tagName)) {
+            return;
+        }
+
+        const action = this.bindings[this.keyName(e)];
+        if (!action) return;
+        e.preventDefault();
+
+        switch (action) {
+            case 'next':
+                this.open(this.current + 1);
+                break;
+            case 'prev':
+                this.open(this.current - 1);
+                break;
+            case 'search':
+                document.querySelector('input[name="query"]')?.focus();
+                break;
+            case 'reply': {
+                const viewer = document.querySelector('[data-viewer-email-id]');
+                // Replying waits until phishing warnings are acknowledged
+                if (viewer && viewer.dataset.replyBlocked !== 'true') {
+                    EmailActions.reply(viewer.dataset.viewerEmailId, viewer.dataset.viewerFolder);
+                }
+                break;
+            }
+            case 'archive':
+                this.archive();
+                break;
+        }
+    }
+
+    // open shows the message at index in the current list
+    open(index) {
+        const rows = document.querySelectorAll('[hx-get^="/api/email/"]');
+        if (index < 0 || index >= rows.length) return;
+        this.current = index;
+        rows[index].scrollIntoView({ block: 'nearest' });
+        rows[index].click();
+    }
+
+    archive() {
+        const viewer = document.querySelector('[data-viewer-email-id]');
+        if (!viewer) return;
+        const emailId = viewer.dataset.viewerEmailId;
+
+        fetch(`/api/email/${emailId}/move`, {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${EmailActions.getToken()}`,
+                'X-CSRF-Token': EmailActions.getCSRFToken(),
+                'X-Folder': viewer.dataset.viewerFolder,
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ target_folder: 'Archive' })
+        })
+            .then(response => {
+                if (!response.ok) throw new Error(`HTTP ${response.status}`);
+                document.querySelector(`[hx-get="/api/email/${emailId}"]`)?.remove();
+                viewer.remove();
+                const msg = window.i18n ? window.i18n.t('message_archived', 'Archived') : 'Archived';
+                toastManager.show(msg, 'success');
+            })
+            .catch(error => {
+                console.error('Archive error:', error);
+                const msg = window.i18n ? window.i18n.t('message_error', 'エラーが発生しました') : 'エラーが発生しました';
+                toastManager.show(msg, 'error');
+            });
+    }
+}
+
 // Notification Manager
 class NotificationManager {
     constructor() {
@@ -433,6 +697,9 @@ document.addEventListener('DOMContentLoaded', () => {
     // Initialize notification manager
     window.notificationManager = new NotificationManager();
 
+    // Initialize keyboard shortcuts
+    window.shortcutManager = new ShortcutManager();
+
     // Initialize email viewer manager (mobile)
     if (window.innerWidth < 768) {
         window.emailViewerManager = new EmailViewerManager();
@@ -11,8 +11,11 @@ class NotificationClient {
         if (this.isConnected) return;
 
         try {
-            // Connect to SSE endpoint
-            this.eventSource = new EventSource('/api/notifications/stream');
+            // Connect to SSE endpoint, asking for anything missed since the
+            // last event this tab saw (also across page loads)
+            const lastEventId = sessionStorage.getItem('lastNotificationId');
+            const url = lastEventId ? `/events?lastEventId=${encodeURIComponent(lastEventId)}` : '/events';
+            this.eventSource = new EventSource(url);
 
             this.eventSource.onopen = () => {
                 console.log('Notification stream connected');
@@ -21,6 +24,9 @@ class NotificationClient {
             };
 
             this.eventSource.onmessage = (event) => {
+                if (event.lastEventId) {
+                    sessionStorage.setItem('lastNotificationId', event.lastEventId);
+                }
                 try {
                     const notification = JSON.parse(event.data);
                     this.handleNotification(notification);
@@ -59,7 +65,7 @@ class NotificationClient {
 
     handleNotification(notification) {
         // Show toast notification
-        if (window.toastManager) {
+        if (window.toastManager && this.shouldToast(notification)) {
             const message = this.getNotificationMessage(notification);
             window.toastManager.show(message, notification.type || 'info');
         }
@@ -75,6 +81,17 @@ class NotificationClient {
             case 'email_deleted':
                 this.handleEmailDeleted(notification);
                 break;
+            case 'folder_updated':
+                this.handleFolderUpdated(notification);
+                break;
+            case 'unread_counts':
+                this.handleUnreadCounts(notification);
+                break;
+            case 'send_failed':
+            case 'login_from_new_device':
+            case 'digest':
+                // Toast only
+                break;
             default:
                 console.log('Unknown notification type:', notification.type);
         }
@@ -85,39 +102,92 @@ class NotificationClient {
         }));
     }
 
+    shouldToast(notification) {
+        // Background cache refreshes only deserve a toast when mail arrived
+        if (notification.type === 'folder_updated') {
+            return notification.data && notification.data.new_count > 0;
+        }
+        // Counter updates only change the sidebar badges
+        if (notification.type === 'unread_counts') {
+            return false;
+        }
+        // The compose form already reports its own send errors
+        if (notification.type === 'send_failed') {
+            return false;
+        }
+        return true;
+    }
+
     getNotificationMessage(notification) {
         const i18n = window.i18n;
 
         switch (notification.type) {
-            case 'new_email':
-                return i18n ? i18n.t('notification_new_email', '新着メール') : '新着メール';
+            case 'new_email': {
+                const title = i18n ? i18n.t('notification_new_email', '新着メール') : '新着メール';
+                const data = notification.data || {};
+                if (data.from || data.subject) {
+                    return `${title}: ${data.from || ''} - ${data.subject || ''}`;
+                }
+                return title;
+            }
             case 'email_sent':
                 return i18n ? i18n.t('notification_email_sent', 'メール送信完了') : 'メール送信完了';
             case 'email_deleted':
                 return i18n ? i18n.t('notification_email_deleted', 'メール削除') : 'メール削除';
+            case 'folder_updated':
+                return i18n ? i18n.t('notification_new_email', '新着メール') : '新着メール';
+            case 'login_from_new_device':
+                return i18n ? i18n.t('notification_new_device_login', '新しいデバイスからのログイン') : '新しいデバイスからのログイン';
             default:
                 return notification.message || '';
         }
     }
 
     handleNewEmail(notification) {
-        // Refresh email list if user is on inbox
-        if (window.location.pathname === '/inbox' || window.location.pathname === '/') {
-            // Use HTMX to refresh email list
-            if (window.htmx) {
-                const emailList = document.getElementById('email-list');
-                if (emailList) {
-                    htmx.trigger(emailList, 'refresh');
-                }
-            }
+        // Mail pushed by the server's IDLE listener shows up in the listing
+        // of its folder without a manual refresh; the unread badges follow
+        // with the unread_counts update
+        this.reloadFolder(notification.data && notification.data.folder);
+    }
+
+    handleFolderUpdated(notification) {
+        this.reloadFolder(notification.data && notification.data.folder);
+    }
+
+    reloadFolder(folder) {
+        // Reload the listing if the folder is the one on screen
+        const path = decodeURIComponent(window.location.pathname);
+        const current = path.startsWith('/folder/') ? path.substring('/folder/'.length) : 'INBOX';
+        if (!folder || folder !== current || !window.htmx) {
+            return;
+        }
+        if (!document.getElementById('email-list')) {
+            return;
         }
 
-        // Update unread count
-        const unreadBadge = document.getElementById('unread-count');
-        if (unreadBadge && notification.unread_count) {
-            unreadBadge.textContent = notification.unread_count;
-            unreadBadge.classList.remove('hidden');
+        const params = new URLSearchParams(window.location.search);
+        if (params.get('view') === 'threaded') {
+            return;
         }
+        const page = params.get('page') || '1';
+        htmx.ajax('GET', `/htmx/folder/${encodeURIComponent(folder)}/emails?page=${page}`, {
+            target: '#email-list',
+            swap: 'innerHTML'
+        });
+    }
+
+    handleUnreadCounts(notification) {
+        // Update every sidebar badge that has a count in the update
+        const counts = (notification.data && notification.data.counts) || {};
+        document.querySelectorAll('[data-unread-folder]').forEach((badge) => {
+            const folder = badge.getAttribute('data-unread-folder');
+            if (!(folder in counts)) {
+                return;
+            }
+            const count = counts[folder];
+            badge.textContent = count;
+            badge.classList.toggle('hidden', count === 0);
+        });
     }
 
     handleEmailSent(notification) {
@@ -3,13 +3,15 @@ package config
 import (
 	"crypto/tls"
 	"fmt"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
 type ServerConfig struct {
-	Port            int  `toml:"port"`
-	UsernameIsEmail bool `toml:"username_is_email"`
+	Port            int    `toml:"port"`
+	UsernameIsEmail bool   `toml:"username_is_email"`
+	BaseURL         string `toml:"base_url"` // Public URL used in links sent by email
 }
 
 type IMAPConfig struct {
@@ -23,6 +25,18 @@ type SMTPConfig struct {
 	UseSTARTTLS bool   `toml:"use_starttls"` // true for port 587, false for port 465
 }
 
+// SMTPRelayConfig routes all outbound mail through one authenticated relay,
+// whichever account it is sent from
+type SMTPRelayConfig struct {
+	Host     string `toml:"host"` // Enables the relay when set
+	Port     int    `toml:"port"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	// AllowedSenders are the addresses, or @domains, mail may be sent from
+	// through the relay. Empty allows any sender.
+	AllowedSenders []string `toml:"allowed_senders"`
+}
+
 type JWTConfig struct {
 	Secret string `toml:"secret"` // For JWT signing
 }
@@ -35,6 +49,158 @@ type EncryptionConfig struct {
 	Key string `toml:"key"` // 32-byte key for AES encryption
 }
 
+type NotificationsConfig struct {
+	PollInterval   int  `toml:"poll_interval"`            // Seconds between new mail checks, 0 disables polling
+	Idle           bool `toml:"idle"`                     // Use IMAP IDLE while a user has the app open
+	MaxConnections int  `toml:"max_connections_per_user"` // Cap on background IMAP connections per user, 0 for no cap
+
+	HeartbeatSeconds int `toml:"heartbeat_seconds"` // Seconds between keep-alive comments on idle SSE streams
+	BufferSize       int `toml:"buffer_size"`       // Notifications queued per open stream before newer ones are dropped
+	BatchWindowMS    int `toml:"batch_window_ms"`   // Milliseconds a burst is gathered into one SSE write, 0 writes each at once
+}
+
+type DigestConfig struct {
+	Enabled bool `toml:"enabled"` // Send scheduled unread digest emails
+}
+
+// SystemConfig holds the operational limits admins can override at
+// runtime from the admin settings page
+type SystemConfig struct {
+	RequestsPerMinute   int      `toml:"requests_per_minute"`  // Rate limit per client IP
+	MaxAttachmentMB     int      `toml:"max_attachment_mb"`    // Size of each attachment of an outgoing email
+	MaxMessageMB        int      `toml:"max_message_mb"`       // Total size of an outgoing email with its attachments
+	BlockedExtensions   []string `toml:"blocked_extensions"`   // File extensions that can't be attached
+	RegistrationEnabled bool     `toml:"registration_enabled"` // Create users on first login
+	AllowedServers      []string `toml:"allowed_servers"`      // IMAP/SMTP servers users may add accounts for, empty allows any
+	DeniedServers       []string `toml:"denied_servers"`       // Hosts, IPs or CIDR ranges accounts may never connect to
+}
+
+// LargeFilesConfig controls sending files too large to attach as expiring
+// download links instead
+type LargeFilesConfig struct {
+	ThresholdMB int          `toml:"threshold_mb"` // Attachments over this size are offered as links, 0 disables links
+	MaxSizeMB   int          `toml:"max_size_mb"`  // Largest file that can be sent as a link
+	ExpiryDays  int          `toml:"expiry_days"`  // How long a link works
+	Backend     string       `toml:"backend"`      // Where files are kept: "local", "s3" or "webdav"
+	Folder      string       `toml:"folder"`       // Folder of the local backend
+	S3          S3Config     `toml:"s3"`
+	WebDAV      WebDAVConfig `toml:"webdav"`
+}
+
+// S3Config is a bucket of S3 or an S3 compatible service
+type S3Config struct {
+	Endpoint  string `toml:"endpoint"` // e.g. https://s3.eu-west-1.amazonaws.com
+	Region    string `toml:"region"`
+	Bucket    string `toml:"bucket"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+}
+
+// WebDAVConfig is a WebDAV folder
+type WebDAVConfig struct {
+	URL      string `toml:"url"` // Folder files are put in, e.g. https://dav.example.com/lilmail/
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+// GraphConfig is the Microsoft Entra app registration Microsoft 365
+// accounts sign in with over the OAuth device code flow
+type GraphConfig struct {
+	ClientID string `toml:"client_id"` // Application (client) ID of a public client app
+	Tenant   string `toml:"tenant"`    // Directory (tenant) ID, or "common" or "organizations"
+}
+
+// OAuthConfig lets users sign in to the configured IMAP and SMTP servers
+// with an OAuth2 provider instead of a password, and logs in to them over
+// XOAUTH2, for providers that turned password logins off like Gmail and
+// Office 365
+type OAuthConfig struct {
+	Provider     string   `toml:"provider"` // "google", "microsoft" or "custom"; empty disables OAuth sign-in
+	ClientID     string   `toml:"client_id"`
+	ClientSecret string   `toml:"client_secret"`
+	Tenant       string   `toml:"tenant"`    // Directory (tenant) ID of the microsoft provider, or "common" or "organizations"
+	AuthURL      string   `toml:"auth_url"`  // Authorization endpoint, set for the google and microsoft providers
+	TokenURL     string   `toml:"token_url"` // Token endpoint, set for the google and microsoft providers
+	Scopes       []string `toml:"scopes"`    // Must include openid and email so the ID token names the address
+	Name         string   `toml:"name"`      // Shown on the login button
+}
+
+// Enabled reports whether users can sign in with the OAuth provider
+func (c *OAuthConfig) Enabled() bool {
+	return c.Provider != "" && c.ClientID != "" && c.AuthURL != "" && c.TokenURL != ""
+}
+
+// applyProvider fills in the endpoints, scopes and name of a known provider
+// where they aren't set
+func (c *OAuthConfig) applyProvider() {
+	var authURL, tokenURL, name string
+	var scopes []string
+	switch c.Provider {
+	case "google":
+		authURL = "https://accounts.google.com/o/oauth2/v2/auth"
+		tokenURL = "https://oauth2.googleapis.com/token"
+		scopes = []string{"openid", "email", "https://mail.google.com/"}
+		name = "Google"
+	case "microsoft":
+		tenant := c.Tenant
+		if tenant == "" {
+			tenant = "common"
+		}
+		authURL = "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0/authorize"
+		tokenURL = "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0/token"
+		scopes = []string{"openid", "email", "offline_access", "https://outlook.office.com/IMAP.AccessAsUser.All", "https://outlook.office.com/SMTP.Send"}
+		name = "Microsoft"
+	default:
+		name = c.Provider
+	}
+
+	if c.AuthURL == "" {
+		c.AuthURL = authURL
+	}
+	if c.TokenURL == "" {
+		c.TokenURL = tokenURL
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = scopes
+	}
+	if c.Name == "" {
+		c.Name = name
+	}
+}
+
+// MaildirConfig lets users read the Maildir of their account on the host
+// lilmail runs on, next to the MTA that delivers it
+type MaildirConfig struct {
+	// Path of a user's Maildir, where {user} is their username and {local}
+	// and {domain} its parts around the @. Empty disables Maildir accounts.
+	Path     string `toml:"path"`
+	Sendmail string `toml:"sendmail"` // Sends Maildir accounts' mail when set, e.g. /usr/sbin/sendmail
+}
+
+// AvatarsConfig controls the sender pictures shown next to messages
+type AvatarsConfig struct {
+	Gravatar  bool `toml:"gravatar"`   // Look senders up on Gravatar; otherwise initials are shown
+	BIMI      bool `toml:"bimi"`       // Show the BIMI brand logo of senders whose mail passed DMARC
+	CacheDays int  `toml:"cache_days"` // Days a sender's picture, or its absence, is cached
+}
+
+// AssistConfig is an OpenAI compatible chat completions API that suggests
+// replies and summarizes threads for users who turn it on in settings
+type AssistConfig struct {
+	Endpoint       string `toml:"endpoint"`        // Base URL, e.g. https://api.openai.com/v1 or http://localhost:11434/v1; empty disables
+	APIKey         string `toml:"api_key"`         // Sent as a bearer token if set
+	Model          string `toml:"model"`           // Model name passed to the endpoint
+	TimeoutSeconds int    `toml:"timeout_seconds"` // How long to wait for an answer
+	MaxInputChars  int    `toml:"max_input_chars"` // Most text of a thread sent to the model
+}
+
+// RedisConfig is a Redis server instances behind a load balancer share
+// rate limits and cached data through
+type RedisConfig struct {
+	URL    string `toml:"url"`    // e.g. redis://:password@localhost:6379/0, or rediss:// for TLS; empty keeps them in each instance
+	Prefix string `toml:"prefix"` // Prepended to every key, to share a server with other apps
+}
+
 type SSLConfig struct {
 	Enabled      bool   `toml:"enabled"`
 	CertFile     string `toml:"cert_file"`     // Path to fullchain.pem
@@ -50,10 +216,22 @@ type Config struct {
 	Server     ServerConfig     `toml:"server"`
 	IMAP       IMAPConfig       `toml:"imap"`
 	SMTP       SMTPConfig       `toml:"smtp"`
+	SMTPRelay  SMTPRelayConfig  `toml:"smtp_relay"`
 	JWT        JWTConfig        `toml:"jwt"`
 	Cache      CacheConfig      `toml:"cache"`
 	Encryption EncryptionConfig `toml:"encryption"`
 	SSL        SSLConfig        `toml:"ssl"`
+
+	Notifications NotificationsConfig `toml:"notifications"`
+	Digest        DigestConfig        `toml:"digest"`
+	System        SystemConfig        `toml:"system"`
+	LargeFiles    LargeFilesConfig    `toml:"large_files"`
+	Graph         GraphConfig         `toml:"graph"`
+	OAuth         OAuthConfig         `toml:"oauth"`
+	Maildir       MaildirConfig       `toml:"maildir"`
+	Avatars       AvatarsConfig       `toml:"avatars"`
+	Assist        AssistConfig        `toml:"assist"`
+	Redis         RedisConfig         `toml:"redis"`
 }
 
 func LoadConfig(filepath string) (*Config, error) {
@@ -64,6 +242,46 @@ func LoadConfig(filepath string) (*Config, error) {
 	// Set default values
 	config.SMTP.Port = 587 // Default to STARTTLS port
 	config.SMTP.UseSTARTTLS = true
+	config.SMTPRelay.Port = 587
+
+	// Default new mail polling interval
+	config.Notifications.PollInterval = 60
+	config.Notifications.Idle = true
+	config.Notifications.MaxConnections = 2
+	config.Notifications.HeartbeatSeconds = 30
+	config.Notifications.BufferSize = 10
+	config.Notifications.BatchWindowMS = 250
+
+	// Default operational limits
+	config.System.RequestsPerMinute = 100
+	config.System.MaxAttachmentMB = 25
+	config.System.MaxMessageMB = 35
+	config.System.BlockedExtensions = []string{"exe", "bat", "cmd", "com", "scr", "pif", "vbs", "js", "jse", "msi", "ps1", "hta", "cpl", "jar"}
+	config.System.RegistrationEnabled = true
+	// Keep user-added accounts off loopback and private networks
+	config.System.DeniedServers = []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "fc00::/7", "fe80::/10"}
+
+	// Default large file links, kept on local disk
+	config.LargeFiles.ThresholdMB = 10
+	config.LargeFiles.MaxSizeMB = 1024
+	config.LargeFiles.ExpiryDays = 14
+	config.LargeFiles.Backend = "local"
+	config.LargeFiles.Folder = "./data/large_files"
+
+	// Let Microsoft 365 accounts of any organization sign in
+	config.Graph.Tenant = "common"
+
+	// Sender pictures
+	config.Avatars.Gravatar = true
+	config.Avatars.BIMI = true
+	config.Avatars.CacheDays = 7
+
+	// Reply suggestions, off until an endpoint is set
+	config.Assist.TimeoutSeconds = 30
+	config.Assist.MaxInputChars = 12000
+
+	// Keys of the shared Redis, when one is set
+	config.Redis.Prefix = "lilmail:"
 
 	// Default SSL configuration
 	config.SSL.Port = 443
@@ -86,6 +304,8 @@ func LoadConfig(filepath string) (*Config, error) {
 		}
 	}
 
+	config.OAuth.applyProvider()
+
 	// Validate SSL configuration if enabled
 	if config.SSL.Enabled {
 		if err := config.ValidateSSL(); err != nil {
@@ -107,6 +327,43 @@ func (c *SMTPConfig) GetPort() int {
 	return 465 // SSL/TLS port
 }
 
+// Enabled reports whether outbound mail goes through the relay
+func (c *SMTPRelayConfig) Enabled() bool {
+	return c.Host != ""
+}
+
+// AllowsSender reports whether mail from an address may be sent through
+// the relay
+func (c *SMTPRelayConfig) AllowsSender(email string) bool {
+	if len(c.AllowedSenders) == 0 {
+		return true
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	for _, allowed := range c.AllowedSenders {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == email || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(email, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled reports whether reply suggestions and summaries are available
+func (c *AssistConfig) Enabled() bool {
+	return c.Endpoint != "" && c.Model != ""
+}
+
+// PublicURL returns the base URL users reach the app at
+func (c *Config) PublicURL() string {
+	if c.Server.BaseURL != "" {
+		return strings.TrimRight(c.Server.BaseURL, "/")
+	}
+	if c.SSL.Enabled && c.SSL.Domain != "" {
+		return "https://" + c.SSL.Domain
+	}
+	return fmt.Sprintf("http://localhost:%d", c.Server.Port)
+}
+
 // ValidateSSL checks if the SSL configuration is valid
 func (c *Config) ValidateSSL() error {
 	if !c.SSL.Enabled {
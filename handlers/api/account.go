@@ -1,10 +1,16 @@
 package api
 
 import (
+	"fmt"
 	"lilmail/config"
 	"lilmail/models"
 	"lilmail/storage"
 	"lilmail/utils"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
@@ -16,15 +22,133 @@ type AccountHandler struct {
 	store   *session.Store
 	config  *config.Config
 	storage *storage.AccountStorage
+	users   *storage.UserStorage
+	system  *storage.SystemSettingsStorage
 }
 
 // NewAccountHandler creates a new account handler
-func NewAccountHandler(store *session.Store, cfg *config.Config, accountStorage *storage.AccountStorage) *AccountHandler {
-	return &AccountHandler{
+func NewAccountHandler(store *session.Store, cfg *config.Config, accountStorage *storage.AccountStorage, userStorage *storage.UserStorage, systemSettings *storage.SystemSettingsStorage) *AccountHandler {
+	h := &AccountHandler{
 		store:   store,
 		config:  cfg,
 		storage: accountStorage,
+		users:   userStorage,
+		system:  systemSettings,
 	}
+	graphTokenSaver = h.saveGraphToken
+	oauthTokenSaver = h.saveOAuthToken
+	accountServerLimits = systemSettings.Current
+	return h
+}
+
+// accountServerLimits returns the admin's limits on the servers accounts
+// connect to. Set by NewAccountHandler.
+var accountServerLimits func() models.SystemSettings
+
+// accountDialer returns a dialer for servers users chose for their
+// accounts. It checks every address it connects to against the deny list,
+// so a server that resolved to a public address when the account was saved
+// can't be rebound to a blocked one.
+func accountDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if accountServerLimits == nil {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("refusing to connect to %s", host)
+			}
+			limits := accountServerLimits()
+			return limits.CheckAddress(ip)
+		},
+	}
+}
+
+// accountTransport returns an HTTP transport that connects with
+// accountDialer, for the JMAP servers users chose
+func accountTransport() *http.Transport {
+	dialer := accountDialer(30 * time.Second)
+	return &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// checkServers makes sure the account's IMAP (or JMAP, or POP3) and SMTP
+// servers are permitted by the admin's allow and deny lists
+func (h *AccountHandler) checkServers(account *models.Account) error {
+	limits := h.system.Current()
+	switch {
+	case account.UsesJMAP():
+		u, err := url.Parse(account.JMAPURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			return fmt.Errorf("invalid JMAP URL")
+		}
+		if err := limits.CheckServer(u.Hostname()); err != nil {
+			return err
+		}
+	case account.UsesPOP3():
+		if err := limits.CheckServer(account.POP3Server); err != nil {
+			return err
+		}
+	case account.UsesGraph():
+		// Always Microsoft's own endpoints
+	case account.UsesMaildir():
+		// Read from disk; only mail sent over SMTP leaves the host
+	default:
+		if err := limits.CheckServer(account.IMAPServer); err != nil {
+			return err
+		}
+	}
+	if account.SMTPServer != "" {
+		return limits.CheckServer(account.SMTPServer)
+	}
+	return nil
+}
+
+// checkAccountLimit enforces the account limit set by an admin
+func (h *AccountHandler) checkAccountLimit(c *fiber.Ctx) error {
+	user, err := CurrentUser(c, h.users)
+	if err != nil || user.Limits.MaxAccounts <= 0 {
+		return nil
+	}
+	counts, err := h.storage.CountAccountsByUser()
+	if err != nil {
+		return utils.InternalServerError("Failed to count accounts", err)
+	}
+	// Some accounts are keyed by username rather than user ID
+	if counts[user.ID]+counts[user.Username] >= user.Limits.MaxAccounts {
+		return utils.ForbiddenError(fmt.Sprintf("You can have at most %d mail accounts", user.Limits.MaxAccounts), nil)
+	}
+	return nil
+}
+
+// canLogIn reports whether the account has what it needs to log in.
+// JMAP accounts need the session URL; their username is optional, since
+// some servers take the password as a bearer token instead. Graph accounts
+// only need the refresh token of their sign-in, and Maildir accounts
+// nothing, being the user's own Maildir.
+func canLogIn(account *models.Account) bool {
+	switch account.Protocol {
+	case models.ProtocolJMAP:
+		return account.JMAPURL != "" && account.Password != ""
+	case models.ProtocolPOP3:
+		return account.POP3Server != "" && account.Username != "" && account.Password != ""
+	case models.ProtocolGraph:
+		return account.Password != ""
+	case models.ProtocolMaildir:
+		return account.Username != ""
+	case "", models.ProtocolIMAP:
+		return account.IMAPServer != "" && account.Username != "" && account.Password != ""
+	}
+	return false
 }
 
 // CreateAccount creates a new email account
@@ -45,10 +169,28 @@ func (h *AccountHandler) CreateAccount(c *fiber.Ctx) error {
 	req.ID = uuid.New().String()
 
 	// Validate required fields
-	if req.Email == "" || req.IMAPServer == "" || req.Username == "" || req.Password == "" {
+	if req.UsesGraph() {
+		return utils.BadRequestError("Microsoft 365 accounts are added by signing in with Microsoft", nil)
+	}
+	if req.UsesMaildir() {
+		// Users can only read their own Maildir
+		req.Username = userID
+		if _, err := NewMaildirClient(h.config.Maildir, userID, h.config.Cache.Folder); err != nil {
+			return utils.BadRequestError("Your Maildir can't be read", err)
+		}
+	}
+	if req.Email == "" || !canLogIn(&req) {
 		return utils.BadRequestError("Missing required fields", nil)
 	}
 
+	if err := h.checkServers(&req); err != nil {
+		return utils.ForbiddenError(err.Error(), err)
+	}
+
+	if err := h.checkAccountLimit(c); err != nil {
+		return err
+	}
+
 	// Create account
 	encryptionKey := []byte(h.config.Encryption.Key)
 	if err := h.storage.CreateAccount(&req, encryptionKey); err != nil {
@@ -141,6 +283,10 @@ func (h *AccountHandler) UpdateAccount(c *fiber.Ctx) error {
 	req.ID = accountID
 	req.UserID = userID
 
+	if err := req.Compose.Validate(); err != nil {
+		return utils.BadRequestError(err.Error(), err)
+	}
+
 	// Verify existing account ownership
 	encryptionKey := []byte(h.config.Encryption.Key)
 	existing, err := h.storage.GetAccount(accountID, encryptionKey)
@@ -152,6 +298,34 @@ func (h *AccountHandler) UpdateAccount(c *fiber.Ctx) error {
 		return utils.UnauthorizedError("Access denied", nil)
 	}
 
+	// A password left out of the update keeps the saved one
+	if req.Password == "" {
+		req.Password = existing.Password
+	}
+	if req.UsesGraph() != existing.UsesGraph() {
+		return utils.BadRequestError("Microsoft 365 accounts can't be changed to or from another protocol", nil)
+	}
+	if req.UsesMaildir() {
+		// Users can only read their own Maildir
+		req.Username = userID
+		if !existing.UsesMaildir() {
+			if _, err := NewMaildirClient(h.config.Maildir, userID, h.config.Cache.Folder); err != nil {
+				return utils.BadRequestError("Your Maildir can't be read", err)
+			}
+		}
+	}
+	if req.Protocol != existing.Protocol && !canLogIn(&req) {
+		return utils.BadRequestError("Missing required fields", nil)
+	}
+
+	// Accounts set up before a server was disallowed keep working
+	if req.IMAPServer != existing.IMAPServer || req.SMTPServer != existing.SMTPServer ||
+		req.Protocol != existing.Protocol || req.JMAPURL != existing.JMAPURL || req.POP3Server != existing.POP3Server {
+		if err := h.checkServers(&req); err != nil {
+			return utils.ForbiddenError(err.Error(), err)
+		}
+	}
+
 	// Update account
 	if err := h.storage.UpdateAccount(&req, encryptionKey); err != nil {
 		return utils.InternalServerError("Failed to update account", err)
@@ -279,7 +453,7 @@ func (h *AccountHandler) SwitchAccount(c *fiber.Ctx) error {
 	// storage.GetAccount usually returns struct with decrypted password if we passed the key?
 	// Let's assume GetAccount decrypts the password into the struct.
 	
-	encryptedCreds, err := EncryptCredentials(account.Email, account.Password, h.config.Encryption.Key)
+	encryptedCreds, err := EncryptAccountCredentials(account, h.config.Encryption.Key)
 	if err != nil {
 		return utils.InternalServerError("Failed to secure credentials", err)
 	}
@@ -287,12 +461,17 @@ func (h *AccountHandler) SwitchAccount(c *fiber.Ctx) error {
 	// Update session values
 	sess.Set("accountId", account.ID)
 	sess.Set("email", account.Email)
-	sess.Set("username", account.Username)
+	// JMAP accounts logging in with a token have no username
+	username := account.Username
+	if username == "" {
+		username = account.Email
+	}
+	sess.Set("username", username)
 	sess.Set("credentials", encryptedCreds)
 	
 	// Regenerate token? Token contains email/username usually.
 	// If token changes, frontend needs it.
-	token, err := GenerateToken(account.Username, account.Email, h.config.JWT.Secret)
+	token, err := GenerateToken(username, account.Email, h.config.JWT.Secret)
 	if err != nil {
 		return utils.InternalServerError("Failed to generate token", err)
 	}
@@ -309,7 +488,84 @@ func (h *AccountHandler) SwitchAccount(c *fiber.Ctx) error {
 		"account": fiber.Map{
 			"id": account.ID,
 			"email": account.Email,
-			"username": account.Username,
+			"username": username,
 		},
 	})
 }
+
+// TestAccount checks that an account's IMAP (or JMAP, or POP3) login works,
+// or that the user's Maildir can be read, before it is saved
+func (h *AccountHandler) TestAccount(c *fiber.Ctx) error {
+	var req struct {
+		Protocol   string `json:"protocol" form:"protocol"`
+		IMAPServer string `json:"imap_server" form:"imap_server"`
+		IMAPPort   int    `json:"imap_port" form:"imap_port"`
+		JMAPURL    string `json:"jmap_url" form:"jmap_url"`
+		POP3Server string `json:"pop3_server" form:"pop3_server"`
+		POP3Port   int    `json:"pop3_port" form:"pop3_port"`
+		SMTPServer string `json:"smtp_server" form:"smtp_server"`
+		Username   string `json:"username" form:"username"`
+		Password   string `json:"password" form:"password"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+
+	account := &models.Account{
+		Protocol:   req.Protocol,
+		IMAPServer: req.IMAPServer,
+		JMAPURL:    req.JMAPURL,
+		POP3Server: req.POP3Server,
+		POP3Port:   req.POP3Port,
+		SMTPServer: req.SMTPServer,
+		Username:   req.Username,
+		Password:   req.Password,
+	}
+	if account.UsesMaildir() {
+		userID, ok := c.Locals("username").(string)
+		if !ok || userID == "" {
+			return utils.UnauthorizedError("User not authenticated", nil)
+		}
+		account.Username = userID
+	}
+	if !canLogIn(account) {
+		return utils.BadRequestError("Missing required fields", nil)
+	}
+
+	// Checked before dialing so the test can't be used to probe hosts
+	if err := h.checkServers(account); err != nil {
+		return utils.ForbiddenError(err.Error(), err)
+	}
+
+	switch {
+	case account.UsesJMAP():
+		client, err := NewJMAPClient(req.JMAPURL, req.Username, req.Password, h.config.Cache.Folder)
+		if err != nil {
+			return utils.BadRequestError("Could not log in to the JMAP server", err)
+		}
+		client.Close()
+	case account.UsesPOP3():
+		// Only logs in; downloading starts once the account is used
+		if err := checkPOP3Login(req.POP3Server, req.POP3Port, req.Username, req.Password); err != nil {
+			return utils.BadRequestError("Could not log in to the POP3 server", err)
+		}
+	case account.UsesMaildir():
+		if _, err := NewMaildirClient(h.config.Maildir, account.Username, h.config.Cache.Folder); err != nil {
+			return utils.BadRequestError("Your Maildir can't be read", err)
+		}
+	default:
+		if req.IMAPPort == 0 {
+			req.IMAPPort = 993
+		}
+		client, err := newClientWithDialer(accountDialer(imapDialTimeout), req.IMAPServer, req.IMAPPort, req.Username, req.Password)
+		if err != nil {
+			return utils.BadRequestError("Could not log in to the IMAP server", err)
+		}
+		client.Close()
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Connection successful",
+	})
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"errors"
+	"lilmail/models"
+	"lilmail/utils"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// graphLogins holds the Microsoft sign-ins in progress, by id
+var graphLogins sync.Map
+
+// graphLogin is a device code sign-in waiting for the user
+type graphLogin struct {
+	userID     string
+	deviceCode string
+	expires    time.Time
+}
+
+// saveGraphToken stores the new refresh token of a Microsoft 365 account
+func (h *AccountHandler) saveGraphToken(accountID, refreshToken string) {
+	encryptionKey := []byte(h.config.Encryption.Key)
+	account, err := h.storage.GetAccount(accountID, encryptionKey)
+	if err != nil {
+		utils.Log.Warn("Failed to load account %s to save its Microsoft sign-in: %v", accountID, err)
+		return
+	}
+	account.Password = refreshToken
+	if err := h.storage.UpdateAccount(account, encryptionKey); err != nil {
+		utils.Log.Warn("Failed to save Microsoft sign-in of account %s: %v", accountID, err)
+	}
+}
+
+// StartGraphLogin starts adding a Microsoft 365 account. The user signs in
+// at Microsoft with the returned code while the page polls FinishGraphLogin.
+func (h *AccountHandler) StartGraphLogin(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+	if h.config.Graph.ClientID == "" {
+		return utils.BadRequestError("Microsoft 365 sign-in is not configured", nil)
+	}
+	if err := h.checkAccountLimit(c); err != nil {
+		return err
+	}
+
+	code, err := requestGraphDeviceCode(h.config.Graph)
+	if err != nil {
+		return utils.InternalServerError("Failed to start Microsoft sign-in", err)
+	}
+
+	id := uuid.New().String()
+	graphLogins.Store(id, &graphLogin{
+		userID:     userID,
+		deviceCode: code.DeviceCode,
+		expires:    time.Now().Add(time.Duration(code.ExpiresIn) * time.Second),
+	})
+
+	return c.JSON(fiber.Map{
+		"success":          true,
+		"id":               id,
+		"user_code":        code.UserCode,
+		"verification_uri": code.VerificationURI,
+		"interval":         code.Interval,
+		"expires_in":       code.ExpiresIn,
+	})
+}
+
+// FinishGraphLogin checks whether the user finished signing in at
+// Microsoft, and adds their account once they have
+func (h *AccountHandler) FinishGraphLogin(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	id := c.Params("id")
+	value, ok := graphLogins.Load(id)
+	if !ok || value.(*graphLogin).userID != userID {
+		return utils.NotFoundError("Sign-in not found", nil)
+	}
+	login := value.(*graphLogin)
+	if time.Now().After(login.expires) {
+		graphLogins.Delete(id)
+		return utils.BadRequestError("The sign-in code expired, please try again", nil)
+	}
+
+	token, err := pollGraphDeviceCode(h.config.Graph, login.deviceCode)
+	if errors.Is(err, errGraphPending) {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"pending": true,
+		})
+	}
+	graphLogins.Delete(id)
+	if err != nil {
+		return utils.BadRequestError("Microsoft sign-in failed", err)
+	}
+
+	profile, err := fetchGraphProfile(token.AccessToken)
+	if err != nil {
+		return utils.InternalServerError("Failed to read the Microsoft 365 account", err)
+	}
+	if err := h.checkAccountLimit(c); err != nil {
+		return err
+	}
+
+	account := &models.Account{
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		Email:       profile.Mail,
+		Protocol:    models.ProtocolGraph,
+		Username:    profile.UserPrincipalName,
+		Password:    token.RefreshToken,
+		DisplayName: profile.DisplayName,
+	}
+	encryptionKey := []byte(h.config.Encryption.Key)
+	if err := h.storage.CreateAccount(account, encryptionKey); err != nil {
+		return utils.InternalServerError("Failed to create account", err)
+	}
+	graphTokens.Store(account.ID, token)
+
+	// Don't return the token
+	account.Password = ""
+
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"account": account,
+	})
+}
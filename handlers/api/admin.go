@@ -0,0 +1,167 @@
+package api
+
+import (
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AdminMiddleware only lets users with the admin role through. It goes
+// after SessionMiddleware, which sets the user in the context.
+func AdminMiddleware(userStorage *storage.UserStorage) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var user *models.User
+		var err error
+		if userID, ok := c.Locals("userId").(string); ok && userID != "" {
+			user, err = userStorage.GetUser(userID)
+		} else if username := GetSessionUser(c); username != "" {
+			user, err = userStorage.GetUserByUsername(username)
+		} else {
+			return utils.UnauthorizedError("User not authenticated", nil)
+		}
+
+		if err != nil || user.Role != "admin" {
+			return utils.ForbiddenError("Access denied", err)
+		}
+
+		c.Locals("adminUser", user)
+		return c.Next()
+	}
+}
+
+// AdminHandler serves the instance statistics of the admin dashboard
+type AdminHandler struct {
+	users    *storage.UserStorage
+	accounts *storage.AccountStorage
+	sessions *storage.FileStorage
+	usage    *storage.UsageReporter
+	notify   *NotificationHandler
+	idle     *IdleManager
+	poller   *MailPoller
+}
+
+// NewAdminHandler creates a new admin handler
+func NewAdminHandler(userStorage *storage.UserStorage, accountStorage *storage.AccountStorage, sessions *storage.FileStorage, usage *storage.UsageReporter, notify *NotificationHandler, idle *IdleManager, poller *MailPoller) *AdminHandler {
+	return &AdminHandler{
+		users:    userStorage,
+		accounts: accountStorage,
+		sessions: sessions,
+		usage:    usage,
+		notify:   notify,
+		idle:     idle,
+		poller:   poller,
+	}
+}
+
+// UserAccounts is a user with the number of mail accounts they set up
+type UserAccounts struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Accounts int    `json:"accounts"`
+}
+
+// GetStats returns counts of users, accounts, sessions and connections,
+// storage usage and the latest logged errors
+func (h *AdminHandler) GetStats(c *fiber.Ctx) error {
+	users, err := h.users.ListUsers()
+	if err != nil {
+		return utils.InternalServerError("Failed to retrieve users", err)
+	}
+
+	counts, err := h.accounts.CountAccountsByUser()
+	if err != nil {
+		return utils.InternalServerError("Failed to count accounts", err)
+	}
+	totalAccounts := 0
+	for _, n := range counts {
+		totalAccounts += n
+	}
+	perUser := make([]UserAccounts, 0, len(users))
+	for _, user := range users {
+		// Some accounts are keyed by username rather than user ID
+		n := counts[user.ID] + counts[user.Username]
+		perUser = append(perUser, UserAccounts{UserID: user.ID, Username: user.Username, Accounts: n})
+	}
+
+	sessions, err := h.sessions.Count()
+	if err != nil {
+		return utils.InternalServerError("Failed to count sessions", err)
+	}
+
+	usage, err := h.usage.Usage()
+	if err != nil {
+		return utils.InternalServerError("Failed to measure storage", err)
+	}
+
+	connectedUsers, subscribers := h.notify.SubscriberCounts()
+	idleWorkers, imapConns := h.idle.Counts()
+
+	return c.JSON(fiber.Map{
+		"success":           true,
+		"total_users":       len(users),
+		"total_accounts":    totalAccounts,
+		"accounts_per_user": perUser,
+		"active_sessions":   sessions,
+		"connected_users":   connectedUsers,
+		"sse_subscribers":   subscribers,
+		"idle_workers":      idleWorkers,
+		"imap_connections":  imapConns,
+		"storage":           usage,
+		"recent_errors":     utils.RecentErrors(),
+	})
+}
+
+// GetSessions lists who is logged in, from where and since when
+func (h *AdminHandler) GetSessions(c *fiber.Ctx) error {
+	sessions := h.sessions.ListSessions()
+	if userID := c.Query("user_id"); userID != "" {
+		filtered := sessions[:0]
+		for _, s := range sessions {
+			if s.UserID == userID {
+				filtered = append(filtered, s)
+			}
+		}
+		sessions = filtered
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"sessions": sessions,
+	})
+}
+
+// RevokeUserSessions logs a user out everywhere, e.g. after offboarding,
+// and stops their background mail connections
+func (h *AdminHandler) RevokeUserSessions(c *fiber.Ctx) error {
+	userID := c.Params("id")
+	if userID == "" {
+		return utils.BadRequestError("User ID required", nil)
+	}
+
+	user, err := h.users.GetUser(userID)
+	if err != nil {
+		return utils.NotFoundError("User not found", err)
+	}
+
+	usernames, err := h.sessions.DeleteUserSessions(user.ID)
+	if err != nil {
+		return utils.InternalServerError("Failed to revoke sessions", err)
+	}
+	for _, username := range usernames {
+		h.poller.Stop(username)
+		h.idle.Logout(username)
+	}
+
+	admin := ""
+	if adminUser, ok := c.Locals("adminUser").(*models.User); ok {
+		admin = adminUser.Username
+	}
+	utils.Log.Info("Sessions of %s revoked by %s", user.Username, admin)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Sessions revoked",
+	})
+}
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lilmail/config"
+	"lilmail/models"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Limits on what the model's answers are cut to
+const (
+	maxReplySuggestions = 3
+	maxSuggestionChars  = 300
+	maxAssistAnswer     = 64 << 10
+)
+
+// assistLanguages names the reply languages of the app's locales for the model
+var assistLanguages = map[string]string{
+	"en": "English",
+	"ja": "Japanese",
+}
+
+// Assistant asks a language model behind an OpenAI compatible chat
+// completions API for reply suggestions and thread summaries. The messages
+// asked about are sent to the endpoint, so it is only used for users who
+// turned it on.
+type Assistant struct {
+	config *config.AssistConfig
+	client *http.Client
+}
+
+// NewAssistant creates an assistant for the configured endpoint, or returns
+// nil if none is configured
+func NewAssistant(cfg *config.Config) *Assistant {
+	if !cfg.Assist.Enabled() {
+		return nil
+	}
+	timeout := cfg.Assist.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = 30
+	}
+	return &Assistant{
+		config: &cfg.Assist,
+		client: &http.Client{Timeout: time.Duration(timeout) * time.Second},
+	}
+}
+
+// SuggestReplies returns a few short replies to the last message of a
+// thread, written in the language of lang
+func (a *Assistant) SuggestReplies(thread []models.Email, lang string) ([]string, error) {
+	system := fmt.Sprintf("You help the user answer their email. Suggest %d short, distinct replies "+
+		"the user could send to the last message of the conversation, each one or two sentences, "+
+		"written in %s. Answer with a JSON array of strings only.", maxReplySuggestions, assistLanguage(lang))
+
+	answer, err := a.complete(system, a.transcript(thread))
+	if err != nil {
+		return nil, err
+	}
+	return parseSuggestions(answer), nil
+}
+
+// Summarize returns a short summary of a thread, written in the language of
+// lang
+func (a *Assistant) Summarize(thread []models.Email, lang string) (string, error) {
+	system := fmt.Sprintf("You help the user keep up with their email. Summarize the conversation "+
+		"in a few sentences written in %s: what it is about, what was decided and what is asked "+
+		"of the user. Answer with the summary only.", assistLanguage(lang))
+
+	answer, err := a.complete(system, a.transcript(thread))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+// chatMessage is a message of a chat completions request or response
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// complete sends a system prompt and the user's text to the endpoint and
+// returns the model's answer
+func (a *Assistant) complete(system, prompt string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model": a.config.Model,
+		"messages": []chatMessage{
+			{Role: "system", Content: system},
+			{Role: "user", Content: prompt},
+		},
+		"temperature": 0.3,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(a.config.Endpoint, "/")+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+a.config.APIKey)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error calling assist endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAssistAnswer))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("assist endpoint returned %s", resp.Status)
+	}
+
+	var result struct {
+		Choices []struct {
+			Message chatMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", fmt.Errorf("error parsing assist answer: %v", err)
+	}
+	if len(result.Choices) == 0 {
+		return "", fmt.Errorf("assist endpoint returned no answer")
+	}
+	return result.Choices[0].Message.Content, nil
+}
+
+// transcript writes a thread out as text for the model, oldest message
+// first. Older messages are dropped to stay within MaxInputChars.
+func (a *Assistant) transcript(thread []models.Email) string {
+	limit := a.config.MaxInputChars
+	if limit <= 0 {
+		limit = 12000
+	}
+
+	var parts []string
+	total := 0
+	for i := len(thread) - 1; i >= 0; i-- {
+		email := thread[i]
+		body := email.Body
+		if body == "" {
+			body = email.Preview
+		}
+		part := fmt.Sprintf("From: %s\nDate: %s\nSubject: %s\n\n%s",
+			email.From, email.Date.Format(time.RFC1123Z), email.Subject, strings.TrimSpace(body))
+		if total+len(part) > limit {
+			if len(parts) > 0 {
+				break
+			}
+			part = strings.ToValidUTF8(part[:limit], "")
+		}
+		parts = append([]string{part}, parts...)
+		total += len(part)
+	}
+	return strings.Join(parts, "\n\n---\n\n")
+}
+
+// parseSuggestions reads the replies out of the model's answer: a JSON array
+// of strings, possibly wrapped in other text, or else one reply per line
+func parseSuggestions(answer string) []string {
+	var replies []string
+	start, end := strings.Index(answer, "["), strings.LastIndex(answer, "]")
+	if start < 0 || end < start || json.Unmarshal([]byte(answer[start:end+1]), &replies) != nil {
+		replies = nil
+		for _, line := range strings.Split(answer, "\n") {
+			line = strings.TrimLeft(strings.TrimSpace(line), "-*•0123456789.) ")
+			if line != "" {
+				replies = append(replies, strings.Trim(line, `"`))
+			}
+		}
+	}
+
+	var suggestions []string
+	for _, reply := range replies {
+		reply = strings.TrimSpace(reply)
+		if reply == "" {
+			continue
+		}
+		if runes := []rune(reply); len(runes) > maxSuggestionChars {
+			reply = string(runes[:maxSuggestionChars])
+		}
+		suggestions = append(suggestions, reply)
+		if len(suggestions) == maxReplySuggestions {
+			break
+		}
+	}
+	return suggestions
+}
+
+// assistLanguage names the language answers are written in
+func assistLanguage(lang string) string {
+	if name, ok := assistLanguages[lang]; ok {
+		return name
+	}
+	return assistLanguages["en"]
+}
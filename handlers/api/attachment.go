@@ -3,7 +3,11 @@ package api
 import (
 	"fmt"
 	"lilmail/config"
+	"lilmail/models"
 	"lilmail/utils"
+	"mime"
+	"net/url"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
@@ -41,37 +45,31 @@ func (h *AttachmentHandler) HandleDownload(c *fiber.Ctx) error {
 	}
 	
 	// Create IMAP client
-	client, err := createIMAPClientFromCredentials(credentials, h.config)
+	client, err := NewMailClient(credentials, h.config)
 	if err != nil {
 		return utils.InternalServerError("Failed to connect to server", err)
 	}
 	defer client.Close()
 	
-	// Fetch email
-	email, err := client.FetchSingleMessage(folderName, emailID)
-	if err != nil {
-		return utils.InternalServerError(fmt.Sprintf("Failed to fetch email: %v", err), err)
-	}
-	
-	// Get attachment by index
+	// Fetch just the attachment's part
 	var index int
 	fmt.Sscanf(attachmentIndex, "%d", &index)
 	
-	if index < 0 || index >= len(email.Attachments) {
-		return utils.NotFoundError("Attachment not found", nil)
+	attachment, err := client.FetchAttachment(folderName, emailID, index)
+	if err != nil {
+		return utils.NotFoundError("Attachment not found", err)
 	}
 	
-	attachment := email.Attachments[index]
-	
 	// Set headers
 	c.Set("Content-Type", attachment.ContentType)
-	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", attachment.Filename))
+	c.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
 	c.Set("Content-Length", fmt.Sprintf("%d", len(attachment.Content)))
 	
 	return c.Send(attachment.Content)
 }
 
-// HandlePreview serves an attachment for preview (images, PDFs)
+// HandlePreview serves a preview of an attachment: images as they are,
+// the first page of PDFs as a PNG, and text and CSV files as a page
 func (h *AttachmentHandler) HandlePreview(c *fiber.Ctx) error {
 	emailID := c.Params("email_id")
 	attachmentIndex := c.Params("index")
@@ -89,32 +87,114 @@ func (h *AttachmentHandler) HandlePreview(c *fiber.Ctx) error {
 	}
 	
 	// Create IMAP client
-	client, err := createIMAPClientFromCredentials(credentials, h.config)
+	client, err := NewMailClient(credentials, h.config)
 	if err != nil {
 		return utils.InternalServerError("Failed to connect to server", err)
 	}
 	defer client.Close()
 	
-	// Fetch email
-	email, err := client.FetchSingleMessage(folderName, emailID)
+	// Fetch just the attachment's part
+	var index int
+	fmt.Sscanf(attachmentIndex, "%d", &index)
+	
+	attachment, err := client.FetchAttachment(folderName, emailID, index)
 	if err != nil {
-		return utils.InternalServerError(fmt.Sprintf("Failed to fetch email: %v", err), err)
+		return utils.NotFoundError("Attachment not found", err)
 	}
 	
-	// Get attachment by index
-	var index int
-	fmt.Sscanf(attachmentIndex, "%d", &index)
+	// Previews never run scripts, whatever the file contains
+	c.Set("Content-Security-Policy", "default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; object-src 'self'; frame-ancestors 'self'; sandbox allow-same-origin")
+	c.Set("X-Content-Type-Options", "nosniff")
+	c.Set("Cache-Control", "private, max-age=3600")
+	
+	switch attachment.PreviewKind() {
+	case models.PreviewImage:
+		return h.sendInline(c, attachment.ContentType, attachment.Filename, attachment.Content)
+	
+	case models.PreviewPDF:
+		png, err := renderPDFPreview(attachment.Content)
+		if err == errNoPDFRenderer {
+			// Let the browser's PDF viewer show it; browsers won't start
+			// it in a sandbox
+			c.Set("Content-Security-Policy", "frame-ancestors 'self'")
+			return h.sendInline(c, "application/pdf", attachment.Filename, attachment.Content)
+		}
+		if err != nil {
+			return utils.InternalServerError("Failed to render PDF preview", err)
+		}
+		return h.sendInline(c, "image/png", strings.TrimSuffix(attachment.Filename, ".pdf")+".png", png)
+	
+	case models.PreviewText:
+		text, truncated := previewText(attachment.Content)
+		return c.Render("partials/attachment-preview", fiber.Map{
+			"Title":     previewTitle(attachment),
+			"Text":      text,
+			"Truncated": truncated,
+		}, "")
+	
+	case models.PreviewCSV:
+		rows, truncated, err := previewCSV(attachment.Content)
+		if err != nil {
+			return utils.NewAppError(fiber.StatusUnprocessableEntity, "Could not read the CSV file", err)
+		}
+		return c.Render("partials/attachment-preview", fiber.Map{
+			"Title":     previewTitle(attachment),
+			"Rows":      rows,
+			"Truncated": truncated,
+		}, "")
+	}
 	
-	if index < 0 || index >= len(email.Attachments) {
-		return utils.NotFoundError("Attachment not found", nil)
+	return utils.NewAppError(fiber.StatusUnsupportedMediaType, "No preview available for this file type", nil)
+}
+
+// sendInline sends content for display in the browser
+func (h *AttachmentHandler) sendInline(c *fiber.Ctx, contentType, filename string, content []byte) error {
+	c.Set("Content-Type", contentType)
+	c.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+	c.Set("Content-Length", fmt.Sprintf("%d", len(content)))
+	
+	return c.Send(content)
+}
+
+// HandleInline serves an inline part referenced from a message's HTML by a
+// cid: URL. Only images are served, as they load from our own origin.
+func (h *AttachmentHandler) HandleInline(c *fiber.Ctx) error {
+	emailID := c.Params("email_id")
+	contentID, err := url.PathUnescape(c.Params("cid"))
+	if emailID == "" || contentID == "" || err != nil {
+		return utils.BadRequestError("Email ID and content ID are required", err)
 	}
 	
-	attachment := email.Attachments[index]
+	folderName := c.Query("folder", "INBOX")
 	
-	// Set headers for inline display
-	c.Set("Content-Type", attachment.ContentType)
-	c.Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", attachment.Filename))
-	c.Set("Content-Length", fmt.Sprintf("%d", len(attachment.Content)))
+	// Get session credentials
+	credentials, err := GetCredentials(c, h.store, h.config.Encryption.Key)
+	if err != nil {
+		return utils.UnauthorizedError("Invalid session", err)
+	}
 	
-	return c.Send(attachment.Content)
+	// Create IMAP client
+	client, err := NewMailClient(credentials, h.config)
+	if err != nil {
+		return utils.InternalServerError("Failed to connect to server", err)
+	}
+	defer client.Close()
+	
+	part, err := client.FetchInlinePart(folderName, emailID, contentID)
+	if err != nil {
+		return utils.NotFoundError("Inline part not found", err)
+	}
+	if !strings.HasPrefix(part.ContentType, "image/") {
+		return utils.NotFoundError("Inline part is not an image", nil)
+	}
+	
+	// Parts of a message never change, so the browser may keep them
+	c.Set("Content-Type", part.ContentType)
+	c.Set("Content-Disposition", "inline")
+	c.Set("Content-Length", fmt.Sprintf("%d", len(part.Content)))
+	c.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	c.Set("X-Content-Type-Options", "nosniff")
+	c.Set("Cache-Control", "private, max-age=86400")
+	
+	return c.Send(part.Content)
 }
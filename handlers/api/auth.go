@@ -9,6 +9,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"lilmail/middleware"
+	"lilmail/models"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -25,6 +27,27 @@ type Claims struct {
 type Credentials struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// JMAPURL is set for accounts read over JMAP. Username is then the JMAP
+	// login; without one the password is sent as a bearer token.
+	JMAPURL  string `json:"jmap_url,omitempty"`
+	Username string `json:"username,omitempty"`
+	// POP3Server is set for accounts downloaded over POP3, which log in
+	// with Username
+	POP3Server    string `json:"pop3_server,omitempty"`
+	POP3Port      int    `json:"pop3_port,omitempty"`
+	LeaveOnServer bool   `json:"leave_on_server,omitempty"`
+	// GraphToken is set for accounts read through Microsoft Graph: the
+	// OAuth refresh token of GraphAccount
+	GraphToken   string `json:"graph_token,omitempty"`
+	GraphAccount string `json:"graph_account,omitempty"`
+	// MaildirUser is set for accounts read from a local Maildir: the user
+	// whose Maildir it is
+	MaildirUser string `json:"maildir_user,omitempty"`
+	// OAuthToken is set for IMAP accounts that log in over XOAUTH2: the
+	// refresh token of the OAuth provider, and OAuthAccount the account
+	// it is saved in, if any
+	OAuthToken   string `json:"oauth_token,omitempty"`
+	OAuthAccount string `json:"oauth_account,omitempty"`
 }
 
 // GenerateToken creates a new JWT token for the user
@@ -66,11 +89,53 @@ func ValidateToken(tokenString, secret string) (*Claims, error) {
 
 // EncryptCredentials encrypts the email and password
 func EncryptCredentials(email, password, key string) (string, error) {
-	creds := Credentials{
-		Email:    email,
-		Password: password,
+	return encryptCredentials(Credentials{Email: email, Password: password}, key)
+}
+
+// EncryptOAuthCredentials encrypts the email and OAuth refresh token of a
+// login over XOAUTH2
+func EncryptOAuthCredentials(email, refreshToken, key string) (string, error) {
+	return encryptCredentials(Credentials{Email: email, OAuthToken: refreshToken}, key)
+}
+
+// EncryptAccountCredentials encrypts the credentials of a saved account
+func EncryptAccountCredentials(account *models.Account, key string) (string, error) {
+	return encryptCredentials(*CredentialsForAccount(account), key)
+}
+
+// CredentialsForAccount returns the credentials of a saved account,
+// including how to reach it over JMAP, POP3, Microsoft Graph or Maildir, or
+// its OAuth sign-in. Everything that connects to a saved account builds its
+// credentials here, so each backend is reached the same way.
+func CredentialsForAccount(account *models.Account) *Credentials {
+	creds := &Credentials{
+		Email:    account.Email,
+		Password: account.Password,
 	}
+	switch {
+	case account.UsesJMAP():
+		creds.JMAPURL = account.JMAPURL
+		creds.Username = account.Username
+	case account.UsesPOP3():
+		creds.POP3Server = account.POP3Server
+		creds.POP3Port = account.POP3Port
+		creds.LeaveOnServer = account.LeaveOnServer
+		creds.Username = account.Username
+	case account.UsesGraph():
+		creds.GraphToken = account.Password
+		creds.GraphAccount = account.ID
+		creds.Password = ""
+	case account.UsesMaildir():
+		creds.MaildirUser = account.Username
+	case account.UsesXOAuth2():
+		creds.OAuthToken = account.Password
+		creds.OAuthAccount = account.ID
+		creds.Password = ""
+	}
+	return creds
+}
 
+func encryptCredentials(creds Credentials, key string) (string, error) {
 	plaintext, err := json.Marshal(creds)
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal credentials: %v", err)
@@ -216,6 +281,23 @@ func SessionMiddleware(store *session.Store) fiber.Handler {
 		if email != nil {
 			c.Locals("email", email)
 		}
+		userID := sess.Get("userId")
+		if userID != nil {
+			c.Locals("userId", userID)
+		}
+		accountID := sess.Get("accountId")
+		if accountID != nil {
+			c.Locals("accountId", accountID)
+		}
+		// The stored language wins over the cookie and header, but not
+		// over an explicit ?lang=
+		if language, _ := sess.Get("language").(string); language != "" && c.Query("lang") == "" {
+			middleware.SetLocale(c, language)
+		}
+		timezone, _ := sess.Get("timezone").(string)
+		c.Locals("timezone", timezone)
+		theme, _ := sess.Get("theme").(string)
+		c.Bind(fiber.Map{"Timezone": timezone, "Theme": theme})
 
 		return c.Next()
 	}
@@ -231,6 +313,12 @@ func GetSessionUser(c *fiber.Ctx) string {
 	return ""
 }
 
+// GetSessionTimezone returns the user's time zone, or "" for server time
+func GetSessionTimezone(c *fiber.Ctx) string {
+	timezone, _ := c.Locals("timezone").(string)
+	return timezone
+}
+
 // GetSessionEmail safely retrieves email from context
 func GetSessionEmail(c *fiber.Ctx) string {
 	if email := c.Locals("email"); email != nil {
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"lilmail/config"
+	"lilmail/utils"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Avatar limits
+const (
+	maxAvatarBytes  = 256 << 10 // Largest picture stored for a sender
+	avatarTimeout   = 5 * time.Second
+	avatarRedirects = 3  // Redirects followed to a picture
+	avatarSize      = 80 // Pixels; avatars are shown at 40 CSS pixels
+)
+
+// avatarColors are the backgrounds of generated initials avatars
+var avatarColors = []string{"#2563eb", "#7c3aed", "#db2777", "#dc2626", "#ea580c", "#16a34a", "#0d9488", "#4b5563"}
+
+// cachedAvatar is a sender's picture as stored on disk. An entry without data
+// records that the sender has no picture, so it isn't looked up every time.
+type cachedAvatar struct {
+	ContentType string    `json:"content_type,omitempty"`
+	Data        []byte    `json:"data,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// avatarSource looks up a picture by a sender's address or domain. It
+// returns nil if there is none there.
+type avatarSource func(key string) (*cachedAvatar, error)
+
+// AvatarHandler serves sender pictures for the email list and viewer. A
+// sender's picture is looked up in each source in turn and cached on disk;
+// senders without one get an avatar with their initials. Brand logos
+// published over BIMI come first where the viewer asks for them.
+type AvatarHandler struct {
+	config  *config.Config
+	client  *http.Client
+	dir     string
+	sources []avatarSource
+}
+
+// NewAvatarHandler creates a new avatar handler
+func NewAvatarHandler(cfg *config.Config) *AvatarHandler {
+	h := &AvatarHandler{
+		config: cfg,
+		client: newPublicClient(avatarTimeout),
+		dir:    filepath.Join(cfg.Cache.Folder, "avatars"),
+	}
+	// BIMI logo URLs come from the sender's DNS, so pictures are only
+	// fetched from public addresses, over a few redirects at most
+	h.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= avatarRedirects {
+			return fmt.Errorf("stopped after %d redirects", avatarRedirects)
+		}
+		return nil
+	}
+	if cfg.Avatars.Gravatar {
+		h.sources = append(h.sources, h.gravatar)
+	}
+	return h
+}
+
+// HandleAvatar serves the picture of the sender in the email query
+// parameter, or an initials avatar made from the name parameter. With bimi=1,
+// which the viewer sets for messages that passed DMARC, the brand logo of the
+// sender's domain is preferred.
+func (h *AvatarHandler) HandleAvatar(c *fiber.Ctx) error {
+	email := strings.ToLower(strings.TrimSpace(c.Query("email")))
+	name := strings.TrimSpace(c.Query("name"))
+
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		var avatar *cachedAvatar
+		if c.Query("bimi") == "1" && h.config.Avatars.BIMI {
+			avatar = h.lookup("bimi:"+email[at+1:], email[at+1:], []avatarSource{h.bimiLogo})
+		}
+		if avatar == nil {
+			avatar = h.lookup(email, email, h.sources)
+		}
+		if avatar != nil {
+			c.Set("Content-Type", avatar.ContentType)
+			c.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+			c.Set("X-Content-Type-Options", "nosniff")
+			c.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(h.cacheTTL().Seconds())))
+			return c.Send(avatar.Data)
+		}
+	}
+
+	c.Set("Content-Type", "image/svg+xml")
+	c.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(h.cacheTTL().Seconds())))
+	return c.SendString(initialsAvatar(email, name))
+}
+
+// lookup returns the picture cached under cacheKey, looking key up in
+// sources again once the cache entry expires. It returns nil if there is no
+// picture.
+func (h *AvatarHandler) lookup(cacheKey, key string, sources []avatarSource) *cachedAvatar {
+	path := h.cachePath(cacheKey)
+	if data, err := os.ReadFile(path); err == nil {
+		var avatar cachedAvatar
+		if json.Unmarshal(data, &avatar) == nil && time.Since(avatar.FetchedAt) < h.cacheTTL() {
+			if len(avatar.Data) == 0 {
+				return nil
+			}
+			return &avatar
+		}
+	}
+
+	found := &cachedAvatar{}
+	for _, source := range sources {
+		avatar, err := source(key)
+		if err != nil {
+			// Try again next time rather than caching a failure
+			utils.Log.Debug("Avatar lookup failed for %s: %v", key, err)
+			return nil
+		}
+		if avatar != nil {
+			found = avatar
+			break
+		}
+	}
+	found.FetchedAt = time.Now()
+
+	if data, err := json.Marshal(found); err == nil {
+		if err := os.MkdirAll(h.dir, 0700); err == nil {
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				utils.Log.Error("Failed to cache avatar: %v", err)
+			}
+		}
+	}
+
+	if len(found.Data) == 0 {
+		return nil
+	}
+	return found
+}
+
+// gravatar looks a sender up on Gravatar
+func (h *AvatarHandler) gravatar(email string) (*cachedAvatar, error) {
+	sum := md5.Sum([]byte(email))
+	target := fmt.Sprintf("https://www.gravatar.com/avatar/%s?s=%d&d=404", hex.EncodeToString(sum[:]), avatarSize)
+	return h.fetchImage(target)
+}
+
+// fetchImage downloads a picture, returning nil if there is none at target
+func (h *AvatarHandler) fetchImage(target string) (*cachedAvatar, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote server returned %s", resp.Status)
+	}
+
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(contentType, "image/") {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAvatarBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAvatarBytes {
+		return nil, nil
+	}
+
+	return &cachedAvatar{ContentType: contentType, Data: data}, nil
+}
+
+// cacheTTL is how long a looked up picture, or the lack of one, is kept
+func (h *AvatarHandler) cacheTTL() time.Duration {
+	days := h.config.Avatars.CacheDays
+	if days <= 0 {
+		days = 7
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// cachePath returns the cache file of a picture
+func (h *AvatarHandler) cachePath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(h.dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// initialsAvatar returns an SVG of the sender's initials on a background
+// color that is the same every time for the same sender
+func initialsAvatar(email, name string) string {
+	key := email
+	if key == "" {
+		key = name
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	color := avatarColors[hash.Sum32()%uint32(len(avatarColors))]
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 40 40">`+
+		`<rect width="40" height="40" fill="%s"/>`+
+		`<text x="50%%" y="50%%" dy=".35em" text-anchor="middle" fill="#fff" font-family="sans-serif" font-size="16">%s</text></svg>`,
+		avatarSize, avatarSize, color, html.EscapeString(avatarInitials(email, name)))
+}
+
+// avatarInitials returns up to two initials from a display name, falling
+// back to the first letter of the address
+func avatarInitials(email, name string) string {
+	var initials []rune
+	for _, word := range strings.Fields(name) {
+		for _, r := range word {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				initials = append(initials, unicode.ToUpper(r))
+				break
+			}
+		}
+	}
+	if len(initials) > 2 {
+		initials = []rune{initials[0], initials[len(initials)-1]}
+	}
+	if len(initials) > 0 {
+		return string(initials)
+	}
+
+	for _, r := range email {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return string(unicode.ToUpper(r))
+		}
+	}
+	return "?"
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"lilmail/models"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// maxBIMILogoBytes is the largest brand logo accepted; the BIMI SVG profile
+// recommends logos stay under 32KB
+const maxBIMILogoBytes = 32 << 10
+
+// bimiLogo looks up the brand logo a domain publishes over BIMI. Like mail
+// clients that show BIMI logos, it requires the domain's DMARC policy to
+// quarantine or reject mail that fails, so the logo can't be borrowed by
+// mail the domain didn't send. Mark certificates (the a= tag) are not checked.
+func (h *AvatarHandler) bimiLogo(domain string) (*cachedAvatar, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), avatarTimeout)
+	defer cancel()
+
+	enforced, err := dmarcEnforced(ctx, domain)
+	if err != nil || !enforced {
+		return nil, err
+	}
+
+	record, _, err := lookupTagRecord(ctx, "default._bimi.", domain, "v=BIMI1")
+	if err != nil || record == nil {
+		return nil, err
+	}
+
+	logo, err := url.Parse(record["l"])
+	if err != nil || logo.Scheme != "https" || logo.Host == "" {
+		// An empty l= tag means the domain declines to show a logo
+		return nil, nil
+	}
+
+	avatar, err := h.fetchImage(logo.String())
+	if err != nil || avatar == nil {
+		return nil, err
+	}
+	if len(avatar.Data) > maxBIMILogoBytes || !bytes.Contains(avatar.Data, []byte("<svg")) {
+		return nil, nil
+	}
+	avatar.ContentType = "image/svg+xml"
+	return avatar, nil
+}
+
+// dmarcEnforced reports whether a domain's DMARC policy quarantines or
+// rejects all mail failing DMARC
+func dmarcEnforced(ctx context.Context, domain string) (bool, error) {
+	record, inherited, err := lookupTagRecord(ctx, "_dmarc.", domain, "v=DMARC1")
+	if err != nil || record == nil {
+		return false, err
+	}
+
+	// Subdomains without a record of their own follow the sp= policy
+	policy := strings.ToLower(record["p"])
+	if inherited && record["sp"] != "" {
+		policy = strings.ToLower(record["sp"])
+	}
+	if pct := record["pct"]; pct != "" && pct != "100" {
+		return false, nil
+	}
+	return policy == "quarantine" || policy == "reject", nil
+}
+
+// lookupTagRecord returns the tags of the TXT record at prefix+domain whose
+// version tag is version, falling back to the organizational domain, and
+// whether it came from there. It returns nil if neither has one.
+func lookupTagRecord(ctx context.Context, prefix, domain, version string) (map[string]string, bool, error) {
+	domains := []string{domain}
+	if org := organizationalDomain(domain); org != domain {
+		domains = append(domains, org)
+	}
+
+	for i, name := range domains {
+		records, err := net.DefaultResolver.LookupTXT(ctx, prefix+name)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				continue
+			}
+			return nil, false, fmt.Errorf("error looking up %s%s: %v", prefix, name, err)
+		}
+		for _, record := range records {
+			tags := parseTagList(record)
+			if strings.EqualFold("v="+tags["v"], version) {
+				return tags, i > 0, nil
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+// parseTagList parses a DNS tag list like "v=BIMI1; l=https://..." into a
+// map of lower case tag names to values
+func parseTagList(record string) map[string]string {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(record, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	return tags
+}
+
+// organizationalDomain approximates the registered domain of a host by its
+// last two labels, or three where the second to last is a common second
+// level like co.uk or co.jp
+func organizationalDomain(domain string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(domain), "."), ".")
+	n := 2
+	if len(labels) > 2 {
+		switch labels[len(labels)-2] {
+		case "co", "com", "ne", "or", "ac", "go", "org", "net", "gov", "edu":
+			if len(labels[len(labels)-1]) == 2 {
+				n = 3
+			}
+		}
+	}
+	if len(labels) <= n {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// DMARCPass reports whether the receiving server recorded that a message
+// passed DMARC for the domain of its From address. Only the topmost
+// Authentication-Results header is trusted, as the one the user's own server
+// added; the ones below it could have been written by the sender.
+func DMARCPass(headers *models.MessageHeaders, from string) bool {
+	at := strings.LastIndex(from, "@")
+	if headers == nil || at < 0 {
+		return false
+	}
+	domain := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(from[at+1:]), ">"))
+
+	for _, field := range headers.Headers {
+		if !strings.EqualFold(field.Name, "Authentication-Results") {
+			continue
+		}
+		for _, result := range strings.Split(field.Value, ";") {
+			words := strings.Fields(strings.ToLower(result))
+			if len(words) == 0 || words[0] != "dmarc=pass" {
+				continue
+			}
+			for _, word := range words[1:] {
+				if value, ok := strings.CutPrefix(word, "header.from="); ok && value == domain {
+					return true
+				}
+			}
+		}
+		// Only the topmost header counts
+		return false
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"lilmail/models"
+	"lilmail/utils"
+)
+
+// blockSenders junks or deletes new INBOX messages from the user's blocked
+// senders and returns the remaining ones
+func blockSenders(client MailClient, userID string, settings *models.UserSettings, emails []models.Email) []models.Email {
+	if len(settings.BlockedSenders) == 0 {
+		return emails
+	}
+
+	var junk string
+	var remaining []models.Email
+	for _, email := range emails {
+		blocked := settings.BlockedSenderFor(email.From)
+		if blocked == nil {
+			remaining = append(remaining, email)
+			continue
+		}
+
+		if err := ApplyBlock(client, blocked, "INBOX", email.ID, &junk); err != nil {
+			utils.Log.Error("Blocked senders: failed to %s %s for %s: %v", blocked.Action, email.ID, userID, err)
+			remaining = append(remaining, email)
+		}
+	}
+	return remaining
+}
+
+// ApplyBlock junks or deletes a message as a blocked sender rule says. The
+// Junk folder is looked up once and kept in junk for further messages.
+func ApplyBlock(client MailClient, blocked *models.BlockedSender, folder, uid string, junk *string) error {
+	if blocked.Action == models.BlockActionDelete {
+		return client.DeleteMessage(folder, uid)
+	}
+
+	if *junk == "" {
+		var err error
+		if *junk, err = JunkFolder(client); err != nil {
+			return err
+		}
+	}
+	if folder == *junk {
+		return nil
+	}
+	return client.MoveMessage(folder, *junk, uid)
+}
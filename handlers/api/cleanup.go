@@ -0,0 +1,316 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"lilmail/config"
+	"lilmail/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// cleanupBatchSize is how many messages are moved or deleted per command
+	cleanupBatchSize = 100
+	// cleanupPreviewSize is how many of the matching messages a preview shows
+	cleanupPreviewSize = 50
+	// maxCleanupSenders caps the senders one cleanup matches
+	maxCleanupSenders = 20
+)
+
+// Cleanup actions
+const (
+	CleanupDelete  = "delete"
+	CleanupArchive = "archive"
+)
+
+// CleanupHandler finds old, large or unwanted messages in bulk and deletes
+// or archives them
+type CleanupHandler struct {
+	store  *session.Store
+	config *config.Config
+}
+
+// NewCleanupHandler creates a new cleanup handler
+func NewCleanupHandler(store *session.Store, cfg *config.Config) *CleanupHandler {
+	return &CleanupHandler{
+		store:  store,
+		config: cfg,
+	}
+}
+
+// CleanupRequest picks the messages of a folder to clean up. Messages must
+// match every criterion given; senders match if any of them does.
+type CleanupRequest struct {
+	Folder         string   `json:"folder"`
+	OlderThanYears int      `json:"older_than_years"`
+	LargerThanMB   int      `json:"larger_than_mb"`
+	Senders        []string `json:"senders"` // Addresses, or domains as @example.com
+	Action         string   `json:"action"`  // For runs: delete or archive
+}
+
+// CleanupProgress is an event of a cleanup run
+type CleanupProgress struct {
+	Total    int    `json:"total"`
+	Done     int    `json:"done"`
+	Failed   int    `json:"failed"`
+	Finished bool   `json:"finished"`
+	Error    string `json:"error,omitempty"`
+}
+
+// batchChanger is a client that moves and deletes many messages with one
+// command, as IMAP does with UID sets. Other clients change them one by one.
+type batchChanger interface {
+	MoveMessages(sourceFolder, targetFolder string, uids []uint32) error
+	DeleteMessages(folderName string, uids []uint32) error
+}
+
+// criteria returns the search for the request's messages, or an error if it
+// has no criteria, which would match the whole folder
+func (r *CleanupRequest) criteria() (*imap.SearchCriteria, error) {
+	criteria := imap.NewSearchCriteria()
+	matched := false
+
+	if r.OlderThanYears > 0 {
+		criteria.Before = time.Now().AddDate(-r.OlderThanYears, 0, 0)
+		matched = true
+	}
+	if r.LargerThanMB > 0 {
+		criteria.Larger = uint32(r.LargerThanMB) << 20
+		matched = true
+	}
+
+	var senders []*imap.SearchCriteria
+	for _, sender := range r.Senders {
+		if sender = strings.TrimSpace(sender); sender != "" {
+			from := imap.NewSearchCriteria()
+			from.Header.Add("From", sender)
+			senders = append(senders, from)
+		}
+	}
+	if len(senders) > maxCleanupSenders {
+		return nil, fmt.Errorf("at most %d senders can be given", maxCleanupSenders)
+	}
+	if len(senders) > 0 {
+		if len(senders) == 1 {
+			criteria.Header = senders[0].Header
+		} else {
+			criteria.Or = anyOf(senders).Or
+		}
+		matched = true
+	}
+
+	if !matched {
+		return nil, fmt.Errorf("an age, a size or a sender is required")
+	}
+	return criteria, nil
+}
+
+// anyOf joins search criteria with OR
+func anyOf(criteria []*imap.SearchCriteria) *imap.SearchCriteria {
+	if len(criteria) == 1 {
+		return criteria[0]
+	}
+	return &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{criteria[0], anyOf(criteria[1:])}}}
+}
+
+// search reads a cleanup request, connects to the mail server and finds the
+// request's messages. Errors are fiber errors with the status to answer with.
+func (h *CleanupHandler) search(c *fiber.Ctx, run bool) (*CleanupRequest, MailClient, []uint32, error) {
+	var req CleanupRequest
+	if err := c.BodyParser(&req); err != nil {
+		return nil, nil, nil, fiber.NewError(400, "Invalid request")
+	}
+	if req.Folder == "" {
+		req.Folder = "INBOX"
+	}
+	if run && req.Action != CleanupDelete && req.Action != CleanupArchive {
+		return nil, nil, nil, fiber.NewError(400, "Action must be delete or archive")
+	}
+	criteria, err := req.criteria()
+	if err != nil {
+		return nil, nil, nil, fiber.NewError(400, err.Error())
+	}
+
+	client, err := h.connect(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	uids, err := client.SearchUIDs(req.Folder, criteria)
+	if err != nil {
+		client.Close()
+		return nil, nil, nil, fiber.NewError(500, "Search failed: "+err.Error())
+	}
+	return &req, client, uids, nil
+}
+
+// connect opens the mail account of the session
+func (h *CleanupHandler) connect(c *fiber.Ctx) (MailClient, error) {
+	// Get session credentials
+	credentials, err := GetCredentials(c, h.store, h.config.Encryption.Key)
+	if err != nil {
+		return nil, fiber.NewError(401, "Invalid session")
+	}
+
+	client, err := NewMailClient(credentials, h.config)
+	if err != nil {
+		return nil, fiber.NewError(500, "Failed to connect to email server")
+	}
+	return client, nil
+}
+
+// cleanupError answers a request that failed before any message was changed
+func cleanupError(c *fiber.Ctx, err error) error {
+	code := 500
+	if e, ok := err.(*fiber.Error); ok {
+		code = e.Code
+	}
+	return c.Status(code).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
+
+// Preview returns how many messages a cleanup would change and the newest
+// of them, so the user can check the criteria before running it
+func (h *CleanupHandler) Preview(c *fiber.Ctx) error {
+	req, client, uids, err := h.search(c, false)
+	if err != nil {
+		return cleanupError(c, err)
+	}
+	defer client.Close()
+
+	sample := uids
+	if len(sample) > cleanupPreviewSize {
+		sample = sample[len(sample)-cleanupPreviewSize:]
+	}
+	messages, err := client.FetchMessagesByUIDs(req.Folder, sample)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch messages",
+		})
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Date.After(messages[j].Date)
+	})
+
+	return c.JSON(fiber.Map{
+		"total":    len(uids),
+		"messages": messages,
+	})
+}
+
+// Run deletes or archives the messages matching a cleanup request in
+// batches. The response is a stream of server-sent events reporting the
+// progress after every batch; the run stops if the client goes away.
+func (h *CleanupHandler) Run(c *fiber.Ctx) error {
+	req, client, uids, err := h.search(c, true)
+	if err != nil {
+		return cleanupError(c, err)
+	}
+
+	var archive string
+	if req.Action == CleanupArchive {
+		if archive, err = client.ArchiveFolder(); err != nil {
+			client.Close()
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to find the archive folder",
+			})
+		}
+		if archive == req.Folder {
+			client.Close()
+			return c.Status(400).JSON(fiber.Map{
+				"error": "The messages are already in the archive folder",
+			})
+		}
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("Transfer-Encoding", "chunked")
+
+	// The stream writer runs after this handler returns
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer client.Close()
+
+		progress := CleanupProgress{Total: len(uids)}
+		if !writeCleanupProgress(w, progress) {
+			return
+		}
+
+		for start := 0; start < len(uids); start += cleanupBatchSize {
+			end := start + cleanupBatchSize
+			if end > len(uids) {
+				end = len(uids)
+			}
+			batch := uids[start:end]
+
+			done, err := cleanupBatch(client, req, archive, batch)
+			progress.Done += done
+			progress.Failed += len(batch) - done
+			if err != nil {
+				utils.Log.Warn("Cleanup of %s failed for %d messages: %v", req.Folder, len(batch)-done, err)
+				progress.Error = err.Error()
+			}
+			if !writeCleanupProgress(w, progress) {
+				return
+			}
+		}
+
+		progress.Finished = true
+		writeCleanupProgress(w, progress)
+	}))
+
+	return nil
+}
+
+// cleanupBatch deletes or archives a batch of messages and returns how many
+// were changed
+func cleanupBatch(client MailClient, req *CleanupRequest, archive string, uids []uint32) (int, error) {
+	if batch, ok := client.(batchChanger); ok {
+		var err error
+		if req.Action == CleanupArchive {
+			err = batch.MoveMessages(req.Folder, archive, uids)
+		} else {
+			err = batch.DeleteMessages(req.Folder, uids)
+		}
+		if err != nil {
+			return 0, err
+		}
+		return len(uids), nil
+	}
+
+	done := 0
+	var lastErr error
+	for _, uid := range uids {
+		var err error
+		if req.Action == CleanupArchive {
+			err = client.MoveMessage(req.Folder, archive, strconv.FormatUint(uint64(uid), 10))
+		} else {
+			err = client.DeleteMessage(req.Folder, strconv.FormatUint(uint64(uid), 10))
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		done++
+	}
+	return done, lastErr
+}
+
+// writeCleanupProgress sends a progress event, reporting false once the
+// client has gone away
+func writeCleanupProgress(w *bufio.Writer, progress CleanupProgress) bool {
+	data, _ := json.Marshal(progress)
+	w.WriteString("data: " + string(data) + "\n\n")
+	return w.Flush() == nil
+}
@@ -2,8 +2,12 @@
 package api
 
 import (
+	"bytes"
 	"fmt"
+	"lilmail/models"
 	"log"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,9 +21,17 @@ type Client struct {
 	username string // Add username field
 }
 
+// imapDialTimeout bounds connecting to servers users chose
+const imapDialTimeout = 30 * time.Second
+
 // NewClient creates a new IMAP client
 func NewClient(server string, port int, email, password string) (*Client, error) {
-	c, err := client.DialTLS(fmt.Sprintf("%s:%d", server, port), nil)
+	return newClientWithDialer(new(net.Dialer), server, port, email, password)
+}
+
+// newClientWithDialer creates a new IMAP client that connects with dialer
+func newClientWithDialer(dialer client.Dialer, server string, port int, email, password string) (*Client, error) {
+	c, err := client.DialWithDialerTLS(dialer, fmt.Sprintf("%s:%d", server, port), nil)
 	if err != nil {
 		log.Printf("DialTLS %s:%d connection err: %v", server, port, err)
 		return nil, fmt.Errorf("connection error: %v", err)
@@ -35,6 +47,25 @@ func NewClient(server string, port int, email, password string) (*Client, error)
 	return &Client{client: c, username: email}, nil
 }
 
+// NewXOAuth2Client creates a new IMAP client that logs in over XOAUTH2 with
+// an OAuth access token instead of a password
+func NewXOAuth2Client(server string, port int, email, accessToken string) (*Client, error) {
+	c, err := client.DialTLS(fmt.Sprintf("%s:%d", server, port), nil)
+	if err != nil {
+		log.Printf("DialTLS %s:%d connection err: %v", server, port, err)
+		return nil, fmt.Errorf("connection error: %v", err)
+	}
+
+	err = c.Authenticate(&xoauth2Client{username: email, accessToken: accessToken})
+	if err != nil {
+		c.Logout()
+		log.Printf("IMAP XOAUTH2 %s login err: %v", email, err)
+		return nil, fmt.Errorf("login error: %v", err)
+	}
+
+	return &Client{client: c, username: email}, nil
+}
+
 // Close closes the IMAP connection
 func (c *Client) Close() error {
 	return c.client.Logout()
@@ -70,6 +101,125 @@ func (c *Client) SelectFolder(folderName string, readOnly bool) (*imap.MailboxSt
 	return c.client.Select(folderName, readOnly)
 }
 
+// MailboxStatus returns the message count, UIDNEXT and UIDVALIDITY of a folder
+// without selecting it
+func (c *Client) MailboxStatus(folderName string) (*imap.MailboxStatus, error) {
+	items := []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity, imap.StatusUnseen}
+	status, err := c.client.Status(folderName, items)
+	if err != nil {
+		return nil, fmt.Errorf("error getting status of %s: %v", folderName, err)
+	}
+	return status, nil
+}
+
+// UnreadCounts returns the number of unseen messages in every selectable folder
+func (c *Client) UnreadCounts() (map[string]uint32, error) {
+	folders, err := c.FetchFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]uint32, len(folders))
+	for _, folder := range folders {
+		selectable := true
+		for _, attr := range folder.Attributes {
+			if attr == imap.NoSelectAttr {
+				selectable = false
+				break
+			}
+		}
+		if !selectable {
+			continue
+		}
+
+		status, err := c.client.Status(folder.Name, []imap.StatusItem{imap.StatusUnseen})
+		if err != nil {
+			return nil, fmt.Errorf("error getting status of %s: %v", folder.Name, err)
+		}
+		counts[folder.Name] = status.Unseen
+	}
+	return counts, nil
+}
+
+// FolderUsage returns the size of a folder: its message counts from STATUS,
+// and the sizes of its messages and of their attachments from RFC822.SIZE
+// and BODYSTRUCTURE
+func (c *Client) FolderUsage(folderName string) (*models.FolderUsage, error) {
+	status, err := c.client.Status(folderName, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+	if err != nil {
+		return nil, fmt.Errorf("error getting status of %s: %v", folderName, err)
+	}
+
+	usage := &models.FolderUsage{Folder: folderName, Messages: status.Messages, Unseen: status.Unseen}
+	if status.Messages == 0 {
+		return usage, nil
+	}
+
+	if _, err := c.client.Select(folderName, true); err != nil {
+		return nil, fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 0)
+
+	messages := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.client.Fetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size, imap.FetchBodyStructure}, messages)
+	}()
+
+	sizes := make(map[uint32]int64)
+	for msg := range messages {
+		sizes[msg.Uid] = int64(msg.Size)
+		usage.Bytes += int64(msg.Size)
+
+		// Inline images take up space just as attachments do
+		parts, inline := findAttachmentParts(msg.BodyStructure)
+		for _, part := range parts {
+			usage.AttachmentBytes += int64(part.structure.Size)
+		}
+		for _, part := range inline {
+			usage.AttachmentBytes += int64(part.structure.Size)
+		}
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+
+	usage.Largest = largestMessages(folderName, sizes)
+	return usage, nil
+}
+
+// statusHighestModSeq is the CONDSTORE status item (RFC 7162)
+const statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+
+// MailboxState returns the change markers of a folder. HIGHESTMODSEQ is only
+// requested from servers that advertise CONDSTORE and is zero otherwise.
+func (c *Client) MailboxState(folderName string) (*models.MailboxState, error) {
+	items := []imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext, imap.StatusMessages}
+	condstore, _ := c.client.Support("CONDSTORE")
+	if condstore {
+		items = append(items, statusHighestModSeq)
+	}
+
+	status, err := c.client.Status(folderName, items)
+	if err != nil {
+		return nil, fmt.Errorf("error getting status of %s: %v", folderName, err)
+	}
+
+	state := &models.MailboxState{
+		UIDValidity: status.UidValidity,
+		UIDNext:     status.UidNext,
+		Messages:    status.Messages,
+	}
+	if raw, ok := status.Items[statusHighestModSeq]; ok && raw != nil {
+		state.HighestModSeq, _ = strconv.ParseUint(fmt.Sprint(raw), 10, 64)
+	}
+	return state, nil
+}
+
 type MailboxInfo struct {
 	Attributes  []string `json:"attributes"`
 	Delimiter   string   `json:"delimiter"`
@@ -118,11 +268,46 @@ func (c *Client) SaveToSent(to, subject, body string) error {
 	return c.client.Append(selectedFolder, nil, time.Now(), strings.NewReader(message))
 }
 
+// AppendMessage stores a raw message in a folder with the given flags
+func (c *Client) AppendMessage(folderName string, message []byte, flags []string) error {
+	if err := c.client.Append(folderName, flags, time.Now(), bytes.NewReader(message)); err != nil {
+		return fmt.Errorf("error appending message to %s: %v", folderName, err)
+	}
+	return nil
+}
+
 // CreateFolder creates a new IMAP folder
 func (c *Client) CreateFolder(folderName string) error {
 	return c.client.Create(folderName)
 }
 
+// ArchiveFolder returns the folder archived mail goes to: the SPECIAL-USE
+// \Archive folder if the server marks one, else "Archive", created if needed
+func (c *Client) ArchiveFolder() (string, error) {
+	folders, err := c.FetchFolders()
+	if err != nil {
+		return "", err
+	}
+
+	for _, folder := range folders {
+		for _, attr := range folder.Attributes {
+			if attr == imap.ArchiveAttr {
+				return folder.Name, nil
+			}
+		}
+	}
+	for _, folder := range folders {
+		if strings.EqualFold(folder.Name, "Archive") {
+			return folder.Name, nil
+		}
+	}
+
+	if err := c.CreateFolder("Archive"); err != nil {
+		return "", fmt.Errorf("error creating Archive folder: %v", err)
+	}
+	return "Archive", nil
+}
+
 // DeleteFolder deletes an IMAP folder
 func (c *Client) DeleteFolder(folderName string) error {
 	return c.client.Delete(folderName)
@@ -138,6 +323,19 @@ func (c *Client) Search(criteria *imap.SearchCriteria) ([]uint32, error) {
 	return c.client.Search(criteria)
 }
 
+// SearchUIDs returns the UIDs of the messages in a folder matching criteria
+func (c *Client) SearchUIDs(folderName string, criteria *imap.SearchCriteria) ([]uint32, error) {
+	if _, err := c.client.Select(folderName, true); err != nil {
+		return nil, fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+
+	uids, err := c.client.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %v", err)
+	}
+	return uids, nil
+}
+
 // RenameFolder renames an IMAP folder
 func (c *Client) RenameFolder(oldName, newName string) error {
 	return c.client.Rename(oldName, newName)
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"fmt"
+	"lilmail/models"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// ContactTimelineLimit caps the messages of a correspondence timeline, and
+// the messages taken from each folder for it
+const ContactTimelineLimit = 200
+
+// ContactTimeline returns the messages exchanged with an address in every
+// folder, newest first: mail from it and mail to or copied to it. A message
+// with copies in several folders is listed once, with its locations.
+func ContactTimeline(client MailClient, address string) ([]models.Email, error) {
+	address = strings.TrimSpace(address)
+	if address == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+
+	var fields []*imap.SearchCriteria
+	for _, key := range []string{"From", "To", "Cc"} {
+		field := imap.NewSearchCriteria()
+		field.Header.Add(key, address)
+		fields = append(fields, field)
+	}
+	criteria := anyOf(fields)
+
+	folders, err := searchFolders(client)
+	if err != nil {
+		return nil, err
+	}
+
+	var hits []searchHit
+	for _, folder := range folders {
+		uids, err := client.SearchUIDs(folder, criteria)
+		if err != nil {
+			return nil, fmt.Errorf("search failed in %s: %v", folder, err)
+		}
+
+		// Newest first
+		sort.Slice(uids, func(i, j int) bool { return uids[i] > uids[j] })
+		if len(uids) > ContactTimelineLimit {
+			uids = uids[:ContactTimelineLimit]
+		}
+		for _, uid := range uids {
+			hits = append(hits, searchHit{Folder: folder, UID: uid})
+		}
+	}
+	if len(hits) == 0 {
+		return []models.Email{}, nil
+	}
+
+	if hits, err = collapseDuplicates(client, hits); err != nil {
+		return nil, err
+	}
+	emails, err := fetchSearchHits(client, hits)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].Date.After(emails[j].Date)
+	})
+	if len(emails) > ContactTimelineLimit {
+		emails = emails[:ContactTimelineLimit]
+	}
+	return emails, nil
+}
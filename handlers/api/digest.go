@@ -0,0 +1,310 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"lilmail/config"
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// digestCheckInterval is how often the scheduler looks for due digests
+	digestCheckInterval = 10 * time.Minute
+	// digestMaxMessages caps each section of a digest
+	digestMaxMessages = 20
+)
+
+// digestTemplate is the HTML body of a digest email
+var digestTemplate = template.Must(template.New("digest").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #1f2937;">
+<h2>Your {{.Frequency}} LilMail digest</h2>
+<p>You have {{.UnreadTotal}} unread and {{.StarredTotal}} starred messages in your inbox.</p>
+{{if .Unread}}
+<h3>Unread</h3>
+<ul>
+{{range .Unread}}<li><strong>{{if .FromName}}{{.FromName}}{{else}}{{.From}}{{end}}</strong> &mdash; {{.Subject}} <span style="color: #6b7280;">({{.Date.Format "Jan 2 15:04"}})</span></li>
+{{end}}
+</ul>
+{{end}}
+{{if .Starred}}
+<h3>Starred</h3>
+<ul>
+{{range .Starred}}<li><strong>{{if .FromName}}{{.FromName}}{{else}}{{.From}}{{end}}</strong> &mdash; {{.Subject}}</li>
+{{end}}
+</ul>
+{{end}}
+<p><a href="{{.AppURL}}/inbox">Open LilMail</a></p>
+<p style="font-size: 12px; color: #6b7280;">
+You receive this email because digests are enabled in your LilMail settings.
+<a href="{{.UnsubscribeURL}}">Unsubscribe</a>
+</p>
+</body>
+</html>`))
+
+// DigestScheduler emails users a periodic summary of their unread and
+// starred messages, following the schedule in their settings
+type DigestScheduler struct {
+	config   *config.Config
+	users    *storage.UserStorage
+	accounts *storage.AccountStorage
+	settings *storage.SettingsStorage
+	notify   *NotificationHandler
+}
+
+// NewDigestScheduler creates a new digest scheduler
+func NewDigestScheduler(cfg *config.Config, users *storage.UserStorage, accounts *storage.AccountStorage, settings *storage.SettingsStorage, notify *NotificationHandler) *DigestScheduler {
+	return &DigestScheduler{
+		config:   cfg,
+		users:    users,
+		accounts: accounts,
+		settings: settings,
+		notify:   notify,
+	}
+}
+
+// Start runs the scheduler in the background if digests are enabled
+func (d *DigestScheduler) Start() {
+	if !d.config.Digest.Enabled {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(digestCheckInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			d.sendDue(time.Now())
+		}
+	}()
+
+	utils.Log.Info("Digest scheduler started")
+}
+
+// sendDue sends every digest that is due at now
+func (d *DigestScheduler) sendDue(now time.Time) {
+	all, err := d.settings.ListSettings()
+	if err != nil {
+		utils.Log.Error("Digest: failed to list settings: %v", err)
+		return
+	}
+
+	for _, settings := range all {
+		if !digestDue(settings, d.timezoneOf(settings.UserID), now) {
+			continue
+		}
+
+		// A failed send waits for the next slot rather than retrying
+		// every check
+		if err := d.sendDigest(settings); err != nil {
+			utils.Log.Error("Digest: failed for %s: %v", settings.UserID, err)
+			settings.DigestFailedAt = now
+		} else {
+			settings.LastDigestAt = now
+		}
+		if err := d.settings.SaveSettings(settings); err != nil {
+			utils.Log.Error("Digest: failed to save schedule for %s: %v", settings.UserID, err)
+		}
+	}
+}
+
+// timezoneOf returns the time zone of a user, or "" for server time
+func (d *DigestScheduler) timezoneOf(username string) string {
+	user, err := d.users.GetUserByUsername(username)
+	if err != nil {
+		return ""
+	}
+	return user.Timezone
+}
+
+// digestDue reports whether a user's digest should be sent at now, with
+// the send hour taken in the named time zone
+func digestDue(settings *models.UserSettings, timezone string, now time.Time) bool {
+	var interval time.Duration
+	switch settings.DigestFrequency {
+	case "daily":
+		interval = 24 * time.Hour
+	case "weekly":
+		interval = 7 * 24 * time.Hour
+	default:
+		return false
+	}
+
+	if utils.InTimezone(now, timezone).Hour() < settings.DigestHour {
+		return false
+	}
+
+	// A failed attempt counts for its slot too
+	last := settings.LastDigestAt
+	if settings.DigestFailedAt.After(last) {
+		last = settings.DigestFailedAt
+	}
+	// Allow some slack so the send time doesn't creep forward each period
+	return now.Sub(last) >= interval-time.Hour
+}
+
+// sendDigest collects the user's unread and starred INBOX messages and emails them a summary
+func (d *DigestScheduler) sendDigest(settings *models.UserSettings) error {
+	username := settings.UserID
+
+	creds, err := d.credentialsFor(username)
+	if err != nil {
+		return err
+	}
+
+	// Digests are read and sent the way the Mailer sends users' mail
+	client, err := NewMailBackend(creds, d.config, d.config.SMTP.Server, d.config.SMTP.GetPort())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	unreadCriteria := imap.NewSearchCriteria()
+	unreadCriteria.WithoutFlags = []string{imap.SeenFlag}
+	unread, unreadTotal, err := searchRecent(client, "INBOX", unreadCriteria, digestMaxMessages)
+	if err != nil {
+		return err
+	}
+
+	starredCriteria := imap.NewSearchCriteria()
+	starredCriteria.WithFlags = []string{imap.FlaggedFlag}
+	starred, starredTotal, err := searchRecent(client, "INBOX", starredCriteria, digestMaxMessages)
+	if err != nil {
+		return err
+	}
+
+	// Nothing worth an email
+	if unreadTotal == 0 && starredTotal == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	err = digestTemplate.Execute(&body, map[string]interface{}{
+		"Frequency":      settings.DigestFrequency,
+		"Unread":         unread,
+		"UnreadTotal":    unreadTotal,
+		"Starred":        starred,
+		"StarredTotal":   starredTotal,
+		"AppURL":         d.config.PublicURL(),
+		"UnsubscribeURL": d.UnsubscribeURL(username),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to render digest: %v", err)
+	}
+
+	subject := fmt.Sprintf("LilMail digest: %d unread, %d starred", unreadTotal, starredTotal)
+	if err := client.SendMail(creds.Email, "", "", subject, body.String(), true, nil); err != nil {
+		return err
+	}
+
+	d.notify.SendNotification(username, Notification{
+		Type:    "digest",
+		Message: "Digest sent",
+		Data: map[string]interface{}{
+			"unread":  unreadTotal,
+			"starred": starredTotal,
+		},
+	})
+	return nil
+}
+
+// credentialsFor returns the mail credentials of the user's default account
+func (d *DigestScheduler) credentialsFor(username string) (*Credentials, error) {
+	user, err := d.users.GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := d.accounts.GetAccountsByUser(user.ID, []byte(d.config.Encryption.Key))
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("no mail account")
+	}
+
+	account := accounts[0]
+	for _, acc := range accounts {
+		if acc.IsDefault {
+			account = acc
+			break
+		}
+	}
+	return CredentialsForAccount(account), nil
+}
+
+// UnsubscribeURL returns the signed link that turns off a user's digest
+func (d *DigestScheduler) UnsubscribeURL(username string) string {
+	params := url.Values{}
+	params.Set("user", username)
+	params.Set("token", d.unsubscribeToken(username))
+	return d.config.PublicURL() + "/digest/unsubscribe?" + params.Encode()
+}
+
+// unsubscribeToken signs a username so unsubscribe links can't be forged
+func (d *DigestScheduler) unsubscribeToken(username string) string {
+	mac := hmac.New(sha256.New, []byte(d.config.JWT.Secret))
+	mac.Write([]byte("digest-unsubscribe:" + username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HandleUnsubscribe turns off digests for the user named in a signed link.
+// It doesn't require a session so it works straight from the email.
+func (d *DigestScheduler) HandleUnsubscribe(c *fiber.Ctx) error {
+	username := c.Query("user")
+	token := c.Query("token")
+	if username == "" || subtle.ConstantTimeCompare([]byte(token), []byte(d.unsubscribeToken(username))) != 1 {
+		return c.Status(400).SendString("Invalid unsubscribe link")
+	}
+
+	settings, err := d.settings.GetSettings(username)
+	if err != nil {
+		return c.Status(500).SendString("Failed to load settings")
+	}
+
+	settings.DigestFrequency = "off"
+	if err := d.settings.SaveSettings(settings); err != nil {
+		return c.Status(500).SendString("Failed to save settings")
+	}
+
+	return c.SendString("You have been unsubscribed from LilMail digest emails.")
+}
+
+// searchRecent returns up to limit of the newest messages in a folder
+// matching criteria, along with the total number of matches
+func searchRecent(c MailClient, folderName string, criteria *imap.SearchCriteria, limit int) ([]models.Email, int, error) {
+	uids, err := c.SearchUIDs(folderName, criteria)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := len(uids)
+	if total == 0 {
+		return nil, 0, nil
+	}
+
+	sort.Slice(uids, func(i, j int) bool { return uids[i] > uids[j] })
+	if len(uids) > limit {
+		uids = uids[:limit]
+	}
+
+	emails, err := c.FetchMessagesByUIDs(folderName, uids)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(emails, func(i, j int) bool { return emails[i].Date.After(emails[j].Date) })
+
+	return emails, total, nil
+}
@@ -1,8 +1,10 @@
 package api
 
 import (
+	"fmt"
 	"lilmail/models"
 	"lilmail/storage"
+	"lilmail/utils"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
@@ -12,26 +14,43 @@ import (
 type DraftHandler struct {
 	store        *session.Store
 	draftStorage *storage.DraftStorage
+	userStorage  *storage.UserStorage
+	system       *storage.SystemSettingsStorage
+	links        *LargeFileHandler // nil when large file links are off
 }
 
 // NewDraftHandler creates a new draft handler
-func NewDraftHandler(store *session.Store, draftStorage *storage.DraftStorage) *DraftHandler {
+func NewDraftHandler(store *session.Store, draftStorage *storage.DraftStorage, userStorage *storage.UserStorage, systemSettings *storage.SystemSettingsStorage, links *LargeFileHandler) *DraftHandler {
 	return &DraftHandler{
 		store:        store,
 		draftStorage: draftStorage,
+		userStorage:  userStorage,
+		system:       systemSettings,
+		links:        links,
 	}
 }
 
-// SaveDraft saves or updates a draft
-func (h *DraftHandler) SaveDraft(c *fiber.Ctx) error {
+// getDraftOwner resolves the user and active account that drafts are stored under
+func (h *DraftHandler) getDraftOwner(c *fiber.Ctx) (string, string, error) {
 	sess, err := h.store.Get(c)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Session error"})
+		return "", "", utils.InternalServerError("Session error", err)
+	}
+
+	userID, _ := sess.Get("userId").(string)
+	if userID == "" {
+		return "", "", utils.UnauthorizedError("Unauthorized", nil)
 	}
 
-	userID := sess.Get("user_id")
-	if userID == nil {
-		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	accountID, _ := sess.Get("accountId").(string)
+	return userID, accountID, nil
+}
+
+// SaveDraft saves or updates a draft
+func (h *DraftHandler) SaveDraft(c *fiber.Ctx) error {
+	userID, accountID, err := h.getDraftOwner(c)
+	if err != nil {
+		return err
 	}
 
 	// Parse request
@@ -59,8 +78,13 @@ func (h *DraftHandler) SaveDraft(c *fiber.Ctx) error {
 		IsHTML:  req.IsHTML,
 	}
 
+	// Enforce the drafts storage limit set by an admin
+	if msg := h.quotaError(userID, accountID, req.ID, draft); msg != "" {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": msg})
+	}
+
 	// Save draft
-	if err := h.draftStorage.SaveDraft(userID.(string), req.ID, draft); err != nil {
+	if err := h.draftStorage.SaveDraft(userID, accountID, req.ID, draft); err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to save draft"})
 	}
 
@@ -70,25 +94,85 @@ func (h *DraftHandler) SaveDraft(c *fiber.Ctx) error {
 	})
 }
 
-// AutoSave handles auto-save requests
+// quotaError describes why saving draft over draftID would break the
+// drafts storage limit set by an admin, or is empty if it wouldn't
+func (h *DraftHandler) quotaError(userID, accountID, draftID string, draft *models.Draft) string {
+	user, err := h.userStorage.GetUser(userID)
+	if err != nil || user.Limits.MaxDraftsMB <= 0 {
+		return ""
+	}
+	maxBytes := int64(user.Limits.MaxDraftsMB) << 20
+	if err := h.draftStorage.CheckQuota(userID, accountID, draftID, draft, maxBytes); err == storage.ErrDraftQuota {
+		return fmt.Sprintf("Drafts are limited to %d MB; delete some drafts to save this one", user.Limits.MaxDraftsMB)
+	}
+	return ""
+}
+
+// AutoSave handles auto-save requests from the editor. The editor sends the
+// revision it last saw and gets back the stored draft; a conflict means the
+// draft was saved elsewhere in the meantime.
 func (h *DraftHandler) AutoSave(c *fiber.Ctx) error {
-	// Reuse SaveDraft logic
-	return h.SaveDraft(c)
+	userID, accountID, err := h.getDraftOwner(c)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		ID       string `json:"id"`
+		Revision int    `json:"revision"`
+		To       string `json:"to"`
+		Cc       string `json:"cc"`
+		Bcc      string `json:"bcc"`
+		Subject  string `json:"subject"`
+		Body     string `json:"body"`
+		IsHTML   bool   `json:"is_html"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	draft := &models.Draft{
+		To:      req.To,
+		Cc:      req.Cc,
+		Bcc:     req.Bcc,
+		Subject: req.Subject,
+		Body:    req.Body,
+		IsHTML:  req.IsHTML,
+	}
+
+	if msg := h.quotaError(userID, accountID, req.ID, draft); msg != "" {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": msg})
+	}
+
+	saved, err := h.draftStorage.AutoSaveDraft(userID, accountID, req.ID, req.Revision, draft)
+	if err == storage.ErrDraftRevision {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "This draft was changed elsewhere",
+			"draft": saved,
+		})
+	}
+	if err != nil && req.ID != "" {
+		return c.Status(404).JSON(fiber.Map{"error": "Draft not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to save draft"})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"draft":   saved,
+	})
 }
 
 // GetDrafts retrieves all drafts for the current user
 func (h *DraftHandler) GetDrafts(c *fiber.Ctx) error {
-	sess, err := h.store.Get(c)
+	userID, accountID, err := h.getDraftOwner(c)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Session error"})
-	}
-
-	userID := sess.Get("user_id")
-	if userID == nil {
-		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		return err
 	}
 
-	drafts, err := h.draftStorage.GetDrafts(userID.(string))
+	drafts, err := h.draftStorage.GetDrafts(userID, accountID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to get drafts"})
 	}
@@ -101,18 +185,13 @@ func (h *DraftHandler) GetDrafts(c *fiber.Ctx) error {
 
 // GetDraft retrieves a specific draft
 func (h *DraftHandler) GetDraft(c *fiber.Ctx) error {
-	sess, err := h.store.Get(c)
+	userID, accountID, err := h.getDraftOwner(c)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Session error"})
-	}
-
-	userID := sess.Get("user_id")
-	if userID == nil {
-		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		return err
 	}
 
 	draftID := c.Params("id")
-	draft, err := h.draftStorage.GetDraft(userID.(string), draftID)
+	draft, err := h.draftStorage.GetDraft(userID, accountID, draftID)
 	if err != nil {
 		return c.Status(404).JSON(fiber.Map{"error": "Draft not found"})
 	}
@@ -125,18 +204,13 @@ func (h *DraftHandler) GetDraft(c *fiber.Ctx) error {
 
 // DeleteDraft deletes a draft
 func (h *DraftHandler) DeleteDraft(c *fiber.Ctx) error {
-	sess, err := h.store.Get(c)
+	userID, accountID, err := h.getDraftOwner(c)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Session error"})
-	}
-
-	userID := sess.Get("user_id")
-	if userID == nil {
-		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		return err
 	}
 
 	draftID := c.Params("id")
-	if err := h.draftStorage.DeleteDraft(userID.(string), draftID); err != nil {
+	if err := h.draftStorage.DeleteDraft(userID, accountID, draftID); err != nil {
 		return c.Status(404).JSON(fiber.Map{"error": "Draft not found"})
 	}
 
@@ -0,0 +1,277 @@
+package api
+
+import (
+	"fmt"
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Chunk sizes for chunked uploads
+const (
+	defaultUploadChunkSize = 4 << 20
+	minUploadChunkSize     = 256 << 10
+	maxUploadChunkSize     = 16 << 20
+)
+
+// uploadStatus describes an upload, including how far it has got, the
+// chunks still to send and whether it should go as a link instead
+func (h *DraftHandler) uploadStatus(upload *models.DraftUpload) fiber.Map {
+	limits := h.system.Current()
+	return fiber.Map{
+		"success":        true,
+		"upload":         upload,
+		"missing":        upload.Missing(),
+		"received_bytes": upload.ReceivedBytes(),
+		"offer_link":     h.links != nil && upload.Size > h.links.thresholdBytes(),
+		"link_only":      upload.Size > limits.MaxAttachmentBytes(),
+	}
+}
+
+// GetUploads lists the attachments uploaded to a draft
+func (h *DraftHandler) GetUploads(c *fiber.Ctx) error {
+	userID, accountID, err := h.getDraftOwner(c)
+	if err != nil {
+		return err
+	}
+
+	uploads, err := h.draftStorage.GetUploads(userID, accountID, c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get uploads"})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"uploads": uploads,
+	})
+}
+
+// CreateUpload starts uploading an attachment to a draft in chunks
+func (h *DraftHandler) CreateUpload(c *fiber.Ctx) error {
+	userID, accountID, err := h.getDraftOwner(c)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+		ChunkSize   int64  `json:"chunk_size"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	req.Filename = filepath.Base(strings.TrimSpace(req.Filename))
+	if req.Filename == "" || req.Filename == "." || req.Size <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "A file name and size are required"})
+	}
+	if req.ChunkSize == 0 {
+		req.ChunkSize = defaultUploadChunkSize
+	}
+	if req.ChunkSize < minUploadChunkSize || req.ChunkSize > maxUploadChunkSize {
+		return c.Status(400).JSON(fiber.Map{
+			"error": fmt.Sprintf("Chunks must be between %d KB and %d MB", minUploadChunkSize>>10, maxUploadChunkSize>>20),
+		})
+	}
+	if req.ContentType == "" {
+		req.ContentType = DetectContentType(req.Filename)
+	}
+
+	// Files too large to attach can still be sent as links
+	limits := h.system.Current()
+	checkSize := req.Size
+	if h.links != nil && req.Size <= h.links.maxBytes() {
+		checkSize = 0
+	}
+	if err := limits.CheckAttachment(req.Filename, checkSize); err != nil {
+		status := fiber.StatusUnsupportedMediaType
+		if checkSize > limits.MaxAttachmentBytes() {
+			status = fiber.StatusRequestEntityTooLarge
+		}
+		return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// The upload counts against the drafts storage limit
+	if user, err := h.userStorage.GetUser(userID); err == nil && user.Limits.MaxDraftsMB > 0 {
+		if usage, err := h.draftStorage.Usage(userID); err == nil && usage+req.Size > int64(user.Limits.MaxDraftsMB)<<20 {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"error": fmt.Sprintf("Drafts are limited to %d MB; delete some drafts to upload this file", user.Limits.MaxDraftsMB),
+			})
+		}
+	}
+
+	upload := &models.DraftUpload{
+		Filename:    req.Filename,
+		ContentType: req.ContentType,
+		Size:        req.Size,
+		ChunkSize:   req.ChunkSize,
+	}
+	if err := h.draftStorage.CreateUpload(userID, accountID, c.Params("id"), upload); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Draft not found"})
+	}
+
+	return c.Status(201).JSON(h.uploadStatus(upload))
+}
+
+// GetUpload reports which chunks of an upload have arrived, so that an
+// interrupted upload can be resumed
+func (h *DraftHandler) GetUpload(c *fiber.Ctx) error {
+	userID, accountID, err := h.getDraftOwner(c)
+	if err != nil {
+		return err
+	}
+
+	upload, err := h.draftStorage.GetUpload(userID, accountID, c.Params("id"), c.Params("upload"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Upload not found"})
+	}
+
+	return c.JSON(h.uploadStatus(upload))
+}
+
+// UploadChunk stores one chunk of an upload. The body is the raw chunk and
+// the X-Chunk-Checksum header its hex SHA-256.
+func (h *DraftHandler) UploadChunk(c *fiber.Ctx) error {
+	userID, accountID, err := h.getDraftOwner(c)
+	if err != nil {
+		return err
+	}
+
+	index, err := strconv.Atoi(c.Params("index"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid chunk index"})
+	}
+	checksum := c.Get("X-Chunk-Checksum")
+	if checksum == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "X-Chunk-Checksum header is required"})
+	}
+
+	upload, err := h.draftStorage.SaveChunk(userID, accountID, c.Params("id"), c.Params("upload"), index, c.Body(), checksum)
+	switch err {
+	case nil:
+		return c.JSON(h.uploadStatus(upload))
+	case storage.ErrUploadChunk:
+		return c.Status(400).JSON(fiber.Map{"error": "Chunk is out of range or the wrong size"})
+	case storage.ErrUploadChecksum:
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": "Chunk checksum does not match; send it again"})
+	}
+	if upload == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Upload not found"})
+	}
+	return c.Status(500).JSON(fiber.Map{"error": "Failed to store chunk"})
+}
+
+// CompleteUpload joins an upload's chunks into the attachment. The
+// optional checksum is the SHA-256 of the whole file.
+func (h *DraftHandler) CompleteUpload(c *fiber.Ctx) error {
+	userID, accountID, err := h.getDraftOwner(c)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Checksum string `json:"checksum"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+
+	upload, err := h.draftStorage.CompleteUpload(userID, accountID, c.Params("id"), c.Params("upload"), req.Checksum)
+	switch err {
+	case nil:
+		return c.JSON(h.uploadStatus(upload))
+	case storage.ErrUploadIncomplete:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":   "Some chunks have not been uploaded",
+			"missing": upload.Missing(),
+		})
+	case storage.ErrUploadChecksum:
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": "File checksum does not match"})
+	}
+	if upload == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Upload not found"})
+	}
+	return c.Status(500).JSON(fiber.Map{"error": "Failed to complete upload"})
+}
+
+// LinkUpload turns a completed upload into a large file sent as an expiring
+// download link, and returns the link to put in the message
+func (h *DraftHandler) LinkUpload(c *fiber.Ctx) error {
+	if h.links == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Large file links are turned off"})
+	}
+
+	userID, accountID, err := h.getDraftOwner(c)
+	if err != nil {
+		return err
+	}
+	username, _ := c.Locals("username").(string)
+
+	draftID, uploadID := c.Params("id"), c.Params("upload")
+	upload, content, err := h.draftStorage.OpenUpload(userID, accountID, draftID, uploadID)
+	if err == storage.ErrUploadIncomplete {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "The upload has not finished"})
+	}
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Upload not found"})
+	}
+	defer content.Close()
+
+	if upload.Size > h.links.maxBytes() {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("Files sent as links are limited to %d MB", h.links.config.LargeFiles.MaxSizeMB),
+		})
+	}
+
+	file := &models.LargeFile{
+		UserID:      username,
+		Filename:    upload.Filename,
+		ContentType: upload.ContentType,
+		Size:        upload.Size,
+		ExpiresAt:   time.Now().AddDate(0, 0, h.links.config.LargeFiles.ExpiryDays),
+	}
+	if err := h.links.storage.CreateFile(file, content); err != nil {
+		utils.Log.Error("Failed to store large file: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store the file"})
+	}
+	content.Close()
+
+	if err := h.draftStorage.DeleteUpload(userID, accountID, draftID, uploadID); err != nil {
+		utils.Log.Warn("Failed to delete linked upload %s: %v", uploadID, err)
+	}
+	if err := h.links.storage.DeleteExpired(); err != nil {
+		utils.Log.Warn("Failed to delete expired large files: %v", err)
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"file":    h.links.fileSummary(file),
+	})
+}
+
+// DeleteUpload removes an attachment uploaded to a draft
+func (h *DraftHandler) DeleteUpload(c *fiber.Ctx) error {
+	userID, accountID, err := h.getDraftOwner(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.draftStorage.DeleteUpload(userID, accountID, c.Params("id"), c.Params("upload")); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Upload not found"})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Upload deleted",
+	})
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"lilmail/models"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Why messages were found to be copies of each other
+const (
+	DuplicateMessageID = "message_id"
+	DuplicateContent   = "content"
+)
+
+// DuplicateGroup is a message and the copies of it found in the same folder.
+// The copy with the lowest UID, the first one stored, is the one kept.
+type DuplicateGroup struct {
+	Reason string         `json:"reason"`
+	Keep   models.Email   `json:"keep"`
+	Copies []models.Email `json:"copies"`
+}
+
+// duplicateSet is the UIDs of a message's copies, lowest first
+type duplicateSet struct {
+	reason string
+	uids   []uint32
+}
+
+// FindDuplicates lists the messages of a folder stored more than once, as
+// happens after a migration was run twice or stopped half way
+func (h *CleanupHandler) FindDuplicates(c *fiber.Ctx) error {
+	folder := c.Query("folder", "INBOX")
+
+	client, err := h.connect(c)
+	if err != nil {
+		return cleanupError(c, err)
+	}
+	defer client.Close()
+
+	sets, err := findDuplicates(client, folder)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to look for duplicates: " + err.Error(),
+		})
+	}
+	groups, err := describeDuplicates(client, folder, sets)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch messages",
+		})
+	}
+
+	copies := 0
+	for _, group := range groups {
+		copies += len(group.Copies)
+	}
+	return c.JSON(fiber.Map{
+		"groups": groups,
+		"copies": copies,
+	})
+}
+
+// RemoveDuplicates deletes the copies of duplicated messages in a folder,
+// keeping the first of each. The folder is scanned again so that only
+// messages that still have another copy are deleted; given uids, only
+// those of them.
+func (h *CleanupHandler) RemoveDuplicates(c *fiber.Ctx) error {
+	var req struct {
+		Folder string   `json:"folder"`
+		UIDs   []uint32 `json:"uids"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request",
+		})
+	}
+	if req.Folder == "" {
+		req.Folder = "INBOX"
+	}
+
+	client, err := h.connect(c)
+	if err != nil {
+		return cleanupError(c, err)
+	}
+	defer client.Close()
+
+	sets, err := findDuplicates(client, req.Folder)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to look for duplicates: " + err.Error(),
+		})
+	}
+
+	wanted := make(map[uint32]bool, len(req.UIDs))
+	for _, uid := range req.UIDs {
+		wanted[uid] = true
+	}
+	var uids []uint32
+	for _, set := range sets {
+		for _, uid := range set.uids[1:] {
+			if len(wanted) == 0 || wanted[uid] {
+				uids = append(uids, uid)
+			}
+		}
+	}
+
+	removed, err := cleanupBatch(client, &CleanupRequest{Folder: req.Folder, Action: CleanupDelete}, "", uids)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to delete copies: " + err.Error(),
+			"removed": removed,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"removed": removed,
+	})
+}
+
+// findDuplicates finds the messages of a folder that are copies of each
+// other: those with the same Message-ID, and among messages without one,
+// those with the same headers and body
+func findDuplicates(client MailClient, folder string) ([]duplicateSet, error) {
+	uids, err := client.SearchUIDs(folder, imap.NewSearchCriteria())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	messageIDs, err := client.FetchMessageIDs(folder, uids)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching message IDs: %v", err)
+	}
+
+	var sets []duplicateSet
+	seen := make(map[string]int)
+	var withoutID []uint32
+	for _, uid := range uids {
+		id := strings.TrimSpace(messageIDs[uid])
+		if id == "" {
+			withoutID = append(withoutID, uid)
+			continue
+		}
+		if i, ok := seen[id]; ok {
+			sets[i].uids = append(sets[i].uids, uid)
+			continue
+		}
+		seen[id] = len(sets)
+		sets = append(sets, duplicateSet{reason: DuplicateMessageID, uids: []uint32{uid}})
+	}
+
+	byContent, err := sameContent(client, folder, withoutID)
+	if err != nil {
+		return nil, err
+	}
+	sets = append(sets, byContent...)
+
+	// Only messages stored more than once are duplicates
+	duplicates := sets[:0]
+	for _, set := range sets {
+		if len(set.uids) > 1 {
+			duplicates = append(duplicates, set)
+		}
+	}
+	return duplicates, nil
+}
+
+// sameContent groups messages whose headers and body hash the same. Only
+// messages with the same sender, subject and date are read in full.
+func sameContent(client MailClient, folder string, uids []uint32) ([]duplicateSet, error) {
+	if len(uids) < 2 {
+		return nil, nil
+	}
+	emails, err := client.FetchMessagesByUIDs(folder, uids)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	candidates := make(map[string][]uint32)
+	for _, email := range emails {
+		uid, err := parseUID(email.ID)
+		if err != nil {
+			continue
+		}
+		key := strings.ToLower(email.From) + "\x00" + email.Subject + "\x00" + fmt.Sprint(email.Date.Unix())
+		if _, ok := candidates[key]; !ok {
+			keys = append(keys, key)
+		}
+		candidates[key] = append(candidates[key], uid)
+	}
+
+	var sets []duplicateSet
+	for _, key := range keys {
+		same := candidates[key]
+		if len(same) < 2 {
+			continue
+		}
+		sort.Slice(same, func(i, j int) bool { return same[i] < same[j] })
+
+		var hashes []string
+		byHash := make(map[string][]uint32)
+		for _, uid := range same {
+			email, err := client.FetchSingleMessage(folder, fmt.Sprint(uid))
+			if err != nil {
+				return nil, err
+			}
+			hash := contentHash(email)
+			if _, ok := byHash[hash]; !ok {
+				hashes = append(hashes, hash)
+			}
+			byHash[hash] = append(byHash[hash], uid)
+		}
+		for _, hash := range hashes {
+			sets = append(sets, duplicateSet{reason: DuplicateContent, uids: byHash[hash]})
+		}
+	}
+	return sets, nil
+}
+
+// contentHash hashes the headers that tell messages apart and the body
+func contentHash(email models.Email) string {
+	h := sha256.New()
+	for _, part := range []string{
+		strings.ToLower(email.From),
+		strings.ToLower(email.To),
+		strings.ToLower(email.Cc),
+		email.Subject,
+		fmt.Sprint(email.Date.Unix()),
+		email.Body,
+		string(email.HTML),
+	} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// describeDuplicates fetches the messages of duplicate sets in one go
+func describeDuplicates(client MailClient, folder string, sets []duplicateSet) ([]DuplicateGroup, error) {
+	var uids []uint32
+	for _, set := range sets {
+		uids = append(uids, set.uids...)
+	}
+
+	byUID := make(map[string]models.Email, len(uids))
+	if len(uids) > 0 {
+		emails, err := client.FetchMessagesByUIDs(folder, uids)
+		if err != nil {
+			return nil, err
+		}
+		for _, email := range emails {
+			byUID[email.ID] = email
+		}
+	}
+
+	groups := make([]DuplicateGroup, 0, len(sets))
+	for _, set := range sets {
+		group := DuplicateGroup{Reason: set.reason, Copies: []models.Email{}}
+		for i, uid := range set.uids {
+			email, ok := byUID[fmt.Sprint(uid)]
+			if !ok {
+				email = models.Email{ID: fmt.Sprint(uid)}
+			}
+			if i == 0 {
+				group.Keep = email
+			} else {
+				group.Copies = append(group.Copies, email)
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"html/template"
 	"io"
@@ -11,7 +12,9 @@ import (
 	"log"
 	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
 	"net/mail"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -41,15 +44,7 @@ func (c *Client) FetchMessages(folderName string, limit uint32) ([]models.Email,
 	seqSet.AddRange(from, mbox.Messages)
 
 	messages := make(chan *imap.Message, limit)
-	// Add header fetch for References
-	// Add header fetch for References
-	section := &imap.BodySectionName{
-		BodyPartName: imap.BodyPartName{
-			Specifier: imap.HeaderSpecifier,
-			Fields:    []string{"REFERENCES"},
-		},
-		Peek: true,
-	}
+	section := threadingHeaderSection()
 
 	items := []imap.FetchItem{
 		imap.FetchEnvelope,
@@ -73,15 +68,9 @@ func (c *Client) FetchMessages(folderName string, limit uint32) ([]models.Email,
 			continue
 		}
 
-		// Extract References header
 		if r := msg.GetBody(section); r != nil {
-			headerBytes, _ := ioutil.ReadAll(r)
-			headerStr := string(headerBytes)
-			// Parse "References: <...>"
-			if idx := strings.Index(headerStr, ":"); idx > -1 {
-				refs := strings.TrimSpace(headerStr[idx+1:])
-				// Split by whitespace
-				email.References = strings.Fields(refs)
+			if header, err := mail.ReadMessage(r); err == nil {
+				setThreadingHeaders(&email, header.Header)
 			}
 		}
 
@@ -95,14 +84,32 @@ func (c *Client) FetchMessages(folderName string, limit uint32) ([]models.Email,
 	return emails, nil
 }
 
-// FetchThreads retrieves messages and organizes them into threads using JWZ algorithm
-func (c *Client) FetchThreads(folderName string, limit uint32) ([]*models.EmailThread, error) {
+// threadWindowFactor is how many recent messages are fetched per thread on a
+// page, since a page of threads spans more messages than threads
+const threadWindowFactor = 3
+
+// FetchThreads retrieves enough recent messages to fill the given page of
+// threads and organizes them into threads using JWZ algorithm. The returned
+// bool is true when the whole folder was fetched, i.e. no older threads exist.
+func (c *Client) FetchThreads(folderName string, page, pageSize uint32) ([]*models.EmailThread, bool, error) {
+	limit := page * pageSize * threadWindowFactor
+
 	// First, fetch all messages
 	emails, err := c.FetchMessages(folderName, limit)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
+	threads := threadEmails(emails)
+
+	// FetchMessages left the folder selected
+	complete := c.client.Mailbox() == nil || c.client.Mailbox().Messages <= limit
+
+	return threads, complete, nil
+}
+
+// threadEmails groups messages into threads using JWZ algorithm
+func threadEmails(emails []models.Email) []*models.EmailThread {
 	// Extract threading info from message headers
 	for i := range emails {
 		email := &emails[i]
@@ -125,7 +132,7 @@ func (c *Client) FetchThreads(folderName string, limit uint32) ([]*models.EmailT
 	threadBuilder := utils.NewThreadBuilder()
 	threads := threadBuilder.BuildThreads(convertToEmailPointers(emails))
 
-	return threads, nil
+	return threads
 }
 
 // Helper function to convert []models.Email to []*models.Email
@@ -295,16 +302,16 @@ func (c *Client) DeleteMessage(folderName, uid string) error {
 
 // MarkMessageAsRead marks a message as read
 func (c *Client) MarkMessageAsRead(folderName, uid string) error {
-	return c.setMessageFlag(folderName, uid, imap.SeenFlag, true)
+	return c.SetFlags(folderName, uid, []string{imap.SeenFlag}, true)
 }
 
 // MarkMessageAsUnread marks a message as unread
 func (c *Client) MarkMessageAsUnread(folderName, uid string) error {
-	return c.setMessageFlag(folderName, uid, imap.SeenFlag, false)
+	return c.SetFlags(folderName, uid, []string{imap.SeenFlag}, false)
 }
 
-// setMessageFlag is a helper function to set or remove flags
-func (c *Client) setMessageFlag(folderName, uid string, flag string, add bool) error {
+// SetFlags adds flags to a message, or removes them when add is false
+func (c *Client) SetFlags(folderName, uid string, flags []string, add bool) error {
 	uidNum, err := parseUID(uid)
 	if err != nil {
 		return fmt.Errorf("invalid UID: %v", err)
@@ -326,9 +333,12 @@ func (c *Client) setMessageFlag(folderName, uid string, flag string, add bool) e
 	}
 
 	item := imap.FormatFlagsOp(operation, true)
-	flags := []interface{}{flag}
+	values := make([]interface{}, len(flags))
+	for i, flag := range flags {
+		values[i] = flag
+	}
 
-	err = c.client.UidStore(seqSet, item, flags, nil)
+	err = c.client.UidStore(seqSet, item, values, nil)
 	if err != nil {
 		return fmt.Errorf("error setting message flag: %v", err)
 	}
@@ -376,57 +386,297 @@ func (c *Client) MoveMessage(sourceFolder, targetFolder, uid string) error {
 	return nil
 }
 
-// processAttachments extracts attachments from the message
-func (c *Client) processAttachments(msg *imap.Message) ([]models.Attachment, error) {
-	var attachments []models.Attachment
+// MoveMessages moves many messages to another folder with one UID COPY
+func (c *Client) MoveMessages(sourceFolder, targetFolder string, uids []uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	if _, err := c.client.Select(sourceFolder, false); err != nil {
+		return fmt.Errorf("error selecting source folder %s: %v", sourceFolder, err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+
+	if err := c.client.UidCopy(seqSet, targetFolder); err != nil {
+		return fmt.Errorf("error copying messages to %s: %v", targetFolder, err)
+	}
+	return c.expungeUIDs(seqSet)
+}
+
+// DeleteMessages permanently deletes many messages of a folder at once
+func (c *Client) DeleteMessages(folderName string, uids []uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	if _, err := c.client.Select(folderName, false); err != nil {
+		return fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	return c.expungeUIDs(seqSet)
+}
 
-	var processAttachmentPart func(bs *imap.BodyStructure, partNum []int) error
-	processAttachmentPart = func(bs *imap.BodyStructure, partNum []int) error {
+// expungeUIDs marks messages of the selected folder deleted and expunges it
+func (c *Client) expungeUIDs(seqSet *imap.SeqSet) error {
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.client.UidStore(seqSet, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return fmt.Errorf("error marking messages as deleted: %v", err)
+	}
+	if err := c.client.Expunge(nil); err != nil {
+		return fmt.Errorf("error expunging mailbox: %v", err)
+	}
+	return nil
+}
+
+// attachmentPart is an attachment found in a message's body structure
+type attachmentPart struct {
+	path      []int // IMAP part number, e.g. [2 1] for section 2.1
+	structure *imap.BodyStructure
+}
+
+// findAttachmentParts walks the body structure, including nested
+// multiparts, and returns the attachments in order. Attachment indexes in
+// URLs refer to this order. Inline parts referenced from the HTML by
+// Content-ID are returned separately, keyed by their Content-ID.
+func findAttachmentParts(root *imap.BodyStructure) ([]attachmentPart, map[string]attachmentPart) {
+	var parts []attachmentPart
+	inline := make(map[string]attachmentPart)
+
+	var walk func(bs *imap.BodyStructure, path []int, related bool)
+	walk = func(bs *imap.BodyStructure, path []int, related bool) {
 		if bs == nil {
-			return nil
+			return
 		}
 
-		isAttachment := bs.Disposition == "attachment" ||
-			(bs.Disposition == "inline" && bs.MIMEType != "text")
+		if strings.EqualFold(bs.MIMEType, "multipart") {
+			isRelated := strings.EqualFold(bs.MIMESubType, "related")
+			for i, child := range bs.Parts {
+				// Copy so siblings don't share the backing array
+				childPath := append(append([]int(nil), path...), i+1)
+				walk(child, childPath, isRelated)
+			}
+			return
+		}
+
+		// The body of a single part message is part 1
+		if len(path) == 0 {
+			path = []int{1}
+		}
+
+		// Parts with a Content-ID inside multipart/related, or marked
+		// inline, are resources of the HTML body rather than attachments
+		if cid := normalizeContentID(bs.Id); cid != "" && !strings.EqualFold(bs.MIMEType, "text") &&
+			!strings.EqualFold(bs.Disposition, "attachment") &&
+			(related || strings.EqualFold(bs.Disposition, "inline")) {
+			inline[cid] = attachmentPart{path: path, structure: bs}
+			return
+		}
 
+		isAttachment := strings.EqualFold(bs.Disposition, "attachment") ||
+			(strings.EqualFold(bs.Disposition, "inline") && !strings.EqualFold(bs.MIMEType, "text"))
 		if isAttachment {
-			section := &imap.BodySectionName{}
-			if len(partNum) > 0 {
-				section.Specifier = imap.PartSpecifier(strings.Join(strings.Fields(fmt.Sprint(partNum)), "."))
-			}
+			parts = append(parts, attachmentPart{path: path, structure: bs})
+		}
+	}
 
-			r := msg.GetBody(section)
-			if r == nil {
-				return fmt.Errorf("no body for attachment part %v", partNum)
-			}
+	walk(root, nil, false)
+	return parts, inline
+}
 
-			content, err := io.ReadAll(r)
-			if err != nil {
-				return fmt.Errorf("error reading attachment content: %v", err)
-			}
+// normalizeContentID strips the angle brackets of a Content-ID header so it
+// compares equal to the cid: URLs that reference it
+func normalizeContentID(id string) string {
+	id = strings.TrimSpace(id)
+	id = strings.TrimPrefix(id, "<")
+	id = strings.TrimSuffix(id, ">")
+	return strings.TrimSpace(id)
+}
 
-			attachment := models.Attachment{
-				Filename:    bs.DispositionParams["filename"],
-				ContentType: fmt.Sprintf("%s/%s", bs.MIMEType, bs.MIMESubType),
-				Size:        len(content),
-				Content:     content,
-			}
+// cidSrcPattern matches src attributes pointing at cid: URLs
+var cidSrcPattern = regexp.MustCompile(`(?i)(\ssrc\s*=\s*)(?:"cid:([^"]*)"|'cid:([^']*)'|cid:([^\s>]+))`)
+
+// rewriteCIDs points cid: image sources at the inline part endpoint. It
+// runs before sanitizing, which drops URLs with the cid: scheme.
+func rewriteCIDs(htmlBody, uid, folder string) string {
+	return cidSrcPattern.ReplaceAllStringFunc(htmlBody, func(match string) string {
+		groups := cidSrcPattern.FindStringSubmatch(match)
+		cid := groups[2] + groups[3] + groups[4]
+		if decoded, err := url.PathUnescape(cid); err == nil {
+			cid = decoded
+		}
+		cid = normalizeContentID(cid)
+		if cid == "" {
+			return match
+		}
+
+		src := fmt.Sprintf("/api/attachments/%s/inline/%s?folder=%s",
+			url.PathEscape(uid), url.PathEscape(cid), url.QueryEscape(folder))
+		return fmt.Sprintf(`%s"%s"`, groups[1], src)
+	})
+}
+
+// partName formats a part number the way IMAP writes it, e.g. "2.1"
+func partName(path []int) string {
+	names := make([]string, len(path))
+	for i, n := range path {
+		names[i] = strconv.Itoa(n)
+	}
+	return strings.Join(names, ".")
+}
+
+// attachmentSection is the body section holding an attachment's content
+func attachmentSection(path []int) *imap.BodySectionName {
+	return &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Path: path},
+		Peek:         true,
+	}
+}
+
+// decodeAttachment undoes the part's Content-Transfer-Encoding
+func decodeAttachment(encoding string, r io.Reader) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	return io.ReadAll(r)
+}
+
+// newAttachment describes an attachment part, with its content if the
+// part's section was fetched
+func newAttachment(part attachmentPart, msg *imap.Message) (models.Attachment, error) {
+	bs := part.structure
+
+	filename := bs.DispositionParams["filename"]
+	if filename == "" {
+		filename = bs.Params["name"]
+	}
+
+	attachment := models.Attachment{
+		Filename:    utils.DecodeHeader(filename),
+		ContentType: strings.ToLower(fmt.Sprintf("%s/%s", bs.MIMEType, bs.MIMESubType)),
+		Part:        partName(part.path),
+		Size:        int(bs.Size), // Encoded size until the content is fetched
+	}
 
-			attachments = append(attachments, attachment)
+	if r := msg.GetBody(attachmentSection(part.path)); r != nil {
+		content, err := decodeAttachment(bs.Encoding, r)
+		if err != nil {
+			return attachment, fmt.Errorf("error reading attachment content: %v", err)
 		}
+		attachment.Content = content
+		attachment.Size = len(content)
+	}
 
-		for i, part := range bs.Parts {
-			newPartNum := append(partNum, i+1)
-			if err := processAttachmentPart(part, newPartNum); err != nil {
-				return err
-			}
+	return attachment, nil
+}
+
+// processAttachments lists the attachments of the message. Their content
+// is only filled in when the message was fetched with the part sections;
+// FetchAttachment gets a single attachment's content.
+func (c *Client) processAttachments(msg *imap.Message) ([]models.Attachment, error) {
+	var attachments []models.Attachment
+
+	parts, _ := findAttachmentParts(msg.BodyStructure)
+	for _, part := range parts {
+		attachment, err := newAttachment(part, msg)
+		if err != nil {
+			return attachments, err
 		}
+		attachments = append(attachments, attachment)
+	}
 
-		return nil
+	return attachments, nil
+}
+
+// FetchAttachment fetches the content of the index-th attachment of a
+// message, without downloading the rest of it
+func (c *Client) FetchAttachment(folderName, uid string, index int) (*models.Attachment, error) {
+	return c.fetchPart(folderName, uid, func(parts []attachmentPart, _ map[string]attachmentPart) (attachmentPart, bool) {
+		if index < 0 || index >= len(parts) {
+			return attachmentPart{}, false
+		}
+		return parts[index], true
+	})
+}
+
+// FetchInlinePart fetches the content of the inline part a cid: URL in the
+// message's HTML refers to
+func (c *Client) FetchInlinePart(folderName, uid, contentID string) (*models.Attachment, error) {
+	return c.fetchPart(folderName, uid, func(_ []attachmentPart, inline map[string]attachmentPart) (attachmentPart, bool) {
+		part, ok := inline[normalizeContentID(contentID)]
+		return part, ok
+	})
+}
+
+// fetchPart finds a part from the message's body structure with pick and
+// fetches just that part
+func (c *Client) fetchPart(folderName, uid string, pick func([]attachmentPart, map[string]attachmentPart) (attachmentPart, bool)) (*models.Attachment, error) {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID: %v", err)
+	}
+
+	if _, err := c.client.Select(folderName, true); err != nil {
+		return nil, fmt.Errorf("error selecting folder %s: %v", folderName, err)
 	}
 
-	err := processAttachmentPart(msg.BodyStructure, nil)
-	return attachments, err
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uidNum)
+
+	// First find the part from the body structure
+	msg, err := c.fetchOne(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchBodyStructure})
+	if err != nil {
+		return nil, err
+	}
+	part, ok := pick(findAttachmentParts(msg.BodyStructure))
+	if !ok {
+		return nil, fmt.Errorf("attachment not found")
+	}
+
+	// Then fetch just that part
+	msg, err = c.fetchOne(seqSet, []imap.FetchItem{imap.FetchUid, attachmentSection(part.path).FetchItem()})
+	if err != nil {
+		return nil, err
+	}
+	attachment, err := newAttachment(part, msg)
+	if err != nil {
+		return nil, err
+	}
+	if attachment.Content == nil {
+		return nil, fmt.Errorf("no body for attachment part %s", attachment.Part)
+	}
+	return &attachment, nil
+}
+
+// fetchOne UID-fetches items of a single message
+func (c *Client) fetchOne(seqSet *imap.SeqSet, items []imap.FetchItem) (*imap.Message, error) {
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.client.UidFetch(seqSet, items, messages)
+	}()
+
+	var msg *imap.Message
+	for m := range messages {
+		if msg == nil {
+			msg = m
+		}
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("message not found")
+	}
+	return msg, nil
 }
 
 func (c *Client) processMessage(msg *imap.Message) (models.Email, error) {
@@ -437,13 +687,20 @@ func (c *Client) processMessage(msg *imap.Message) (models.Email, error) {
 
 	// Process envelope information
 	if msg.Envelope != nil {
-		email.Subject = msg.Envelope.Subject
+		// The envelope keeps encoded-words in charsets go-imap can't read
+		email.Subject = utils.DecodeHeader(msg.Envelope.Subject)
 		email.Date = msg.Envelope.Date
+		if ids := parseMessageIDs(msg.Envelope.MessageId); len(ids) > 0 {
+			email.MessageID = ids[0]
+		}
+		if ids := parseMessageIDs(msg.Envelope.InReplyTo); len(ids) > 0 {
+			email.InReplyTo = ids[0]
+		}
 
 		// Process From addresses
 		if len(msg.Envelope.From) > 0 && msg.Envelope.From[0] != nil {
 			email.From = msg.Envelope.From[0].Address()
-			email.FromName = msg.Envelope.From[0].PersonalName
+			email.FromName = utils.DecodeHeader(msg.Envelope.From[0].PersonalName)
 		}
 
 		// Process To addresses
@@ -454,7 +711,7 @@ func (c *Client) processMessage(msg *imap.Message) (models.Email, error) {
 				if addr != nil {
 					toAddresses = append(toAddresses, addr.Address())
 					if addr.PersonalName != "" {
-						toNames = append(toNames, addr.PersonalName)
+						toNames = append(toNames, utils.DecodeHeader(addr.PersonalName))
 					}
 				}
 			}
@@ -472,6 +729,11 @@ func (c *Client) processMessage(msg *imap.Message) (models.Email, error) {
 			}
 			email.Cc = strings.Join(ccAddresses, ", ")
 		}
+
+		// Servers fill Reply-To with From when the header is absent
+		if len(msg.Envelope.ReplyTo) > 0 && msg.Envelope.ReplyTo[0] != nil {
+			email.ReplyTo = msg.Envelope.ReplyTo[0].Address()
+		}
 	}
 
 	// Process body
@@ -494,56 +756,31 @@ func (c *Client) processMessage(msg *imap.Message) (models.Email, error) {
 			return email, fmt.Errorf("error parsing message: %v", err)
 		}
 
+		// The full message has the headers the envelope lacks
+		setThreadingHeaders(&email, m.Header)
+
 		// Debug content type
 		contentType := m.Header.Get("Content-Type")
 		log.Printf("Content-Type: %s", contentType)
 
-		// Handle multipart messages
-		mediaType, params, err := mime.ParseMediaType(contentType)
-		if err == nil && strings.HasPrefix(mediaType, "multipart/") {
-			mr := multipart.NewReader(m.Body, params["boundary"])
-			for {
-				p, err := mr.NextPart()
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					log.Printf("Error getting next part: %v", err)
-					continue
-				}
-
-				// Debug part content type
-				log.Printf("Part Content-Type: %s", p.Header.Get("Content-Type"))
+		// Find the text bodies, however deep they are nested
+		texts := make(map[string]string)
+		collectTextParts(contentType, m.Header.Get("Content-Transfer-Encoding"), m.Body, texts, 0)
 
-				// Read the part
-				partData, err := ioutil.ReadAll(p)
-				if err != nil {
-					log.Printf("Error reading part: %v", err)
-					continue
-				}
-
-				// Debug part length
-				log.Printf("Part length: %d", len(partData))
-
-				partType := p.Header.Get("Content-Type")
-				switch {
-				case strings.Contains(partType, "text/plain"):
-					email.Body = string(partData)
-					log.Printf("Found plain text: %d bytes", len(email.Body))
-				case strings.Contains(partType, "text/html"):
-					// Sanitize HTML to prevent XSS
-					sanitized := utils.SanitizeHTML(string(partData))
-					email.HTML = template.HTML(sanitized)
-					log.Printf("Found HTML: %d bytes (sanitized)", len(string(email.HTML)))
-				}
-			}
-		} else {
-			// Handle non-multipart messages
-			bodyData, err := ioutil.ReadAll(m.Body)
-			if err == nil {
-				email.Body = string(bodyData)
-				log.Printf("Non-multipart body: %d bytes", len(email.Body))
+		if plain, ok := texts["text/plain"]; ok {
+			email.Body = plain
+			log.Printf("Found plain text: %d bytes", len(email.Body))
+		}
+		if htmlBody, ok := texts["text/html"]; ok {
+			// Point inline images at the inline part endpoint
+			if mbox := c.client.Mailbox(); mbox != nil {
+				htmlBody = rewriteCIDs(htmlBody, email.ID, mbox.Name)
 			}
+			// Structured data is in scripts, which sanitizing removes
+			email.StructuredData = utils.ExtractJSONLD(htmlBody)
+			// Sanitize HTML to prevent XSS
+			email.HTML = template.HTML(utils.SanitizeHTML(htmlBody))
+			log.Printf("Found HTML: %d bytes (sanitized)", len(string(email.HTML)))
 		}
 
 		// Add preview after all content is processed
@@ -569,6 +806,70 @@ func (c *Client) processMessage(msg *imap.Message) (models.Email, error) {
 	return email, nil
 }
 
+// maxMultipartDepth bounds how deep collectTextParts descends into nested
+// multiparts
+const maxMultipartDepth = 10
+
+// collectTextParts walks a MIME entity, descending into nested multiparts
+// such as multipart/alternative inside multipart/mixed, and keeps the first
+// text/plain and text/html bodies that aren't attachments, keyed by type.
+func collectTextParts(contentType, transferEncoding string, body io.Reader, texts map[string]string, depth int) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain" // RFC 2045 default
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMultipartDepth {
+			return
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				log.Printf("Error getting next part: %v", err)
+				return
+			}
+
+			if disposition, _, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition")); disposition == "attachment" {
+				continue
+			}
+			collectTextParts(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p, texts, depth+1)
+		}
+	}
+
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return
+	}
+	if _, found := texts[mediaType]; found {
+		return
+	}
+
+	// multipart.Reader already undoes quoted-printable in parts
+	switch strings.ToLower(strings.TrimSpace(transferEncoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	if charset := strings.ToLower(params["charset"]); charset != "" && charset != "utf-8" && charset != "us-ascii" {
+		if r, err := utils.CharsetReader(charset, body); err == nil {
+			body = r
+		}
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		log.Printf("Error reading %s part: %v", mediaType, err)
+		return
+	}
+	texts[mediaType] = string(data)
+}
+
 // Simple HTML tag stripping
 func stripHTML(html string) string {
 	var builder strings.Builder
@@ -661,9 +962,8 @@ func (c *Client) getMessageBody(msg *imap.Message, wantHTML bool) string {
 				(!wantHTML && strings.ToLower(bs.MIMESubType) == "plain"))
 
 		if isDesiredPart {
-			section := &imap.BodySectionName{}
-			if len(partNum) > 0 {
-				section.Specifier = imap.PartSpecifier(strings.Join(strings.Fields(fmt.Sprint(partNum)), "."))
+			section := &imap.BodySectionName{
+				BodyPartName: imap.BodyPartName{Path: partNum},
 			}
 
 			r := msg.GetBody(section)
@@ -680,7 +980,7 @@ func (c *Client) getMessageBody(msg *imap.Message, wantHTML bool) string {
 		}
 
 		for i, part := range bs.Parts {
-			newPartNum := append(partNum, i+1)
+			newPartNum := append(append([]int(nil), partNum...), i+1)
 			if body, found := findSection(part, newPartNum); found {
 				return body, true
 			}
@@ -707,15 +1007,7 @@ func (c *Client) FetchMessagesByUIDs(folderName string, uids []uint32) ([]models
 	seqSet := new(imap.SeqSet)
 	seqSet.AddNum(uids...)
 
-	// Add header fetch for References (same as FetchMessages)
-	// Add header fetch for References (same as FetchMessages)
-	section := &imap.BodySectionName{
-		BodyPartName: imap.BodyPartName{
-			Specifier: imap.HeaderSpecifier,
-			Fields:    []string{"REFERENCES"},
-		},
-		Peek: true,
-	}
+	section := threadingHeaderSection()
 
 	items := []imap.FetchItem{
 		imap.FetchEnvelope,
@@ -740,14 +1032,10 @@ func (c *Client) FetchMessagesByUIDs(folderName string, uids []uint32) ([]models
 			fmt.Printf("Error processing message %d: %v\n", msg.Uid, err)
 			continue
 		}
-		
-		// Extract References header
+
 		if r := msg.GetBody(section); r != nil {
-			headerBytes, _ := ioutil.ReadAll(r)
-			headerStr := string(headerBytes)
-			if idx := strings.Index(headerStr, ":"); idx > -1 {
-				refs := strings.TrimSpace(headerStr[idx+1:])
-				email.References = strings.Fields(refs)
+			if header, err := mail.ReadMessage(r); err == nil {
+				setThreadingHeaders(&email, header.Header)
 			}
 		}
 
@@ -768,3 +1056,216 @@ func (c *Client) FetchMessagesByUIDs(folderName string, uids []uint32) ([]models
 	
 	return emails, nil
 }
+
+// FetchNewMessages retrieves messages with a UID greater than sinceUID
+func (c *Client) FetchNewMessages(folderName string, sinceUID uint32) ([]models.Email, error) {
+	mbox, err := c.client.Select(folderName, true)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+
+	if mbox.Messages == 0 || (mbox.UidNext > 0 && mbox.UidNext <= sinceUID+1) {
+		return []models.Email{}, nil
+	}
+
+	// UID range sinceUID+1:* (0 means "*")
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(sinceUID+1, 0)
+
+	// List-Id is needed by auto-labeling rules, References by muted threads
+	section := threadingHeaderSection()
+	section.Fields = append(section.Fields, "LIST-ID")
+
+	items := []imap.FetchItem{
+		imap.FetchEnvelope,
+		imap.FetchFlags,
+		imap.FetchBody,
+		imap.FetchBodyStructure,
+		imap.FetchUid,
+		section.FetchItem(),
+	}
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.client.UidFetch(seqSet, items, messages)
+	}()
+
+	var emails []models.Email
+	for msg := range messages {
+		// "n:*" always includes the highest UID, even when it is below n
+		if msg.Uid <= sinceUID {
+			continue
+		}
+		email, err := c.processMessage(msg)
+		if err != nil {
+			fmt.Printf("Error processing message %d: %v\n", msg.Uid, err)
+			continue
+		}
+		if r := msg.GetBody(section); r != nil {
+			if header, err := mail.ReadMessage(r); err == nil {
+				email.ListID = parseListID(header.Header.Get("List-Id"))
+				setThreadingHeaders(&email, header.Header)
+			}
+		}
+		emails = append(emails, email)
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+
+	return emails, nil
+}
+
+// threadingHeaderSection is the header fetch for the threading headers.
+// The envelope has Message-ID and In-Reply-To but not References.
+func threadingHeaderSection() *imap.BodySectionName {
+	return &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{
+			Specifier: imap.HeaderSpecifier,
+			Fields:    []string{"MESSAGE-ID", "IN-REPLY-TO", "REFERENCES"},
+		},
+		Peek: true,
+	}
+}
+
+// setThreadingHeaders fills the references of an email from its headers,
+// and its message ID and parent when the envelope didn't have them
+func setThreadingHeaders(email *models.Email, header mail.Header) {
+	if refs := parseMessageIDs(header.Get("References")); len(refs) > 0 {
+		email.References = refs
+	}
+	if email.MessageID == "" {
+		if ids := parseMessageIDs(header.Get("Message-Id")); len(ids) > 0 {
+			email.MessageID = ids[0]
+		}
+	}
+	if email.InReplyTo == "" {
+		if ids := parseMessageIDs(header.Get("In-Reply-To")); len(ids) > 0 {
+			email.InReplyTo = ids[0]
+		}
+	}
+}
+
+// parseMessageIDs returns the <id@host> message IDs in a header value,
+// skipping the comments and junk some clients put around them
+func parseMessageIDs(value string) []string {
+	var ids []string
+	for {
+		start := strings.Index(value, "<")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(value[start:], ">")
+		if end < 0 {
+			break
+		}
+		if id := value[start : start+end+1]; len(id) > 2 && !strings.ContainsAny(id, " \t\r\n") {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+	return ids
+}
+
+// parseListID extracts the list identifier from a List-Id header value, e.g.
+// "Go Nuts <golang-nuts.googlegroups.com>" gives "golang-nuts.googlegroups.com"
+func parseListID(value string) string {
+	value = strings.TrimSpace(value)
+	if start := strings.LastIndex(value, "<"); start > -1 {
+		if end := strings.Index(value[start:], ">"); end > -1 {
+			return value[start+1 : start+end]
+		}
+	}
+	return value
+}
+
+// FetchFlags retrieves the flags of every message with a UID of at least fromUID
+func (c *Client) FetchFlags(folderName string, fromUID uint32) (map[uint32][]string, error) {
+	mbox, err := c.client.Select(folderName, true)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+
+	flags := make(map[uint32][]string)
+	if mbox.Messages == 0 {
+		return flags, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(fromUID, 0)
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.client.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, messages)
+	}()
+
+	for msg := range messages {
+		if msg.Uid >= fromUID {
+			flags[msg.Uid] = msg.Flags
+		}
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+
+	return flags, nil
+}
+
+// FetchMessageIDs returns the Message-ID of each of the given UIDs
+func (c *Client) FetchMessageIDs(folderName string, uids []uint32) (map[uint32]string, error) {
+	ids := make(map[uint32]string)
+	if len(uids) == 0 {
+		return ids, nil
+	}
+
+	if _, err := c.client.Select(folderName, true); err != nil {
+		return nil, fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.client.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, messages)
+	}()
+
+	for msg := range messages {
+		if msg.Envelope != nil && msg.Envelope.MessageId != "" {
+			ids[msg.Uid] = msg.Envelope.MessageId
+		}
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+
+	return ids, nil
+}
+
+// FindUIDByMessageID returns the UID of the message with the given
+// Message-ID, or 0 if the folder has no such message
+func (c *Client) FindUIDByMessageID(folderName, messageID string) (uint32, error) {
+	if _, err := c.client.Select(folderName, true); err != nil {
+		return 0, fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", messageID)
+	uids, err := c.client.UidSearch(criteria)
+	if err != nil {
+		return 0, fmt.Errorf("search failed: %v", err)
+	}
+	if len(uids) == 0 {
+		return 0, nil
+	}
+	return uids[0], nil
+}
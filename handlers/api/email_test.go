@@ -0,0 +1,182 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// partStructure returns a single part body structure
+func partStructure(mimeType, subType, disposition, id string) *imap.BodyStructure {
+	return &imap.BodyStructure{MIMEType: mimeType, MIMESubType: subType, Disposition: disposition, Id: id}
+}
+
+// multipartStructure returns a multipart body structure of the parts
+func multipartStructure(subType string, parts ...*imap.BodyStructure) *imap.BodyStructure {
+	return &imap.BodyStructure{MIMEType: "multipart", MIMESubType: subType, Parts: parts}
+}
+
+func TestFindAttachmentParts(t *testing.T) {
+	forwarded := partStructure("message", "rfc822", "attachment", "")
+	forwarded.BodyStructure = multipartStructure("mixed",
+		partStructure("text", "plain", "", ""),
+		partStructure("application", "pdf", "attachment", ""),
+	)
+
+	tests := []struct {
+		name       string
+		root       *imap.BodyStructure
+		wantParts  []string
+		wantInline map[string]string
+	}{
+		{
+			name: "mixed with alternative and related",
+			root: multipartStructure("mixed",
+				multipartStructure("alternative",
+					partStructure("text", "plain", "", ""),
+					multipartStructure("related",
+						partStructure("text", "html", "", ""),
+						partStructure("image", "png", "", "<logo@example.com>"),
+					),
+				),
+				partStructure("application", "pdf", "attachment", ""),
+			),
+			wantParts:  []string{"2"},
+			wantInline: map[string]string{"logo@example.com": "1.2.2"},
+		},
+		{
+			name: "attachments in nested multiparts",
+			root: multipartStructure("mixed",
+				partStructure("text", "plain", "", ""),
+				multipartStructure("mixed",
+					partStructure("application", "pdf", "attachment", ""),
+					multipartStructure("mixed",
+						partStructure("application", "zip", "attachment", ""),
+					),
+				),
+				partStructure("image", "jpeg", "inline", ""),
+			),
+			wantParts:  []string{"2.1", "2.2.1", "3"},
+			wantInline: map[string]string{},
+		},
+		{
+			name: "related inside mixed inside mixed",
+			root: multipartStructure("mixed",
+				partStructure("text", "plain", "", ""),
+				multipartStructure("mixed",
+					multipartStructure("related",
+						partStructure("text", "html", "", ""),
+						partStructure("image", "gif", "", "<a@example.com>"),
+						partStructure("application", "pdf", "attachment", "<b@example.com>"),
+					),
+				),
+			),
+			wantParts:  []string{"2.1.3"},
+			wantInline: map[string]string{"a@example.com": "2.1.2"},
+		},
+		{
+			name:       "forwarded message is one attachment",
+			root:       multipartStructure("mixed", partStructure("text", "plain", "", ""), forwarded),
+			wantParts:  []string{"2"},
+			wantInline: map[string]string{},
+		},
+		{
+			name:       "single part attachment",
+			root:       partStructure("application", "pdf", "attachment", ""),
+			wantParts:  []string{"1"},
+			wantInline: map[string]string{},
+		},
+		{
+			name:       "single part inline image",
+			root:       partStructure("image", "png", "inline", "<c@example.com>"),
+			wantParts:  nil,
+			wantInline: map[string]string{"c@example.com": "1"},
+		},
+		{
+			name:       "single text part",
+			root:       partStructure("text", "plain", "", ""),
+			wantParts:  nil,
+			wantInline: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts, inline := findAttachmentParts(tt.root)
+
+			var gotParts []string
+			for _, p := range parts {
+				gotParts = append(gotParts, partName(p.path))
+			}
+			if !reflect.DeepEqual(gotParts, tt.wantParts) {
+				t.Errorf("got parts %v, want %v", gotParts, tt.wantParts)
+			}
+
+			gotInline := make(map[string]string)
+			for cid, p := range inline {
+				gotInline[cid] = partName(p.path)
+			}
+			if !reflect.DeepEqual(gotInline, tt.wantInline) {
+				t.Errorf("got inline parts %v, want %v", gotInline, tt.wantInline)
+			}
+		})
+	}
+}
+
+func TestFindAttachmentPartsSinglePartPath(t *testing.T) {
+	root := partStructure("application", "pdf", "attachment", "")
+	parts, _ := findAttachmentParts(root)
+	if len(parts) != 1 {
+		t.Fatalf("got %d parts, want 1", len(parts))
+	}
+	if !reflect.DeepEqual(parts[0].path, []int{1}) {
+		t.Errorf("got path %v, want [1]", parts[0].path)
+	}
+	if parts[0].structure != root {
+		t.Error("got a different structure than the root")
+	}
+}
+
+func TestPartName(t *testing.T) {
+	tests := []struct {
+		path []int
+		want string
+	}{
+		{nil, ""},
+		{[]int{1}, "1"},
+		{[]int{2, 1}, "2.1"},
+		{[]int{2, 2, 1}, "2.2.1"},
+		{[]int{10, 3}, "10.3"},
+	}
+
+	for _, tt := range tests {
+		if got := partName(tt.path); got != tt.want {
+			t.Errorf("partName(%v) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAttachmentSection(t *testing.T) {
+	tests := []struct {
+		path []int
+		want imap.FetchItem
+	}{
+		{[]int{1}, "BODY.PEEK[1]"},
+		{[]int{2, 1}, "BODY.PEEK[2.1]"},
+		{[]int{2, 2, 1}, "BODY.PEEK[2.2.1]"},
+	}
+
+	for _, tt := range tests {
+		section := attachmentSection(tt.path)
+		if !section.Peek {
+			t.Errorf("section of %v doesn't peek, which would mark the message seen", tt.path)
+		}
+		if !reflect.DeepEqual(section.Path, tt.path) {
+			t.Errorf("got section path %v, want %v", section.Path, tt.path)
+		}
+		if got := section.FetchItem(); got != tt.want {
+			t.Errorf("got fetch item %q, want %q", got, tt.want)
+		}
+	}
+}
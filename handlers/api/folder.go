@@ -56,7 +56,7 @@ func (h *FolderHandler) CreateFolder(c *fiber.Ctx) error {
 	}
 
 	// Create IMAP client
-	client, err := createIMAPClientFromCredentials(credentials, h.config)
+	client, err := NewMailClient(credentials, h.config)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to connect to email server",
@@ -106,7 +106,7 @@ func (h *FolderHandler) DeleteFolder(c *fiber.Ctx) error {
 	}
 
 	// Create IMAP client
-	client, err := createIMAPClientFromCredentials(credentials, h.config)
+	client, err := NewMailClient(credentials, h.config)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to connect to email server",
@@ -161,7 +161,7 @@ func (h *FolderHandler) RenameFolder(c *fiber.Ctx) error {
 	}
 
 	// Create IMAP client
-	client, err := createIMAPClientFromCredentials(credentials, h.config)
+	client, err := NewMailClient(credentials, h.config)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to connect to email server",
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"fmt"
+	"lilmail/models"
+	"lilmail/utils"
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxLargestMessages is how many of the largest messages a usage report
+// lists, for the mailbox and for each folder
+const maxLargestMessages = 10
+
+// MailboxUsage reports how much each folder of the mailbox takes up and
+// which messages are the largest, so users can see what fills their quota
+func (h *FolderHandler) MailboxUsage(c *fiber.Ctx) error {
+	// Get session credentials
+	credentials, err := GetCredentials(c, h.store, h.config.Encryption.Key)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Invalid session",
+		})
+	}
+
+	client, err := NewMailClient(credentials, h.config)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to connect to email server",
+		})
+	}
+	defer client.Close()
+
+	usage, err := mailboxUsage(client)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to measure folders: " + err.Error(),
+		})
+	}
+
+	return c.JSON(usage)
+}
+
+// mailboxUsage measures every selectable folder of a mailbox. Folders that
+// can't be measured are left out rather than failing the whole report.
+func mailboxUsage(client MailClient) (*models.MailboxUsage, error) {
+	folders, err := searchFolders(client)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &models.MailboxUsage{
+		Folders: []models.FolderUsage{},
+		Largest: []models.MessageSize{},
+	}
+	for _, folder := range folders {
+		folderUsage, err := client.FolderUsage(folder)
+		if err != nil {
+			utils.Log.Warn("Failed to measure folder %s: %v", folder, err)
+			continue
+		}
+
+		usage.Messages += folderUsage.Messages
+		usage.Bytes += folderUsage.Bytes
+		usage.AttachmentBytes += folderUsage.AttachmentBytes
+		usage.Largest = append(usage.Largest, folderUsage.Largest...)
+
+		// The largest messages are listed once, for the whole mailbox
+		folderUsage.Largest = nil
+		usage.Folders = append(usage.Folders, *folderUsage)
+	}
+
+	sort.SliceStable(usage.Folders, func(i, j int) bool {
+		return usage.Folders[i].Bytes > usage.Folders[j].Bytes
+	})
+	sortBySize(usage.Largest)
+	if len(usage.Largest) > maxLargestMessages {
+		usage.Largest = usage.Largest[:maxLargestMessages]
+	}
+	describeMessages(client, usage.Largest)
+
+	return usage, nil
+}
+
+// largestMessages returns the largest of a folder's messages, given their
+// sizes by UID
+func largestMessages(folderName string, sizes map[uint32]int64) []models.MessageSize {
+	largest := make([]models.MessageSize, 0, len(sizes))
+	for uid, size := range sizes {
+		largest = append(largest, models.MessageSize{Folder: folderName, UID: uid, Size: size})
+	}
+	sortBySize(largest)
+	if len(largest) > maxLargestMessages {
+		largest = largest[:maxLargestMessages]
+	}
+	return largest
+}
+
+// sortBySize sorts messages largest first, and by folder and UID among
+// messages of the same size so the order is stable between reports
+func sortBySize(messages []models.MessageSize) {
+	sort.Slice(messages, func(i, j int) bool {
+		a, b := messages[i], messages[j]
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		if a.Folder != b.Folder {
+			return a.Folder < b.Folder
+		}
+		return a.UID < b.UID
+	})
+}
+
+// describeMessages fills in the subject, sender and date of messages
+func describeMessages(client MailClient, messages []models.MessageSize) {
+	byFolder := make(map[string][]uint32)
+	for _, msg := range messages {
+		byFolder[msg.Folder] = append(byFolder[msg.Folder], msg.UID)
+	}
+
+	for folder, uids := range byFolder {
+		emails, err := client.FetchMessagesByUIDs(folder, uids)
+		if err != nil {
+			utils.Log.Warn("Failed to fetch largest messages of %s: %v", folder, err)
+			continue
+		}
+
+		byUID := make(map[string]models.Email, len(emails))
+		for _, email := range emails {
+			byUID[email.ID] = email
+		}
+		for i := range messages {
+			if messages[i].Folder != folder {
+				continue
+			}
+			if email, ok := byUID[fmt.Sprint(messages[i].UID)]; ok {
+				messages[i].Subject = email.Subject
+				messages[i].From = email.From
+				messages[i].Date = email.Date
+			}
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"lilmail/config"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// graphAPI is the Microsoft Graph endpoint mail is read through
+const graphAPI = "https://graph.microsoft.com/v1.0"
+
+// graphScopes are the delegated permissions lilmail asks for; offline_access
+// gets a refresh token so accounts keep working without signing in again
+const graphScopes = "offline_access https://graph.microsoft.com/Mail.ReadWrite https://graph.microsoft.com/Mail.Send https://graph.microsoft.com/User.Read"
+
+// graphMaxMIMESize is the largest message /sendMail accepts as MIME
+const graphMaxMIMESize = 4 << 20
+
+// errGraphPending is returned while a device code sign-in waits for the user
+var errGraphPending = errors.New("waiting for the user to sign in")
+
+// graphToken is a token response of the Microsoft identity platform
+type graphToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+
+	expires time.Time
+}
+
+// graphTokens holds the latest token of each account, by account ID.
+// Refresh tokens are replaced whenever they are used, so this is also where
+// a newer refresh token than the one in the session is found.
+var graphTokens sync.Map
+
+// graphTokenMu serializes refreshes, so an account's clients don't each
+// spend the refresh token
+var graphTokenMu sync.Mutex
+
+// graphTokenSaver stores a new refresh token of an account, so it is still
+// there after a restart. Set by NewAccountHandler.
+var graphTokenSaver func(accountID, refreshToken string)
+
+// graphDeviceCode is the start of a device code sign-in
+type graphDeviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+	Message         string `json:"message"`
+}
+
+// graphOAuthError is an error response of the Microsoft identity platform
+type graphOAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *graphOAuthError) Error() string {
+	if e.Description != "" {
+		// The description repeats the code and adds trace ids on later lines
+		return strings.SplitN(e.Description, "\r\n", 2)[0]
+	}
+	return e.Code
+}
+
+// graphAuthority returns an endpoint of the tenant's OAuth authority
+func graphAuthority(cfg config.GraphConfig, endpoint string) string {
+	tenant := cfg.Tenant
+	if tenant == "" {
+		tenant = "common"
+	}
+	return "https://login.microsoftonline.com/" + url.PathEscape(tenant) + "/oauth2/v2.0/" + endpoint
+}
+
+// graphOAuth posts a form to an endpoint of the authority and decodes the
+// response into result
+func graphOAuth(cfg config.GraphConfig, endpoint string, form url.Values, result interface{}) error {
+	if cfg.ClientID == "" {
+		return errors.New("Microsoft 365 sign-in is not configured")
+	}
+	form.Set("client_id", cfg.ClientID)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.PostForm(graphAuthority(cfg, endpoint), form)
+	if err != nil {
+		return fmt.Errorf("error reaching Microsoft sign-in: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		oauthErr := &graphOAuthError{}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(oauthErr); err != nil || oauthErr.Code == "" {
+			return fmt.Errorf("Microsoft sign-in returned %s", resp.Status)
+		}
+		return oauthErr
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("error decoding Microsoft sign-in response: %v", err)
+	}
+	return nil
+}
+
+// requestGraphDeviceCode starts a device code sign-in
+func requestGraphDeviceCode(cfg config.GraphConfig) (*graphDeviceCode, error) {
+	code := &graphDeviceCode{}
+	if err := graphOAuth(cfg, "devicecode", url.Values{"scope": {graphScopes}}, code); err != nil {
+		return nil, err
+	}
+	if code.Interval <= 0 {
+		code.Interval = 5
+	}
+	return code, nil
+}
+
+// pollGraphDeviceCode asks whether the user finished a device code sign-in.
+// It returns errGraphPending until they have.
+func pollGraphDeviceCode(cfg config.GraphConfig, deviceCode string) (*graphToken, error) {
+	token := &graphToken{}
+	err := graphOAuth(cfg, "token", url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {deviceCode},
+	}, token)
+	var oauthErr *graphOAuthError
+	if errors.As(err, &oauthErr) && (oauthErr.Code == "authorization_pending" || oauthErr.Code == "slow_down") {
+		return nil, errGraphPending
+	}
+	if err != nil {
+		return nil, err
+	}
+	token.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return token, nil
+}
+
+// graphAccessToken returns an access token of an account, refreshing it
+// when it is about to expire
+func graphAccessToken(cfg config.GraphConfig, accountID, refreshToken string) (string, error) {
+	graphTokenMu.Lock()
+	defer graphTokenMu.Unlock()
+
+	if cached, ok := graphTokens.Load(accountID); ok {
+		token := cached.(*graphToken)
+		if time.Until(token.expires) > time.Minute {
+			return token.AccessToken, nil
+		}
+		refreshToken = token.RefreshToken
+	}
+
+	token := &graphToken{}
+	err := graphOAuth(cfg, "token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"scope":         {graphScopes},
+	}, token)
+	if err != nil {
+		return "", fmt.Errorf("error refreshing Microsoft 365 sign-in: %v", err)
+	}
+	token.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+	graphTokens.Store(accountID, token)
+
+	if token.RefreshToken != refreshToken && graphTokenSaver != nil {
+		graphTokenSaver(accountID, token.RefreshToken)
+	}
+	return token.AccessToken, nil
+}
+
+// graphError is an error response of Microsoft Graph
+type graphError struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *graphError) Error() string {
+	return fmt.Sprintf("graph: %s: %s", e.Code, e.Message)
+}
+
+// GraphClient is a connection to a Microsoft 365 mailbox through Microsoft
+// Graph. Messages are named by immutable ids, which the client maps to
+// IMAP-like UIDs the way JMAPClient does; folders are synced with delta
+// queries, which also stand in for the IMAP modseq.
+type GraphClient struct {
+	http  *http.Client
+	token string
+	email string
+	ids   *graphIDMap
+	// synced holds the folders whose delta was applied by this client
+	synced map[string]bool
+
+	// Folders by path, loaded on first use
+	folders map[string]*graphFolder
+}
+
+// NewGraphClient connects to the mailbox of a Microsoft 365 account with
+// its refresh token
+func NewGraphClient(cfg config.GraphConfig, accountID, refreshToken, cacheFolder string) (*GraphClient, error) {
+	if accountID == "" || refreshToken == "" {
+		return nil, fmt.Errorf("Microsoft 365 account and sign-in are required")
+	}
+	token, err := graphAccessToken(cfg, accountID, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// Not in the user's cache folder, which is cleared on logout
+	key := sha256.Sum256([]byte(accountID))
+	c := &GraphClient{
+		http:   &http.Client{Timeout: 60 * time.Second},
+		token:  token,
+		ids:    loadGraphIDMap(filepath.Join(cacheFolder, "graph", hex.EncodeToString(key[:])[:32]+".json")),
+		synced: make(map[string]bool),
+	}
+	return c, nil
+}
+
+// request sends a request to Graph. body is sent as JSON unless it is
+// already a reader.
+func (c *GraphClient) request(method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+		contentType = "text/plain"
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	u := path
+	if !strings.HasPrefix(u, "https://") {
+		u = graphAPI + path
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	// Ids that survive moving a message between folders, and delta pages
+	// larger than the default of 10 messages
+	req.Header.Set("Prefer", `IdType="ImmutableId", odata.maxpagesize=`+strconv.Itoa(graphSyncPage))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Graph request failed: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var result struct {
+			Error graphError `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result)
+		graphErr := &result.Error
+		graphErr.Status = resp.StatusCode
+		if graphErr.Code == "" {
+			graphErr.Code = resp.Status
+		}
+		return nil, graphErr
+	}
+	return resp, nil
+}
+
+// get fetches a resource and decodes it into result
+func (c *GraphClient) get(path string, result interface{}) error {
+	return c.call(http.MethodGet, path, nil, result)
+}
+
+// call sends a request and decodes the response into result, if any
+func (c *GraphClient) call(method, path string, body, result interface{}) error {
+	resp, err := c.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("error decoding Graph response: %v", err)
+	}
+	return nil
+}
+
+// download fetches the raw content of a resource
+func (c *GraphClient) download(path string) ([]byte, error) {
+	resp, err := c.request(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// graphProfile is the signed-in user
+type graphProfile struct {
+	DisplayName       string `json:"displayName"`
+	Mail              string `json:"mail"`
+	UserPrincipalName string `json:"userPrincipalName"`
+}
+
+// fetchGraphProfile returns the user an access token belongs to
+func fetchGraphProfile(accessToken string) (*graphProfile, error) {
+	c := &GraphClient{http: &http.Client{Timeout: 30 * time.Second}, token: accessToken}
+	profile := &graphProfile{}
+	if err := c.get("/me?$select=displayName,mail,userPrincipalName", profile); err != nil {
+		return nil, fmt.Errorf("error fetching Microsoft 365 profile: %v", err)
+	}
+	if profile.Mail == "" {
+		profile.Mail = profile.UserPrincipalName
+	}
+	return profile, nil
+}
+
+// SendMail sends an email through /sendMail, which also keeps a copy in
+// Sent Items. The message goes as MIME so it is the same as over SMTP.
+func (c *GraphClient) SendMail(to, cc, bcc, subject, body string, isHTML bool, attachments []AttachmentData) error {
+	if c.email == "" {
+		profile := &graphProfile{}
+		if err := c.get("/me?$select=mail,userPrincipalName", profile); err != nil {
+			return fmt.Errorf("error fetching sender address: %v", err)
+		}
+		c.email = profile.Mail
+		if c.email == "" {
+			c.email = profile.UserPrincipalName
+		}
+	}
+
+	var message bytes.Buffer
+	if err := writeMessage(&message, c.email, to, cc, bcc, subject, body, isHTML, attachments); err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(message.Bytes())
+	if len(encoded) > graphMaxMIMESize {
+		return fmt.Errorf("message is too large to send through Microsoft 365 (at most %d MB)", graphMaxMIMESize>>20)
+	}
+
+	if err := c.call(http.MethodPost, "/me/sendMail", strings.NewReader(encoded), nil); err != nil {
+		return fmt.Errorf("error sending through Microsoft 365: %v", err)
+	}
+	return nil
+}
+
+// Close saves the UID map. There is no connection to close.
+func (c *GraphClient) Close() error {
+	return c.ids.save()
+}
@@ -0,0 +1,286 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"lilmail/utils"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// graphSyncPage is how many messages a page of a delta query holds
+const graphSyncPage = 500
+
+// graphIDMaps holds the UID map of each account, shared by its clients
+var graphIDMaps sync.Map
+
+// graphIDMap assigns UIDs to the immutable ids of an account's messages,
+// like jmapIDMap. Graph only tracks changes per folder, so the map also
+// keeps the messages and flags of each synced folder, by folder id, and the
+// delta link that brings the folder up to date.
+type graphIDMap struct {
+	mu   sync.Mutex
+	path string
+	uids map[uint32]string
+	// dirty is set when the map changed since it was saved
+	dirty bool
+
+	Validity uint32                         `json:"validity"`
+	Next     uint32                         `json:"next"`
+	ModSeq   uint64                         `json:"modseq"`
+	IDs      map[string]uint32              `json:"ids"`
+	Folders  map[string]map[string][]string `json:"folders"`
+	Deltas   map[string]string              `json:"deltas"`
+}
+
+// loadGraphIDMap returns the UID map kept at path, loading it from disk the
+// first time. A missing or unreadable file starts a new map.
+func loadGraphIDMap(path string) *graphIDMap {
+	if m, ok := graphIDMaps.Load(path); ok {
+		return m.(*graphIDMap)
+	}
+
+	m := &graphIDMap{path: path}
+	if err := utils.LoadCache(path, m); err != nil || m.Validity == 0 || m.IDs == nil {
+		m = &graphIDMap{
+			path:     path,
+			Validity: uint32(time.Now().Unix()),
+			Next:     1,
+			ModSeq:   1,
+			IDs:      make(map[string]uint32),
+		}
+	}
+	if m.Folders == nil {
+		m.Folders = make(map[string]map[string][]string)
+	}
+	if m.Deltas == nil {
+		m.Deltas = make(map[string]string)
+	}
+	m.uids = make(map[uint32]string, len(m.IDs))
+	for id, uid := range m.IDs {
+		m.uids[uid] = id
+	}
+
+	actual, _ := graphIDMaps.LoadOrStore(path, m)
+	return actual.(*graphIDMap)
+}
+
+// uid returns the UID of a message id, assigning the next one if the id is
+// new to the map
+func (m *graphIDMap) uid(id string) uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.assign(id)
+}
+
+func (m *graphIDMap) assign(id string) uint32 {
+	if uid, ok := m.IDs[id]; ok {
+		return uid
+	}
+	uid := m.Next
+	m.Next++
+	m.IDs[id] = uid
+	m.uids[uid] = id
+	m.dirty = true
+	return uid
+}
+
+// forget drops a deleted message from the map and its folders
+func (m *graphIDMap) forget(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if uid, ok := m.IDs[id]; ok {
+		delete(m.IDs, id)
+		delete(m.uids, uid)
+	}
+	for _, messages := range m.Folders {
+		delete(messages, id)
+	}
+	m.ModSeq++
+	m.dirty = true
+}
+
+// id returns the message id of a UID
+func (m *graphIDMap) id(uid uint32) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.uids[uid]
+	return id, ok
+}
+
+// flags returns the flags of the synced messages of a folder with a UID of
+// at least fromUID, by UID
+func (m *graphIDMap) flags(folderID string, fromUID uint32) map[uint32][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	flags := make(map[uint32][]string)
+	for id, messageFlags := range m.Folders[folderID] {
+		if uid := m.IDs[id]; uid >= fromUID {
+			flags[uid] = messageFlags
+		}
+	}
+	return flags
+}
+
+// idsAbove returns the ids of the synced messages of a folder with a UID
+// greater than uid
+func (m *graphIDMap) idsAbove(folderID string, uid uint32) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []string
+	for id := range m.Folders[folderID] {
+		if m.IDs[id] > uid {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// status returns the UID validity, next UID and modseq of the map
+func (m *graphIDMap) status() (uint32, uint32, uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Validity, m.Next, m.ModSeq
+}
+
+// save writes the map to disk if it changed
+func (m *graphIDMap) save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return fmt.Errorf("error creating Graph cache folder: %v", err)
+	}
+	if err := utils.SaveCache(m.path, m); err != nil {
+		return err
+	}
+	m.dirty = false
+	return nil
+}
+
+// graphDeltaMessage is a message of a delta query page
+type graphDeltaMessage struct {
+	ID               string    `json:"id"`
+	ReceivedDateTime time.Time `json:"receivedDateTime"`
+	IsRead           bool      `json:"isRead"`
+	IsDraft          bool      `json:"isDraft"`
+	Flag             struct {
+		FlagStatus string `json:"flagStatus"`
+	} `json:"flag"`
+	Removed *struct {
+		Reason string `json:"reason"`
+	} `json:"@removed"`
+}
+
+// messageFlags returns the IMAP flags of a message's properties
+func messageFlags(isRead, isDraft bool, flagStatus string) []string {
+	flags := []string{}
+	if isDraft {
+		flags = append(flags, imap.DraftFlag)
+	}
+	if flagStatus == "flagged" {
+		flags = append(flags, imap.FlaggedFlag)
+	}
+	if isRead {
+		flags = append(flags, imap.SeenFlag)
+	}
+	return flags
+}
+
+// sync brings a folder of the UID map up to date, once per client. Other
+// clients of the account may have synced it already, in which case the
+// delta has nothing to report.
+func (c *GraphClient) sync(folder *graphFolder) error {
+	if c.synced[folder.ID] {
+		return nil
+	}
+
+	m := c.ids
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := c.syncDelta(m, folder.ID)
+	var graphErr *graphError
+	if errors.As(err, &graphErr) && (graphErr.Status == http.StatusGone || graphErr.Code == "SyncStateNotFound") {
+		// The delta link expired; list the folder again
+		delete(m.Deltas, folder.ID)
+		err = c.syncDelta(m, folder.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("error syncing %s: %v", folder.path, err)
+	}
+
+	c.synced[folder.ID] = true
+	return nil
+}
+
+// syncDelta applies the changes to a folder since its delta link, or lists
+// the whole folder when it has none. New messages get UIDs oldest first, so
+// that UIDs follow arrival order.
+func (c *GraphClient) syncDelta(m *graphIDMap, folderID string) error {
+	link, ok := m.Deltas[folderID]
+	full := !ok
+	if full {
+		link = "/me/mailFolders/" + url.PathEscape(folderID) + "/messages/delta?$select=receivedDateTime,isRead,isDraft,flag"
+	}
+
+	messages := make(map[string][]string)
+	if !full && m.Folders[folderID] != nil {
+		messages = m.Folders[folderID]
+	}
+	var added []graphDeltaMessage
+	changed := false
+
+	for link != "" {
+		var page struct {
+			Value     []graphDeltaMessage `json:"value"`
+			NextLink  string              `json:"@odata.nextLink"`
+			DeltaLink string              `json:"@odata.deltaLink"`
+		}
+		if err := c.get(link, &page); err != nil {
+			return err
+		}
+
+		for _, message := range page.Value {
+			changed = true
+			if message.Removed != nil {
+				// Also reported when a message moves to another folder,
+				// where its id and UID stay the same
+				delete(messages, message.ID)
+				continue
+			}
+			if _, ok := m.IDs[message.ID]; !ok {
+				added = append(added, message)
+			}
+			messages[message.ID] = messageFlags(message.IsRead, message.IsDraft, message.Flag.FlagStatus)
+		}
+
+		link = page.NextLink
+		if page.DeltaLink != "" {
+			m.Deltas[folderID] = page.DeltaLink
+		}
+	}
+
+	sort.SliceStable(added, func(i, j int) bool {
+		return added[i].ReceivedDateTime.Before(added[j].ReceivedDateTime)
+	})
+	for _, message := range added {
+		m.assign(message.ID)
+	}
+
+	m.Folders[folderID] = messages
+	if changed || full {
+		m.ModSeq++
+	}
+	m.dirty = true
+	return nil
+}
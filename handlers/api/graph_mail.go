@@ -0,0 +1,1127 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"lilmail/models"
+	"lilmail/utils"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// graphDelimiter separates the levels of a folder path
+const graphDelimiter = "/"
+
+// graphBatchSize is how many requests a JSON batch may hold
+const graphBatchSize = 20
+
+// graphFolder is a Graph mailFolder
+type graphFolder struct {
+	ID               string `json:"id"`
+	DisplayName      string `json:"displayName"`
+	ParentFolderID   string `json:"parentFolderId"`
+	ChildFolderCount int    `json:"childFolderCount"`
+	TotalItemCount   uint32 `json:"totalItemCount"`
+	UnreadItemCount  uint32 `json:"unreadItemCount"`
+
+	// path is the folder name lilmail uses, e.g. "INBOX/Lists"
+	path string
+	// attr is the SPECIAL-USE attribute of a well-known folder
+	attr string
+}
+
+const graphFolderFields = "id,displayName,parentFolderId,childFolderCount,totalItemCount,unreadItemCount"
+
+// graphWellKnownAttrs are the SPECIAL-USE attributes of the well-known
+// folder names
+var graphWellKnownAttrs = map[string]string{
+	"archive":      imap.ArchiveAttr,
+	"deleteditems": imap.TrashAttr,
+	"drafts":       imap.DraftsAttr,
+	"junkemail":    imap.JunkAttr,
+	"sentitems":    imap.SentAttr,
+}
+
+type graphRecipient struct {
+	EmailAddress struct {
+		Name    string `json:"name"`
+		Address string `json:"address"`
+	} `json:"emailAddress"`
+}
+
+type graphAttachment struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	ContentType  string `json:"contentType"`
+	Size         int    `json:"size"`
+	IsInline     bool   `json:"isInline"`
+	ContentID    string `json:"contentId"`
+	ContentBytes []byte `json:"contentBytes"`
+}
+
+// graphMessage is a Graph message with the properties in graphMessageFields
+type graphMessage struct {
+	ID               string           `json:"id"`
+	Subject          string           `json:"subject"`
+	BodyPreview      string           `json:"bodyPreview"`
+	ReceivedDateTime time.Time        `json:"receivedDateTime"`
+	SentDateTime     *time.Time       `json:"sentDateTime"`
+	HasAttachments   bool             `json:"hasAttachments"`
+	IsRead           bool             `json:"isRead"`
+	IsDraft          bool             `json:"isDraft"`
+	From             *graphRecipient  `json:"from"`
+	ToRecipients     []graphRecipient `json:"toRecipients"`
+	CcRecipients     []graphRecipient `json:"ccRecipients"`
+	ReplyTo          []graphRecipient `json:"replyTo"`
+	InternetID       string           `json:"internetMessageId"`
+	Headers          []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"internetMessageHeaders"`
+	Flag struct {
+		FlagStatus string `json:"flagStatus"`
+	} `json:"flag"`
+	Body *struct {
+		ContentType string `json:"contentType"`
+		Content     string `json:"content"`
+	} `json:"body"`
+	Attachments []graphAttachment `json:"attachments"`
+}
+
+// graphMessageFields are the properties lilmail lists messages with; bodies
+// and attachments are only fetched for messages that are opened
+const graphMessageFields = "id,subject,bodyPreview,receivedDateTime,sentDateTime,hasAttachments," +
+	"isRead,isDraft,from,toRecipients,ccRecipients,replyTo,internetMessageId,internetMessageHeaders,flag"
+
+// graphFullMessage is the query of a message with its body and the
+// metadata of its attachments
+const graphFullMessage = "?$select=" + graphMessageFields + ",body&$expand=attachments($select=id,name,contentType,size,isInline)"
+
+// splitGraphAttachments separates the attachments of a message from its
+// inline parts, which the HTML refers to by Content-ID
+func splitGraphAttachments(parts []graphAttachment) ([]graphAttachment, map[string]graphAttachment) {
+	var attachments []graphAttachment
+	inline := make(map[string]graphAttachment)
+	for _, part := range parts {
+		if part.IsInline {
+			if cid := normalizeContentID(part.ContentID); cid != "" {
+				inline[cid] = part
+			}
+			continue
+		}
+		attachments = append(attachments, part)
+	}
+	return attachments, inline
+}
+
+func graphAddresses(recipients []graphRecipient) string {
+	list := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		list[i] = recipient.EmailAddress.Address
+	}
+	return strings.Join(list, ", ")
+}
+
+// messagePath is the path of a message resource
+func messagePath(id string) string {
+	return "/me/messages/" + url.PathEscape(id)
+}
+
+// toEmail converts a Graph message, read from folder, to the model
+func (c *GraphClient) toEmail(m *graphMessage, folder string) models.Email {
+	email := models.Email{
+		ID:             strconv.FormatUint(uint64(c.ids.uid(m.ID)), 10),
+		Flags:          messageFlags(m.IsRead, m.IsDraft, m.Flag.FlagStatus),
+		Subject:        m.Subject,
+		Date:           m.ReceivedDateTime,
+		Cc:             graphAddresses(m.CcRecipients),
+		To:             graphAddresses(m.ToRecipients),
+		HasAttachments: m.HasAttachments,
+	}
+	if m.SentDateTime != nil {
+		email.Date = *m.SentDateTime
+	}
+
+	// Threading headers are only in the internet headers
+	header := make(mail.Header)
+	for _, h := range m.Headers {
+		key := textproto.CanonicalMIMEHeaderKey(h.Name)
+		header[key] = append(header[key], h.Value)
+	}
+	if ids := parseMessageIDs(m.InternetID); len(ids) > 0 {
+		email.MessageID = ids[0]
+	}
+	setThreadingHeaders(&email, header)
+	email.ListID = parseListID(header.Get("List-Id"))
+
+	if m.From != nil {
+		email.From = m.From.EmailAddress.Address
+		email.FromName = m.From.EmailAddress.Name
+	}
+	for _, recipient := range m.ToRecipients {
+		if recipient.EmailAddress.Name != "" {
+			email.ToNames = append(email.ToNames, recipient.EmailAddress.Name)
+		}
+	}
+	if len(m.ReplyTo) > 0 {
+		email.ReplyTo = m.ReplyTo[0].EmailAddress.Address
+	}
+
+	if m.Body != nil {
+		if strings.EqualFold(m.Body.ContentType, "html") {
+			// Point inline images at the inline part endpoint
+			htmlBody := rewriteCIDs(m.Body.Content, email.ID, folder)
+			// Structured data is in scripts, which sanitizing removes
+			email.StructuredData = utils.ExtractJSONLD(htmlBody)
+			email.HTML = template.HTML(utils.SanitizeHTML(htmlBody))
+		} else {
+			email.Body = m.Body.Content
+		}
+	}
+	if email.Body != "" {
+		email.Preview = createPreview(email.Body)
+	} else {
+		email.Preview = createPreview(m.BodyPreview)
+	}
+
+	attachments, _ := splitGraphAttachments(m.Attachments)
+	for _, part := range attachments {
+		email.Attachments = append(email.Attachments, models.Attachment{
+			Filename:    part.Name,
+			ContentType: strings.ToLower(part.ContentType),
+			Part:        part.ID,
+			Size:        part.Size,
+		})
+	}
+	if m.Body != nil {
+		// Only known once the attachments were fetched
+		email.HasAttachments = len(email.Attachments) > 0
+	}
+
+	return email
+}
+
+// toEmails converts Graph messages to the model, oldest first like IMAP
+// fetches return them
+func (c *GraphClient) toEmails(list []graphMessage, folderName string) []models.Email {
+	emails := make([]models.Email, 0, len(list))
+	for i := range list {
+		emails = append(emails, c.toEmail(&list[i], folderName))
+	}
+	sort.SliceStable(emails, func(i, j int) bool { return emails[i].Date.Before(emails[j].Date) })
+	return emails
+}
+
+// batch sends GET requests in JSON batches and returns the body of each
+// response, in order. Requests that failed have a nil body.
+func (c *GraphClient) batch(paths []string) ([]json.RawMessage, error) {
+	bodies := make([]json.RawMessage, len(paths))
+	for start := 0; start < len(paths); start += graphBatchSize {
+		end := start + graphBatchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+
+		requests := make([]map[string]interface{}, 0, end-start)
+		for i := start; i < end; i++ {
+			requests = append(requests, map[string]interface{}{
+				"id":      strconv.Itoa(i),
+				"method":  http.MethodGet,
+				"url":     paths[i],
+				"headers": map[string]string{"Prefer": `IdType="ImmutableId"`},
+			})
+		}
+		var result struct {
+			Responses []struct {
+				ID     string          `json:"id"`
+				Status int             `json:"status"`
+				Body   json.RawMessage `json:"body"`
+			} `json:"responses"`
+		}
+		if err := c.call(http.MethodPost, "/$batch", map[string]interface{}{"requests": requests}, &result); err != nil {
+			return nil, err
+		}
+		for _, response := range result.Responses {
+			i, err := strconv.Atoi(response.ID)
+			if err != nil || i < start || i >= end || response.Status >= 300 {
+				continue
+			}
+			bodies[i] = response.Body
+		}
+	}
+	return bodies, nil
+}
+
+// loadFolders fetches the account's folders and names them by path
+func (c *GraphClient) loadFolders() (map[string]*graphFolder, error) {
+	if c.folders != nil {
+		return c.folders, nil
+	}
+
+	var all []*graphFolder
+	list := func(path string) ([]*graphFolder, error) {
+		var folders []*graphFolder
+		for path != "" {
+			var page struct {
+				Value    []*graphFolder `json:"value"`
+				NextLink string         `json:"@odata.nextLink"`
+			}
+			if err := c.get(path, &page); err != nil {
+				return nil, err
+			}
+			folders = append(folders, page.Value...)
+			path = page.NextLink
+		}
+		return folders, nil
+	}
+
+	level, err := list("/me/mailFolders?$top=250&$select=" + graphFolderFields)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching folders: %v", err)
+	}
+	for depth := 0; len(level) > 0 && depth < maxMultipartDepth; depth++ {
+		all = append(all, level...)
+		var next []*graphFolder
+		for _, folder := range level {
+			if folder.ChildFolderCount == 0 {
+				continue
+			}
+			children, err := list("/me/mailFolders/" + url.PathEscape(folder.ID) + "/childFolders?$top=250&$select=" + graphFolderFields)
+			if err != nil {
+				return nil, fmt.Errorf("error fetching folders: %v", err)
+			}
+			next = append(next, children...)
+		}
+		level = next
+	}
+
+	// Well-known folders are only found by name
+	names := []string{"inbox"}
+	for name := range graphWellKnownAttrs {
+		names = append(names, name)
+	}
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = "/me/mailFolders/" + name + "?$select=id"
+	}
+	bodies, err := c.batch(paths)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching folders: %v", err)
+	}
+	inboxID := ""
+	byID := make(map[string]*graphFolder, len(all))
+	for _, folder := range all {
+		byID[folder.ID] = folder
+	}
+	for i, body := range bodies {
+		var wellKnown struct {
+			ID string `json:"id"`
+		}
+		if body == nil || json.Unmarshal(body, &wellKnown) != nil {
+			continue
+		}
+		if names[i] == "inbox" {
+			inboxID = wellKnown.ID
+		} else if folder, ok := byID[wellKnown.ID]; ok {
+			folder.attr = graphWellKnownAttrs[names[i]]
+		}
+	}
+
+	var pathOf func(folder *graphFolder, depth int) string
+	pathOf = func(folder *graphFolder, depth int) string {
+		name := folder.DisplayName
+		if folder.ID == inboxID {
+			name = "INBOX"
+		}
+		if parent, ok := byID[folder.ParentFolderID]; ok && depth < maxMultipartDepth {
+			return pathOf(parent, depth+1) + graphDelimiter + name
+		}
+		return name
+	}
+
+	c.folders = make(map[string]*graphFolder, len(all))
+	for _, folder := range all {
+		folder.path = pathOf(folder, 0)
+		c.folders[folder.path] = folder
+	}
+	return c.folders, nil
+}
+
+// folder returns the folder with a path
+func (c *GraphClient) folder(folderName string) (*graphFolder, error) {
+	folders, err := c.loadFolders()
+	if err != nil {
+		return nil, err
+	}
+	if folder, ok := folders[folderName]; ok {
+		return folder, nil
+	}
+	if strings.EqualFold(folderName, "INBOX") {
+		if folder, ok := folders["INBOX"]; ok {
+			return folder, nil
+		}
+	}
+	return nil, fmt.Errorf("folder %s not found", folderName)
+}
+
+// FetchFolders retrieves all mailbox folders
+func (c *GraphClient) FetchFolders() ([]*MailboxInfo, error) {
+	folders, err := c.loadFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*MailboxInfo, 0, len(folders))
+	for _, folder := range folders {
+		info := &MailboxInfo{
+			Name:       folder.path,
+			Delimiter:  graphDelimiter,
+			Attributes: []string{},
+		}
+		if folder.attr != "" {
+			info.Attributes = append(info.Attributes, folder.attr)
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// MailboxStatus returns the status of a folder
+func (c *GraphClient) MailboxStatus(folderName string) (*imap.MailboxStatus, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sync(folder); err != nil {
+		return nil, err
+	}
+
+	validity, next, _ := c.ids.status()
+	status := imap.NewMailboxStatus(folderName, []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity, imap.StatusUnseen})
+	status.Messages = folder.TotalItemCount
+	status.Unseen = folder.UnreadItemCount
+	status.UidNext = next
+	status.UidValidity = validity
+	return status, nil
+}
+
+// MailboxState returns the change markers of a folder. The modseq changes
+// whenever a synced folder of the account does.
+func (c *GraphClient) MailboxState(folderName string) (*models.MailboxState, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sync(folder); err != nil {
+		return nil, err
+	}
+
+	validity, next, modseq := c.ids.status()
+	return &models.MailboxState{
+		UIDValidity:   validity,
+		UIDNext:       next,
+		HighestModSeq: modseq,
+		Messages:      folder.TotalItemCount,
+	}, nil
+}
+
+// UnreadCounts returns the number of unseen messages in every folder
+func (c *GraphClient) UnreadCounts() (map[string]uint32, error) {
+	folders, err := c.loadFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]uint32, len(folders))
+	for path, folder := range folders {
+		counts[path] = folder.UnreadItemCount
+	}
+	return counts, nil
+}
+
+// graphFolderSize is the MAPI property holding the size of a folder in bytes
+const graphFolderSize = "Long 0x0E08"
+
+// FolderUsage returns the size of a folder as Exchange reports it. Graph
+// can't order messages by size or tell attachments apart without reading
+// every message, so only the folder's total is given.
+func (c *GraphClient) FolderUsage(folderName string) (*models.FolderUsage, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	usage := &models.FolderUsage{Folder: folderName, Messages: folder.TotalItemCount, Unseen: folder.UnreadItemCount}
+
+	query := url.Values{}
+	query.Set("$select", "id")
+	query.Set("$expand", "singleValueExtendedProperties($filter=id eq '"+graphFolderSize+"')")
+	var result struct {
+		Properties []struct {
+			ID    string `json:"id"`
+			Value string `json:"value"`
+		} `json:"singleValueExtendedProperties"`
+	}
+	if err := c.get("/me/mailFolders/"+url.PathEscape(folder.ID)+"?"+query.Encode(), &result); err != nil {
+		return nil, fmt.Errorf("error getting size of %s: %v", folderName, err)
+	}
+	for _, property := range result.Properties {
+		if strings.EqualFold(property.ID, graphFolderSize) {
+			usage.Bytes, _ = strconv.ParseInt(property.Value, 10, 64)
+		}
+	}
+	return usage, nil
+}
+
+// splitFolderPath returns the parent folder id and name of a folder path.
+// Top level folders have no parent id.
+func (c *GraphClient) splitFolderPath(folderName string) (string, string, error) {
+	i := strings.LastIndex(folderName, graphDelimiter)
+	if i < 0 {
+		return "", folderName, nil
+	}
+	parent, err := c.folder(folderName[:i])
+	if err != nil {
+		return "", "", err
+	}
+	return parent.ID, folderName[i+1:], nil
+}
+
+// CreateFolder creates a new folder
+func (c *GraphClient) CreateFolder(folderName string) error {
+	parentID, name, err := c.splitFolderPath(folderName)
+	if err != nil {
+		return err
+	}
+	path := "/me/mailFolders"
+	if parentID != "" {
+		path += "/" + url.PathEscape(parentID) + "/childFolders"
+	}
+	c.folders = nil
+	return c.call(http.MethodPost, path, map[string]string{"displayName": name}, nil)
+}
+
+// RenameFolder renames or moves a folder
+func (c *GraphClient) RenameFolder(oldName, newName string) error {
+	folder, err := c.folder(oldName)
+	if err != nil {
+		return err
+	}
+	oldParentID, _, err := c.splitFolderPath(oldName)
+	if err != nil {
+		return err
+	}
+	parentID, name, err := c.splitFolderPath(newName)
+	if err != nil {
+		return err
+	}
+	path := "/me/mailFolders/" + url.PathEscape(folder.ID)
+
+	c.folders = nil
+	if name != folder.DisplayName {
+		if err := c.call(http.MethodPatch, path, map[string]string{"displayName": name}, nil); err != nil {
+			return err
+		}
+	}
+	if parentID != oldParentID {
+		if parentID == "" {
+			parentID = "msgfolderroot"
+		}
+		return c.call(http.MethodPost, path+"/move", map[string]string{"destinationId": parentID}, nil)
+	}
+	return nil
+}
+
+// DeleteFolder deletes a folder along with its messages, like IMAP DELETE
+func (c *GraphClient) DeleteFolder(folderName string) error {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return err
+	}
+	c.folders = nil
+	return c.call(http.MethodDelete, "/me/mailFolders/"+url.PathEscape(folder.ID), nil, nil)
+}
+
+// ArchiveFolder returns the folder archived mail goes to: the well-known
+// archive folder if there is one, else "Archive", created if needed
+func (c *GraphClient) ArchiveFolder() (string, error) {
+	folders, err := c.loadFolders()
+	if err != nil {
+		return "", err
+	}
+	for _, folder := range folders {
+		if folder.attr == imap.ArchiveAttr {
+			return folder.path, nil
+		}
+	}
+	if _, ok := folders["Archive"]; ok {
+		return "Archive", nil
+	}
+	if err := c.CreateFolder("Archive"); err != nil {
+		return "", fmt.Errorf("error creating Archive folder: %v", err)
+	}
+	return "Archive", nil
+}
+
+// queryMessages returns a window of a folder's messages, newest first
+func (c *GraphClient) queryMessages(folder *graphFolder, skip, limit uint32) ([]graphMessage, error) {
+	var messages []graphMessage
+	query := url.Values{
+		"$select":  {graphMessageFields},
+		"$orderby": {"receivedDateTime desc"},
+		"$top":     {strconv.Itoa(int(min(limit, graphSyncPage)))},
+		"$skip":    {strconv.Itoa(int(skip))},
+	}
+	path := "/me/mailFolders/" + url.PathEscape(folder.ID) + "/messages?" + query.Encode()
+	for path != "" && uint32(len(messages)) < limit {
+		var page struct {
+			Value    []graphMessage `json:"value"`
+			NextLink string         `json:"@odata.nextLink"`
+		}
+		if err := c.get(path, &page); err != nil {
+			return nil, fmt.Errorf("error fetching messages of %s: %v", folder.path, err)
+		}
+		messages = append(messages, page.Value...)
+		path = page.NextLink
+	}
+	if uint32(len(messages)) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+// getMessages fetches messages by id with their bodies and attachments,
+// skipping ones that no longer exist
+func (c *GraphClient) getMessages(ids []string, query string) ([]graphMessage, error) {
+	paths := make([]string, len(ids))
+	for i, id := range ids {
+		paths[i] = messagePath(id) + query
+	}
+	bodies, err := c.batch(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]graphMessage, 0, len(bodies))
+	for _, body := range bodies {
+		var message graphMessage
+		if body == nil || json.Unmarshal(body, &message) != nil {
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// FetchMessages retrieves the newest messages of a folder
+func (c *GraphClient) FetchMessages(folderName string, limit uint32) ([]models.Email, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.queryMessages(folder, 0, limit)
+	if err != nil {
+		return nil, err
+	}
+	return c.toEmails(list, folderName), nil
+}
+
+// FetchMessagesPaginated retrieves messages with pagination support
+func (c *GraphClient) FetchMessagesPaginated(folderName string, page, pageSize uint32) (*models.PaginatedEmails, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	if folder.TotalItemCount == 0 {
+		return models.NewPaginatedEmails([]models.Email{}, page, pageSize, 0), nil
+	}
+
+	totalPages := (folder.TotalItemCount + pageSize - 1) / pageSize
+	if page < 1 {
+		page = 1
+	}
+	if page > totalPages {
+		page = totalPages
+	}
+
+	list, err := c.queryMessages(folder, (page-1)*pageSize, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return models.NewPaginatedEmails(c.toEmails(list, folderName), page, pageSize, folder.TotalItemCount), nil
+}
+
+// FetchThreads retrieves enough recent messages to fill the given page of
+// threads and organizes them into threads. The returned bool is true when
+// the whole folder was fetched.
+func (c *GraphClient) FetchThreads(folderName string, page, pageSize uint32) ([]*models.EmailThread, bool, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, false, err
+	}
+	limit := page * pageSize * threadWindowFactor
+
+	list, err := c.queryMessages(folder, 0, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	return threadEmails(c.toEmails(list, folderName)), folder.TotalItemCount <= limit, nil
+}
+
+// FetchSingleMessage retrieves a single message by UID
+func (c *GraphClient) FetchSingleMessage(folderName, uid string) (models.Email, error) {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return models.Email{}, fmt.Errorf("invalid UID: %v", err)
+	}
+	emails, err := c.FetchMessagesByUIDs(folderName, []uint32{uidNum})
+	if err != nil {
+		return models.Email{}, err
+	}
+	if len(emails) == 0 {
+		return models.Email{}, fmt.Errorf("message not found")
+	}
+	return emails[0], nil
+}
+
+// messageIDs returns the message ids of UIDs, skipping unknown ones
+func (c *GraphClient) messageIDs(uids []uint32) []string {
+	ids := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		if id, ok := c.ids.id(uid); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// messageID returns the message id of a UID
+func (c *GraphClient) messageID(uid string) (string, error) {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return "", fmt.Errorf("invalid UID: %v", err)
+	}
+	id, ok := c.ids.id(uidNum)
+	if !ok {
+		return "", fmt.Errorf("message not found")
+	}
+	return id, nil
+}
+
+// FetchMessagesByUIDs retrieves messages for a specific list of UIDs
+func (c *GraphClient) FetchMessagesByUIDs(folderName string, uids []uint32) ([]models.Email, error) {
+	if len(uids) == 0 {
+		return []models.Email{}, nil
+	}
+	list, err := c.getMessages(c.messageIDs(uids), graphFullMessage)
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+	return c.toEmails(list, folderName), nil
+}
+
+// FetchNewMessages retrieves messages with a UID greater than sinceUID
+func (c *GraphClient) FetchNewMessages(folderName string, sinceUID uint32) ([]models.Email, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sync(folder); err != nil {
+		return nil, err
+	}
+
+	list, err := c.getMessages(c.ids.idsAbove(folder.ID, sinceUID), "?$select="+graphMessageFields)
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+	return c.toEmails(list, folderName), nil
+}
+
+// FetchFlags retrieves the flags of every message with a UID of at least
+// fromUID, as of the folder's last sync
+func (c *GraphClient) FetchFlags(folderName string, fromUID uint32) (map[uint32][]string, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sync(folder); err != nil {
+		return nil, err
+	}
+	return c.ids.flags(folder.ID, fromUID), nil
+}
+
+// FetchMessageIDs returns the Message-ID of each of the given UIDs
+func (c *GraphClient) FetchMessageIDs(folderName string, uids []uint32) (map[uint32]string, error) {
+	list, err := c.getMessages(c.messageIDs(uids), "?$select=internetMessageId")
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+
+	messageIDs := make(map[uint32]string)
+	for _, m := range list {
+		if ids := parseMessageIDs(m.InternetID); len(ids) > 0 {
+			messageIDs[c.ids.uid(m.ID)] = ids[0]
+		}
+	}
+	return messageIDs, nil
+}
+
+// folderMessageIDs returns the ids of the messages in a folder matching a
+// query, e.g. a $filter or $search
+func (c *GraphClient) folderMessageIDs(folder *graphFolder, query url.Values) ([]string, error) {
+	query.Set("$select", "id")
+	query.Set("$top", strconv.Itoa(graphSyncPage))
+	path := "/me/mailFolders/" + url.PathEscape(folder.ID) + "/messages?" + query.Encode()
+
+	var ids []string
+	for path != "" {
+		var page struct {
+			Value []struct {
+				ID string `json:"id"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		if err := c.get(path, &page); err != nil {
+			return nil, fmt.Errorf("search failed: %v", err)
+		}
+		for _, m := range page.Value {
+			ids = append(ids, m.ID)
+		}
+		path = page.NextLink
+	}
+	return ids, nil
+}
+
+// FindUIDByMessageID returns the UID of the message with the given
+// Message-ID, or 0 if the folder has no such message
+func (c *GraphClient) FindUIDByMessageID(folderName, messageID string) (uint32, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := c.folderMessageIDs(folder, url.Values{
+		"$filter": {"internetMessageId eq '" + strings.ReplaceAll(messageID, "'", "''") + "'"},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return c.ids.uid(ids[0]), nil
+}
+
+// graphSearchProperties are the KQL properties of the headers Graph can
+// search directly
+var graphSearchProperties = map[string]string{
+	"From":    "from",
+	"To":      "to",
+	"Cc":      "cc",
+	"Bcc":     "bcc",
+	"Subject": "subject",
+}
+
+// kqlValue quotes a search value. Quotes inside it can't be escaped in a
+// $search, so they are dropped.
+func kqlValue(value string) string {
+	value = strings.NewReplacer(`"`, "", `\`, "").Replace(value)
+	return `\"` + value + `\"`
+}
+
+// searchKQL translates IMAP search criteria to a KQL query for $search.
+// Graph can't search by flag, so flags are left to matchesFlags.
+func searchKQL(criteria *imap.SearchCriteria) string {
+	var conditions []string
+	for name, values := range criteria.Header {
+		for _, value := range values {
+			switch {
+			case graphSearchProperties[name] != "":
+				conditions = append(conditions, graphSearchProperties[name]+":"+kqlValue(value))
+			case name == textproto.CanonicalMIMEHeaderKey("Content-Type") && strings.EqualFold(value, "multipart/mixed"):
+				conditions = append(conditions, "hasattachment:true")
+			case value != "":
+				conditions = append(conditions, kqlValue(value))
+			}
+		}
+	}
+	for _, value := range criteria.Body {
+		conditions = append(conditions, "body:"+kqlValue(value))
+	}
+	for _, value := range criteria.Text {
+		conditions = append(conditions, kqlValue(value))
+	}
+
+	if !criteria.Since.IsZero() {
+		conditions = append(conditions, "received>="+criteria.Since.Format("2006-01-02"))
+	}
+	if !criteria.Before.IsZero() {
+		conditions = append(conditions, "received<"+criteria.Before.Format("2006-01-02"))
+	}
+	if !criteria.SentSince.IsZero() {
+		conditions = append(conditions, "sent>="+criteria.SentSince.Format("2006-01-02"))
+	}
+	if !criteria.SentBefore.IsZero() {
+		conditions = append(conditions, "sent<"+criteria.SentBefore.Format("2006-01-02"))
+	}
+	if criteria.Larger > 0 {
+		conditions = append(conditions, fmt.Sprintf("size>%d", criteria.Larger))
+	}
+	if criteria.Smaller > 0 {
+		conditions = append(conditions, fmt.Sprintf("size<%d", criteria.Smaller))
+	}
+
+	for _, not := range criteria.Not {
+		if kql := searchKQL(not); kql != "" {
+			conditions = append(conditions, "NOT ("+kql+")")
+		}
+	}
+	for _, or := range criteria.Or {
+		left, right := searchKQL(or[0]), searchKQL(or[1])
+		if left != "" && right != "" {
+			conditions = append(conditions, "(("+left+") OR ("+right+"))")
+		}
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// matchesFlags evaluates the flag criteria searchKQL leaves out, including
+// those of negations that only test flags
+func matchesFlags(criteria *imap.SearchCriteria, flags []string) bool {
+	for _, flag := range criteria.WithFlags {
+		if !hasFlag(flags, flag) {
+			return false
+		}
+	}
+	for _, flag := range criteria.WithoutFlags {
+		if hasFlag(flags, flag) {
+			return false
+		}
+	}
+	for _, not := range criteria.Not {
+		if searchKQL(not) == "" && (len(not.WithFlags) > 0 || len(not.WithoutFlags) > 0) && matchesFlags(not, flags) {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchUIDs returns the UIDs of the messages in a folder matching criteria
+func (c *GraphClient) SearchUIDs(folderName string, criteria *imap.SearchCriteria) ([]uint32, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	// Flags are matched against the synced folder
+	if err := c.sync(folder); err != nil {
+		return nil, err
+	}
+	flags := c.ids.flags(folder.ID, 0)
+
+	var uids []uint32
+	if kql := searchKQL(criteria); kql != "" {
+		ids, err := c.folderMessageIDs(folder, url.Values{"$search": {`"` + kql + `"`}})
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			uids = append(uids, c.ids.uid(id))
+		}
+	} else {
+		for uid := range flags {
+			uids = append(uids, uid)
+		}
+	}
+
+	matching := make([]uint32, 0, len(uids))
+	for _, uid := range uids {
+		if criteria.Uid != nil && !criteria.Uid.Contains(uid) {
+			continue
+		}
+		if messageFlags, ok := flags[uid]; ok && !matchesFlags(criteria, messageFlags) {
+			continue
+		}
+		matching = append(matching, uid)
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i] < matching[j] })
+	return matching, nil
+}
+
+// FetchHeaders returns the full headers and MIME structure of a message
+func (c *GraphClient) FetchHeaders(folderName, uid string) (*models.MessageHeaders, error) {
+	id, err := c.messageID(uid)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := c.download(messagePath(id) + "/$value")
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+	return rawHeaders(raw)
+}
+
+// fetchPart downloads the attachment of a message chosen by pick
+func (c *GraphClient) fetchPart(uid string, pick func([]graphAttachment, map[string]graphAttachment) (graphAttachment, bool)) (*models.Attachment, error) {
+	id, err := c.messageID(uid)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Value []graphAttachment `json:"value"`
+	}
+	if err := c.get(messagePath(id)+"/attachments", &list); err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+
+	part, ok := pick(splitGraphAttachments(list.Value))
+	if !ok {
+		return nil, fmt.Errorf("attachment not found")
+	}
+	content := part.ContentBytes
+	if content == nil {
+		// Attached messages and other items have no content bytes
+		if content, err = c.download(messagePath(id) + "/attachments/" + url.PathEscape(part.ID) + "/$value"); err != nil {
+			return nil, err
+		}
+	}
+	return &models.Attachment{
+		Filename:    part.Name,
+		ContentType: strings.ToLower(part.ContentType),
+		Part:        part.ID,
+		Size:        len(content),
+		Content:     content,
+	}, nil
+}
+
+// FetchAttachment fetches the content of the index-th attachment of a message
+func (c *GraphClient) FetchAttachment(folderName, uid string, index int) (*models.Attachment, error) {
+	return c.fetchPart(uid, func(parts []graphAttachment, _ map[string]graphAttachment) (graphAttachment, bool) {
+		if index < 0 || index >= len(parts) {
+			return graphAttachment{}, false
+		}
+		return parts[index], true
+	})
+}
+
+// FetchInlinePart fetches the content of the inline part a cid: URL in the
+// message's HTML refers to
+func (c *GraphClient) FetchInlinePart(folderName, uid, contentID string) (*models.Attachment, error) {
+	return c.fetchPart(uid, func(_ []graphAttachment, inline map[string]graphAttachment) (graphAttachment, bool) {
+		part, ok := inline[normalizeContentID(contentID)]
+		return part, ok
+	})
+}
+
+// updateMessage applies a patch to the message with a UID
+func (c *GraphClient) updateMessage(uid string, patch map[string]interface{}) error {
+	id, err := c.messageID(uid)
+	if err != nil {
+		return err
+	}
+	return c.call(http.MethodPatch, messagePath(id), patch, nil)
+}
+
+// MarkMessageAsRead marks a message as read
+func (c *GraphClient) MarkMessageAsRead(folderName, uid string) error {
+	return c.updateMessage(uid, map[string]interface{}{"isRead": true})
+}
+
+// MarkMessageAsUnread marks a message as unread
+func (c *GraphClient) MarkMessageAsUnread(folderName, uid string) error {
+	return c.updateMessage(uid, map[string]interface{}{"isRead": false})
+}
+
+// flagPatch returns the properties that add or remove flags. Graph has no
+// place for flags other than \Seen and \Flagged, which are left out.
+func flagPatch(flags []string, add bool) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for _, flag := range flags {
+		switch flag {
+		case imap.SeenFlag:
+			patch["isRead"] = add
+		case imap.FlaggedFlag:
+			status := "notFlagged"
+			if add {
+				status = "flagged"
+			}
+			patch["flag"] = map[string]string{"flagStatus": status}
+		}
+	}
+	return patch
+}
+
+// SetFlags adds flags to a message, or removes them when add is false
+func (c *GraphClient) SetFlags(folderName, uid string, flags []string, add bool) error {
+	patch := flagPatch(flags, add)
+	if len(patch) == 0 {
+		return nil
+	}
+	return c.updateMessage(uid, patch)
+}
+
+// AppendMessage stores a raw message in a folder with the given flags.
+// Graph keeps messages created from MIME as drafts.
+func (c *GraphClient) AppendMessage(folderName string, message []byte, flags []string) error {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(message)
+	if len(encoded) > graphMaxMIMESize {
+		return fmt.Errorf("message is too large for Microsoft 365 (at most %d MB)", graphMaxMIMESize>>20)
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	path := "/me/mailFolders/" + url.PathEscape(folder.ID) + "/messages"
+	if err := c.call(http.MethodPost, path, strings.NewReader(encoded), &created); err != nil {
+		return fmt.Errorf("error appending message to %s: %v", folderName, err)
+	}
+	if patch := flagPatch(flags, true); len(patch) > 0 {
+		return c.call(http.MethodPatch, messagePath(created.ID), patch, nil)
+	}
+	return nil
+}
+
+// MoveMessage moves a message from one folder to another. Its immutable id,
+// and so its UID, stays the same.
+func (c *GraphClient) MoveMessage(sourceFolder, targetFolder, uid string) error {
+	target, err := c.folder(targetFolder)
+	if err != nil {
+		return err
+	}
+	id, err := c.messageID(uid)
+	if err != nil {
+		return err
+	}
+	return c.call(http.MethodPost, messagePath(id)+"/move", map[string]string{"destinationId": target.ID}, nil)
+}
+
+// DeleteMessage permanently deletes a message
+func (c *GraphClient) DeleteMessage(folderName, uid string) error {
+	id, err := c.messageID(uid)
+	if err != nil {
+		return err
+	}
+	if err := c.call(http.MethodPost, messagePath(id)+"/permanentDelete", nil, nil); err != nil {
+		return err
+	}
+	c.ids.forget(id)
+	return nil
+}
+
+// SaveToSent does nothing: mail sent through Graph is already in Sent
+// Items, and other senders aren't used for Microsoft 365 accounts
+func (c *GraphClient) SaveToSent(to, subject, body string) error {
+	return nil
+}
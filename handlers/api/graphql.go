@@ -0,0 +1,693 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"lilmail/config"
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// GraphQLHandler answers GraphQL queries over the mail account and the
+// local stores, so dashboards can fetch exactly the fields they need from
+// several sources in one request. The schema is generated from the Go types
+// the queries return and served as SDL by GET without a query.
+//
+// Queries support aliases, variables, fragments and @include/@skip; there
+// are no mutations, subscriptions or introspection.
+type GraphQLHandler struct {
+	store      *session.Store
+	config     *config.Config
+	labels     *storage.LabelStorage
+	drafts     *storage.DraftStorage
+	recipients *storage.SentRecipientStorage
+}
+
+// NewGraphQLHandler creates a new GraphQL handler
+func NewGraphQLHandler(store *session.Store, cfg *config.Config, labels *storage.LabelStorage, drafts *storage.DraftStorage, recipients *storage.SentRecipientStorage) *GraphQLHandler {
+	return &GraphQLHandler{
+		store:      store,
+		config:     cfg,
+		labels:     labels,
+		drafts:     drafts,
+		recipients: recipients,
+	}
+}
+
+// GraphQLContact is someone the user has written to
+type GraphQLContact struct {
+	Address     string    `json:"address"`
+	LastWritten time.Time `json:"last_written"`
+}
+
+// GraphQLMessagePage is a page of a folder's messages
+type GraphQLMessagePage struct {
+	Messages   []MobileMessageHeader `json:"messages"`
+	Page       int                   `json:"page"`
+	PageSize   int                   `json:"page_size"`
+	Total      int                   `json:"total"`
+	TotalPages int                   `json:"total_pages"`
+	HasNext    bool                  `json:"has_next"`
+}
+
+// graphqlRootField is a field of the Query type
+type graphqlRootField struct {
+	name     string
+	describe string
+	args     []graphqlArg
+	result   reflect.Type
+	resolve  func(q *graphqlQuery, args graphqlArgs) (interface{}, error)
+}
+
+// graphqlArg is an argument of a root field, with its SDL type and default
+type graphqlArg struct {
+	name, typ string
+	value     interface{}
+}
+
+// graphqlArgs are the arguments a root field was given, or their defaults
+type graphqlArgs map[string]interface{}
+
+func (a graphqlArgs) String(name string) string {
+	s, _ := a[name].(string)
+	return s
+}
+
+func (a graphqlArgs) Int(name string) int {
+	n, _ := a[name].(float64)
+	return int(n)
+}
+
+// graphqlRoot is the Query type, its fields in the order of the schema
+var graphqlRoot = []graphqlRootField{
+	{
+		name:     "folders",
+		describe: "Selectable folders with their message counts",
+		result:   reflect.TypeOf([]MobileFolder{}),
+		resolve:  (*graphqlQuery).folders,
+	},
+	{
+		name:     "messages",
+		describe: "A page of a folder's messages, newest first",
+		args:     []graphqlArg{{"folder", "String", "INBOX"}, {"page", "Int", float64(1)}, {"page_size", "Int", float64(mobileDefaultPageSize)}},
+		result:   reflect.TypeOf(GraphQLMessagePage{}),
+		resolve:  (*graphqlQuery).messages,
+	},
+	{
+		name:     "message",
+		describe: "A message with its body and attachments",
+		args:     []graphqlArg{{"folder", "String", "INBOX"}, {"id", "ID!", nil}},
+		result:   reflect.TypeOf(MobileMessage{}),
+		resolve:  (*graphqlQuery).message,
+	},
+	{
+		name:     "threads",
+		describe: "A page of a folder's conversations, latest first",
+		args:     []graphqlArg{{"folder", "String", "INBOX"}, {"page", "Int", float64(1)}, {"page_size", "Int", float64(mobileDefaultPageSize)}},
+		result:   reflect.TypeOf([]*models.EmailThread{}),
+		resolve:  (*graphqlQuery).threads,
+	},
+	{
+		name:     "labels",
+		describe: "The user's labels",
+		result:   reflect.TypeOf([]models.Label{}),
+		resolve:  (*graphqlQuery).labelList,
+	},
+	{
+		name:     "contacts",
+		describe: "Addresses the user has written to, most recent first",
+		result:   reflect.TypeOf([]GraphQLContact{}),
+		resolve:  (*graphqlQuery).contacts,
+	},
+	{
+		name:     "drafts",
+		describe: "Drafts of the current account, last changed first",
+		result:   reflect.TypeOf([]*models.Draft{}),
+		resolve:  (*graphqlQuery).draftList,
+	},
+}
+
+// graphqlQuery is a query being answered. The mail account is connected to
+// on first use, and only if a field needs it.
+type graphqlQuery struct {
+	h      *GraphQLHandler
+	c      *fiber.Ctx
+	client MailClient
+}
+
+func (q *graphqlQuery) mail() (MailClient, error) {
+	if q.client != nil {
+		return q.client, nil
+	}
+	credentials, err := GetCredentials(q.c, q.h.store, q.h.config.Encryption.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session")
+	}
+	if q.client, err = NewMailClient(credentials, q.h.config); err != nil {
+		utils.Log.Error("GraphQL failed to connect for %s: %v", credentials.Email, err)
+		return nil, fmt.Errorf("failed to connect to email server")
+	}
+	return q.client, nil
+}
+
+// userID is who local stores keep data under, as cacheUserID in web
+func (q *graphqlQuery) userID() string {
+	if userID, ok := q.c.Locals("userId").(string); ok && userID != "" {
+		return userID
+	}
+	return GetSessionUser(q.c)
+}
+
+// pageArgs checks the paging arguments of a field
+func pageArgs(args graphqlArgs) (uint32, uint32, error) {
+	page, pageSize := args.Int("page"), args.Int("page_size")
+	if page < 1 {
+		return 0, 0, fmt.Errorf("page must be 1 or more")
+	}
+	if pageSize < 1 || pageSize > mobileMaxPageSize {
+		return 0, 0, fmt.Errorf("page_size must be between 1 and %d", mobileMaxPageSize)
+	}
+	return uint32(page), uint32(pageSize), nil
+}
+
+func (q *graphqlQuery) folders(args graphqlArgs) (interface{}, error) {
+	client, err := q.mail()
+	if err != nil {
+		return nil, err
+	}
+	folders, err := mobileFolders(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch folders")
+	}
+	return folders, nil
+}
+
+func (q *graphqlQuery) messages(args graphqlArgs) (interface{}, error) {
+	page, pageSize, err := pageArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	client, err := q.mail()
+	if err != nil {
+		return nil, err
+	}
+	folder := args.String("folder")
+	paginated, err := client.FetchMessagesPaginated(folder, page, pageSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch messages of %s", folder)
+	}
+
+	result := GraphQLMessagePage{
+		Messages:   make([]MobileMessageHeader, 0, len(paginated.Emails)),
+		Page:       int(paginated.Page),
+		PageSize:   int(paginated.PageSize),
+		Total:      int(paginated.TotalEmails),
+		TotalPages: int(paginated.TotalPages),
+		HasNext:    paginated.HasNext,
+	}
+	for _, email := range paginated.Emails {
+		result.Messages = append(result.Messages, mobileHeader(folder, email))
+	}
+	return result, nil
+}
+
+func (q *graphqlQuery) message(args graphqlArgs) (interface{}, error) {
+	id := args.String("id")
+	if _, err := parseUID(id); err != nil {
+		return nil, fmt.Errorf("invalid message id %q", id)
+	}
+	client, err := q.mail()
+	if err != nil {
+		return nil, err
+	}
+	folder := args.String("folder")
+	email, err := client.FetchSingleMessage(folder, id)
+	if err != nil {
+		return nil, fmt.Errorf("message %s not found in %s", id, folder)
+	}
+	return mobileMessage(folder, email), nil
+}
+
+func (q *graphqlQuery) threads(args graphqlArgs) (interface{}, error) {
+	page, pageSize, err := pageArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	client, err := q.mail()
+	if err != nil {
+		return nil, err
+	}
+	folder := args.String("folder")
+	threads, _, err := client.FetchThreads(folder, page, pageSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch threads of %s", folder)
+	}
+	return threads, nil
+}
+
+func (q *graphqlQuery) labelList(args graphqlArgs) (interface{}, error) {
+	if q.h.labels == nil {
+		return []models.Label{}, nil
+	}
+	labels, err := q.h.labels.GetLabelsByUser(GetSessionUser(q.c))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load labels")
+	}
+	return labels, nil
+}
+
+func (q *graphqlQuery) contacts(args graphqlArgs) (interface{}, error) {
+	recipients, err := q.h.recipients.GetRecipients(q.userID())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load contacts")
+	}
+	contacts := make([]GraphQLContact, 0, len(recipients))
+	for address, last := range recipients {
+		contacts = append(contacts, GraphQLContact{Address: address, LastWritten: last})
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].LastWritten.After(contacts[j].LastWritten)
+	})
+	return contacts, nil
+}
+
+func (q *graphqlQuery) draftList(args graphqlArgs) (interface{}, error) {
+	userID, _ := q.c.Locals("userId").(string)
+	if userID == "" {
+		return []*models.Draft{}, nil
+	}
+	sess, err := q.h.store.Get(q.c)
+	if err != nil {
+		return nil, fmt.Errorf("session error")
+	}
+	accountID, _ := sess.Get("accountId").(string)
+	drafts, err := q.h.drafts.GetDrafts(userID, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load drafts")
+	}
+	return drafts, nil
+}
+
+// graphqlRequest is a GraphQL request, posted as JSON or given as ?query=
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphqlError is an error of a GraphQL response, with the path of the
+// field it happened in
+type graphqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// Schema serves the schema as SDL, and runs ?query= if one is given
+func (h *GraphQLHandler) Schema(c *fiber.Ctx) error {
+	if c.Query("query") != "" {
+		req := graphqlRequest{Query: c.Query("query"), OperationName: c.Query("operationName")}
+		if vars := c.Query("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				return graphqlFail(c, "variables must be a JSON object")
+			}
+		}
+		return h.run(c, req)
+	}
+	c.Set(fiber.HeaderContentType, "application/graphql; charset=utf-8")
+	return c.SendString(graphqlSDL())
+}
+
+// Query runs a posted query
+func (h *GraphQLHandler) Query(c *fiber.Ctx) error {
+	var req graphqlRequest
+	if err := c.BodyParser(&req); err != nil {
+		return graphqlFail(c, "Invalid request")
+	}
+	return h.run(c, req)
+}
+
+// graphqlFail answers a request that could not be run at all
+func graphqlFail(c *fiber.Ctx, message string) error {
+	return c.Status(400).JSON(fiber.Map{
+		"errors": []graphqlError{{Message: message}},
+	})
+}
+
+func (h *GraphQLHandler) run(c *fiber.Ctx, req graphqlRequest) error {
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return graphqlFail(c, err.Error())
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return graphqlFail(c, err.Error())
+	}
+	if op.kind != "query" {
+		return graphqlFail(c, "only queries are supported, not "+op.kind+"s")
+	}
+
+	variables := make(map[string]interface{}, len(op.defaults)+len(req.Variables))
+	for name, value := range op.defaults {
+		variables[name] = value
+	}
+	for name, value := range req.Variables {
+		variables[name] = value
+	}
+	fields, err := doc.fields(op.selection, variables, 0)
+	if err != nil {
+		return graphqlFail(c, err.Error())
+	}
+
+	q := &graphqlQuery{h: h, c: c}
+	defer func() {
+		if q.client != nil {
+			q.client.Close()
+		}
+	}()
+
+	data := make(graphqlObject, 0, len(fields))
+	var errs []graphqlError
+	for _, field := range fields {
+		value, err := q.resolveRoot(field)
+		if err != nil {
+			errs = append(errs, graphqlError{Message: err.Error(), Path: []interface{}{field.Key()}})
+			value = nil
+		}
+		data = append(data, graphqlEntry{field.Key(), value})
+	}
+
+	response := fiber.Map{"data": data}
+	if len(errs) > 0 {
+		response["errors"] = errs
+	}
+	return c.JSON(response)
+}
+
+// resolveRoot resolves a field of the Query type and selects the requested
+// fields of its result
+func (q *graphqlQuery) resolveRoot(field gqlField) (interface{}, error) {
+	if field.Name == "__typename" {
+		return "Query", nil
+	}
+	var root *graphqlRootField
+	for i := range graphqlRoot {
+		if graphqlRoot[i].name == field.Name {
+			root = &graphqlRoot[i]
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("cannot query field %q on type \"Query\"", field.Name)
+	}
+
+	args := make(graphqlArgs, len(root.args))
+	known := make(map[string]bool, len(root.args))
+	for _, arg := range root.args {
+		known[arg.name] = true
+		value, given := field.Args[arg.name]
+		if !given || value == nil {
+			value = arg.value
+		}
+		if value == nil && strings.HasSuffix(arg.typ, "!") {
+			return nil, fmt.Errorf("argument %q of field %q is required", arg.name, field.Name)
+		}
+		// IDs may be given as numbers
+		if n, ok := value.(float64); ok && strings.HasPrefix(arg.typ, "ID") {
+			value = fmt.Sprint(int64(n))
+		}
+		if err := graphqlCheckArg(arg, value); err != nil {
+			return nil, fmt.Errorf("argument %q of field %q: %v", arg.name, field.Name, err)
+		}
+		args[arg.name] = value
+	}
+	for name := range field.Args {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown argument %q on field %q", name, field.Name)
+		}
+	}
+
+	result, err := root.resolve(q, args)
+	if err != nil {
+		return nil, err
+	}
+	return graphqlSelect(reflect.ValueOf(result), field)
+}
+
+// graphqlCheckArg checks that an argument has the type the schema gives it
+func graphqlCheckArg(arg graphqlArg, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	switch strings.TrimSuffix(arg.typ, "!") {
+	case "String", "ID":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("expected a string")
+		}
+	case "Int":
+		if n, ok := value.(float64); !ok || n != float64(int64(n)) {
+			return fmt.Errorf("expected an integer")
+		}
+	}
+	return nil
+}
+
+// graphqlObject is an object of a response, which keeps its fields in the
+// order they were selected in
+type graphqlObject []graphqlEntry
+
+type graphqlEntry struct {
+	key   string
+	value interface{}
+}
+
+func (o graphqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, entry := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(entry.key)
+		value, err := json.Marshal(entry.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	timeType          = reflect.TypeOf(time.Time{})
+)
+
+// graphqlSelect picks the selected fields of a value. Objects are structs,
+// whose fields are named by their JSON names, like the REST API's.
+func graphqlSelect(v reflect.Value, field gqlField) (interface{}, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+
+	if graphqlIsScalar(v.Type()) {
+		if len(field.Selection) > 0 {
+			return nil, fmt.Errorf("field %q of type %q has no subfields", field.Name, graphqlTypeName(v.Type()))
+		}
+		return v.Interface(), nil
+	}
+
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			item, err := graphqlSelect(v.Index(i), field)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = item
+		}
+		return list, nil
+	}
+
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("field %q can't be queried", field.Name)
+	}
+	if len(field.Selection) == 0 {
+		return nil, fmt.Errorf("field %q of type %q must have a selection of subfields", field.Name, graphqlTypeName(v.Type()))
+	}
+
+	fields := graphqlFields(v.Type())
+	object := make(graphqlObject, 0, len(field.Selection))
+	for _, sub := range field.Selection {
+		if sub.Name == "__typename" {
+			object = append(object, graphqlEntry{sub.Key(), graphqlTypeName(v.Type())})
+			continue
+		}
+		index, ok := fields[sub.Name]
+		if !ok {
+			return nil, fmt.Errorf("cannot query field %q on type %q", sub.Name, graphqlTypeName(v.Type()))
+		}
+		if len(sub.Args) > 0 {
+			return nil, fmt.Errorf("field %q takes no arguments", sub.Name)
+		}
+		value, err := graphqlSelect(v.FieldByIndex(index), sub)
+		if err != nil {
+			return nil, err
+		}
+		object = append(object, graphqlEntry{sub.Key(), value})
+	}
+	return object, nil
+}
+
+// graphqlIsScalar reports whether values of a type are leaves of a result
+func graphqlIsScalar(t reflect.Type) bool {
+	if t == timeType || t.Implements(jsonMarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Ptr, reflect.Interface, reflect.Map:
+		return false
+	case reflect.Slice, reflect.Array:
+		return t.Elem().Kind() == reflect.Uint8
+	}
+	return true
+}
+
+// graphqlFields returns the queryable fields of a struct by JSON name, with
+// those of embedded structs. Fields hidden from JSON are left out.
+func graphqlFields(t reflect.Type) map[string][]int {
+	fields := make(map[string][]int)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for sub, index := range graphqlFields(f.Type) {
+				if _, ok := fields[sub]; !ok {
+					fields[sub] = append([]int{i}, index...)
+				}
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Index
+	}
+	return fields
+}
+
+// graphqlTypeNames names the types whose Go names don't make their GraphQL
+// names, or would clash with another's
+var graphqlTypeNames = map[reflect.Type]string{
+	reflect.TypeOf(models.EmailThread{}): "Thread",
+	reflect.TypeOf(models.Attachment{}):  "EmailAttachment",
+}
+
+// graphqlTypeName names the GraphQL type of a Go type
+func graphqlTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return "DateTime"
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return "[" + graphqlTypeName(t.Elem()) + "]"
+	case t.Kind() == reflect.Bool:
+		return "Boolean"
+	case t.Kind() == reflect.String:
+		return "String"
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return "Int"
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return "Float"
+	case t.Kind() == reflect.Struct:
+		if name, ok := graphqlTypeNames[t]; ok {
+			return name
+		}
+		return strings.TrimPrefix(strings.TrimPrefix(t.Name(), "Mobile"), "GraphQL")
+	}
+	return "JSON"
+}
+
+// graphqlSDL writes the schema: the Query type and every object type it
+// reaches
+func graphqlSDL() string {
+	var b strings.Builder
+	b.WriteString("# Dates are RFC 3339 strings\nscalar DateTime\n\ntype Query {\n")
+	var types []reflect.Type
+	for _, root := range graphqlRoot {
+		fmt.Fprintf(&b, "  # %s\n  %s", root.describe, root.name)
+		if len(root.args) > 0 {
+			var args []string
+			for _, arg := range root.args {
+				s := arg.name + ": " + arg.typ
+				if arg.value != nil {
+					value, _ := json.Marshal(arg.value)
+					s += " = " + string(value)
+				}
+				args = append(args, s)
+			}
+			b.WriteString("(" + strings.Join(args, ", ") + ")")
+		}
+		b.WriteString(": " + graphqlTypeName(root.result) + "\n")
+		types = append(types, root.result)
+	}
+	b.WriteString("}\n")
+
+	seen := make(map[reflect.Type]bool)
+	for len(types) > 0 {
+		t := types[0]
+		types = types[1:]
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || graphqlIsScalar(t) || seen[t] {
+			continue
+		}
+		seen[t] = true
+
+		fields := graphqlFields(t)
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			a, b := fields[names[i]], fields[names[j]]
+			for k := 0; k < len(a) && k < len(b); k++ {
+				if a[k] != b[k] {
+					return a[k] < b[k]
+				}
+			}
+			return len(a) < len(b)
+		})
+
+		fmt.Fprintf(&b, "\ntype %s {\n", graphqlTypeName(t))
+		for _, name := range names {
+			ft := t.FieldByIndex(fields[name]).Type
+			fmt.Fprintf(&b, "  %s: %s\n", name, graphqlTypeName(ft))
+			types = append(types, ft)
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,629 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// gqlField is a field selected by a GraphQL query
+type gqlField struct {
+	Alias     string
+	Name      string
+	Args      map[string]interface{}
+	Selection []gqlField
+}
+
+// Key returns the name of the field in the result
+func (f gqlField) Key() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+// gqlDocument is a parsed GraphQL document: its operations by name ("" for
+// an anonymous one) and its fragments, kept as their selections
+type gqlDocument struct {
+	operations map[string]*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind      string // query, mutation or subscription
+	defaults  map[string]interface{}
+	selection []gqlRawSelection
+}
+
+type gqlFragment struct {
+	selection []gqlRawSelection
+}
+
+// gqlRawSelection is a selection as written: a field, a named fragment
+// spread or an inline fragment, with its @include and @skip directives
+type gqlRawSelection struct {
+	alias      string
+	name       string
+	args       map[string]gqlValue
+	directives map[string]map[string]gqlValue
+	selection  []gqlRawSelection
+	spread     string            // Fragment name of ...Name
+	inline     []gqlRawSelection // Selection of ... on Type { }
+	isInline   bool
+}
+
+// gqlValue is an argument value: a literal, or a variable to look up
+type gqlValue struct {
+	literal  interface{}
+	variable string
+	list     []gqlValue
+	object   map[string]gqlValue
+	kind     byte // 'l' literal, 'v' variable, '[' list, '{' object
+}
+
+// parseGraphQL parses a GraphQL document
+func parseGraphQL(source string) (*gqlDocument, error) {
+	p := &gqlParser{src: source}
+	p.next()
+
+	doc := &gqlDocument{
+		operations: make(map[string]*gqlOperation),
+		fragments:  make(map[string]*gqlFragment),
+	}
+	for p.tok != "" {
+		switch {
+		case p.tok == "{":
+			op, err := p.operation("query")
+			if err != nil {
+				return nil, err
+			}
+			if err := doc.addOperation("", op); err != nil {
+				return nil, err
+			}
+		case p.tok == "query" || p.tok == "mutation" || p.tok == "subscription":
+			kind := p.tok
+			p.next()
+			name := ""
+			if p.isName() {
+				name = p.tok
+				p.next()
+			}
+			op, err := p.operation(kind)
+			if err != nil {
+				return nil, err
+			}
+			if err := doc.addOperation(name, op); err != nil {
+				return nil, err
+			}
+		case p.tok == "fragment":
+			p.next()
+			name := p.tok
+			if !p.isName() || name == "on" {
+				return nil, p.errorf("expected fragment name")
+			}
+			p.next()
+			if p.tok != "on" {
+				return nil, p.errorf("expected \"on\"")
+			}
+			p.next()
+			p.next() // Type condition; the schema has no interfaces to check it against
+			selection, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.fragments[name] = &gqlFragment{selection: selection}
+		default:
+			return nil, p.errorf("unexpected %q", p.tok)
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("the document has no operation")
+	}
+	return doc, nil
+}
+
+func (d *gqlDocument) addOperation(name string, op *gqlOperation) error {
+	if _, ok := d.operations[name]; ok {
+		return fmt.Errorf("operation %q is defined twice", name)
+	}
+	d.operations[name] = op
+	return nil
+}
+
+// operation picks the operation to run, the only one unless name is given
+func (d *gqlDocument) operation(name string) (*gqlOperation, error) {
+	if name == "" {
+		if len(d.operations) > 1 {
+			return nil, fmt.Errorf("operationName is required when the document has several operations")
+		}
+		for _, op := range d.operations {
+			return op, nil
+		}
+	}
+	op, ok := d.operations[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown operation %q", name)
+	}
+	return op, nil
+}
+
+// fields resolves an operation's selection against variables: fragments
+// are expanded, fields left out by @include or @skip dropped and variables
+// replaced by their values
+func (d *gqlDocument) fields(selection []gqlRawSelection, variables map[string]interface{}, depth int) ([]gqlField, error) {
+	if depth > 20 {
+		return nil, fmt.Errorf("the query is nested too deeply")
+	}
+
+	var fields []gqlField
+	for _, raw := range selection {
+		included, err := raw.included(variables)
+		if err != nil {
+			return nil, err
+		}
+		if !included {
+			continue
+		}
+
+		switch {
+		case raw.spread != "":
+			fragment, ok := d.fragments[raw.spread]
+			if !ok {
+				return nil, fmt.Errorf("unknown fragment %q", raw.spread)
+			}
+			expanded, err := d.fields(fragment.selection, variables, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, expanded...)
+		case raw.isInline:
+			expanded, err := d.fields(raw.inline, variables, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, expanded...)
+		default:
+			field := gqlField{Alias: raw.alias, Name: raw.name}
+			if len(raw.args) > 0 {
+				field.Args = make(map[string]interface{}, len(raw.args))
+				for name, value := range raw.args {
+					field.Args[name] = value.resolve(variables)
+				}
+			}
+			if raw.selection != nil {
+				if field.Selection, err = d.fields(raw.selection, variables, depth+1); err != nil {
+					return nil, err
+				}
+			}
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// included applies the @include(if:) and @skip(if:) directives
+func (s gqlRawSelection) included(variables map[string]interface{}) (bool, error) {
+	for name, args := range s.directives {
+		value, ok := args["if"]
+		if !ok {
+			return false, fmt.Errorf("directive @%s needs an \"if\" argument", name)
+		}
+		condition, _ := value.resolve(variables).(bool)
+		switch name {
+		case "include":
+			if !condition {
+				return false, nil
+			}
+		case "skip":
+			if condition {
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("unknown directive @%s", name)
+		}
+	}
+	return true, nil
+}
+
+func (v gqlValue) resolve(variables map[string]interface{}) interface{} {
+	switch v.kind {
+	case 'v':
+		return variables[v.variable]
+	case '[':
+		list := make([]interface{}, len(v.list))
+		for i, item := range v.list {
+			list[i] = item.resolve(variables)
+		}
+		return list
+	case '{':
+		object := make(map[string]interface{}, len(v.object))
+		for name, item := range v.object {
+			object[name] = item.resolve(variables)
+		}
+		return object
+	}
+	return v.literal
+}
+
+// gqlParser reads a GraphQL document token by token. tok is the current
+// token: a punctuator, a name, or a number or string literal, with str set
+// for strings; "" at the end.
+type gqlParser struct {
+	src   string
+	pos   int
+	tok   string
+	str   bool
+	start int
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	line := strings.Count(p.src[:p.start], "\n") + 1
+	return fmt.Errorf("syntax error at line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *gqlParser) isName() bool {
+	if p.str || p.tok == "" {
+		return false
+	}
+	return isNameStart(p.tok[0])
+}
+
+// isNameStart reports whether a GraphQL name can start with ch
+func isNameStart(ch byte) bool {
+	return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
+
+// next moves to the next token, skipping white space, commas and comments
+func (p *gqlParser) next() {
+	p.str = false
+	for p.pos < len(p.src) {
+		ch := p.src[p.pos]
+		if ch == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		if ch == ',' || ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	p.start = p.pos
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return
+	}
+
+	ch := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+	case strings.ContainsRune("{}()[]:$!=@|&", rune(ch)):
+		p.pos++
+	case ch == '"':
+		p.readString()
+		return
+	case ch == '-' || (ch >= '0' && ch <= '9'):
+		p.pos++
+		for p.pos < len(p.src) && strings.ContainsRune("0123456789.eE+-", rune(p.src[p.pos])) {
+			p.pos++
+		}
+	case isNameStart(ch):
+		for p.pos < len(p.src) && (isNameStart(p.src[p.pos]) || p.src[p.pos] >= '0' && p.src[p.pos] <= '9') {
+			p.pos++
+		}
+	default:
+		p.pos++
+	}
+	p.tok = p.src[p.start:p.pos]
+}
+
+// readString reads a string literal into tok, unescaped
+func (p *gqlParser) readString() {
+	p.str = true
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end < 0 {
+			p.tok, p.pos = p.src[p.pos+3:], len(p.src)
+			return
+		}
+		p.tok = strings.ReplaceAll(p.src[p.pos+3:p.pos+3+end], `\"""`, `"""`)
+		p.pos += end + 6
+		return
+	}
+
+	var b strings.Builder
+	p.pos++
+	for p.pos < len(p.src) && p.src[p.pos] != '"' && p.src[p.pos] != '\n' {
+		ch := p.src[p.pos]
+		if ch != '\\' || p.pos+1 >= len(p.src) {
+			b.WriteByte(ch)
+			p.pos++
+			continue
+		}
+		p.pos++
+		switch esc := p.src[p.pos]; esc {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if p.pos+4 < len(p.src) {
+				if r, err := strconv.ParseUint(p.src[p.pos+1:p.pos+5], 16, 32); err == nil {
+					b.WriteRune(rune(r))
+					p.pos += 4
+				}
+			}
+		default:
+			b.WriteByte(esc)
+		}
+		p.pos++
+	}
+	p.pos++ // Closing quote
+	p.tok = b.String()
+}
+
+func (p *gqlParser) expect(tok string) error {
+	if p.tok != tok || p.str {
+		if p.tok == "" {
+			return p.errorf("expected %q, found the end of the document", tok)
+		}
+		return p.errorf("expected %q, found %q", tok, p.tok)
+	}
+	p.next()
+	return nil
+}
+
+// operation reads what follows the operation keyword and name
+func (p *gqlParser) operation(kind string) (*gqlOperation, error) {
+	op := &gqlOperation{kind: kind, defaults: make(map[string]interface{})}
+	if p.tok == "(" {
+		p.next()
+		for p.tok != ")" {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			name := p.tok
+			p.next()
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if err := p.skipType(); err != nil {
+				return nil, err
+			}
+			if p.tok == "=" {
+				p.next()
+				value, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				op.defaults[name] = value.resolve(nil)
+			}
+		}
+		p.next()
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+
+	selection, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selection = selection
+	return op, nil
+}
+
+// skipType reads a variable type, like [String!]!
+func (p *gqlParser) skipType() error {
+	if p.tok == "[" {
+		p.next()
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else {
+		if !p.isName() {
+			return p.errorf("expected a type")
+		}
+		p.next()
+	}
+	if p.tok == "!" {
+		p.next()
+	}
+	return nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlRawSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	selection := []gqlRawSelection{}
+	for p.tok != "}" {
+		if p.tok == "" {
+			return nil, p.errorf("unterminated selection set")
+		}
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selection = append(selection, s)
+	}
+	p.next()
+	return selection, nil
+}
+
+func (p *gqlParser) selection() (gqlRawSelection, error) {
+	var s gqlRawSelection
+	var err error
+
+	if p.tok == "..." {
+		p.next()
+		if p.tok == "on" || p.tok == "{" || p.tok == "@" {
+			if p.tok == "on" {
+				p.next()
+				p.next() // Type condition
+			}
+			s.isInline = true
+			if s.directives, err = p.directives(); err != nil {
+				return s, err
+			}
+			s.inline, err = p.selectionSet()
+			return s, err
+		}
+		if !p.isName() {
+			return s, p.errorf("expected a fragment name")
+		}
+		s.spread = p.tok
+		p.next()
+		s.directives, err = p.directives()
+		return s, err
+	}
+
+	if !p.isName() {
+		return s, p.errorf("expected a field, found %q", p.tok)
+	}
+	s.name = p.tok
+	p.next()
+	if p.tok == ":" {
+		p.next()
+		if !p.isName() {
+			return s, p.errorf("expected a field after alias %q", s.name)
+		}
+		s.alias, s.name = s.name, p.tok
+		p.next()
+	}
+	if p.tok == "(" {
+		if s.args, err = p.arguments(); err != nil {
+			return s, err
+		}
+	}
+	if s.directives, err = p.directives(); err != nil {
+		return s, err
+	}
+	if p.tok == "{" {
+		if s.selection, err = p.selectionSet(); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+func (p *gqlParser) arguments() (map[string]gqlValue, error) {
+	args := make(map[string]gqlValue)
+	p.next()
+	for p.tok != ")" {
+		if !p.isName() {
+			return nil, p.errorf("expected an argument name, found %q", p.tok)
+		}
+		name := p.tok
+		p.next()
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		args[name] = value
+	}
+	p.next()
+	return args, nil
+}
+
+func (p *gqlParser) directives() (map[string]map[string]gqlValue, error) {
+	var directives map[string]map[string]gqlValue
+	for p.tok == "@" {
+		p.next()
+		name := p.tok
+		p.next()
+		args := map[string]gqlValue{}
+		if p.tok == "(" {
+			var err error
+			if args, err = p.arguments(); err != nil {
+				return nil, err
+			}
+		}
+		if directives == nil {
+			directives = make(map[string]map[string]gqlValue)
+		}
+		directives[name] = args
+	}
+	return directives, nil
+}
+
+func (p *gqlParser) value() (gqlValue, error) {
+	tok, str := p.tok, p.str
+	switch {
+	case tok == "" && !str:
+		return gqlValue{}, p.errorf("expected a value, found the end of the document")
+	case str:
+		p.next()
+		return gqlValue{kind: 'l', literal: tok}, nil
+	case tok == "$":
+		p.next()
+		name := p.tok
+		p.next()
+		return gqlValue{kind: 'v', variable: name}, nil
+	case tok == "[":
+		p.next()
+		list := gqlValue{kind: '['}
+		for p.tok != "]" {
+			item, err := p.value()
+			if err != nil {
+				return gqlValue{}, err
+			}
+			list.list = append(list.list, item)
+		}
+		p.next()
+		return list, nil
+	case tok == "{":
+		p.next()
+		object := gqlValue{kind: '{', object: map[string]gqlValue{}}
+		for p.tok != "}" {
+			name := p.tok
+			p.next()
+			if err := p.expect(":"); err != nil {
+				return gqlValue{}, err
+			}
+			item, err := p.value()
+			if err != nil {
+				return gqlValue{}, err
+			}
+			object.object[name] = item
+		}
+		p.next()
+		return object, nil
+	case tok == "-" || (tok[0] >= '0' && tok[0] <= '9'):
+		p.next()
+		if n, err := strconv.ParseInt(tok, 10, 64); err == nil {
+			return gqlValue{kind: 'l', literal: float64(n)}, nil
+		}
+		f, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return gqlValue{}, p.errorf("invalid number %q", tok)
+		}
+		return gqlValue{kind: 'l', literal: f}, nil
+	case tok == "true" || tok == "false":
+		p.next()
+		return gqlValue{kind: 'l', literal: tok == "true"}, nil
+	case tok == "null":
+		p.next()
+		return gqlValue{kind: 'l'}, nil
+	case p.isName():
+		// Enum values are passed on as strings
+		p.next()
+		return gqlValue{kind: 'l', literal: tok}, nil
+	}
+	return gqlValue{}, p.errorf("unexpected %q", tok)
+}
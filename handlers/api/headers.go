@@ -0,0 +1,196 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"lilmail/models"
+	"lilmail/utils"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// FetchHeaders fetches the full header of a message and its MIME structure
+func (c *Client) FetchHeaders(folderName, uid string) (*models.MessageHeaders, error) {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID: %v", err)
+	}
+
+	if _, err := c.client.Select(folderName, true); err != nil {
+		return nil, fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uidNum)
+
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier},
+		Peek:         true,
+	}
+	msg, err := c.fetchOne(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchBodyStructure, section.FetchItem()})
+	if err != nil {
+		return nil, err
+	}
+
+	r := msg.GetBody(section)
+	if r == nil {
+		return nil, fmt.Errorf("no header returned for message %s", uid)
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+
+	return newMessageHeaders(string(raw), messageParts(msg.BodyStructure)), nil
+}
+
+// newMessageHeaders describes a message from its raw header and parts
+func newMessageHeaders(raw string, parts []models.MessagePart) *models.MessageHeaders {
+	headers := &models.MessageHeaders{
+		Headers:               parseHeaderFields(raw),
+		Received:              []models.ReceivedHop{},
+		AuthenticationResults: []string{},
+		Parts:                 parts,
+		Raw:                   raw,
+	}
+
+	var received []string
+	for _, field := range headers.Headers {
+		switch strings.ToLower(field.Name) {
+		case "received":
+			received = append(received, field.Value)
+		case "authentication-results", "arc-authentication-results":
+			headers.AuthenticationResults = append(headers.AuthenticationResults, field.Value)
+		}
+	}
+	headers.Received = receivedChain(received)
+
+	return headers
+}
+
+// parseHeaderFields splits a raw header into its fields, keeping their order
+// and repeats, unfolding continuation lines and decoding encoded-words
+func parseHeaderFields(raw string) []models.HeaderField {
+	fields := []models.HeaderField{}
+
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			last := &fields[len(fields)-1]
+			last.Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, models.HeaderField{
+			Name:  strings.TrimSpace(name),
+			Value: strings.TrimSpace(value),
+		})
+	}
+
+	for i := range fields {
+		fields[i].Value = utils.DecodeHeader(fields[i].Value)
+	}
+	return fields
+}
+
+// receivedChain parses Received headers, which servers prepend, into hops
+// in delivery order with the delay at each hop
+func receivedChain(values []string) []models.ReceivedHop {
+	hops := make([]models.ReceivedHop, 0, len(values))
+
+	for i := len(values) - 1; i >= 0; i-- {
+		hop := parseReceived(values[i])
+		if n := len(hops); n > 0 && !hop.Date.IsZero() && !hops[n-1].Date.IsZero() {
+			hop.Delay = int(hop.Date.Sub(hops[n-1].Date).Seconds())
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// parseReceived reads the from, by and with clauses and the date of a
+// Received header like "from a.example (a.example [192.0.2.1]) by
+// mx.example with ESMTPS id 123; Tue, 1 Oct 2024 10:00:00 +0000"
+func parseReceived(value string) models.ReceivedHop {
+	hop := models.ReceivedHop{Raw: value}
+
+	clauses := value
+	if i := strings.LastIndex(value, ";"); i >= 0 {
+		clauses = value[:i]
+		if date, err := mail.ParseDate(strings.TrimSpace(value[i+1:])); err == nil {
+			hop.Date = date
+		}
+	}
+
+	// Clause values run until the next keyword; comments stay with them
+	keywords := map[string]*string{"from": &hop.From, "by": &hop.By, "with": &hop.With}
+	stops := map[string]bool{"from": true, "by": true, "with": true, "via": true, "id": true, "for": true}
+
+	var current *string
+	depth := 0
+	for _, word := range strings.Fields(clauses) {
+		if depth == 0 && stops[strings.ToLower(word)] {
+			current = keywords[strings.ToLower(word)]
+			continue
+		}
+		depth += strings.Count(word, "(") - strings.Count(word, ")")
+		if depth < 0 {
+			depth = 0
+		}
+		if current == nil {
+			continue
+		}
+		if *current != "" {
+			*current += " "
+		}
+		*current += word
+	}
+
+	return hop
+}
+
+// messageParts lists the leaf parts of a body structure
+func messageParts(root *imap.BodyStructure) []models.MessagePart {
+	parts := []models.MessagePart{}
+
+	var walk func(bs *imap.BodyStructure, path []int)
+	walk = func(bs *imap.BodyStructure, path []int) {
+		if bs == nil {
+			return
+		}
+		if strings.EqualFold(bs.MIMEType, "multipart") {
+			for i, child := range bs.Parts {
+				walk(child, append(append([]int(nil), path...), i+1))
+			}
+			return
+		}
+		if len(path) == 0 {
+			path = []int{1}
+		}
+
+		filename := bs.DispositionParams["filename"]
+		if filename == "" {
+			filename = bs.Params["name"]
+		}
+		parts = append(parts, models.MessagePart{
+			Part:        partName(path),
+			ContentType: strings.ToLower(bs.MIMEType + "/" + bs.MIMESubType),
+			Charset:     bs.Params["charset"],
+			Encoding:    strings.ToLower(bs.Encoding),
+			Disposition: strings.ToLower(bs.Disposition),
+			Filename:    utils.DecodeHeader(filename),
+			Size:        int(bs.Size),
+		})
+	}
+
+	walk(root, nil)
+	return parts
+}
@@ -1,16 +1,70 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"lilmail/config"
+	"net"
 )
 
-// createIMAPClientFromCredentials creates an IMAP client from credentials
-func createIMAPClientFromCredentials(creds *Credentials, cfg *config.Config) (*Client, error) {
+// ErrSenderNotAllowed means the SMTP relay may not send from the account's
+// address
+var ErrSenderNotAllowed = errors.New("sending from this address is not allowed")
+
+// NewMailClient connects to the mail account of the given credentials: the
+// account's JMAP or POP3 server if it has one, Microsoft Graph for Microsoft
+// 365 accounts, the user's Maildir for Maildir accounts, else the configured
+// IMAP server, logging in over XOAUTH2 for accounts signed in with the OAuth
+// provider
+func NewMailClient(creds *Credentials, cfg *config.Config) (MailClient, error) {
 	if creds == nil {
 		return nil, fmt.Errorf("credentials cannot be nil")
 	}
 
+	// A failed connection must come back as a nil interface, not a typed nil
+	if creds.JMAPURL != "" {
+		client, err := NewJMAPClient(creds.JMAPURL, creds.Username, creds.Password, cfg.Cache.Folder)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	if creds.GraphToken != "" {
+		client, err := NewGraphClient(cfg.Graph, creds.GraphAccount, creds.GraphToken, cfg.Cache.Folder)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	if creds.MaildirUser != "" {
+		client, err := NewMaildirClient(cfg.Maildir, creds.MaildirUser, cfg.Cache.Folder)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	if creds.POP3Server != "" {
+		client, err := NewPOP3Client(creds.POP3Server, creds.POP3Port, creds.Username, creds.Password, creds.LeaveOnServer, cfg.Cache.Folder)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
+	// XOAUTH2 logs in as the full address with an access token of the
+	// account's sign-in
+	if creds.OAuthToken != "" {
+		accessToken, err := oauthAccessToken(cfg.OAuth, creds.Email, creds.OAuthAccount, creds.OAuthToken)
+		if err != nil {
+			return nil, err
+		}
+		client, err := NewXOAuth2Client(cfg.IMAP.Server, cfg.IMAP.Port, creds.Email, accessToken)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
 	var username string
 	if cfg.Server.UsernameIsEmail {
 		username = creds.Email
@@ -22,10 +76,79 @@ func createIMAPClientFromCredentials(creds *Credentials, cfg *config.Config) (*C
 		return nil, fmt.Errorf("invalid email format")
 	}
 
-	return NewClient(
+	client, err := NewClient(
 		cfg.IMAP.Server,
 		cfg.IMAP.Port,
 		username,
 		creds.Password,
 	)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// MailSender sends mail as the account of a session
+type MailSender interface {
+	SendMail(to, cc, bcc, subject, body string, isHTML bool, attachments []AttachmentData) error
+}
+
+// NewMailSender returns how mail of the given credentials is sent: through
+// the SMTP relay when one is configured, whatever the account; else through
+// Microsoft Graph for Microsoft 365 accounts, the local sendmail for Maildir
+// accounts when one is configured, or over SMTP to server, logging in over
+// XOAUTH2 for accounts signed in with the OAuth provider
+func NewMailSender(creds *Credentials, cfg *config.Config, server string, port int) (MailSender, error) {
+	if cfg.SMTPRelay.Enabled() {
+		if !cfg.SMTPRelay.AllowsSender(creds.Email) {
+			return nil, fmt.Errorf("%w: %s", ErrSenderNotAllowed, creds.Email)
+		}
+		return NewRelayClient(cfg.SMTPRelay, creds.Email), nil
+	}
+	if creds.GraphToken != "" {
+		client, err := NewGraphClient(cfg.Graph, creds.GraphAccount, creds.GraphToken, cfg.Cache.Folder)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	if creds.MaildirUser != "" && cfg.Maildir.Sendmail != "" {
+		return NewSendmailClient(cfg.Maildir.Sendmail, creds.Email), nil
+	}
+	var client *SMTPClient
+	if creds.OAuthToken != "" {
+		accessToken, err := oauthAccessToken(cfg.OAuth, creds.Email, creds.OAuthAccount, creds.OAuthToken)
+		if err != nil {
+			return nil, err
+		}
+		client = NewXOAuth2SMTPClient(server, port, creds.Email, accessToken)
+	} else {
+		client = NewSMTPClient(server, port, creds.Email, creds.Password)
+	}
+	// Like the instance's IMAP server, its own SMTP server is configured
+	// by admins and may be on a denied address such as localhost
+	if server == cfg.SMTP.Server {
+		client.dialer = &net.Dialer{Timeout: smtpDialTimeout}
+	}
+	return client, nil
+}
+
+// NewMailBackend connects to the mail account of the given credentials and
+// pairs it with how its mail is sent. Clients that send mail themselves,
+// like GraphClient, are their own backend unless mail goes through the
+// SMTP relay.
+func NewMailBackend(creds *Credentials, cfg *config.Config, server string, port int) (MailBackend, error) {
+	client, err := NewMailClient(creds, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if backend, ok := client.(MailBackend); ok && !cfg.SMTPRelay.Enabled() {
+		return backend, nil
+	}
+	sender, err := NewMailSender(creds, cfg, server, port)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &mailBackend{MailClient: client, MailSender: sender}, nil
 }
@@ -2,6 +2,9 @@ package api
 
 import (
 	"lilmail/utils"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -9,36 +12,50 @@ import (
 // I18nHandler handles i18n-related requests
 type I18nHandler struct{}
 
-// GetTranslations returns translations for the client-side JavaScript
+// GetTranslations returns every message of a language for the client-side
+// JavaScript, falling back to English for languages that aren't registered.
+// Browsers revalidate it with the ETag and Last-Modified of the locale file.
 func (h *I18nHandler) GetTranslations(c *fiber.Ctx) error {
-	lang := c.Params("lang")
+	lang := utils.SupportedLanguage(c.Params("lang"))
 	if lang == "" {
 		lang = "en"
 	}
 
-	// Only allow supported languages
-	if lang != "en" && lang != "ja" {
-		lang = "en"
+	catalog, ok := utils.GetCatalog(lang)
+	if !ok {
+		return c.Status(404).JSON(fiber.Map{"error": "No translations for " + lang})
 	}
 
-	localizer := utils.GetLocalizer(lang)
-
-	// Create a map of common translation keys for client-side use
-	translations := map[string]string{
-		"message_sent_success":   utils.T(localizer, "message_sent_success"),
-		"message_saved_draft":    utils.T(localizer, "message_saved_draft"),
-		"message_deleted":        utils.T(localizer, "message_deleted"),
-		"message_error":          utils.T(localizer, "message_error"),
-		"message_connection_error": utils.T(localizer, "message_connection_error"),
-		"confirm_delete_email":   utils.T(localizer, "confirm_delete_email"),
-		"confirm_yes":            utils.T(localizer, "confirm_yes"),
-		"confirm_no":             utils.T(localizer, "confirm_no"),
-		"email_loading":          utils.T(localizer, "email_loading"),
-		"email_no_messages":      utils.T(localizer, "email_no_messages"),
-		"error_network":          utils.T(localizer, "error_network"),
-		"error_404":              utils.T(localizer, "error_404"),
-		"error_500":              utils.T(localizer, "error_500"),
+	c.Set(fiber.HeaderCacheControl, "private, no-cache")
+	c.Set(fiber.HeaderETag, catalog.ETag)
+	c.Set(fiber.HeaderContentLanguage, lang)
+	if !catalog.LastModified.IsZero() {
+		c.Set(fiber.HeaderLastModified, catalog.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if catalogNotModified(c, catalog) {
+		return c.SendStatus(fiber.StatusNotModified)
 	}
 
-	return c.JSON(translations)
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	return c.Send(catalog.JSON)
+}
+
+// catalogNotModified reports whether the browser's copy of a catalog is
+// current. If-None-Match takes precedence over If-Modified-Since.
+func catalogNotModified(c *fiber.Ctx, catalog *utils.Catalog) bool {
+	if noneMatch := c.Get(fiber.HeaderIfNoneMatch); noneMatch != "" {
+		for _, etag := range strings.Split(noneMatch, ",") {
+			etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+			if etag == catalog.ETag || etag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince))
+	if err != nil || catalog.LastModified.IsZero() {
+		return false
+	}
+	return !catalog.LastModified.Truncate(time.Second).After(since)
 }
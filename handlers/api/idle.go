@@ -0,0 +1,388 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"lilmail/config"
+	"lilmail/utils"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+const (
+	// idleRetryDelay is the wait before reconnecting after an IDLE connection fails
+	idleRetryDelay = 30 * time.Second
+	// idleRestartInterval restarts IDLE before servers drop the connection
+	idleRestartInterval = 25 * time.Minute
+)
+
+// ErrPushUnsupported means the mail server can't push new mail, leaving
+// the user to the mail poller
+var ErrPushUnsupported = errors.New("mail server does not support push")
+
+// idleWorker holds one user's IDLE connection
+type idleWorker struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// IdleManager runs one long-lived IMAP IDLE (or JMAP push, or Maildir
+// watch) goroutine per user while the user has live SSE/WebSocket
+// subscribers, and caps the number of mail server connections background
+// workers open per user
+type IdleManager struct {
+	store    *session.Store
+	config   *config.Config
+	notify   *NotificationHandler
+	rules    *LabelRules
+	mutes    *ThreadMutes
+	spam     *SpamFilter
+	maxConns int
+
+	mu      sync.Mutex
+	creds   map[string]*Credentials
+	workers map[string]*idleWorker
+	conns   map[string]int
+}
+
+// NewIdleManager creates a new IDLE manager and registers it for subscriber events
+func NewIdleManager(store *session.Store, cfg *config.Config, notify *NotificationHandler) *IdleManager {
+	m := &IdleManager{
+		store:    store,
+		config:   cfg,
+		notify:   notify,
+		maxConns: cfg.Notifications.MaxConnections,
+		creds:    make(map[string]*Credentials),
+		workers:  make(map[string]*idleWorker),
+		conns:    make(map[string]int),
+	}
+	if cfg.Notifications.Idle {
+		notify.SetLifecycle(m)
+	}
+	return m
+}
+
+// SetLabelRules applies auto-labeling rules to new mail seen over IDLE
+func (m *IdleManager) SetLabelRules(rules *LabelRules) {
+	m.rules = rules
+}
+
+// SetThreadMutes archives new replies to muted threads seen over IDLE
+// instead of notifying about them
+func (m *IdleManager) SetThreadMutes(mutes *ThreadMutes) {
+	m.mutes = mutes
+}
+
+// SetSpamFilter moves new mail seen over IDLE that the user's spam
+// classifier is confident about to the Junk folder
+func (m *IdleManager) SetSpamFilter(spam *SpamFilter) {
+	m.spam = spam
+}
+
+// Register is a handler that remembers the session's credentials so an IDLE
+// worker can be started once the subscriber connects
+func (m *IdleManager) Register(c *fiber.Ctx) error {
+	if m.config.Notifications.Idle {
+		if creds, err := GetCredentials(c, m.store, m.config.Encryption.Key); err == nil {
+			if username := GetSessionUser(c); username != "" {
+				m.mu.Lock()
+				m.creds[username] = creds
+				m.mu.Unlock()
+			}
+		}
+	}
+	return c.Next()
+}
+
+// UserConnected starts the user's IDLE worker on their first subscriber
+func (m *IdleManager) UserConnected(username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	creds, ok := m.creds[username]
+	if !ok {
+		return
+	}
+	if _, running := m.workers[username]; running {
+		return
+	}
+
+	w := &idleWorker{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	m.workers[username] = w
+	go m.run(username, creds, w)
+
+	utils.Log.Info("Started IDLE worker for %s", username)
+}
+
+// UserDisconnected stops the user's IDLE worker once their last subscriber is gone
+func (m *IdleManager) UserDisconnected(username string) {
+	m.stopWorker(username)
+}
+
+// Logout stops the user's IDLE worker and forgets their credentials
+func (m *IdleManager) Logout(username string) {
+	m.stopWorker(username)
+
+	m.mu.Lock()
+	delete(m.creds, username)
+	m.mu.Unlock()
+}
+
+// IsActive reports whether an IDLE worker is watching the user's INBOX
+func (m *IdleManager) IsActive(username string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.workers[username]
+	return ok
+}
+
+// Counts returns the number of running IDLE workers and of background IMAP
+// connections in use
+func (m *IdleManager) Counts() (workers, conns int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, n := range m.conns {
+		conns += n
+	}
+	return len(m.workers), conns
+}
+
+// AcquireConn reserves one of the user's background IMAP connections.
+// It returns false when the per-user cap is reached.
+func (m *IdleManager) AcquireConn(username string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.maxConns > 0 && m.conns[username] >= m.maxConns {
+		return false
+	}
+	m.conns[username]++
+	return true
+}
+
+// ReleaseConn frees a connection reserved with AcquireConn
+func (m *IdleManager) ReleaseConn(username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conns[username] <= 1 {
+		delete(m.conns, username)
+		return
+	}
+	m.conns[username]--
+}
+
+// stopWorker stops a user's IDLE worker and waits for it to close its connection
+func (m *IdleManager) stopWorker(username string) {
+	m.mu.Lock()
+	w, ok := m.workers[username]
+	if ok {
+		delete(m.workers, username)
+	}
+	m.mu.Unlock()
+
+	if ok {
+		close(w.stop)
+		<-w.done
+		utils.Log.Info("Stopped IDLE worker for %s", username)
+	}
+}
+
+// run keeps an IDLE connection open until the worker is stopped,
+// reconnecting after failures
+func (m *IdleManager) run(username string, creds *Credentials, w *idleWorker) {
+	defer close(w.done)
+
+	for {
+		if m.AcquireConn(username) {
+			err := m.idle(username, creds, w.stop)
+			m.ReleaseConn(username)
+			if err == nil {
+				return
+			}
+			if errors.Is(err, client.ErrExtensionUnsupported) || errors.Is(err, ErrPushUnsupported) {
+				// Leave the user to the mail poller
+				utils.Log.Warn("Server does not support IDLE, falling back to polling for %s", username)
+				m.mu.Lock()
+				if m.workers[username] == w {
+					delete(m.workers, username)
+				}
+				m.mu.Unlock()
+				return
+			}
+			utils.Log.Warn("IDLE failed for %s: %v", username, err)
+		} else {
+			utils.Log.Warn("IDLE for %s skipped: connection limit reached", username)
+		}
+
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(idleRetryDelay):
+		}
+	}
+}
+
+// idle watches INBOX on a single connection and notifies about new mail.
+// It returns nil when stopped and an error if the connection failed.
+func (m *IdleManager) idle(username string, creds *Credentials, stop <-chan struct{}) error {
+	mc, err := NewMailClient(creds, m.config)
+	if err != nil {
+		return err
+	}
+	defer mc.Close()
+
+	var c *Client
+	switch mc := mc.(type) {
+	case *Client:
+		c = mc
+	case pushClient:
+		return m.push(username, creds.Email, mc, stop)
+	default:
+		// POP3 and Graph have no way to push new mail here
+		return ErrPushUnsupported
+	}
+
+	// Updates must always be drained or the client blocks, so collapse
+	// mailbox updates into a single pending signal
+	updates := make(chan client.Update, 16)
+	changed := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case update := <-updates:
+				switch update.(type) {
+				case *client.MailboxUpdate, *client.MessageUpdate, *client.ExpungeUpdate:
+					// New mail, flag changes and expunges all move unread counts
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	c.client.Updates = updates
+
+	if ok, err := c.client.Support("IDLE"); err != nil {
+		return err
+	} else if !ok {
+		return client.ErrExtensionUnsupported
+	}
+
+	mbox, err := c.client.Select("INBOX", true)
+	if err != nil {
+		return err
+	}
+	uidNext := mbox.UidNext
+	if uidNext == 0 {
+		status, err := c.MailboxStatus("INBOX")
+		if err != nil {
+			return err
+		}
+		uidNext = status.UidNext
+	}
+
+	for {
+		stopIdle := make(chan struct{})
+		idleDone := make(chan error, 1)
+		go func() {
+			idleDone <- c.client.Idle(stopIdle, &idleOptions)
+		}()
+
+		select {
+		case <-stop:
+			close(stopIdle)
+			<-idleDone
+			return nil
+		case err := <-idleDone:
+			return err
+		case <-changed:
+			close(stopIdle)
+			if err := <-idleDone; err != nil {
+				return err
+			}
+		}
+
+		if uidNext, err = notifyNewMessages(c, m.notify, m.rules, m.mutes, m.spam, username, creds.Email, uidNext); err != nil {
+			return err
+		}
+		if err := notifyUnreadCounts(c, m.notify, username); err != nil {
+			return err
+		}
+	}
+}
+
+// idleOptions restarts IDLE periodically and never falls back to polling,
+// which the mail poller already covers
+var idleOptions = client.IdleOptions{
+	LogoutTimeout: idleRestartInterval,
+	PollInterval:  -1,
+}
+
+// pushClient is a client that tells when its account changes: JMAPClient
+// through the account's event source, MaildirClient by watching the Maildir
+type pushClient interface {
+	MailClient
+	WatchChanges(ctx context.Context, changed chan<- struct{}) error
+	// Refresh makes the client see the changes it was told about
+	Refresh()
+}
+
+// push is the counterpart of idle for clients that watch their account
+// themselves: it notifies about new mail after each change
+func (m *IdleManager) push(username, account string, c pushClient, stop <-chan struct{}) error {
+	status, err := c.MailboxStatus("INBOX")
+	if err != nil {
+		return err
+	}
+	uidNext := status.UidNext
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	changed := make(chan struct{}, 1)
+	pushDone := make(chan error, 1)
+	go func() {
+		pushDone <- c.WatchChanges(ctx, changed)
+	}()
+
+	for {
+		select {
+		case err := <-pushDone:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		case <-changed:
+		}
+
+		c.Refresh()
+		if uidNext, err = notifyNewMessages(c, m.notify, m.rules, m.mutes, m.spam, username, account, uidNext); err != nil {
+			return err
+		}
+		if err := notifyUnreadCounts(c, m.notify, username); err != nil {
+			return err
+		}
+	}
+}
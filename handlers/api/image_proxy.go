@@ -0,0 +1,204 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"lilmail/utils"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Image proxy limits
+const (
+	maxProxiedImageBytes = 5 << 20  // Largest image the proxy fetches
+	imageProxyCacheBytes = 64 << 20 // Memory the cache may hold
+	imageProxyCacheTTL   = time.Hour
+	imageProxyTimeout    = 10 * time.Second
+)
+
+type cachedImage struct {
+	contentType string
+	data        []byte
+	expires     time.Time
+}
+
+// ImageProxy loads remote images of HTML messages on behalf of the reader,
+// so senders only see the server's address, and caches them in memory
+type ImageProxy struct {
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*cachedImage
+	size  int
+}
+
+// NewImageProxy creates an image proxy that refuses to connect to private,
+// loopback and link-local addresses
+func NewImageProxy() *ImageProxy {
+	return &ImageProxy{
+		client: newPublicClient(imageProxyTimeout),
+		cache:  make(map[string]*cachedImage),
+	}
+}
+
+// publicDialer returns a dialer that refuses to connect to private,
+// loopback and link-local addresses. The check runs on the resolved address
+// of every connection, so it also holds on redirects and DNS rebinding.
+func publicDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("refusing to connect to %s", host)
+			}
+			return nil
+		},
+	}
+}
+
+// newPublicClient returns an HTTP client for URLs users or senders choose,
+// which only connects to public addresses
+func newPublicClient(timeout time.Duration) *http.Client {
+	dialer := publicDialer(timeout)
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, address)
+			},
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+}
+
+// publicIP reports whether an address is on the public internet
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() ||
+		ip.IsInterfaceLocalMulticast())
+}
+
+// HandleImage serves the remote image in the url query parameter
+func (p *ImageProxy) HandleImage(c *fiber.Ctx) error {
+	target, err := url.Parse(c.Query("url"))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return utils.BadRequestError("Invalid image URL", err)
+	}
+
+	image, err := p.get(target.String())
+	if err != nil {
+		utils.Log.Debug("Image proxy failed for %s: %v", target.Host, err)
+		return utils.NotFoundError("Image not available", err)
+	}
+
+	c.Set("Content-Type", image.contentType)
+	c.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	c.Set("X-Content-Type-Options", "nosniff")
+	c.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(imageProxyCacheTTL.Seconds())))
+
+	return c.Send(image.data)
+}
+
+// get returns an image from the cache, fetching it when missing or expired
+func (p *ImageProxy) get(target string) (*cachedImage, error) {
+	p.mu.Lock()
+	image, ok := p.cache[target]
+	p.mu.Unlock()
+	if ok && time.Now().Before(image.expires) {
+		return image, nil
+	}
+
+	image, err := p.fetch(target)
+	if err != nil {
+		return nil, err
+	}
+	p.store(target, image)
+	return image, nil
+}
+
+func (p *ImageProxy) fetch(target string) (*cachedImage, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote server returned %s", resp.Status)
+	}
+
+	// Only images; anything else could run from our origin
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("not an image: %q", resp.Header.Get("Content-Type"))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxProxiedImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxProxiedImageBytes {
+		return nil, fmt.Errorf("image larger than %d bytes", maxProxiedImageBytes)
+	}
+
+	return &cachedImage{
+		contentType: contentType,
+		data:        data,
+		expires:     time.Now().Add(imageProxyCacheTTL),
+	}, nil
+}
+
+// store caches an image, evicting expired entries and then the entries
+// closest to expiring until it fits
+func (p *ImageProxy) store(target string, image *cachedImage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if old, ok := p.cache[target]; ok {
+		p.size -= len(old.data)
+		delete(p.cache, target)
+	}
+
+	now := time.Now()
+	for key, cached := range p.cache {
+		if now.After(cached.expires) {
+			p.size -= len(cached.data)
+			delete(p.cache, key)
+		}
+	}
+
+	for p.size+len(image.data) > imageProxyCacheBytes && len(p.cache) > 0 {
+		var oldestKey string
+		var oldest *cachedImage
+		for key, cached := range p.cache {
+			if oldest == nil || cached.expires.Before(oldest.expires) {
+				oldestKey, oldest = key, cached
+			}
+		}
+		p.size -= len(oldest.data)
+		delete(p.cache, oldestKey)
+	}
+
+	p.cache[target] = image
+	p.size += len(image.data)
+}
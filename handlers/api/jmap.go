@@ -0,0 +1,339 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JMAP capabilities lilmail uses (RFC 8620, RFC 8621)
+const (
+	jmapCore = "urn:ietf:params:jmap:core"
+	jmapMail = "urn:ietf:params:jmap:mail"
+)
+
+// jmapSessionTTL is how long a fetched session resource is reused
+const jmapSessionTTL = 15 * time.Minute
+
+// jmapDefaultMaxObjects is used when the server doesn't say how many
+// objects a single /get may ask for
+const jmapDefaultMaxObjects = 256
+
+// jmapSession is the session resource (RFC 8620, section 2)
+type jmapSession struct {
+	APIURL          string            `json:"apiUrl"`
+	DownloadURL     string            `json:"downloadUrl"`
+	UploadURL       string            `json:"uploadUrl"`
+	EventSourceURL  string            `json:"eventSourceUrl"`
+	State           string            `json:"state"`
+	Username        string            `json:"username"`
+	PrimaryAccounts map[string]string `json:"primaryAccounts"`
+	Capabilities    struct {
+		Core struct {
+			MaxObjectsInGet int `json:"maxObjectsInGet"`
+		} `json:"urn:ietf:params:jmap:core"`
+	} `json:"capabilities"`
+
+	fetched time.Time
+}
+
+// jmapSessions caches session resources by server and credentials, so the
+// short-lived clients of a request don't each fetch the session again
+var jmapSessions sync.Map
+
+// jmapCall is a method call of a JMAP request
+type jmapCall struct {
+	name string
+	args map[string]interface{}
+}
+
+// jmapError is a method-level error returned by the server
+type jmapError struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (e *jmapError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("jmap: %s: %s", e.Type, e.Description)
+	}
+	return "jmap: " + e.Type
+}
+
+// jmapRef refers to a result of an earlier call in the same request, e.g.
+// the ids of an Email/query
+func jmapRef(call int, name, path string) map[string]interface{} {
+	return map[string]interface{}{
+		"resultOf": strconv.Itoa(call),
+		"name":     name,
+		"path":     path,
+	}
+}
+
+// JMAPClient is a connection to a mail account over JMAP. JMAP names
+// messages by opaque ids, so the client keeps a persistent map from those to
+// IMAP-like UIDs; it also stands in for the IMAP modseq, letting folder
+// caches see flag changes.
+type JMAPClient struct {
+	http      *http.Client
+	url       string
+	username  string
+	password  string
+	session   *jmapSession
+	accountID string
+	ids       *jmapIDMap
+	synced    bool
+
+	// Mailboxes by path, loaded on first use
+	mailboxes map[string]*jmapMailbox
+}
+
+// NewJMAPClient connects to the JMAP server whose session resource is at
+// sessionURL. Without a username the password is sent as a bearer token.
+func NewJMAPClient(sessionURL, username, password, cacheFolder string) (*JMAPClient, error) {
+	u, err := url.Parse(sessionURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid JMAP URL: %s", sessionURL)
+	}
+
+	c := &JMAPClient{
+		http:     &http.Client{Timeout: 60 * time.Second, Transport: accountTransport()},
+		url:      sessionURL,
+		username: username,
+		password: password,
+	}
+	if err := c.loadSession(); err != nil {
+		return nil, err
+	}
+
+	key := sha256.Sum256([]byte(sessionURL + "\x00" + c.accountID))
+	path := filepath.Join(cacheFolder, "jmap", hex.EncodeToString(key[:])[:32]+".json")
+	c.ids = loadJMAPIDMap(path)
+
+	return c, nil
+}
+
+// sessionKey identifies the cached session of these credentials
+func (c *JMAPClient) sessionKey() string {
+	sum := sha256.Sum256([]byte(c.password))
+	return c.url + "\x00" + c.username + "\x00" + hex.EncodeToString(sum[:])
+}
+
+// loadSession fetches the session resource, or reuses a recent one
+func (c *JMAPClient) loadSession() error {
+	if cached, ok := jmapSessions.Load(c.sessionKey()); ok {
+		if session := cached.(*jmapSession); time.Since(session.fetched) < jmapSessionTTL {
+			return c.useSession(session)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching JMAP session: %v", err)
+	}
+	defer resp.Body.Close()
+
+	session := &jmapSession{fetched: time.Now()}
+	if err := json.NewDecoder(resp.Body).Decode(session); err != nil {
+		return fmt.Errorf("error decoding JMAP session: %v", err)
+	}
+	if err := c.useSession(session); err != nil {
+		return err
+	}
+
+	jmapSessions.Store(c.sessionKey(), session)
+	return nil
+}
+
+func (c *JMAPClient) useSession(session *jmapSession) error {
+	accountID := session.PrimaryAccounts[jmapMail]
+	if accountID == "" || session.APIURL == "" {
+		return errors.New("JMAP server has no mail account for this user")
+	}
+
+	c.session = session
+	c.accountID = accountID
+	return nil
+}
+
+// maxObjects is how many objects a single /get may ask for
+func (c *JMAPClient) maxObjects() int {
+	if n := c.session.Capabilities.Core.MaxObjectsInGet; n > 0 {
+		return n
+	}
+	return jmapDefaultMaxObjects
+}
+
+// do sends an authenticated request and fails on error statuses
+func (c *JMAPClient) do(req *http.Request) (*http.Response, error) {
+	return c.doWith(c.http, req)
+}
+
+func (c *JMAPClient) doWith(client *http.Client, req *http.Request) (*http.Response, error) {
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+c.password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		jmapSessions.Delete(c.sessionKey())
+		return nil, errors.New("JMAP authentication failed")
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("JMAP server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// call sends the method calls in a single request and returns the
+// arguments of each call's response, in order. Calls are named by their
+// position, which is what jmapRef refers to.
+func (c *JMAPClient) call(calls ...jmapCall) ([]json.RawMessage, error) {
+	methodCalls := make([][]interface{}, len(calls))
+	for i, call := range calls {
+		call.args["accountId"] = c.accountID
+		methodCalls[i] = []interface{}{call.name, call.args, strconv.Itoa(i)}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"using":       []string{jmapCore, jmapMail},
+		"methodCalls": methodCalls,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.session.APIURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("JMAP request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		MethodResponses [][3]json.RawMessage `json:"methodResponses"`
+		SessionState    string               `json:"sessionState"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding JMAP response: %v", err)
+	}
+	if result.SessionState != "" && result.SessionState != c.session.State {
+		// Accounts or URLs changed; fetch the session again next time
+		jmapSessions.Delete(c.sessionKey())
+	}
+
+	responses := make([]json.RawMessage, len(calls))
+	for _, response := range result.MethodResponses {
+		var name, id string
+		if json.Unmarshal(response[0], &name) != nil || json.Unmarshal(response[2], &id) != nil {
+			continue
+		}
+		i, err := strconv.Atoi(id)
+		if err != nil || i < 0 || i >= len(calls) || responses[i] != nil {
+			continue // Extra responses, e.g. of an implicit Email/set
+		}
+		if name == "error" {
+			methodErr := &jmapError{}
+			json.Unmarshal(response[1], methodErr)
+			return nil, fmt.Errorf("%s: %w", calls[i].name, methodErr)
+		}
+		responses[i] = response[1]
+	}
+	for i, response := range responses {
+		if response == nil {
+			return nil, fmt.Errorf("%s: no response from JMAP server", calls[i].name)
+		}
+	}
+	return responses, nil
+}
+
+// expandTemplate fills the {variables} of a session URL template
+func expandTemplate(template string, values map[string]string) string {
+	for name, value := range values {
+		template = strings.ReplaceAll(template, "{"+name+"}", url.PathEscape(value))
+	}
+	return template
+}
+
+// download fetches the content of a blob
+func (c *JMAPClient) download(blobID, name, contentType string) ([]byte, error) {
+	if name == "" {
+		name = "attachment"
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	u := expandTemplate(c.session.DownloadURL, map[string]string{
+		"accountId": c.accountID,
+		"blobId":    blobID,
+		"name":      name,
+		"type":      contentType,
+	})
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading blob: %v", err)
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// upload stores data as a blob and returns its id
+func (c *JMAPClient) upload(data []byte, contentType string) (string, error) {
+	u := expandTemplate(c.session.UploadURL, map[string]string{"accountId": c.accountID})
+
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := c.do(req)
+	if err != nil {
+		return "", fmt.Errorf("error uploading blob: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		BlobID string `json:"blobId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("error decoding upload response: %v", err)
+	}
+	return result.BlobID, nil
+}
+
+// Close saves the UID map. There is no connection to close.
+func (c *JMAPClient) Close() error {
+	return c.ids.save()
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/utils"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// jmapSyncPage is how many ids a single Email/query or Email/changes
+// returns while syncing
+const jmapSyncPage = 1024
+
+// jmapIDMaps holds the UID map of each account, shared by its clients
+var jmapIDMaps sync.Map
+
+// jmapIDMap assigns UIDs to the ids of an account's emails. UIDs are
+// account-wide and only grow, so they are unique and ascending within any
+// folder. State is the Email state the map was last synced to, which is
+// all Email/changes needs to bring it up to date.
+type jmapIDMap struct {
+	mu   sync.Mutex
+	path string
+	uids map[uint32]string
+	// dirty is set when the map changed since it was saved
+	dirty bool
+
+	Validity uint32            `json:"validity"`
+	State    string            `json:"state"`
+	Next     uint32            `json:"next"`
+	ModSeq   uint64            `json:"modseq"`
+	IDs      map[string]uint32 `json:"ids"`
+}
+
+// loadJMAPIDMap returns the UID map kept at path, loading it from disk the
+// first time. A missing or unreadable file starts a new map.
+func loadJMAPIDMap(path string) *jmapIDMap {
+	if m, ok := jmapIDMaps.Load(path); ok {
+		return m.(*jmapIDMap)
+	}
+
+	m := &jmapIDMap{path: path}
+	if err := utils.LoadCache(path, m); err != nil || m.Validity == 0 || m.IDs == nil {
+		m = &jmapIDMap{
+			path:     path,
+			Validity: uint32(time.Now().Unix()),
+			Next:     1,
+			ModSeq:   1,
+			IDs:      make(map[string]uint32),
+		}
+	}
+	m.uids = make(map[uint32]string, len(m.IDs))
+	for id, uid := range m.IDs {
+		m.uids[uid] = id
+	}
+
+	actual, _ := jmapIDMaps.LoadOrStore(path, m)
+	return actual.(*jmapIDMap)
+}
+
+// uid returns the UID of an email id, assigning the next one if the id is
+// new to the map
+func (m *jmapIDMap) uid(id string) uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.assign(id)
+}
+
+func (m *jmapIDMap) assign(id string) uint32 {
+	if uid, ok := m.IDs[id]; ok {
+		return uid
+	}
+	uid := m.Next
+	m.Next++
+	m.IDs[id] = uid
+	m.uids[uid] = id
+	m.dirty = true
+	return uid
+}
+
+func (m *jmapIDMap) forget(id string) {
+	if uid, ok := m.IDs[id]; ok {
+		delete(m.IDs, id)
+		delete(m.uids, uid)
+		m.dirty = true
+	}
+}
+
+// id returns the email id of a UID
+func (m *jmapIDMap) id(uid uint32) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.uids[uid]
+	return id, ok
+}
+
+// idsAbove returns the email ids with a UID greater than uid
+func (m *jmapIDMap) idsAbove(uid uint32) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []string
+	for u, id := range m.uids {
+		if u > uid {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// status returns the UID validity, next UID and modseq of the map
+func (m *jmapIDMap) status() (uint32, uint32, uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Validity, m.Next, m.ModSeq
+}
+
+// save writes the map to disk if it changed
+func (m *jmapIDMap) save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return fmt.Errorf("error creating JMAP cache folder: %v", err)
+	}
+	if err := utils.SaveCache(m.path, m); err != nil {
+		return err
+	}
+	m.dirty = false
+	return nil
+}
+
+// sync brings the UID map up to date with the server, once per client.
+// Other clients of the account may have synced it already, in which case
+// Email/changes has nothing to report.
+func (c *JMAPClient) sync() error {
+	if c.synced {
+		return nil
+	}
+
+	m := c.ids
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var err error
+	if m.State == "" {
+		err = c.syncAll(m)
+	} else {
+		err = c.syncChanges(m)
+		var methodErr *jmapError
+		if errors.As(err, &methodErr) && methodErr.Type == "cannotCalculateChanges" {
+			err = c.syncAll(m)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error syncing JMAP mailbox: %v", err)
+	}
+
+	c.synced = true
+	return nil
+}
+
+// syncChanges applies the Email changes since the map's state
+func (c *JMAPClient) syncChanges(m *jmapIDMap) error {
+	for {
+		responses, err := c.call(jmapCall{"Email/changes", map[string]interface{}{
+			"sinceState": m.State,
+			"maxChanges": jmapSyncPage,
+		}})
+		if err != nil {
+			return err
+		}
+
+		var changes struct {
+			NewState       string   `json:"newState"`
+			HasMoreChanges bool     `json:"hasMoreChanges"`
+			Created        []string `json:"created"`
+			Updated        []string `json:"updated"`
+			Destroyed      []string `json:"destroyed"`
+		}
+		if err := json.Unmarshal(responses[0], &changes); err != nil {
+			return err
+		}
+
+		for _, id := range changes.Created {
+			m.assign(id)
+		}
+		for _, id := range changes.Destroyed {
+			m.forget(id)
+		}
+		if len(changes.Created)+len(changes.Updated)+len(changes.Destroyed) > 0 {
+			m.ModSeq++
+		}
+		if changes.NewState != m.State {
+			m.State = changes.NewState
+			m.dirty = true
+		}
+
+		if !changes.HasMoreChanges {
+			return nil
+		}
+	}
+}
+
+// syncAll lists every email of the account, oldest first so that UIDs
+// follow arrival order. Emails already in the map keep their UID.
+func (c *JMAPClient) syncAll(m *jmapIDMap) error {
+	seen := make(map[string]bool, len(m.IDs))
+	var state string
+
+	for position := 0; ; {
+		calls := []jmapCall{{"Email/query", map[string]interface{}{
+			"sort":           []map[string]interface{}{{"property": "receivedAt", "isAscending": true}},
+			"position":       position,
+			"limit":          jmapSyncPage,
+			"calculateTotal": true,
+		}}}
+		if position == 0 {
+			// Record the state before listing, so changes made meanwhile
+			// are caught by the next sync
+			calls = append([]jmapCall{{"Email/get", map[string]interface{}{
+				"ids":        []string{},
+				"properties": []string{"id"},
+			}}}, calls...)
+		}
+
+		responses, err := c.call(calls...)
+		if err != nil {
+			return err
+		}
+		if position == 0 {
+			var get struct {
+				State string `json:"state"`
+			}
+			if err := json.Unmarshal(responses[0], &get); err != nil {
+				return err
+			}
+			state = get.State
+		}
+
+		var query struct {
+			IDs   []string `json:"ids"`
+			Total int      `json:"total"`
+		}
+		if err := json.Unmarshal(responses[len(responses)-1], &query); err != nil {
+			return err
+		}
+
+		for _, id := range query.IDs {
+			m.assign(id)
+			seen[id] = true
+		}
+		// Servers may return fewer ids than asked for
+		position += len(query.IDs)
+		if len(query.IDs) == 0 || position >= query.Total {
+			break
+		}
+	}
+
+	for id := range m.IDs {
+		if !seen[id] {
+			m.forget(id)
+		}
+	}
+	m.State = state
+	m.ModSeq++
+	m.dirty = true
+	return nil
+}
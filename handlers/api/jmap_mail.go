@@ -0,0 +1,1177 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"lilmail/models"
+	"lilmail/utils"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// jmapMailbox is a JMAP Mailbox object
+type jmapMailbox struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	ParentID     string `json:"parentId"`
+	Role         string `json:"role"`
+	TotalEmails  uint32 `json:"totalEmails"`
+	UnreadEmails uint32 `json:"unreadEmails"`
+
+	// path is the folder name lilmail uses, e.g. "INBOX/Lists"
+	path string
+}
+
+// jmapDelimiter separates the levels of a mailbox path
+const jmapDelimiter = "/"
+
+// jmapRoleAttrs are the SPECIAL-USE attributes of the mailbox roles
+var jmapRoleAttrs = map[string]string{
+	"all":       imap.AllAttr,
+	"archive":   imap.ArchiveAttr,
+	"drafts":    imap.DraftsAttr,
+	"flagged":   imap.FlaggedAttr,
+	"important": imap.ImportantAttr,
+	"junk":      imap.JunkAttr,
+	"sent":      imap.SentAttr,
+	"trash":     imap.TrashAttr,
+}
+
+// jmapKeywords are the JMAP keywords of the IMAP system flags
+var jmapKeywords = map[string]string{
+	imap.SeenFlag:     "$seen",
+	imap.FlaggedFlag:  "$flagged",
+	imap.AnsweredFlag: "$answered",
+	imap.DraftFlag:    "$draft",
+	imap.DeletedFlag:  "$deleted",
+}
+
+// flagKeyword returns the JMAP keyword of an IMAP flag
+func flagKeyword(flag string) string {
+	if keyword, ok := jmapKeywords[flag]; ok {
+		return keyword
+	}
+	return strings.ToLower(flag)
+}
+
+// keywordFlags returns the IMAP flags of a set of JMAP keywords
+func keywordFlags(keywords map[string]bool) []string {
+	flags := []string{}
+	for keyword, set := range keywords {
+		if !set {
+			continue
+		}
+		flag := keyword
+		for f, k := range jmapKeywords {
+			if k == keyword {
+				flag = f
+				break
+			}
+		}
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+type jmapAddress struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type jmapBodyPart struct {
+	PartID      string         `json:"partId"`
+	BlobID      string         `json:"blobId"`
+	Size        int            `json:"size"`
+	Name        string         `json:"name"`
+	Type        string         `json:"type"`
+	Charset     string         `json:"charset"`
+	Disposition string         `json:"disposition"`
+	CID         string         `json:"cid"`
+	SubParts    []jmapBodyPart `json:"subParts"`
+}
+
+type jmapBodyValue struct {
+	Value string `json:"value"`
+}
+
+// jmapEmail is a JMAP Email object with the properties in jmapEmailProperties
+type jmapEmail struct {
+	ID          string                   `json:"id"`
+	MailboxIDs  map[string]bool          `json:"mailboxIds"`
+	Size        int64                    `json:"size"`
+	Keywords    map[string]bool          `json:"keywords"`
+	From        []jmapAddress            `json:"from"`
+	To          []jmapAddress            `json:"to"`
+	Cc          []jmapAddress            `json:"cc"`
+	ReplyTo     []jmapAddress            `json:"replyTo"`
+	Subject     string                   `json:"subject"`
+	ReceivedAt  time.Time                `json:"receivedAt"`
+	SentAt      *time.Time               `json:"sentAt"`
+	MessageID   []string                 `json:"messageId"`
+	InReplyTo   []string                 `json:"inReplyTo"`
+	References  []string                 `json:"references"`
+	ListID      string                   `json:"header:List-Id:asText"`
+	Preview     string                   `json:"preview"`
+	TextBody    []jmapBodyPart           `json:"textBody"`
+	HTMLBody    []jmapBodyPart           `json:"htmlBody"`
+	Attachments []jmapBodyPart           `json:"attachments"`
+	BodyValues  map[string]jmapBodyValue `json:"bodyValues"`
+}
+
+var jmapEmailProperties = []string{
+	"id", "mailboxIds", "keywords", "from", "to", "cc", "replyTo", "subject",
+	"receivedAt", "sentAt", "messageId", "inReplyTo", "references",
+	"header:List-Id:asText", "preview", "textBody", "htmlBody", "attachments",
+	"bodyValues",
+}
+
+// emailGet is an Email/get of the properties lilmail shows
+func emailGet(args map[string]interface{}) jmapCall {
+	args["properties"] = jmapEmailProperties
+	args["fetchTextBodyValues"] = true
+	args["fetchHTMLBodyValues"] = true
+	return jmapCall{"Email/get", args}
+}
+
+// splitAttachments separates the attachments of an email from the inline
+// parts its HTML refers to by Content-ID, the way findAttachmentParts does
+func splitAttachments(parts []jmapBodyPart) ([]jmapBodyPart, map[string]jmapBodyPart) {
+	var attachments []jmapBodyPart
+	inline := make(map[string]jmapBodyPart)
+	for _, part := range parts {
+		if cid := normalizeContentID(part.CID); cid != "" && !strings.HasPrefix(part.Type, "text/") &&
+			!strings.EqualFold(part.Disposition, "attachment") {
+			inline[cid] = part
+			continue
+		}
+		attachments = append(attachments, part)
+	}
+	return attachments, inline
+}
+
+// jmapMessageIDs wraps the message ids JMAP returns in angle brackets
+func jmapMessageIDs(ids []string) []string {
+	wrapped := make([]string, len(ids))
+	for i, id := range ids {
+		wrapped[i] = "<" + id + ">"
+	}
+	return wrapped
+}
+
+func jmapAddresses(addresses []jmapAddress) string {
+	list := make([]string, len(addresses))
+	for i, address := range addresses {
+		list[i] = address.Email
+	}
+	return strings.Join(list, ", ")
+}
+
+// toEmail converts a JMAP email, read from folder, to the model
+func (c *JMAPClient) toEmail(e *jmapEmail, folder string) models.Email {
+	email := models.Email{
+		ID:      strconv.FormatUint(uint64(c.ids.uid(e.ID)), 10),
+		Flags:   keywordFlags(e.Keywords),
+		Subject: e.Subject,
+		Date:    e.ReceivedAt,
+		Cc:      jmapAddresses(e.Cc),
+		ListID:  parseListID(e.ListID),
+	}
+	if e.SentAt != nil {
+		email.Date = *e.SentAt
+	}
+
+	if ids := jmapMessageIDs(e.MessageID); len(ids) > 0 {
+		email.MessageID = ids[0]
+	}
+	if ids := jmapMessageIDs(e.InReplyTo); len(ids) > 0 {
+		email.InReplyTo = ids[0]
+	}
+	if refs := jmapMessageIDs(e.References); len(refs) > 0 {
+		email.References = refs
+	}
+
+	if len(e.From) > 0 {
+		email.From = e.From[0].Email
+		email.FromName = e.From[0].Name
+	}
+	email.To = jmapAddresses(e.To)
+	for _, address := range e.To {
+		if address.Name != "" {
+			email.ToNames = append(email.ToNames, address.Name)
+		}
+	}
+	if len(e.ReplyTo) > 0 {
+		email.ReplyTo = e.ReplyTo[0].Email
+	}
+
+	var text, html strings.Builder
+	for _, part := range e.TextBody {
+		if part.Type == "text/plain" {
+			text.WriteString(e.BodyValues[part.PartID].Value)
+		}
+	}
+	for _, part := range e.HTMLBody {
+		if part.Type == "text/html" {
+			html.WriteString(e.BodyValues[part.PartID].Value)
+		}
+	}
+	email.Body = text.String()
+	if html.Len() > 0 {
+		// Point inline images at the inline part endpoint
+		htmlBody := rewriteCIDs(html.String(), email.ID, folder)
+		// Structured data is in scripts, which sanitizing removes
+		email.StructuredData = utils.ExtractJSONLD(htmlBody)
+		email.HTML = template.HTML(utils.SanitizeHTML(htmlBody))
+	}
+
+	if email.Body != "" {
+		email.Preview = createPreview(email.Body)
+	} else {
+		email.Preview = createPreview(e.Preview)
+	}
+
+	attachments, _ := splitAttachments(e.Attachments)
+	for _, part := range attachments {
+		email.Attachments = append(email.Attachments, models.Attachment{
+			Filename:    part.Name,
+			ContentType: strings.ToLower(part.Type),
+			Part:        part.PartID,
+			Size:        part.Size,
+		})
+	}
+	email.HasAttachments = len(email.Attachments) > 0
+
+	return email
+}
+
+// loadMailboxes fetches the account's mailboxes and names them by path
+func (c *JMAPClient) loadMailboxes() (map[string]*jmapMailbox, error) {
+	if c.mailboxes != nil {
+		return c.mailboxes, nil
+	}
+
+	responses, err := c.call(jmapCall{"Mailbox/get", map[string]interface{}{
+		"ids":        nil,
+		"properties": []string{"id", "name", "parentId", "role", "totalEmails", "unreadEmails"},
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching folders: %v", err)
+	}
+	var get struct {
+		List []*jmapMailbox `json:"list"`
+	}
+	if err := json.Unmarshal(responses[0], &get); err != nil {
+		return nil, fmt.Errorf("error fetching folders: %v", err)
+	}
+
+	byID := make(map[string]*jmapMailbox, len(get.List))
+	for _, mailbox := range get.List {
+		byID[mailbox.ID] = mailbox
+	}
+	var pathOf func(mailbox *jmapMailbox, depth int) string
+	pathOf = func(mailbox *jmapMailbox, depth int) string {
+		name := mailbox.Name
+		if mailbox.Role == "inbox" && mailbox.ParentID == "" {
+			name = "INBOX"
+		}
+		if parent, ok := byID[mailbox.ParentID]; ok && depth < maxMultipartDepth {
+			return pathOf(parent, depth+1) + jmapDelimiter + name
+		}
+		return name
+	}
+
+	c.mailboxes = make(map[string]*jmapMailbox, len(get.List))
+	for _, mailbox := range get.List {
+		mailbox.path = pathOf(mailbox, 0)
+		c.mailboxes[mailbox.path] = mailbox
+	}
+	return c.mailboxes, nil
+}
+
+// mailbox returns the mailbox of a folder
+func (c *JMAPClient) mailbox(folderName string) (*jmapMailbox, error) {
+	mailboxes, err := c.loadMailboxes()
+	if err != nil {
+		return nil, err
+	}
+	if mailbox, ok := mailboxes[folderName]; ok {
+		return mailbox, nil
+	}
+	if strings.EqualFold(folderName, "INBOX") {
+		for _, mailbox := range mailboxes {
+			if mailbox.Role == "inbox" {
+				return mailbox, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("folder %s not found", folderName)
+}
+
+// mailboxByRole returns the mailbox with a role, or the first of names
+func (c *JMAPClient) mailboxByRole(role string, names ...string) (*jmapMailbox, bool) {
+	mailboxes, err := c.loadMailboxes()
+	if err != nil {
+		return nil, false
+	}
+	for _, mailbox := range mailboxes {
+		if mailbox.Role == role {
+			return mailbox, true
+		}
+	}
+	for _, name := range names {
+		if mailbox, ok := mailboxes[name]; ok {
+			return mailbox, true
+		}
+	}
+	return nil, false
+}
+
+// FetchFolders retrieves all mailbox folders
+func (c *JMAPClient) FetchFolders() ([]*MailboxInfo, error) {
+	mailboxes, err := c.loadMailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	folders := make([]*MailboxInfo, 0, len(mailboxes))
+	for _, mailbox := range mailboxes {
+		folder := &MailboxInfo{
+			Name:       mailbox.path,
+			Delimiter:  jmapDelimiter,
+			Attributes: []string{},
+		}
+		if attr, ok := jmapRoleAttrs[mailbox.Role]; ok {
+			folder.Attributes = append(folder.Attributes, attr)
+		}
+		folders = append(folders, folder)
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Name < folders[j].Name })
+	return folders, nil
+}
+
+// MailboxStatus returns the status of a folder
+func (c *JMAPClient) MailboxStatus(folderName string) (*imap.MailboxStatus, error) {
+	mailbox, err := c.mailbox(folderName)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sync(); err != nil {
+		return nil, err
+	}
+
+	validity, next, _ := c.ids.status()
+	status := imap.NewMailboxStatus(folderName, []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity, imap.StatusUnseen})
+	status.Messages = mailbox.TotalEmails
+	status.Unseen = mailbox.UnreadEmails
+	status.UidNext = next
+	status.UidValidity = validity
+	return status, nil
+}
+
+// MailboxState returns the change markers of a folder. The modseq changes
+// whenever any email of the account does.
+func (c *JMAPClient) MailboxState(folderName string) (*models.MailboxState, error) {
+	mailbox, err := c.mailbox(folderName)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sync(); err != nil {
+		return nil, err
+	}
+
+	validity, next, modseq := c.ids.status()
+	return &models.MailboxState{
+		UIDValidity:   validity,
+		UIDNext:       next,
+		HighestModSeq: modseq,
+		Messages:      mailbox.TotalEmails,
+	}, nil
+}
+
+// UnreadCounts returns the number of unseen messages in every folder
+func (c *JMAPClient) UnreadCounts() (map[string]uint32, error) {
+	mailboxes, err := c.loadMailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]uint32, len(mailboxes))
+	for path, mailbox := range mailboxes {
+		counts[path] = mailbox.UnreadEmails
+	}
+	return counts, nil
+}
+
+// FolderUsage returns the size of a folder from the sizes of its emails and
+// of their attachments
+func (c *JMAPClient) FolderUsage(folderName string) (*models.FolderUsage, error) {
+	mailbox, err := c.mailbox(folderName)
+	if err != nil {
+		return nil, err
+	}
+	usage := &models.FolderUsage{Folder: folderName, Messages: mailbox.TotalEmails, Unseen: mailbox.UnreadEmails}
+
+	ids, err := c.folderIDs(folderName, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sync(); err != nil {
+		return nil, err
+	}
+	list, err := c.getEmails(ids, "id", "size", "attachments")
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+
+	sizes := make(map[uint32]int64, len(list))
+	for _, e := range list {
+		sizes[c.ids.uid(e.ID)] = e.Size
+		usage.Bytes += e.Size
+		for _, part := range e.Attachments {
+			usage.AttachmentBytes += int64(part.Size)
+		}
+	}
+	usage.Largest = largestMessages(folderName, sizes)
+	return usage, nil
+}
+
+// setMailboxes runs a Mailbox/set and fails if it wasn't applied
+func (c *JMAPClient) setMailboxes(args map[string]interface{}) error {
+	c.mailboxes = nil
+	return c.set("Mailbox/set", args)
+}
+
+// set runs a /set call and fails if any of its changes were rejected
+func (c *JMAPClient) set(method string, args map[string]interface{}) error {
+	responses, err := c.call(jmapCall{method, args})
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		NotCreated   map[string]jmapError `json:"notCreated"`
+		NotUpdated   map[string]jmapError `json:"notUpdated"`
+		NotDestroyed map[string]jmapError `json:"notDestroyed"`
+	}
+	if err := json.Unmarshal(responses[0], &result); err != nil {
+		return err
+	}
+	for _, failed := range []map[string]jmapError{result.NotCreated, result.NotUpdated, result.NotDestroyed} {
+		for id := range failed {
+			setErr := failed[id]
+			return fmt.Errorf("%s: %w", method, &setErr)
+		}
+	}
+	return nil
+}
+
+// splitMailboxPath returns the parent mailbox id and name of a folder path
+func (c *JMAPClient) splitMailboxPath(folderName string) (interface{}, string, error) {
+	i := strings.LastIndex(folderName, jmapDelimiter)
+	if i < 0 {
+		return nil, folderName, nil
+	}
+	parent, err := c.mailbox(folderName[:i])
+	if err != nil {
+		return nil, "", err
+	}
+	return parent.ID, folderName[i+1:], nil
+}
+
+// CreateFolder creates a new folder
+func (c *JMAPClient) CreateFolder(folderName string) error {
+	parentID, name, err := c.splitMailboxPath(folderName)
+	if err != nil {
+		return err
+	}
+	return c.setMailboxes(map[string]interface{}{
+		"create": map[string]interface{}{
+			"folder": map[string]interface{}{"name": name, "parentId": parentID},
+		},
+	})
+}
+
+// RenameFolder renames or moves a folder
+func (c *JMAPClient) RenameFolder(oldName, newName string) error {
+	mailbox, err := c.mailbox(oldName)
+	if err != nil {
+		return err
+	}
+	parentID, name, err := c.splitMailboxPath(newName)
+	if err != nil {
+		return err
+	}
+	return c.setMailboxes(map[string]interface{}{
+		"update": map[string]interface{}{
+			mailbox.ID: map[string]interface{}{"name": name, "parentId": parentID},
+		},
+	})
+}
+
+// DeleteFolder deletes a folder along with its messages, like IMAP DELETE
+func (c *JMAPClient) DeleteFolder(folderName string) error {
+	mailbox, err := c.mailbox(folderName)
+	if err != nil {
+		return err
+	}
+	return c.setMailboxes(map[string]interface{}{
+		"destroy":               []string{mailbox.ID},
+		"onDestroyRemoveEmails": true,
+	})
+}
+
+// ArchiveFolder returns the folder archived mail goes to: the mailbox with
+// the archive role if there is one, else "Archive", created if needed
+func (c *JMAPClient) ArchiveFolder() (string, error) {
+	if mailbox, ok := c.mailboxByRole("archive", "Archive"); ok {
+		return mailbox.path, nil
+	}
+	if err := c.CreateFolder("Archive"); err != nil {
+		return "", fmt.Errorf("error creating Archive folder: %v", err)
+	}
+	return "Archive", nil
+}
+
+// queryEmails returns a window of a folder's emails, newest first, and the
+// number of emails in the folder
+func (c *JMAPClient) queryEmails(folderName string, position, limit uint32) ([]jmapEmail, uint32, error) {
+	mailbox, err := c.mailbox(folderName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	responses, err := c.call(
+		jmapCall{"Email/query", map[string]interface{}{
+			"filter":         map[string]interface{}{"inMailbox": mailbox.ID},
+			"sort":           []map[string]interface{}{{"property": "receivedAt", "isAscending": false}},
+			"position":       position,
+			"limit":          limit,
+			"calculateTotal": true,
+		}},
+		emailGet(map[string]interface{}{"#ids": jmapRef(0, "Email/query", "/ids")}),
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error fetching messages of %s: %v", folderName, err)
+	}
+
+	var query struct {
+		Total uint32 `json:"total"`
+	}
+	var get struct {
+		List []jmapEmail `json:"list"`
+	}
+	if err := json.Unmarshal(responses[0], &query); err != nil {
+		return nil, 0, err
+	}
+	if err := json.Unmarshal(responses[1], &get); err != nil {
+		return nil, 0, err
+	}
+	return get.List, query.Total, nil
+}
+
+// getEmails fetches emails by id, in batches the server accepts
+func (c *JMAPClient) getEmails(ids []string, properties ...string) ([]jmapEmail, error) {
+	var emails []jmapEmail
+	for start := 0; start < len(ids); start += c.maxObjects() {
+		end := start + c.maxObjects()
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		call := emailGet(map[string]interface{}{"ids": ids[start:end]})
+		if len(properties) > 0 {
+			call.args["properties"] = properties
+		}
+		responses, err := c.call(call)
+		if err != nil {
+			return nil, err
+		}
+		var get struct {
+			List []jmapEmail `json:"list"`
+		}
+		if err := json.Unmarshal(responses[0], &get); err != nil {
+			return nil, err
+		}
+		emails = append(emails, get.List...)
+	}
+	return emails, nil
+}
+
+// toEmails converts JMAP emails to the model, oldest first like IMAP
+// fetches return them
+func (c *JMAPClient) toEmails(list []jmapEmail, folderName string) []models.Email {
+	emails := make([]models.Email, 0, len(list))
+	for i := range list {
+		emails = append(emails, c.toEmail(&list[i], folderName))
+	}
+	sort.SliceStable(emails, func(i, j int) bool { return emails[i].Date.Before(emails[j].Date) })
+	return emails
+}
+
+// FetchMessages retrieves the newest messages of a folder
+func (c *JMAPClient) FetchMessages(folderName string, limit uint32) ([]models.Email, error) {
+	list, _, err := c.queryEmails(folderName, 0, limit)
+	if err != nil {
+		return nil, err
+	}
+	return c.toEmails(list, folderName), nil
+}
+
+// FetchMessagesPaginated retrieves messages with pagination support
+func (c *JMAPClient) FetchMessagesPaginated(folderName string, page, pageSize uint32) (*models.PaginatedEmails, error) {
+	mailbox, err := c.mailbox(folderName)
+	if err != nil {
+		return nil, err
+	}
+	if mailbox.TotalEmails == 0 {
+		return models.NewPaginatedEmails([]models.Email{}, page, pageSize, 0), nil
+	}
+
+	totalPages := (mailbox.TotalEmails + pageSize - 1) / pageSize
+	if page < 1 {
+		page = 1
+	}
+	if page > totalPages {
+		page = totalPages
+	}
+
+	list, total, err := c.queryEmails(folderName, (page-1)*pageSize, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return models.NewPaginatedEmails(c.toEmails(list, folderName), page, pageSize, total), nil
+}
+
+// FetchThreads retrieves enough recent messages to fill the given page of
+// threads and organizes them into threads. The returned bool is true when
+// the whole folder was fetched.
+func (c *JMAPClient) FetchThreads(folderName string, page, pageSize uint32) ([]*models.EmailThread, bool, error) {
+	limit := page * pageSize * threadWindowFactor
+
+	list, total, err := c.queryEmails(folderName, 0, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	return threadEmails(c.toEmails(list, folderName)), total <= limit, nil
+}
+
+// FetchSingleMessage retrieves a single message by UID
+func (c *JMAPClient) FetchSingleMessage(folderName, uid string) (models.Email, error) {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return models.Email{}, fmt.Errorf("invalid UID: %v", err)
+	}
+	emails, err := c.FetchMessagesByUIDs(folderName, []uint32{uidNum})
+	if err != nil {
+		return models.Email{}, err
+	}
+	if len(emails) == 0 {
+		return models.Email{}, fmt.Errorf("message not found")
+	}
+	return emails[0], nil
+}
+
+// emailIDs returns the email ids of UIDs, skipping unknown ones
+func (c *JMAPClient) emailIDs(uids []uint32) ([]string, error) {
+	if err := c.sync(); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		if id, ok := c.ids.id(uid); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// FetchMessagesByUIDs retrieves messages for a specific list of UIDs
+func (c *JMAPClient) FetchMessagesByUIDs(folderName string, uids []uint32) ([]models.Email, error) {
+	if len(uids) == 0 {
+		return []models.Email{}, nil
+	}
+	ids, err := c.emailIDs(uids)
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.getEmails(ids)
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+	return c.toEmails(list, folderName), nil
+}
+
+// FetchNewMessages retrieves messages with a UID greater than sinceUID
+func (c *JMAPClient) FetchNewMessages(folderName string, sinceUID uint32) ([]models.Email, error) {
+	mailbox, err := c.mailbox(folderName)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sync(); err != nil {
+		return nil, err
+	}
+
+	list, err := c.getEmails(c.ids.idsAbove(sinceUID))
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+	var inFolder []jmapEmail
+	for _, e := range list {
+		if e.MailboxIDs[mailbox.ID] {
+			inFolder = append(inFolder, e)
+		}
+	}
+	return c.toEmails(inFolder, folderName), nil
+}
+
+// folderIDs returns the ids of the emails in a folder matching filter
+func (c *JMAPClient) folderIDs(folderName string, filter map[string]interface{}) ([]string, error) {
+	mailbox, err := c.mailbox(folderName)
+	if err != nil {
+		return nil, err
+	}
+	conditions := []interface{}{map[string]interface{}{"inMailbox": mailbox.ID}}
+	if filter != nil {
+		conditions = append(conditions, filter)
+	}
+
+	var ids []string
+	for {
+		responses, err := c.call(jmapCall{"Email/query", map[string]interface{}{
+			"filter":         map[string]interface{}{"operator": "AND", "conditions": conditions},
+			"position":       len(ids),
+			"limit":          jmapSyncPage,
+			"calculateTotal": true,
+		}})
+		if err != nil {
+			return nil, fmt.Errorf("search failed: %v", err)
+		}
+		var query struct {
+			IDs   []string `json:"ids"`
+			Total int      `json:"total"`
+		}
+		if err := json.Unmarshal(responses[0], &query); err != nil {
+			return nil, err
+		}
+		ids = append(ids, query.IDs...)
+		if len(query.IDs) == 0 || len(ids) >= query.Total {
+			return ids, nil
+		}
+	}
+}
+
+// FetchFlags retrieves the flags of every message with a UID of at least fromUID
+func (c *JMAPClient) FetchFlags(folderName string, fromUID uint32) (map[uint32][]string, error) {
+	ids, err := c.folderIDs(folderName, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sync(); err != nil {
+		return nil, err
+	}
+
+	var wanted []string
+	for _, id := range ids {
+		if c.ids.uid(id) >= fromUID {
+			wanted = append(wanted, id)
+		}
+	}
+	list, err := c.getEmails(wanted, "id", "keywords")
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+
+	flags := make(map[uint32][]string, len(list))
+	for _, e := range list {
+		flags[c.ids.uid(e.ID)] = keywordFlags(e.Keywords)
+	}
+	return flags, nil
+}
+
+// FetchMessageIDs returns the Message-ID of each of the given UIDs
+func (c *JMAPClient) FetchMessageIDs(folderName string, uids []uint32) (map[uint32]string, error) {
+	messageIDs := make(map[uint32]string)
+	ids, err := c.emailIDs(uids)
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.getEmails(ids, "id", "messageId")
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+	for _, e := range list {
+		if len(e.MessageID) > 0 {
+			messageIDs[c.ids.uid(e.ID)] = "<" + e.MessageID[0] + ">"
+		}
+	}
+	return messageIDs, nil
+}
+
+// FindUIDByMessageID returns the UID of the message with the given
+// Message-ID, or 0 if the folder has no such message
+func (c *JMAPClient) FindUIDByMessageID(folderName, messageID string) (uint32, error) {
+	ids, err := c.folderIDs(folderName, map[string]interface{}{
+		"header": []string{"Message-ID", messageID},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	if err := c.sync(); err != nil {
+		return 0, err
+	}
+	return c.ids.uid(ids[0]), nil
+}
+
+// jmapHeaderFilters are the filter properties of the headers JMAP can
+// search directly
+var jmapHeaderFilters = map[string]string{
+	"From":    "from",
+	"To":      "to",
+	"Cc":      "cc",
+	"Bcc":     "bcc",
+	"Subject": "subject",
+}
+
+// searchFilter translates IMAP search criteria to a JMAP filter. Every
+// criterion becomes its own condition, since a condition can only hold one
+// value per property.
+func searchFilter(criteria *imap.SearchCriteria) map[string]interface{} {
+	var conditions []interface{}
+	add := func(property string, value interface{}) {
+		conditions = append(conditions, map[string]interface{}{property: value})
+	}
+
+	for name, values := range criteria.Header {
+		for _, value := range values {
+			switch {
+			case jmapHeaderFilters[name] != "":
+				add(jmapHeaderFilters[name], value)
+			case name == textproto.CanonicalMIMEHeaderKey("Content-Type") && strings.EqualFold(value, "multipart/mixed"):
+				add("hasAttachment", true)
+			default:
+				add("header", []string{name, value})
+			}
+		}
+	}
+	for _, value := range criteria.Body {
+		add("body", value)
+	}
+	for _, value := range criteria.Text {
+		add("text", value)
+	}
+
+	// JMAP has no sent date filter; the received date is close enough
+	for _, since := range []time.Time{criteria.Since, criteria.SentSince} {
+		if !since.IsZero() {
+			add("after", since.UTC().Format(time.RFC3339))
+		}
+	}
+	for _, before := range []time.Time{criteria.Before, criteria.SentBefore} {
+		if !before.IsZero() {
+			add("before", before.UTC().Format(time.RFC3339))
+		}
+	}
+
+	for _, flag := range criteria.WithFlags {
+		add("hasKeyword", flagKeyword(flag))
+	}
+	for _, flag := range criteria.WithoutFlags {
+		add("notKeyword", flagKeyword(flag))
+	}
+	if criteria.Larger > 0 {
+		add("minSize", criteria.Larger+1)
+	}
+	if criteria.Smaller > 0 {
+		add("maxSize", criteria.Smaller)
+	}
+
+	for _, not := range criteria.Not {
+		conditions = append(conditions, map[string]interface{}{
+			"operator":   "NOT",
+			"conditions": []interface{}{searchFilter(not)},
+		})
+	}
+	for _, or := range criteria.Or {
+		conditions = append(conditions, map[string]interface{}{
+			"operator":   "OR",
+			"conditions": []interface{}{searchFilter(or[0]), searchFilter(or[1])},
+		})
+	}
+
+	return map[string]interface{}{"operator": "AND", "conditions": conditions}
+}
+
+// SearchUIDs returns the UIDs of the messages in a folder matching criteria
+func (c *JMAPClient) SearchUIDs(folderName string, criteria *imap.SearchCriteria) ([]uint32, error) {
+	ids, err := c.folderIDs(folderName, searchFilter(criteria))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sync(); err != nil {
+		return nil, err
+	}
+
+	uids := make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		uid := c.ids.uid(id)
+		if criteria.Uid == nil || criteria.Uid.Contains(uid) {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, nil
+}
+
+// FetchHeaders returns the full headers and MIME structure of a message
+func (c *JMAPClient) FetchHeaders(folderName, uid string) (*models.MessageHeaders, error) {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID: %v", err)
+	}
+	ids, err := c.emailIDs([]uint32{uidNum})
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("message not found")
+	}
+
+	responses, err := c.call(jmapCall{"Email/get", map[string]interface{}{
+		"ids":            ids,
+		"properties":     []string{"headers", "bodyStructure"},
+		"bodyProperties": []string{"partId", "type", "charset", "disposition", "name", "size", "subParts"},
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+	var get struct {
+		List []struct {
+			Headers []struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			} `json:"headers"`
+			BodyStructure jmapBodyPart `json:"bodyStructure"`
+		} `json:"list"`
+	}
+	if err := json.Unmarshal(responses[0], &get); err != nil {
+		return nil, err
+	}
+	if len(get.List) == 0 {
+		return nil, fmt.Errorf("message not found")
+	}
+	e := get.List[0]
+
+	// Header values are raw, starting right after the colon
+	var raw strings.Builder
+	for _, header := range e.Headers {
+		raw.WriteString(header.Name + ":" + header.Value + "\r\n")
+	}
+
+	parts := []models.MessagePart{}
+	var walk func(part jmapBodyPart)
+	walk = func(part jmapBodyPart) {
+		if strings.HasPrefix(part.Type, "multipart/") {
+			for _, child := range part.SubParts {
+				walk(child)
+			}
+			return
+		}
+		parts = append(parts, models.MessagePart{
+			Part:        part.PartID,
+			ContentType: strings.ToLower(part.Type),
+			Charset:     part.Charset,
+			Disposition: strings.ToLower(part.Disposition),
+			Filename:    part.Name,
+			Size:        part.Size,
+		})
+	}
+	walk(e.BodyStructure)
+
+	return newMessageHeaders(raw.String(), parts), nil
+}
+
+// fetchPart downloads the part of a message chosen by pick
+func (c *JMAPClient) fetchPart(uid string, pick func([]jmapBodyPart, map[string]jmapBodyPart) (jmapBodyPart, bool)) (*models.Attachment, error) {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID: %v", err)
+	}
+	ids, err := c.emailIDs([]uint32{uidNum})
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.getEmails(ids, "id", "attachments")
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("message not found")
+	}
+
+	part, ok := pick(splitAttachments(list[0].Attachments))
+	if !ok {
+		return nil, fmt.Errorf("attachment not found")
+	}
+	content, err := c.download(part.BlobID, part.Name, part.Type)
+	if err != nil {
+		return nil, err
+	}
+	return &models.Attachment{
+		Filename:    part.Name,
+		ContentType: strings.ToLower(part.Type),
+		Part:        part.PartID,
+		Size:        len(content),
+		Content:     content,
+	}, nil
+}
+
+// FetchAttachment fetches the content of the index-th attachment of a message
+func (c *JMAPClient) FetchAttachment(folderName, uid string, index int) (*models.Attachment, error) {
+	return c.fetchPart(uid, func(parts []jmapBodyPart, _ map[string]jmapBodyPart) (jmapBodyPart, bool) {
+		if index < 0 || index >= len(parts) {
+			return jmapBodyPart{}, false
+		}
+		return parts[index], true
+	})
+}
+
+// FetchInlinePart fetches the content of the inline part a cid: URL in the
+// message's HTML refers to
+func (c *JMAPClient) FetchInlinePart(folderName, uid, contentID string) (*models.Attachment, error) {
+	return c.fetchPart(uid, func(_ []jmapBodyPart, inline map[string]jmapBodyPart) (jmapBodyPart, bool) {
+		part, ok := inline[normalizeContentID(contentID)]
+		return part, ok
+	})
+}
+
+// updateEmail applies a patch to the email with a UID
+func (c *JMAPClient) updateEmail(uid string, patch map[string]interface{}) error {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return fmt.Errorf("invalid UID: %v", err)
+	}
+	ids, err := c.emailIDs([]uint32{uidNum})
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("message not found")
+	}
+	return c.set("Email/set", map[string]interface{}{
+		"update": map[string]interface{}{ids[0]: patch},
+	})
+}
+
+// MarkMessageAsRead marks a message as read
+func (c *JMAPClient) MarkMessageAsRead(folderName, uid string) error {
+	return c.updateEmail(uid, map[string]interface{}{"keywords/$seen": true})
+}
+
+// MarkMessageAsUnread marks a message as unread
+func (c *JMAPClient) MarkMessageAsUnread(folderName, uid string) error {
+	return c.updateEmail(uid, map[string]interface{}{"keywords/$seen": nil})
+}
+
+// SetFlags adds flags to a message, or removes them when add is false
+func (c *JMAPClient) SetFlags(folderName, uid string, flags []string, add bool) error {
+	patch := make(map[string]interface{}, len(flags))
+	for _, flag := range flags {
+		if add {
+			patch["keywords/"+flagKeyword(flag)] = true
+		} else {
+			patch["keywords/"+flagKeyword(flag)] = nil
+		}
+	}
+	return c.updateEmail(uid, patch)
+}
+
+// MoveMessage moves a message from one folder to another
+func (c *JMAPClient) MoveMessage(sourceFolder, targetFolder, uid string) error {
+	source, err := c.mailbox(sourceFolder)
+	if err != nil {
+		return err
+	}
+	target, err := c.mailbox(targetFolder)
+	if err != nil {
+		return err
+	}
+	return c.updateEmail(uid, map[string]interface{}{
+		"mailboxIds/" + source.ID: nil,
+		"mailboxIds/" + target.ID: true,
+	})
+}
+
+// DeleteMessage permanently deletes a message
+func (c *JMAPClient) DeleteMessage(folderName, uid string) error {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return fmt.Errorf("invalid UID: %v", err)
+	}
+	ids, err := c.emailIDs([]uint32{uidNum})
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("message not found")
+	}
+	return c.set("Email/set", map[string]interface{}{"destroy": ids})
+}
+
+// SaveToSent stores a copy of a sent message in the Sent folder
+func (c *JMAPClient) SaveToSent(to, subject, body string) error {
+	sent, ok := c.mailboxByRole("sent", "Sent", "Sent Items", "Sent Mail")
+	if !ok {
+		return fmt.Errorf("could not find Sent folder")
+	}
+
+	message := fmt.Sprintf("From: %s\r\n"+
+		"To: %s\r\n"+
+		"Subject: %s\r\n"+
+		"Date: %s\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n"+
+		"\r\n"+
+		"%s", c.session.Username, to, subject,
+		time.Now().Format(time.RFC1123Z), body)
+
+	return c.importEmail(sent.ID, []byte(message), []string{imap.SeenFlag})
+}
+
+// AppendMessage stores a raw message in a folder with the given flags
+func (c *JMAPClient) AppendMessage(folderName string, message []byte, flags []string) error {
+	mailbox, err := c.mailbox(folderName)
+	if err != nil {
+		return err
+	}
+	return c.importEmail(mailbox.ID, message, flags)
+}
+
+// importEmail uploads a raw message and imports it into a mailbox
+func (c *JMAPClient) importEmail(mailboxID string, message []byte, flags []string) error {
+	blobID, err := c.upload(message, "message/rfc822")
+	if err != nil {
+		return err
+	}
+	keywords := make(map[string]bool, len(flags))
+	for _, flag := range flags {
+		keywords[flagKeyword(flag)] = true
+	}
+	return c.set("Email/import", map[string]interface{}{
+		"emails": map[string]interface{}{
+			"message": map[string]interface{}{
+				"blobId":     blobID,
+				"mailboxIds": map[string]bool{mailboxID: true},
+				"keywords":   keywords,
+			},
+		},
+	})
+}
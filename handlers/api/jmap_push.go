@@ -0,0 +1,107 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jmapPingInterval is how often the server is asked to ping an idle event
+// source, in seconds
+const jmapPingInterval = 300
+
+// jmapPushTimeout is how long an event source may stay silent before it is
+// considered dead, a little over the ping interval
+const jmapPushTimeout = (jmapPingInterval + 60) * time.Second
+
+// WatchChanges follows the account's event source (RFC 8620, section 7.3)
+// and signals changed whenever an email or mailbox of the account changes.
+// It returns when ctx is done or the stream fails.
+func (c *JMAPClient) WatchChanges(ctx context.Context, changed chan<- struct{}) error {
+	if c.session.EventSourceURL == "" {
+		return ErrPushUnsupported
+	}
+	u := expandTemplate(c.session.EventSourceURL, map[string]string{
+		"types":      "Email,Mailbox",
+		"closeafter": "no",
+		"ping":       fmt.Sprint(jmapPingInterval),
+	})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// The stream outlives the client's request timeout
+	resp, err := c.doWith(&http.Client{Transport: c.http.Transport}, req)
+	if err != nil {
+		return fmt.Errorf("error opening JMAP event source: %v", err)
+	}
+	defer resp.Body.Close()
+
+	watchdog := time.AfterFunc(jmapPushTimeout, cancel)
+	defer watchdog.Stop()
+
+	var event string
+	var data strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		watchdog.Reset(jmapPushTimeout)
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			// A blank line ends the event
+			if event == "state" || event == "" {
+				if c.stateChanged(data.String()) {
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("JMAP event source failed: %v", err)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.New("JMAP event source closed")
+}
+
+// stateChanged reports whether a StateChange event concerns the account
+func (c *JMAPClient) stateChanged(data string) bool {
+	var change struct {
+		Type    string                       `json:"@type"`
+		Changed map[string]map[string]string `json:"changed"`
+	}
+	if json.Unmarshal([]byte(data), &change) != nil || change.Type != "StateChange" {
+		return false
+	}
+	_, ok := change.Changed[c.accountID]
+	return ok
+}
+
+// Refresh forgets what the client has loaded, so that the next calls see
+// the changes the event source announced
+func (c *JMAPClient) Refresh() {
+	c.synced = false
+	c.mailboxes = nil
+}
@@ -1,9 +1,12 @@
 package api
 
 import (
+	"fmt"
+	"lilmail/config"
 	"lilmail/models"
 	"lilmail/storage"
 	"lilmail/utils"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
@@ -13,13 +16,15 @@ import (
 // LabelHandler handles label management requests
 type LabelHandler struct {
 	store   *session.Store
+	config  *config.Config
 	storage *storage.LabelStorage
 }
 
 // NewLabelHandler creates a new label handler
-func NewLabelHandler(store *session.Store, labelStorage *storage.LabelStorage) *LabelHandler {
+func NewLabelHandler(store *session.Store, config *config.Config, labelStorage *storage.LabelStorage) *LabelHandler {
 	return &LabelHandler{
 		store:   store,
+		config:  config,
 		storage: labelStorage,
 	}
 }
@@ -46,6 +51,10 @@ func (h *LabelHandler) CreateLabel(c *fiber.Ctx) error {
 	if req.Color == "" {
 		req.Color = "#808080" // Default grey
 	}
+	if err := h.validateParent(userID, req.ID, req.ParentID); err != nil {
+		return err
+	}
+	req.Rules = cleanLabelRules(req.Rules)
 
 	if err := h.storage.CreateLabel(&req); err != nil {
 		return utils.InternalServerError("Failed to create label", err)
@@ -69,12 +78,129 @@ func (h *LabelHandler) GetLabels(c *fiber.Ctx) error {
 		return utils.InternalServerError("Failed to retrieve labels", err)
 	}
 
+	counts, err := h.storage.CountEmailsByLabel()
+	if err != nil {
+		return utils.InternalServerError("Failed to count labeled emails", err)
+	}
+	// Only report this user's labels
+	userCounts := make(map[string]int, len(labels))
+	for _, label := range labels {
+		userCounts[label.ID] = counts[label.ID]
+	}
+
 	return c.JSON(fiber.Map{
 		"success": true,
 		"labels":  labels,
+		"counts":  userCounts,
+		"tree":    models.BuildLabelTree(labels, userCounts),
+	})
+}
+
+// UpdateLabel changes a label's name, color or description. Fields left out
+// of the request keep their current value.
+func (h *LabelHandler) UpdateLabel(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	id := c.Params("id")
+	if id == "" {
+		return utils.BadRequestError("Label ID required", nil)
+	}
+
+	var req struct {
+		Name        *string             `json:"name"`
+		Color       *string             `json:"color"`
+		Description *string             `json:"description"`
+		ParentID    *string             `json:"parent_id"`
+		Rules       *[]models.LabelRule `json:"rules"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+
+	// Verify ownership
+	label, err := h.storage.GetLabel(id)
+	if err != nil {
+		return utils.NotFoundError("Label not found", nil)
+	}
+	if label.UserID != userID {
+		return utils.UnauthorizedError("Access denied", nil)
+	}
+
+	if req.Name != nil {
+		if *req.Name == "" {
+			return utils.BadRequestError("Label name required", nil)
+		}
+		label.Name = *req.Name
+	}
+	if req.Color != nil {
+		label.Color = *req.Color
+		if label.Color == "" {
+			label.Color = "#808080" // Default grey
+		}
+	}
+	if req.Description != nil {
+		label.Description = *req.Description
+	}
+	if req.ParentID != nil {
+		if err := h.validateParent(userID, label.ID, *req.ParentID); err != nil {
+			return err
+		}
+		label.ParentID = *req.ParentID
+	}
+	if req.Rules != nil {
+		label.Rules = cleanLabelRules(*req.Rules)
+	}
+
+	if err := h.storage.UpdateLabel(label); err != nil {
+		return utils.InternalServerError("Failed to update label", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"label":   label,
 	})
 }
 
+// validateParent checks that parentID is one of the user's labels and that
+// nesting labelID under it wouldn't create a cycle
+func (h *LabelHandler) validateParent(userID, labelID, parentID string) error {
+	for id := parentID; id != ""; {
+		if id == labelID {
+			return utils.BadRequestError("A label can't be nested inside itself", nil)
+		}
+		parent, err := h.storage.GetLabel(id)
+		if err != nil || parent.UserID != userID {
+			return utils.BadRequestError("Parent label not found", nil)
+		}
+		id = parent.ParentID
+	}
+	return nil
+}
+
+// cleanLabelRules trims rule values and drops rules without conditions,
+// which would otherwise never match
+func cleanLabelRules(rules []models.LabelRule) []models.LabelRule {
+	var cleaned []models.LabelRule
+	for _, rule := range rules {
+		rule.SenderDomain = strings.TrimSpace(rule.SenderDomain)
+		rule.ListID = strings.TrimSpace(rule.ListID)
+		var keywords []string
+		for _, keyword := range rule.SubjectKeywords {
+			if keyword = strings.TrimSpace(keyword); keyword != "" {
+				keywords = append(keywords, keyword)
+			}
+		}
+		rule.SubjectKeywords = keywords
+		if !rule.IsEmpty() {
+			cleaned = append(cleaned, rule)
+		}
+	}
+	return cleaned
+}
+
 // DeleteLabel deletes a label
 func (h *LabelHandler) DeleteLabel(c *fiber.Ctx) error {
 	userID, ok := c.Locals("username").(string)
@@ -106,7 +232,14 @@ func (h *LabelHandler) DeleteLabel(c *fiber.Ctx) error {
 	})
 }
 
-// AssignLabel adds a label to an email
+// labelEmailKey is the key label associations use for the message with
+// the given UID in a folder of the session's account
+func labelEmailKey(c *fiber.Ctx, folder, uid string) string {
+	return storage.LabelEmailKey(GetSessionUser(c), GetSessionEmail(c), folder, uid)
+}
+
+// AssignLabel adds a label to an email in the folder given by ?folder=
+// (INBOX by default)
 func (h *LabelHandler) AssignLabel(c *fiber.Ctx) error {
 	// ... Authentication check ...
 	userID, ok := c.Locals("username").(string)
@@ -126,7 +259,8 @@ func (h *LabelHandler) AssignLabel(c *fiber.Ctx) error {
 		return utils.UnauthorizedError("Access denied", nil)
 	}
 
-	if err := h.storage.AssignLabel(emailID, labelID); err != nil {
+	emailKey := labelEmailKey(c, c.Query("folder", "INBOX"), emailID)
+	if err := h.storage.AssignLabel(emailKey, labelID); err != nil {
 		return utils.InternalServerError("Failed to assign label", err)
 	}
 
@@ -136,7 +270,65 @@ func (h *LabelHandler) AssignLabel(c *fiber.Ctx) error {
 	})
 }
 
-// RemoveLabel removes a label from an email
+// maxBulkAssign caps the number of emails labeled in one request
+const maxBulkAssign = 1000
+
+// BulkAssignLabel adds a label to a list of emails, e.g. from a multi-select
+// in the list view, in the folder given by ?folder= (INBOX by default)
+func (h *LabelHandler) BulkAssignLabel(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	labelID := c.Params("labelId")
+
+	var req struct {
+		EmailIDs []string `json:"email_ids"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+
+	folder := c.Query("folder", "INBOX")
+	var emailIDs []string
+	seen := make(map[string]bool, len(req.EmailIDs))
+	for _, id := range req.EmailIDs {
+		id = strings.TrimSpace(id)
+		if id != "" && !seen[id] {
+			seen[id] = true
+			emailIDs = append(emailIDs, labelEmailKey(c, folder, id))
+		}
+	}
+	if len(emailIDs) == 0 {
+		return utils.BadRequestError("Email IDs required", nil)
+	}
+	if len(emailIDs) > maxBulkAssign {
+		return utils.BadRequestError(fmt.Sprintf("At most %d emails can be labeled at once", maxBulkAssign), nil)
+	}
+
+	// Verify label ownership
+	label, err := h.storage.GetLabel(labelID)
+	if err != nil {
+		return utils.NotFoundError("Label not found", nil)
+	}
+	if label.UserID != userID {
+		return utils.UnauthorizedError("Access denied", nil)
+	}
+
+	if err := h.storage.AssignLabelToEmails(emailIDs, labelID); err != nil {
+		return utils.InternalServerError("Failed to assign label", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"message":  "Label assigned",
+		"assigned": len(emailIDs),
+	})
+}
+
+// RemoveLabel removes a label from an email in the folder given by
+// ?folder= (INBOX by default)
 func (h *LabelHandler) RemoveLabel(c *fiber.Ctx) error {
 	// ... Authentication check ...
 	userID, ok := c.Locals("username").(string)
@@ -156,7 +348,8 @@ func (h *LabelHandler) RemoveLabel(c *fiber.Ctx) error {
 		return utils.UnauthorizedError("Access denied", nil)
 	}
 
-	if err := h.storage.RemoveLabel(emailID, labelID); err != nil {
+	emailKey := labelEmailKey(c, c.Query("folder", "INBOX"), emailID)
+	if err := h.storage.RemoveLabel(emailKey, labelID); err != nil {
 		return utils.InternalServerError("Failed to remove label", err)
 	}
 
@@ -166,21 +359,22 @@ func (h *LabelHandler) RemoveLabel(c *fiber.Ctx) error {
 	})
 }
 
-// GetEmailLabels retrieves labels for a specific email
+// GetEmailLabels retrieves the user's labels on an email in the folder
+// given by ?folder= (INBOX by default)
 func (h *LabelHandler) GetEmailLabels(c *fiber.Ctx) error {
-	emailID := c.Params("emailId")
-	
-	// Note: Ideally we should verify if the user owns this email, 
-	// but email ownership check requires IMAP access or checking cache.
-	// For now, checks are loose or assumed handled by upstream middleware/check.
-	
-	labels, err := h.storage.GetLabelsForEmail(emailID)
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	emailKey := labelEmailKey(c, c.Query("folder", "INBOX"), c.Params("emailId"))
+	labels, err := h.storage.GetLabelsForEmail(userID, emailKey)
 	if err != nil {
 		return utils.InternalServerError("Failed to get email labels", err)
 	}
-	
+
 	return c.JSON(fiber.Map{
 		"success": true,
-		"labels": labels,
+		"labels":  labels,
 	})
 }
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+)
+
+// LabelRules applies the auto-labeling rules of a user's labels to newly
+// fetched mail
+type LabelRules struct {
+	labels *storage.LabelStorage
+}
+
+// NewLabelRules creates a new label rules engine
+func NewLabelRules(labelStorage *storage.LabelStorage) *LabelRules {
+	return &LabelRules{labels: labelStorage}
+}
+
+// Apply assigns every label whose rules match to the given emails in a
+// folder of the account with the given address and returns the number of
+// labels assigned. It does nothing without label storage, so new mail is
+// still handled when labels are unavailable.
+func (r *LabelRules) Apply(userID, account, folder string, emails []models.Email) int {
+	if r == nil || r.labels == nil || len(emails) == 0 {
+		return 0
+	}
+
+	labels, err := r.labels.GetLabelsByUser(userID)
+	if err != nil {
+		utils.Log.Error("Label rules: failed to load labels for %s: %v", userID, err)
+		return 0
+	}
+
+	assigned := 0
+	for _, label := range labels {
+		if len(label.Rules) == 0 {
+			continue
+		}
+		for i := range emails {
+			if !labelRulesMatch(label.Rules, &emails[i]) {
+				continue
+			}
+			key := storage.LabelEmailKey(userID, account, folder, emails[i].ID)
+			if err := r.labels.AssignLabel(key, label.ID); err != nil {
+				utils.Log.Error("Label rules: failed to assign %s to %s: %v", label.Name, emails[i].ID, err)
+				continue
+			}
+			assigned++
+		}
+	}
+	return assigned
+}
+
+// labelRulesMatch reports whether any of a label's rules matches the email
+func labelRulesMatch(rules []models.LabelRule, email *models.Email) bool {
+	for _, rule := range rules {
+		if rule.Matches(email) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"fmt"
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// labelExportVersion is bumped when the export format changes
+const labelExportVersion = 1
+
+// LabelExport is a user's labels and email associations as exported to
+// JSON. Folder is where associations without a folder of their own are
+// matched, as in exports from before associations had one.
+type LabelExport struct {
+	Version      int                      `json:"version"`
+	ExportedAt   time.Time                `json:"exported_at"`
+	Folder       string                   `json:"folder,omitempty"`
+	Labels       []models.Label           `json:"labels"`
+	Associations []LabelExportAssociation `json:"associations"`
+}
+
+// LabelExportAssociation links an exported label to an email, by its UID
+// in a folder. The Message-ID lets the link survive UID changes on another
+// server or instance.
+type LabelExportAssociation struct {
+	LabelID   string `json:"label_id"`
+	EmailID   string `json:"email_id"`
+	Folder    string `json:"folder,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// ExportLabels returns the user's labels and their associations with
+// emails of the session's account as a JSON download
+func (h *LabelHandler) ExportLabels(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+	account := GetSessionEmail(c)
+
+	labels, err := h.storage.GetLabelsByUser(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to retrieve labels", err)
+	}
+
+	export := LabelExport{
+		Version:      labelExportVersion,
+		ExportedAt:   time.Now(),
+		Labels:       labels,
+		Associations: []LabelExportAssociation{},
+	}
+
+	uidsByFolder := make(map[string][]uint32)
+	for _, label := range labels {
+		emailKeys, err := h.storage.GetEmailIDsForLabel(label.ID)
+		if err != nil {
+			return utils.InternalServerError("Failed to retrieve label associations", err)
+		}
+		for _, key := range emailKeys {
+			// Only messages of this account can be looked up
+			owner, keyAccount, folder, emailID, ok := storage.ParseLabelEmailKey(key)
+			if !ok || owner != userID || !strings.EqualFold(keyAccount, account) {
+				continue
+			}
+			export.Associations = append(export.Associations, LabelExportAssociation{LabelID: label.ID, EmailID: emailID, Folder: folder})
+			if uid, err := parseUID(emailID); err == nil {
+				uidsByFolder[folder] = append(uidsByFolder[folder], uid)
+			}
+		}
+	}
+
+	if len(uidsByFolder) > 0 {
+		client, err := h.mailClient(c)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		messageIDs := make(map[string]map[uint32]string, len(uidsByFolder))
+		for folder, uids := range uidsByFolder {
+			if messageIDs[folder], err = client.FetchMessageIDs(folder, uids); err != nil {
+				return utils.InternalServerError("Failed to look up Message-IDs", err)
+			}
+		}
+		for i := range export.Associations {
+			assoc := &export.Associations[i]
+			if uid, err := parseUID(assoc.EmailID); err == nil {
+				assoc.MessageID = messageIDs[assoc.Folder][uid]
+			}
+		}
+	}
+
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="lilmail-labels-%s.json"`, time.Now().Format("20060102")))
+	return c.JSON(export)
+}
+
+// ImportLabels recreates labels from an export. Labels get new IDs, and
+// associations are matched to emails of the session's account by
+// Message-ID where possible, falling back to the exported email ID.
+// Associations without a folder are matched in the folder given by
+// ?folder=, else the export's, else INBOX.
+func (h *LabelHandler) ImportLabels(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	var export LabelExport
+	if err := c.BodyParser(&export); err != nil {
+		return utils.BadRequestError("Invalid label export", err)
+	}
+	if export.Version != labelExportVersion {
+		return utils.BadRequestError(fmt.Sprintf("Unsupported label export version %d", export.Version), nil)
+	}
+	folder := c.Query("folder", export.Folder)
+	if folder == "" {
+		folder = "INBOX"
+	}
+
+	// New IDs, so importing twice or into a shared instance can't clash.
+	// Labels without a name aren't imported, so they get none, and their
+	// associations and nesting are dropped below.
+	newIDs := make(map[string]string, len(export.Labels))
+	for _, label := range export.Labels {
+		if label.Name != "" {
+			newIDs[label.ID] = uuid.New().String()
+		}
+	}
+
+	imported := 0
+	for _, label := range export.Labels {
+		if label.Name == "" {
+			continue
+		}
+		label.ID = newIDs[label.ID]
+		label.UserID = userID
+		label.ParentID = newIDs[label.ParentID]
+		label.Rules = cleanLabelRules(label.Rules)
+		if label.Color == "" {
+			label.Color = "#808080" // Default grey
+		}
+		if err := h.storage.CreateLabel(&label); err != nil {
+			return utils.InternalServerError("Failed to create label", err)
+		}
+		imported++
+	}
+
+	var client MailClient
+	matched, skipped := 0, 0
+	byLabel := make(map[string][]string)
+	for _, assoc := range export.Associations {
+		labelID, ok := newIDs[assoc.LabelID]
+		if !ok {
+			skipped++
+			continue
+		}
+
+		assocFolder := assoc.Folder
+		if assocFolder == "" {
+			assocFolder = folder
+		}
+
+		emailID := assoc.EmailID
+		if assoc.MessageID != "" {
+			if client == nil {
+				var err error
+				if client, err = h.mailClient(c); err != nil {
+					return err
+				}
+				defer client.Close()
+			}
+			uid, err := client.FindUIDByMessageID(assocFolder, assoc.MessageID)
+			if err != nil {
+				return utils.InternalServerError("Failed to look up message", err)
+			}
+			if uid == 0 {
+				// The message isn't on this server
+				skipped++
+				continue
+			}
+			emailID = strconv.FormatUint(uint64(uid), 10)
+		}
+		if emailID == "" {
+			skipped++
+			continue
+		}
+
+		byLabel[labelID] = append(byLabel[labelID], labelEmailKey(c, assocFolder, emailID))
+		matched++
+	}
+
+	for labelID, emailIDs := range byLabel {
+		if err := h.storage.AssignLabelToEmails(emailIDs, labelID); err != nil {
+			return utils.InternalServerError("Failed to assign labels", err)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success":      true,
+		"labels":       imported,
+		"associations": matched,
+		"skipped":      skipped,
+	})
+}
+
+// mailClient connects to the mail server with the session's credentials
+func (h *LabelHandler) mailClient(c *fiber.Ctx) (MailClient, error) {
+	creds, err := GetCredentials(c, h.store, h.config.Encryption.Key)
+	if err != nil {
+		return nil, utils.UnauthorizedError("Unauthorized", err)
+	}
+
+	client, err := NewMailClient(creds, h.config)
+	if err != nil {
+		return nil, utils.InternalServerError("Failed to connect to mail server", err)
+	}
+	return client, nil
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"lilmail/config"
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"mime"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// LargeFileHandler handles files sent as expiring download links
+type LargeFileHandler struct {
+	config  *config.Config
+	storage *storage.LargeFileStorage
+}
+
+// NewLargeFileHandler creates a new large file handler
+func NewLargeFileHandler(cfg *config.Config, largeFileStorage *storage.LargeFileStorage) *LargeFileHandler {
+	return &LargeFileHandler{
+		config:  cfg,
+		storage: largeFileStorage,
+	}
+}
+
+// thresholdBytes is the attachment size over which a link is offered
+func (h *LargeFileHandler) thresholdBytes() int64 {
+	return int64(h.config.LargeFiles.ThresholdMB) << 20
+}
+
+// maxBytes is the size of the largest file that can be sent as a link
+func (h *LargeFileHandler) maxBytes() int64 {
+	return int64(h.config.LargeFiles.MaxSizeMB) << 20
+}
+
+// fileSignature signs a link's file ID and expiry
+func (h *LargeFileHandler) fileSignature(file *models.LargeFile) string {
+	mac := hmac.New(sha256.New, []byte(h.config.Encryption.Key))
+	fmt.Fprintf(mac, "file.%s.%d", file.ID, file.ExpiresAt.Unix())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// fileURL is the public download link of a file, for use in emails
+func (h *LargeFileHandler) fileURL(file *models.LargeFile) string {
+	return fmt.Sprintf("%s/files/%s.%s", h.config.PublicURL(), file.ID, h.fileSignature(file))
+}
+
+// fileSummary describes a file to its owner
+func (h *LargeFileHandler) fileSummary(file *models.LargeFile) fiber.Map {
+	summary := fiber.Map{
+		"id":           file.ID,
+		"filename":     file.Filename,
+		"content_type": file.ContentType,
+		"size":         file.Size,
+		"downloads":    file.Downloads,
+		"expires_at":   file.ExpiresAt,
+		"created_at":   file.CreatedAt,
+	}
+	if file.Active() {
+		summary["url"] = h.fileURL(file)
+	}
+	return summary
+}
+
+// GetFiles lists the files the current user sent as links
+func (h *LargeFileHandler) GetFiles(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	files, err := h.storage.GetFilesByUser(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to retrieve files", err)
+	}
+
+	summaries := make([]fiber.Map, 0, len(files))
+	for _, file := range files {
+		summaries = append(summaries, h.fileSummary(file))
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"files":   summaries,
+	})
+}
+
+// DeleteFile deletes one of the current user's files, so its link stops
+// working
+func (h *LargeFileHandler) DeleteFile(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	file, err := h.storage.GetFile(c.Params("id"))
+	if err != nil || file.UserID != userID {
+		return utils.NotFoundError("File not found", err)
+	}
+
+	if err := h.storage.DeleteFile(file); err != nil {
+		return utils.InternalServerError("Failed to delete file", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "File deleted",
+	})
+}
+
+// HandleDownload downloads a file for anyone with its link. Links that are
+// forged, expired or deleted all look the same.
+func (h *LargeFileHandler) HandleDownload(c *fiber.Ctx) error {
+	id, signature, ok := strings.Cut(c.Params("token"), ".")
+	if !ok || id == "" {
+		return utils.NotFoundError("File not found", nil)
+	}
+
+	file, err := h.storage.GetFile(id)
+	if err != nil {
+		return utils.NotFoundError("File not found", err)
+	}
+	if !hmac.Equal([]byte(signature), []byte(h.fileSignature(file))) || !file.Active() {
+		return utils.NotFoundError("File not found", nil)
+	}
+
+	content, err := h.storage.OpenFile(file)
+	if err != nil {
+		return utils.InternalServerError("Failed to open file", err)
+	}
+
+	c.Set("Content-Type", file.ContentType)
+	c.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename}))
+	c.Set("X-Content-Type-Options", "nosniff")
+	c.Set("Cache-Control", "private, no-store")
+	c.Set("X-Robots-Tag", "noindex")
+	return c.SendStream(content, int(file.Size))
+}
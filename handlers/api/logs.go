@@ -0,0 +1,158 @@
+package api
+
+import (
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Page size bounds of the log and audit APIs
+const (
+	defaultLogPageSize = 50
+	maxLogPageSize     = 200
+)
+
+// LogHandler lets admins read the recent application logs and the audit
+// trail from the web UI
+type LogHandler struct {
+	audit *storage.AuditStorage
+}
+
+// NewLogHandler creates a new log handler
+func NewLogHandler(audit *storage.AuditStorage) *LogHandler {
+	return &LogHandler{
+		audit: audit,
+	}
+}
+
+// AuditMiddleware records every change made through the routes it guards.
+// It goes after AdminMiddleware, which sets the acting admin.
+func AuditMiddleware(audit *storage.AuditStorage) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead {
+			return c.Next()
+		}
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if appErr, ok := err.(*utils.AppError); ok {
+			status = appErr.Code
+		}
+		event := &models.AuditEvent{
+			Action: c.Method() + " " + c.Path(),
+			IP:     c.IP(),
+			Status: status,
+		}
+		if admin, ok := c.Locals("adminUser").(*models.User); ok {
+			event.User = admin.Username
+		}
+		if recErr := audit.Record(event); recErr != nil {
+			utils.Log.Error("Failed to record audit event: %v", recErr)
+		}
+
+		return err
+	}
+}
+
+// pageParams reads the page and page_size query parameters
+func pageParams(c *fiber.Ctx) (page, pageSize int) {
+	page = c.QueryInt("page", 1)
+	if page < 1 {
+		page = 1
+	}
+	pageSize = c.QueryInt("page_size", defaultLogPageSize)
+	if pageSize < 1 || pageSize > maxLogPageSize {
+		pageSize = defaultLogPageSize
+	}
+	return page, pageSize
+}
+
+// timeParams reads the since and until query parameters, given as RFC 3339
+// times or dates
+func timeParams(c *fiber.Ctx) (since, until time.Time, err error) {
+	parse := func(name string, endOfDay bool) (time.Time, error) {
+		value := c.Query(name)
+		if value == "" {
+			return time.Time{}, nil
+		}
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, nil
+		}
+		t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			return time.Time{}, utils.BadRequestError("Invalid "+name+" time", err)
+		}
+		if endOfDay {
+			t = t.Add(24*time.Hour - time.Nanosecond)
+		}
+		return t, nil
+	}
+
+	if since, err = parse("since", false); err != nil {
+		return
+	}
+	until, err = parse("until", true)
+	return
+}
+
+// GetLogs returns recent log messages filtered by minimum level, user and
+// time range
+func (h *LogHandler) GetLogs(c *fiber.Ctx) error {
+	since, until, err := timeParams(c)
+	if err != nil {
+		return err
+	}
+	level := c.Query("level")
+	if _, ok := utils.ParseLogLevel(level); level != "" && !ok {
+		return utils.BadRequestError("Unknown log level", nil)
+	}
+
+	page, pageSize := pageParams(c)
+	entries, total := utils.QueryLogs(utils.LogFilter{
+		Level: level,
+		User:  c.Query("user"),
+		Since: since,
+		Until: until,
+	}, (page-1)*pageSize, pageSize)
+
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"entries":   entries,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+		"has_next":  page*pageSize < total,
+	})
+}
+
+// GetAudit returns audit events filtered by user, action and time range
+func (h *LogHandler) GetAudit(c *fiber.Ctx) error {
+	since, until, err := timeParams(c)
+	if err != nil {
+		return err
+	}
+
+	page, pageSize := pageParams(c)
+	events, total, err := h.audit.Query(models.AuditFilter{
+		User:   c.Query("user"),
+		Action: c.Query("action"),
+		Since:  since,
+		Until:  until,
+	}, (page-1)*pageSize, pageSize)
+	if err != nil {
+		return utils.InternalServerError("Failed to read audit log", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"events":    events,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+		"has_next":  page*pageSize < total,
+	})
+}
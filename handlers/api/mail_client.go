@@ -0,0 +1,64 @@
+package api
+
+import (
+	"lilmail/models"
+
+	"github.com/emersion/go-imap"
+)
+
+// MailClient is a connection to a mail account. Client reads the account
+// over IMAP, JMAPClient over JMAP, POP3Client from a store of downloaded
+// mail and GraphClient through Microsoft Graph; all name messages by a UID
+// that is stable within a folder and grows as new mail arrives.
+type MailClient interface {
+	Close() error
+
+	// Folders
+	FetchFolders() ([]*MailboxInfo, error)
+	MailboxStatus(folderName string) (*imap.MailboxStatus, error)
+	MailboxState(folderName string) (*models.MailboxState, error)
+	UnreadCounts() (map[string]uint32, error)
+	FolderUsage(folderName string) (*models.FolderUsage, error)
+	CreateFolder(folderName string) error
+	RenameFolder(oldName, newName string) error
+	DeleteFolder(folderName string) error
+	ArchiveFolder() (string, error)
+
+	// Messages
+	FetchMessages(folderName string, limit uint32) ([]models.Email, error)
+	FetchMessagesPaginated(folderName string, page, pageSize uint32) (*models.PaginatedEmails, error)
+	FetchThreads(folderName string, page, pageSize uint32) ([]*models.EmailThread, bool, error)
+	FetchSingleMessage(folderName, uid string) (models.Email, error)
+	FetchMessagesByUIDs(folderName string, uids []uint32) ([]models.Email, error)
+	FetchNewMessages(folderName string, sinceUID uint32) ([]models.Email, error)
+	FetchFlags(folderName string, fromUID uint32) (map[uint32][]string, error)
+	FetchMessageIDs(folderName string, uids []uint32) (map[uint32]string, error)
+	FindUIDByMessageID(folderName, messageID string) (uint32, error)
+	FetchHeaders(folderName, uid string) (*models.MessageHeaders, error)
+	FetchAttachment(folderName, uid string, index int) (*models.Attachment, error)
+	FetchInlinePart(folderName, uid, contentID string) (*models.Attachment, error)
+	SearchUIDs(folderName string, criteria *imap.SearchCriteria) ([]uint32, error)
+
+	// Changes
+	MarkMessageAsRead(folderName, uid string) error
+	MarkMessageAsUnread(folderName, uid string) error
+	SetFlags(folderName, uid string, flags []string, add bool) error
+	AppendMessage(folderName string, message []byte, flags []string) error
+	MoveMessage(sourceFolder, targetFolder, uid string) error
+	DeleteMessage(folderName, uid string) error
+	SaveToSent(to, subject, body string) error
+}
+
+// MailBackend is everything lilmail does with a mail account: reading and
+// changing it through a MailClient and sending through a MailSender. Code
+// written against it works the same with every protocol, or with a fake.
+type MailBackend interface {
+	MailClient
+	MailSender
+}
+
+// mailBackend pairs the client of an account with the way it sends mail
+type mailBackend struct {
+	MailClient
+	MailSender
+}
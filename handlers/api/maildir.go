@@ -0,0 +1,508 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"lilmail/config"
+	"lilmail/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// maildirDelimiter separates the levels of a Maildir++ folder name, whose
+// directory is the name with a leading dot
+const maildirDelimiter = "."
+
+// maildirIndexes holds the UID index of each Maildir, shared by its clients
+var maildirIndexes sync.Map
+
+// maildirDeliveries numbers the messages this process writes, so their
+// unique names never collide
+var maildirDeliveries atomic.Uint64
+
+// maildirFlags are the IMAP flags of the Maildir info letters, which are
+// kept in ASCII order in file names
+var maildirFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', imap.DraftFlag},
+	{'F', imap.FlaggedFlag},
+	{'P', "$Forwarded"},
+	{'R', imap.AnsweredFlag},
+	{'S', imap.SeenFlag},
+	{'T', imap.DeletedFlag},
+}
+
+// maildirPath returns the Maildir of a user from the configured template.
+// Usernames that could leave the template's directory are refused.
+func maildirPath(cfg config.MaildirConfig, username string) (string, error) {
+	if cfg.Path == "" {
+		return "", fmt.Errorf("Maildir accounts are not enabled")
+	}
+	if username == "" || strings.ContainsAny(username, "/\\\x00") || strings.HasPrefix(username, ".") {
+		return "", fmt.Errorf("invalid Maildir user %q", username)
+	}
+
+	local, domain := username, ""
+	if i := strings.LastIndex(username, "@"); i >= 0 {
+		local, domain = username[:i], username[i+1:]
+	}
+	path := strings.NewReplacer("{user}", username, "{local}", local, "{domain}", domain).Replace(cfg.Path)
+	return filepath.Clean(path), nil
+}
+
+// maildirInfoFlags returns the IMAP flags of a file name's info
+func maildirInfoFlags(info string) []string {
+	flags := []string{}
+	if !strings.HasPrefix(info, "2,") {
+		return flags
+	}
+	for _, f := range maildirFlags {
+		if strings.IndexByte(info[2:], f.letter) >= 0 {
+			flags = append(flags, f.flag)
+		}
+	}
+	return flags
+}
+
+// maildirInfo returns the info of a file name for IMAP flags. Flags Maildir
+// has no letter for are dropped.
+func maildirInfo(flags []string) string {
+	info := "2,"
+	for _, f := range maildirFlags {
+		if hasFlag(flags, f.flag) {
+			info += string(f.letter)
+		}
+	}
+	return info
+}
+
+// splitMaildirName splits a file name into its unique name and its info
+func splitMaildirName(name string) (string, string) {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// newMaildirName returns a unique name for a message delivered now
+func newMaildirName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	// Slashes and colons would break the name
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), maildirDeliveries.Add(1), host)
+}
+
+// maildirMessage is a message file of a folder
+type maildirMessage struct {
+	UID   uint32
+	Name  string // Unique name
+	Info  string
+	Flags []string
+	Date  time.Time // When it was delivered
+	Size  int
+}
+
+// file returns the message's file name in cur
+func (m maildirMessage) file() string {
+	if m.Info == "" {
+		return m.Name
+	}
+	return m.Name + ":" + m.Info
+}
+
+// meta describes the message the way stored messages are searched
+func (m maildirMessage) meta(folder string) pop3Message {
+	return pop3Message{UID: m.UID, Folder: folder, Flags: m.Flags, Date: m.Date, Size: m.Size}
+}
+
+// maildirFolder holds the UIDs of a folder's messages, by unique name, and
+// the info each had when last seen, so that changes made by other programs
+// move the modseq too
+type maildirFolder struct {
+	Validity uint32            `json:"validity"`
+	Next     uint32            `json:"next"`
+	UIDs     map[string]uint32 `json:"uids"`
+	Infos    map[string]string `json:"infos"`
+}
+
+// maildirIndex assigns UIDs to the messages of a Maildir. Maildir has no
+// UIDs of its own, and the index is kept in lilmail's cache rather than the
+// Maildir, which belongs to the MTA and other mail programs.
+type maildirIndex struct {
+	mu   sync.Mutex
+	path string
+	root string
+	// dirty is set when the index changed since it was saved
+	dirty bool
+
+	ModSeq  uint64                    `json:"modseq"`
+	Folders map[string]*maildirFolder `json:"folders"`
+}
+
+// loadMaildirIndex returns the UID index of the Maildir at root, kept at
+// path, loading it from disk the first time
+func loadMaildirIndex(path, root string) *maildirIndex {
+	if x, ok := maildirIndexes.Load(path); ok {
+		return x.(*maildirIndex)
+	}
+
+	x := &maildirIndex{path: path, root: root}
+	if err := utils.LoadCache(path, x); err != nil || x.ModSeq == 0 {
+		x = &maildirIndex{path: path, root: root, ModSeq: 1}
+	}
+	if x.Folders == nil {
+		x.Folders = make(map[string]*maildirFolder)
+	}
+
+	actual, _ := maildirIndexes.LoadOrStore(path, x)
+	return actual.(*maildirIndex)
+}
+
+// save writes the index to disk if it changed
+func (x *maildirIndex) save() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(x.path), 0700); err != nil {
+		return fmt.Errorf("error creating Maildir cache folder: %v", err)
+	}
+	if err := utils.SaveCache(x.path, x); err != nil {
+		return err
+	}
+	x.dirty = false
+	return nil
+}
+
+// changed records a change, so folder caches see it
+func (x *maildirIndex) changed() {
+	x.ModSeq++
+	x.dirty = true
+}
+
+// dir returns the directory of a folder
+func (x *maildirIndex) dir(folder string) string {
+	if folder == "INBOX" {
+		return x.root
+	}
+	return filepath.Join(x.root, maildirDelimiter+folder)
+}
+
+// folder returns the UIDs of a folder, starting them if the folder is new
+// to the index
+func (x *maildirIndex) folder(name string) *maildirFolder {
+	f, ok := x.Folders[name]
+	if !ok {
+		f = &maildirFolder{
+			Validity: uint32(time.Now().Unix()),
+			Next:     1,
+			UIDs:     make(map[string]uint32),
+			Infos:    make(map[string]string),
+		}
+		x.Folders[name] = f
+		x.dirty = true
+	}
+	return f
+}
+
+// scan lists the messages of a folder by ascending UID. Messages just
+// delivered to new are moved to cur, as mail readers do, and get UIDs in
+// delivery order.
+func (x *maildirIndex) scan(folder string) ([]maildirMessage, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	dir := x.dir(folder)
+	fresh, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading folder %s: %v", folder, err)
+	}
+	for _, entry := range fresh {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		name, _ := splitMaildirName(entry.Name())
+		// Another reader may have moved it first
+		os.Rename(filepath.Join(dir, "new", entry.Name()), filepath.Join(dir, "cur", name+":2,"))
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "cur"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading folder %s: %v", folder, err)
+	}
+
+	f := x.folder(folder)
+	changed := false
+	seen := make(map[string]bool, len(entries))
+	var messages, added []maildirMessage
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Moved or deleted since the directory was read
+			continue
+		}
+		msg := maildirMessage{Date: info.ModTime(), Size: int(info.Size())}
+		msg.Name, msg.Info = splitMaildirName(entry.Name())
+		msg.Flags = maildirInfoFlags(msg.Info)
+		seen[msg.Name] = true
+
+		if old, ok := f.Infos[msg.Name]; !ok || old != msg.Info {
+			f.Infos[msg.Name] = msg.Info
+			changed = true
+		}
+		if uid, ok := f.UIDs[msg.Name]; ok {
+			msg.UID = uid
+			messages = append(messages, msg)
+		} else {
+			added = append(added, msg)
+		}
+	}
+
+	for name := range f.UIDs {
+		if !seen[name] {
+			delete(f.UIDs, name)
+			delete(f.Infos, name)
+			changed = true
+		}
+	}
+
+	sort.SliceStable(added, func(i, j int) bool {
+		if added[i].Date.Equal(added[j].Date) {
+			return added[i].Name < added[j].Name
+		}
+		return added[i].Date.Before(added[j].Date)
+	})
+	for _, msg := range added {
+		msg.UID = f.Next
+		f.Next++
+		f.UIDs[msg.Name] = msg.UID
+		messages = append(messages, msg)
+	}
+
+	if changed {
+		x.changed()
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].UID < messages[j].UID })
+	return messages, nil
+}
+
+// status returns the UID validity and next UID of a folder and the modseq
+// of the Maildir
+func (x *maildirIndex) status(folder string) (uint32, uint32, uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	f := x.folder(folder)
+	return f.Validity, f.Next, x.ModSeq
+}
+
+// deliver writes a message to a folder the Maildir way, through tmp, and
+// gives it the next UID
+func (x *maildirIndex) deliver(folder string, raw []byte, flags []string) (uint32, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	dir := x.dir(folder)
+	name := newMaildirName()
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return 0, fmt.Errorf("error storing message: %v", err)
+	}
+	info := maildirInfo(flags)
+	if err := os.Rename(tmp, filepath.Join(dir, "cur", name+":"+info)); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("error storing message: %v", err)
+	}
+
+	f := x.folder(folder)
+	uid := f.Next
+	f.Next++
+	f.UIDs[name] = uid
+	f.Infos[name] = info
+	x.changed()
+	return uid, nil
+}
+
+// rename gives a message of a folder new flags by renaming its file
+func (x *maildirIndex) rename(folder string, msg maildirMessage, flags []string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	info := maildirInfo(flags)
+	if info == msg.Info {
+		return nil
+	}
+	cur := filepath.Join(x.dir(folder), "cur")
+	if err := os.Rename(filepath.Join(cur, msg.file()), filepath.Join(cur, msg.Name+":"+info)); err != nil {
+		return fmt.Errorf("error setting message flags: %v", err)
+	}
+	x.folder(folder).Infos[msg.Name] = info
+	x.changed()
+	return nil
+}
+
+// move moves a message to another folder, where it gets the next UID
+func (x *maildirIndex) move(source, target string, msg maildirMessage) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	from := filepath.Join(x.dir(source), "cur", msg.file())
+	if err := os.Rename(from, filepath.Join(x.dir(target), "cur", msg.file())); err != nil {
+		return fmt.Errorf("error moving message: %v", err)
+	}
+
+	src := x.folder(source)
+	delete(src.UIDs, msg.Name)
+	delete(src.Infos, msg.Name)
+	dst := x.folder(target)
+	dst.UIDs[msg.Name] = dst.Next
+	dst.Infos[msg.Name] = msg.Info
+	dst.Next++
+	x.changed()
+	return nil
+}
+
+// remove deletes a message of a folder
+func (x *maildirIndex) remove(folder string, msg maildirMessage) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := os.Remove(filepath.Join(x.dir(folder), "cur", msg.file())); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error deleting message: %v", err)
+	}
+	f := x.folder(folder)
+	delete(f.UIDs, msg.Name)
+	delete(f.Infos, msg.Name)
+	x.changed()
+	return nil
+}
+
+// folders returns the names of the Maildir's folders, INBOX first
+func (x *maildirIndex) folders() ([]string, error) {
+	entries, err := os.ReadDir(x.root)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Maildir: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, maildirDelimiter) || name == "." || name == ".." {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(x.root, name, "cur")); err != nil || !info.IsDir() {
+			continue
+		}
+		names = append(names, name[1:])
+	}
+	sort.Strings(names)
+	return append([]string{"INBOX"}, names...), nil
+}
+
+// validMaildirFolder checks a folder name before it becomes a directory
+func validMaildirFolder(name string) error {
+	if name == "" || strings.EqualFold(name, "INBOX") {
+		return fmt.Errorf("invalid folder name")
+	}
+	if strings.ContainsAny(name, "/\\\x00") || strings.HasPrefix(name, maildirDelimiter) ||
+		strings.HasSuffix(name, maildirDelimiter) || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid folder name %q", name)
+	}
+	return nil
+}
+
+// createFolder creates a Maildir++ folder
+func (x *maildirIndex) createFolder(name string) error {
+	if err := validMaildirFolder(name); err != nil {
+		return err
+	}
+	dir := x.dir(name)
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("folder %s already exists", name)
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return fmt.Errorf("error creating folder: %v", err)
+		}
+	}
+	// Marks the directory as a folder for Courier and Dovecot
+	return os.WriteFile(filepath.Join(dir, "maildirfolder"), nil, 0600)
+}
+
+// renameFolder renames a folder and its subfolders, keeping their UIDs
+func (x *maildirIndex) renameFolder(oldName, newName string) error {
+	if err := validMaildirFolder(oldName); err != nil {
+		return fmt.Errorf("cannot rename %s", oldName)
+	}
+	if err := validMaildirFolder(newName); err != nil {
+		return err
+	}
+	if _, err := os.Stat(x.dir(newName)); err == nil {
+		return fmt.Errorf("folder %s already exists", newName)
+	}
+	names, err := x.folders()
+	if err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, name := range names {
+		if name != oldName && !strings.HasPrefix(name, oldName+maildirDelimiter) {
+			continue
+		}
+		renamed := newName + strings.TrimPrefix(name, oldName)
+		if err := os.Rename(x.dir(name), x.dir(renamed)); err != nil {
+			return fmt.Errorf("error renaming folder: %v", err)
+		}
+		if f, ok := x.Folders[name]; ok {
+			delete(x.Folders, name)
+			x.Folders[renamed] = f
+		}
+	}
+	x.changed()
+	return nil
+}
+
+// deleteFolder deletes a folder and the messages in it. Its subfolders
+// are left, as Maildir++ allows.
+func (x *maildirIndex) deleteFolder(name string) error {
+	if err := validMaildirFolder(name); err != nil {
+		return fmt.Errorf("cannot delete %s", name)
+	}
+	if _, err := os.Stat(x.dir(name)); err != nil {
+		return fmt.Errorf("folder %s not found", name)
+	}
+	if err := os.RemoveAll(x.dir(name)); err != nil {
+		return fmt.Errorf("error deleting folder: %v", err)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.Folders, name)
+	x.changed()
+	return nil
+}
+
+// maildirCachePath returns where the index of the Maildir at root is kept.
+// Not in the user's cache folder, which is cleared on logout.
+func maildirCachePath(cacheFolder, root string) string {
+	key := sha256.Sum256([]byte(root))
+	return filepath.Join(cacheFolder, "maildir", hex.EncodeToString(key[:])[:32]+".json")
+}
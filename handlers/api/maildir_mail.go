@@ -0,0 +1,646 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"lilmail/config"
+	"lilmail/models"
+	"lilmail/utils"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// MaildirClient reads a Maildir on the lilmail host, the way the MTA
+// delivers it, without going through an IMAP server. Folders follow the
+// Maildir++ layout Courier and Dovecot use, so other mail programs reading
+// the same Maildir see the same folders and flags.
+type MaildirClient struct {
+	username string
+	index    *maildirIndex
+	// listed caches the messages of each folder read by this client
+	listed map[string][]maildirMessage
+}
+
+// NewMaildirClient opens the Maildir of a user
+func NewMaildirClient(cfg config.MaildirConfig, username, cacheFolder string) (*MaildirClient, error) {
+	root, err := maildirPath(cfg, username)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(filepath.Join(root, "cur")); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("no Maildir at %s", root)
+	}
+
+	return &MaildirClient{
+		username: username,
+		index:    loadMaildirIndex(maildirCachePath(cacheFolder, root), root),
+		listed:   make(map[string][]maildirMessage),
+	}, nil
+}
+
+// Close saves the UID index
+func (c *MaildirClient) Close() error {
+	return c.index.save()
+}
+
+// Refresh forgets the folders this client read, so changes made since are
+// seen
+func (c *MaildirClient) Refresh() {
+	c.listed = make(map[string][]maildirMessage)
+}
+
+// folder checks that a folder exists
+func (c *MaildirClient) folder(folderName string) (string, error) {
+	if strings.EqualFold(folderName, "INBOX") {
+		return "INBOX", nil
+	}
+	if validMaildirFolder(folderName) != nil {
+		return "", fmt.Errorf("folder %s not found", folderName)
+	}
+	if info, err := os.Stat(filepath.Join(c.index.dir(folderName), "cur")); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("folder %s not found", folderName)
+	}
+	return folderName, nil
+}
+
+// list returns the messages of a folder by ascending UID
+func (c *MaildirClient) list(folder string) ([]maildirMessage, error) {
+	if messages, ok := c.listed[folder]; ok {
+		return messages, nil
+	}
+	messages, err := c.index.scan(folder)
+	if err != nil {
+		return nil, err
+	}
+	c.listed[folder] = messages
+	return messages, nil
+}
+
+// message returns the message with a UID in folder
+func (c *MaildirClient) message(folder string, uid uint32) (maildirMessage, error) {
+	messages, err := c.list(folder)
+	if err != nil {
+		return maildirMessage{}, err
+	}
+	i := sort.Search(len(messages), func(i int) bool { return messages[i].UID >= uid })
+	if i == len(messages) || messages[i].UID != uid {
+		return maildirMessage{}, fmt.Errorf("message not found")
+	}
+	return messages[i], nil
+}
+
+// raw reads the text of a message
+func (c *MaildirClient) raw(folder string, msg maildirMessage) ([]byte, error) {
+	return os.ReadFile(filepath.Join(c.index.dir(folder), "cur", msg.file()))
+}
+
+// FetchFolders retrieves all mailbox folders
+func (c *MaildirClient) FetchFolders() ([]*MailboxInfo, error) {
+	names, err := c.index.folders()
+	if err != nil {
+		return nil, err
+	}
+	var folders []*MailboxInfo
+	for _, name := range names {
+		folder := &MailboxInfo{
+			Name:       name,
+			Delimiter:  maildirDelimiter,
+			Attributes: []string{},
+		}
+		if attr, ok := pop3FolderAttrs[name]; ok {
+			folder.Attributes = append(folder.Attributes, attr)
+		}
+		folders = append(folders, folder)
+	}
+	return folders, nil
+}
+
+// unseenMaildir counts the messages without \Seen
+func unseenMaildir(messages []maildirMessage) uint32 {
+	var count uint32
+	for _, msg := range messages {
+		if !hasFlag(msg.Flags, imap.SeenFlag) {
+			count++
+		}
+	}
+	return count
+}
+
+// MailboxStatus returns the status of a folder
+func (c *MaildirClient) MailboxStatus(folderName string) (*imap.MailboxStatus, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.list(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	validity, next, _ := c.index.status(folder)
+	status := imap.NewMailboxStatus(folderName, []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity, imap.StatusUnseen})
+	status.Messages = uint32(len(messages))
+	status.Unseen = unseenMaildir(messages)
+	status.UidNext = next
+	status.UidValidity = validity
+	return status, nil
+}
+
+// MailboxState returns the change markers of a folder. The modseq changes
+// whenever any message in the Maildir does.
+func (c *MaildirClient) MailboxState(folderName string) (*models.MailboxState, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.list(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	validity, next, modseq := c.index.status(folder)
+	return &models.MailboxState{
+		UIDValidity:   validity,
+		UIDNext:       next,
+		HighestModSeq: modseq,
+		Messages:      uint32(len(messages)),
+	}, nil
+}
+
+// UnreadCounts returns the number of unseen messages in every folder
+func (c *MaildirClient) UnreadCounts() (map[string]uint32, error) {
+	names, err := c.index.folders()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]uint32)
+	for _, folder := range names {
+		messages, err := c.list(folder)
+		if err != nil {
+			continue
+		}
+		counts[folder] = unseenMaildir(messages)
+	}
+	return counts, nil
+}
+
+// FolderUsage returns the size of a folder from the sizes of its message
+// files. Attachments aren't counted apart, as that would mean parsing every
+// message.
+func (c *MaildirClient) FolderUsage(folderName string) (*models.FolderUsage, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.list(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &models.FolderUsage{Folder: folderName, Messages: uint32(len(messages)), Unseen: unseenMaildir(messages)}
+	sizes := make(map[uint32]int64, len(messages))
+	for _, msg := range messages {
+		sizes[msg.UID] = int64(msg.Size)
+		usage.Bytes += int64(msg.Size)
+	}
+	usage.Largest = largestMessages(folderName, sizes)
+	return usage, nil
+}
+
+// CreateFolder creates a new Maildir++ folder
+func (c *MaildirClient) CreateFolder(folderName string) error {
+	return c.index.createFolder(folderName)
+}
+
+// RenameFolder renames a folder and its subfolders
+func (c *MaildirClient) RenameFolder(oldName, newName string) error {
+	c.Refresh()
+	return c.index.renameFolder(oldName, newName)
+}
+
+// DeleteFolder deletes a folder along with its messages
+func (c *MaildirClient) DeleteFolder(folderName string) error {
+	delete(c.listed, folderName)
+	return c.index.deleteFolder(folderName)
+}
+
+// ArchiveFolder returns the "Archive" folder, created if needed
+func (c *MaildirClient) ArchiveFolder() (string, error) {
+	if _, err := c.folder("Archive"); err != nil {
+		if err := c.index.createFolder("Archive"); err != nil {
+			return "", fmt.Errorf("error creating Archive folder: %v", err)
+		}
+	}
+	return "Archive", nil
+}
+
+// toEmails parses messages of a folder, skipping any that can't be read
+func (c *MaildirClient) toEmails(messages []maildirMessage, folder string) []models.Email {
+	emails := make([]models.Email, 0, len(messages))
+	for _, msg := range messages {
+		raw, err := c.raw(folder, msg)
+		if err != nil {
+			utils.Log.Warn("Failed to read Maildir message %s: %v", msg.Name, err)
+			continue
+		}
+		email, err := parseRawEmail(raw, msg.UID, folder, msg.Flags, msg.Date)
+		if err != nil {
+			utils.Log.Warn("Failed to parse Maildir message %s: %v", msg.Name, err)
+			continue
+		}
+		emails = append(emails, email)
+	}
+	return emails
+}
+
+// FetchMessages retrieves the newest messages of a folder
+func (c *MaildirClient) FetchMessages(folderName string, limit uint32) ([]models.Email, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.list(folder)
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(messages)) > limit {
+		messages = messages[uint32(len(messages))-limit:]
+	}
+	return c.toEmails(messages, folder), nil
+}
+
+// FetchMessagesPaginated retrieves messages with pagination support,
+// newest first like the IMAP client
+func (c *MaildirClient) FetchMessagesPaginated(folderName string, page, pageSize uint32) (*models.PaginatedEmails, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.list(folder)
+	if err != nil {
+		return nil, err
+	}
+	total := uint32(len(messages))
+	if total == 0 {
+		return models.NewPaginatedEmails([]models.Email{}, page, pageSize, 0), nil
+	}
+
+	totalPages := (total + pageSize - 1) / pageSize
+	if page < 1 {
+		page = 1
+	}
+	if page > totalPages {
+		page = totalPages
+	}
+	end := total - (page-1)*pageSize
+	start := uint32(0)
+	if end > pageSize {
+		start = end - pageSize
+	}
+
+	return models.NewPaginatedEmails(c.toEmails(messages[start:end], folder), page, pageSize, total), nil
+}
+
+// FetchThreads retrieves enough recent messages to fill the given page of
+// threads and organizes them into threads. The returned bool is true when
+// the whole folder was fetched.
+func (c *MaildirClient) FetchThreads(folderName string, page, pageSize uint32) ([]*models.EmailThread, bool, error) {
+	limit := page * pageSize * threadWindowFactor
+
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, false, err
+	}
+	messages, err := c.list(folder)
+	if err != nil {
+		return nil, false, err
+	}
+	complete := uint32(len(messages)) <= limit
+	if !complete {
+		messages = messages[uint32(len(messages))-limit:]
+	}
+	return threadEmails(c.toEmails(messages, folder)), complete, nil
+}
+
+// FetchSingleMessage retrieves a single message by UID
+func (c *MaildirClient) FetchSingleMessage(folderName, uid string) (models.Email, error) {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return models.Email{}, fmt.Errorf("invalid UID: %v", err)
+	}
+	emails, err := c.FetchMessagesByUIDs(folderName, []uint32{uidNum})
+	if err != nil {
+		return models.Email{}, err
+	}
+	if len(emails) == 0 {
+		return models.Email{}, fmt.Errorf("message not found")
+	}
+	return emails[0], nil
+}
+
+// FetchMessagesByUIDs retrieves messages for a specific list of UIDs
+func (c *MaildirClient) FetchMessagesByUIDs(folderName string, uids []uint32) ([]models.Email, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	var messages []maildirMessage
+	for _, uid := range uids {
+		if msg, err := c.message(folder, uid); err == nil {
+			messages = append(messages, msg)
+		}
+	}
+	return c.toEmails(messages, folder), nil
+}
+
+// since returns the messages of a folder with a UID of at least fromUID
+func (c *MaildirClient) since(folderName string, fromUID uint32) ([]maildirMessage, string, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, "", err
+	}
+	messages, err := c.list(folder)
+	if err != nil {
+		return nil, "", err
+	}
+	i := sort.Search(len(messages), func(i int) bool { return messages[i].UID >= fromUID })
+	return messages[i:], folder, nil
+}
+
+// FetchNewMessages retrieves messages with a UID greater than sinceUID
+func (c *MaildirClient) FetchNewMessages(folderName string, sinceUID uint32) ([]models.Email, error) {
+	messages, folder, err := c.since(folderName, sinceUID+1)
+	if err != nil {
+		return nil, err
+	}
+	return c.toEmails(messages, folder), nil
+}
+
+// FetchFlags retrieves the flags of every message with a UID of at least fromUID
+func (c *MaildirClient) FetchFlags(folderName string, fromUID uint32) (map[uint32][]string, error) {
+	messages, _, err := c.since(folderName, fromUID)
+	if err != nil {
+		return nil, err
+	}
+	flags := make(map[uint32][]string, len(messages))
+	for _, msg := range messages {
+		flags[msg.UID] = msg.Flags
+	}
+	return flags, nil
+}
+
+// header reads the header of a message
+func (c *MaildirClient) header(folder string, msg maildirMessage) (mail.Header, error) {
+	raw, err := c.raw(folder, msg)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return parsed.Header, nil
+}
+
+// FetchMessageIDs returns the Message-ID of each of the given UIDs
+func (c *MaildirClient) FetchMessageIDs(folderName string, uids []uint32) (map[uint32]string, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[uint32]string)
+	for _, uid := range uids {
+		msg, err := c.message(folder, uid)
+		if err != nil {
+			continue
+		}
+		if header, err := c.header(folder, msg); err == nil && header.Get("Message-Id") != "" {
+			ids[uid] = header.Get("Message-Id")
+		}
+	}
+	return ids, nil
+}
+
+// FindUIDByMessageID returns the UID of the message with the given
+// Message-ID, or 0 if the folder has no such message
+func (c *MaildirClient) FindUIDByMessageID(folderName, messageID string) (uint32, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return 0, err
+	}
+	messages, err := c.list(folder)
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range messages {
+		header, err := c.header(folder, msg)
+		if err != nil {
+			continue
+		}
+		if ids := parseMessageIDs(header.Get("Message-Id")); len(ids) > 0 && ids[0] == messageID {
+			return msg.UID, nil
+		}
+	}
+	return 0, nil
+}
+
+// SearchUIDs returns the UIDs of the messages in a folder matching
+// criteria, searched the way the POP3 store is
+func (c *MaildirClient) SearchUIDs(folderName string, criteria *imap.SearchCriteria) ([]uint32, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.list(folder)
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, msg := range messages {
+		raw, err := c.raw(folder, msg)
+		if err != nil {
+			continue
+		}
+		if matchesCriteria(criteria, newLocalMessage(msg.meta(folder), raw)) {
+			uids = append(uids, msg.UID)
+		}
+	}
+	return uids, nil
+}
+
+// FetchHeaders returns the full headers and MIME structure of a message
+func (c *MaildirClient) FetchHeaders(folderName, uid string) (*models.MessageHeaders, error) {
+	raw, err := c.rawMessage(folderName, uid)
+	if err != nil {
+		return nil, err
+	}
+	return rawHeaders(raw)
+}
+
+// rawMessage reads a message of a folder
+func (c *MaildirClient) rawMessage(folderName, uid string) ([]byte, error) {
+	folder, msg, err := c.find(folderName, uid)
+	if err != nil {
+		return nil, err
+	}
+	return c.raw(folder, msg)
+}
+
+// find returns a folder and its message with a UID
+func (c *MaildirClient) find(folderName, uid string) (string, maildirMessage, error) {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return "", maildirMessage{}, fmt.Errorf("invalid UID: %v", err)
+	}
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return "", maildirMessage{}, err
+	}
+	msg, err := c.message(folder, uidNum)
+	return folder, msg, err
+}
+
+// fetchPart returns the part of a message chosen by pick
+func (c *MaildirClient) fetchPart(folderName, uid string, pick func([]rawPart, map[string]rawPart) (rawPart, bool)) (*models.Attachment, error) {
+	raw, err := c.rawMessage(folderName, uid)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing message: %v", err)
+	}
+
+	part, ok := pick(rawAttachmentParts(rawMessageParts(msg)))
+	if !ok {
+		return nil, fmt.Errorf("attachment not found")
+	}
+	content, err := part.content()
+	if err != nil {
+		return nil, fmt.Errorf("error reading attachment content: %v", err)
+	}
+	return &models.Attachment{
+		Filename:    part.filename(),
+		ContentType: part.mediaType,
+		Part:        partName(part.path),
+		Size:        len(content),
+		Content:     content,
+	}, nil
+}
+
+// FetchAttachment returns the content of the index-th attachment of a message
+func (c *MaildirClient) FetchAttachment(folderName, uid string, index int) (*models.Attachment, error) {
+	return c.fetchPart(folderName, uid, func(parts []rawPart, _ map[string]rawPart) (rawPart, bool) {
+		if index < 0 || index >= len(parts) {
+			return rawPart{}, false
+		}
+		return parts[index], true
+	})
+}
+
+// FetchInlinePart returns the content of the inline part a cid: URL in the
+// message's HTML refers to
+func (c *MaildirClient) FetchInlinePart(folderName, uid, contentID string) (*models.Attachment, error) {
+	return c.fetchPart(folderName, uid, func(_ []rawPart, inline map[string]rawPart) (rawPart, bool) {
+		part, ok := inline[normalizeContentID(contentID)]
+		return part, ok
+	})
+}
+
+// SetFlags adds flags to a message, or removes them when add is false.
+// Maildir only has letters for the system flags and $Forwarded.
+func (c *MaildirClient) SetFlags(folderName, uid string, flags []string, add bool) error {
+	folder, msg, err := c.find(folderName, uid)
+	if err != nil {
+		return err
+	}
+
+	kept := []string{}
+next:
+	for _, f := range msg.Flags {
+		for _, flag := range flags {
+			if strings.EqualFold(f, flag) {
+				continue next
+			}
+		}
+		kept = append(kept, f)
+	}
+	if add {
+		kept = append(kept, flags...)
+	}
+
+	delete(c.listed, folder)
+	return c.index.rename(folder, msg, kept)
+}
+
+// MarkMessageAsRead marks a message as read
+func (c *MaildirClient) MarkMessageAsRead(folderName, uid string) error {
+	return c.SetFlags(folderName, uid, []string{imap.SeenFlag}, true)
+}
+
+// MarkMessageAsUnread marks a message as unread
+func (c *MaildirClient) MarkMessageAsUnread(folderName, uid string) error {
+	return c.SetFlags(folderName, uid, []string{imap.SeenFlag}, false)
+}
+
+// AppendMessage stores a raw message in a folder with the given flags
+func (c *MaildirClient) AppendMessage(folderName string, message []byte, flags []string) error {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return err
+	}
+	delete(c.listed, folder)
+	_, err = c.index.deliver(folder, message, flags)
+	return err
+}
+
+// MoveMessage moves a message from one folder to another
+func (c *MaildirClient) MoveMessage(sourceFolder, targetFolder, uid string) error {
+	source, msg, err := c.find(sourceFolder, uid)
+	if err != nil {
+		return err
+	}
+	target, err := c.folder(targetFolder)
+	if err != nil {
+		return err
+	}
+	delete(c.listed, source)
+	delete(c.listed, target)
+	return c.index.move(source, target, msg)
+}
+
+// DeleteMessage permanently deletes a message
+func (c *MaildirClient) DeleteMessage(folderName, uid string) error {
+	folder, msg, err := c.find(folderName, uid)
+	if err != nil {
+		return err
+	}
+	delete(c.listed, folder)
+	return c.index.remove(folder, msg)
+}
+
+// SaveToSent stores a copy of a sent message in the Sent folder
+func (c *MaildirClient) SaveToSent(to, subject, body string) error {
+	if _, err := c.folder("Sent"); err != nil {
+		if err := c.index.createFolder("Sent"); err != nil {
+			return err
+		}
+	}
+
+	message := fmt.Sprintf("From: %s\r\n"+
+		"To: %s\r\n"+
+		"Subject: %s\r\n"+
+		"Date: %s\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n"+
+		"\r\n"+
+		"%s", c.username, to, subject,
+		time.Now().Format(time.RFC1123Z), body)
+
+	return c.AppendMessage("Sent", []byte(message), []string{imap.SeenFlag})
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maildirWatchInterval is how often a watched Maildir is checked for changes
+const maildirWatchInterval = 2 * time.Second
+
+// maildirStamps returns the modification time of every folder directory
+// that changes when a message is delivered, moved, flagged or deleted
+func (c *MaildirClient) maildirStamps() map[string]time.Time {
+	stamps := make(map[string]time.Time)
+	if info, err := os.Stat(c.index.root); err == nil {
+		stamps[c.index.root] = info.ModTime()
+	}
+	folders, err := c.index.folders()
+	if err != nil {
+		return stamps
+	}
+	for _, folder := range folders {
+		for _, sub := range []string{"new", "cur"} {
+			dir := filepath.Join(c.index.dir(folder), sub)
+			if info, err := os.Stat(dir); err == nil {
+				stamps[dir] = info.ModTime()
+			}
+		}
+	}
+	return stamps
+}
+
+// WatchChanges watches the Maildir's directories and signals changed
+// whenever the MTA or another mail program changes a folder. Directories
+// are compared by modification time, which works on every platform lilmail
+// runs on. It returns when ctx is done.
+func (c *MaildirClient) WatchChanges(ctx context.Context, changed chan<- struct{}) error {
+	last := c.maildirStamps()
+	ticker := time.NewTicker(maildirWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		stamps := c.maildirStamps()
+		if !sameStamps(last, stamps) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+		last = stamps
+	}
+}
+
+// sameStamps reports whether two sets of modification times are equal
+func sameStamps(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for dir, t := range a {
+		if other, ok := b[dir]; !ok || !other.Equal(t) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,349 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"lilmail/config"
+	"lilmail/storage"
+	"lilmail/utils"
+	"mime/multipart"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// maxImageWidth is the width attached images are scaled down to
+const maxImageWidth = 1920
+
+// OutgoingMail is an email a user wrote, as posted by the compose form or
+// an API client
+type OutgoingMail struct {
+	To      string
+	Cc      string
+	Bcc     string
+	Subject string
+	Body    string
+	IsHTML  bool
+
+	// Files uploaded with the request
+	Files []*multipart.FileHeader
+	// Attachments of a forwarded message to send on, by their index in it
+	ForwardFolder  string
+	ForwardUID     string
+	ForwardIndexes []string
+	// Draft the email was written in, deleted once it is sent, and the
+	// attachments uploaded to it in chunks
+	DraftID   string
+	UploadIDs []string
+}
+
+// Mailer sends the mail users write, whichever handler it comes through:
+// it checks the email and its attachments against the limits, counts it
+// against the user's daily limit, sends it as the account sends mail,
+// keeps a copy in Sent, remembers the recipients, deletes the draft it was
+// written in and tells the user's sessions when sending fails.
+type Mailer struct {
+	store      *session.Store
+	config     *config.Config
+	system     *storage.SystemSettingsStorage
+	users      *storage.UserStorage
+	drafts     *storage.DraftStorage
+	recipients *storage.SentRecipientStorage
+	notify     *NotificationHandler
+}
+
+// NewMailer creates the mail sending service
+func NewMailer(store *session.Store, cfg *config.Config, systemSettings *storage.SystemSettingsStorage, userStorage *storage.UserStorage, draftStorage *storage.DraftStorage, recipients *storage.SentRecipientStorage, notify *NotificationHandler) *Mailer {
+	return &Mailer{
+		store:      store,
+		config:     cfg,
+		system:     systemSettings,
+		users:      userStorage,
+		drafts:     draftStorage,
+		recipients: recipients,
+		notify:     notify,
+	}
+}
+
+// ParseOutgoingMail reads an email from a multipart form, which may carry
+// attachments, or from a SendRequest posted as JSON or as a form
+func ParseOutgoingMail(c *fiber.Ctx) (*OutgoingMail, error) {
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		var req SendRequest
+		if err := c.BodyParser(&req); err != nil {
+			return nil, utils.BadRequestError("Invalid request", err)
+		}
+		return &OutgoingMail{
+			To:      req.To,
+			Cc:      req.Cc,
+			Bcc:     req.Bcc,
+			Subject: req.Subject,
+			Body:    req.Body,
+			IsHTML:  req.IsHTML,
+			DraftID: req.DraftID,
+		}, nil
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, utils.BadRequestError("Invalid form data", err)
+	}
+	value := func(name string) string {
+		if v := form.Value[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	out := &OutgoingMail{
+		To:             value("to"),
+		Cc:             value("cc"),
+		Bcc:            value("bcc"),
+		Subject:        value("subject"),
+		Body:           value("body"),
+		IsHTML:         value("is_html") == "true",
+		ForwardFolder:  value("forward_folder"),
+		ForwardUID:     value("forward_uid"),
+		ForwardIndexes: form.Value["forward_attachments"],
+		DraftID:        value("draft_id"),
+		UploadIDs:      form.Value["uploads"],
+	}
+
+	// Files are attached whatever field they were posted as, in field order
+	fields := make([]string, 0, len(form.File))
+	for field := range form.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		out.Files = append(out.Files, form.File[field]...)
+	}
+	return out, nil
+}
+
+// Send sends an email from the account of the request's session. Errors
+// are *utils.AppError carrying the status to answer with; when attachments
+// break the limits, their "errors" context lists every problem.
+func (m *Mailer) Send(c *fiber.Ctx, out *OutgoingMail) error {
+	if strings.TrimSpace(out.To) == "" || strings.TrimSpace(out.Subject) == "" {
+		return utils.BadRequestError("Missing required fields (to, subject)", nil)
+	}
+
+	// Recipients get clean markup whatever the editor produced
+	if out.IsHTML {
+		var err error
+		if out.Body, err = utils.PrepareOutgoingHTML(out.Body); err != nil {
+			return utils.BadRequestError("The message body is not valid HTML", err)
+		}
+	}
+
+	credentials, err := GetCredentials(c, m.store, m.config.Encryption.Key)
+	if err != nil {
+		return utils.UnauthorizedError("Invalid session", err)
+	}
+	userID, accountID := m.draftOwner(c)
+
+	attachments, err := m.readUploads(userID, accountID, out)
+	if err != nil {
+		return utils.BadRequestError("An uploaded attachment is missing or incomplete", err)
+	}
+
+	// Connect to the account, which sends over SMTP or, for Microsoft 365
+	// accounts, through Graph
+	backend, err := NewMailBackend(credentials, m.config, m.config.SMTP.Server, m.config.SMTP.GetPort())
+	if errors.Is(err, ErrSenderNotAllowed) {
+		return utils.ForbiddenError("Sending from this address is not allowed", err)
+	}
+	if err != nil {
+		return utils.NewAppError(fiber.StatusBadGateway, "Failed to connect to email server", err)
+	}
+	defer backend.Close()
+
+	if out.ForwardUID != "" && len(out.ForwardIndexes) > 0 {
+		forwarded, err := fetchForwardedAttachments(backend, out.ForwardFolder, out.ForwardUID, out.ForwardIndexes)
+		if err != nil {
+			return utils.NewAppError(fiber.StatusBadGateway, "Failed to fetch the attachments of the forwarded message", err)
+		}
+		attachments = append(forwarded, attachments...)
+	}
+
+	if status, problems := CheckAttachments(m.system.Current(), out.Files, attachments, len(out.Body)); len(problems) > 0 {
+		return utils.NewAppError(status, problems[0], nil).WithContext("errors", problems)
+	}
+	for _, file := range out.Files {
+		attachment, err := readAttachment(file)
+		if err != nil {
+			return utils.BadRequestError("Failed to read attachment "+file.Filename, err)
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	// Count the message against the user's daily limit
+	reservedFor := ""
+	if user, err := CurrentUser(c, m.users); err == nil {
+		err := m.users.ReserveSend(user.ID)
+		if err == storage.ErrDailySendLimit {
+			return utils.NewAppError(fiber.StatusTooManyRequests, fmt.Sprintf("You have reached your limit of %d messages per day", user.Limits.MaxMessagesPerDay), err)
+		}
+		if err == nil {
+			reservedFor = user.ID
+		}
+	}
+
+	if err := backend.SendMail(out.To, out.Cc, out.Bcc, out.Subject, out.Body, out.IsHTML, attachments); err != nil {
+		// The message wasn't sent, so it doesn't count against the limit
+		if reservedFor != "" {
+			if err := m.users.ReleaseSend(reservedFor); err != nil {
+				utils.Log.Warn("Failed to release send reservation of user %s: %v", reservedFor, err)
+			}
+		}
+		if m.notify != nil {
+			m.notify.NotifySendFailed(GetSessionUser(c), out.To, out.Subject, err)
+		}
+		return utils.NewAppError(fiber.StatusBadGateway, "Failed to send email: "+err.Error(), err)
+	}
+	utils.Log.Info("Email sent successfully: to=%s subject=%s attachments=%d", out.To, out.Subject, len(attachments))
+
+	// The email was sent either way, so these only log their failures
+	if err := backend.SaveToSent(out.To, out.Subject, out.Body); err != nil {
+		utils.Log.Warn("Failed to save sent email to the Sent folder: %v", err)
+	}
+	m.recordRecipients(c, out.To, out.Cc, out.Bcc)
+	if out.DraftID != "" && userID != "" {
+		if err := m.drafts.DeleteDraft(userID, accountID, out.DraftID); err != nil {
+			utils.Log.Warn("Failed to delete sent draft %s: %v", out.DraftID, err)
+		}
+	}
+	return nil
+}
+
+// draftOwner returns the user and account drafts of the session are kept
+// under, "" when it has no user record
+func (m *Mailer) draftOwner(c *fiber.Ctx) (string, string) {
+	sess, err := m.store.Get(c)
+	if err != nil {
+		return "", ""
+	}
+	userID, _ := sess.Get("userId").(string)
+	accountID, _ := sess.Get("accountId").(string)
+	return userID, accountID
+}
+
+// readUploads reads the attachments uploaded in chunks to the draft
+func (m *Mailer) readUploads(userID, accountID string, out *OutgoingMail) ([]AttachmentData, error) {
+	if len(out.UploadIDs) == 0 {
+		return nil, nil
+	}
+	if out.DraftID == "" || userID == "" {
+		return nil, fmt.Errorf("uploads without a draft")
+	}
+
+	var attachments []AttachmentData
+	for _, uploadID := range out.UploadIDs {
+		upload, data, err := m.drafts.ReadUpload(userID, accountID, out.DraftID, uploadID)
+		if err != nil {
+			return nil, fmt.Errorf("upload %s: %v", uploadID, err)
+		}
+		attachments = append(attachments, optimizeAttachment(AttachmentData{
+			Filename:    upload.Filename,
+			ContentType: upload.ContentType,
+			Data:        data,
+		}))
+	}
+	return attachments, nil
+}
+
+// recordRecipients remembers who the user just sent mail to
+func (m *Mailer) recordRecipients(c *fiber.Ctx, lists ...string) {
+	if m.recipients == nil {
+		return
+	}
+
+	var addresses []string
+	for _, list := range lists {
+		parsed, err := mail.ParseAddressList(list)
+		if err != nil {
+			continue
+		}
+		for _, address := range parsed {
+			addresses = append(addresses, address.Address)
+		}
+	}
+
+	// Recipients are kept by user record, or by username without one
+	userID, ok := c.Locals("userId").(string)
+	if !ok || userID == "" {
+		userID = GetSessionUser(c)
+	}
+	if err := m.recipients.AddRecipients(userID, addresses); err != nil {
+		utils.Log.Warn("Failed to record sent recipients: %v", err)
+	}
+}
+
+// fetchForwardedAttachments fetches the attachments of a forwarded message
+// the sender kept, by their index in the original message
+func fetchForwardedAttachments(client MailClient, folder, uid string, indexes []string) ([]AttachmentData, error) {
+	if folder == "" {
+		folder = "INBOX"
+	}
+
+	var attachments []AttachmentData
+	for _, value := range indexes {
+		index, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attachment index %q", value)
+		}
+		attachment, err := client.FetchAttachment(folder, uid, index)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %d: %v", index, err)
+		}
+		attachments = append(attachments, AttachmentData{
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Data:        attachment.Content,
+		})
+	}
+	return attachments, nil
+}
+
+// readAttachment reads a file uploaded with the email
+func readAttachment(file *multipart.FileHeader) (AttachmentData, error) {
+	f, err := file.Open()
+	if err != nil {
+		return AttachmentData{}, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return AttachmentData{}, err
+	}
+
+	contentType := file.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = DetectContentType(file.Filename)
+	}
+	return optimizeAttachment(AttachmentData{
+		Filename:    file.Filename,
+		ContentType: contentType,
+		Data:        data,
+	}), nil
+}
+
+// optimizeAttachment scales attached images down to maxImageWidth
+func optimizeAttachment(attachment AttachmentData) AttachmentData {
+	if !utils.IsImage(attachment.ContentType) {
+		return attachment
+	}
+	if optimized, err := utils.OptimizeImage(attachment.Data, maxImageWidth); err == nil {
+		attachment.Data = optimized
+	} else {
+		utils.Log.Warn("Failed to optimize image %s: %v", attachment.Filename, err)
+	}
+	return attachment
+}
@@ -0,0 +1,330 @@
+package api
+
+import (
+	"lilmail/config"
+	"lilmail/models"
+	"lilmail/utils"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// Paging of message lists of the mobile API
+const (
+	mobileDefaultPageSize = 50
+	mobileMaxPageSize     = 100
+)
+
+// mobileErrorCodes are the codes of mobile API errors by HTTP status
+var mobileErrorCodes = map[int]string{
+	400: "bad_request",
+	401: "unauthorized",
+	403: "forbidden",
+	404: "not_found",
+	413: "too_large",
+	415: "unsupported_media_type",
+	429: "too_many_requests",
+}
+
+// MobileHandler serves /api/v1, the JSON API of native and mobile clients.
+// Unlike the HTMX handlers it renders no HTML: every answer is an envelope,
+// {"data": ...} with "meta" for pages, or {"error": {"code", "message"}}.
+// Clients sign in through POST /login and send the session cookie back.
+type MobileHandler struct {
+	store  *session.Store
+	config *config.Config
+	mailer *Mailer
+}
+
+// NewMobileHandler creates a new mobile API handler
+func NewMobileHandler(store *session.Store, cfg *config.Config, mailer *Mailer) *MobileHandler {
+	return &MobileHandler{
+		store:  store,
+		config: cfg,
+		mailer: mailer,
+	}
+}
+
+// MobileFolder is a folder with its message counts
+type MobileFolder struct {
+	Name     string   `json:"name"`
+	Messages uint32   `json:"messages"`
+	Unread   uint32   `json:"unread"`
+	Flags    []string `json:"flags"`
+}
+
+// MobileMessageHeader is a message as listed in a folder
+type MobileMessageHeader struct {
+	ID             string    `json:"id"`
+	Folder         string    `json:"folder"`
+	From           string    `json:"from"`
+	FromName       string    `json:"from_name"`
+	To             string    `json:"to"`
+	Subject        string    `json:"subject"`
+	Date           time.Time `json:"date"`
+	Preview        string    `json:"preview"`
+	Unread         bool      `json:"unread"`
+	Flagged        bool      `json:"flagged"`
+	HasAttachments bool      `json:"has_attachments"`
+}
+
+// MobileMessage is a message with its body
+type MobileMessage struct {
+	MobileMessageHeader
+	Cc          string             `json:"cc"`
+	ReplyTo     string             `json:"reply_to,omitempty"`
+	MessageID   string             `json:"message_id"`
+	Text        string             `json:"text"`
+	HTML        string             `json:"html,omitempty"`
+	Attachments []MobileAttachment `json:"attachments"`
+}
+
+// MobileAttachment describes an attachment, downloaded from DownloadURL
+type MobileAttachment struct {
+	Index       int    `json:"index"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	DownloadURL string `json:"download_url"`
+}
+
+// mobileData answers with the data envelope
+func mobileData(c *fiber.Ctx, data interface{}) error {
+	return c.JSON(fiber.Map{"data": data})
+}
+
+// mobileError answers with the error envelope. Its code is named after the
+// status, "server_error" for failures of the server or the mail server.
+func mobileError(c *fiber.Ctx, status int, message string) error {
+	code, ok := mobileErrorCodes[status]
+	if !ok {
+		code = "server_error"
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"error": fiber.Map{"code": code, "message": message},
+	})
+}
+
+// mobileFail answers with an error returned by a helper, a fiber error or
+// an AppError carrying the status to answer with
+func mobileFail(c *fiber.Ctx, err error) error {
+	switch e := err.(type) {
+	case *fiber.Error:
+		return mobileError(c, e.Code, e.Message)
+	case *utils.AppError:
+		return mobileError(c, e.Code, e.Message)
+	}
+	return mobileError(c, 500, err.Error())
+}
+
+// Authenticate lets requests with a signed-in session through, answering
+// others with 401 rather than the login redirect of web pages. Changes must
+// be sent as JSON, which browsers can't post across sites without CORS, so
+// they don't need the CSRF token of forms.
+func (h *MobileHandler) Authenticate(c *fiber.Ctx) error {
+	sess, err := ValidateSession(c, h.store)
+	if err != nil {
+		return mobileError(c, 401, "Sign in required")
+	}
+	if c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead && !strings.HasPrefix(c.Get("Content-Type"), fiber.MIMEApplicationJSON) {
+		return mobileError(c, 415, "Requests must be sent as application/json")
+	}
+
+	if username := sess.Get("username"); username != nil {
+		c.Locals("username", username)
+	}
+	if email := sess.Get("email"); email != nil {
+		c.Locals("email", email)
+	}
+	if userID := sess.Get("userId"); userID != nil {
+		c.Locals("userId", userID)
+	}
+	return c.Next()
+}
+
+// NotFound answers requests for routes the API doesn't have
+func (h *MobileHandler) NotFound(c *fiber.Ctx) error {
+	return mobileError(c, 404, "No such endpoint: "+c.Method()+" "+c.Path())
+}
+
+// connect opens the mail account of the session
+func (h *MobileHandler) connect(c *fiber.Ctx) (MailClient, error) {
+	credentials, err := GetCredentials(c, h.store, h.config.Encryption.Key)
+	if err != nil {
+		return nil, fiber.NewError(401, "Invalid session")
+	}
+	client, err := NewMailClient(credentials, h.config)
+	if err != nil {
+		utils.Log.Error("Mobile API failed to connect for %s: %v", credentials.Email, err)
+		return nil, fiber.NewError(502, "Failed to connect to email server")
+	}
+	return client, nil
+}
+
+// Folders lists the selectable folders with their message and unread counts
+func (h *MobileHandler) Folders(c *fiber.Ctx) error {
+	client, err := h.connect(c)
+	if err != nil {
+		return mobileFail(c, err)
+	}
+	defer client.Close()
+
+	folders, err := mobileFolders(client)
+	if err != nil {
+		return mobileError(c, 502, "Failed to fetch folders")
+	}
+	return mobileData(c, folders)
+}
+
+// Messages lists a page of the messages of ?folder=, newest first. Pages
+// are numbered from 1 with ?page=; ?page_size= is at most 100.
+func (h *MobileHandler) Messages(c *fiber.Ctx) error {
+	folder := c.Query("folder", "INBOX")
+	page := c.QueryInt("page", 1)
+	pageSize := c.QueryInt("page_size", mobileDefaultPageSize)
+	if page < 1 {
+		return mobileError(c, 400, "page must be 1 or more")
+	}
+	if pageSize < 1 || pageSize > mobileMaxPageSize {
+		return mobileError(c, 400, "page_size must be between 1 and "+strconv.Itoa(mobileMaxPageSize))
+	}
+
+	client, err := h.connect(c)
+	if err != nil {
+		return mobileFail(c, err)
+	}
+	defer client.Close()
+
+	paginated, err := client.FetchMessagesPaginated(folder, uint32(page), uint32(pageSize))
+	if err != nil {
+		return mobileError(c, 404, "Failed to fetch messages of "+folder)
+	}
+
+	headers := make([]MobileMessageHeader, 0, len(paginated.Emails))
+	for _, email := range paginated.Emails {
+		headers = append(headers, mobileHeader(folder, email))
+	}
+	return c.JSON(fiber.Map{
+		"data": headers,
+		"meta": fiber.Map{
+			"folder":      folder,
+			"page":        paginated.Page,
+			"page_size":   paginated.PageSize,
+			"total":       paginated.TotalEmails,
+			"total_pages": paginated.TotalPages,
+			"has_next":    paginated.HasNext,
+		},
+	})
+}
+
+// Message returns a message of ?folder= with its body and attachments
+func (h *MobileHandler) Message(c *fiber.Ctx) error {
+	folder := c.Query("folder", "INBOX")
+	id := c.Params("id")
+	if _, err := parseUID(id); err != nil {
+		return mobileError(c, 400, "Invalid message id")
+	}
+
+	client, err := h.connect(c)
+	if err != nil {
+		return mobileFail(c, err)
+	}
+	defer client.Close()
+
+	email, err := client.FetchSingleMessage(folder, id)
+	if err != nil {
+		return mobileError(c, 404, "Message not found")
+	}
+
+	return mobileData(c, mobileMessage(folder, email))
+}
+
+// Send sends a plain text or HTML message given as a SendRequest, without
+// attachments
+func (h *MobileHandler) Send(c *fiber.Ctx) error {
+	out, err := ParseOutgoingMail(c)
+	if err == nil {
+		err = h.mailer.Send(c, out)
+	}
+	if err != nil {
+		return mobileFail(c, err)
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"data": fiber.Map{"sent": true},
+	})
+}
+
+// mobileFolders lists the selectable folders of an account with their counts
+func mobileFolders(client MailClient) ([]MobileFolder, error) {
+	mailboxes, err := client.FetchFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	folders := make([]MobileFolder, 0, len(mailboxes))
+	for _, mailbox := range mailboxes {
+		if hasFlag(mailbox.Attributes, imap.NoSelectAttr) {
+			continue
+		}
+		folder := MobileFolder{Name: mailbox.Name, Flags: mailbox.Attributes}
+		if folder.Flags == nil {
+			folder.Flags = []string{}
+		}
+		if status, err := client.MailboxStatus(mailbox.Name); err == nil {
+			folder.Messages = status.Messages
+			folder.Unread = status.Unseen
+		}
+		folders = append(folders, folder)
+	}
+	return folders, nil
+}
+
+// mobileMessage converts a message to its full form
+func mobileMessage(folder string, email models.Email) MobileMessage {
+	id := email.ID
+	message := MobileMessage{
+		MobileMessageHeader: mobileHeader(folder, email),
+		Cc:                  email.Cc,
+		ReplyTo:             email.ReplyTo,
+		MessageID:           email.MessageID,
+		Text:                email.Body,
+		HTML:                string(email.HTML),
+		Attachments:         make([]MobileAttachment, 0, len(email.Attachments)),
+	}
+	for i, attachment := range email.Attachments {
+		message.Attachments = append(message.Attachments, MobileAttachment{
+			Index:       i,
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Size:        attachment.Size,
+			DownloadURL: "/api/attachments/" + id + "/" + strconv.Itoa(i) + "/download?folder=" + url.QueryEscape(message.Folder),
+		})
+	}
+	return message
+}
+
+// mobileHeader converts a message to its listed form
+func mobileHeader(folder string, email models.Email) MobileMessageHeader {
+	if email.Folder != "" {
+		folder = email.Folder
+	}
+	return MobileMessageHeader{
+		ID:             email.ID,
+		Folder:         folder,
+		From:           email.From,
+		FromName:       email.FromName,
+		To:             email.To,
+		Subject:        email.Subject,
+		Date:           email.Date,
+		Preview:        email.Preview,
+		Unread:         !hasFlag(email.Flags, imap.SeenFlag),
+		Flagged:        hasFlag(email.Flags, imap.FlaggedFlag),
+		HasAttachments: email.HasAttachments || len(email.Attachments) > 0,
+	}
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxNoteLength caps the length of a note in bytes
+const maxNoteLength = 10000
+
+// NoteHandler handles internal notes on messages
+type NoteHandler struct {
+	storage *storage.NoteStorage
+}
+
+// NewNoteHandler creates a new note handler
+func NewNoteHandler(noteStorage *storage.NoteStorage) *NoteHandler {
+	return &NoteHandler{
+		storage: noteStorage,
+	}
+}
+
+// NoteRequest is the body of a request to add or edit a note
+type NoteRequest struct {
+	MessageKey string `json:"message_key"`
+	Body       string `json:"body"`
+	Shared     bool   `json:"shared"`
+}
+
+// noteUser returns the signed in user and the mailbox they are reading.
+// Users signed in to the same address share a mailbox's shared notes.
+func noteUser(c *fiber.Ctx) (string, string, error) {
+	username := GetSessionUser(c)
+	mailbox := strings.ToLower(GetSessionEmail(c))
+	if username == "" || mailbox == "" {
+		return "", "", utils.UnauthorizedError("User not authenticated", nil)
+	}
+	return username, mailbox, nil
+}
+
+// GetNotes lists the notes on a message the user can see
+func (h *NoteHandler) GetNotes(c *fiber.Ctx) error {
+	username, mailbox, err := noteUser(c)
+	if err != nil {
+		return err
+	}
+
+	messageKey := c.Query("message_key")
+	if messageKey == "" {
+		return utils.BadRequestError("Message key is required", nil)
+	}
+
+	notes, err := h.storage.GetNotes(mailbox, messageKey, username)
+	if err != nil {
+		return utils.InternalServerError("Failed to retrieve notes", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"notes":   notes,
+	})
+}
+
+// CreateNote adds a note to a message
+func (h *NoteHandler) CreateNote(c *fiber.Ctx) error {
+	username, mailbox, err := noteUser(c)
+	if err != nil {
+		return err
+	}
+
+	var req NoteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+	if req.MessageKey == "" {
+		return utils.BadRequestError("Message key is required", nil)
+	}
+	body, err := noteBody(req.Body)
+	if err != nil {
+		return err
+	}
+
+	note := &models.Note{
+		Mailbox:    mailbox,
+		MessageKey: req.MessageKey,
+		Author:     username,
+		Body:       body,
+		Shared:     req.Shared,
+	}
+	if err := h.storage.SaveNote(note); err != nil {
+		return utils.InternalServerError("Failed to save note", err)
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"note":    note,
+	})
+}
+
+// UpdateNote edits one of the user's notes
+func (h *NoteHandler) UpdateNote(c *fiber.Ctx) error {
+	note, err := h.ownedNote(c)
+	if err != nil {
+		return err
+	}
+
+	var req NoteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+	if note.Body, err = noteBody(req.Body); err != nil {
+		return err
+	}
+	note.Shared = req.Shared
+
+	if err := h.storage.SaveNote(note); err != nil {
+		return utils.InternalServerError("Failed to save note", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"note":    note,
+	})
+}
+
+// DeleteNote removes one of the user's notes
+func (h *NoteHandler) DeleteNote(c *fiber.Ctx) error {
+	note, err := h.ownedNote(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.storage.DeleteNote(note.Mailbox, note.ID); err != nil {
+		return utils.InternalServerError("Failed to delete note", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Note deleted",
+	})
+}
+
+// ownedNote loads the note named in the route, which only its author may
+// change
+func (h *NoteHandler) ownedNote(c *fiber.Ctx) (*models.Note, error) {
+	username, mailbox, err := noteUser(c)
+	if err != nil {
+		return nil, err
+	}
+
+	note, err := h.storage.GetNote(mailbox, c.Params("id"))
+	if err != nil || note.Author != username {
+		return nil, utils.NotFoundError("Note not found", err)
+	}
+	note.Mailbox = mailbox
+	return note, nil
+}
+
+// noteBody validates the text of a note
+func noteBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return "", utils.BadRequestError("Note is empty", nil)
+	}
+	if len(body) > maxNoteLength {
+		return "", utils.BadRequestError("Note is too long", nil)
+	}
+	return body, nil
+}
@@ -3,7 +3,12 @@ package api
 import (
 	"bufio"
 	"encoding/json"
+	"fmt"
+	"lilmail/config"
+	"lilmail/models"
+	"lilmail/storage"
 	"lilmail/utils"
+	"strconv"
 	"sync"
 	"time"
 
@@ -15,41 +20,119 @@ import (
 )
 
 // Notification represents a real-time notification
-type Notification struct {
-	ID      string                 `json:"id"`
-	Type    string                 `json:"type"` // "new_email", "deleted", "status_change"
-	Message string                 `json:"message"`
-	Data    map[string]interface{} `json:"data"`
-	Time    time.Time              `json:"time"`
-}
+type Notification = models.Notification
 
 // NotificationHandler handles real-time notifications using SSE
 type NotificationHandler struct {
 	store       *session.Store
+	config      *config.Config
+	storage     *storage.NotificationStorage
+	settings    *storage.SettingsStorage
 	// Map userID to map of subscriberID to channel
 	subscribers map[string]map[string]chan Notification
-	mu          sync.RWMutex
+	lifecycle   SubscriberLifecycle
+	webhooks    *WebhookDispatcher
+	// Last per-folder unread counts sent to each user
+	unreadCounts map[string]map[string]uint32
+	mu           sync.RWMutex
 }
 
 // NewNotificationHandler creates a new notification handler
-func NewNotificationHandler(store *session.Store) *NotificationHandler {
+func NewNotificationHandler(store *session.Store, cfg *config.Config, notificationStorage *storage.NotificationStorage, settingsStorage *storage.SettingsStorage) *NotificationHandler {
 	return &NotificationHandler{
-		store:       store,
-		subscribers: make(map[string]map[string]chan Notification),
+		store:        store,
+		config:       cfg,
+		storage:      notificationStorage,
+		settings:     settingsStorage,
+		subscribers:  make(map[string]map[string]chan Notification),
+		unreadCounts: make(map[string]map[string]uint32),
+	}
+}
+
+// SubscriberLifecycle is told when a user gets their first live subscriber
+// and when their last one goes away
+type SubscriberLifecycle interface {
+	UserConnected(userID string)
+	UserDisconnected(userID string)
+}
+
+// SetWebhooks forwards every notification to the user's webhooks
+func (h *NotificationHandler) SetWebhooks(webhooks *WebhookDispatcher) {
+	h.mu.Lock()
+	h.webhooks = webhooks
+	h.mu.Unlock()
+}
+
+// SetLifecycle registers the hooks called as users connect and disconnect
+func (h *NotificationHandler) SetLifecycle(lifecycle SubscriberLifecycle) {
+	h.mu.Lock()
+	h.lifecycle = lifecycle
+	h.mu.Unlock()
+}
+
+// SubscriberCounts returns the number of users with an open SSE or
+// WebSocket connection and the number of connections
+func (h *NotificationHandler) SubscriberCounts() (users, subscribers int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, subMap := range h.subscribers {
+		subscribers += len(subMap)
+	}
+	return len(h.subscribers), subscribers
+}
+
+// addSubscriber registers a new subscriber channel for a user
+func (h *NotificationHandler) addSubscriber(userID string) (string, chan Notification) {
+	subscriberID := uuid.New().String()
+	bufferSize := h.config.Notifications.BufferSize
+	if bufferSize < 1 {
+		bufferSize = 10
+	}
+	messageChan := make(chan Notification, bufferSize)
+
+	h.mu.Lock()
+	first := false
+	if _, ok := h.subscribers[userID]; !ok {
+		h.subscribers[userID] = make(map[string]chan Notification)
+		first = true
+	}
+	h.subscribers[userID][subscriberID] = messageChan
+	lifecycle := h.lifecycle
+	h.mu.Unlock()
+
+	if first && lifecycle != nil {
+		lifecycle.UserConnected(userID)
+	}
+	return subscriberID, messageChan
+}
+
+// removeSubscriber unregisters a subscriber and closes its channel
+func (h *NotificationHandler) removeSubscriber(userID, subscriberID string) {
+	h.mu.Lock()
+	last := false
+	if subMap, ok := h.subscribers[userID]; ok {
+		if ch, ok := subMap[subscriberID]; ok {
+			close(ch)
+			delete(subMap, subscriberID)
+		}
+		if len(subMap) == 0 {
+			delete(h.subscribers, userID)
+			last = true
+		}
+	}
+	lifecycle := h.lifecycle
+	h.mu.Unlock()
+
+	if last && lifecycle != nil {
+		lifecycle.UserDisconnected(userID)
 	}
 }
 
 // HandleSSE handles Server-Sent Events for real-time notifications
 func (h *NotificationHandler) HandleSSE(c *fiber.Ctx) error {
-	// Set headers for SSE
-	c.Set("Content-Type", "text/event-stream")
-	c.Set("Cache-Control", "no-cache")
-	c.Set("Connection", "keep-alive")
-	c.Set("Transfer-Encoding", "chunked")
-	
 	// Get session token to identify subscriber
-	token, err := GetSessionToken(c, h.store)
-	if err != nil {
+	if _, err := GetSessionToken(c, h.store); err != nil {
 		return utils.UnauthorizedError("Invalid session", err)
 	}
 
@@ -58,111 +141,377 @@ func (h *NotificationHandler) HandleSSE(c *fiber.Ctx) error {
 	if !ok || userID == "" {
 		return utils.UnauthorizedError("User not authenticated", nil)
 	}
-	
-	// Create channel for this subscriber
-	subscriberID := uuid.New().String()
-	messageChan := make(chan Notification, 10)
-	
-	h.mu.Lock()
-	if _, ok := h.subscribers[userID]; !ok {
-		h.subscribers[userID] = make(map[string]chan Notification)
+
+	// Set headers for SSE
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("Transfer-Encoding", "chunked")
+
+	subscriberID, messageChan := h.addSubscriber(userID)
+	utils.Log.Info("SSE subscriber connected: %s (User: %s)", subscriberID, userID)
+
+	// Catch the client up on anything sent since the last event it saw.
+	// EventSource sends Last-Event-ID when it reconnects by itself; the
+	// query parameter covers new connections after a page load.
+	var missed []Notification
+	lastEventID := c.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
 	}
-	h.subscribers[userID][subscriberID] = messageChan
-	h.mu.Unlock()
-	
-	// Cleanup on disconnect
-	defer func() {
-		h.mu.Lock()
-		if subMap, ok := h.subscribers[userID]; ok {
-			delete(subMap, subscriberID)
-			if len(subMap) == 0 {
-				delete(h.subscribers, userID)
-			}
+	if lastSeq, err := strconv.ParseUint(lastEventID, 10, 64); err == nil && lastSeq > 0 {
+		if missed, err = h.storage.Since(userID, lastSeq); err != nil {
+			utils.Log.Warn("Failed to load missed notifications for %s: %v", userID, err)
 		}
-		close(messageChan)
-		h.mu.Unlock()
-		
-		utils.Log.Info("SSE subscriber disconnected: %s (User: %s, Token: %s)", subscriberID, userID, token[:8])
-	}()
-	
-	utils.Log.Info("SSE subscriber connected: %s (User: %s)", subscriberID, userID)
-	
-	// Send initial connection message  
+	}
+
+	// The stream writer runs after this handler returns, so cleanup happens
+	// there once a write fails because the client went away
 	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer func() {
+			h.removeSubscriber(userID, subscriberID)
+			utils.Log.Info("SSE subscriber disconnected: %s (User: %s)", subscriberID, userID)
+		}()
+
+		var replayed uint64
+		for _, notification := range missed {
+			replayed = notification.Seq
+		}
+		for _, notification := range coalesceStatusChanges(missed) {
+			writeSSEEvent(w, notification)
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+
 		// Keep-alive ticker
-		ticker := time.NewTicker(30 * time.Second)
+		heartbeat := time.Duration(h.config.Notifications.HeartbeatSeconds) * time.Second
+		if heartbeat <= 0 {
+			heartbeat = 30 * time.Second
+		}
+		ticker := time.NewTicker(heartbeat)
 		defer ticker.Stop()
-		
+		batchWindow := time.Duration(h.config.Notifications.BatchWindowMS) * time.Millisecond
+
 		for {
 			select {
-			case notification := <-messageChan:
-				// Send notification
-				data, _ := json.Marshal(notification)
-				w.WriteString("data: " + string(data) + "\n\n")
-				w.Flush()
-				
+			case notification, ok := <-messageChan:
+				if !ok {
+					return
+				}
+				batch := []Notification{notification}
+				if batchWindow > 0 {
+					batch, ok = collectBurst(messageChan, batch, batchWindow)
+				}
+				for _, notification := range coalesceStatusChanges(batch) {
+					// Already sent as part of the replay
+					if notification.Seq != 0 && notification.Seq <= replayed {
+						continue
+					}
+					writeSSEEvent(w, notification)
+				}
+				if err := w.Flush(); err != nil || !ok {
+					return
+				}
+
 			case <-ticker.C:
 				// Send keep-alive comment
 				w.WriteString(": keepalive\n\n")
-				w.Flush()
-				
-			case <-c.Context().Done():
-				return
+				if err := w.Flush(); err != nil {
+					return
+				}
 			}
 		}
 	}))
-	
+
 	return nil
 }
 
-// HandleWebSocket handles WebSocket connections for real-time notifications
+// writeSSEEvent writes a notification as an SSE event, using its sequence number as the event ID
+func writeSSEEvent(w *bufio.Writer, notification Notification) {
+	data, _ := json.Marshal(notification)
+	if notification.Seq != 0 {
+		fmt.Fprintf(w, "id: %d\n", notification.Seq)
+	}
+	w.WriteString("data: " + string(data) + "\n\n")
+}
+
+// collectBurst adds the notifications arriving within window to batch, so
+// a burst is written to the stream at once. It reports false if the
+// channel was closed.
+func collectBurst(messageChan chan Notification, batch []Notification, window time.Duration) ([]Notification, bool) {
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+
+	for {
+		select {
+		case notification, ok := <-messageChan:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, notification)
+		case <-timer.C:
+			return batch, true
+		}
+	}
+}
+
+// coalesceStatusChanges keeps only the last status_change of each message in
+// batch, which holds its current status and the highest sequence number, so
+// marking many messages over and over doesn't flood slow clients
+func coalesceStatusChanges(batch []Notification) []Notification {
+	last := make(map[string]int)
+	for i, notification := range batch {
+		if emailID, ok := notification.Data["email_id"].(string); ok && notification.Type == "status_change" {
+			last[emailID] = i
+		}
+	}
+	if len(last) == 0 {
+		return batch
+	}
+
+	coalesced := batch[:0:0]
+	for i, notification := range batch {
+		if emailID, ok := notification.Data["email_id"].(string); ok && notification.Type == "status_change" && last[emailID] != i {
+			continue
+		}
+		coalesced = append(coalesced, notification)
+	}
+	return coalesced
+}
+
+const (
+	// wsPongWait is how long a WebSocket may go without answering a ping
+	wsPongWait = 60 * time.Second
+	// wsPingPeriod must be shorter than wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+	// wsWriteWait bounds a single write to the socket
+	wsWriteWait = 10 * time.Second
+)
+
+// wsCommand is a client to server message on the notification socket
+type wsCommand struct {
+	Action string `json:"action"` // "subscribe", "unsubscribe", "mark_read"
+	Folder string `json:"folder"`
+	ID     string `json:"id"`
+}
+
+// wsSubscriptions tracks the folders a socket subscribed to. With no
+// subscriptions, folder-scoped notifications for every folder are delivered.
+type wsSubscriptions struct {
+	folders map[string]bool
+	mu      sync.Mutex
+}
+
+// wants reports whether a notification should be delivered to the socket
+func (s *wsSubscriptions) wants(notification Notification) bool {
+	folder, ok := notification.Data["folder"].(string)
+	if !ok {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.folders) == 0 || s.folders[folder]
+}
+
+// WebSocketUpgrade validates the session before a WebSocket upgrade and
+// passes the user's identity and credentials on to HandleWebSocket
+func (h *NotificationHandler) WebSocketUpgrade(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+
+	sess, err := ValidateSession(c, h.store)
+	if err != nil {
+		return utils.UnauthorizedError("Invalid session", err)
+	}
+
+	username, ok := sess.Get("username").(string)
+	if !ok || username == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+	c.Locals("username", username)
+
+	if creds, err := GetCredentials(c, h.store, h.config.Encryption.Key); err == nil {
+		c.Locals("credentials", creds)
+	}
+
+	return c.Next()
+}
+
+// HandleWebSocket handles WebSocket connections for real-time notifications.
+// Besides receiving notifications, clients can subscribe to folders and mark
+// messages as read over the socket.
 func (h *NotificationHandler) HandleWebSocket(c *websocket.Conn) {
 	userID, ok := c.Locals("username").(string)
 	if !ok || userID == "" {
 		c.Close()
 		return
 	}
+	creds, _ := c.Locals("credentials").(*Credentials)
+
+	subscriberID, messageChan := h.addSubscriber(userID)
 
-	subscriberID := uuid.New().String()
-	messageChan := make(chan Notification, 10)
-	
-	h.mu.Lock()
-	if _, ok := h.subscribers[userID]; !ok {
-		h.subscribers[userID] = make(map[string]chan Notification)
-	}
-	h.subscribers[userID][subscriberID] = messageChan
-	h.mu.Unlock()
-	
 	defer func() {
-		h.mu.Lock()
-		if subMap, ok := h.subscribers[userID]; ok {
-			delete(subMap, subscriberID)
-			if len(subMap) == 0 {
-				delete(h.subscribers, userID)
-			}
-		}
-		close(messageChan)
-		h.mu.Unlock()
-		
+		h.removeSubscriber(userID, subscriberID)
 		c.Close()
 		utils.Log.Info("WebSocket subscriber disconnected: %s", subscriberID)
 	}()
-	
+
 	utils.Log.Info("WebSocket subscriber connected: %s", subscriberID)
-	
-	// Send messages
-	for notification := range messageChan {
+
+	subs := &wsSubscriptions{folders: make(map[string]bool)}
+	replies := make(chan Notification, 10)
+
+	// Reader: handles commands and pongs, and detects dead connections
+	c.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var cmd wsCommand
+			var reply Notification
+			if err := json.Unmarshal(data, &cmd); err != nil {
+				reply = commandResult("", fmt.Errorf("invalid command"))
+			} else {
+				reply = commandResult(cmd.Action, h.handleCommand(userID, creds, subs, cmd))
+			}
+
+			select {
+			case replies <- reply:
+			default:
+			}
+		}
+	}()
+
+	// Writer: all writes happen here
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	write := func(notification Notification) bool {
+		c.SetWriteDeadline(time.Now().Add(wsWriteWait))
 		if err := c.WriteJSON(notification); err != nil {
 			utils.Log.Error("Failed to send WebSocket notification: %v", err)
-			break
+			return false
+		}
+		return true
+	}
+
+	for {
+		select {
+		case notification, ok := <-messageChan:
+			if !ok {
+				return
+			}
+			if subs.wants(notification) && !write(notification) {
+				return
+			}
+		case reply := <-replies:
+			if !write(reply) {
+				return
+			}
+		case <-ticker.C:
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-closed:
+			return
 		}
 	}
 }
 
+// handleCommand runs a client command received over the socket
+func (h *NotificationHandler) handleCommand(userID string, creds *Credentials, subs *wsSubscriptions, cmd wsCommand) error {
+	switch cmd.Action {
+	case "subscribe", "unsubscribe":
+		if cmd.Folder == "" {
+			return fmt.Errorf("folder required")
+		}
+		subs.mu.Lock()
+		if cmd.Action == "subscribe" {
+			subs.folders[cmd.Folder] = true
+		} else {
+			delete(subs.folders, cmd.Folder)
+		}
+		subs.mu.Unlock()
+		return nil
+
+	case "mark_read":
+		if cmd.ID == "" {
+			return fmt.Errorf("email ID required")
+		}
+		if creds == nil {
+			return fmt.Errorf("no credentials in session")
+		}
+		folder := cmd.Folder
+		if folder == "" {
+			folder = "INBOX"
+		}
+
+		client, err := NewMailClient(creds, h.config)
+		if err != nil {
+			return fmt.Errorf("failed to connect to mail server")
+		}
+		defer client.Close()
+
+		if err := client.MarkMessageAsRead(folder, cmd.ID); err != nil {
+			return err
+		}
+
+		// Let the user's other sessions update
+		h.NotifyStatusChange(userID, cmd.ID, "read")
+		return nil
+	}
+
+	return fmt.Errorf("unknown action: %s", cmd.Action)
+}
+
+// commandResult builds the reply sent for a socket command
+func commandResult(action string, err error) Notification {
+	result := Notification{
+		Type:    "command_result",
+		Message: "OK",
+		Data: map[string]interface{}{
+			"action":  action,
+			"success": err == nil,
+		},
+		Time: time.Now(),
+	}
+	if err != nil {
+		result.Message = err.Error()
+		result.Data["error"] = err.Error()
+	}
+	return result
+}
+
 // SendNotification sends a notification to a specific user
 func (h *NotificationHandler) SendNotification(userID string, notification Notification) {
 	notification.ID = uuid.New().String()
 	notification.Time = time.Now()
+
+	// Webhooks are subscribed per event, so they don't go through the preferences
+	if h.webhooks != nil {
+		go h.webhooks.Dispatch(userID, notification)
+	}
+
+	if !h.wantsNotification(userID, notification.Type) {
+		return
+	}
+
+	// Keep it for clients that reconnect after missing it
+	if err := h.storage.Append(userID, &notification); err != nil {
+		utils.Log.Warn("Failed to store notification for %s: %v", userID, err)
+	}
 	
 	h.mu.RLock()
 	defer h.mu.RUnlock()
@@ -180,14 +529,67 @@ func (h *NotificationHandler) SendNotification(userID string, notification Notif
 	}
 }
 
-// NotifyNewEmail sends a notification for a new email
-func (h *NotificationHandler) NotifyNewEmail(userID, from, subject string) {
+// wantsNotification checks a notification type against the user's
+// preferences. Types that keep the UI in sync are always delivered.
+func (h *NotificationHandler) wantsNotification(userID, notificationType string) bool {
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		utils.Log.Warn("Failed to load notification preferences for %s: %v", userID, err)
+		return true
+	}
+
+	switch notificationType {
+	case "new_email":
+		return settings.EnableNotifications && settings.NotifyNewMail
+	case "status_change", "deleted":
+		return settings.EnableNotifications && settings.NotifyStatusChanges
+	case "digest":
+		return settings.EnableNotifications && settings.NotifyDigests
+	}
+	return true
+}
+
+// NotifyNewEmail sends a notification for a new email that arrived in a
+// folder on the server
+func (h *NotificationHandler) NotifyNewEmail(userID, folder string, email models.Email) {
+	from := email.FromName
+	if from == "" {
+		from = email.From
+	}
 	h.SendNotification(userID, Notification{
 		Type:    "new_email",
 		Message: "New email received",
 		Data: map[string]interface{}{
-			"from":    from,
+			"folder":   folder,
+			"email_id": email.ID,
+			"from":     from,
+			"subject":  email.Subject,
+			"date":     email.Date,
+		},
+	})
+}
+
+// NotifySendFailed sends a notification when an outgoing email could not be sent
+func (h *NotificationHandler) NotifySendFailed(userID, to, subject string, err error) {
+	h.SendNotification(userID, Notification{
+		Type:    "send_failed",
+		Message: "Failed to send email",
+		Data: map[string]interface{}{
+			"to":      to,
 			"subject": subject,
+			"error":   err.Error(),
+		},
+	})
+}
+
+// NotifyLoginFromNewDevice sends a notification when the user signs in from an unknown device
+func (h *NotificationHandler) NotifyLoginFromNewDevice(userID, ip, userAgent string) {
+	h.SendNotification(userID, Notification{
+		Type:    "login_from_new_device",
+		Message: "New sign-in to your account",
+		Data: map[string]interface{}{
+			"ip":         ip,
+			"user_agent": userAgent,
 		},
 	})
 }
@@ -214,3 +616,46 @@ func (h *NotificationHandler) NotifyStatusChange(userID, emailID, status string)
 		},
 	})
 }
+
+// NotifyUnreadCounts sends the per-folder unread counts to a user if they
+// changed since the last update
+func (h *NotificationHandler) NotifyUnreadCounts(userID string, counts map[string]uint32) {
+	h.mu.Lock()
+	last, ok := h.unreadCounts[userID]
+	changed := !ok || len(last) != len(counts)
+	if !changed {
+		for folder, count := range counts {
+			if prev, ok := last[folder]; !ok || prev != count {
+				changed = true
+				break
+			}
+		}
+	}
+	if changed {
+		h.unreadCounts[userID] = counts
+	}
+	h.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	data := make(map[string]interface{}, len(counts))
+	for folder, count := range counts {
+		data[folder] = count
+	}
+	h.SendNotification(userID, Notification{
+		Type:    "unread_counts",
+		Message: "Unread counts updated",
+		Data: map[string]interface{}{
+			"counts": data,
+		},
+	})
+}
+
+// UnreadCounts returns the last known per-folder unread counts for a user
+func (h *NotificationHandler) UnreadCounts(userID string) map[string]uint32 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.unreadCounts[userID]
+}
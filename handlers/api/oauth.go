@@ -0,0 +1,284 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"lilmail/config"
+	"lilmail/utils"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauthToken is a token response of the OAuth provider
+type oauthToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	IDToken      string `json:"id_token"`
+
+	expires time.Time
+}
+
+// oauthTokens holds the latest token of each address signed in with the
+// OAuth provider. Providers may replace refresh tokens when they are used,
+// so this is also where a newer refresh token than the session's is found.
+var oauthTokens sync.Map
+
+// oauthTokenMu serializes refreshes, so an address's clients don't each
+// spend the refresh token
+var oauthTokenMu sync.Mutex
+
+// oauthTokenSaver stores a new refresh token of an account, so it is still
+// there after a restart. Set by NewAccountHandler.
+var oauthTokenSaver func(accountID, refreshToken string)
+
+// oauthError is an error response of the OAuth provider
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauthError) Error() string {
+	if e.Description != "" {
+		return strings.SplitN(e.Description, "\r\n", 2)[0]
+	}
+	return e.Code
+}
+
+// OAuthSignIn is a user who signed in with the OAuth provider
+type OAuthSignIn struct {
+	Email        string
+	AccessToken  string
+	RefreshToken string
+}
+
+// NewOAuthState returns the state and PKCE code verifier of a new sign-in,
+// which the callback must present again
+func NewOAuthState() (string, string, error) {
+	buf := make([]byte, 64)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:16]), base64.RawURLEncoding.EncodeToString(buf[16:]), nil
+}
+
+// OAuthAuthCodeURL returns the provider's page the user signs in at, which
+// sends them back to redirectURI with a code
+func OAuthAuthCodeURL(cfg config.OAuthConfig, redirectURI, state, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cfg.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Join(cfg.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if cfg.Provider == "google" {
+		// Google only hands out refresh tokens for offline access, and
+		// only on consent
+		query.Set("access_type", "offline")
+		query.Set("prompt", "consent")
+	}
+
+	sep := "?"
+	if strings.Contains(cfg.AuthURL, "?") {
+		sep = "&"
+	}
+	return cfg.AuthURL + sep + query.Encode()
+}
+
+// ExchangeOAuthCode trades the code the provider sent the user back with
+// for their tokens, and reads their address from the ID token
+func ExchangeOAuthCode(cfg config.OAuthConfig, redirectURI, code, verifier string) (*OAuthSignIn, error) {
+	token := &oauthToken{}
+	err := oauthRequest(cfg, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}, token)
+	if err != nil {
+		return nil, err
+	}
+	if token.RefreshToken == "" {
+		return nil, errors.New("the provider did not grant offline access")
+	}
+
+	email, err := idTokenEmail(token.IDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	token.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	oauthTokens.Store(strings.ToLower(email), token)
+
+	return &OAuthSignIn{
+		Email:        email,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+	}, nil
+}
+
+// oauthRequest posts a form to the provider's token endpoint and decodes
+// the response into result
+func oauthRequest(cfg config.OAuthConfig, form url.Values, result interface{}) error {
+	if !cfg.Enabled() {
+		return errors.New("OAuth sign-in is not configured")
+	}
+	form.Set("client_id", cfg.ClientID)
+	if cfg.ClientSecret != "" {
+		form.Set("client_secret", cfg.ClientSecret)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.PostForm(cfg.TokenURL, form)
+	if err != nil {
+		return fmt.Errorf("error reaching %s sign-in: %v", cfg.Name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		oauthErr := &oauthError{}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(oauthErr); err != nil || oauthErr.Code == "" {
+			return fmt.Errorf("%s sign-in returned %s", cfg.Name, resp.Status)
+		}
+		return oauthErr
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("error decoding %s sign-in response: %v", cfg.Name, err)
+	}
+	return nil
+}
+
+// idTokenEmail returns the address an ID token was issued for. The token
+// came straight from the token endpoint over TLS, so its signature isn't
+// checked; the mail server checks the access token when logging in.
+func idTokenEmail(idToken string) (string, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("the provider sent no ID token; add the openid and email scopes")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", fmt.Errorf("invalid ID token: %v", err)
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("invalid ID token: %v", err)
+	}
+
+	// Microsoft only includes the email claim when the tenant sets one
+	email := claims.Email
+	if email == "" {
+		email = claims.PreferredUsername
+	}
+	if !strings.Contains(email, "@") {
+		return "", errors.New("the ID token has no email address")
+	}
+	return email, nil
+}
+
+// oauthAccessToken returns an access token of an address, refreshing it
+// when it is about to expire. A new refresh token is saved in accountID.
+func oauthAccessToken(cfg config.OAuthConfig, email, accountID, refreshToken string) (string, error) {
+	oauthTokenMu.Lock()
+	defer oauthTokenMu.Unlock()
+
+	key := strings.ToLower(email)
+	if cached, ok := oauthTokens.Load(key); ok {
+		token := cached.(*oauthToken)
+		if time.Until(token.expires) > time.Minute {
+			return token.AccessToken, nil
+		}
+		refreshToken = token.RefreshToken
+	}
+
+	token := &oauthToken{}
+	err := oauthRequest(cfg, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	}, token)
+	if err != nil {
+		return "", fmt.Errorf("error refreshing %s sign-in: %v", cfg.Name, err)
+	}
+	token.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+	oauthTokens.Store(key, token)
+
+	if token.RefreshToken != refreshToken && accountID != "" && oauthTokenSaver != nil {
+		oauthTokenSaver(accountID, token.RefreshToken)
+	}
+	return token.AccessToken, nil
+}
+
+// saveOAuthToken stores the new refresh token of an XOAUTH2 account
+func (h *AccountHandler) saveOAuthToken(accountID, refreshToken string) {
+	encryptionKey := []byte(h.config.Encryption.Key)
+	account, err := h.storage.GetAccount(accountID, encryptionKey)
+	if err != nil {
+		utils.Log.Warn("Failed to load account %s to save its OAuth sign-in: %v", accountID, err)
+		return
+	}
+	account.Password = refreshToken
+	if err := h.storage.UpdateAccount(account, encryptionKey); err != nil {
+		utils.Log.Warn("Failed to save OAuth sign-in of account %s: %v", accountID, err)
+	}
+}
+
+// xoauth2Response is the initial response of the XOAUTH2 SASL mechanism
+func xoauth2Response(username, accessToken string) []byte {
+	return []byte("user=" + username + "\x01auth=Bearer " + accessToken + "\x01\x01")
+}
+
+// xoauth2Client logs in to an IMAP server over XOAUTH2
+type xoauth2Client struct {
+	username    string
+	accessToken string
+}
+
+func (a *xoauth2Client) Start() (string, []byte, error) {
+	return "XOAUTH2", xoauth2Response(a.username, a.accessToken), nil
+}
+
+// Next answers the error the server sends as a challenge when it refuses
+// the token with an empty response, after which it fails the login
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// xoauth2Auth logs in to an SMTP server over XOAUTH2
+type xoauth2Auth struct {
+	username    string
+	accessToken string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "XOAUTH2", xoauth2Response(a.username, a.accessToken), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
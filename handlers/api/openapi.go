@@ -0,0 +1,190 @@
+package api
+
+//go:generate go run ../../tools/openapidoc -o openapi_docs.go . ../web
+
+import (
+	"encoding/json"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// openAPIDoc documents the handler of a route, as collected from its doc
+// comment and body by tools/openapidoc
+type openAPIDoc struct {
+	Summary     string
+	Description string
+	Query       []openAPIParam
+	Body        string // "json" or "multipart" if the handler reads a body
+}
+
+// openAPIParam is a query parameter and its schema type
+type openAPIParam struct {
+	Name string
+	Type string
+}
+
+// OpenAPIHandler serves an OpenAPI 3 document of the /api routes. Paths and
+// methods come from the router, so they can't drift from what is served;
+// summaries and parameters come from the handlers' doc comments, collected
+// into openapi_docs.go by go generate.
+type OpenAPIHandler struct {
+	app  *fiber.App
+	once sync.Once
+	spec []byte
+}
+
+// NewOpenAPIHandler creates a handler describing the routes of app. The
+// document is built on the first request, once every route is registered.
+func NewOpenAPIHandler(app *fiber.App) *OpenAPIHandler {
+	return &OpenAPIHandler{app: app}
+}
+
+// Spec serves the OpenAPI document as JSON
+func (h *OpenAPIHandler) Spec(c *fiber.Ctx) error {
+	h.once.Do(func() {
+		h.spec, _ = json.MarshalIndent(buildOpenAPI(h.app.GetRoutes(true)), "", "  ")
+	})
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	return c.Send(h.spec)
+}
+
+// buildOpenAPI describes the /api routes among routes
+func buildOpenAPI(routes []fiber.Route) fiber.Map {
+	paths := make(map[string]fiber.Map)
+	tags := make(map[string]bool)
+
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, "/api/") || route.Method == fiber.MethodHead || len(route.Handlers) == 0 {
+			continue
+		}
+		// Catch-all routes only answer for paths that don't exist
+		if strings.Contains(route.Path, "*") {
+			continue
+		}
+
+		path, pathParams := openAPIPath(route.Path)
+		doc := openAPIDocs[handlerName(route.Handlers[len(route.Handlers)-1])]
+		tag := openAPITag(route.Path)
+		tags[tag] = true
+
+		op := fiber.Map{
+			"tags":      []string{tag},
+			"responses": openAPIResponses,
+		}
+		if doc.Summary != "" {
+			op["summary"] = doc.Summary
+		}
+		if doc.Description != "" {
+			op["description"] = doc.Description
+		}
+
+		var params []fiber.Map
+		for _, name := range pathParams {
+			params = append(params, fiber.Map{
+				"name": name, "in": "path", "required": true,
+				"schema": fiber.Map{"type": "string"},
+			})
+		}
+		for _, q := range doc.Query {
+			params = append(params, fiber.Map{
+				"name": q.Name, "in": "query",
+				"schema": fiber.Map{"type": q.Type},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		switch doc.Body {
+		case "json":
+			op["requestBody"] = fiber.Map{"content": fiber.Map{
+				fiber.MIMEApplicationJSON: fiber.Map{"schema": fiber.Map{"type": "object"}},
+				fiber.MIMEApplicationForm: fiber.Map{"schema": fiber.Map{"type": "object"}},
+			}}
+		case "multipart":
+			op["requestBody"] = fiber.Map{"content": fiber.Map{
+				fiber.MIMEMultipartForm: fiber.Map{"schema": fiber.Map{"type": "object"}},
+			}}
+		}
+
+		if paths[path] == nil {
+			paths[path] = fiber.Map{}
+		}
+		paths[path][strings.ToLower(route.Method)] = op
+	}
+
+	tagList := make([]fiber.Map, 0, len(tags))
+	for tag := range tags {
+		tagList = append(tagList, fiber.Map{"name": tag})
+	}
+	sort.Slice(tagList, func(i, j int) bool {
+		return tagList[i]["name"].(string) < tagList[j]["name"].(string)
+	})
+
+	return fiber.Map{
+		"openapi": "3.0.3",
+		"info": fiber.Map{
+			"title":       "lilmail API",
+			"version":     "1",
+			"description": "Routes under /api use the session cookie set by POST /login. Except under /api/v1, requests that change data must send the CSRF token of the page in the X-CSRF-Token header.",
+		},
+		"tags":  tagList,
+		"paths": paths,
+		"components": fiber.Map{
+			"securitySchemes": fiber.Map{
+				"session": fiber.Map{"type": "apiKey", "in": "cookie", "name": "session_id"},
+			},
+		},
+		"security": []fiber.Map{{"session": []string{}}},
+	}
+}
+
+// openAPIResponses are the responses every operation documents
+var openAPIResponses = fiber.Map{
+	"200":     fiber.Map{"description": "Success"},
+	"default": fiber.Map{"description": "Error, with a JSON body giving its message"},
+}
+
+// openAPIPath turns a route path into an OpenAPI path template and its
+// parameters: /api/email/:id becomes /api/email/{id}
+func openAPIPath(path string) (string, []string) {
+	var params []string
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			name = strings.TrimSuffix(name, "?")
+			params = append(params, name)
+			segments[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// openAPITag groups a route by its first path segment after /api, or after
+// /api/v1 for the mobile API
+func openAPITag(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/api/"), "/")
+	if segments[0] == "v1" && len(segments) > 1 {
+		return "v1/" + segments[1]
+	}
+	return strings.TrimSuffix(segments[0], ".json")
+}
+
+// handlerName returns the name a handler's function is documented under,
+// like web.(*EmailHandler).HandleEmailView
+func handlerName(handler fiber.Handler) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(handler).Pointer())
+	if fn == nil {
+		return ""
+	}
+	name := fn.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.TrimSuffix(name, "-fm")
+}
@@ -0,0 +1,613 @@
+// Code generated by openapidoc from the handlers' doc comments; DO NOT EDIT.
+
+package api
+
+// openAPIDocs documents the handlers of HTTP routes by function name
+var openAPIDocs = map[string]openAPIDoc{
+	"api.(*AccountHandler).CreateAccount": {
+		Summary: "Creates a new email account",
+		Body:    "json",
+	},
+	"api.(*AccountHandler).DeleteAccount": {
+		Summary: "Deletes an account",
+	},
+	"api.(*AccountHandler).FinishGraphLogin": {
+		Summary: "Checks whether the user finished signing in at Microsoft, and adds their account once they have",
+	},
+	"api.(*AccountHandler).GetAccount": {
+		Summary: "Retrieves a specific account",
+	},
+	"api.(*AccountHandler).GetAccounts": {
+		Summary: "Retrieves all accounts for the current user",
+	},
+	"api.(*AccountHandler).SetDefaultAccount": {
+		Summary: "Sets an account as the default",
+	},
+	"api.(*AccountHandler).StartGraphLogin": {
+		Summary:     "Starts adding a Microsoft 365 account",
+		Description: "StartGraphLogin starts adding a Microsoft 365 account. The user signs in at Microsoft with the returned code while the page polls FinishGraphLogin.",
+	},
+	"api.(*AccountHandler).SwitchAccount": {
+		Summary: "Switches the active session to the specified account",
+	},
+	"api.(*AccountHandler).TestAccount": {
+		Summary: "Checks that an account's IMAP (or JMAP, or POP3) login works, or that the user's Maildir can be read, before it is saved",
+		Body:    "json",
+	},
+	"api.(*AccountHandler).UpdateAccount": {
+		Summary: "Updates an existing account",
+		Body:    "json",
+	},
+	"api.(*AccountHandler).checkAccountLimit": {
+		Summary: "Enforces the account limit set by an admin",
+	},
+	"api.(*AdminHandler).GetSessions": {
+		Summary: "Lists who is logged in, from where and since when",
+		Query:   []openAPIParam{{"user_id", "string"}},
+	},
+	"api.(*AdminHandler).GetStats": {
+		Summary: "Returns counts of users, accounts, sessions and connections, storage usage and the latest logged errors",
+	},
+	"api.(*AdminHandler).RevokeUserSessions": {
+		Summary:     "Logs a user out everywhere, e.g",
+		Description: "RevokeUserSessions logs a user out everywhere, e.g. after offboarding, and stops their background mail connections",
+	},
+	"api.(*AttachmentHandler).HandleDownload": {
+		Summary: "Serves an attachment for download",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"api.(*AttachmentHandler).HandleInline": {
+		Summary:     "Serves an inline part referenced from a message's HTML by a cid: URL",
+		Description: "HandleInline serves an inline part referenced from a message's HTML by a cid: URL. Only images are served, as they load from our own origin.",
+		Query:       []openAPIParam{{"folder", "string"}},
+	},
+	"api.(*AttachmentHandler).HandlePreview": {
+		Summary: "Serves a preview of an attachment: images as they are, the first page of PDFs as a PNG, and text and CSV files as a page",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"api.(*AvatarHandler).HandleAvatar": {
+		Summary:     "Serves the picture of the sender in the email query parameter, or an initials avatar made from the name parameter",
+		Description: "HandleAvatar serves the picture of the sender in the email query parameter, or an initials avatar made from the name parameter. With bimi=1, which the viewer sets for messages that passed DMARC, the brand logo of the sender's domain is preferred.",
+		Query:       []openAPIParam{{"email", "string"}, {"name", "string"}, {"bimi", "string"}},
+	},
+	"api.(*CleanupHandler).FindDuplicates": {
+		Summary: "Lists the messages of a folder stored more than once, as happens after a migration was run twice or stopped half way",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"api.(*CleanupHandler).Preview": {
+		Summary: "Returns how many messages a cleanup would change and the newest of them, so the user can check the criteria before running it",
+	},
+	"api.(*CleanupHandler).RemoveDuplicates": {
+		Summary:     "Deletes the copies of duplicated messages in a folder, keeping the first of each",
+		Description: "RemoveDuplicates deletes the copies of duplicated messages in a folder, keeping the first of each. The folder is scanned again so that only messages that still have another copy are deleted; given uids, only those of them.",
+		Body:        "json",
+	},
+	"api.(*CleanupHandler).Run": {
+		Summary:     "Deletes or archives the messages matching a cleanup request in batches",
+		Description: "Run deletes or archives the messages matching a cleanup request in batches. The response is a stream of server-sent events reporting the progress after every batch; the run stops if the client goes away.",
+	},
+	"api.(*DigestScheduler).HandleUnsubscribe": {
+		Summary:     "Turns off digests for the user named in a signed link",
+		Description: "HandleUnsubscribe turns off digests for the user named in a signed link. It doesn't require a session so it works straight from the email.",
+		Query:       []openAPIParam{{"user", "string"}, {"token", "string"}},
+	},
+	"api.(*DraftHandler).AutoSave": {
+		Summary:     "Handles auto-save requests from the editor",
+		Description: "AutoSave handles auto-save requests from the editor. The editor sends the revision it last saw and gets back the stored draft; a conflict means the draft was saved elsewhere in the meantime.",
+		Body:        "json",
+	},
+	"api.(*DraftHandler).CompleteUpload": {
+		Summary:     "Joins an upload's chunks into the attachment",
+		Description: "CompleteUpload joins an upload's chunks into the attachment. The optional checksum is the SHA-256 of the whole file.",
+		Body:        "json",
+	},
+	"api.(*DraftHandler).CreateUpload": {
+		Summary: "Starts uploading an attachment to a draft in chunks",
+		Body:    "json",
+	},
+	"api.(*DraftHandler).DeleteDraft": {
+		Summary: "Deletes a draft",
+	},
+	"api.(*DraftHandler).DeleteUpload": {
+		Summary: "Removes an attachment uploaded to a draft",
+	},
+	"api.(*DraftHandler).GetDraft": {
+		Summary: "Retrieves a specific draft",
+	},
+	"api.(*DraftHandler).GetDrafts": {
+		Summary: "Retrieves all drafts for the current user",
+	},
+	"api.(*DraftHandler).GetUpload": {
+		Summary: "Reports which chunks of an upload have arrived, so that an interrupted upload can be resumed",
+	},
+	"api.(*DraftHandler).GetUploads": {
+		Summary: "Lists the attachments uploaded to a draft",
+	},
+	"api.(*DraftHandler).LinkUpload": {
+		Summary: "Turns a completed upload into a large file sent as an expiring download link, and returns the link to put in the message",
+	},
+	"api.(*DraftHandler).SaveDraft": {
+		Summary: "Saves or updates a draft",
+		Body:    "json",
+	},
+	"api.(*DraftHandler).UploadChunk": {
+		Summary:     "Stores one chunk of an upload",
+		Description: "UploadChunk stores one chunk of an upload. The body is the raw chunk and the X-Chunk-Checksum header its hex SHA-256.",
+	},
+	"api.(*FolderHandler).CreateFolder": {
+		Summary: "Creates a new IMAP folder",
+		Body:    "json",
+	},
+	"api.(*FolderHandler).DeleteFolder": {
+		Summary: "Deletes an IMAP folder",
+	},
+	"api.(*FolderHandler).MailboxUsage": {
+		Summary: "Reports how much each folder of the mailbox takes up and which messages are the largest, so users can see what fills their quota",
+	},
+	"api.(*FolderHandler).RenameFolder": {
+		Summary: "Renames an IMAP folder",
+		Body:    "json",
+	},
+	"api.(*GraphQLHandler).Query": {
+		Summary: "Runs a posted query",
+		Body:    "json",
+	},
+	"api.(*GraphQLHandler).Schema": {
+		Summary: "Serves the schema as SDL, and runs ?query= if one is given",
+		Query:   []openAPIParam{{"query", "string"}, {"operationName", "string"}, {"variables", "string"}},
+	},
+	"api.(*I18nHandler).GetTranslations": {
+		Summary:     "Returns every message of a language for the client-side JavaScript, falling back to English for languages that aren't registered",
+		Description: "GetTranslations returns every message of a language for the client-side JavaScript, falling back to English for languages that aren't registered. Browsers revalidate it with the ETag and Last-Modified of the locale file.",
+	},
+	"api.(*IdleManager).Register": {
+		Summary: "Is a handler that remembers the session's credentials so an IDLE worker can be started once the subscriber connects",
+	},
+	"api.(*ImageProxy).HandleImage": {
+		Summary: "Serves the remote image in the url query parameter",
+		Query:   []openAPIParam{{"url", "string"}},
+	},
+	"api.(*LabelHandler).AssignLabel": {
+		Summary: "Adds a label to an email in the folder given by ?folder= (INBOX by default)",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"api.(*LabelHandler).BulkAssignLabel": {
+		Summary:     "Adds a label to a list of emails, e.g",
+		Description: "BulkAssignLabel adds a label to a list of emails, e.g. from a multi-select in the list view, in the folder given by ?folder= (INBOX by default)",
+		Query:       []openAPIParam{{"folder", "string"}},
+		Body:        "json",
+	},
+	"api.(*LabelHandler).CreateLabel": {
+		Summary: "Creates a new label",
+		Body:    "json",
+	},
+	"api.(*LabelHandler).DeleteLabel": {
+		Summary: "Deletes a label",
+	},
+	"api.(*LabelHandler).ExportLabels": {
+		Summary: "Returns the user's labels and their associations with emails of the session's account as a JSON download",
+	},
+	"api.(*LabelHandler).GetEmailLabels": {
+		Summary: "Retrieves the user's labels on an email in the folder given by ?folder= (INBOX by default)",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"api.(*LabelHandler).GetLabels": {
+		Summary: "Retrieves all labels for the current user",
+	},
+	"api.(*LabelHandler).ImportLabels": {
+		Summary:     "Recreates labels from an export",
+		Description: "ImportLabels recreates labels from an export. Labels get new IDs, and associations are matched to emails of the session's account by Message-ID where possible, falling back to the exported email ID. Associations without a folder are matched in the folder given by ?folder=, else the export's, else INBOX.",
+		Query:       []openAPIParam{{"folder", "string"}},
+		Body:        "json",
+	},
+	"api.(*LabelHandler).RemoveLabel": {
+		Summary: "Removes a label from an email in the folder given by ?folder= (INBOX by default)",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"api.(*LabelHandler).UpdateLabel": {
+		Summary:     "Changes a label's name, color or description",
+		Description: "UpdateLabel changes a label's name, color or description. Fields left out of the request keep their current value.",
+		Body:        "json",
+	},
+	"api.(*LargeFileHandler).DeleteFile": {
+		Summary: "Deletes one of the current user's files, so its link stops working",
+	},
+	"api.(*LargeFileHandler).GetFiles": {
+		Summary: "Lists the files the current user sent as links",
+	},
+	"api.(*LargeFileHandler).HandleDownload": {
+		Summary:     "Downloads a file for anyone with its link",
+		Description: "HandleDownload downloads a file for anyone with its link. Links that are forged, expired or deleted all look the same.",
+	},
+	"api.(*LogHandler).GetAudit": {
+		Summary: "Returns audit events filtered by user, action and time range",
+		Query:   []openAPIParam{{"user", "string"}, {"action", "string"}},
+	},
+	"api.(*LogHandler).GetLogs": {
+		Summary: "Returns recent log messages filtered by minimum level, user and time range",
+		Query:   []openAPIParam{{"level", "string"}, {"user", "string"}},
+	},
+	"api.(*MailPoller).EnsureStarted": {
+		Summary:     "Is a handler that starts polling for the session's user if it isn't running yet, e.g",
+		Description: "EnsureStarted is a handler that starts polling for the session's user if it isn't running yet, e.g. after a server restart",
+	},
+	"api.(*MobileHandler).Authenticate": {
+		Summary:     "Lets requests with a signed-in session through, answering others with 401 rather than the login redirect of web pages",
+		Description: "Authenticate lets requests with a signed-in session through, answering others with 401 rather than the login redirect of web pages. Changes must be sent as JSON, which browsers can't post across sites without CORS, so they don't need the CSRF token of forms.",
+	},
+	"api.(*MobileHandler).Folders": {
+		Summary: "Lists the selectable folders with their message and unread counts",
+	},
+	"api.(*MobileHandler).Message": {
+		Summary: "Returns a message of ?folder= with its body and attachments",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"api.(*MobileHandler).Messages": {
+		Summary:     "Lists a page of the messages of ?folder=, newest first",
+		Description: "Messages lists a page of the messages of ?folder=, newest first. Pages are numbered from 1 with ?page=; ?page_size= is at most 100.",
+		Query:       []openAPIParam{{"folder", "string"}, {"page", "integer"}, {"page_size", "integer"}},
+	},
+	"api.(*MobileHandler).NotFound": {
+		Summary: "Answers requests for routes the API doesn't have",
+	},
+	"api.(*MobileHandler).Send": {
+		Summary: "Sends a plain text or HTML message given as a SendRequest, without attachments",
+	},
+	"api.(*NoteHandler).CreateNote": {
+		Summary: "Adds a note to a message",
+		Body:    "json",
+	},
+	"api.(*NoteHandler).DeleteNote": {
+		Summary: "Removes one of the user's notes",
+	},
+	"api.(*NoteHandler).GetNotes": {
+		Summary: "Lists the notes on a message the user can see",
+		Query:   []openAPIParam{{"message_key", "string"}},
+	},
+	"api.(*NoteHandler).UpdateNote": {
+		Summary: "Edits one of the user's notes",
+		Body:    "json",
+	},
+	"api.(*NotificationHandler).HandleSSE": {
+		Summary: "Handles Server-Sent Events for real-time notifications",
+		Query:   []openAPIParam{{"lastEventId", "string"}},
+	},
+	"api.(*NotificationHandler).WebSocketUpgrade": {
+		Summary: "Validates the session before a WebSocket upgrade and passes the user's identity and credentials on to HandleWebSocket",
+	},
+	"api.(*OpenAPIHandler).Spec": {
+		Summary: "Serves the OpenAPI document as JSON",
+	},
+	"api.(*PreferencesHandler).AddImageSender": {
+		Summary: "Always loads remote images from an address or @domain",
+		Body:    "json",
+	},
+	"api.(*PreferencesHandler).BlockSender": {
+		Summary:     "Junks or deletes new mail from an address or @domain",
+		Description: "BlockSender junks or deletes new mail from an address or @domain. Blocking a sender again changes what happens to their mail.",
+		Body:        "json",
+	},
+	"api.(*PreferencesHandler).GetAssistPreferences": {
+		Summary: "Returns whether the user turned reply suggestions on and whether the server offers them",
+	},
+	"api.(*PreferencesHandler).GetBlockedSenders": {
+		Summary: "Returns the senders whose new mail is junked or deleted",
+	},
+	"api.(*PreferencesHandler).GetClientConfig": {
+		Summary: "Returns the per-user settings the frontend scripts need",
+	},
+	"api.(*PreferencesHandler).GetComposePreferences": {
+		Summary: "Returns the user's compose window defaults",
+	},
+	"api.(*PreferencesHandler).GetImageSenders": {
+		Summary: "Returns the senders whose remote images always load",
+	},
+	"api.(*PreferencesHandler).GetNotificationPreferences": {
+		Summary: "Returns the user's notification preferences",
+	},
+	"api.(*PreferencesHandler).GetPreferences": {
+		Summary: "Returns all of the user's settings",
+	},
+	"api.(*PreferencesHandler).GetShortcuts": {
+		Summary: "Returns the user's keyboard shortcuts, defaults included",
+	},
+	"api.(*PreferencesHandler).GetSpamPreferences": {
+		Summary: "Returns the user's spam filter settings and how much the classifier has been trained",
+	},
+	"api.(*PreferencesHandler).RemoveImageSender": {
+		Summary: "Stops always loading remote images from a sender",
+	},
+	"api.(*PreferencesHandler).ResetPreferences": {
+		Summary: "Restores the default settings for the user",
+	},
+	"api.(*PreferencesHandler).ResetSpamFilter": {
+		Summary: "Forgets everything the user's spam classifier learned",
+	},
+	"api.(*PreferencesHandler).UnblockSender": {
+		Summary: "Stops junking or deleting new mail from a sender",
+	},
+	"api.(*PreferencesHandler).UpdateAssistPreferences": {
+		Summary:     "Turns reply suggestions on or off",
+		Description: "UpdateAssistPreferences turns reply suggestions on or off. It accepts JSON or the settings page form, where an unchecked box is absent.",
+		Body:        "json",
+	},
+	"api.(*PreferencesHandler).UpdateComposePreferences": {
+		Summary:     "Saves the user's compose window defaults",
+		Description: "UpdateComposePreferences saves the user's compose window defaults. Fields left out go back to their default.",
+		Body:        "json",
+	},
+	"api.(*PreferencesHandler).UpdateNotificationPreferences": {
+		Summary:     "Saves the user's notification preferences",
+		Description: "UpdateNotificationPreferences saves the user's notification preferences. It accepts JSON or the settings page form, where unchecked boxes are absent.",
+		Body:        "json",
+	},
+	"api.(*PreferencesHandler).UpdatePreferences": {
+		Summary:     "Saves the user's display preferences",
+		Description: "UpdatePreferences saves the user's display preferences. It accepts a partial JSON update or the settings page form, where unchecked boxes are absent.",
+		Body:        "json",
+	},
+	"api.(*PreferencesHandler).UpdateShortcuts": {
+		Summary:     "Rebinds keyboard shortcuts",
+		Description: "UpdateShortcuts rebinds keyboard shortcuts. The body maps actions to keys, either as is or under \"shortcuts\"; an empty key restores the default.",
+		Body:        "json",
+	},
+	"api.(*PreferencesHandler).UpdateSpamPreferences": {
+		Summary:     "Saves the user's spam filter settings",
+		Description: "UpdateSpamPreferences saves the user's spam filter settings. It accepts JSON or the settings page form, where unchecked boxes are absent.",
+		Body:        "json",
+	},
+	"api.(*SearchHandler).HandleSearch": {
+		Summary: "Performs search on IMAP server",
+		Query:   []openAPIParam{{"folder", "string"}, {"page", "integer"}},
+	},
+	"api.(*SendHandler).HandleSend": {
+		Summary: "Sends an email posted as JSON, or as a multipart form with its attachments",
+	},
+	"api.(*ShareHandler).CreateShare": {
+		Summary: "Copies a message into a new expiring link",
+		Body:    "json",
+	},
+	"api.(*ShareHandler).GetShares": {
+		Summary: "Lists the current user's links",
+	},
+	"api.(*ShareHandler).HandleSharedAttachment": {
+		Summary: "Downloads an attachment of a shared message",
+	},
+	"api.(*ShareHandler).HandleSharedEmail": {
+		Summary: "Shows a shared message to anyone with its link",
+	},
+	"api.(*ShareHandler).RevokeShare": {
+		Summary: "Stops one of the current user's links from opening",
+	},
+	"api.(*SnippetHandler).CreateSnippet": {
+		Summary: "Adds a snippet",
+	},
+	"api.(*SnippetHandler).DeleteSnippet": {
+		Summary: "Removes one of the current user's snippets",
+	},
+	"api.(*SnippetHandler).GetSnippets": {
+		Summary: "Lists the current user's snippets",
+	},
+	"api.(*SnippetHandler).UpdateSnippet": {
+		Summary: "Edits one of the current user's snippets",
+	},
+	"api.(*SystemSettingsHandler).GetSettings": {
+		Summary: "Returns the settings in effect and the config.toml defaults",
+	},
+	"api.(*SystemSettingsHandler).ResetSettings": {
+		Summary: "Goes back to the config.toml values",
+	},
+	"api.(*SystemSettingsHandler).UpdateSettings": {
+		Summary: "Replaces the settings; they apply to the next request",
+		Body:    "json",
+	},
+	"api.(*ThemeHandler).CreateTheme": {
+		Summary: "Uploads a custom theme (Admin only)",
+		Body:    "json",
+	},
+	"api.(*ThemeHandler).DeleteTheme": {
+		Summary:     "Removes a custom theme (Admin only)",
+		Description: "DeleteTheme removes a custom theme (Admin only). Users who picked it fall back to the light theme.",
+	},
+	"api.(*ThemeHandler).GetThemes": {
+		Summary: "Lists the built-in and custom themes and the user's choice",
+	},
+	"api.(*ThemeHandler).SetTheme": {
+		Summary: "Saves the theme the user picked",
+		Body:    "json",
+	},
+	"api.(*ThemeHandler).ThemeCSS": {
+		Summary: "Serves the custom themes as a stylesheet, one data-theme rule per theme",
+	},
+	"api.(*UserHandler).CreateUser": {
+		Summary: "Creates a new user (Admin only)",
+		Body:    "json",
+	},
+	"api.(*UserHandler).DeleteUser": {
+		Summary: "Deletes a user (Admin only)",
+	},
+	"api.(*UserHandler).GetUsers": {
+		Summary: "Retrieves all users (Admin only)",
+	},
+	"api.(*UserHandler).UpdateLimits": {
+		Summary: "Sets a user's resource limits (Admin only)",
+		Body:    "json",
+	},
+	"api.(*UserHandler).UpdatePassword": {
+		Summary: "Updates a user's password",
+		Body:    "json",
+	},
+	"api.(*UserHandler).UpdateUser": {
+		Summary: "Updates a user (Admin only)",
+		Body:    "json",
+	},
+	"api.(*WebhookHandler).CreateWebhook": {
+		Summary: "Registers a new webhook",
+		Body:    "json",
+	},
+	"api.(*WebhookHandler).DeleteWebhook": {
+		Summary: "Removes a webhook",
+	},
+	"api.(*WebhookHandler).GetWebhooks": {
+		Summary: "Lists the current user's webhooks",
+	},
+	"api.(*WebhookHandler).TestWebhook": {
+		Summary: "Sends a test event to a webhook and reports the result",
+	},
+	"web.(*AdminHandler).ShowAPIDocs": {
+		Summary: "Renders Swagger UI over the OpenAPI document of /api",
+	},
+	"web.(*AdminHandler).ShowDashboard": {
+		Summary: "Renders the admin dashboard with instance statistics",
+	},
+	"web.(*AdminHandler).ShowUsers": {
+		Summary: "Renders the user management page",
+	},
+	"web.(*AttachmentWebHandler).HandleAttachments": {
+		Summary: "Renders the attachment manager page from the attachment index kept with the message cache, so no messages are fetched",
+		Query:   []openAPIParam{{"folder", "string"}, {"page", "string"}},
+	},
+	"web.(*AuthHandler).HandleLogin": {
+		Summary: "Processes the login form",
+	},
+	"web.(*AuthHandler).HandleLogout": {
+		Summary: "Processes user logout",
+	},
+	"web.(*AuthHandler).HandleOAuthCallback": {
+		Summary: "Logs in the user the OAuth provider sent back, over XOAUTH2 with the tokens of their sign-in",
+		Query:   []openAPIParam{{"error", "string"}, {"error_description", "string"}, {"state", "string"}, {"code", "string"}},
+	},
+	"web.(*AuthHandler).ShowLogin": {
+		Summary: "Renders the login page",
+	},
+	"web.(*AuthHandler).ShowOAuthLogin": {
+		Summary: "Sends the user to sign in at the OAuth provider, which sends them back to HandleOAuthCallback",
+	},
+	"web.(*EmailHandler).HandleBlockSender": {
+		Summary:     "Blocks the sender of the message named in the route, or their whole domain with scope=domain, so their new mail is junked or deleted as action says",
+		Description: "HandleBlockSender blocks the sender of the message named in the route, or their whole domain with scope=domain, so their new mail is junked or deleted as action says. The message itself is junked or deleted right away.",
+		Query:       []openAPIParam{{"folder", "string"}},
+		Body:        "json",
+	},
+	"web.(*EmailHandler).HandleCardCalendar": {
+		Summary: "Serves one of a message's summary cards as an iCalendar event, for the card's \"add to calendar\" action",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"web.(*EmailHandler).HandleCompose": {
+		Summary:     "Opens the inbox with the compose modal prefilled from a mailto: link",
+		Description: "HandleCompose opens the inbox with the compose modal prefilled from a mailto: link. The browser sends mailto: links here once lilmail is registered as its mail client.",
+		Query:       []openAPIParam{{"mailto", "string"}},
+	},
+	"web.(*EmailHandler).HandleComposeEmail": {
+		Summary: "Sends an email from the compose form",
+	},
+	"web.(*EmailHandler).HandleContact": {
+		Summary: "Renders the correspondence with one address: every message from or to it in any folder, newest first, with the first and latest contact and actions like writing to or blocking the address",
+		Query:   []openAPIParam{{"address", "string"}},
+	},
+	"web.(*EmailHandler).HandleDeleteEmail": {
+		Summary: "Handles the email deletion request",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"web.(*EmailHandler).HandleEmailBody": {
+		Summary: "Serves a message's HTML as a standalone document for the viewer's sandboxed frame, so gaps in the sanitizer can't reach the app",
+		Query:   []openAPIParam{{"folder", "string"}, {"images", "string"}},
+	},
+	"web.(*EmailHandler).HandleEmailHeaders": {
+		Summary: "Returns a message's full headers, its Received chain, authentication results and MIME parts, for the viewer's original panel",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"web.(*EmailHandler).HandleEmailPDF": {
+		Summary: "Exports a message as a PDF download",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"web.(*EmailHandler).HandleEmailPrint": {
+		Summary: "Renders a message without the app's layout for printing or saving as PDF from the browser: its headers, body and attachment list",
+		Query:   []openAPIParam{{"folder", "string"}, {"images", "string"}},
+	},
+	"web.(*EmailHandler).HandleEmailView": {
+		Summary: "Handles the HTMX request for viewing a single email",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"web.(*EmailHandler).HandleFolder": {
+		Summary: "Displays emails from a specific folder",
+		Query:   []openAPIParam{{"view", "string"}, {"page", "string"}, {"q", "string"}},
+	},
+	"web.(*EmailHandler).HandleFolderEmails": {
+		Summary: "handlers/web/email.go",
+		Query:   []openAPIParam{{"page", "string"}},
+	},
+	"web.(*EmailHandler).HandleHome": {
+		Summary:     "Opens the user's default folder",
+		Description: "HandleHome opens the user's default folder. A \"label:<id>\" default opens a search for that label. Defaults that no longer exist fall back to INBOX.",
+	},
+	"web.(*EmailHandler).HandleInbox": {
+		Summary: "Renders the main inbox page",
+		Query:   []openAPIParam{{"view", "string"}, {"page", "string"}, {"q", "string"}},
+	},
+	"web.(*EmailHandler).HandleMarkNotSpam": {
+		Summary: "Trains the spam classifier with a message that is not spam and moves it back to INBOX if it was in the Junk folder",
+	},
+	"web.(*EmailHandler).HandleMarkRead": {
+		Summary: "Marks an email as read",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"web.(*EmailHandler).HandleMarkSpam": {
+		Summary: "Trains the spam classifier with a message and moves it to the Junk folder",
+	},
+	"web.(*EmailHandler).HandleMarkUnread": {
+		Summary: "Marks an email as unread",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"web.(*EmailHandler).HandleMoveEmail": {
+		Summary: "Moves an email to another folder",
+		Query:   []openAPIParam{{"folder", "string"}},
+		Body:    "json",
+	},
+	"web.(*EmailHandler).HandleMuteThread": {
+		Summary: "Mutes a cached thread: new replies to it are archived without a notification until it is unmuted",
+	},
+	"web.(*EmailHandler).HandleSuggest": {
+		Summary:     "Returns short reply suggestions for the message named in the route, or with kind=summary a summary of its conversation",
+		Description: "HandleSuggest returns short reply suggestions for the message named in the route, or with kind=summary a summary of its conversation. Earlier messages of the conversation found in the same folder are sent along.",
+		Query:       []openAPIParam{{"folder", "string"}, {"kind", "string"}},
+	},
+	"web.(*EmailHandler).HandleThread": {
+		Summary:     "Returns the reply tree of a single cached thread as JSON",
+		Description: "HandleThread returns the reply tree of a single cached thread as JSON. Message bodies are left out unless their UID is listed in ?expand=, so the threaded inbox only fetches the messages a user opens.",
+		Query:       []openAPIParam{{"folder", "string"}, {"expand", "string"}},
+	},
+	"web.(*EmailHandler).HandleThreadPDF": {
+		Summary: "Exports every message of a thread, oldest first, as one PDF download",
+		Query:   []openAPIParam{{"folder", "string"}},
+	},
+	"web.(*EmailHandler).HandleUnmuteThread": {
+		Summary: "Unmutes a cached thread",
+	},
+	"web.(*EmailHandler).HandleValidateRecipients": {
+		Summary: "Checks compose recipients before sending: their syntax, domains one typo away from a contact's or a common provider's, and optionally whether their domains can receive mail",
+		Body:    "json",
+	},
+	"web.(*ReplyHandler).HandleComposeInit": {
+		Summary: "Returns the defaults a new compose window opens with",
+	},
+	"web.(*ReplyHandler).HandleForward": {
+		Summary: "Prepares the compose modal with forward data",
+	},
+	"web.(*ReplyHandler).HandleMailto": {
+		Summary: "Prepares the compose modal with the fields of a mailto: link",
+		Query:   []openAPIParam{{"url", "string"}},
+	},
+	"web.(*ReplyHandler).HandleReply": {
+		Summary: "Prepares the compose modal with reply data",
+	},
+	"web.(*ReplyHandler).HandleReplyAll": {
+		Summary: "Prepares the compose modal with reply-all data",
+	},
+	"web.(*SettingsHandler).ShowSettings": {
+		Summary: "Renders the settings page",
+	},
+	"web.(*SettingsHandler).UpdateGeneralSettings": {
+		Summary: "Updates general user settings",
+	},
+}
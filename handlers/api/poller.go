@@ -0,0 +1,237 @@
+package api
+
+import (
+	"lilmail/config"
+	"lilmail/utils"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+const (
+	// pollerLifetime matches the session lifetime; a poller nobody renews stops after it
+	pollerLifetime = 24 * time.Hour
+	// maxNewMailNotifications caps per-message notifications for a single poll
+	maxNewMailNotifications = 5
+)
+
+// pollWorker polls one user's INBOX
+type pollWorker struct {
+	creds   *Credentials
+	expires time.Time
+	stop    chan struct{}
+}
+
+// MailPoller checks the INBOX of logged in users for new mail in the
+// background and sends new_email notifications to their open sessions
+type MailPoller struct {
+	store    *session.Store
+	config   *config.Config
+	notify   *NotificationHandler
+	idle     *IdleManager
+	rules    *LabelRules
+	mutes    *ThreadMutes
+	spam     *SpamFilter
+	interval time.Duration
+	workers  map[string]*pollWorker
+	mu       sync.Mutex
+}
+
+// NewMailPoller creates a new mail poller
+func NewMailPoller(store *session.Store, cfg *config.Config, notify *NotificationHandler, idle *IdleManager) *MailPoller {
+	return &MailPoller{
+		store:    store,
+		config:   cfg,
+		notify:   notify,
+		idle:     idle,
+		interval: time.Duration(cfg.Notifications.PollInterval) * time.Second,
+		workers:  make(map[string]*pollWorker),
+	}
+}
+
+// SetLabelRules applies auto-labeling rules to new mail found by the poller
+func (p *MailPoller) SetLabelRules(rules *LabelRules) {
+	p.rules = rules
+}
+
+// SetThreadMutes archives new replies to muted threads found by the poller
+// instead of notifying about them
+func (p *MailPoller) SetThreadMutes(mutes *ThreadMutes) {
+	p.mutes = mutes
+}
+
+// SetSpamFilter moves new mail found by the poller that the user's spam
+// classifier is confident about to the Junk folder
+func (p *MailPoller) SetSpamFilter(spam *SpamFilter) {
+	p.spam = spam
+}
+
+// Start begins polling for a user. If a poller is already running its
+// credentials and lifetime are renewed.
+func (p *MailPoller) Start(username string, creds *Credentials) {
+	if p.interval <= 0 || username == "" || creds == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if w, ok := p.workers[username]; ok {
+		w.creds = creds
+		w.expires = time.Now().Add(pollerLifetime)
+		return
+	}
+
+	w := &pollWorker{
+		creds:   creds,
+		expires: time.Now().Add(pollerLifetime),
+		stop:    make(chan struct{}),
+	}
+	p.workers[username] = w
+	go p.run(username, w)
+
+	utils.Log.Info("Started mail poller for %s (every %s)", username, p.interval)
+}
+
+// Stop stops polling for a user
+func (p *MailPoller) Stop(username string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if w, ok := p.workers[username]; ok {
+		close(w.stop)
+		delete(p.workers, username)
+		utils.Log.Info("Stopped mail poller for %s", username)
+	}
+}
+
+// EnsureStarted is a handler that starts polling for the session's user if it
+// isn't running yet, e.g. after a server restart
+func (p *MailPoller) EnsureStarted(c *fiber.Ctx) error {
+	if p.interval > 0 {
+		if creds, err := GetCredentials(c, p.store, p.config.Encryption.Key); err == nil {
+			p.Start(GetSessionUser(c), creds)
+		}
+	}
+	return c.Next()
+}
+
+// run polls until the worker is stopped or expires
+func (p *MailPoller) run(username string, w *pollWorker) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	var lastUIDNext, lastValidity uint32
+
+	for {
+		p.mu.Lock()
+		creds, expired := w.creds, time.Now().After(w.expires)
+		p.mu.Unlock()
+
+		if expired {
+			p.mu.Lock()
+			if p.workers[username] == w {
+				delete(p.workers, username)
+			}
+			p.mu.Unlock()
+			utils.Log.Info("Mail poller for %s expired", username)
+			return
+		}
+
+		if p.idle.IsActive(username) {
+			// IDLE is pushing new mail; start from a fresh baseline afterwards
+			lastUIDNext, lastValidity = 0, 0
+		} else if p.idle.AcquireConn(username) {
+			uidNext, validity, err := p.poll(username, creds, lastUIDNext, lastValidity)
+			p.idle.ReleaseConn(username)
+			if err != nil {
+				utils.Log.Warn("Mail poll failed for %s: %v", username, err)
+			} else {
+				lastUIDNext, lastValidity = uidNext, validity
+			}
+		}
+
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll checks INBOX UIDNEXT and notifies about messages that arrived since
+// the previous poll. The first poll only records the baseline.
+func (p *MailPoller) poll(username string, creds *Credentials, lastUIDNext, lastValidity uint32) (uint32, uint32, error) {
+	client, err := NewMailClient(creds, p.config)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer client.Close()
+
+	status, err := client.MailboxStatus("INBOX")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Keep sidebar badges in sync with read/unread changes made elsewhere
+	if err := notifyUnreadCounts(client, p.notify, username); err != nil {
+		utils.Log.Warn("Failed to get unread counts for %s: %v", username, err)
+	}
+
+	// Nothing to compare against yet, or the mailbox was recreated
+	if lastUIDNext == 0 || status.UidValidity != lastValidity || status.UidNext <= lastUIDNext {
+		return status.UidNext, status.UidValidity, nil
+	}
+
+	if _, err := notifyNewMessages(client, p.notify, p.rules, p.mutes, p.spam, username, creds.Email, lastUIDNext); err != nil {
+		return 0, 0, err
+	}
+
+	return status.UidNext, status.UidValidity, nil
+}
+
+// notifyNewMessages applies label rules to INBOX messages with a UID of at
+// least uidNext, junks or deletes mail from blocked senders, moves spam to
+// Junk, archives replies to muted threads, sends new_email notifications for
+// the rest and returns the UIDNEXT to use for the next check. account is the
+// address of the account client is signed in to.
+func notifyNewMessages(client MailClient, notify *NotificationHandler, rules *LabelRules, mutes *ThreadMutes, spam *SpamFilter, username, account string, uidNext uint32) (uint32, error) {
+	if uidNext == 0 {
+		uidNext = 1
+	}
+
+	emails, err := client.FetchNewMessages("INBOX", uidNext-1)
+	if err != nil {
+		return uidNext, err
+	}
+
+	rules.Apply(username, account, "INBOX", emails)
+
+	for _, email := range emails {
+		if uid, err := parseUID(email.ID); err == nil && uid >= uidNext {
+			uidNext = uid + 1
+		}
+	}
+
+	emails = spam.Filter(client, username, emails)
+	for i, email := range mutes.Archive(client, username, emails) {
+		if i >= maxNewMailNotifications {
+			break
+		}
+		notify.NotifyNewEmail(username, "INBOX", email)
+	}
+
+	return uidNext, nil
+}
+
+// notifyUnreadCounts sends the user's per-folder unread counts if they changed
+func notifyUnreadCounts(client MailClient, notify *NotificationHandler, username string) error {
+	counts, err := client.UnreadCounts()
+	if err != nil {
+		return err
+	}
+	notify.NotifyUnreadCounts(username, counts)
+	return nil
+}
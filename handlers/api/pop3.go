@@ -0,0 +1,150 @@
+package api
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pop3Timeout bounds each exchange with a POP3 server
+const pop3Timeout = 60 * time.Second
+
+// pop3Conn is a connection to a POP3 server (RFC 1939)
+type pop3Conn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// dialPOP3 connects to a POP3 server. Port 995 (the default) speaks TLS
+// from the start; other ports must offer STLS, since the password would
+// otherwise be sent in the clear.
+func dialPOP3(server string, port int) (*pop3Conn, error) {
+	if port == 0 {
+		port = 995
+	}
+	addr := net.JoinHostPort(server, strconv.Itoa(port))
+	// POP3 servers are chosen by users
+	dialer := accountDialer(pop3Timeout)
+
+	var conn net.Conn
+	var err error
+	if port == 995 {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: server})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to POP3 server: %v", err)
+	}
+
+	c := &pop3Conn{conn: conn, text: textproto.NewConn(conn)}
+	if _, err := c.response(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	if port != 995 {
+		if _, err := c.cmd("STLS"); err != nil {
+			c.conn.Close()
+			return nil, fmt.Errorf("POP3 server does not support STLS: %v", err)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: server})
+		c.conn = tlsConn
+		c.text = textproto.NewConn(tlsConn)
+	}
+	return c, nil
+}
+
+// response reads a status line and returns the text after +OK
+func (c *pop3Conn) response() (string, error) {
+	c.conn.SetDeadline(time.Now().Add(pop3Timeout))
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", fmt.Errorf("error reading POP3 response: %v", err)
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	}
+	return "", fmt.Errorf("POP3 server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+}
+
+// cmd sends a command and returns its status line
+func (c *pop3Conn) cmd(format string, args ...interface{}) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(pop3Timeout))
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", fmt.Errorf("error sending POP3 command: %v", err)
+	}
+	return c.response()
+}
+
+// login authenticates with USER and PASS
+func (c *pop3Conn) login(username, password string) error {
+	if _, err := c.cmd("USER %s", username); err != nil {
+		return err
+	}
+	if _, err := c.cmd("PASS %s", password); err != nil {
+		return errors.New("POP3 login failed")
+	}
+	return nil
+}
+
+// uidl returns the unique id of every message, by message number
+func (c *pop3Conn) uidl() (map[int]string, error) {
+	if _, err := c.cmd("UIDL"); err != nil {
+		return nil, err
+	}
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		return nil, fmt.Errorf("error reading UIDL: %v", err)
+	}
+
+	ids := make(map[int]string, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.Atoi(fields[0]); err == nil {
+			ids[n] = fields[1]
+		}
+	}
+	return ids, nil
+}
+
+// retr downloads a message, at most limit bytes of it
+func (c *pop3Conn) retr(n int, limit int64) ([]byte, error) {
+	if _, err := c.cmd("RETR %d", n); err != nil {
+		return nil, err
+	}
+	// Raise the deadline, large messages take a while
+	c.conn.SetDeadline(time.Now().Add(10 * pop3Timeout))
+	r := c.text.DotReader()
+	raw, err := io.ReadAll(io.LimitReader(r, limit))
+	if err != nil {
+		return nil, fmt.Errorf("error downloading message %d: %v", n, err)
+	}
+	// Drain whatever is over the limit so the connection stays in sync
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, fmt.Errorf("error downloading message %d: %v", n, err)
+	}
+	return raw, nil
+}
+
+// dele marks a message for deletion when the session ends
+func (c *pop3Conn) dele(n int) error {
+	_, err := c.cmd("DELE %d", n)
+	return err
+}
+
+// quit ends the session, which commits deletions
+func (c *pop3Conn) quit() error {
+	_, err := c.cmd("QUIT")
+	c.conn.Close()
+	return err
+}
@@ -0,0 +1,685 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"lilmail/models"
+	"lilmail/utils"
+	"net/mail"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// pop3Delimiter separates the levels of a local folder path
+const pop3Delimiter = "/"
+
+// pop3FetchInterval is how often new mail is downloaded at most. Clients
+// are created per request, so this keeps page loads from each logging in.
+const pop3FetchInterval = 30 * time.Second
+
+// pop3MaxMessageSize caps the size of a downloaded message
+const pop3MaxMessageSize = 64 << 20
+
+// pop3FolderAttrs are the SPECIAL-USE attributes of the default folders
+var pop3FolderAttrs = map[string]string{
+	"Archive": imap.ArchiveAttr,
+	"Drafts":  imap.DraftsAttr,
+	"Junk":    imap.JunkAttr,
+	"Sent":    imap.SentAttr,
+	"Trash":   imap.TrashAttr,
+}
+
+// POP3Client reads a POP3 account. New mail is downloaded into a local
+// store, and removed from the server unless it is left there; everything
+// else, folders included, works on the store.
+type POP3Client struct {
+	server        string
+	port          int
+	username      string
+	password      string
+	leaveOnServer bool
+	store         *pop3Store
+}
+
+// NewPOP3Client opens the local store of a POP3 account and downloads new
+// mail into it. If the server can't be reached the stored mail can still
+// be read.
+func NewPOP3Client(server string, port int, username, password string, leaveOnServer bool, cacheFolder string) (*POP3Client, error) {
+	if server == "" || username == "" {
+		return nil, fmt.Errorf("POP3 server and username are required")
+	}
+
+	// Not in the user's cache folder, which is cleared on logout
+	key := sha256.Sum256([]byte(server + "\x00" + username))
+	c := &POP3Client{
+		server:        server,
+		port:          port,
+		username:      username,
+		password:      password,
+		leaveOnServer: leaveOnServer,
+		store:         loadPOP3Store(filepath.Join(cacheFolder, "pop3", hex.EncodeToString(key[:])[:32])),
+	}
+
+	if err := c.fetch(); err != nil {
+		utils.Log.Warn("Failed to download mail from %s for %s: %v", server, username, err)
+	}
+	return c, nil
+}
+
+// checkPOP3Login checks that a POP3 login works, without downloading
+func checkPOP3Login(server string, port int, username, password string) error {
+	conn, err := dialPOP3(server, port)
+	if err != nil {
+		return err
+	}
+	defer conn.quit()
+	return conn.login(username, password)
+}
+
+// fetch downloads the messages the store doesn't have yet into INBOX
+func (c *POP3Client) fetch() error {
+	s := c.store
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+	if time.Since(s.lastFetch) < pop3FetchInterval {
+		return nil
+	}
+	// Failed attempts wait too, so a bad login isn't retried on every request
+	defer func() { s.lastFetch = time.Now() }()
+
+	conn, err := dialPOP3(c.server, c.port)
+	if err != nil {
+		return err
+	}
+	defer conn.quit()
+	if err := conn.login(c.username, c.password); err != nil {
+		return err
+	}
+	ids, err := conn.uidl()
+	if err != nil {
+		return fmt.Errorf("POP3 server does not support UIDL: %v", err)
+	}
+
+	numbers := make([]int, 0, len(ids))
+	for n := range ids {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	onServer := make(map[string]bool, len(ids))
+	for _, n := range numbers {
+		uidl := ids[n]
+		onServer[uidl] = true
+
+		s.mu.Lock()
+		downloaded := s.Downloaded[uidl]
+		s.mu.Unlock()
+		if !downloaded {
+			raw, err := conn.retr(n, pop3MaxMessageSize)
+			if err != nil {
+				return err
+			}
+			if _, err := s.add(raw, "INBOX", nil); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			s.Downloaded[uidl] = true
+			s.dirty = true
+			s.mu.Unlock()
+		}
+
+		// Deleted when the session ends. Messages downloaded before are
+		// deleted again in case that session failed to end.
+		if !c.leaveOnServer {
+			if err := conn.dele(n); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Forget messages the server no longer has
+	s.mu.Lock()
+	for uidl := range s.Downloaded {
+		if !onServer[uidl] {
+			delete(s.Downloaded, uidl)
+			s.dirty = true
+		}
+	}
+	s.mu.Unlock()
+
+	// Saved before QUIT deletes the messages from the server
+	return s.save()
+}
+
+// Close saves the store's index
+func (c *POP3Client) Close() error {
+	return c.store.save()
+}
+
+// folder checks that a folder exists
+func (c *POP3Client) folder(folderName string) (string, error) {
+	if strings.EqualFold(folderName, "INBOX") {
+		return "INBOX", nil
+	}
+	if !c.store.hasFolder(folderName) {
+		return "", fmt.Errorf("folder %s not found", folderName)
+	}
+	return folderName, nil
+}
+
+// FetchFolders retrieves all mailbox folders
+func (c *POP3Client) FetchFolders() ([]*MailboxInfo, error) {
+	var folders []*MailboxInfo
+	for _, name := range c.store.folders() {
+		folder := &MailboxInfo{
+			Name:       name,
+			Delimiter:  pop3Delimiter,
+			Attributes: []string{},
+		}
+		if attr, ok := pop3FolderAttrs[name]; ok {
+			folder.Attributes = append(folder.Attributes, attr)
+		}
+		folders = append(folders, folder)
+	}
+	return folders, nil
+}
+
+// hasFlag reports whether flags contains flag
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// unseen counts the messages without \Seen
+func unseen(messages []pop3Message) uint32 {
+	var count uint32
+	for _, msg := range messages {
+		if !hasFlag(msg.Flags, imap.SeenFlag) {
+			count++
+		}
+	}
+	return count
+}
+
+// MailboxStatus returns the status of a folder
+func (c *POP3Client) MailboxStatus(folderName string) (*imap.MailboxStatus, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := c.store.list(folder)
+	validity, next, _ := c.store.status()
+	status := imap.NewMailboxStatus(folderName, []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity, imap.StatusUnseen})
+	status.Messages = uint32(len(messages))
+	status.Unseen = unseen(messages)
+	status.UidNext = next
+	status.UidValidity = validity
+	return status, nil
+}
+
+// MailboxState returns the change markers of a folder. The modseq changes
+// whenever any message in the store does.
+func (c *POP3Client) MailboxState(folderName string) (*models.MailboxState, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+
+	validity, next, modseq := c.store.status()
+	return &models.MailboxState{
+		UIDValidity:   validity,
+		UIDNext:       next,
+		HighestModSeq: modseq,
+		Messages:      uint32(len(c.store.list(folder))),
+	}, nil
+}
+
+// UnreadCounts returns the number of unseen messages in every folder
+func (c *POP3Client) UnreadCounts() (map[string]uint32, error) {
+	counts := make(map[string]uint32)
+	for _, folder := range c.store.folders() {
+		counts[folder] = unseen(c.store.list(folder))
+	}
+	return counts, nil
+}
+
+// FolderUsage returns the size of a folder in the local store. Attachments
+// aren't counted apart, as that would mean parsing every message.
+func (c *POP3Client) FolderUsage(folderName string) (*models.FolderUsage, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := c.store.list(folder)
+	usage := &models.FolderUsage{Folder: folderName, Messages: uint32(len(messages)), Unseen: unseen(messages)}
+	sizes := make(map[uint32]int64, len(messages))
+	for _, msg := range messages {
+		sizes[msg.UID] = int64(msg.Size)
+		usage.Bytes += int64(msg.Size)
+	}
+	usage.Largest = largestMessages(folderName, sizes)
+	return usage, nil
+}
+
+// CreateFolder creates a new local folder
+func (c *POP3Client) CreateFolder(folderName string) error {
+	return c.store.createFolder(folderName)
+}
+
+// RenameFolder renames a local folder
+func (c *POP3Client) RenameFolder(oldName, newName string) error {
+	return c.store.renameFolder(oldName, newName)
+}
+
+// DeleteFolder deletes a local folder along with its messages
+func (c *POP3Client) DeleteFolder(folderName string) error {
+	return c.store.deleteFolder(folderName)
+}
+
+// ArchiveFolder returns the "Archive" folder, created if needed
+func (c *POP3Client) ArchiveFolder() (string, error) {
+	if !c.store.hasFolder("Archive") {
+		if err := c.store.createFolder("Archive"); err != nil {
+			return "", fmt.Errorf("error creating Archive folder: %v", err)
+		}
+	}
+	return "Archive", nil
+}
+
+// toEmails parses stored messages, skipping any that can't be read
+func (c *POP3Client) toEmails(messages []pop3Message, folder string) []models.Email {
+	emails := make([]models.Email, 0, len(messages))
+	for _, msg := range messages {
+		raw, err := c.store.raw(msg.UID)
+		if err != nil {
+			utils.Log.Warn("Failed to read stored message %d: %v", msg.UID, err)
+			continue
+		}
+		email, err := parseRawEmail(raw, msg.UID, folder, msg.Flags, msg.Date)
+		if err != nil {
+			utils.Log.Warn("Failed to parse stored message %d: %v", msg.UID, err)
+			continue
+		}
+		emails = append(emails, email)
+	}
+	return emails
+}
+
+// FetchMessages retrieves the newest messages of a folder
+func (c *POP3Client) FetchMessages(folderName string, limit uint32) ([]models.Email, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	messages := c.store.list(folder)
+	if uint32(len(messages)) > limit {
+		messages = messages[uint32(len(messages))-limit:]
+	}
+	return c.toEmails(messages, folder), nil
+}
+
+// FetchMessagesPaginated retrieves messages with pagination support,
+// newest first like the IMAP client
+func (c *POP3Client) FetchMessagesPaginated(folderName string, page, pageSize uint32) (*models.PaginatedEmails, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	messages := c.store.list(folder)
+	total := uint32(len(messages))
+	if total == 0 {
+		return models.NewPaginatedEmails([]models.Email{}, page, pageSize, 0), nil
+	}
+
+	totalPages := (total + pageSize - 1) / pageSize
+	if page < 1 {
+		page = 1
+	}
+	if page > totalPages {
+		page = totalPages
+	}
+	end := total - (page-1)*pageSize
+	start := uint32(0)
+	if end > pageSize {
+		start = end - pageSize
+	}
+
+	return models.NewPaginatedEmails(c.toEmails(messages[start:end], folder), page, pageSize, total), nil
+}
+
+// FetchThreads retrieves enough recent messages to fill the given page of
+// threads and organizes them into threads. The returned bool is true when
+// the whole folder was fetched.
+func (c *POP3Client) FetchThreads(folderName string, page, pageSize uint32) ([]*models.EmailThread, bool, error) {
+	limit := page * pageSize * threadWindowFactor
+
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, false, err
+	}
+	messages := c.store.list(folder)
+	complete := uint32(len(messages)) <= limit
+	if !complete {
+		messages = messages[uint32(len(messages))-limit:]
+	}
+	return threadEmails(c.toEmails(messages, folder)), complete, nil
+}
+
+// FetchSingleMessage retrieves a single message by UID
+func (c *POP3Client) FetchSingleMessage(folderName, uid string) (models.Email, error) {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return models.Email{}, fmt.Errorf("invalid UID: %v", err)
+	}
+	emails, err := c.FetchMessagesByUIDs(folderName, []uint32{uidNum})
+	if err != nil {
+		return models.Email{}, err
+	}
+	if len(emails) == 0 {
+		return models.Email{}, fmt.Errorf("message not found")
+	}
+	return emails[0], nil
+}
+
+// FetchMessagesByUIDs retrieves messages for a specific list of UIDs
+func (c *POP3Client) FetchMessagesByUIDs(folderName string, uids []uint32) ([]models.Email, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	var messages []pop3Message
+	for _, uid := range uids {
+		if msg, ok := c.store.message(folder, uid); ok {
+			messages = append(messages, msg)
+		}
+	}
+	return c.toEmails(messages, folder), nil
+}
+
+// since returns the messages of a folder with a UID of at least fromUID
+func (c *POP3Client) since(folderName string, fromUID uint32) ([]pop3Message, string, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, "", err
+	}
+	messages := c.store.list(folder)
+	i := sort.Search(len(messages), func(i int) bool { return messages[i].UID >= fromUID })
+	return messages[i:], folder, nil
+}
+
+// FetchNewMessages retrieves messages with a UID greater than sinceUID
+func (c *POP3Client) FetchNewMessages(folderName string, sinceUID uint32) ([]models.Email, error) {
+	messages, folder, err := c.since(folderName, sinceUID+1)
+	if err != nil {
+		return nil, err
+	}
+	return c.toEmails(messages, folder), nil
+}
+
+// FetchFlags retrieves the flags of every message with a UID of at least fromUID
+func (c *POP3Client) FetchFlags(folderName string, fromUID uint32) (map[uint32][]string, error) {
+	messages, _, err := c.since(folderName, fromUID)
+	if err != nil {
+		return nil, err
+	}
+	flags := make(map[uint32][]string, len(messages))
+	for _, msg := range messages {
+		flags[msg.UID] = msg.Flags
+	}
+	return flags, nil
+}
+
+// header reads the header of a stored message
+func (c *POP3Client) header(uid uint32) (mail.Header, error) {
+	raw, err := c.store.raw(uid)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
+
+// FetchMessageIDs returns the Message-ID of each of the given UIDs
+func (c *POP3Client) FetchMessageIDs(folderName string, uids []uint32) (map[uint32]string, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[uint32]string)
+	for _, uid := range uids {
+		if _, ok := c.store.message(folder, uid); !ok {
+			continue
+		}
+		if header, err := c.header(uid); err == nil && header.Get("Message-Id") != "" {
+			ids[uid] = header.Get("Message-Id")
+		}
+	}
+	return ids, nil
+}
+
+// FindUIDByMessageID returns the UID of the message with the given
+// Message-ID, or 0 if the folder has no such message
+func (c *POP3Client) FindUIDByMessageID(folderName, messageID string) (uint32, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range c.store.list(folder) {
+		header, err := c.header(msg.UID)
+		if err != nil {
+			continue
+		}
+		if ids := parseMessageIDs(header.Get("Message-Id")); len(ids) > 0 && ids[0] == messageID {
+			return msg.UID, nil
+		}
+	}
+	return 0, nil
+}
+
+// SearchUIDs returns the UIDs of the messages in a folder matching criteria
+func (c *POP3Client) SearchUIDs(folderName string, criteria *imap.SearchCriteria) ([]uint32, error) {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, msg := range c.store.list(folder) {
+		raw, err := c.store.raw(msg.UID)
+		if err != nil {
+			continue
+		}
+		if matchesCriteria(criteria, newLocalMessage(msg, raw)) {
+			uids = append(uids, msg.UID)
+		}
+	}
+	return uids, nil
+}
+
+// FetchHeaders returns the full headers and MIME structure of a message
+func (c *POP3Client) FetchHeaders(folderName, uid string) (*models.MessageHeaders, error) {
+	raw, err := c.rawMessage(folderName, uid)
+	if err != nil {
+		return nil, err
+	}
+	return rawHeaders(raw)
+}
+
+// rawMessage reads a message of a folder
+func (c *POP3Client) rawMessage(folderName, uid string) ([]byte, error) {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID: %v", err)
+	}
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.store.message(folder, uidNum); !ok {
+		return nil, fmt.Errorf("message not found")
+	}
+	return c.store.raw(uidNum)
+}
+
+// fetchPart returns the part of a message chosen by pick
+func (c *POP3Client) fetchPart(folderName, uid string, pick func([]rawPart, map[string]rawPart) (rawPart, bool)) (*models.Attachment, error) {
+	raw, err := c.rawMessage(folderName, uid)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing message: %v", err)
+	}
+
+	part, ok := pick(rawAttachmentParts(rawMessageParts(msg)))
+	if !ok {
+		return nil, fmt.Errorf("attachment not found")
+	}
+	content, err := part.content()
+	if err != nil {
+		return nil, fmt.Errorf("error reading attachment content: %v", err)
+	}
+	return &models.Attachment{
+		Filename:    part.filename(),
+		ContentType: part.mediaType,
+		Part:        partName(part.path),
+		Size:        len(content),
+		Content:     content,
+	}, nil
+}
+
+// FetchAttachment returns the content of the index-th attachment of a message
+func (c *POP3Client) FetchAttachment(folderName, uid string, index int) (*models.Attachment, error) {
+	return c.fetchPart(folderName, uid, func(parts []rawPart, _ map[string]rawPart) (rawPart, bool) {
+		if index < 0 || index >= len(parts) {
+			return rawPart{}, false
+		}
+		return parts[index], true
+	})
+}
+
+// FetchInlinePart returns the content of the inline part a cid: URL in the
+// message's HTML refers to
+func (c *POP3Client) FetchInlinePart(folderName, uid, contentID string) (*models.Attachment, error) {
+	return c.fetchPart(folderName, uid, func(_ []rawPart, inline map[string]rawPart) (rawPart, bool) {
+		part, ok := inline[normalizeContentID(contentID)]
+		return part, ok
+	})
+}
+
+// SetFlags adds flags to a message, or removes them when add is false
+func (c *POP3Client) SetFlags(folderName, uid string, flags []string, add bool) error {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return fmt.Errorf("invalid UID: %v", err)
+	}
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return err
+	}
+	return c.store.update(folder, uidNum, func(msg *pop3Message) {
+		kept := []string{}
+	next:
+		for _, f := range msg.Flags {
+			for _, flag := range flags {
+				if strings.EqualFold(f, flag) {
+					continue next
+				}
+			}
+			kept = append(kept, f)
+		}
+		if add {
+			kept = append(kept, flags...)
+		}
+		msg.Flags = kept
+	})
+}
+
+// MarkMessageAsRead marks a message as read
+func (c *POP3Client) MarkMessageAsRead(folderName, uid string) error {
+	return c.SetFlags(folderName, uid, []string{imap.SeenFlag}, true)
+}
+
+// MarkMessageAsUnread marks a message as unread
+func (c *POP3Client) MarkMessageAsUnread(folderName, uid string) error {
+	return c.SetFlags(folderName, uid, []string{imap.SeenFlag}, false)
+}
+
+// AppendMessage stores a raw message in a folder with the given flags
+func (c *POP3Client) AppendMessage(folderName string, message []byte, flags []string) error {
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return err
+	}
+	_, err = c.store.add(message, folder, flags)
+	return err
+}
+
+// MoveMessage moves a message from one folder to another
+func (c *POP3Client) MoveMessage(sourceFolder, targetFolder, uid string) error {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return fmt.Errorf("invalid UID: %v", err)
+	}
+	source, err := c.folder(sourceFolder)
+	if err != nil {
+		return err
+	}
+	target, err := c.folder(targetFolder)
+	if err != nil {
+		return err
+	}
+	return c.store.update(source, uidNum, func(msg *pop3Message) {
+		msg.Folder = target
+	})
+}
+
+// DeleteMessage deletes a message from the store. A message left on the
+// server is not downloaded again.
+func (c *POP3Client) DeleteMessage(folderName, uid string) error {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return fmt.Errorf("invalid UID: %v", err)
+	}
+	folder, err := c.folder(folderName)
+	if err != nil {
+		return err
+	}
+	return c.store.remove(folder, uidNum)
+}
+
+// SaveToSent stores a copy of a sent message in the Sent folder
+func (c *POP3Client) SaveToSent(to, subject, body string) error {
+	if !c.store.hasFolder("Sent") {
+		if err := c.store.createFolder("Sent"); err != nil {
+			return err
+		}
+	}
+
+	message := fmt.Sprintf("From: %s\r\n"+
+		"To: %s\r\n"+
+		"Subject: %s\r\n"+
+		"Date: %s\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n"+
+		"\r\n"+
+		"%s", c.username, to, subject,
+		time.Now().Format(time.RFC1123Z), body)
+
+	_, err := c.store.add([]byte(message), "Sent", []string{imap.SeenFlag})
+	return err
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bytes"
+	"lilmail/utils"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// localMessage is a stored message being matched against search criteria.
+// Its text is only parsed when a criterion needs it.
+type localMessage struct {
+	meta   pop3Message
+	raw    []byte
+	header mail.Header
+	body   *string
+}
+
+func newLocalMessage(meta pop3Message, raw []byte) *localMessage {
+	m := &localMessage{meta: meta, raw: raw, header: mail.Header{}}
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		m.header = msg.Header
+	}
+	return m
+}
+
+// text returns the message's body text, lowercased
+func (m *localMessage) text() string {
+	if m.body == nil {
+		email, _ := parseRawEmail(m.raw, m.meta.UID, m.meta.Folder, nil, m.meta.Date)
+		text := strings.ToLower(email.Body + "\n" + stripHTML(string(email.HTML)))
+		m.body = &text
+	}
+	return *m.body
+}
+
+// containsFold reports whether s contains substr, ignoring case
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// headerMatches implements HEADER: an empty value matches any message
+// that has the field
+func (m *localMessage) headerMatches(key, value string) bool {
+	// mail.Header keys are canonical MIME keys
+	values := m.header[textproto.CanonicalMIMEHeaderKey(key)]
+	for _, v := range values {
+		if value == "" || containsFold(utils.DecodeHeader(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrAfterDay and beforeDay compare dates the way IMAP SEARCH does,
+// ignoring the time of day
+func sameOrAfterDay(t, day time.Time) bool {
+	y, mo, d := day.Date()
+	return !t.Before(time.Date(y, mo, d, 0, 0, 0, 0, day.Location()))
+}
+
+func beforeDay(t, day time.Time) bool {
+	y, mo, d := day.Date()
+	return t.Before(time.Date(y, mo, d, 0, 0, 0, 0, day.Location()))
+}
+
+// matchesCriteria evaluates IMAP search criteria against a stored message
+func matchesCriteria(criteria *imap.SearchCriteria, m *localMessage) bool {
+	if criteria.Uid != nil && !criteria.Uid.Contains(m.meta.UID) {
+		return false
+	}
+
+	if !criteria.Since.IsZero() && !sameOrAfterDay(m.meta.Date, criteria.Since) {
+		return false
+	}
+	if !criteria.Before.IsZero() && !beforeDay(m.meta.Date, criteria.Before) {
+		return false
+	}
+	if !criteria.SentSince.IsZero() || !criteria.SentBefore.IsZero() {
+		sent, err := m.header.Date()
+		if err != nil {
+			return false
+		}
+		if !criteria.SentSince.IsZero() && !sameOrAfterDay(sent, criteria.SentSince) {
+			return false
+		}
+		if !criteria.SentBefore.IsZero() && !beforeDay(sent, criteria.SentBefore) {
+			return false
+		}
+	}
+
+	for key, values := range criteria.Header {
+		for _, value := range values {
+			if !m.headerMatches(key, value) {
+				return false
+			}
+		}
+	}
+	for _, value := range criteria.Body {
+		if !strings.Contains(m.text(), strings.ToLower(value)) {
+			return false
+		}
+	}
+	for _, value := range criteria.Text {
+		inHeader := false
+		for _, values := range m.header {
+			for _, v := range values {
+				if containsFold(utils.DecodeHeader(v), value) {
+					inHeader = true
+				}
+			}
+		}
+		if !inHeader && !strings.Contains(m.text(), strings.ToLower(value)) {
+			return false
+		}
+	}
+
+	for _, flag := range criteria.WithFlags {
+		if !hasFlag(m.meta.Flags, flag) {
+			return false
+		}
+	}
+	for _, flag := range criteria.WithoutFlags {
+		if hasFlag(m.meta.Flags, flag) {
+			return false
+		}
+	}
+	if criteria.Larger > 0 && uint32(m.meta.Size) <= criteria.Larger {
+		return false
+	}
+	if criteria.Smaller > 0 && uint32(m.meta.Size) >= criteria.Smaller {
+		return false
+	}
+
+	for _, not := range criteria.Not {
+		if matchesCriteria(not, m) {
+			return false
+		}
+	}
+	for _, or := range criteria.Or {
+		if !matchesCriteria(or[0], m) && !matchesCriteria(or[1], m) {
+			return false
+		}
+	}
+	return true
+}
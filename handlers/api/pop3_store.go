@@ -0,0 +1,295 @@
+package api
+
+import (
+	"fmt"
+	"lilmail/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pop3Stores holds the local store of each POP3 account, shared by its
+// clients
+var pop3Stores sync.Map
+
+// pop3DefaultFolders are the folders a new store starts with
+var pop3DefaultFolders = []string{"INBOX", "Sent", "Drafts", "Trash"}
+
+// pop3Message is a message kept in a local store. Its raw text is in a
+// file named after its UID.
+type pop3Message struct {
+	UID    uint32    `json:"uid"`
+	Folder string    `json:"folder"`
+	Flags  []string  `json:"flags"`
+	Date   time.Time `json:"date"` // When it was downloaded
+	Size   int       `json:"size"`
+}
+
+// pop3Store keeps the mail downloaded from a POP3 account. POP3 only has
+// an inbox, so folders, flags and UIDs all live here; UIDs are store-wide
+// and only grow. Downloaded records the UIDL of every message fetched that
+// the server may still have, so nothing is downloaded twice.
+type pop3Store struct {
+	mu  sync.Mutex
+	dir string
+	// dirty is set when the index changed since it was saved
+	dirty bool
+
+	// fetchMu serializes downloads; lastFetch is when the last one ended
+	fetchMu   sync.Mutex
+	lastFetch time.Time
+
+	Validity   uint32                  `json:"validity"`
+	Next       uint32                  `json:"next"`
+	ModSeq     uint64                  `json:"modseq"`
+	Folders    []string                `json:"folders"`
+	Messages   map[uint32]*pop3Message `json:"messages"`
+	Downloaded map[string]bool         `json:"downloaded"`
+}
+
+// loadPOP3Store returns the store kept in dir, loading its index from
+// disk the first time
+func loadPOP3Store(dir string) *pop3Store {
+	if s, ok := pop3Stores.Load(dir); ok {
+		return s.(*pop3Store)
+	}
+
+	s := &pop3Store{dir: dir}
+	if err := utils.LoadCache(filepath.Join(dir, "index.json"), s); err != nil || s.Validity == 0 {
+		s = &pop3Store{
+			dir:      dir,
+			Validity: uint32(time.Now().Unix()),
+			Next:     1,
+			ModSeq:   1,
+			Folders:  append([]string(nil), pop3DefaultFolders...),
+		}
+	}
+	if s.Messages == nil {
+		s.Messages = make(map[uint32]*pop3Message)
+	}
+	if s.Downloaded == nil {
+		s.Downloaded = make(map[string]bool)
+	}
+
+	actual, _ := pop3Stores.LoadOrStore(dir, s)
+	return actual.(*pop3Store)
+}
+
+func (s *pop3Store) messagePath(uid uint32) string {
+	return filepath.Join(s.dir, "messages", strconv.FormatUint(uint64(uid), 10)+".eml")
+}
+
+// save writes the index to disk if it changed
+func (s *pop3Store) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("error creating POP3 store: %v", err)
+	}
+	if err := utils.SaveCache(filepath.Join(s.dir, "index.json"), s); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// changed records a change, so folder caches see it
+func (s *pop3Store) changed() {
+	s.ModSeq++
+	s.dirty = true
+}
+
+// add stores a message in a folder
+func (s *pop3Store) add(raw []byte, folder string, flags []string) (*pop3Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Join(s.dir, "messages"), 0700); err != nil {
+		return nil, fmt.Errorf("error creating POP3 store: %v", err)
+	}
+	msg := &pop3Message{
+		UID:    s.Next,
+		Folder: folder,
+		Flags:  flags,
+		Date:   time.Now(),
+		Size:   len(raw),
+	}
+	if msg.Flags == nil {
+		msg.Flags = []string{}
+	}
+	if err := os.WriteFile(s.messagePath(msg.UID), raw, 0600); err != nil {
+		return nil, fmt.Errorf("error storing message: %v", err)
+	}
+
+	s.Next++
+	s.Messages[msg.UID] = msg
+	s.changed()
+	return msg, nil
+}
+
+// raw reads the text of a message
+func (s *pop3Store) raw(uid uint32) ([]byte, error) {
+	return os.ReadFile(s.messagePath(uid))
+}
+
+// message returns a copy of the message with a UID in folder
+func (s *pop3Store) message(folder string, uid uint32) (pop3Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg, ok := s.Messages[uid]
+	if !ok || msg.Folder != folder {
+		return pop3Message{}, false
+	}
+	return *msg, true
+}
+
+// list returns copies of the messages in a folder, by ascending UID
+func (s *pop3Store) list(folder string) []pop3Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var messages []pop3Message
+	for _, msg := range s.Messages {
+		if msg.Folder == folder {
+			messages = append(messages, *msg)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].UID < messages[j].UID })
+	return messages
+}
+
+// update applies change to the message with a UID in folder
+func (s *pop3Store) update(folder string, uid uint32, change func(*pop3Message)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg, ok := s.Messages[uid]
+	if !ok || msg.Folder != folder {
+		return fmt.Errorf("message not found")
+	}
+	change(msg)
+	s.changed()
+	return nil
+}
+
+// remove deletes the message with a UID in folder
+func (s *pop3Store) remove(folder string, uid uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg, ok := s.Messages[uid]
+	if !ok || msg.Folder != folder {
+		return fmt.Errorf("message not found")
+	}
+	delete(s.Messages, uid)
+	s.changed()
+	if err := os.Remove(s.messagePath(uid)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error deleting message: %v", err)
+	}
+	return nil
+}
+
+// hasFolder reports whether a folder exists
+func (s *pop3Store) hasFolder(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.folderIndex(name) >= 0
+}
+
+func (s *pop3Store) folderIndex(name string) int {
+	for i, folder := range s.Folders {
+		if folder == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// folders returns the names of the folders
+func (s *pop3Store) folders() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.Folders...)
+}
+
+// createFolder adds a folder
+func (s *pop3Store) createFolder(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = strings.Trim(name, pop3Delimiter)
+	if name == "" {
+		return fmt.Errorf("folder name is required")
+	}
+	if s.folderIndex(name) >= 0 {
+		return fmt.Errorf("folder %s already exists", name)
+	}
+	s.Folders = append(s.Folders, name)
+	sort.Strings(s.Folders)
+	s.dirty = true
+	return nil
+}
+
+// renameFolder renames a folder and its subfolders, with their messages
+func (s *pop3Store) renameFolder(oldName, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	newName = strings.Trim(newName, pop3Delimiter)
+	if oldName == "INBOX" || newName == "" {
+		return fmt.Errorf("cannot rename %s", oldName)
+	}
+	if s.folderIndex(oldName) < 0 {
+		return fmt.Errorf("folder %s not found", oldName)
+	}
+	if s.folderIndex(newName) >= 0 {
+		return fmt.Errorf("folder %s already exists", newName)
+	}
+
+	rename := func(name string) string {
+		if name == oldName {
+			return newName
+		}
+		if strings.HasPrefix(name, oldName+pop3Delimiter) {
+			return newName + strings.TrimPrefix(name, oldName)
+		}
+		return name
+	}
+	for i, folder := range s.Folders {
+		s.Folders[i] = rename(folder)
+	}
+	sort.Strings(s.Folders)
+	for _, msg := range s.Messages {
+		msg.Folder = rename(msg.Folder)
+	}
+	s.changed()
+	return nil
+}
+
+// deleteFolder deletes a folder and the messages in it
+func (s *pop3Store) deleteFolder(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.folderIndex(name)
+	if name == "INBOX" || i < 0 {
+		return fmt.Errorf("cannot delete %s", name)
+	}
+	s.Folders = append(s.Folders[:i], s.Folders[i+1:]...)
+	for uid, msg := range s.Messages {
+		if msg.Folder == name {
+			delete(s.Messages, uid)
+			os.Remove(s.messagePath(uid))
+		}
+	}
+	s.changed()
+	return nil
+}
+
+// status returns the UID validity, next UID and modseq of the store
+func (s *pop3Store) status() (uint32, uint32, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Validity, s.Next, s.ModSeq
+}
@@ -0,0 +1,775 @@
+package api
+
+import (
+	"fmt"
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// NotificationPreferences is the notification part of a user's settings
+type NotificationPreferences struct {
+	EnableNotifications bool   `json:"enable_notifications"`
+	NotifyNewMail       bool   `json:"notify_new_mail"`
+	NotifyStatusChanges bool   `json:"notify_status_changes"`
+	NotifyDigests       bool   `json:"notify_digests"`
+	DigestFrequency     string `json:"digest_frequency"`
+	DigestHour          int    `json:"digest_hour"`
+}
+
+// PreferencesHandler handles user preference requests
+type PreferencesHandler struct {
+	store    *session.Store
+	settings *storage.SettingsStorage
+	spam     *SpamFilter
+	assist   *Assistant
+}
+
+// NewPreferencesHandler creates a new preferences handler
+func NewPreferencesHandler(store *session.Store, settingsStorage *storage.SettingsStorage) *PreferencesHandler {
+	return &PreferencesHandler{
+		store:    store,
+		settings: settingsStorage,
+	}
+}
+
+// SetSpamFilter lets users see and reset what their spam classifier learned
+func (h *PreferencesHandler) SetSpamFilter(spam *SpamFilter) {
+	h.spam = spam
+}
+
+// SetAssistant lets users turn reply suggestions on when the server has a
+// language model configured
+func (h *PreferencesHandler) SetAssistant(assist *Assistant) {
+	h.assist = assist
+}
+
+// GetNotificationPreferences returns the user's notification preferences
+func (h *PreferencesHandler) GetNotificationPreferences(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"preferences": NotificationPreferences{
+			EnableNotifications: settings.EnableNotifications,
+			NotifyNewMail:       settings.NotifyNewMail,
+			NotifyStatusChanges: settings.NotifyStatusChanges,
+			NotifyDigests:       settings.NotifyDigests,
+			DigestFrequency:     settings.DigestFrequency,
+			DigestHour:          settings.DigestHour,
+		},
+	})
+}
+
+// UpdateNotificationPreferences saves the user's notification preferences.
+// It accepts JSON or the settings page form, where unchecked boxes are absent.
+func (h *PreferencesHandler) UpdateNotificationPreferences(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	var prefs NotificationPreferences
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		if err := c.BodyParser(&prefs); err != nil {
+			return utils.BadRequestError("Invalid request", err)
+		}
+	} else {
+		prefs = NotificationPreferences{
+			EnableNotifications: c.FormValue("enableNotifications") == "on",
+			NotifyNewMail:       c.FormValue("newEmailNotifications") == "on",
+			NotifyStatusChanges: c.FormValue("statusChangeNotifications") == "on",
+			NotifyDigests:       c.FormValue("digestNotifications") == "on",
+			DigestFrequency:     c.FormValue("digestFrequency", "off"),
+		}
+		hour, err := strconv.Atoi(c.FormValue("digestHour", "8"))
+		if err != nil {
+			return utils.BadRequestError("Invalid digest hour", err)
+		}
+		prefs.DigestHour = hour
+	}
+
+	switch prefs.DigestFrequency {
+	case "", "off":
+		prefs.DigestFrequency = "off"
+	case "daily", "weekly":
+	default:
+		return utils.BadRequestError("Invalid digest frequency", nil)
+	}
+	if prefs.DigestHour < 0 || prefs.DigestHour > 23 {
+		return utils.BadRequestError("Digest hour must be between 0 and 23", nil)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	settings.EnableNotifications = prefs.EnableNotifications
+	settings.NotifyNewMail = prefs.NotifyNewMail
+	settings.NotifyStatusChanges = prefs.NotifyStatusChanges
+	settings.NotifyDigests = prefs.NotifyDigests
+	settings.DigestFrequency = prefs.DigestFrequency
+	settings.DigestHour = prefs.DigestHour
+
+	if err := h.settings.SaveSettings(settings); err != nil {
+		return utils.InternalServerError("Failed to save settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":     true,
+		"message":     "Notification preferences updated",
+		"preferences": prefs,
+	})
+}
+
+// DisplayPreferences is the mailbox display part of a user's settings. Fields
+// left out of a JSON update keep their current value.
+type DisplayPreferences struct {
+	EmailsPerPage  *int    `json:"emails_per_page,omitempty"`
+	DefaultFolder  *string `json:"default_folder,omitempty"`
+	ShowPreview    *bool   `json:"show_preview,omitempty"`
+	AutoMarkAsRead *bool   `json:"auto_mark_as_read,omitempty"`
+	// Seconds before an opened message is marked read
+	AutoMarkReadDelay *int  `json:"auto_mark_read_delay,omitempty"`
+	BlockRemoteImages *bool `json:"block_remote_images,omitempty"`
+	ProxyRemoteImages *bool `json:"proxy_remote_images,omitempty"`
+}
+
+// GetPreferences returns all of the user's settings
+func (h *PreferencesHandler) GetPreferences(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":     true,
+		"preferences": settings,
+	})
+}
+
+// UpdatePreferences saves the user's display preferences. It accepts a
+// partial JSON update or the settings page form, where unchecked boxes are
+// absent.
+func (h *PreferencesHandler) UpdatePreferences(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	var prefs DisplayPreferences
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		if err := c.BodyParser(&prefs); err != nil {
+			return utils.BadRequestError("Invalid request", err)
+		}
+	} else {
+		perPage, err := strconv.Atoi(c.FormValue("emailsPerPage"))
+		if err != nil {
+			return utils.BadRequestError("Invalid emails per page", err)
+		}
+		folder := c.FormValue("defaultFolder")
+		showPreview := c.FormValue("showPreview") == "on"
+		autoMarkAsRead := c.FormValue("autoMarkAsRead") == "on"
+		blockImages := c.FormValue("blockRemoteImages") == "on"
+		proxyImages := c.FormValue("proxyRemoteImages") == "on"
+		delay, err := strconv.Atoi(c.FormValue("autoMarkReadDelay", "0"))
+		if err != nil {
+			return utils.BadRequestError("Invalid mark as read delay", err)
+		}
+		prefs = DisplayPreferences{
+			EmailsPerPage:     &perPage,
+			DefaultFolder:     &folder,
+			ShowPreview:       &showPreview,
+			AutoMarkAsRead:    &autoMarkAsRead,
+			AutoMarkReadDelay: &delay,
+			BlockRemoteImages: &blockImages,
+			ProxyRemoteImages: &proxyImages,
+		}
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	if prefs.EmailsPerPage != nil {
+		if *prefs.EmailsPerPage < models.MinEmailsPerPage || *prefs.EmailsPerPage > models.MaxEmailsPerPage {
+			return utils.BadRequestError(fmt.Sprintf("Emails per page must be between %d and %d", models.MinEmailsPerPage, models.MaxEmailsPerPage), nil)
+		}
+		settings.EmailsPerPage = *prefs.EmailsPerPage
+	}
+	if prefs.DefaultFolder != nil {
+		folder := strings.TrimSpace(*prefs.DefaultFolder)
+		if folder == "" {
+			folder = "INBOX"
+		}
+		settings.DefaultFolder = folder
+	}
+	if prefs.ShowPreview != nil {
+		settings.ShowPreview = *prefs.ShowPreview
+	}
+	if prefs.AutoMarkAsRead != nil {
+		settings.AutoMarkAsRead = *prefs.AutoMarkAsRead
+	}
+	if prefs.AutoMarkReadDelay != nil {
+		if *prefs.AutoMarkReadDelay < 0 || *prefs.AutoMarkReadDelay > models.MaxAutoMarkReadDelay {
+			return utils.BadRequestError(fmt.Sprintf("Mark as read delay must be between 0 and %d seconds", models.MaxAutoMarkReadDelay), nil)
+		}
+		settings.AutoMarkReadDelay = *prefs.AutoMarkReadDelay
+	}
+	if prefs.BlockRemoteImages != nil {
+		settings.BlockRemoteImages = *prefs.BlockRemoteImages
+	}
+	if prefs.ProxyRemoteImages != nil {
+		settings.ProxyRemoteImages = *prefs.ProxyRemoteImages
+	}
+
+	if err := h.settings.SaveSettings(settings); err != nil {
+		return utils.InternalServerError("Failed to save settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":     true,
+		"message":     "Preferences updated",
+		"preferences": settings,
+	})
+}
+
+// ResetPreferences restores the default settings for the user
+func (h *PreferencesHandler) ResetPreferences(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	if err := h.settings.DeleteSettings(userID); err != nil {
+		return utils.InternalServerError("Failed to reset settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":     true,
+		"message":     "Preferences reset",
+		"preferences": models.DefaultUserSettings(userID),
+	})
+}
+
+// GetImageSenders returns the senders whose remote images always load
+func (h *PreferencesHandler) GetImageSenders(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"senders": settings.ImageSenders,
+	})
+}
+
+// AddImageSender always loads remote images from an address or @domain
+func (h *PreferencesHandler) AddImageSender(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	var req struct {
+		Sender string `json:"sender" form:"sender"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+	sender, err := models.NormalizeImageSender(req.Sender)
+	if err != nil {
+		return utils.BadRequestError(err.Error(), err)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	found := false
+	for _, existing := range settings.ImageSenders {
+		if existing == sender {
+			found = true
+			break
+		}
+	}
+	if !found {
+		settings.ImageSenders = append(settings.ImageSenders, sender)
+		if err := h.settings.SaveSettings(settings); err != nil {
+			return utils.InternalServerError("Failed to save settings", err)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Images from " + sender + " will load automatically",
+		"senders": settings.ImageSenders,
+	})
+}
+
+// RemoveImageSender stops always loading remote images from a sender
+func (h *PreferencesHandler) RemoveImageSender(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	sender, err := url.PathUnescape(c.Params("sender"))
+	if err != nil {
+		return utils.BadRequestError("Invalid sender", err)
+	}
+	sender = strings.ToLower(strings.TrimSpace(sender))
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	senders := settings.ImageSenders[:0]
+	for _, existing := range settings.ImageSenders {
+		if existing != sender {
+			senders = append(senders, existing)
+		}
+	}
+	if len(senders) == len(settings.ImageSenders) {
+		return utils.NotFoundError("Sender not found", nil)
+	}
+	settings.ImageSenders = senders
+
+	if err := h.settings.SaveSettings(settings); err != nil {
+		return utils.InternalServerError("Failed to save settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"senders": settings.ImageSenders,
+	})
+}
+
+// GetBlockedSenders returns the senders whose new mail is junked or deleted
+func (h *PreferencesHandler) GetBlockedSenders(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"senders": settings.BlockedSenders,
+	})
+}
+
+// BlockSender junks or deletes new mail from an address or @domain. Blocking
+// a sender again changes what happens to their mail.
+func (h *PreferencesHandler) BlockSender(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	var req struct {
+		Sender string `json:"sender" form:"sender"`
+		Action string `json:"action" form:"action"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+	if req.Action == "" {
+		req.Action = models.BlockActionJunk
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	blocked, err := settings.BlockSender(req.Sender, req.Action)
+	if err != nil {
+		return utils.BadRequestError(err.Error(), err)
+	}
+	if err := h.settings.SaveSettings(settings); err != nil {
+		return utils.InternalServerError("Failed to save settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Blocked " + blocked.Sender,
+		"senders": settings.BlockedSenders,
+	})
+}
+
+// UnblockSender stops junking or deleting new mail from a sender
+func (h *PreferencesHandler) UnblockSender(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	sender, err := url.PathUnescape(c.Params("sender"))
+	if err != nil {
+		return utils.BadRequestError("Invalid sender", err)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	if !settings.UnblockSender(sender) {
+		return utils.NotFoundError("Sender not found", nil)
+	}
+	if err := h.settings.SaveSettings(settings); err != nil {
+		return utils.InternalServerError("Failed to save settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"senders": settings.BlockedSenders,
+	})
+}
+
+// GetShortcuts returns the user's keyboard shortcuts, defaults included
+func (h *PreferencesHandler) GetShortcuts(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"shortcuts": settings.ShortcutMap(),
+		"defaults":  models.DefaultShortcuts,
+	})
+}
+
+// UpdateShortcuts rebinds keyboard shortcuts. The body maps actions to keys,
+// either as is or under "shortcuts"; an empty key restores the default.
+func (h *PreferencesHandler) UpdateShortcuts(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	var req struct {
+		Shortcuts map[string]string `json:"shortcuts"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+	if req.Shortcuts == nil {
+		if err := c.BodyParser(&req.Shortcuts); err != nil {
+			return utils.BadRequestError("Invalid request", err)
+		}
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+	if settings.Shortcuts == nil {
+		settings.Shortcuts = make(map[string]string)
+	}
+
+	for action, key := range req.Shortcuts {
+		if _, ok := models.DefaultShortcuts[action]; !ok {
+			return utils.BadRequestError(fmt.Sprintf("Unknown shortcut action %q", action), nil)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" || key == models.DefaultShortcuts[action] {
+			delete(settings.Shortcuts, action)
+			continue
+		}
+		if !models.ValidShortcutKey(key) {
+			return utils.BadRequestError(fmt.Sprintf("Invalid key %q for %s", key, action), nil)
+		}
+		settings.Shortcuts[action] = key
+	}
+
+	// One key can't trigger two actions
+	bound := make(map[string]string)
+	for action, key := range settings.ShortcutMap() {
+		if other, ok := bound[key]; ok {
+			return utils.BadRequestError(fmt.Sprintf("%q is bound to both %s and %s", key, other, action), nil)
+		}
+		bound[key] = action
+	}
+
+	if err := h.settings.SaveSettings(settings); err != nil {
+		return utils.InternalServerError("Failed to save settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"message":   "Shortcuts updated",
+		"shortcuts": settings.ShortcutMap(),
+	})
+}
+
+// GetClientConfig returns the per-user settings the frontend scripts need
+func (h *PreferencesHandler) GetClientConfig(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"config": fiber.Map{
+			"shortcuts":            settings.ShortcutMap(),
+			"emails_per_page":      settings.EmailsPerPage,
+			"show_preview":         settings.ShowPreview,
+			"auto_mark_as_read":    settings.AutoMarkAsRead,
+			"auto_mark_read_delay": settings.AutoMarkReadDelay,
+			"language":             c.Locals("lang"),
+			"timezone":             GetSessionTimezone(c),
+		},
+	})
+}
+
+// GetComposePreferences returns the user's compose window defaults
+func (h *PreferencesHandler) GetComposePreferences(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"compose": settings.Compose,
+		"fonts":   models.ComposeFonts,
+	})
+}
+
+// UpdateComposePreferences saves the user's compose window defaults. Fields
+// left out go back to their default.
+func (h *PreferencesHandler) UpdateComposePreferences(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	var req models.ComposeSettings
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+	if err := req.Validate(); err != nil {
+		return utils.BadRequestError(err.Error(), err)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	settings.Compose = models.DefaultComposeSettings().Merge(req)
+
+	if err := h.settings.SaveSettings(settings); err != nil {
+		return utils.InternalServerError("Failed to save settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Compose preferences updated",
+		"compose": settings.Compose,
+	})
+}
+
+// SpamPreferences is the spam filter part of a user's settings
+type SpamPreferences struct {
+	SpamFilter   bool `json:"spam_filter"`
+	SpamAutoMove bool `json:"spam_auto_move"`
+}
+
+// GetSpamPreferences returns the user's spam filter settings and how much
+// the classifier has been trained
+func (h *PreferencesHandler) GetSpamPreferences(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	spam, ham, err := h.spam.Stats(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load spam filter", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"preferences": SpamPreferences{
+			SpamFilter:   settings.SpamFilter,
+			SpamAutoMove: settings.SpamAutoMove,
+		},
+		"trained_spam": spam,
+		"trained_ham":  ham,
+		"min_training": models.SpamMinTraining,
+	})
+}
+
+// UpdateSpamPreferences saves the user's spam filter settings. It accepts
+// JSON or the settings page form, where unchecked boxes are absent.
+func (h *PreferencesHandler) UpdateSpamPreferences(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	var prefs SpamPreferences
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		if err := c.BodyParser(&prefs); err != nil {
+			return utils.BadRequestError("Invalid request", err)
+		}
+	} else {
+		prefs = SpamPreferences{
+			SpamFilter:   c.FormValue("spamFilter") == "on",
+			SpamAutoMove: c.FormValue("spamAutoMove") == "on",
+		}
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	settings.SpamFilter = prefs.SpamFilter
+	settings.SpamAutoMove = prefs.SpamAutoMove
+
+	if err := h.settings.SaveSettings(settings); err != nil {
+		return utils.InternalServerError("Failed to save settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":     true,
+		"message":     "Spam filter preferences updated",
+		"preferences": prefs,
+	})
+}
+
+// GetAssistPreferences returns whether the user turned reply suggestions on
+// and whether the server offers them
+func (h *PreferencesHandler) GetAssistPreferences(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":        true,
+		"available":      h.assist != nil,
+		"assist_enabled": settings.AssistEnabled && h.assist != nil,
+	})
+}
+
+// UpdateAssistPreferences turns reply suggestions on or off. It accepts JSON
+// or the settings page form, where an unchecked box is absent.
+func (h *PreferencesHandler) UpdateAssistPreferences(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	var req struct {
+		AssistEnabled bool `json:"assist_enabled"`
+	}
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		if err := c.BodyParser(&req); err != nil {
+			return utils.BadRequestError("Invalid request", err)
+		}
+	} else {
+		req.AssistEnabled = c.FormValue("assistEnabled") == "on"
+	}
+	if req.AssistEnabled && h.assist == nil {
+		return utils.BadRequestError("Reply suggestions are not configured on this server", nil)
+	}
+
+	settings, err := h.settings.GetSettings(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to load settings", err)
+	}
+
+	settings.AssistEnabled = req.AssistEnabled
+
+	if err := h.settings.SaveSettings(settings); err != nil {
+		return utils.InternalServerError("Failed to save settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":        true,
+		"message":        "Assist preferences updated",
+		"assist_enabled": settings.AssistEnabled,
+	})
+}
+
+// ResetSpamFilter forgets everything the user's spam classifier learned
+func (h *PreferencesHandler) ResetSpamFilter(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	if err := h.spam.Reset(userID); err != nil {
+		return utils.InternalServerError("Failed to reset spam filter", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Spam filter training cleared",
+	})
+}
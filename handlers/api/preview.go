@@ -0,0 +1,124 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"lilmail/models"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Preview limits
+const (
+	maxPreviewTextBytes = 256 << 10 // Text shown before the preview is cut off
+	maxPreviewCSVRows   = 200
+	pdfPreviewWidth     = 1200 // Pixels
+	pdfPreviewTimeout   = 15 * time.Second
+)
+
+// pdfRenderer is the poppler tool that renders PDF pages to images
+const pdfRenderer = "pdftoppm"
+
+// errNoPDFRenderer means pdftoppm isn't installed, so PDFs are shown by the
+// browser's own viewer instead
+var errNoPDFRenderer = fmt.Errorf("%s is not installed", pdfRenderer)
+
+// renderPDFPreview renders the first page of a PDF to a PNG
+func renderPDFPreview(data []byte) ([]byte, error) {
+	renderer, err := exec.LookPath(pdfRenderer)
+	if err != nil {
+		return nil, errNoPDFRenderer
+	}
+
+	dir, err := os.MkdirTemp("", "lilmail-preview-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "attachment.pdf")
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pdfPreviewTimeout)
+	defer cancel()
+
+	output := filepath.Join(dir, "page")
+	cmd := exec.CommandContext(ctx, renderer,
+		"-png", "-singlefile", "-f", "1", "-l", "1",
+		"-scale-to-x", fmt.Sprint(pdfPreviewWidth), "-scale-to-y", "-1",
+		input, output)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %v: %s", pdfRenderer, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return os.ReadFile(output + ".png")
+}
+
+// previewText returns the start of a text attachment as valid UTF-8 and
+// whether it was cut off
+func previewText(data []byte) (string, bool) {
+	truncated := len(data) > maxPreviewTextBytes
+	if truncated {
+		data = data[:maxPreviewTextBytes]
+		// Don't split a multi-byte character
+		for i := 1; i < utf8.UTFMax && len(data) > 0; i++ {
+			if r, size := utf8.DecodeLastRune(data); r != utf8.RuneError || size != 1 {
+				break
+			}
+			data = data[:len(data)-1]
+		}
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) // UTF-8 BOM
+	return strings.ToValidUTF8(string(data), "�"), truncated
+}
+
+// previewCSV parses the first rows of a CSV attachment and whether there
+// were more. Semicolon separated files, common from spreadsheets in many
+// locales, are detected from the first line.
+func previewCSV(data []byte) ([][]string, bool, error) {
+	text, cut := previewText(data)
+
+	r := csv.NewReader(strings.NewReader(text))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	firstLine, _, _ := strings.Cut(text, "\n")
+	if strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		r.Comma = ';'
+	}
+
+	var rows [][]string
+	for len(rows) < maxPreviewCSVRows {
+		record, err := r.Read()
+		if err == io.EOF {
+			return rows, cut, nil
+		}
+		if err != nil {
+			// The text may have been cut off mid-record
+			if len(rows) > 0 {
+				return rows, true, nil
+			}
+			return nil, false, err
+		}
+		rows = append(rows, record)
+	}
+	return rows, true, nil
+}
+
+// previewTitle is the heading of a text or CSV preview
+func previewTitle(attachment *models.Attachment) string {
+	if attachment.Filename != "" {
+		return attachment.Filename
+	}
+	return attachment.ContentType
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"lilmail/models"
+	"lilmail/utils"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rawPart is a leaf MIME part of a message kept as raw RFC 5322 text,
+// the counterpart of an IMAP body structure part
+type rawPart struct {
+	path        []int
+	mediaType   string
+	params      map[string]string
+	disposition string
+	dispParams  map[string]string
+	contentID   string
+	encoding    string
+	body        []byte // Still transfer-encoded
+	related     bool   // Inside multipart/related
+}
+
+func (p rawPart) filename() string {
+	filename := p.dispParams["filename"]
+	if filename == "" {
+		filename = p.params["name"]
+	}
+	return utils.DecodeHeader(filename)
+}
+
+// content returns the part's body with the transfer encoding undone
+func (p rawPart) content() ([]byte, error) {
+	return decodeAttachment(p.encoding, bytes.NewReader(p.body))
+}
+
+// rawMessageParts walks a raw message and returns its leaf parts in order
+func rawMessageParts(msg *mail.Message) []rawPart {
+	var parts []rawPart
+
+	var walk func(header textproto.MIMEHeader, body io.Reader, path []int, related bool, depth int)
+	walk = func(header textproto.MIMEHeader, body io.Reader, path []int, related bool, depth int) {
+		mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+		if err != nil {
+			mediaType, params = "text/plain", map[string]string{} // RFC 2045 default
+		}
+
+		if strings.HasPrefix(mediaType, "multipart/") {
+			if depth >= maxMultipartDepth {
+				return
+			}
+			// NextRawPart keeps the transfer encoding, like IMAP sections
+			mr := multipart.NewReader(body, params["boundary"])
+			for i := 1; ; i++ {
+				p, err := mr.NextRawPart()
+				if err != nil {
+					return
+				}
+				childPath := append(append([]int(nil), path...), i)
+				walk(p.Header, p, childPath, mediaType == "multipart/related", depth+1)
+			}
+		}
+
+		// The body of a single part message is part 1
+		if len(path) == 0 {
+			path = []int{1}
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return
+		}
+		disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+		parts = append(parts, rawPart{
+			path:        path,
+			mediaType:   mediaType,
+			params:      params,
+			disposition: disposition,
+			dispParams:  dispParams,
+			contentID:   normalizeContentID(header.Get("Content-Id")),
+			encoding:    strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))),
+			body:        data,
+			related:     related,
+		})
+	}
+
+	walk(textproto.MIMEHeader(msg.Header), msg.Body, nil, false, 0)
+	return parts
+}
+
+// rawAttachmentParts sorts the leaf parts into attachments and the inline
+// parts the HTML refers to, with the same rules as findAttachmentParts
+func rawAttachmentParts(parts []rawPart) ([]rawPart, map[string]rawPart) {
+	var attachments []rawPart
+	inline := make(map[string]rawPart)
+	for _, part := range parts {
+		isText := strings.HasPrefix(part.mediaType, "text/")
+		if part.contentID != "" && !isText && part.disposition != "attachment" &&
+			(part.related || part.disposition == "inline") {
+			inline[part.contentID] = part
+			continue
+		}
+		if part.disposition == "attachment" || (part.disposition == "inline" && !isText) {
+			attachments = append(attachments, part)
+		}
+	}
+	return attachments, inline
+}
+
+// rawAddresses lists the addresses of an address header, and the names of
+// those that have one
+func rawAddresses(header mail.Header, key string) ([]string, []string) {
+	list, err := header.AddressList(key)
+	if err != nil {
+		if value := strings.TrimSpace(header.Get(key)); value != "" {
+			return []string{utils.DecodeHeader(value)}, nil
+		}
+		return nil, nil
+	}
+
+	var addresses, names []string
+	for _, address := range list {
+		addresses = append(addresses, address.Address)
+		if address.Name != "" {
+			names = append(names, address.Name)
+		}
+	}
+	return addresses, names
+}
+
+// parseRawEmail builds the model of a raw message. date is used when the
+// message has no usable Date header.
+func parseRawEmail(raw []byte, uid uint32, folder string, flags []string, date time.Time) (models.Email, error) {
+	email := models.Email{
+		ID:    strconv.FormatUint(uint64(uid), 10),
+		Flags: flags,
+		Date:  date,
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return email, fmt.Errorf("error parsing message: %v", err)
+	}
+	header := msg.Header
+
+	email.Subject = utils.DecodeHeader(header.Get("Subject"))
+	if sent, err := header.Date(); err == nil {
+		email.Date = sent
+	}
+	setThreadingHeaders(&email, header)
+	email.ListID = parseListID(header.Get("List-Id"))
+
+	if from, names := rawAddresses(header, "From"); len(from) > 0 {
+		email.From = from[0]
+		if len(names) > 0 {
+			email.FromName = names[0]
+		}
+	}
+	to, toNames := rawAddresses(header, "To")
+	email.To = strings.Join(to, ", ")
+	email.ToNames = toNames
+	cc, _ := rawAddresses(header, "Cc")
+	email.Cc = strings.Join(cc, ", ")
+	if replyTo, _ := rawAddresses(header, "Reply-To"); len(replyTo) > 0 {
+		email.ReplyTo = replyTo[0]
+	}
+
+	// Find the text bodies, however deep they are nested
+	texts := make(map[string]string)
+	collectTextParts(header.Get("Content-Type"), header.Get("Content-Transfer-Encoding"), msg.Body, texts, 0)
+	email.Body = texts["text/plain"]
+	if htmlBody, ok := texts["text/html"]; ok {
+		// Point inline images at the inline part endpoint
+		htmlBody = rewriteCIDs(htmlBody, email.ID, folder)
+		// Structured data is in scripts, which sanitizing removes
+		email.StructuredData = utils.ExtractJSONLD(htmlBody)
+		email.HTML = template.HTML(utils.SanitizeHTML(htmlBody))
+	}
+	if email.Body != "" {
+		email.Preview = createPreview(email.Body)
+	} else if email.HTML != "" {
+		email.Preview = createPreview(stripHTML(string(email.HTML)))
+	}
+
+	// The body was consumed; parse again for the parts
+	if msg, err = mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		attachments, _ := rawAttachmentParts(rawMessageParts(msg))
+		for _, part := range attachments {
+			email.Attachments = append(email.Attachments, models.Attachment{
+				Filename:    part.filename(),
+				ContentType: part.mediaType,
+				Part:        partName(part.path),
+				Size:        len(part.body), // Encoded size until the content is fetched
+			})
+		}
+	}
+	email.HasAttachments = len(email.Attachments) > 0
+
+	return email, nil
+}
+
+// rawHeaders describes the headers and MIME structure of a raw message
+func rawHeaders(raw []byte) (*models.MessageHeaders, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing message: %v", err)
+	}
+
+	// The header ends at the first blank line
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if lf := bytes.Index(raw, []byte("\n\n")); end < 0 || (lf >= 0 && lf < end) {
+		end = lf
+	}
+	if end < 0 {
+		end = len(raw)
+	}
+
+	parts := []models.MessagePart{}
+	for _, part := range rawMessageParts(msg) {
+		parts = append(parts, models.MessagePart{
+			Part:        partName(part.path),
+			ContentType: part.mediaType,
+			Charset:     part.params["charset"],
+			Encoding:    part.encoding,
+			Disposition: part.disposition,
+			Filename:    part.filename(),
+			Size:        len(part.body),
+		})
+	}
+	return newMessageHeaders(string(raw[:end]), parts), nil
+}
@@ -1,25 +1,41 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"time"
 	"lilmail/config"
 	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"net/url"
+	"sort"
+	"strings"
 
-	"github.com/emersion/go-imap"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
 )
 
+const (
+	// searchPageSize is the number of results shown per page
+	searchPageSize = 50
+	// searchCacheTTL is how long matched messages are kept for paging
+	searchCacheTTL = 5 * time.Minute
+)
+
 type SearchHandler struct {
 	store  *session.Store
 	config *config.Config
+	labels *storage.LabelStorage
 }
 
-func NewSearchHandler(store *session.Store, config *config.Config) *SearchHandler {
+func NewSearchHandler(store *session.Store, config *config.Config, labelStorage *storage.LabelStorage) *SearchHandler {
 	return &SearchHandler{
 		store:  store,
 		config: config,
+		labels: labelStorage,
 	}
 }
 
@@ -32,6 +48,8 @@ func NewSearchHandler(store *session.Store, config *config.Config) *SearchHandle
 		dateFromStr := c.FormValue("dateFrom")
 		dateToStr := c.FormValue("dateTo")
 		hasAttachment := c.FormValue("hasAttachment") == "on" // HTML checkbox sends "on"
+		labelIDsStr := c.FormValue("labels")                  // Comma separated label IDs
+		allFolders := c.FormValue("allFolders") == "on"
 
 		// Create IMAP Client from session credentials
 		creds, err := GetCredentials(c, h.store, h.config.Encryption.Key)
@@ -39,66 +57,114 @@ func NewSearchHandler(store *session.Store, config *config.Config) *SearchHandle
 			return c.Status(401).SendString("Unauthorized")
 		}
 
-		client, err := createIMAPClientFromCredentials(creds, h.config)
+		client, err := NewMailClient(creds, h.config)
 		if err != nil {
 			return c.Status(500).SendString("Failed to connect to mail server")
 		}
 		defer client.Close()
 
-		// Perform Search
-		criteria := imap.NewSearchCriteria()
-		
-		if query != "" {
-			switch scope {
-			case "from":
-				criteria.Header.Add("From", query)
-			case "to":
-				criteria.Header.Add("To", query)
-			case "subject":
-				criteria.Header.Add("Subject", query)
-			case "body":
-				criteria.Body = []string{query}
-			default:
-				// Search all reasonable fields
-				// Note: Text criteria usually searches Subject, From, To, Cc, Bcc, and Body
-				criteria.Text = []string{query}
-			}
+		// Parse operators (from:, subject:, has:attachment, ...) out of the query
+		// and merge in the advanced search form fields
+		parsed := ParseSearchQuery(query)
+		if hasAttachment {
+			parsed.HasAttachment = true
 		}
-
-		// Date Filters
-		if dateFromStr != "" {
+		if dateFromStr != "" && parsed.After.IsZero() {
 			if dateFrom, err := time.Parse("2006-01-02", dateFromStr); err == nil {
-				criteria.Since = dateFrom
+				parsed.After = dateFrom
 			}
 		}
-		if dateToStr != "" {
+		if dateToStr != "" && parsed.Before.IsZero() {
 			if dateTo, err := time.Parse("2006-01-02", dateToStr); err == nil {
 				// Search Before is strictly before, so we add 1 day to include the end date
-				criteria.Before = dateTo.AddDate(0, 0, 1)
+				parsed.Before = dateTo.AddDate(0, 0, 1)
 			}
 		}
 
-		// Attachment Filter
-		// Note: IMAP doesn't have a standard HAS_ATTACHMENT flag.
-		// Common workaround is checking Content-Type or Body structure.
-		// Checking Header "Content-Type" for "multipart/mixed" is a common approximation.
-		if hasAttachment {
-			criteria.Header.Add("Content-Type", "multipart/mixed")
+		page := c.QueryInt("page", 1)
+		if page < 1 {
+			page = 1
 		}
 
-		// Select folder
-		_, err = client.client.Select(folder, false)
+		// Search parameters, used both as the cache key and for page links
+		params := url.Values{}
+		params.Set("query", query)
+		params.Set("folder", folder)
+		params.Set("scope", scope)
+		params.Set("dateFrom", dateFromStr)
+		params.Set("dateTo", dateToStr)
+		params.Set("hasAttachment", c.FormValue("hasAttachment"))
+		params.Set("labels", labelIDsStr)
+		params.Set("allFolders", c.FormValue("allFolders"))
+
+		sess, err := h.store.Get(c)
 		if err != nil {
-			return c.Status(500).SendString("Folder selection failed")
+			return c.Status(500).SendString("Failed to get session")
 		}
+		accountID, _ := sess.Get("accountId").(string)
+		cacheKey := searchCacheKey(sess.ID(), accountID, params)
 
-		// Execute Search
-		uids, err := client.client.Search(criteria)
-		if err != nil {
-			return c.Status(500).SendString("Search failed")
+		// Reuse the matched messages while the user pages through results
+		hits, cached := getCachedSearch(cacheKey)
+		if !cached {
+			criteria := parsed.Criteria(scope)
+
+			// Labels are stored locally, so resolve them before going to the server
+			var labelIDs []string
+			if len(parsed.Labels) > 0 || labelIDsStr != "" {
+				labelIDs, err = h.resolveLabels(GetSessionUser(c), parsed.Labels, strings.Split(labelIDsStr, ","))
+				if err != nil {
+					return c.Status(500).SendString("Failed to load labels")
+				}
+				if labelIDs == nil {
+					// An unknown label can't match anything
+					return c.Render("partials/email-list", fiber.Map{
+						"Emails":        []models.Email{},
+						"CurrentFolder": folder,
+						"Pagination":    nil,
+					})
+				}
+			}
+
+			folders := []string{folder}
+			if allFolders {
+				folders, err = searchFolders(client)
+				if err != nil {
+					return c.Status(500).SendString("Failed to list folders")
+				}
+			}
+
+			hits = []searchHit{}
+			for _, name := range folders {
+				// Execute Search. Use UIDs since results are fetched by UID
+				uids, err := client.SearchUIDs(name, criteria)
+				if err != nil {
+					return c.Status(500).SendString("Search failed")
+				}
+
+				if len(labelIDs) > 0 {
+					uids = h.filterByLabels(GetSessionUser(c), GetSessionEmail(c), name, uids, labelIDs)
+				}
+
+				// Newest first
+				sort.Slice(uids, func(i, j int) bool { return uids[i] > uids[j] })
+				for _, uid := range uids {
+					hits = append(hits, searchHit{Folder: name, UID: uid})
+				}
+			}
+
+			// Copies of a message only turn up when several folders are
+			// searched, so a single folder search skips the Message-ID fetch
+			if len(folders) > 1 && len(hits) > 0 {
+				hits, err = collapseDuplicates(client, hits)
+				if err != nil {
+					return c.Status(500).SendString("Search failed")
+				}
+			}
+			utils.GlobalCache.Set(cacheKey, hits, searchCacheTTL)
 		}
 
-		if len(uids) == 0 {
+		if len(hits) == 0 {
 			// Return empty list partial
 			return c.Render("partials/email-list", fiber.Map{
 				"Emails":        []models.Email{},
@@ -107,15 +173,128 @@ func NewSearchHandler(store *session.Store, config *config.Config) *SearchHandle
 			})
 		}
 
-		// Fetch messages for UIDs
-		messages, err := client.FetchMessagesByUIDs(folder, uids)
+		// Only fetch the window for the requested page
+		start := (page - 1) * searchPageSize
+		if start >= len(hits) {
+			start = 0
+			page = 1
+		}
+		end := start + searchPageSize
+		if end > len(hits) {
+			end = len(hits)
+		}
+
+		messages, err := fetchSearchHits(client, hits[start:end])
 		if err != nil {
 			return c.Status(500).SendString(fmt.Sprintf("Failed to fetch search results: %v", err))
 		}
 
+		AddSearchSnippets(messages, parsed.HighlightTerms())
+
+		if h.labels != nil {
+			username, account := GetSessionUser(c), GetSessionEmail(c)
+			for i := range messages {
+				key := storage.LabelEmailKey(username, account, messages[i].Folder, messages[i].ID)
+				if labels, err := h.labels.GetLabelsForEmail(username, key); err == nil {
+					messages[i].Labels = labels
+				}
+			}
+		}
+
 		return c.Render("partials/email-list", fiber.Map{
 			"Emails":        messages,
 			"CurrentFolder": folder,
-			"Pagination":    nil, // Search results are not paginated yet
+			"Pagination":    models.NewPaginatedEmails(messages, uint32(page), searchPageSize, uint32(len(hits))),
+			"PageURL":       "/api/search?" + params.Encode() + "&",
+			"PageTarget":    "#search-results",
 		}, "")
 	}
+
+// resolveLabels maps label names (from label: operators) and label IDs to the
+// IDs of the user's labels. It returns nil if any of them is not a label the
+// user owns.
+func (h *SearchHandler) resolveLabels(userID string, names, ids []string) ([]string, error) {
+	if h.labels == nil {
+		return nil, errors.New("label storage is unavailable")
+	}
+	userLabels, err := h.labels.GetLabelsByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolved []string
+	for _, name := range names {
+		found := false
+		for _, label := range userLabels {
+			if strings.EqualFold(label.Name, name) {
+				resolved = append(resolved, label.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, nil
+		}
+	}
+
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		found := false
+		for _, label := range userLabels {
+			if label.ID == id {
+				resolved = append(resolved, label.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, nil
+		}
+	}
+
+	if len(resolved) == 0 {
+		return []string{}, nil
+	}
+	return resolved, nil
+}
+
+// filterByLabels keeps the UIDs of emails in a folder of the account that
+// carry every one of the user's labelIDs
+func (h *SearchHandler) filterByLabels(userID, account, folder string, uids []uint32, labelIDs []string) []uint32 {
+	var filtered []uint32
+	for _, uid := range uids {
+		key := storage.LabelEmailKey(userID, account, folder, fmt.Sprint(uid))
+		labels, err := h.labels.GetLabelsForEmail(userID, key)
+		if err != nil || len(labels) == 0 {
+			continue
+		}
+
+		assigned := make(map[string]bool, len(labels))
+		for _, label := range labels {
+			assigned[label.ID] = true
+		}
+
+		matches := true
+		for _, id := range labelIDs {
+			if !assigned[id] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			filtered = append(filtered, uid)
+		}
+	}
+	return filtered
+}
+
+// searchCacheKey builds a file-safe cache key for a session's search. UIDs
+// only mean something in the account they came from, so switching accounts
+// starts a new search.
+func searchCacheKey(sessionID, accountID string, params url.Values) string {
+	sum := sha256.Sum256([]byte(sessionID + "|" + accountID + "|" + params.Encode()))
+	return "search_" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"lilmail/models"
+	"lilmail/utils"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// searchHit is one search result: the copy of a message that is shown and
+// the folders holding a copy of it
+type searchHit struct {
+	Folder    string   `json:"folder"`
+	UID       uint32   `json:"uid"`
+	Locations []string `json:"locations,omitempty"`
+}
+
+// searchFolders returns the folders an all-folders search looks in, with
+// INBOX first so that its copy of a duplicated message is the one shown
+func searchFolders(client MailClient) ([]string, error) {
+	folders, err := client.FetchFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{"INBOX"}
+	for _, folder := range folders {
+		if strings.EqualFold(folder.Name, "INBOX") {
+			continue
+		}
+		selectable := true
+		for _, attr := range folder.Attributes {
+			if attr == imap.NoSelectAttr {
+				selectable = false
+				break
+			}
+		}
+		if selectable {
+			names = append(names, folder.Name)
+		}
+	}
+	return names, nil
+}
+
+// collapseDuplicates merges hits that share a Message-ID into the first of
+// them, which records every folder a copy was found in. This catches Gmail
+// labels, which show up as one copy per label folder, and messages that were
+// copied rather than moved. Hits without a Message-ID are kept as they are.
+func collapseDuplicates(client MailClient, hits []searchHit) ([]searchHit, error) {
+	byFolder := make(map[string][]uint32)
+	for _, hit := range hits {
+		byFolder[hit.Folder] = append(byFolder[hit.Folder], hit.UID)
+	}
+
+	messageIDs := make(map[string]map[uint32]string, len(byFolder))
+	for folder, uids := range byFolder {
+		ids, err := client.FetchMessageIDs(folder, uids)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching message IDs in %s: %v", folder, err)
+		}
+		messageIDs[folder] = ids
+	}
+
+	collapsed := make([]searchHit, 0, len(hits))
+	seen := make(map[string]int)
+	for _, hit := range hits {
+		id := strings.TrimSpace(messageIDs[hit.Folder][hit.UID])
+		if id == "" {
+			collapsed = append(collapsed, hit)
+			continue
+		}
+
+		if i, ok := seen[id]; ok {
+			if !containsString(collapsed[i].Locations, hit.Folder) {
+				collapsed[i].Locations = append(collapsed[i].Locations, hit.Folder)
+			}
+			continue
+		}
+
+		hit.Locations = []string{hit.Folder}
+		seen[id] = len(collapsed)
+		collapsed = append(collapsed, hit)
+	}
+
+	// Only messages found in more than one folder list their locations
+	for i := range collapsed {
+		if len(collapsed[i].Locations) < 2 {
+			collapsed[i].Locations = nil
+		}
+	}
+	return collapsed, nil
+}
+
+// fetchSearchHits fetches the messages of a page of hits, which may come
+// from several folders, in the order of the hits
+func fetchSearchHits(client MailClient, hits []searchHit) ([]models.Email, error) {
+	var folders []string
+	byFolder := make(map[string][]uint32)
+	for _, hit := range hits {
+		if _, ok := byFolder[hit.Folder]; !ok {
+			folders = append(folders, hit.Folder)
+		}
+		byFolder[hit.Folder] = append(byFolder[hit.Folder], hit.UID)
+	}
+
+	fetched := make(map[string]models.Email, len(hits))
+	for _, folder := range folders {
+		messages, err := client.FetchMessagesByUIDs(folder, byFolder[folder])
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			fetched[folder+"\x00"+message.ID] = message
+		}
+	}
+
+	emails := make([]models.Email, 0, len(hits))
+	for _, hit := range hits {
+		email, ok := fetched[hit.Folder+"\x00"+fmt.Sprint(hit.UID)]
+		if !ok {
+			continue
+		}
+		email.Folder = hit.Folder
+		email.Locations = hit.Locations
+		emails = append(emails, email)
+	}
+	return emails, nil
+}
+
+// getCachedSearch returns the hits of a search, if still cached. Entries
+// restored from disk come back as decoded JSON and are converted back.
+func getCachedSearch(key string) ([]searchHit, bool) {
+	value, ok := utils.GlobalCache.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	if hits, ok := value.([]searchHit); ok {
+		return hits, true
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, false
+	}
+	var hits []searchHit
+	if err := json.Unmarshal(data, &hits); err != nil {
+		return nil, false
+	}
+	return hits, true
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
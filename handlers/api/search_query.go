@@ -0,0 +1,166 @@
+package api
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+)
+
+// SearchQuery is a search string parsed into its Gmail-style operators
+type SearchQuery struct {
+	Terms         []string // Free text not bound to an operator
+	From          []string
+	To            []string
+	Subject       []string
+	Labels        []string
+	HasAttachment bool
+	Before        time.Time
+	After         time.Time
+}
+
+// searchDateLayouts are the date formats accepted by before: and after:
+var searchDateLayouts = []string{"2006-01-02", "2006/01/02", "2006.01.02"}
+
+// ParseSearchQuery splits a query such as `from:acme subject:"march invoice" has:attachment`
+// into structured criteria. Unknown operators are kept as free text.
+func ParseSearchQuery(query string) *SearchQuery {
+	q := &SearchQuery{}
+
+	for _, token := range tokenizeSearchQuery(query) {
+		op, value, found := strings.Cut(token, ":")
+		if !found || value == "" {
+			q.Terms = append(q.Terms, token)
+			continue
+		}
+
+		switch strings.ToLower(op) {
+		case "from":
+			q.From = append(q.From, value)
+		case "to":
+			q.To = append(q.To, value)
+		case "subject":
+			q.Subject = append(q.Subject, value)
+		case "label":
+			q.Labels = append(q.Labels, value)
+		case "has":
+			if strings.EqualFold(value, "attachment") {
+				q.HasAttachment = true
+			} else {
+				q.Terms = append(q.Terms, token)
+			}
+		case "before":
+			if t, ok := parseSearchDate(value); ok {
+				q.Before = t
+			} else {
+				q.Terms = append(q.Terms, token)
+			}
+		case "after":
+			if t, ok := parseSearchDate(value); ok {
+				q.After = t
+			} else {
+				q.Terms = append(q.Terms, token)
+			}
+		default:
+			q.Terms = append(q.Terms, token)
+		}
+	}
+
+	return q
+}
+
+// IsEmpty reports whether the query has no criteria at all
+func (q *SearchQuery) IsEmpty() bool {
+	return len(q.Terms) == 0 && len(q.From) == 0 && len(q.To) == 0 &&
+		len(q.Subject) == 0 && len(q.Labels) == 0 && !q.HasAttachment &&
+		q.Before.IsZero() && q.After.IsZero()
+}
+
+// Criteria converts the query to IMAP search criteria. Free text terms are
+// matched against the field selected by scope ("from", "to", "subject",
+// "body" or anything else for all text). Labels are local to LilMail and
+// are not part of the IMAP criteria.
+func (q *SearchQuery) Criteria(scope string) *imap.SearchCriteria {
+	criteria := imap.NewSearchCriteria()
+
+	for _, term := range q.Terms {
+		switch scope {
+		case "from":
+			criteria.Header.Add("From", term)
+		case "to":
+			criteria.Header.Add("To", term)
+		case "subject":
+			criteria.Header.Add("Subject", term)
+		case "body":
+			criteria.Body = append(criteria.Body, term)
+		default:
+			// Text searches Subject, From, To, Cc, Bcc, and Body
+			criteria.Text = append(criteria.Text, term)
+		}
+	}
+
+	for _, from := range q.From {
+		criteria.Header.Add("From", from)
+	}
+	for _, to := range q.To {
+		criteria.Header.Add("To", to)
+	}
+	for _, subject := range q.Subject {
+		criteria.Header.Add("Subject", subject)
+	}
+
+	if !q.After.IsZero() {
+		criteria.Since = q.After
+	}
+	if !q.Before.IsZero() {
+		criteria.Before = q.Before
+	}
+
+	// IMAP doesn't have a standard HAS_ATTACHMENT flag.
+	// Checking Header "Content-Type" for "multipart/mixed" is a common approximation.
+	if q.HasAttachment {
+		criteria.Header.Add("Content-Type", "multipart/mixed")
+	}
+
+	return criteria
+}
+
+// tokenizeSearchQuery splits a query on whitespace, keeping double-quoted
+// phrases (including operator values like subject:"a b") together
+func tokenizeSearchQuery(query string) []string {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, r := range query {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case unicode.IsSpace(r) && !inQuotes:
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// parseSearchDate parses a before:/after: value
+func parseSearchDate(value string) (time.Time, bool) {
+	for _, layout := range searchDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"html"
+	"html/template"
+	"lilmail/models"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// snippetContext is the number of bytes of context kept on each side of the first match
+const snippetContext = 60
+
+// HighlightTerms returns the terms that should be marked in result snippets
+func (q *SearchQuery) HighlightTerms() []string {
+	terms := make([]string, 0, len(q.Terms)+len(q.Subject))
+	terms = append(terms, q.Terms...)
+	terms = append(terms, q.Subject...)
+	return terms
+}
+
+// highlightPattern builds a case-insensitive pattern matching any of the terms,
+// longest first so overlapping terms mark the widest match
+func highlightPattern(terms []string) *regexp.Regexp {
+	quoted := make([]string, 0, len(terms))
+	for _, term := range terms {
+		if term = strings.TrimSpace(term); term != "" {
+			quoted = append(quoted, regexp.QuoteMeta(term))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	sort.Slice(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+	return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
+
+// AddSearchSnippets sets a highlighted match-context snippet on each email.
+// The snippet is cut around the first match in the body (or preview), falling
+// back to the subject so users can see why a message matched.
+func AddSearchSnippets(emails []models.Email, terms []string) {
+	pattern := highlightPattern(terms)
+	if pattern == nil {
+		return
+	}
+
+	for i := range emails {
+		email := &emails[i]
+		for _, text := range []string{email.Body, email.Preview, email.Subject} {
+			text = strings.Join(strings.Fields(text), " ")
+			if snippet, ok := buildSnippet(text, pattern); ok {
+				email.Snippet = snippet
+				break
+			}
+		}
+	}
+}
+
+// buildSnippet cuts text around the first match of pattern and wraps every
+// match in the window in <mark>. The text is escaped before it is marked.
+func buildSnippet(text string, pattern *regexp.Regexp) (template.HTML, bool) {
+	loc := pattern.FindStringIndex(text)
+	if loc == nil {
+		return "", false
+	}
+
+	start := loc[0] - snippetContext
+	if start < 0 {
+		start = 0
+	}
+	end := loc[1] + snippetContext
+	if end > len(text) {
+		end = len(text)
+	}
+	// Don't split multi-byte characters
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	window := text[start:end]
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("...")
+	}
+	last := 0
+	for _, m := range pattern.FindAllStringIndex(window, -1) {
+		b.WriteString(html.EscapeString(window[last:m[0]]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(window[m[0]:m[1]]))
+		b.WriteString("</mark>")
+		last = m[1]
+	}
+	b.WriteString(html.EscapeString(window[last:]))
+	if end < len(text) {
+		b.WriteString("...")
+	}
+
+	return template.HTML(b.String()), true
+}
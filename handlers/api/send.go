@@ -1,139 +1,87 @@
 package api
 
 import (
-	"io"
-	"strings"
-	"lilmail/config"
-	"lilmail/utils"
+	"mime/multipart"
+	"lilmail/models"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/session"
 )
 
 // SendHandler handles email sending
 type SendHandler struct {
-	store  *session.Store
-	config *config.Config
+	mailer *Mailer
 }
 
 // NewSendHandler creates a new send handler
-func NewSendHandler(store *session.Store, cfg *config.Config) *SendHandler {
+func NewSendHandler(mailer *Mailer) *SendHandler {
 	return &SendHandler{
-		store:  store,
-		config: cfg,
+		mailer: mailer,
 	}
 }
 
-// SendRequest represents an email send request
-type SendRequest struct {
-	To      string `json:"to"`
-	Cc      string `json:"cc"`
-	Bcc     string `json:"bcc"`
-	Subject string `json:"subject"`
-	Body    string `json:"body"`
-	IsHTML  bool   `json:"is_html"`
-}
-
-// HandleSend handles the email send request
-// HandleSend handles the email send request
-func (h *SendHandler) HandleSend(c *fiber.Ctx) error {
-	var to, cc, bcc, subject, body string
-	var isHTML bool
-	var attachments []AttachmentData
-
-	contentType := c.Get("Content-Type")
-
-	if strings.Contains(contentType, "multipart/form-data") {
-		// Handle Multipart Form (for attachments)
-		form, err := c.MultipartForm()
-		if err != nil {
-			return utils.BadRequestError("Invalid form data", err)
-		}
-
-		// Get standard fields
-		if v, ok := form.Value["to"]; ok && len(v) > 0 { to = v[0] }
-		if v, ok := form.Value["cc"]; ok && len(v) > 0 { cc = v[0] }
-		if v, ok := form.Value["bcc"]; ok && len(v) > 0 { bcc = v[0] }
-		if v, ok := form.Value["subject"]; ok && len(v) > 0 { subject = v[0] }
-		if v, ok := form.Value["body"]; ok && len(v) > 0 { body = v[0] }
-		if v, ok := form.Value["is_html"]; ok && len(v) > 0 { isHTML = v[0] == "true" }
-
-		// Process attachments
-		for _, files := range form.File {
-			for _, file := range files {
-				// Open file
-				f, err := file.Open()
-				if err != nil {
-					utils.Log.Error("Failed to open attachment: %v", err)
-					continue
-				}
-				defer f.Close()
-
-				// Read content
-				data, err := io.ReadAll(f)
-				if err != nil {
-					utils.Log.Error("Failed to read attachment: %v", err)
-					continue
-				}
-
-				// Create attachment data
-				att := AttachmentData{
-					Filename:    file.Filename,
-					ContentType: file.Header.Get("Content-Type"),
-					Data:        data,
-				}
-				if att.ContentType == "" {
-					att.ContentType = DetectContentType(file.Filename)
-				}
-
-				attachments = append(attachments, att)
+// CheckAttachments checks the files of an outgoing email, uploaded or
+// forwarded from another message, against the attachment limits. It returns
+// one message per problem, naming the file, and the status to reject the
+// email with: 413 when something is too large, otherwise 415 for blocked
+// file types.
+func CheckAttachments(limits models.SystemSettings, files []*multipart.FileHeader, forwarded []AttachmentData, bodySize int) (int, []string) {
+	var problems []string
+	tooLarge := false
+
+	total := int64(bodySize)
+	check := func(filename string, size int64) {
+		total += size
+		if err := limits.CheckAttachment(filename, size); err != nil {
+			problems = append(problems, err.Error())
+			if size > limits.MaxAttachmentBytes() {
+				tooLarge = true
 			}
 		}
-
-	} else {
-		// Handle JSON (legacy/no-attachment)
-		var req SendRequest
-		if err := c.BodyParser(&req); err != nil {
-			return utils.BadRequestError("Invalid request", err)
-		}
-		to = req.To
-		cc = req.Cc
-		bcc = req.Bcc
-		subject = req.Subject
-		body = req.Body
-		isHTML = req.IsHTML
 	}
-
-	// Validate required fields
-	if to == "" || subject == "" {
-		return utils.BadRequestError("Missing required fields (to, subject)", nil)
+	for _, file := range files {
+		check(file.Filename, file.Size)
+	}
+	for _, file := range forwarded {
+		check(file.Filename, int64(len(file.Data)))
+	}
+	if err := limits.CheckMessageSize(total); err != nil {
+		problems = append(problems, err.Error())
+		tooLarge = true
 	}
 
-	// Get session credentials
-	credentials, err := GetCredentials(c, h.store, h.config.Encryption.Key)
-	if err != nil {
-		return utils.UnauthorizedError("Invalid session", err)
+	if len(problems) == 0 {
+		return fiber.StatusOK, nil
+	}
+	if tooLarge {
+		return fiber.StatusRequestEntityTooLarge, problems
 	}
+	return fiber.StatusUnsupportedMediaType, problems
+}
 
-	// Create SMTP client
-	smtpClient := NewSMTPClient(
-		h.config.SMTP.Server,
-		h.config.SMTP.Port,
-		credentials.Email,
-		credentials.Password,
-	)
+// SendRequest represents an email send request
+type SendRequest struct {
+	To      string `json:"to" form:"to"`
+	Cc      string `json:"cc" form:"cc"`
+	Bcc     string `json:"bcc" form:"bcc"`
+	Subject string `json:"subject" form:"subject"`
+	Body    string `json:"body" form:"body"`
+	IsHTML  bool   `json:"is_html" form:"is_html"`
+	DraftID string `json:"draft_id,omitempty" form:"draft_id"` // Draft deleted once the email is sent
+}
 
-	// Send email
-	err = smtpClient.SendMail(to, cc, bcc, subject, body, isHTML, attachments)
+// HandleSend sends an email posted as JSON, or as a multipart form with
+// its attachments
+func (h *SendHandler) HandleSend(c *fiber.Ctx) error {
+	out, err := ParseOutgoingMail(c)
 	if err != nil {
-		return utils.InternalServerError("Failed to send email", err)
+		return err
+	}
+	if err := h.mailer.Send(c, out); err != nil {
+		return err
 	}
-
-	utils.Log.Info("Email sent successfully: to=%s subject=%s attachments=%d", to, subject, len(attachments))
 
 	return c.JSON(fiber.Map{
 		"success": true,
 		"message": "Email sent successfully",
 	})
 }
-
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// SendmailClient sends mail through the sendmail program of the MTA on the
+// lilmail host, which needs no login
+type SendmailClient struct {
+	path  string
+	email string
+}
+
+// NewSendmailClient creates a client that sends as email with the sendmail
+// program at path
+func NewSendmailClient(path, email string) *SendmailClient {
+	return &SendmailClient{
+		path:  path,
+		email: email,
+	}
+}
+
+// SendMail hands a message to sendmail. Recipients are given as arguments,
+// so Bcc recipients stay out of the headers as they do over SMTP.
+func (c *SendmailClient) SendMail(to, cc, bcc, subject, body string, isHTML bool, attachments []AttachmentData) error {
+	args := []string{"-i", "-f", c.email, "--"}
+	for _, list := range []string{to, cc, bcc} {
+		for _, addr := range strings.Split(list, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				args = append(args, addr)
+			}
+		}
+	}
+	if len(args) == 4 {
+		return fmt.Errorf("no recipients")
+	}
+
+	var message bytes.Buffer
+	if err := writeMessage(&message, c.email, to, cc, "", subject, body, isHTML, attachments); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(c.path, args...)
+	cmd.Stdin = &message
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sendmail failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"lilmail/config"
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// Share link lifetimes
+const (
+	defaultShareHours = 7 * 24
+	maxShareHours     = 30 * 24
+	// keepExpiredShares is how long expired links stay listed before they
+	// are deleted
+	keepExpiredShares = 30 * 24 * time.Hour
+)
+
+// sharedPageCSP keeps a shared message from running scripts or loading
+// anything; it is sandboxed away from the app's origin entirely
+const sharedPageCSP = "default-src 'none'; img-src data:; style-src 'unsafe-inline'; frame-ancestors 'none'; " +
+	"sandbox allow-popups allow-popups-to-escape-sandbox allow-downloads"
+
+// ShareHandler handles sharing messages by expiring public links
+type ShareHandler struct {
+	store   *session.Store
+	config  *config.Config
+	storage *storage.ShareStorage
+	system  *storage.SystemSettingsStorage
+}
+
+// NewShareHandler creates a new share handler
+func NewShareHandler(store *session.Store, cfg *config.Config, shareStorage *storage.ShareStorage, systemSettings *storage.SystemSettingsStorage) *ShareHandler {
+	return &ShareHandler{
+		store:   store,
+		config:  cfg,
+		storage: shareStorage,
+		system:  systemSettings,
+	}
+}
+
+// ShareRequest is the body of a request to share a message
+type ShareRequest struct {
+	Folder             string `json:"folder" form:"folder"`
+	ExpiresInHours     int    `json:"expires_in_hours" form:"expires_in_hours"`
+	IncludeAttachments bool   `json:"include_attachments" form:"include_attachments"`
+}
+
+// shareSignature signs a link's ID and expiry, so a link can't be guessed
+// or have its expiry changed
+func (h *ShareHandler) shareSignature(share *models.SharedEmail) string {
+	mac := hmac.New(sha256.New, []byte(h.config.Encryption.Key))
+	fmt.Fprintf(mac, "%s.%d", share.ID, share.ExpiresAt.Unix())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareURL is the public link of a shared message
+func (h *ShareHandler) shareURL(c *fiber.Ctx, share *models.SharedEmail) string {
+	return fmt.Sprintf("%s/share/%s.%s", c.BaseURL(), share.ID, h.shareSignature(share))
+}
+
+// shareSummary describes a link to its owner, without the message copy
+func (h *ShareHandler) shareSummary(c *fiber.Ctx, share *models.SharedEmail) fiber.Map {
+	summary := fiber.Map{
+		"id":          share.ID,
+		"folder":      share.Folder,
+		"email_id":    share.EmailID,
+		"subject":     share.Email.Subject,
+		"attachments": len(share.Attachments),
+		"expires_at":  share.ExpiresAt,
+		"revoked":     share.Revoked,
+		"active":      share.Active(),
+		"views":       share.Views,
+		"created_at":  share.CreatedAt,
+	}
+	if share.Active() {
+		summary["url"] = h.shareURL(c, share)
+	}
+	return summary
+}
+
+// CreateShare copies a message into a new expiring link
+func (h *ShareHandler) CreateShare(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	emailID := c.Params("id")
+	if emailID == "" {
+		return utils.BadRequestError("Email ID is required", nil)
+	}
+
+	var req ShareRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+	if req.Folder == "" {
+		req.Folder = "INBOX"
+	}
+	if req.ExpiresInHours == 0 {
+		req.ExpiresInHours = defaultShareHours
+	}
+	if req.ExpiresInHours < 1 || req.ExpiresInHours > maxShareHours {
+		return utils.BadRequestError(fmt.Sprintf("Links can last from 1 to %d hours", maxShareHours), nil)
+	}
+
+	credentials, err := GetCredentials(c, h.store, h.config.Encryption.Key)
+	if err != nil {
+		return utils.UnauthorizedError("Invalid session", err)
+	}
+
+	client, err := NewMailClient(credentials, h.config)
+	if err != nil {
+		return utils.InternalServerError("Failed to connect to server", err)
+	}
+	defer client.Close()
+
+	email, err := client.FetchSingleMessage(req.Folder, emailID)
+	if err != nil {
+		return utils.NotFoundError("Email not found", err)
+	}
+
+	// The copy is read-only and shown to people outside the mailbox
+	email.Flags = nil
+	email.Labels = nil
+	share := &models.SharedEmail{
+		UserID:    userID,
+		Folder:    req.Folder,
+		EmailID:   emailID,
+		Email:     email,
+		ExpiresAt: time.Now().Add(time.Duration(req.ExpiresInHours) * time.Hour),
+	}
+
+	if req.IncludeAttachments {
+		limits := h.system.Current()
+		var total int64
+		for i := range email.Attachments {
+			attachment, err := client.FetchAttachment(req.Folder, emailID, i)
+			if err != nil {
+				return utils.InternalServerError("Failed to fetch attachment", err)
+			}
+			total += int64(len(attachment.Content))
+			if err := limits.CheckMessageSize(total); err != nil {
+				return utils.NewAppError(fiber.StatusRequestEntityTooLarge, "The attachments are too large to share", err)
+			}
+			share.Attachments = append(share.Attachments, models.SharedAttachment{
+				Filename:    attachment.Filename,
+				ContentType: attachment.ContentType,
+				Content:     attachment.Content,
+			})
+		}
+	}
+
+	if err := h.storage.CreateShare(share); err != nil {
+		return utils.InternalServerError("Failed to create link", err)
+	}
+	if err := h.storage.DeleteExpired(keepExpiredShares); err != nil {
+		utils.Log.Warn("Failed to delete expired shares: %v", err)
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"share":   h.shareSummary(c, share),
+	})
+}
+
+// GetShares lists the current user's links
+func (h *ShareHandler) GetShares(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	shares, err := h.storage.GetSharesByUser(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to retrieve links", err)
+	}
+
+	summaries := make([]fiber.Map, 0, len(shares))
+	for _, share := range shares {
+		summaries = append(summaries, h.shareSummary(c, share))
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"shares":  summaries,
+	})
+}
+
+// RevokeShare stops one of the current user's links from opening
+func (h *ShareHandler) RevokeShare(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	share, err := h.storage.GetShare(c.Params("id"))
+	if err != nil || share.UserID != userID {
+		return utils.NotFoundError("Link not found", err)
+	}
+
+	if err := h.storage.RevokeShare(share.ID); err != nil {
+		return utils.InternalServerError("Failed to revoke link", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Link revoked",
+	})
+}
+
+// sharedEmail looks up the message a public link token opens. Links that
+// are forged, expired or revoked all look the same to the visitor.
+func (h *ShareHandler) sharedEmail(token string) (*models.SharedEmail, error) {
+	id, signature, ok := strings.Cut(token, ".")
+	if !ok || id == "" {
+		return nil, utils.NotFoundError("Link not found", nil)
+	}
+
+	share, err := h.storage.GetShare(id)
+	if err != nil {
+		return nil, utils.NotFoundError("Link not found", err)
+	}
+	if !hmac.Equal([]byte(signature), []byte(h.shareSignature(share))) || !share.Active() {
+		return nil, utils.NotFoundError("Link not found", nil)
+	}
+	return share, nil
+}
+
+// HandleSharedEmail shows a shared message to anyone with its link
+func (h *ShareHandler) HandleSharedEmail(c *fiber.Ctx) error {
+	share, err := h.sharedEmail(c.Params("token"))
+	if err != nil {
+		return err
+	}
+
+	if err := h.storage.RecordView(share.ID); err != nil {
+		utils.Log.Warn("Failed to record view of share %s: %v", share.ID, err)
+	}
+
+	// Remote images would tell the sender's trackers who opened the link
+	body, _ := utils.RewriteRemoteImages(string(share.Email.HTML), true, false)
+
+	// Only attachments that were shared are listed
+	email := share.Email
+	email.Attachments = nil
+	for _, attachment := range share.Attachments {
+		email.Attachments = append(email.Attachments, models.Attachment{
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Size:        len(attachment.Content),
+		})
+	}
+
+	c.Set("Content-Security-Policy", sharedPageCSP)
+	c.Set("Cache-Control", "private, no-store")
+	c.Set("X-Robots-Tag", "noindex")
+	return c.Render("print", fiber.Map{
+		"Title": share.Email.Subject,
+		"Messages": []fiber.Map{{
+			"Email": email,
+			"Body":  template.HTML(body),
+		}},
+		"Offline":        true,
+		"AttachmentsURL": "/share/" + c.Params("token") + "/attachments",
+		"SharedUntil":    share.ExpiresAt,
+		"Timezone":       "",
+	}, "")
+}
+
+// HandleSharedAttachment downloads an attachment of a shared message
+func (h *ShareHandler) HandleSharedAttachment(c *fiber.Ctx) error {
+	share, err := h.sharedEmail(c.Params("token"))
+	if err != nil {
+		return err
+	}
+
+	index, err := strconv.Atoi(c.Params("index"))
+	if err != nil || index < 0 || index >= len(share.Attachments) {
+		return utils.NotFoundError("Attachment not found", err)
+	}
+	attachment := share.Attachments[index]
+
+	c.Set("Content-Type", attachment.ContentType)
+	c.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	c.Set("X-Content-Type-Options", "nosniff")
+	c.Set("Cache-Control", "private, no-store")
+	return c.Send(attachment.Content)
+}
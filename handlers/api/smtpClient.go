@@ -6,10 +6,14 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"lilmail/config"
+	"lilmail/utils"
 	"math/rand"
+	"net"
 	"net/smtp"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,9 +23,19 @@ type SMTPClient struct {
 	server   string
 	port     int
 	email    string
+	username string // Logs in as the address's local part when empty
 	password string
+	// accessToken logs in over XOAUTH2 as the address instead of with
+	// the password
+	accessToken string
+	// dialer connects to server, checking the deny list unless admins
+	// configured the server
+	dialer *net.Dialer
 }
 
+// smtpDialTimeout bounds connecting to an SMTP server
+const smtpDialTimeout = 30 * time.Second
+
 // AttachmentData represents a file attachment
 type AttachmentData struct {
 	Filename    string
@@ -36,6 +50,33 @@ func NewSMTPClient(server string, port int, email, password string) *SMTPClient
 		port:     port,
 		email:    email,
 		password: password,
+		dialer:   accountDialer(smtpDialTimeout),
+	}
+}
+
+// NewXOAuth2SMTPClient creates a new SMTP client that logs in over XOAUTH2
+// with an OAuth access token
+func NewXOAuth2SMTPClient(server string, port int, email, accessToken string) *SMTPClient {
+	return &SMTPClient{
+		server:      server,
+		port:        port,
+		email:       email,
+		accessToken: accessToken,
+		dialer:      accountDialer(smtpDialTimeout),
+	}
+}
+
+// NewRelayClient creates a client that sends as email through the
+// configured relay, logging in with the relay's own credentials. Admins
+// configure the relay, so it isn't held to the server deny list.
+func NewRelayClient(relay config.SMTPRelayConfig, email string) *SMTPClient {
+	return &SMTPClient{
+		server:   relay.Host,
+		port:     relay.Port,
+		email:    email,
+		username: relay.Username,
+		password: relay.Password,
+		dialer:   &net.Dialer{Timeout: smtpDialTimeout},
 	}
 }
 
@@ -45,16 +86,20 @@ func (c *SMTPClient) SendMail(to, cc, bcc, subject, body string, isHTML bool, at
 	fmt.Printf("Connecting to %s:%d as %s\n", c.server, c.port, c.email)
 
 	// Connect to the server
-	addr := fmt.Sprintf("%s:%d", c.server, c.port)
-	client, err := smtp.Dial(addr)
+	addr := net.JoinHostPort(c.server, strconv.Itoa(c.port))
+	conn, err := c.dialer.Dial("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("dial failed: %v", err)
 	}
+	client, err := smtp.NewClient(conn, c.server)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("dial failed: %v", err)
+	}
 	defer client.Close()
 
 	// Send EHLO with domain from email
-	domain := GetDomainFromEmail(c.email)
-	if err := client.Hello(domain); err != nil {
+	if err := client.Hello(GetDomainFromEmail(c.email)); err != nil {
 		return fmt.Errorf("hello failed: %v", err)
 	}
 
@@ -67,9 +112,15 @@ func (c *SMTPClient) SendMail(to, cc, bcc, subject, body string, isHTML bool, at
 		return fmt.Errorf("starttls failed: %v", err)
 	}
 
-	username := GetUsernameFromEmail(c.email)
+	username := c.username
+	if username == "" {
+		username = GetUsernameFromEmail(c.email)
+	}
 	// Authenticate after TLS
 	auth := smtp.PlainAuth("", username, c.password, c.server)
+	if c.accessToken != "" {
+		auth = &xoauth2Auth{username: c.email, accessToken: c.accessToken}
+	}
 	if err = client.Auth(auth); err != nil {
 		return fmt.Errorf("auth failed: %v", err)
 	}
@@ -109,7 +160,26 @@ func (c *SMTPClient) SendMail(to, cc, bcc, subject, body string, isHTML bool, at
 	if err != nil {
 		return fmt.Errorf("data failed: %v", err)
 	}
-	
+	// Bcc recipients stay out of the headers
+	if err := writeMessage(writer, c.email, to, cc, "", subject, body, isHTML, attachments); err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("data close failed: %v", err)
+	}
+
+	return client.Quit()
+}
+
+// writeMessage writes an email as MIME text from the given address. Bcc is
+// only written as a header when given, for senders that read recipients
+// from the headers.
+func writeMessage(writer io.Writer, email, to, cc, bcc, subject, body string, isHTML bool, attachments []AttachmentData) error {
+	username := GetUsernameFromEmail(email)
+	domain := GetDomainFromEmail(email)
+
 	// Construct Headers
 	now := time.Now().Format(time.RFC1123Z)
 	mixedBoundary := fmt.Sprintf("mixed-%s", generateBoundary())
@@ -117,12 +187,14 @@ func (c *SMTPClient) SendMail(to, cc, bcc, subject, body string, isHTML bool, at
 
 	headers := make(map[string]string)
 	headers["Date"] = now
-	headers["From"] = fmt.Sprintf("%s <%s>", username, c.email)
+	headers["From"] = fmt.Sprintf("%s <%s>", username, email)
 	headers["To"] = to
 	if cc != "" {
 		headers["Cc"] = cc
 	}
-	// BCC is usually not added to headers
+	if bcc != "" {
+		headers["Bcc"] = bcc
+	}
 	headers["Subject"] = subject
 	headers["MIME-Version"] = "1.0"
 	headers["Message-ID"] = fmt.Sprintf("<%s@%s>", generateMessageID(), domain)
@@ -189,21 +261,15 @@ func (c *SMTPClient) SendMail(to, cc, bcc, subject, body string, isHTML bool, at
 			return err
 		}
 	}
-	
-	err = writer.Close()
-	if err != nil {
-		return fmt.Errorf("data close failed: %v", err)
-	}
 
-	return client.Quit()
+	return nil
 }
 
 func writeAlternativePart(w io.Writer, body string, boundary string) {
-	// Plain text version (stripped HTML or raw body)
+	// Plain text version rendered from the HTML
 	fmt.Fprintf(w, "--%s\r\n", boundary)
 	fmt.Fprintf(w, "Content-Type: text/plain; charset=\"utf-8\"\r\n\r\n")
-	// Simple strip for plain text fallback
-	plainText := stripHTMLTags(body) 
+	plainText := utils.HTMLToText(body)
 	fmt.Fprintf(w, "%s\r\n", plainText)
 
 	// HTML version
@@ -212,11 +278,6 @@ func writeAlternativePart(w io.Writer, body string, boundary string) {
 	fmt.Fprintf(w, "%s\r\n", body)
 }
 
-func stripHTMLTags(html string) string {
-    // Basic stripper
-	return strings.ReplaceAll(strings.ReplaceAll(html, "<br>", "\n"), "<div>", "\n") 
-}
-
 func generateBoundary() string {
 	return fmt.Sprintf("%x", rand.Int63())
 }
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Snippet limits
+const (
+	maxSnippetNameLength = 100
+	maxSnippetLength     = 10000
+)
+
+// snippetShortcutPattern is what may follow ";" to insert a snippet
+var snippetShortcutPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// SnippetHandler handles compose snippet requests
+type SnippetHandler struct {
+	storage *storage.SnippetStorage
+}
+
+// NewSnippetHandler creates a new snippet handler
+func NewSnippetHandler(snippetStorage *storage.SnippetStorage) *SnippetHandler {
+	return &SnippetHandler{
+		storage: snippetStorage,
+	}
+}
+
+// SnippetRequest is the body of a request to create or edit a snippet
+type SnippetRequest struct {
+	Name     string `json:"name"`
+	Shortcut string `json:"shortcut"`
+	Body     string `json:"body"`
+}
+
+// GetSnippets lists the current user's snippets
+func (h *SnippetHandler) GetSnippets(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	snippets, err := h.storage.GetSnippets(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to retrieve snippets", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"snippets": snippets,
+	})
+}
+
+// CreateSnippet adds a snippet
+func (h *SnippetHandler) CreateSnippet(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	snippet := &models.Snippet{UserID: userID}
+	if err := h.applyRequest(c, snippet); err != nil {
+		return err
+	}
+
+	if err := h.save(snippet); err != nil {
+		return err
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"snippet": snippet,
+	})
+}
+
+// UpdateSnippet edits one of the current user's snippets
+func (h *SnippetHandler) UpdateSnippet(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	snippet, err := h.storage.GetSnippet(userID, c.Params("id"))
+	if err != nil {
+		return utils.NotFoundError("Snippet not found", err)
+	}
+	if err := h.applyRequest(c, snippet); err != nil {
+		return err
+	}
+
+	if err := h.save(snippet); err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"snippet": snippet,
+	})
+}
+
+// DeleteSnippet removes one of the current user's snippets
+func (h *SnippetHandler) DeleteSnippet(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	if err := h.storage.DeleteSnippet(userID, c.Params("id")); err != nil {
+		return utils.NotFoundError("Snippet not found", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Snippet deleted",
+	})
+}
+
+// applyRequest validates a create or edit request into snippet
+func (h *SnippetHandler) applyRequest(c *fiber.Ctx, snippet *models.Snippet) error {
+	var req SnippetRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	req.Shortcut = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(req.Shortcut), ";"))
+
+	switch {
+	case req.Name == "":
+		return utils.BadRequestError("Name is required", nil)
+	case len(req.Name) > maxSnippetNameLength:
+		return utils.BadRequestError("Name is too long", nil)
+	case strings.TrimSpace(req.Body) == "":
+		return utils.BadRequestError("Snippet is empty", nil)
+	case len(req.Body) > maxSnippetLength:
+		return utils.BadRequestError("Snippet is too long", nil)
+	case req.Shortcut != "" && !snippetShortcutPattern.MatchString(req.Shortcut):
+		return utils.BadRequestError("Shortcuts may only use letters, digits, - and _, up to 32 characters", nil)
+	}
+
+	snippet.Name = req.Name
+	snippet.Shortcut = req.Shortcut
+	snippet.Body = req.Body
+	return nil
+}
+
+// save stores a snippet, reporting a taken shortcut as a conflict
+func (h *SnippetHandler) save(snippet *models.Snippet) error {
+	err := h.storage.SaveSnippet(snippet)
+	if err == storage.ErrShortcutTaken {
+		return utils.NewAppError(fiber.StatusConflict, "Another snippet already uses this shortcut", err)
+	}
+	if err != nil {
+		return utils.InternalServerError("Failed to save snippet", err)
+	}
+	return nil
+}
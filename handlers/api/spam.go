@@ -0,0 +1,227 @@
+package api
+
+import (
+	"fmt"
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+)
+
+const (
+	// spamThreshold is the score at or above which new mail is moved to Junk
+	spamThreshold = 0.99
+	// spamMaxMessageTokens caps the tokens taken from one message
+	spamMaxMessageTokens = 1000
+)
+
+// SpamFilter is a local Naive Bayes spam classifier per user. It is trained
+// by the user marking messages as spam or not spam, and scores new INBOX
+// mail for users who turned it on.
+type SpamFilter struct {
+	models   *storage.SpamStorage
+	settings *storage.SettingsStorage
+	mu       sync.Mutex
+}
+
+// NewSpamFilter creates a new spam filter
+func NewSpamFilter(spamStorage *storage.SpamStorage, settingsStorage *storage.SettingsStorage) *SpamFilter {
+	return &SpamFilter{
+		models:   spamStorage,
+		settings: settingsStorage,
+	}
+}
+
+// Train trains the user's classifier with a message marked as spam or not
+// spam. Marking a message the other way retrains it.
+func (f *SpamFilter) Train(userID string, email *models.Email, spam bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	model, err := f.models.GetModel(userID)
+	if err != nil {
+		return err
+	}
+	if !model.Train(email.MessageID, spamTokens(email), spam) {
+		return nil
+	}
+	return f.models.SaveModel(userID, model)
+}
+
+// Reset forgets everything the user's classifier was trained on
+func (f *SpamFilter) Reset(userID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.models.DeleteModel(userID)
+}
+
+// Stats returns how many spam and non-spam messages the user trained
+func (f *SpamFilter) Stats(userID string) (spam, ham int, err error) {
+	model, err := f.models.GetModel(userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return model.SpamMessages, model.HamMessages, nil
+}
+
+// Filter first junks or deletes new INBOX messages from senders the user
+// blocked, then scores the rest for users who turned the spam filter on. If
+// they also chose to, messages scoring at least spamThreshold are moved to
+// the Junk folder; the remaining messages are returned. Nothing is scored
+// until the classifier has been trained with enough of both kinds of mail.
+func (f *SpamFilter) Filter(client MailClient, userID string, emails []models.Email) []models.Email {
+	if f == nil || len(emails) == 0 {
+		return emails
+	}
+
+	settings, err := f.settings.GetSettings(userID)
+	if err != nil {
+		utils.Log.Error("Spam filter: failed to load settings for %s: %v", userID, err)
+		return emails
+	}
+	emails = blockSenders(client, userID, settings, emails)
+	if !settings.SpamFilter || len(emails) == 0 {
+		return emails
+	}
+
+	model, err := f.models.GetModel(userID)
+	if err != nil {
+		utils.Log.Error("Spam filter: failed to load model for %s: %v", userID, err)
+		return emails
+	}
+	if !model.Ready() {
+		return emails
+	}
+
+	var junk string
+	var remaining []models.Email
+	for _, email := range emails {
+		score := model.Score(spamTokens(&email))
+		utils.Log.Debug("Spam filter: message %s for %s scored %.3f", email.ID, userID, score)
+		if score < spamThreshold || !settings.SpamAutoMove {
+			remaining = append(remaining, email)
+			continue
+		}
+
+		if junk == "" {
+			if junk, err = JunkFolder(client); err != nil {
+				utils.Log.Error("Spam filter: failed to find junk folder for %s: %v", userID, err)
+				return append(remaining, email)
+			}
+		}
+		if err := client.MoveMessage("INBOX", junk, email.ID); err != nil {
+			utils.Log.Error("Spam filter: failed to move %s for %s: %v", email.ID, userID, err)
+			remaining = append(remaining, email)
+		}
+	}
+	return remaining
+}
+
+// JunkFolder returns the folder spam is kept in: the one with the \Junk
+// attribute, else one with a usual junk folder name, else a new "Junk" folder
+func JunkFolder(client MailClient) (string, error) {
+	folders, err := client.FetchFolders()
+	if err != nil {
+		return "", err
+	}
+
+	for _, folder := range folders {
+		for _, attr := range folder.Attributes {
+			if attr == imap.JunkAttr {
+				return folder.Name, nil
+			}
+		}
+	}
+	for _, name := range []string{"Junk", "Spam", "Junk Mail", "Junk E-mail"} {
+		for _, folder := range folders {
+			if strings.EqualFold(folder.Name, name) {
+				return folder.Name, nil
+			}
+		}
+	}
+
+	if err := client.CreateFolder("Junk"); err != nil {
+		return "", fmt.Errorf("error creating Junk folder: %v", err)
+	}
+	return "Junk", nil
+}
+
+// spamTokens returns the distinct tokens of a message that the classifier
+// counts: words of the subject and body, and the sender's address and domain.
+// Text without spaces between words, like Japanese, is split into pairs of
+// characters.
+func spamTokens(email *models.Email) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	add := func(token string) {
+		if len(tokens) < spamMaxMessageTokens && !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	from := strings.ToLower(strings.TrimSpace(email.From))
+	if from != "" {
+		add("from:" + from)
+		if at := strings.LastIndex(from, "@"); at >= 0 {
+			add("from:" + from[at:])
+		}
+	}
+	if email.HasAttachments {
+		add("has:attachment")
+	}
+
+	for _, word := range spamWords(email.Subject) {
+		add("subject:" + word)
+	}
+	body := email.Body
+	if body == "" {
+		body = email.Preview
+	}
+	for _, word := range spamWords(body) {
+		add(word)
+	}
+	return tokens
+}
+
+// spamWords splits text into lower case words of 2 to 30 characters, leaving
+// out plain numbers. Runs of CJK characters become overlapping pairs.
+func spamWords(text string) []string {
+	var words []string
+	var word, cjk []rune
+
+	flushWord := func() {
+		if n := len(word); n >= 2 && n <= 30 && strings.IndexFunc(string(word), unicode.IsLetter) >= 0 {
+			words = append(words, string(word))
+		}
+		word = word[:0]
+	}
+	flushCJK := func() {
+		for i := 0; i+1 < len(cjk); i++ {
+			words = append(words, string(cjk[i:i+2]))
+		}
+		cjk = cjk[:0]
+	}
+
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '$' || r == '\'':
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return words
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SystemSettingsHandler lets admins change the operational limits of the
+// instance without editing config.toml and restarting
+type SystemSettingsHandler struct {
+	storage *storage.SystemSettingsStorage
+}
+
+// NewSystemSettingsHandler creates a new system settings handler
+func NewSystemSettingsHandler(systemSettings *storage.SystemSettingsStorage) *SystemSettingsHandler {
+	return &SystemSettingsHandler{
+		storage: systemSettings,
+	}
+}
+
+// GetSettings returns the settings in effect and the config.toml defaults
+func (h *SystemSettingsHandler) GetSettings(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"settings": h.storage.Current(),
+		"defaults": h.storage.Defaults(),
+	})
+}
+
+// UpdateSettings replaces the settings; they apply to the next request
+func (h *SystemSettingsHandler) UpdateSettings(c *fiber.Ctx) error {
+	settings := h.storage.Current()
+	if err := c.BodyParser(&settings); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+
+	updatedBy := ""
+	if admin, ok := c.Locals("adminUser").(*models.User); ok {
+		updatedBy = admin.Username
+	}
+
+	if err := settings.Validate(); err != nil {
+		return utils.BadRequestError(err.Error(), err)
+	}
+	if err := h.storage.Save(settings, updatedBy); err != nil {
+		return utils.InternalServerError("Failed to save system settings", err)
+	}
+
+	utils.Log.Info("System settings updated by %s", updatedBy)
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"settings": h.storage.Current(),
+	})
+}
+
+// ResetSettings goes back to the config.toml values
+func (h *SystemSettingsHandler) ResetSettings(c *fiber.Ctx) error {
+	if err := h.storage.Reset(); err != nil {
+		return utils.InternalServerError("Failed to reset system settings", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"settings": h.storage.Current(),
+	})
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"fmt"
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// ThemeHandler handles theme listing, selection and admin uploads
+type ThemeHandler struct {
+	store       *session.Store
+	storage     *storage.ThemeStorage
+	userStorage *storage.UserStorage
+}
+
+// NewThemeHandler creates a new theme handler
+func NewThemeHandler(store *session.Store, themeStorage *storage.ThemeStorage, userStorage *storage.UserStorage) *ThemeHandler {
+	return &ThemeHandler{
+		store:       store,
+		storage:     themeStorage,
+		userStorage: userStorage,
+	}
+}
+
+// GetThemes lists the built-in and custom themes and the user's choice
+func (h *ThemeHandler) GetThemes(c *fiber.Ctx) error {
+	username, ok := c.Locals("username").(string)
+	if !ok || username == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	themes, err := h.allThemes()
+	if err != nil {
+		return utils.InternalServerError("Failed to retrieve themes", err)
+	}
+
+	current := "light"
+	if user, err := h.userStorage.GetUserByUsername(username); err == nil && user.Theme != "" {
+		current = user.Theme
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"themes":  themes,
+		"current": current,
+	})
+}
+
+// SetTheme saves the theme the user picked
+func (h *ThemeHandler) SetTheme(c *fiber.Ctx) error {
+	username, ok := c.Locals("username").(string)
+	if !ok || username == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	var req struct {
+		Theme string `json:"theme" form:"theme"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+	if !h.themeExists(req.Theme) {
+		return utils.BadRequestError("Unknown theme", nil)
+	}
+
+	user, err := h.userStorage.GetUserByUsername(username)
+	if err != nil {
+		return utils.NotFoundError("User not found", err)
+	}
+	user.Theme = req.Theme
+	if err := h.userStorage.UpdateUser(user); err != nil {
+		return utils.InternalServerError("Failed to save theme", err)
+	}
+
+	// The layout reads the theme from the session
+	sess, err := h.store.Get(c)
+	if err != nil {
+		return utils.InternalServerError("Failed to get session", err)
+	}
+	sess.Set("theme", req.Theme)
+	if err := sess.Save(); err != nil {
+		return utils.InternalServerError("Failed to save session", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"theme":   req.Theme,
+	})
+}
+
+// CreateTheme uploads a custom theme (Admin only)
+func (h *ThemeHandler) CreateTheme(c *fiber.Ctx) error {
+	if !h.isAdmin(c) {
+		return utils.ForbiddenError("Access denied", nil)
+	}
+
+	var req models.Theme
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return utils.BadRequestError("Theme name is required", nil)
+	}
+	if len(req.Variables) == 0 {
+		return utils.BadRequestError("At least one CSS variable is required", nil)
+	}
+	for name, value := range req.Variables {
+		if !models.ValidThemeVariable(name, value) {
+			return utils.BadRequestError(fmt.Sprintf("Invalid CSS variable %q", name), nil)
+		}
+	}
+
+	// IDs are generated so they can't collide with built-in themes
+	req.ID = ""
+	if err := h.storage.CreateTheme(&req); err != nil {
+		return utils.InternalServerError("Failed to create theme", err)
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"theme":   req,
+	})
+}
+
+// DeleteTheme removes a custom theme (Admin only). Users who picked it fall
+// back to the light theme.
+func (h *ThemeHandler) DeleteTheme(c *fiber.Ctx) error {
+	if !h.isAdmin(c) {
+		return utils.ForbiddenError("Access denied", nil)
+	}
+
+	id := c.Params("id")
+	if models.BuiltinTheme(id) != nil {
+		return utils.BadRequestError("Built-in themes can't be deleted", nil)
+	}
+	if _, err := h.storage.GetTheme(id); err != nil {
+		return utils.NotFoundError("Theme not found", err)
+	}
+
+	if err := h.storage.DeleteTheme(id); err != nil {
+		return utils.InternalServerError("Failed to delete theme", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Theme deleted",
+	})
+}
+
+// ThemeCSS serves the custom themes as a stylesheet, one data-theme rule
+// per theme
+func (h *ThemeHandler) ThemeCSS(c *fiber.Ctx) error {
+	themes, err := h.storage.ListThemes()
+	if err != nil {
+		return utils.InternalServerError("Failed to retrieve themes", err)
+	}
+
+	var css strings.Builder
+	for _, theme := range themes {
+		names := make([]string, 0, len(theme.Variables))
+		for name := range theme.Variables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(&css, "/* %s */\n[data-theme=\"%s\"] {\n", strings.ReplaceAll(theme.Name, "*/", ""), theme.ID)
+		for _, name := range names {
+			// Checked on upload, but don't trust what's in the database
+			if models.ValidThemeVariable(name, theme.Variables[name]) {
+				fmt.Fprintf(&css, "    %s: %s;\n", name, theme.Variables[name])
+			}
+		}
+		css.WriteString("}\n\n")
+	}
+
+	c.Set(fiber.HeaderContentType, "text/css; charset=utf-8")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	return c.SendString(css.String())
+}
+
+// allThemes returns the built-in themes followed by the custom ones
+func (h *ThemeHandler) allThemes() ([]*models.Theme, error) {
+	custom, err := h.storage.ListThemes()
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]*models.Theme{}, models.BuiltinThemes...), custom...), nil
+}
+
+// themeExists reports whether id can be picked as a user's theme
+func (h *ThemeHandler) themeExists(id string) bool {
+	if id == models.ThemeAuto || models.BuiltinTheme(id) != nil {
+		return true
+	}
+	_, err := h.storage.GetTheme(id)
+	return err == nil
+}
+
+// isAdmin checks the role of the logged-in user
+func (h *ThemeHandler) isAdmin(c *fiber.Ctx) bool {
+	var user *models.User
+	var err error
+	if userID, ok := c.Locals("userId").(string); ok && userID != "" {
+		user, err = h.userStorage.GetUser(userID)
+	} else if username, ok := c.Locals("username").(string); ok && username != "" {
+		user, err = h.userStorage.GetUserByUsername(username)
+	} else {
+		return false
+	}
+	return err == nil && user.Role == "admin"
+}
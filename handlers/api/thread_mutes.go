@@ -0,0 +1,176 @@
+package api
+
+import (
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"sync"
+	"time"
+)
+
+// ThreadMutes keeps track of the conversations a user muted. New replies to
+// a muted conversation raise no notification and are archived on arrival.
+type ThreadMutes struct {
+	threads *storage.ThreadStorage
+	mu      sync.Mutex
+}
+
+// NewThreadMutes creates a new thread mutes tracker
+func NewThreadMutes(threadStorage *storage.ThreadStorage) *ThreadMutes {
+	return &ThreadMutes{threads: threadStorage}
+}
+
+// Mute mutes the conversation of thread for the user
+func (m *ThreadMutes) Mute(userID string, thread *models.EmailThread) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mutes, err := m.threads.GetMutedThreads(userID)
+	if err != nil {
+		return err
+	}
+
+	mutes = removeMutes(mutes, thread)
+	mutes = append(mutes, models.MutedThread{
+		ThreadID:   thread.ID,
+		MessageIDs: threadMessageIDs(thread),
+		MutedAt:    time.Now(),
+	})
+	return m.threads.SaveMutedThreads(userID, mutes)
+}
+
+// Unmute unmutes the conversation of thread for the user
+func (m *ThreadMutes) Unmute(userID string, thread *models.EmailThread) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mutes, err := m.threads.GetMutedThreads(userID)
+	if err != nil {
+		return err
+	}
+	return m.threads.SaveMutedThreads(userID, removeMutes(mutes, thread))
+}
+
+// MarkMuted sets the Muted flag of the user's muted threads
+func (m *ThreadMutes) MarkMuted(userID string, threads []*models.EmailThread) {
+	if m == nil || len(threads) == 0 {
+		return
+	}
+
+	mutes, err := m.threads.GetMutedThreads(userID)
+	if err != nil {
+		utils.Log.Error("Thread mutes: failed to load mutes for %s: %v", userID, err)
+		return
+	}
+
+	for _, thread := range threads {
+		thread.Muted = false
+		for i := range mutes {
+			if muteCovers(&mutes[i], thread) {
+				thread.Muted = true
+				break
+			}
+		}
+	}
+}
+
+// Archive moves new INBOX messages that belong to a muted conversation to the
+// archive folder and returns the remaining ones. The Message-IDs of archived
+// replies are added to their mute so replies to them are caught too.
+func (m *ThreadMutes) Archive(client MailClient, userID string, emails []models.Email) []models.Email {
+	if m == nil || len(emails) == 0 {
+		return emails
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mutes, err := m.threads.GetMutedThreads(userID)
+	if err != nil {
+		utils.Log.Error("Thread mutes: failed to load mutes for %s: %v", userID, err)
+		return emails
+	}
+	if len(mutes) == 0 {
+		return emails
+	}
+
+	var archive string
+	var remaining []models.Email
+	changed := false
+	for _, email := range emails {
+		mute := matchingMute(mutes, &email)
+		if mute == nil {
+			remaining = append(remaining, email)
+			continue
+		}
+
+		if email.MessageID != "" {
+			mute.MessageIDs = append(mute.MessageIDs, email.MessageID)
+			changed = true
+		}
+
+		if archive == "" {
+			if archive, err = client.ArchiveFolder(); err != nil {
+				utils.Log.Error("Thread mutes: failed to find archive folder for %s: %v", userID, err)
+				continue
+			}
+		}
+		if err := client.MoveMessage("INBOX", archive, email.ID); err != nil {
+			utils.Log.Error("Thread mutes: failed to archive %s for %s: %v", email.ID, userID, err)
+		}
+	}
+
+	if changed {
+		if err := m.threads.SaveMutedThreads(userID, mutes); err != nil {
+			utils.Log.Error("Thread mutes: failed to save mutes for %s: %v", userID, err)
+		}
+	}
+	return remaining
+}
+
+// matchingMute returns the mute that email belongs to, if any
+func matchingMute(mutes []models.MutedThread, email *models.Email) *models.MutedThread {
+	for i := range mutes {
+		if mutes[i].Matches(email) {
+			return &mutes[i]
+		}
+	}
+	return nil
+}
+
+// removeMutes drops the mutes that cover thread
+func removeMutes(mutes []models.MutedThread, thread *models.EmailThread) []models.MutedThread {
+	var kept []models.MutedThread
+	for i := range mutes {
+		if !muteCovers(&mutes[i], thread) {
+			kept = append(kept, mutes[i])
+		}
+	}
+	return kept
+}
+
+// muteCovers reports whether mute is for thread. Thread IDs change when a
+// conversation is rebuilt, so its messages are compared as well.
+func muteCovers(mute *models.MutedThread, thread *models.EmailThread) bool {
+	if mute.ThreadID == thread.ID {
+		return true
+	}
+	for i := range thread.Messages {
+		if mute.Matches(&thread.Messages[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// threadMessageIDs returns the Message-IDs of a thread's messages. Messages
+// without one fall back to their UID when threaded, which is left out here.
+func threadMessageIDs(thread *models.EmailThread) []string {
+	var ids []string
+	for _, email := range thread.Messages {
+		if email.MessageID != "" && email.MessageID != email.ID {
+			ids = append(ids, email.MessageID)
+		}
+	}
+	return ids
+}
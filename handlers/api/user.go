@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"lilmail/config"
 	"lilmail/models"
 	"lilmail/storage"
@@ -26,6 +27,17 @@ func NewUserHandler(store *session.Store, cfg *config.Config, userStorage *stora
 	}
 }
 
+// CurrentUser loads the logged in user's record
+func CurrentUser(c *fiber.Ctx, users *storage.UserStorage) (*models.User, error) {
+	if userID, ok := c.Locals("userId").(string); ok && userID != "" {
+		return users.GetUser(userID)
+	}
+	if username := GetSessionUser(c); username != "" {
+		return users.GetUserByUsername(username)
+	}
+	return nil, errors.New("user not authenticated")
+}
+
 // GetUsers retrieves all users (Admin only)
 func (h *UserHandler) GetUsers(c *fiber.Ctx) error {
 	// Verify Admin Role
@@ -92,6 +104,43 @@ func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
 	})
 }
 
+// UpdateLimits sets a user's resource limits (Admin only)
+func (h *UserHandler) UpdateLimits(c *fiber.Ctx) error {
+	if !h.isAdmin(c) {
+		return utils.ForbiddenError("Access denied", nil)
+	}
+
+	userID := c.Params("id")
+	if userID == "" {
+		return utils.BadRequestError("User ID required", nil)
+	}
+
+	var req models.UserLimits
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+	if err := req.Validate(); err != nil {
+		return utils.BadRequestError(err.Error(), nil)
+	}
+
+	user, err := h.storage.GetUser(userID)
+	if err != nil {
+		return utils.NotFoundError("User not found", err)
+	}
+
+	user.Limits = req
+	if err := h.storage.UpdateUser(user); err != nil {
+		return utils.InternalServerError("Failed to update limits", err)
+	}
+
+	user.PasswordHash = ""
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"user":    user,
+	})
+}
+
 // DeleteUser deletes a user (Admin only)
 func (h *UserHandler) DeleteUser(c *fiber.Ctx) error {
     // Verify Admin Role
@@ -122,6 +171,11 @@ func (h *UserHandler) DeleteUser(c *fiber.Ctx) error {
 
 // Helper to check admin role
 func (h *UserHandler) isAdmin(c *fiber.Ctx) bool {
+    // Already checked by AdminMiddleware on the admin routes
+    if _, ok := c.Locals("adminUser").(*models.User); ok {
+        return true
+    }
+
     userID, ok := c.Locals("userId").(string) // Ensure userId is set in Locals by middleware
     if !ok || userID == "" {
         // Fallback or check storage?
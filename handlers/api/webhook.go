@@ -0,0 +1,304 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/google/uuid"
+)
+
+const (
+	// webhookAttempts is the number of delivery attempts per event
+	webhookAttempts = 3
+	// webhookRetryDelay is the delay before the first retry, doubled for each retry
+	webhookRetryDelay = 5 * time.Second
+)
+
+// webhookEvents are the events a webhook can subscribe to
+var webhookEvents = []string{
+	models.WebhookEventNewEmail,
+	models.WebhookEventSendFailed,
+	models.WebhookEventLoginFromNewDevice,
+}
+
+// WebhookPayload is the JSON body posted to webhook URLs
+type WebhookPayload struct {
+	ID    string                 `json:"id"`
+	Event string                 `json:"event"`
+	Time  time.Time              `json:"time"`
+	User  string                 `json:"user"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+// WebhookDispatcher delivers events to the webhooks registered by users
+type WebhookDispatcher struct {
+	storage *storage.WebhookStorage
+	client  *http.Client
+}
+
+// NewWebhookDispatcher creates a new webhook dispatcher. Webhook URLs are
+// chosen by users, so deliveries refuse to connect to private, loopback and
+// link-local addresses.
+func NewWebhookDispatcher(webhookStorage *storage.WebhookStorage) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		storage: webhookStorage,
+		client:  newPublicClient(10 * time.Second),
+	}
+}
+
+// Dispatch sends an event to every active webhook of the user subscribed to it.
+// Notifications that aren't webhook events are ignored. Deliveries happen in
+// the background.
+func (d *WebhookDispatcher) Dispatch(userID string, notification Notification) {
+	if !isWebhookEvent(notification.Type) {
+		return
+	}
+
+	webhooks, err := d.storage.GetWebhooksByUser(userID)
+	if err != nil {
+		utils.Log.Error("Failed to load webhooks for %s: %v", userID, err)
+		return
+	}
+
+	payload := WebhookPayload{
+		ID:    notification.ID,
+		Event: notification.Type,
+		Time:  notification.Time,
+		User:  userID,
+		Data:  notification.Data,
+	}
+
+	for _, webhook := range webhooks {
+		if webhook.Wants(notification.Type) {
+			go d.deliver(webhook, payload)
+		}
+	}
+}
+
+// deliver posts a payload to a webhook, retrying with backoff on failure
+func (d *WebhookDispatcher) deliver(webhook *models.Webhook, payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = d.post(webhook, payload, body)
+		if err == nil {
+			return nil
+		}
+		if attempt == webhookAttempts {
+			break
+		}
+		utils.Log.Warn("Webhook %s delivery attempt %d failed: %v", webhook.ID, attempt, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	utils.Log.Error("Webhook %s delivery of %s failed: %v", webhook.ID, payload.Event, err)
+	return err
+}
+
+// post makes a single signed delivery attempt
+func (d *WebhookDispatcher) post(webhook *models.Webhook, payload WebhookPayload, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "LilMail-Webhook")
+	req.Header.Set("X-LilMail-Event", payload.Event)
+	req.Header.Set("X-LilMail-Delivery", payload.ID)
+	req.Header.Set("X-LilMail-Signature", "sha256="+signWebhook(webhook.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of body keyed with the webhook secret
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookHandler handles webhook management requests
+type WebhookHandler struct {
+	store      *session.Store
+	storage    *storage.WebhookStorage
+	dispatcher *WebhookDispatcher
+}
+
+// NewWebhookHandler creates a new webhook handler
+func NewWebhookHandler(store *session.Store, webhookStorage *storage.WebhookStorage, dispatcher *WebhookDispatcher) *WebhookHandler {
+	return &WebhookHandler{
+		store:      store,
+		storage:    webhookStorage,
+		dispatcher: dispatcher,
+	}
+}
+
+// GetWebhooks lists the current user's webhooks
+func (h *WebhookHandler) GetWebhooks(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	webhooks, err := h.storage.GetWebhooksByUser(userID)
+	if err != nil {
+		return utils.InternalServerError("Failed to retrieve webhooks", err)
+	}
+
+	// Secrets are only shown once, on creation
+	for _, webhook := range webhooks {
+		webhook.Secret = ""
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"webhooks": webhooks,
+		"events":   webhookEvents,
+	})
+}
+
+// CreateWebhook registers a new webhook
+func (h *WebhookHandler) CreateWebhook(c *fiber.Ctx) error {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	var req models.Webhook
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequestError("Invalid request", err)
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return utils.BadRequestError("A valid http(s) URL is required", err)
+	}
+
+	for _, event := range req.Events {
+		if !isWebhookEvent(event) {
+			return utils.BadRequestError("Unknown event: "+event, nil)
+		}
+	}
+
+	if req.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return utils.InternalServerError("Failed to generate secret", err)
+		}
+		req.Secret = hex.EncodeToString(secret)
+	}
+
+	req.ID = uuid.New().String()
+	req.UserID = userID
+	req.Active = true
+
+	if err := h.storage.CreateWebhook(&req); err != nil {
+		return utils.InternalServerError("Failed to create webhook", err)
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"webhook": req,
+	})
+}
+
+// DeleteWebhook removes a webhook
+func (h *WebhookHandler) DeleteWebhook(c *fiber.Ctx) error {
+	webhook, err := h.ownedWebhook(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.storage.DeleteWebhook(webhook.ID); err != nil {
+		return utils.InternalServerError("Failed to delete webhook", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Webhook deleted",
+	})
+}
+
+// TestWebhook sends a test event to a webhook and reports the result
+func (h *WebhookHandler) TestWebhook(c *fiber.Ctx) error {
+	webhook, err := h.ownedWebhook(c)
+	if err != nil {
+		return err
+	}
+
+	payload := WebhookPayload{
+		ID:    uuid.New().String(),
+		Event: "test",
+		Time:  time.Now(),
+		User:  webhook.UserID,
+		Data:  map[string]interface{}{"message": "Test delivery from LilMail"},
+	}
+	body, _ := json.Marshal(payload)
+
+	// The error is only logged: it would tell users about hosts and ports
+	// they can't reach themselves
+	if err := h.dispatcher.post(webhook, payload, body); err != nil {
+		utils.Log.Warn("Test delivery of webhook %s failed: %v", webhook.ID, err)
+		return utils.BadRequestError("Test delivery failed", nil)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Test delivery succeeded",
+	})
+}
+
+// ownedWebhook loads the webhook named in the route and checks it belongs to the user
+func (h *WebhookHandler) ownedWebhook(c *fiber.Ctx) (*models.Webhook, error) {
+	userID, ok := c.Locals("username").(string)
+	if !ok || userID == "" {
+		return nil, utils.UnauthorizedError("User not authenticated", nil)
+	}
+
+	webhook, err := h.storage.GetWebhook(c.Params("id"))
+	if err != nil {
+		return nil, utils.NotFoundError("Webhook not found", nil)
+	}
+	if webhook.UserID != userID {
+		return nil, utils.ForbiddenError("Access denied", nil)
+	}
+	return webhook, nil
+}
+
+// isWebhookEvent reports whether event is a known webhook event
+func isWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
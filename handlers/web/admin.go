@@ -46,6 +46,37 @@ func (h *AdminHandler) ShowUsers(c *fiber.Ctx) error {
 	})
 }
 
+// ShowDashboard renders the admin dashboard with instance statistics
+func (h *AdminHandler) ShowDashboard(c *fiber.Ctx) error {
+	token := ""
+	if sess, err := h.store.Get(c); err == nil {
+		if t, ok := sess.Get("token").(string); ok {
+			token = t
+		}
+	}
+
+	return c.Render("admin", fiber.Map{
+		"Title":     "Admin",
+		"Username":  c.Locals("username"),
+		"Token":     token,
+		"CSRFToken": c.Locals("csrf"),
+	})
+}
+
+// apiDocsCSP is the Content-Security-Policy of the API reference, which
+// loads Swagger UI and its styles from unpkg
+const apiDocsCSP = "default-src 'self'; script-src 'self' 'unsafe-inline' https://cdn.tailwindcss.com https://unpkg.com; style-src 'self' 'unsafe-inline' https://unpkg.com; img-src 'self' data: https:; font-src 'self'; connect-src 'self'; frame-ancestors 'none'; base-uri 'self'; form-action 'self';"
+
+// ShowAPIDocs renders Swagger UI over the OpenAPI document of /api
+func (h *AdminHandler) ShowAPIDocs(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentSecurityPolicy, apiDocsCSP)
+	return c.Render("admin/api-docs", fiber.Map{
+		"Title":     "API Reference",
+		"Username":  c.Locals("username"),
+		"CSRFToken": c.Locals("csrf"),
+	})
+}
+
 // Helper to check admin role
 func (h *AdminHandler) isAdmin(c *fiber.Ctx) bool {
     userID, ok := c.Locals("userId").(string)
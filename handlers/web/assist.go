@@ -0,0 +1,109 @@
+package web
+
+import (
+	"lilmail/handlers/api"
+	"lilmail/models"
+	"lilmail/utils"
+	"sort"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxAssistThread caps the earlier messages of a conversation sent along
+// with the one asked about
+const maxAssistThread = 10
+
+// SetAssistant offers reply suggestions and summaries to users who turned
+// them on
+func (h *EmailHandler) SetAssistant(assist *api.Assistant) {
+	h.assistant = assist
+}
+
+// assistEnabled reports whether the signed in user can ask for suggestions
+func (h *EmailHandler) assistEnabled(settings *models.UserSettings) bool {
+	return h.assistant != nil && settings.AssistEnabled
+}
+
+// HandleSuggest returns short reply suggestions for the message named in the
+// route, or with kind=summary a summary of its conversation. Earlier
+// messages of the conversation found in the same folder are sent along.
+func (h *EmailHandler) HandleSuggest(c *fiber.Ctx) error {
+	emailID := c.Params("id")
+	if emailID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Email ID required"})
+	}
+	if !h.assistEnabled(h.userSettings(c)) {
+		return c.Status(403).JSON(fiber.Map{"error": "Reply suggestions are turned off"})
+	}
+
+	folder := c.Get("X-Folder")
+	if folder == "" {
+		folder = c.Query("folder", "INBOX")
+	}
+
+	client, err := h.auth.CreateMailClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error connecting to email server"})
+	}
+	defer client.Close()
+
+	email, err := client.FetchSingleMessage(folder, emailID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Email not found"})
+	}
+	thread := append(earlierMessages(client, folder, &email), email)
+
+	lang, _ := c.Locals("lang").(string)
+	if c.Query("kind") == "summary" {
+		summary, err := h.assistant.Summarize(thread, lang)
+		if err != nil {
+			utils.Log.Error("Failed to summarize %s: %v", emailID, err)
+			return c.Status(502).JSON(fiber.Map{"error": "Failed to get a summary"})
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"summary":  summary,
+			"messages": len(thread),
+		})
+	}
+
+	suggestions, err := h.assistant.SuggestReplies(thread, lang)
+	if err != nil {
+		utils.Log.Error("Failed to suggest replies to %s: %v", emailID, err)
+		return c.Status(502).JSON(fiber.Map{"error": "Failed to get suggestions"})
+	}
+	return c.JSON(fiber.Map{
+		"success":     true,
+		"suggestions": suggestions,
+	})
+}
+
+// earlierMessages returns the messages email refers to that are in folder,
+// oldest first
+func earlierMessages(client api.MailClient, folder string, email *models.Email) []models.Email {
+	refs := email.References
+	if len(refs) > maxAssistThread {
+		refs = refs[len(refs)-maxAssistThread:]
+	}
+
+	var uids []uint32
+	for _, ref := range refs {
+		if uid, err := client.FindUIDByMessageID(folder, ref); err == nil && uid != 0 && strconv.Itoa(int(uid)) != email.ID {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+
+	earlier, err := client.FetchMessagesByUIDs(folder, uids)
+	if err != nil {
+		utils.Log.Warn("Failed to fetch earlier messages of %s: %v", email.ID, err)
+		return nil
+	}
+	sort.Slice(earlier, func(i, j int) bool {
+		return earlier[i].Date.Before(earlier[j].Date)
+	})
+	return earlier
+}
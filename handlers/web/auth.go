@@ -2,6 +2,8 @@
 package web
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"lilmail/config"
 	"lilmail/handlers/api"
@@ -16,23 +18,53 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/google/uuid"
 )
 
 type AuthHandler struct {
 	store          *session.Store
 	config         *config.Config
-	client         *api.Client
 	userStorage    *storage.UserStorage
 	accountStorage *storage.AccountStorage
+	poller         *api.MailPoller
+	idle           *api.IdleManager
+	notify         *api.NotificationHandler
+	system         *storage.SystemSettingsStorage
+	sessions       *storage.FileStorage
+	audit          *storage.AuditStorage
 }
 
 // NewAuthHandler creates a new instance of AuthHandler
-func NewAuthHandler(store *session.Store, config *config.Config, userStorage *storage.UserStorage, accountStorage *storage.AccountStorage) *AuthHandler {
+func NewAuthHandler(store *session.Store, config *config.Config, userStorage *storage.UserStorage, accountStorage *storage.AccountStorage, poller *api.MailPoller, idle *api.IdleManager, notify *api.NotificationHandler, systemSettings *storage.SystemSettingsStorage, sessions *storage.FileStorage) *AuthHandler {
 	return &AuthHandler{
 		store:          store,
 		config:         config,
 		userStorage:    userStorage,
 		accountStorage: accountStorage,
+		poller:         poller,
+		idle:           idle,
+		notify:         notify,
+		system:         systemSettings,
+		sessions:       sessions,
+	}
+}
+
+// SetAudit records logins and logouts in the audit trail
+func (h *AuthHandler) SetAudit(audit *storage.AuditStorage) {
+	h.audit = audit
+}
+
+// recordAudit adds an event to the audit trail, if there is one
+func (h *AuthHandler) recordAudit(c *fiber.Ctx, username, action string) {
+	if h.audit == nil {
+		return
+	}
+	if err := h.audit.Record(&models.AuditEvent{
+		User:   username,
+		Action: action,
+		IP:     c.IP(),
+	}); err != nil {
+		log.Printf("Failed to record %s of %s: %v", action, username, err)
 	}
 }
 
@@ -42,10 +74,11 @@ func (h *AuthHandler) ShowLogin(c *fiber.Ctx) error {
 	if err == nil {
 		authenticated := sess.Get("authenticated")
 		if authenticated == true {
-			return c.Redirect("/inbox")
+			return c.Redirect("/")
 		}
 	}
 	return c.Render("login", fiber.Map{
+		"OAuthName": h.oauthName(),
 		"CSRFToken": c.Locals("csrf"),
 	})
 }
@@ -56,6 +89,8 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Status(500).SendString("Session error")
 	}
+	// Failed logins offer the OAuth provider again
+	c.Bind(fiber.Map{"OAuthName": h.oauthName()})
 
 	email := strings.TrimSpace(c.FormValue("email"))
 	password := strings.TrimSpace(c.FormValue("password"))
@@ -90,6 +125,7 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 		password,
 	)
 	if err != nil {
+		h.recordAudit(c, username, models.AuditLoginFailed)
 		return c.Status(401).Render("login", fiber.Map{
 			"Error": "Invalid credentials or server error",
 			"Email": email,
@@ -98,6 +134,102 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 	}
 	defer client.Close()
 
+	return h.completeLogin(c, sess, client, email, username, password, "")
+}
+
+// ShowOAuthLogin sends the user to sign in at the OAuth provider, which
+// sends them back to HandleOAuthCallback
+func (h *AuthHandler) ShowOAuthLogin(c *fiber.Ctx) error {
+	if !h.config.OAuth.Enabled() {
+		return c.Redirect("/login")
+	}
+	sess, err := h.store.Get(c)
+	if err != nil {
+		return c.Status(500).SendString("Session error")
+	}
+
+	state, verifier, err := api.NewOAuthState()
+	if err != nil {
+		return c.Status(500).SendString("Failed to start sign-in")
+	}
+	sess.Set("oauthState", state)
+	sess.Set("oauthVerifier", verifier)
+	if err := sess.Save(); err != nil {
+		return c.Status(500).SendString("Session error")
+	}
+
+	return c.Redirect(api.OAuthAuthCodeURL(h.config.OAuth, h.oauthRedirectURI(), state, verifier))
+}
+
+// HandleOAuthCallback logs in the user the OAuth provider sent back, over
+// XOAUTH2 with the tokens of their sign-in
+func (h *AuthHandler) HandleOAuthCallback(c *fiber.Ctx) error {
+	sess, err := h.store.Get(c)
+	if err != nil {
+		return c.Status(500).SendString("Session error")
+	}
+	state, _ := sess.Get("oauthState").(string)
+	verifier, _ := sess.Get("oauthVerifier").(string)
+	sess.Delete("oauthState")
+	sess.Delete("oauthVerifier")
+
+	c.Bind(fiber.Map{"OAuthName": h.oauthName()})
+
+	fail := func(status int, message string) error {
+		return c.Status(status).Render("login", fiber.Map{
+			"Error":     message,
+			"CSRFToken": c.Locals("csrf"),
+		})
+	}
+	if reason := c.Query("error"); reason != "" {
+		if description := c.Query("error_description"); description != "" {
+			reason = description
+		}
+		return fail(401, "Sign-in was not completed: "+reason)
+	}
+	if state == "" || c.Query("state") != state {
+		return fail(400, "The sign-in expired, please try again")
+	}
+
+	signIn, err := api.ExchangeOAuthCode(h.config.OAuth, h.oauthRedirectURI(), c.Query("code"), verifier)
+	if err != nil {
+		log.Printf("OAuth sign-in failed: %v", err)
+		return fail(401, "Failed to sign in with "+h.config.OAuth.Name)
+	}
+
+	client, err := api.NewXOAuth2Client(h.config.IMAP.Server, h.config.IMAP.Port, signIn.Email, signIn.AccessToken)
+	if err != nil {
+		h.recordAudit(c, signIn.Email, models.AuditLoginFailed)
+		return fail(401, "The mail server refused the sign-in of "+signIn.Email)
+	}
+	defer client.Close()
+
+	// The username follows username_is_email as for password logins
+	username := signIn.Email
+	if !h.config.Server.UsernameIsEmail {
+		username = api.GetUsernameFromEmail(signIn.Email)
+	}
+	return h.completeLogin(c, sess, client, signIn.Email, username, "", signIn.RefreshToken)
+}
+
+// oauthRedirectURI is where the OAuth provider sends users back to, which
+// must be registered with the provider
+func (h *AuthHandler) oauthRedirectURI() string {
+	return h.config.PublicURL() + "/login/oauth/callback"
+}
+
+// oauthName is the OAuth provider offered on the login page, "" without one
+func (h *AuthHandler) oauthName() string {
+	if !h.config.OAuth.Enabled() {
+		return ""
+	}
+	return h.config.OAuth.Name
+}
+
+// completeLogin starts the session of a user whose mail server accepted
+// their password, or the refreshToken of their OAuth sign-in, and sets up
+// their user record and account
+func (h *AuthHandler) completeLogin(c *fiber.Ctx, sess *session.Session, client api.MailClient, email, username, password, refreshToken string) error {
 	userCacheFolder := filepath.Join(h.config.Cache.Folder, username)
 	if err := h.ensureUserCacheFolder(userCacheFolder); err != nil {
 		return c.Status(500).Render("login", fiber.Map{
@@ -116,7 +248,16 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 		})
 	}
 
-	encryptedCreds, err := api.EncryptCredentials(email, password, h.config.Encryption.Key)
+	// The account keeps the password, or the refresh token of an OAuth
+	// sign-in, it logs in with
+	auth, secret := models.AuthPassword, password
+	var encryptedCreds string
+	if refreshToken != "" {
+		auth, secret = models.AuthXOAuth2, refreshToken
+		encryptedCreds, err = api.EncryptOAuthCredentials(email, refreshToken, h.config.Encryption.Key)
+	} else {
+		encryptedCreds, err = api.EncryptCredentials(email, password, h.config.Encryption.Key)
+	}
 	if err != nil {
 		return c.Status(500).Render("login", fiber.Map{
 			"Error": "Failed to secure credentials",
@@ -128,8 +269,15 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 	// --- Multi-User & Account Logic Start ---
 	
 	// 1. Find or Create User
+	isNewUser := false
 	user, err := h.userStorage.GetUserByEmail(email)
-	if err != nil {
+	if err != nil && !h.system.Current().RegistrationEnabled {
+		return c.Status(403).Render("login", fiber.Map{
+			"Error": "Registration is closed on this instance",
+			"Email": email,
+			"CSRFToken": c.Locals("csrf"),
+		})
+	} else if err != nil {
 		// Create new user if not found
 		newUser := &models.User{
 			Username:    username,
@@ -139,11 +287,17 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 			Language:    "en", // Default, could be from config
 			Theme:       "light",
 		}
-		if err := h.userStorage.CreateUser(newUser, password); err != nil {
+		// Users signed in with OAuth get a password nobody knows
+		userPassword := password
+		if userPassword == "" {
+			userPassword = uuid.New().String()
+		}
+		if err := h.userStorage.CreateUser(newUser, userPassword); err != nil {
 			fmt.Printf("Failed to create user: %v\n", err)
 			// Non-fatal, proceed with session login
 		} else {
 			user = newUser
+			isNewUser = true
 		}
 	} else {
 		// Update last login
@@ -175,8 +329,9 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 				SMTPServer:  h.config.SMTP.Server,
 				SMTPPort:    h.config.SMTP.GetPort(),
 				SMTPSSL:     h.config.SMTP.UseSTARTTLS, // Using StartTLS setting as proxy
+				Auth:        auth,
 				Username:    username,
-				Password:    password, // Will be encrypted by storage
+				Password:    secret, // Will be encrypted by storage
 				DisplayName: username,
 				IsDefault:   len(accounts) == 0,
 			}
@@ -186,12 +341,27 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 			} else {
 				currentAccount = newAccount
 			}
+		} else if currentAccount.UsesJMAP() || currentAccount.UsesPOP3() || currentAccount.UsesGraph() || currentAccount.UsesMaildir() {
+			// The account is read over JMAP, POP3 or Graph with its own saved
+			// password or sign-in, or from the user's Maildir
+			if creds, err := api.EncryptAccountCredentials(currentAccount, h.config.Encryption.Key); err == nil {
+				encryptedCreds = creds
+			}
 		} else {
 			// Update password if changed (detected by successful IMAP login with new password)
-			// Since we can't easily decrypt and compare without overhead, just update it if we are logging in successfully
-			currentAccount.Password = password
+			// Since we can't easily decrypt and compare without overhead, just update it if we are logging in successfully.
+			// Logging in with a password or OAuth switches the account over to it.
+			currentAccount.Auth = auth
+			currentAccount.Password = secret
 			h.accountStorage.UpdateAccount(currentAccount, []byte(h.config.Encryption.Key))
 		}
+
+		// Newer refresh tokens the provider hands out are saved in the account
+		if currentAccount != nil && currentAccount.UsesXOAuth2() {
+			if creds, err := api.EncryptAccountCredentials(currentAccount, h.config.Encryption.Key); err == nil {
+				encryptedCreds = creds
+			}
+		}
 	}
 
 	// --- Multi-User & Account Logic End ---
@@ -205,6 +375,9 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 	// Set UserID and AccountID in session for multi-user/account features
 	if user != nil {
 		sess.Set("userId", user.ID)
+		sess.Set("timezone", user.Timezone)
+		sess.Set("language", user.Language)
+		sess.Set("theme", user.Theme)
 	}
 	if currentAccount != nil {
 		sess.Set("accountId", currentAccount.ID)
@@ -212,6 +385,7 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 	
 	sess.SetExpiry(24 * 60 * 60 * time.Second)
 
+	sessionID := sess.ID() // Save releases the session
 	if err := sess.Save(); err != nil {
 		return c.Status(500).Render("login", fiber.Map{
 			"Error": "Failed to create session",
@@ -220,11 +394,64 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 		})
 	}
 
+	h.recordAudit(c, username, models.AuditLogin)
+
+	// Let admins see and revoke the session
+	if user != nil {
+		if err := h.sessions.Track(sessionID, storage.SessionInfo{
+			UserID:    user.ID,
+			Username:  username,
+			IP:        c.IP(),
+			UserAgent: c.Get("User-Agent"),
+		}); err != nil {
+			log.Printf("Failed to track session for %s: %v", username, err)
+		}
+	}
+
+	// Switch the UI to the user's saved language
+	if user != nil && user.Language != "" {
+		c.Cookie(&fiber.Cookie{
+			Name:  "lang",
+			Value: user.Language,
+			Path:  "/",
+		})
+	}
+
 	if err := h.fetchInitialData(client, userCacheFolder); err != nil {
 		fmt.Printf("Error fetching initial data for user %s: %v\n", username, err)
 	}
 
-	return c.Redirect("/inbox")
+	// Watch for new mail in the background
+	pollCreds := &api.Credentials{Email: email, Password: password}
+	if currentAccount != nil && currentAccount.UsesXOAuth2() {
+		pollCreds = api.CredentialsForAccount(currentAccount)
+	} else if refreshToken != "" {
+		pollCreds = &api.Credentials{Email: email, OAuthToken: refreshToken}
+	}
+	h.poller.Start(username, pollCreds)
+
+	if user != nil {
+		h.checkNewDevice(c, user.ID, username, isNewUser)
+	}
+
+	return c.Redirect("/")
+}
+
+// checkNewDevice records the device used to log in and notifies the user
+// when it hasn't been seen before. A brand new user's first device is just recorded.
+func (h *AuthHandler) checkNewDevice(c *fiber.Ctx, userID, username string, isNewUser bool) {
+	userAgent := c.Get(fiber.HeaderUserAgent)
+	sum := sha256.Sum256([]byte(userAgent))
+	fingerprint := hex.EncodeToString(sum[:8])
+
+	isNew, err := h.userStorage.RecordDevice(userID, fingerprint)
+	if err != nil {
+		utils.Log.Warn("Failed to record login device for %s: %v", username, err)
+		return
+	}
+	if isNew && !isNewUser {
+		h.notify.NotifyLoginFromNewDevice(username, c.IP(), userAgent)
+	}
 }
 
 // HandleLogout processes user logout
@@ -242,6 +469,10 @@ func (h *AuthHandler) HandleLogout(c *fiber.Ctx) error {
 			if err := h.clearUserCache(userCacheFolder); err != nil {
 				fmt.Printf("Error clearing cache for user %s: %v\n", userStr, err)
 			}
+			utils.ClearFolderList(userCacheFolder)
+			h.poller.Stop(userStr)
+			h.idle.Logout(userStr)
+			h.recordAudit(c, userStr, models.AuditLogout)
 		}
 	}
 
@@ -288,12 +519,12 @@ func (h *AuthHandler) clearUserCache(path string) error {
 	return nil
 }
 
-func (h *AuthHandler) fetchInitialData(client *api.Client, cacheFolder string) error {
+func (h *AuthHandler) fetchInitialData(client api.MailClient, cacheFolder string) error {
 	folders, err := client.FetchFolders()
 	if err != nil {
 		return fmt.Errorf("failed to fetch folders: %v", err)
 	}
-	if err := utils.SaveCache(filepath.Join(cacheFolder, "folders.json"), folders); err != nil {
+	if err := utils.SaveFolderList(cacheFolder, folders); err != nil {
 		return fmt.Errorf("failed to cache folders: %v", err)
 	}
 
@@ -309,58 +540,17 @@ func (h *AuthHandler) fetchInitialData(client *api.Client, cacheFolder string) e
 	return nil
 }
 
-// Add this method to the AuthHandler struct
-func (h *AuthHandler) CreateIMAPClient(c *fiber.Ctx) (*api.Client, error) {
-	// Get credentials from session
-	sess, err := h.store.Get(c)
+// CreateMailClient connects to the mail account of the request's session
+func (h *AuthHandler) CreateMailClient(c *fiber.Ctx) (api.MailClient, error) {
+	creds, err := h.sessionCredentials(c)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get session: %v", err)
-	}
-
-	encryptedCreds := sess.Get("credentials")
-	if encryptedCreds == nil {
-		return nil, fmt.Errorf("no credentials found in session")
+		return nil, err
 	}
-
-	encryptedStr, ok := encryptedCreds.(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid credentials format")
-	}
-
-	// Decrypt credentials
-	creds, err := api.DecryptCredentials(encryptedStr, h.config.Encryption.Key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt credentials: %v", err)
-	}
-
-	// Get username from email
-	var username string
-	if h.config.Server.UsernameIsEmail {
-		username = creds.Email
-	} else {
-		username = api.GetUsernameFromEmail(creds.Email)
-	}
-
-	if username == "" {
-		return nil, fmt.Errorf("invalid email format")
-	}
-
-	// Create new IMAP client
-	return api.NewClient(
-		h.config.IMAP.Server,
-		h.config.IMAP.Port,
-		username,
-		creds.Password,
-	)
+	return h.NewMailClient(creds)
 }
 
-func (h *AuthHandler) CreateSMTPClient(c *fiber.Ctx) (*api.SMTPClient, error) {
-	// Convert IMAP server to SMTP server (e.g., imap.gmail.com -> smtp.gmail.com)
-	smtpServer := strings.Replace(h.config.IMAP.Server, "imap.", "smtp.", 1)
-
-	// Get SMTP port from config, or use default
-	smtpPort := h.config.SMTP.GetPort()
-
+// sessionCredentials decrypts the credentials of the request's session
+func (h *AuthHandler) sessionCredentials(c *fiber.Ctx) (*api.Credentials, error) {
 	// Get credentials from session
 	sess, err := h.store.Get(c)
 	if err != nil {
@@ -382,11 +572,12 @@ func (h *AuthHandler) CreateSMTPClient(c *fiber.Ctx) (*api.SMTPClient, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt credentials: %v", err)
 	}
+	return creds, nil
+}
 
-	client := api.NewSMTPClient(smtpServer, smtpPort, creds.Email, creds.Password)
-	if client == nil {
-		return nil, fmt.Errorf("failed to create SMTP client")
-	}
-
-	return client, nil
+// NewMailClient connects to a mail account with already decrypted
+// credentials. Background jobs use this since they cannot read the request
+// session.
+func (h *AuthHandler) NewMailClient(creds *api.Credentials) (api.MailClient, error) {
+	return api.NewMailClient(creds, h.config)
 }
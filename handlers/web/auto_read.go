@@ -0,0 +1,60 @@
+package web
+
+import (
+	"lilmail/handlers/api"
+	"lilmail/utils"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/gofiber/fiber/v2"
+)
+
+// pendingRead is the message a user last opened, waiting to be marked read
+type pendingRead struct {
+	folder  string
+	emailID string
+}
+
+// scheduleMarkRead marks a message as read once it has stayed open for the
+// given delay. Opening another message first cancels the pending mark, so
+// skimming through the list leaves messages unread.
+func (h *EmailHandler) scheduleMarkRead(c *fiber.Ctx, folder, emailID string, delay time.Duration) {
+	creds, err := api.GetCredentials(c, h.store, h.config.Encryption.Key)
+	if err != nil {
+		utils.Log.Warn("Failed to schedule mark as read of %s: %v", emailID, err)
+		return
+	}
+	username := api.GetSessionUser(c)
+	userID, accountID := cacheUserID(c), cacheAccountID(c)
+
+	pending := &pendingRead{folder: folder, emailID: emailID}
+	h.pendingReads.Store(username, pending)
+
+	time.AfterFunc(delay, func() {
+		// Give up if a newer message replaced this one in the meantime
+		if h.pendingReads.CompareAndDelete(username, pending) {
+			h.markRead(creds, username, userID, accountID, folder, emailID)
+		}
+	})
+}
+
+// markRead sets \Seen on a message in the background and updates the cache
+// and the user's open sessions
+func (h *EmailHandler) markRead(creds *api.Credentials, username, userID, accountID, folder, emailID string) {
+	client, err := h.auth.NewMailClient(creds)
+	if err != nil {
+		utils.Log.Warn("Failed to connect to mark %s as read: %v", emailID, err)
+		return
+	}
+	defer client.Close()
+
+	if err := client.MarkMessageAsRead(folder, emailID); err != nil {
+		utils.Log.Warn("Failed to mark email %s as read: %v", emailID, err)
+		return
+	}
+
+	if err := h.messageCache.SetFlag(userID, accountID, folder, emailID, imap.SeenFlag, true); err != nil {
+		utils.Log.Warn("Failed to update message cache: %v", err)
+	}
+	h.notify.NotifyStatusChange(username, emailID, "read")
+}
@@ -0,0 +1,82 @@
+package web
+
+import (
+	"lilmail/handlers/api"
+	"lilmail/utils"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HandleBlockSender blocks the sender of the message named in the route, or
+// their whole domain with scope=domain, so their new mail is junked or
+// deleted as action says. The message itself is junked or deleted right away.
+func (h *EmailHandler) HandleBlockSender(c *fiber.Ctx) error {
+	emailID := c.Params("id")
+	if emailID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Email ID required"})
+	}
+
+	folder := c.Get("X-Folder")
+	if folder == "" {
+		folder = c.Query("folder", "INBOX")
+	}
+
+	var req struct {
+		Scope  string `json:"scope" form:"scope"`
+		Action string `json:"action" form:"action"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	client, err := h.auth.CreateMailClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error connecting to email server"})
+	}
+	defer client.Close()
+
+	email, err := client.FetchSingleMessage(folder, emailID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Email not found"})
+	}
+
+	sender := strings.ToLower(strings.TrimSpace(email.From))
+	if req.Scope == "domain" {
+		if at := strings.LastIndex(sender, "@"); at >= 0 {
+			sender = sender[at:]
+		}
+	}
+
+	username := api.GetSessionUser(c)
+	settings, err := h.settings.GetSettings(username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load settings"})
+	}
+	blocked, err := settings.BlockSender(sender, req.Action)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.settings.SaveSettings(settings); err != nil {
+		utils.Log.Error("Failed to save blocked senders for %s: %v", username, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to save settings"})
+	}
+
+	var junk string
+	if err := api.ApplyBlock(client, blocked, folder, emailID, &junk); err != nil {
+		utils.Log.Error("Failed to %s %s: %v", blocked.Action, emailID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Sender blocked, but the message could not be moved"})
+	}
+	if folder != junk {
+		if err := h.messageCache.DeleteMessage(cacheUserID(c), cacheAccountID(c), folder, emailID); err != nil {
+			utils.Log.Error("Error updating message cache: %v", err)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"sender":  blocked.Sender,
+		"action":  blocked.Action,
+		"moved":   folder != junk,
+	})
+}
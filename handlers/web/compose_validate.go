@@ -0,0 +1,155 @@
+package web
+
+import (
+	"context"
+	"lilmail/utils"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Recipient validation limits
+const (
+	maxValidateRecipients = 100
+	mxLookupTimeout       = 5 * time.Second
+)
+
+// ValidateRecipientsRequest is the body of a recipient validation request.
+// The fields hold comma-separated addresses as typed in compose.
+type ValidateRecipientsRequest struct {
+	To      string `json:"to"`
+	Cc      string `json:"cc"`
+	Bcc     string `json:"bcc"`
+	CheckMX bool   `json:"check_mx"`
+}
+
+// RecipientCheck is the result of validating one recipient
+type RecipientCheck struct {
+	Field      string `json:"field"` // to, cc or bcc
+	Address    string `json:"address"`
+	Valid      bool   `json:"valid"`
+	Error      string `json:"error,omitempty"`
+	Suggestion string `json:"suggestion,omitempty"`  // Likely intended address
+	MailServer *bool  `json:"mail_server,omitempty"` // Whether the domain takes mail, if checked
+	Warning    string `json:"warning,omitempty"`
+}
+
+// HandleValidateRecipients checks compose recipients before sending: their
+// syntax, domains one typo away from a contact's or a common provider's,
+// and optionally whether their domains can receive mail
+func (h *EmailHandler) HandleValidateRecipients(c *fiber.Ctx) error {
+	var req ValidateRecipientsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	var checks []RecipientCheck
+	for _, field := range []struct{ name, value string }{{"to", req.To}, {"cc", req.Cc}, {"bcc", req.Bcc}} {
+		for _, entry := range strings.Split(field.value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				checks = append(checks, RecipientCheck{Field: field.name, Address: entry})
+			}
+		}
+	}
+	if len(checks) > maxValidateRecipients {
+		return c.Status(400).JSON(fiber.Map{"error": "Too many recipients"})
+	}
+
+	// Domains the user writes to regularly are the ones worth matching typos against
+	known := make(map[string]int)
+	if counts, err := h.messageCache.CorrespondentDomains(cacheUserID(c), cacheAccountID(c)); err == nil {
+		for domain, n := range counts {
+			if n >= minContactMessages {
+				known[domain] = n
+			}
+		}
+	}
+
+	domains := make(map[string]bool)
+	for i := range checks {
+		check := &checks[i]
+		addr, err := mail.ParseAddress(check.Address)
+		if err != nil {
+			check.Error = "Not a valid email address"
+			continue
+		}
+		check.Valid = true
+		check.Address = addr.Address
+
+		local, domain := splitAddress(addr.Address)
+		if suggested := utils.SuggestDomain(domain, known); suggested != "" {
+			check.Suggestion = local + "@" + suggested
+			check.Warning = "Did you mean " + check.Suggestion + "?"
+		}
+		domains[strings.ToLower(domain)] = true
+	}
+
+	if req.CheckMX {
+		servers := lookupMailServers(domains)
+		for i := range checks {
+			check := &checks[i]
+			if !check.Valid {
+				continue
+			}
+			_, domain := splitAddress(check.Address)
+			if ok, checked := servers[strings.ToLower(domain)]; checked {
+				check.MailServer = &ok
+				if !ok && check.Warning == "" {
+					check.Warning = domain + " can't receive email"
+				}
+			}
+		}
+	}
+
+	warnings := 0
+	for _, check := range checks {
+		if !check.Valid || check.Warning != "" {
+			warnings++
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"recipients": checks,
+		"warnings":   warnings,
+	})
+}
+
+// lookupMailServers checks in parallel whether each domain takes mail.
+// Domains whose lookup failed are left out.
+func lookupMailServers(domains map[string]bool) map[string]bool {
+	ctx, cancel := context.WithTimeout(context.Background(), mxLookupTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	servers := make(map[string]bool)
+	for domain := range domains {
+		wg.Add(1)
+		go func(domain string) {
+			defer wg.Done()
+			err := utils.CheckMailServer(ctx, domain)
+			if err != nil && err != utils.ErrNoMailServer {
+				utils.Log.Warn("Mail server lookup for %s failed: %v", domain, err)
+				return
+			}
+			mu.Lock()
+			servers[domain] = err == nil
+			mu.Unlock()
+		}(domain)
+	}
+	wg.Wait()
+	return servers
+}
+
+// splitAddress splits an address into its local part and domain
+func splitAddress(address string) (string, string) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address, ""
+	}
+	return address[:at], address[at+1:]
+}
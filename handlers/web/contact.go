@@ -0,0 +1,82 @@
+package web
+
+import (
+	"lilmail/handlers/api"
+	"lilmail/models"
+	"lilmail/utils"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ContactEntry is a message of a correspondence timeline
+type ContactEntry struct {
+	models.Email
+	Sent bool // Sent to the contact rather than received from them
+}
+
+// HandleContact renders the correspondence with one address: every message
+// from or to it in any folder, newest first, with the first and latest
+// contact and actions like writing to or blocking the address
+func (h *EmailHandler) HandleContact(c *fiber.Ctx) error {
+	username := c.Locals("username")
+	if username == nil {
+		return c.Redirect("/login")
+	}
+
+	address := senderAddress(c.Query("address"))
+	if address == "" {
+		return c.Redirect("/inbox")
+	}
+
+	client, err := h.auth.CreateMailClient(c)
+	if err != nil {
+		return c.Status(500).SendString("Error connecting to email server")
+	}
+	defer client.Close()
+
+	emails, err := api.ContactTimeline(client, address)
+	if err != nil {
+		utils.Log.Error("Failed to load correspondence with %s: %v", address, err)
+		return c.Status(500).SendString("Failed to load messages")
+	}
+
+	var name string
+	var received, sent int
+	var first, last time.Time
+	entries := make([]ContactEntry, 0, len(emails))
+	for _, email := range emails {
+		entry := ContactEntry{Email: email, Sent: senderAddress(email.From) != address}
+		if entry.Sent {
+			sent++
+		} else {
+			received++
+			if name == "" {
+				name = email.FromName
+			}
+		}
+		if first.IsZero() || email.Date.Before(first) {
+			first = email.Date
+		}
+		if email.Date.After(last) {
+			last = email.Date
+		}
+		entries = append(entries, entry)
+	}
+
+	return c.Render("contact", fiber.Map{
+		"Username":  username,
+		"Address":   address,
+		"Name":      name,
+		"Entries":   entries,
+		"Received":  received,
+		"Sent":      sent,
+		"First":     first,
+		"Last":      last,
+		"Limited":   len(emails) >= api.ContactTimelineLimit,
+		"Limit":     api.ContactTimelineLimit,
+		"Lang":      c.Locals("lang"),
+		"Timezone":  api.GetSessionTimezone(c),
+		"CSRFToken": c.Locals("csrf"),
+	})
+}
@@ -3,16 +3,21 @@ package web
 
 import (
 	"fmt"
-	"io"
+	"html/template"
 	"lilmail/config"
 	"lilmail/handlers/api"
+	"lilmail/models"
 	"lilmail/storage"
 	"lilmail/utils"
 	"log"
 	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/emersion/go-imap"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
 )
@@ -23,15 +28,140 @@ type EmailHandler struct {
 	auth          *AuthHandler
 	notify        *api.NotificationHandler
 	threadStorage *storage.ThreadStorage
+	messageCache  *storage.MessageCacheStorage
+	labelRules    *api.LabelRules
+	threadMutes   *api.ThreadMutes
+	settings      *storage.SettingsStorage
+	labels        *storage.LabelStorage
+	system        *storage.SystemSettingsStorage
+	drafts        *storage.DraftStorage
+	spamFilter    *api.SpamFilter
+	sentRecipients *storage.SentRecipientStorage
+	assistant     *api.Assistant
+	mailer        *api.Mailer
+	refreshing    sync.Map // Folders with a cache refresh in flight
+	pendingReads  sync.Map // Username to the message waiting to be marked read
+	senderHistories sync.Map // User ID to their cached *senderHistory
 }
 
-func NewEmailHandler(store *session.Store, config *config.Config, auth *AuthHandler, notify *api.NotificationHandler, threadStorage *storage.ThreadStorage) *EmailHandler {
+func NewEmailHandler(store *session.Store, config *config.Config, auth *AuthHandler, notify *api.NotificationHandler, threadStorage *storage.ThreadStorage, messageCache *storage.MessageCacheStorage, labelRules *api.LabelRules, threadMutes *api.ThreadMutes, settingsStorage *storage.SettingsStorage, labelStorage *storage.LabelStorage, systemSettings *storage.SystemSettingsStorage, draftStorage *storage.DraftStorage) *EmailHandler {
 	return &EmailHandler{
 		store:         store,
 		config:        config,
 		auth:          auth,
 		notify:        notify,
 		threadStorage: threadStorage,
+		messageCache:  messageCache,
+		labelRules:    labelRules,
+		threadMutes:   threadMutes,
+		settings:      settingsStorage,
+		labels:        labelStorage,
+		system:        systemSettings,
+		drafts:        draftStorage,
+	}
+}
+
+// SetMailer sets the service the compose form sends mail through
+func (h *EmailHandler) SetMailer(mailer *api.Mailer) {
+	h.mailer = mailer
+}
+
+// cacheUserID returns the ID that per-user storage is keyed by
+func cacheUserID(c *fiber.Ctx) string {
+	if userID, ok := c.Locals("userId").(string); ok && userID != "" {
+		return userID
+	}
+	return api.GetSessionUser(c)
+}
+
+// cacheAccountID returns the account that per-account storage is keyed by,
+// "" for sessions without one
+func cacheAccountID(c *fiber.Ctx) string {
+	accountID, _ := c.Locals("accountId").(string)
+	return accountID
+}
+
+// userSettings returns the signed in user's settings, falling back to the
+// defaults if they can't be loaded
+func (h *EmailHandler) userSettings(c *fiber.Ctx) *models.UserSettings {
+	username := api.GetSessionUser(c)
+	settings, err := h.settings.GetSettings(username)
+	if err != nil {
+		utils.Log.Warn("Failed to load settings for %s: %v", username, err)
+		return models.DefaultUserSettings(username)
+	}
+	return settings
+}
+
+// pageSizeFor returns the number of emails per page: the per_page query
+// parameter carried by pagination links, else the user's setting, within the
+// allowed bounds
+func pageSizeFor(c *fiber.Ctx, settings *models.UserSettings) int {
+	pageSize := settings.EmailsPerPage
+	if n, err := strconv.Atoi(c.Query("per_page")); err == nil && n > 0 {
+		pageSize = n
+	}
+	return models.ClampEmailsPerPage(pageSize)
+}
+
+// HandleHome opens the user's default folder. A "label:<id>" default opens a
+// search for that label. Defaults that no longer exist fall back to INBOX.
+func (h *EmailHandler) HandleHome(c *fiber.Ctx) error {
+	username := api.GetSessionUser(c)
+	target := h.userSettings(c).DefaultFolder
+
+	if labelID, ok := strings.CutPrefix(target, "label:"); ok {
+		if label, err := h.labels.GetLabel(labelID); err == nil && label.UserID == username {
+			return c.Redirect("/inbox?q=" + url.QueryEscape(fmt.Sprintf("label:%q", label.Name)))
+		}
+		utils.Log.Warn("Default label %s of %s no longer exists", labelID, username)
+		return h.HandleInbox(c)
+	}
+
+	if target == "" || strings.EqualFold(target, "INBOX") {
+		return h.HandleInbox(c)
+	}
+	if folder := h.findFolder(username, target); folder != "" {
+		return c.Redirect("/folder/" + url.PathEscape(folder))
+	}
+	utils.Log.Warn("Default folder %s of %s no longer exists", target, username)
+	return h.HandleInbox(c)
+}
+
+// findFolder returns the name of the user's folder matching name, or "" if
+// there is none. "Archive" also matches the server's SPECIAL-USE archive
+// folder, whatever it is called.
+func (h *EmailHandler) findFolder(username, name string) string {
+	var folders []*api.MailboxInfo
+	if err := utils.LoadFolderList(filepath.Join(h.config.Cache.Folder, username), &folders); err != nil {
+		return ""
+	}
+
+	for _, folder := range folders {
+		if folder.Name == name {
+			return folder.Name
+		}
+	}
+	if strings.EqualFold(name, "Archive") {
+		for _, folder := range folders {
+			for _, attr := range folder.Attributes {
+				if attr == imap.ArchiveAttr {
+					return folder.Name
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// setUnreadCounts fills in the sidebar unread counts last pushed to the user,
+// so badges start out right and live updates only need to adjust them
+func (h *EmailHandler) setUnreadCounts(username string, folders []*api.MailboxInfo) {
+	counts := h.notify.UnreadCounts(username)
+	for _, folder := range folders {
+		if count, ok := counts[folder.Name]; ok {
+			folder.UnreadCount = int(count)
+		}
 	}
 }
 
@@ -50,16 +180,10 @@ func (h *EmailHandler) HandleInbox(c *fiber.Ctx) error {
 	// Load folders from cache
 	userCacheFolder := filepath.Join(h.config.Cache.Folder, userStr)
 	var folders []*api.MailboxInfo
-	if err := utils.LoadCache(filepath.Join(userCacheFolder, "folders.json"), &folders); err != nil {
+	if err := utils.LoadFolderList(userCacheFolder, &folders); err != nil {
 		return c.Status(500).SendString("Error loading folders")
 	}
-
-	// Get IMAP client
-	client, err := h.auth.CreateIMAPClient(c)
-	if err != nil {
-		return c.Status(500).SendString("Error connecting to email server")
-	}
-	defer client.Close()
+	h.setUnreadCounts(api.GetSessionUser(c), folders)
 
 	// Check if thread view is requested
 	viewMode := c.Query("view", "flat")
@@ -91,42 +215,31 @@ func (h *EmailHandler) HandleInbox(c *fiber.Ctx) error {
 			page = val
 		}
 	}
-	pageSize := 50
+	settings := h.userSettings(c)
+	pageSize := pageSizeFor(c, settings)
 
 	if isThreaded {
-		// Fetch threaded messages
-		// 1. Try to get from storage first
-		threads, err := h.threadStorage.GetThreadsByFolder(userID, "INBOX")
-		
-		// If cache miss or empty, fetch from IMAP
-		if err != nil || len(threads) == 0 {
-			apiThreads, err := client.FetchThreads("INBOX", 100) // Threading currently fetches recent 100
-			if err != nil {
-				return c.Status(500).SendString("Error fetching threads")
-			}
-			
-			// Save to storage
-			for _, t := range apiThreads {
-				t.UserID = userID
-				t.Folder = "INBOX"
-				h.threadStorage.SaveThread(t)
-			}
-			threads = apiThreads
+		// Fetch a page of threads, served from storage when it covers the page
+		threads, err := h.loadThreadPage(c, userID, "INBOX", page, pageSize)
+		if err != nil {
+			return c.Status(500).SendString("Error fetching threads")
 		}
 
 		return c.Render("inbox", fiber.Map{
 			"Username":      userStr,
 			"Email":         email,
 			"Folders":       folders,
-			"Threads":       threads,
+			"Threads":       threads.Threads,
+			"Pagination":    threads,
 			"CurrentFolder": "INBOX",
+			"Mailto":        c.Locals("mailto"),
 			"Token":         token,
 			"ViewMode":      "threaded",
 			"CSRFToken":     c.Locals("csrf"),
 		})
 	} else {
 		// Fetch paginated messages
-		paginated, err := client.FetchMessagesPaginated("INBOX", uint32(page), uint32(pageSize))
+		paginated, err := h.loadFolderPage(c, userID, "INBOX", page, pageSize)
 		if err != nil {
 			return c.Status(500).SendString("Error fetching emails")
 		}
@@ -138,8 +251,11 @@ func (h *EmailHandler) HandleInbox(c *fiber.Ctx) error {
 			"Emails":        paginated.Emails,
 			"Pagination":    paginated,
 			"CurrentFolder": "INBOX",
+			"Mailto":        c.Locals("mailto"),
 			"Token":         token,
 			"ViewMode":      "flat",
+			"HidePreview":   !settings.ShowPreview,
+			"SearchQuery":   c.Query("q"),
 			"CSRFToken":     c.Locals("csrf"),
 		})
 	}
@@ -165,16 +281,10 @@ func (h *EmailHandler) HandleFolder(c *fiber.Ctx) error {
 	// Load folders for sidebar
 	userCacheFolder := filepath.Join(h.config.Cache.Folder, userStr)
 	var folders []*api.MailboxInfo
-	if err := utils.LoadCache(filepath.Join(userCacheFolder, "folders.json"), &folders); err != nil {
+	if err := utils.LoadFolderList(userCacheFolder, &folders); err != nil {
 		return c.Status(500).SendString("Error loading folders")
 	}
-
-	// Get IMAP client
-	client, err := h.auth.CreateIMAPClient(c)
-	if err != nil {
-		return c.Status(500).SendString("Error connecting to email server")
-	}
-	defer client.Close()
+	h.setUnreadCounts(api.GetSessionUser(c), folders)
 
 	// Check if thread view is requested
 	viewMode := c.Query("view", "flat")
@@ -206,34 +316,22 @@ func (h *EmailHandler) HandleFolder(c *fiber.Ctx) error {
 			page = val
 		}
 	}
-	pageSize := 50
+	settings := h.userSettings(c)
+	pageSize := pageSizeFor(c, settings)
 
 	if isThreaded {
-		// Fetch threaded messages
-		// 1. Try to get from storage first
-		threads, err := h.threadStorage.GetThreadsByFolder(userID, folderName)
-		
-		// If cache miss or empty, fetch from IMAP
-		if err != nil || len(threads) == 0 {
-			apiThreads, err := client.FetchThreads(folderName, 100)
-			if err != nil {
-				return c.Status(500).SendString("Error fetching threads")
-			}
-			
-			// Save to storage
-			for _, t := range apiThreads {
-				t.UserID = userID
-				t.Folder = folderName
-				h.threadStorage.SaveThread(t)
-			}
-			threads = apiThreads
+		// Fetch a page of threads, served from storage when it covers the page
+		threads, err := h.loadThreadPage(c, userID, folderName, page, pageSize)
+		if err != nil {
+			return c.Status(500).SendString("Error fetching threads")
 		}
 
 		return c.Render("inbox", fiber.Map{
 			"Username":      userStr,
 			"Email":         email,
 			"Folders":       folders,
-			"Threads":       threads,
+			"Threads":       threads.Threads,
+			"Pagination":    threads,
 			"CurrentFolder": folderName,
 			"Token":         token,
 			"ViewMode":      "threaded",
@@ -241,7 +339,7 @@ func (h *EmailHandler) HandleFolder(c *fiber.Ctx) error {
 		})
 	} else {
 		// Fetch paginated messages
-		paginated, err := client.FetchMessagesPaginated(folderName, uint32(page), uint32(pageSize))
+		paginated, err := h.loadFolderPage(c, userID, folderName, page, pageSize)
 		if err != nil {
 			return c.Status(500).SendString("Error fetching emails")
 		}
@@ -255,6 +353,8 @@ func (h *EmailHandler) HandleFolder(c *fiber.Ctx) error {
 			"CurrentFolder": folderName,
 			"Token":         token,
 			"ViewMode":      "flat",
+			"HidePreview":   !settings.ShowPreview,
+			"SearchQuery":   c.Query("q"),
 			"CSRFToken":     c.Locals("csrf"),
 		})
 	}
@@ -283,7 +383,7 @@ func (h *EmailHandler) HandleEmailView(c *fiber.Ctx) error {
 	}
 
 	// Get IMAP client
-	client, err := h.auth.CreateIMAPClient(c)
+	client, err := h.auth.CreateMailClient(c)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Error connecting to email server",
@@ -299,14 +399,201 @@ func (h *EmailHandler) HandleEmailView(c *fiber.Ctx) error {
 			"error": fmt.Sprintf("Error fetching email: %v", err),
 		})
 	}
+	settings := h.userSettings(c)
+	if settings.AutoMarkAsRead && !isSeen(email.Flags) {
+		h.scheduleMarkRead(c, folderName, emailID, time.Duration(settings.AutoMarkReadDelay)*time.Second)
+	}
+
+	// The HTML itself loads in a sandboxed frame from HandleEmailBody; the
+	// viewer only needs to know whether images were held back or trackers
+	// removed
+	_, blockedImages, trackers := messageHTML(email, settings, false)
+	warnings := utils.CheckPhishing(email, string(email.HTML), h.contactDomains(c))
+	viewed := []models.Email{email}
+	h.markSenders(c, cacheUserID(c), viewed)
+	email = viewed[0]
+	brandLogo := h.config.Avatars.BIMI && h.passedDMARC(client, folderName, emailID, email.From)
+
 	// Important: Set empty layout and only render the partial
 	return c.Render("partials/email-viewer", fiber.Map{
 		"Email":         email,
 		"CurrentFolder": folderName,
+		"BlockedImages": blockedImages,
+		"Trackers":      trackers,
+		"Warnings":      warnings,
+		"Cards":         utils.SummaryCards(email),
+		"Assist":        h.assistEnabled(settings),
+		"BrandLogo":     brandLogo,
+		"NoteKey":       models.NoteKey(email, folderName),
+		"Username":      api.GetSessionUser(c),
 		"Layout":        "", // This is crucial to prevent full HTML rendering
 	}, "") // Add empty string as second argument to explicitly disable layout
 }
 
+// messageHTML returns the message's sanitized HTML without tracking pixels
+// and with remote images held back, unless the sender is trusted or
+// loadImages is set, along with how many images were held back and how many
+// trackers were removed
+func messageHTML(email models.Email, settings *models.UserSettings, loadImages bool) (template.HTML, int, int) {
+	if email.HTML == "" {
+		return "", 0, 0
+	}
+	stripped, trackers := utils.StripTrackers(string(email.HTML))
+	block := !loadImages && !settings.AllowsImagesFrom(email.From)
+	rewritten, blocked := utils.RewriteRemoteImages(stripped, block, settings.ProxyRemoteImages)
+	return template.HTML(rewritten), blocked, trackers
+}
+
+// passedDMARC reports whether the user's server recorded that a message
+// passed DMARC for its sender's domain, which lets the viewer show the
+// domain's BIMI brand logo
+func (h *EmailHandler) passedDMARC(client api.MailClient, folder, uid, from string) bool {
+	headers, err := client.FetchHeaders(folder, uid)
+	if err != nil {
+		utils.Log.Debug("Failed to fetch headers of %s for BIMI: %v", uid, err)
+		return false
+	}
+	return api.DMARCPass(headers, from)
+}
+
+// minContactMessages is how many cached messages a domain must appear in to
+// count as one the user corresponds with
+const minContactMessages = 2
+
+// contactDomains returns the domains the user corresponds with, judged from
+// the addresses in their cached folders
+func (h *EmailHandler) contactDomains(c *fiber.Ctx) map[string]bool {
+	counts, err := h.messageCache.CorrespondentDomains(cacheUserID(c), cacheAccountID(c))
+	if err != nil {
+		utils.Log.Warn("Failed to load correspondent domains: %v", err)
+		return nil
+	}
+
+	domains := make(map[string]bool)
+	for domain, n := range counts {
+		if n >= minContactMessages {
+			domains[domain] = true
+		}
+	}
+	return domains
+}
+
+// emailBodyCSP keeps message HTML from running scripts, submitting forms or
+// loading anything but images, and sandboxes it away from the app's origin
+// for scripts. Same origin is kept so the viewer can size the frame.
+const emailBodyCSP = "default-src 'none'; img-src 'self' data: https: http:; style-src 'unsafe-inline'; " +
+	"frame-ancestors 'self'; sandbox allow-same-origin allow-popups allow-popups-to-escape-sandbox"
+
+// HandleEmailBody serves a message's HTML as a standalone document for the
+// viewer's sandboxed frame, so gaps in the sanitizer can't reach the app
+func (h *EmailHandler) HandleEmailBody(c *fiber.Ctx) error {
+	folderName := c.Query("folder", "INBOX")
+	emailID := c.Params("id")
+	if emailID == "" {
+		return c.Status(400).SendString("Email ID required")
+	}
+
+	client, err := h.auth.CreateMailClient(c)
+	if err != nil {
+		return c.Status(500).SendString("Error connecting to email server")
+	}
+	defer client.Close()
+
+	email, err := client.FetchSingleMessage(folderName, emailID)
+	if err != nil {
+		log.Printf("Error fetching email %s from folder %s: %v", emailID, folderName, err)
+		return c.Status(404).SendString("Email not found")
+	}
+
+	body, _, _ := messageHTML(email, h.userSettings(c), c.Query("images") == "1")
+
+	c.Set("Content-Security-Policy", emailBodyCSP)
+	c.Set("X-Frame-Options", "SAMEORIGIN")
+	c.Set("Cache-Control", "private, no-store")
+	return c.Render("partials/email-body", fiber.Map{
+		"Body": body,
+	}, "")
+}
+
+// emailPrintCSP is emailBodyCSP for the print view, which opens as a page of
+// its own; modals are allowed so the browser can show its print dialog
+const emailPrintCSP = "default-src 'none'; img-src 'self' data: https: http:; style-src 'unsafe-inline'; " +
+	"frame-ancestors 'none'; sandbox allow-same-origin allow-modals allow-popups allow-popups-to-escape-sandbox"
+
+// HandleEmailPrint renders a message without the app's layout for printing
+// or saving as PDF from the browser: its headers, body and attachment list
+func (h *EmailHandler) HandleEmailPrint(c *fiber.Ctx) error {
+	folderName := c.Query("folder", "INBOX")
+	emailID := c.Params("id")
+	if emailID == "" {
+		return c.Status(400).SendString("Email ID required")
+	}
+
+	client, err := h.auth.CreateMailClient(c)
+	if err != nil {
+		return c.Status(500).SendString("Error connecting to email server")
+	}
+	defer client.Close()
+
+	email, err := client.FetchSingleMessage(folderName, emailID)
+	if err != nil {
+		log.Printf("Error fetching email %s from folder %s: %v", emailID, folderName, err)
+		return c.Status(404).SendString("Email not found")
+	}
+
+	body, _, _ := messageHTML(email, h.userSettings(c), c.Query("images") == "1")
+
+	c.Set("Content-Security-Policy", emailPrintCSP)
+	c.Set("Cache-Control", "private, no-store")
+	return c.Render("print", fiber.Map{
+		"Title":    email.Subject,
+		"Messages": []printMessage{{Email: email, Body: body}},
+	}, "")
+}
+
+// HandleEmailHeaders returns a message's full headers, its Received chain,
+// authentication results and MIME parts, for the viewer's original panel
+func (h *EmailHandler) HandleEmailHeaders(c *fiber.Ctx) error {
+	folderName := c.Query("folder", "INBOX")
+	emailID := c.Params("id")
+	if emailID == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Email ID required",
+		})
+	}
+
+	client, err := h.auth.CreateMailClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error connecting to email server",
+		})
+	}
+	defer client.Close()
+
+	headers, err := client.FetchHeaders(folderName, emailID)
+	if err != nil {
+		log.Printf("Error fetching headers of email %s from folder %s: %v", emailID, folderName, err)
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Email not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"headers": headers,
+	})
+}
+
+// isSeen reports whether a message's flags include \Seen
+func isSeen(flags []string) bool {
+	for _, flag := range flags {
+		if flag == imap.SeenFlag {
+			return true
+		}
+	}
+	return false
+}
+
 // HandleDeleteEmail handles the email deletion request
 func (h *EmailHandler) HandleDeleteEmail(c *fiber.Ctx) error {
 	// Validate Authorization header
@@ -336,7 +623,7 @@ func (h *EmailHandler) HandleDeleteEmail(c *fiber.Ctx) error {
 	}
 
 	// Get IMAP client
-	client, err := h.auth.CreateIMAPClient(c)
+	client, err := h.auth.CreateMailClient(c)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Error connecting to email server",
@@ -352,6 +639,10 @@ func (h *EmailHandler) HandleDeleteEmail(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := h.messageCache.DeleteMessage(cacheUserID(c), cacheAccountID(c), folderName, emailID); err != nil {
+		log.Printf("Error updating message cache: %v", err)
+	}
+
 	// Notify
 	if userID, ok := c.Locals("username").(string); ok {
 		h.notify.NotifyEmailDeleted(userID, emailID)
@@ -386,7 +677,7 @@ func (h *EmailHandler) HandleMarkRead(c *fiber.Ctx) error {
 	}
 
 	// Get IMAP client
-	client, err := h.auth.CreateIMAPClient(c)
+	client, err := h.auth.CreateMailClient(c)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Error connecting to email server",
@@ -402,6 +693,10 @@ func (h *EmailHandler) HandleMarkRead(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := h.messageCache.SetFlag(cacheUserID(c), cacheAccountID(c), folderName, emailID, imap.SeenFlag, true); err != nil {
+		log.Printf("Error updating message cache: %v", err)
+	}
+
 	// Notify
 	if userID, ok := c.Locals("username").(string); ok {
 		h.notify.NotifyStatusChange(userID, emailID, "read")
@@ -436,7 +731,7 @@ func (h *EmailHandler) HandleMarkUnread(c *fiber.Ctx) error {
 	}
 
 	// Get IMAP client
-	client, err := h.auth.CreateIMAPClient(c)
+	client, err := h.auth.CreateMailClient(c)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Error connecting to email server",
@@ -452,6 +747,10 @@ func (h *EmailHandler) HandleMarkUnread(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := h.messageCache.SetFlag(cacheUserID(c), cacheAccountID(c), folderName, emailID, imap.SeenFlag, false); err != nil {
+		log.Printf("Error updating message cache: %v", err)
+	}
+
 	// Notify
 	if userID, ok := c.Locals("username").(string); ok {
 		h.notify.NotifyStatusChange(userID, emailID, "unread")
@@ -488,15 +787,6 @@ func (h *EmailHandler) HandleFolderEmails(c *fiber.Ctx) error {
 		})
 	}
 
-	// Get IMAP client
-	client, err := h.auth.CreateIMAPClient(c)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Error connecting to email server",
-		})
-	}
-	defer client.Close()
-
 	// Parse page number
 	page := 1
 	if p := c.Query("page"); p != "" {
@@ -504,10 +794,11 @@ func (h *EmailHandler) HandleFolderEmails(c *fiber.Ctx) error {
 			page = val
 		}
 	}
-	pageSize := 50
+	settings := h.userSettings(c)
+	pageSize := pageSizeFor(c, settings)
 
 	// Fetch emails from the folder
-	paginated, err := client.FetchMessagesPaginated(folderName, uint32(page), uint32(pageSize))
+	paginated, err := h.loadFolderPage(c, cacheUserID(c), folderName, page, pageSize)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": fmt.Sprintf("Error fetching emails: %v", err),
@@ -522,144 +813,38 @@ func (h *EmailHandler) HandleFolderEmails(c *fiber.Ctx) error {
 		"Pagination":    paginated,
 		"CurrentFolder": folderName,
 		"Token":         token,
+		"HidePreview":   !settings.ShowPreview,
 	}, "") // Explicitly set no layout
 }
 
-// HandleComposeEmail handles the email composition and sending
+// HandleComposeEmail sends an email from the compose form
 func (h *EmailHandler) HandleComposeEmail(c *fiber.Ctx) error {
-
-	// Parse multipart/form-data
-	// Default max memory is 32MB
-	form, err := c.MultipartForm()
-	
-	var to, cc, bcc, subject, body string
-	var isHTML bool
-
-	if err == nil && form != nil {
-		if v, ok := form.Value["to"]; ok && len(v) > 0 { to = v[0] }
-		if v, ok := form.Value["cc"]; ok && len(v) > 0 { cc = v[0] }
-		if v, ok := form.Value["bcc"]; ok && len(v) > 0 { bcc = v[0] }
-		if v, ok := form.Value["subject"]; ok && len(v) > 0 { subject = v[0] }
-		if v, ok := form.Value["body"]; ok && len(v) > 0 { body = v[0] }
-		if v, ok := form.Value["is_html"]; ok && len(v) > 0 { 
-			isHTML = v[0] == "true" 
-		}
-	} else {
-		// Fallback to JSON or FormValue if not multipart?
-		// But client will send JSON or Multipart.
-		// If JSON, usage of BodyParser is needed.
-		// Let's support both.
-		type ComposeRequest struct {
-			To      string `json:"to"`
-			Cc      string `json:"cc"`
-			Bcc     string `json:"bcc"`
-			Subject string `json:"subject"`
-			Body    string `json:"body"`
-			IsHTML  bool   `json:"is_html"`
-		}
-		var req ComposeRequest
-		if err := c.BodyParser(&req); err == nil && req.To != "" {
-			to = req.To
-			cc = req.Cc
-			bcc = req.Bcc
-			subject = req.Subject
-			body = req.Body
-			isHTML = req.IsHTML
-		} else {
-			// Try FormValue fallback
-			to = c.FormValue("to")
-			cc = c.FormValue("cc")
-			bcc = c.FormValue("bcc")
-			subject = c.FormValue("subject")
-			body = c.FormValue("body")
-			isHTML = c.FormValue("is_html") == "true"
-		}
-	}
-
-	if to == "" || subject == "" || body == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"error": "All fields are required",
-		})
-	}
-
-	// Handle Attachments
-	var attachments []api.AttachmentData
-	if form != nil {
-		for _, fileHeaders := range form.File["attachments"] {
-			file, err := fileHeaders.Open()
-			if err != nil {
-				log.Printf("Error opening attachment: %v", err)
-				continue
-			}
-			data, err := io.ReadAll(file)
-			file.Close()
-			if err != nil {
-				log.Printf("Error reading attachment: %v", err)
-				continue
-			}
-			
-			contentType := fileHeaders.Header.Get("Content-Type")
-			if contentType == "" {
-				contentType = api.DetectContentType(fileHeaders.Filename)
-			}
-
-			// Optimize image if needed
-			if utils.IsImage(contentType) {
-				// Resize to max 1920px width
-				if optimizedData, err := utils.OptimizeImage(data, 1920); err == nil {
-					data = optimizedData
-					// Update content length if needed, though usually not strictly required for byte slice
-				} else {
-					log.Printf("Failed to optimize image %s: %v", fileHeaders.Filename, err)
-				}
-			}
-
-			attachments = append(attachments, api.AttachmentData{
-				Filename:    fileHeaders.Filename,
-				ContentType: contentType,
-				Data:        data,
-			})
-		}
+	out, err := api.ParseOutgoingMail(c)
+	if err == nil {
+		err = h.mailer.Send(c, out)
 	}
-
-	// Create SMTP client
-	smtpClient, err := h.auth.CreateSMTPClient(c)
-	if err != nil {
-		log.Printf("SMTP client creation error: %v", err)
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Failed to connect to email server",
-		})
-	}
-
-	// Send the email
-	err = smtpClient.SendMail(to, cc, bcc, subject, body, isHTML, attachments)
 	if err != nil {
 		log.Printf("Email sending error: %v", err)
-		return c.Status(500).JSON(fiber.Map{
-			"error": fmt.Sprintf("Failed to send email: %v", err),
-		})
-	}
-
-	// Get IMAP client to save to Sent folder
-	imapClient, err := h.auth.CreateIMAPClient(c)
-	if err != nil {
-		log.Printf("IMAP client error when saving to Sent: %v", err)
-		// Don't return error here since email was sent successfully
-	} else {
-		defer imapClient.Close()
-
-		// Try to save to Sent folder
-		if err := imapClient.SaveToSent(to, subject, body); err != nil {
-			log.Printf("Error saving to Sent folder: %v", err)
+		appErr, ok := err.(*utils.AppError)
+		if !ok {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to send email"})
+		}
+		response := fiber.Map{"error": appErr.Message}
+		if problems, ok := appErr.Context["errors"]; ok {
+			response["errors"] = problems
 		}
+		return c.Status(appErr.Code).JSON(response)
 	}
 
+	// Pick up the new recipients on the next page load
+	h.senderHistories.Delete(senderHistoryKey(cacheUserID(c), cacheAccountID(c)))
+
 	return c.JSON(fiber.Map{
 		"success": true,
 		"message": "Email sent successfully",
 		"details": fiber.Map{
-			"to":      to,
-			"subject": subject,
+			"to":      out.To,
+			"subject": out.Subject,
 		},
 	})
 }
@@ -704,7 +889,7 @@ func (h *EmailHandler) HandleMoveEmail(c *fiber.Ctx) error {
 	}
 
 	// Get IMAP client
-	client, err := h.auth.CreateIMAPClient(c)
+	client, err := h.auth.CreateMailClient(c)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Error connecting to email server",
@@ -720,6 +905,10 @@ func (h *EmailHandler) HandleMoveEmail(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := h.messageCache.DeleteMessage(cacheUserID(c), cacheAccountID(c), sourceFolder, emailID); err != nil {
+		log.Printf("Error updating message cache: %v", err)
+	}
+
 	return c.JSON(fiber.Map{
 		"success": true,
 		"message": "Email moved successfully",
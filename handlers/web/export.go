@@ -0,0 +1,140 @@
+package web
+
+import (
+	"bytes"
+	"html/template"
+	"lilmail/handlers/api"
+	"lilmail/models"
+	"lilmail/utils"
+	"log"
+	"mime"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// printMessage is a message on the print page
+type printMessage struct {
+	Email models.Email
+	Body  template.HTML
+}
+
+// HandleEmailPDF exports a message as a PDF download
+func (h *EmailHandler) HandleEmailPDF(c *fiber.Ctx) error {
+	folderName := c.Query("folder", "INBOX")
+	emailID := c.Params("id")
+	if emailID == "" {
+		return c.Status(400).SendString("Email ID required")
+	}
+
+	client, err := h.auth.CreateMailClient(c)
+	if err != nil {
+		return c.Status(500).SendString("Error connecting to email server")
+	}
+	defer client.Close()
+
+	email, err := client.FetchSingleMessage(folderName, emailID)
+	if err != nil {
+		log.Printf("Error fetching email %s from folder %s: %v", emailID, folderName, err)
+		return c.Status(404).SendString("Email not found")
+	}
+
+	return h.sendPDF(c, email.Subject, []models.Email{email})
+}
+
+// HandleThreadPDF exports every message of a thread, oldest first, as one
+// PDF download
+func (h *EmailHandler) HandleThreadPDF(c *fiber.Ctx) error {
+	threadID, err := url.PathUnescape(c.Params("id"))
+	if err != nil || threadID == "" {
+		return c.Status(400).SendString("Thread ID required")
+	}
+
+	thread, err := h.threadStorage.GetThread(threadID)
+	if err != nil || thread.UserID != cacheUserID(c) {
+		return c.Status(404).SendString("Thread not found")
+	}
+
+	folder := c.Query("folder", thread.Folder)
+	if folder == "" {
+		folder = "INBOX"
+	}
+
+	client, err := h.auth.CreateMailClient(c)
+	if err != nil {
+		return c.Status(500).SendString("Error connecting to email server")
+	}
+	defer client.Close()
+
+	messages := make([]models.Email, 0, len(thread.Messages))
+	for _, cached := range thread.Messages {
+		email, err := client.FetchSingleMessage(folder, cached.ID)
+		if err != nil {
+			log.Printf("Error fetching email %s of thread %s: %v", cached.ID, threadID, err)
+			return c.Status(500).SendString("Error fetching email")
+		}
+		messages = append(messages, email)
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Date.Before(messages[j].Date)
+	})
+
+	return h.sendPDF(c, thread.Subject, messages)
+}
+
+// sendPDF renders messages with the print template and sends them as a PDF.
+// Remote images are always left out: the converter must not fetch anything
+// on the server's behalf.
+func (h *EmailHandler) sendPDF(c *fiber.Ctx, title string, emails []models.Email) error {
+	messages := make([]printMessage, 0, len(emails))
+	for _, email := range emails {
+		body, _ := utils.RewriteRemoteImages(string(email.HTML), true, false)
+		messages = append(messages, printMessage{Email: email, Body: template.HTML(body)})
+	}
+
+	var page bytes.Buffer
+	err := c.App().Config().Views.Render(&page, "print", fiber.Map{
+		"Title":    title,
+		"Messages": messages,
+		"Offline":  true,
+		"Lang":     c.Locals("lang"),
+		"Timezone": api.GetSessionTimezone(c),
+	})
+	if err != nil {
+		log.Printf("Error rendering PDF page: %v", err)
+		return c.Status(500).SendString("Error rendering PDF")
+	}
+
+	pdf, err := utils.HTMLToPDF(page.Bytes())
+	if err == utils.ErrNoPDFConverter {
+		return c.Status(fiber.StatusNotImplemented).SendString("PDF export is not available on this server; use Print and save as PDF instead")
+	}
+	if err != nil {
+		log.Printf("Error converting to PDF: %v", err)
+		return c.Status(500).SendString("Error rendering PDF")
+	}
+
+	c.Set("Content-Type", "application/pdf")
+	c.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": pdfFilename(title)}))
+	c.Set("Cache-Control", "private, no-store")
+	return c.Send(pdf)
+}
+
+// pdfFilename names an export after its subject
+func pdfFilename(subject string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(subject))
+	if name == "" {
+		name = "message"
+	}
+	if len([]rune(name)) > 100 {
+		name = string([]rune(name)[:100])
+	}
+	return name + ".pdf"
+}
@@ -0,0 +1,185 @@
+package web
+
+import (
+	"lilmail/handlers/api"
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// seedSize is the number of recent messages fetched when a folder is first cached
+	seedSize = 50
+	// minRefreshInterval throttles background refreshes of the same folder
+	minRefreshInterval = 15 * time.Second
+)
+
+// loadFolderPage returns a page of messages for a folder. Pages covered by the
+// local message cache are served from it immediately and a background refresh
+// picks up new mail; otherwise the page is fetched from IMAP.
+func (h *EmailHandler) loadFolderPage(c *fiber.Ctx, userID, folder string, page, pageSize int) (*models.PaginatedEmails, error) {
+	creds, err := api.GetCredentials(c, h.store, h.config.Encryption.Key)
+	if err != nil {
+		return nil, err
+	}
+	username := api.GetSessionUser(c)
+	accountID := cacheAccountID(c)
+
+	meta, err := h.messageCache.GetFolderMeta(userID, accountID, folder)
+	if err != nil {
+		utils.Log.Warn("Failed to read message cache for %s: %v", folder, err)
+	}
+
+	if meta != nil {
+		offset := (page - 1) * pageSize
+		emails, count, err := h.messageCache.GetMessages(userID, accountID, folder, offset, pageSize)
+		covered := offset+pageSize <= count || uint32(count) >= meta.Total
+		if err == nil && covered && len(emails) > 0 {
+			go h.refreshFolderCache(creds, username, userID, accountID, folder, nil)
+
+			total := meta.Total
+			if uint32(count) > total {
+				total = uint32(count)
+			}
+			h.markSenders(c, userID, emails)
+			return models.NewPaginatedEmails(emails, uint32(page), uint32(pageSize), total), nil
+		}
+	}
+
+	client, err := h.auth.NewMailClient(creds)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	paginated, err := client.FetchMessagesPaginated(folder, uint32(page), uint32(pageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	// The first page is the newest contiguous run of messages, so it can seed the cache
+	if page == 1 {
+		go h.refreshFolderCache(creds, username, userID, accountID, folder, paginated.Emails)
+	}
+
+	h.markSenders(c, userID, paginated.Emails)
+	return paginated, nil
+}
+
+// syncFolderInBackground starts a cache refresh of a folder for the signed
+// in user, seeding the cache if the folder was never cached
+func (h *EmailHandler) syncFolderInBackground(c *fiber.Ctx, folder string) error {
+	creds, err := api.GetCredentials(c, h.store, h.config.Encryption.Key)
+	if err != nil {
+		return err
+	}
+	go h.refreshFolderCache(creds, api.GetSessionUser(c), cacheUserID(c), cacheAccountID(c), folder, nil)
+	return nil
+}
+
+// refreshFolderCache brings the cached copy of a folder up to date with the
+// server and notifies the user's open sessions when the listing changed.
+// seed, when given, holds freshly fetched messages to store if the folder has
+// not been cached yet.
+func (h *EmailHandler) refreshFolderCache(creds *api.Credentials, username, userID, accountID, folder string, seed []models.Email) {
+	key := userID + "|" + accountID + "|" + folder
+	if _, busy := h.refreshing.LoadOrStore(key, true); busy {
+		return
+	}
+	defer h.refreshing.Delete(key)
+
+	meta, err := h.messageCache.GetFolderMeta(userID, accountID, folder)
+	if err != nil {
+		utils.Log.Error("Failed to read message cache for %s: %v", folder, err)
+		return
+	}
+	if meta != nil && seed == nil && time.Since(meta.SyncedAt) < minRefreshInterval {
+		return
+	}
+
+	client, err := h.auth.NewMailClient(creds)
+	if err != nil {
+		utils.Log.Error("Cache refresh: failed to connect for %s: %v", username, err)
+		return
+	}
+	defer client.Close()
+
+	status, err := client.MailboxStatus(folder)
+	if err != nil {
+		utils.Log.Error("Cache refresh: %v", err)
+		return
+	}
+
+	// A new UIDVALIDITY, or a backlog too large to fetch incrementally, invalidates the cache
+	if meta != nil && (meta.UIDValidity != status.UidValidity || status.Messages > meta.Total+seedSize*10) {
+		if err := h.messageCache.ClearFolder(userID, accountID, folder); err != nil {
+			utils.Log.Error("Cache refresh: failed to clear %s: %v", folder, err)
+			return
+		}
+		h.notifyFolderUpdated(username, folder, 0)
+		meta = nil
+		seed = nil
+	}
+
+	if meta == nil {
+		if seed == nil {
+			if seed, err = client.FetchMessages(folder, seedSize); err != nil {
+				utils.Log.Error("Cache refresh: failed to seed %s: %v", folder, err)
+				return
+			}
+		}
+		newMeta := storage.FolderCacheMeta{UIDValidity: status.UidValidity, Total: status.Messages}
+		if err := h.messageCache.SaveMessages(userID, accountID, folder, newMeta, seed); err != nil {
+			utils.Log.Error("Cache refresh: failed to save %s: %v", folder, err)
+		}
+		return
+	}
+
+	newEmails, err := client.FetchNewMessages(folder, meta.HighestUID)
+	if err != nil {
+		utils.Log.Error("Cache refresh: failed to fetch new messages in %s: %v", folder, err)
+		return
+	}
+
+	// Rules are for incoming mail, as with the poller and IDLE
+	if strings.EqualFold(folder, "INBOX") {
+		h.labelRules.Apply(username, creds.Email, "INBOX", newEmails)
+	}
+
+	// Reconcile flags and expunges for messages already in the cache
+	updated, removed := 0, 0
+	if low, _, err := h.messageCache.GetUIDRange(userID, accountID, folder); err == nil && low > 0 {
+		if flags, err := client.FetchFlags(folder, low); err == nil {
+			updated, removed, err = h.messageCache.SyncFlags(userID, accountID, folder, flags)
+			if err != nil {
+				utils.Log.Error("Cache refresh: failed to sync flags in %s: %v", folder, err)
+			}
+		}
+	}
+
+	meta.Total = status.Messages
+	if err := h.messageCache.SaveMessages(userID, accountID, folder, *meta, newEmails); err != nil {
+		utils.Log.Error("Cache refresh: failed to save %s: %v", folder, err)
+		return
+	}
+
+	if len(newEmails) > 0 || updated > 0 || removed > 0 {
+		h.notifyFolderUpdated(username, folder, len(newEmails))
+	}
+}
+
+// notifyFolderUpdated tells the user's open pages that a folder listing changed
+func (h *EmailHandler) notifyFolderUpdated(username, folder string, newCount int) {
+	h.notify.SendNotification(username, api.Notification{
+		Type:    "folder_updated",
+		Message: "Folder updated",
+		Data: map[string]interface{}{
+			"folder":    folder,
+			"new_count": newCount,
+		},
+	})
+}
@@ -0,0 +1,121 @@
+package web
+
+import (
+	"lilmail/handlers/api"
+	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// senderHistoryTTL is how long a user's correspondence is reused between
+// page loads before it is gathered again
+const senderHistoryTTL = time.Minute
+
+// senderHistory is who a user corresponds with: the addresses they wrote to
+// and how many messages came from everyone else
+type senderHistory struct {
+	known    map[string]bool
+	received map[string]int
+	loadedAt time.Time
+}
+
+// SetSentRecipients remembers the recipients of mail sent through lilmail so
+// they count as known senders when they write back
+func (h *EmailHandler) SetSentRecipients(recipients *storage.SentRecipientStorage) {
+	h.sentRecipients = recipients
+}
+
+// markSenders sets the SenderStatus of messages: known if the user has
+// written to the sender, first time if no other message from the sender is
+// in the user's cached mail. Messages the user sent themselves are left alone.
+func (h *EmailHandler) markSenders(c *fiber.Ctx, userID string, emails []models.Email) {
+	if len(emails) == 0 {
+		return
+	}
+
+	own := ownAddresses(c)
+	history := h.senderHistory(userID, cacheAccountID(c), own)
+	if history == nil {
+		return
+	}
+
+	self := make(map[string]bool, len(own))
+	for _, address := range own {
+		self[senderAddress(address)] = true
+	}
+
+	for i := range emails {
+		from := senderAddress(emails[i].From)
+		switch {
+		case from == "" || self[from]:
+		case history.known[from]:
+			emails[i].SenderStatus = models.SenderKnown
+		case history.received[from] <= 1:
+			emails[i].SenderStatus = models.SenderFirstTime
+		}
+	}
+}
+
+// senderHistoryKey is the key of a user's account in senderHistories
+func senderHistoryKey(userID, accountID string) string {
+	return userID + "|" + accountID
+}
+
+// senderHistory returns the correspondence of a user's account, gathered
+// from the message cache and the recipients of mail they sent
+func (h *EmailHandler) senderHistory(userID, accountID string, own []string) *senderHistory {
+	key := senderHistoryKey(userID, accountID)
+	if cached, ok := h.senderHistories.Load(key); ok {
+		if history := cached.(*senderHistory); time.Since(history.loadedAt) < senderHistoryTTL {
+			return history
+		}
+	}
+
+	known, received, err := h.messageCache.SenderHistory(userID, accountID, own)
+	if err != nil {
+		utils.Log.Warn("Failed to load sender history: %v", err)
+		return nil
+	}
+
+	if h.sentRecipients != nil {
+		recipients, err := h.sentRecipients.GetRecipients(userID)
+		if err != nil {
+			utils.Log.Warn("Failed to load sent recipients: %v", err)
+		}
+		for address := range recipients {
+			known[address] = true
+		}
+	}
+
+	history := &senderHistory{known: known, received: received, loadedAt: time.Now()}
+	h.senderHistories.Store(key, history)
+	return history
+}
+
+// ownAddresses returns the addresses of the signed in user: their login and
+// the account they are reading
+func ownAddresses(c *fiber.Ctx) []string {
+	own := []string{api.GetSessionUser(c)}
+	if email, ok := c.Locals("email").(string); ok && email != "" {
+		own = append(own, email)
+	}
+	return own
+}
+
+// senderAddress returns the lower case address of "Name <address>" or a
+// plain address, or "" if s holds none
+func senderAddress(s string) string {
+	if addr, err := mail.ParseAddress(strings.TrimSpace(s)); err == nil {
+		return strings.ToLower(addr.Address)
+	}
+	s = strings.ToLower(strings.TrimSpace(s))
+	if !strings.Contains(s, "@") {
+		return ""
+	}
+	return s
+}
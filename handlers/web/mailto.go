@@ -0,0 +1,56 @@
+package web
+
+import (
+	"lilmail/models"
+	"lilmail/utils"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HandleCompose opens the inbox with the compose modal prefilled from a
+// mailto: link. The browser sends mailto: links here once lilmail is
+// registered as its mail client.
+func (h *EmailHandler) HandleCompose(c *fiber.Ctx) error {
+	mailto := c.Query("mailto")
+	if mailto == "" {
+		return c.Redirect("/inbox")
+	}
+	if _, err := utils.ParseMailto(mailto); err != nil {
+		return c.Redirect("/inbox")
+	}
+
+	c.Locals("mailto", mailto)
+	return h.HandleInbox(c)
+}
+
+// HandleMailto prepares the compose modal with the fields of a mailto: link
+func (h *ReplyHandler) HandleMailto(c *fiber.Ctx) error {
+	link, err := utils.ParseMailto(c.Query("url"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid mailto link"})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    prepareMailtoData(link, h.composeSettings(c)),
+	})
+}
+
+func prepareMailtoData(link *utils.MailtoLink, compose models.ComposeSettings) map[string]interface{} {
+	body := link.Body
+	if body != "" && compose.Format == models.ComposeFormatHTML {
+		body = textToHTML(body)
+	}
+
+	return map[string]interface{}{
+		"to":      strings.Join(link.To, ", "),
+		"cc":      strings.Join(link.Cc, ", "),
+		"bcc":     strings.Join(link.Bcc, ", "),
+		"subject": link.Subject,
+		"body":    body,
+		"mode":    "mailto",
+		"format":  compose.Format,
+		"font":    compose.Font,
+	}
+}
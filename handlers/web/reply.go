@@ -2,8 +2,13 @@ package web
 
 import (
 	"fmt"
+	"html"
 	"lilmail/config"
+	"lilmail/handlers/api"
 	"lilmail/models"
+	"lilmail/storage"
+	"lilmail/utils"
+	"net/mail"
 	"strings"
 	"time"
 
@@ -13,27 +18,59 @@ import (
 
 // ReplyHandler handles email reply, reply-all, and forward operations
 type ReplyHandler struct {
-	store  *session.Store
-	config *config.Config
-	auth   *AuthHandler
+	store    *session.Store
+	config   *config.Config
+	auth     *AuthHandler
+	settings *storage.SettingsStorage
+	accounts *storage.AccountStorage
 }
 
 // NewReplyHandler creates a new reply handler
-func NewReplyHandler(store *session.Store, config *config.Config, auth *AuthHandler) *ReplyHandler {
+func NewReplyHandler(store *session.Store, config *config.Config, auth *AuthHandler, settingsStorage *storage.SettingsStorage, accountStorage *storage.AccountStorage) *ReplyHandler {
 	return &ReplyHandler{
-		store:  store,
-		config: config,
-		auth:   auth,
+		store:    store,
+		config:   config,
+		auth:     auth,
+		settings: settingsStorage,
+		accounts: accountStorage,
 	}
 }
 
+// HandleComposeInit returns the defaults a new compose window opens with
+func (h *ReplyHandler) HandleComposeInit(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    h.composeSettings(c),
+	})
+}
+
+// composeSettings returns the user's compose defaults with the current
+// account's overrides applied
+func (h *ReplyHandler) composeSettings(c *fiber.Ctx) models.ComposeSettings {
+	compose := models.DefaultComposeSettings()
+
+	if username := api.GetSessionUser(c); username != "" {
+		if settings, err := h.settings.GetSettings(username); err == nil {
+			compose = compose.Merge(settings.Compose)
+		}
+	}
+
+	if accountID, ok := c.Locals("accountId").(string); ok && accountID != "" {
+		if account, err := h.accounts.GetAccount(accountID, []byte(h.config.Encryption.Key)); err == nil {
+			compose = compose.Merge(account.Compose)
+		}
+	}
+
+	return compose
+}
+
 // HandleReply prepares the compose modal with reply data
 func (h *ReplyHandler) HandleReply(c *fiber.Ctx) error {
 	emailID := c.Params("id")
 	folder := c.Get("X-Folder", "INBOX")
 
 	// Get IMAP client using auth handler
-	client, err := h.auth.CreateIMAPClient(c)
+	client, err := h.auth.CreateMailClient(c)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to connect to IMAP server"})
 	}
@@ -45,8 +82,11 @@ func (h *ReplyHandler) HandleReply(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "Email not found"})
 	}
 
+	// Quote the date in the user's time zone
+	email.Date = utils.InTimezone(email.Date, api.GetSessionTimezone(c))
+
 	// Prepare reply data
-	replyData := prepareReplyData(&email, "reply")
+	replyData := prepareReplyData(&email, "reply", h.composeSettings(c), h.ownAddresses(c))
 
 	return c.JSON(fiber.Map{
 		"success": true,
@@ -60,7 +100,7 @@ func (h *ReplyHandler) HandleReplyAll(c *fiber.Ctx) error {
 	folder := c.Get("X-Folder", "INBOX")
 
 	// Get IMAP client using auth handler
-	client, err := h.auth.CreateIMAPClient(c)
+	client, err := h.auth.CreateMailClient(c)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to connect to IMAP server"})
 	}
@@ -72,8 +112,11 @@ func (h *ReplyHandler) HandleReplyAll(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "Email not found"})
 	}
 
+	// Quote the date in the user's time zone
+	email.Date = utils.InTimezone(email.Date, api.GetSessionTimezone(c))
+
 	// Prepare reply-all data
-	replyData := prepareReplyData(&email, "replyall")
+	replyData := prepareReplyData(&email, "replyall", h.composeSettings(c), h.ownAddresses(c))
 
 	return c.JSON(fiber.Map{
 		"success": true,
@@ -87,7 +130,7 @@ func (h *ReplyHandler) HandleForward(c *fiber.Ctx) error {
 	folder := c.Get("X-Folder", "INBOX")
 
 	// Get IMAP client using auth handler
-	client, err := h.auth.CreateIMAPClient(c)
+	client, err := h.auth.CreateMailClient(c)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to connect to IMAP server"})
 	}
@@ -99,8 +142,11 @@ func (h *ReplyHandler) HandleForward(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "Email not found"})
 	}
 
+	// Quote the date in the user's time zone
+	email.Date = utils.InTimezone(email.Date, api.GetSessionTimezone(c))
+
 	// Prepare forward data
-	forwardData := prepareForwardData(&email)
+	forwardData := prepareForwardData(&email, folder, h.composeSettings(c))
 
 	return c.JSON(fiber.Map{
 		"success": true,
@@ -108,30 +154,32 @@ func (h *ReplyHandler) HandleForward(c *fiber.Ctx) error {
 	})
 }
 
-// prepareReplyData prepares the reply/reply-all email data
-func prepareReplyData(email *models.Email, replyType string) map[string]interface{} {
-	to := email.From
-	cc := ""
-	
-	// For reply-all, include all original recipients
-	if replyType == "replyall" {
-		// Parse To addresses and add to CC
-		toAddrs := strings.Split(email.To, ",")
-		ccAddrs := []string{}
-		
-		if email.Cc != "" {
-			ccAddrs = append(ccAddrs, strings.Split(email.Cc, ",")...)
+// prepareReplyData prepares the reply/reply-all email data. own are the
+// addresses of the active account, which are never replied to.
+func prepareReplyData(email *models.Email, replyType string, compose models.ComposeSettings, own []string) map[string]interface{} {
+	seen := make(map[string]bool)
+	for _, address := range own {
+		if address = strings.ToLower(strings.TrimSpace(address)); address != "" {
+			seen[address] = true
 		}
-		
-		// Add all To addresses to CC (except the current user)
-		for _, addr := range toAddrs {
-			trimmed := strings.TrimSpace(addr)
-			if trimmed != "" {
-				ccAddrs = append(ccAddrs, trimmed)
-			}
+	}
+
+	// Replying to a message the user sent goes back to its recipients
+	var to, cc string
+	if from, err := mail.ParseAddress(email.From); err == nil && seen[strings.ToLower(from.Address)] {
+		to = replyRecipients(seen, email.To)
+		if replyType == "replyall" {
+			cc = replyRecipients(seen, email.Cc)
 		}
-		
-		cc = strings.Join(ccAddrs, ", ")
+	} else {
+		to = replyRecipients(seen, email.From)
+		// For reply-all, copy the other recipients
+		if replyType == "replyall" {
+			cc = replyRecipients(seen, email.To, email.Cc)
+		}
+	}
+	if to == "" {
+		to = email.From
 	}
 
 	// Add "Re:" prefix to subject if not already present
@@ -141,7 +189,10 @@ func prepareReplyData(email *models.Email, replyType string) map[string]interfac
 	}
 
 	// Create quoted body
-	quotedBody := formatQuotedBody(email)
+	quotedBody := formatQuotedBody(email, compose.QuoteStyle)
+	if compose.Format == models.ComposeFormatHTML {
+		quotedBody = textToHTML(quotedBody)
+	}
 
 	return map[string]interface{}{
 		"to":      to,
@@ -149,11 +200,69 @@ func prepareReplyData(email *models.Email, replyType string) map[string]interfac
 		"subject": subject,
 		"body":    quotedBody,
 		"mode":    replyType,
+		"format":  compose.Format,
+		"font":    compose.Font,
+	}
+}
+
+// replyRecipients joins the addresses of the given address lists, leaving
+// out those already in seen and adding the rest to it
+func replyRecipients(seen map[string]bool, lists ...string) string {
+	var kept []string
+	for _, list := range lists {
+		for _, entry := range splitAddressList(list) {
+			address := entry
+			if addr, err := mail.ParseAddress(entry); err == nil {
+				address = addr.Address
+			}
+			key := strings.ToLower(address)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			kept = append(kept, entry)
+		}
 	}
+	return strings.Join(kept, ", ")
 }
 
-// prepareForwardData prepares the forward email data
-func prepareForwardData(email *models.Email) map[string]interface{} {
+// splitAddressList splits an address header into its entries, falling back
+// to splitting on commas when the header doesn't parse
+func splitAddressList(list string) []string {
+	var entries []string
+	if addrs, err := mail.ParseAddressList(list); err == nil {
+		for _, addr := range addrs {
+			if addr.Name == "" {
+				entries = append(entries, addr.Address)
+			} else {
+				entries = append(entries, fmt.Sprintf("%s <%s>", addr.Name, addr.Address))
+			}
+		}
+		return entries
+	}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// ownAddresses returns the addresses of the active account
+func (h *ReplyHandler) ownAddresses(c *fiber.Ctx) []string {
+	own := []string{api.GetSessionEmail(c)}
+	if accountID, ok := c.Locals("accountId").(string); ok && accountID != "" {
+		if account, err := h.accounts.GetAccount(accountID, []byte(h.config.Encryption.Key)); err == nil {
+			own = append(own, account.Email, account.Username)
+		}
+	}
+	return own
+}
+
+// prepareForwardData prepares the forward email data. The original
+// attachments are listed rather than sent to the browser; the compose
+// form refers back to them by folder, UID and index when sending.
+func prepareForwardData(email *models.Email, folder string, compose models.ComposeSettings) map[string]interface{} {
 	// Add "Fwd:" prefix to subject if not already present
 	subject := email.Subject
 	if !strings.HasPrefix(strings.ToLower(subject), "fwd:") && 
@@ -163,21 +272,44 @@ func prepareForwardData(email *models.Email) map[string]interface{} {
 
 	// Create forwarded message body
 	forwardedBody := formatForwardedBody(email)
+	if compose.Format == models.ComposeFormatHTML {
+		forwardedBody = textToHTML(forwardedBody)
+	}
+
+	attachments := make([]map[string]interface{}, 0, len(email.Attachments))
+	for i, attachment := range email.Attachments {
+		attachments = append(attachments, map[string]interface{}{
+			"index":        i,
+			"filename":     attachment.Filename,
+			"content_type": attachment.ContentType,
+			"size":         attachment.Size,
+		})
+	}
 
 	return map[string]interface{}{
-		"to":      "",
-		"cc":      "",
-		"subject": subject,
-		"body":    forwardedBody,
-		"mode":    "forward",
+		"to":          "",
+		"cc":          "",
+		"subject":     subject,
+		"body":        forwardedBody,
+		"mode":        "forward",
+		"format":      compose.Format,
+		"font":        compose.Font,
+		"folder":      folder,
+		"uid":         email.ID,
+		"attachments": attachments,
 	}
 }
 
-// formatQuotedBody formats the email body with quote marks
-func formatQuotedBody(email *models.Email) string {
+// formatQuotedBody formats the email body with quote marks. With the inline
+// quote style the blank lines for the reply go after the quote instead of
+// before it.
+func formatQuotedBody(email *models.Email, quoteStyle string) string {
 	var sb strings.Builder
 	
-	sb.WriteString(fmt.Sprintf("\n\n\nOn %s, %s wrote:\n", 
+	if quoteStyle != models.QuoteStyleInline {
+		sb.WriteString("\n\n\n")
+	}
+	sb.WriteString(fmt.Sprintf("On %s, %s wrote:\n", 
 		email.Date.Format(time.RFC1123), email.From))
 	
 	// Get the text body
@@ -192,6 +324,10 @@ func formatQuotedBody(email *models.Email) string {
 	for _, line := range lines {
 		sb.WriteString("> " + line + "\n")
 	}
+
+	if quoteStyle == models.QuoteStyleInline {
+		sb.WriteString("\n")
+	}
 	
 	return sb.String()
 }
@@ -252,3 +388,35 @@ func stripHTML(html string) string {
 	
 	return strings.TrimSpace(sb.String())
 }
+
+// textToHTML converts a prepared plain-text body for the rich text editor:
+// lines are escaped and "> " quoted runs become a blockquote
+func textToHTML(text string) string {
+	var sb strings.Builder
+	inQuote := false
+
+	for _, line := range strings.Split(text, "\n") {
+		quoted := strings.HasPrefix(line, "> ")
+		if quoted != inQuote {
+			if quoted {
+				sb.WriteString("<blockquote>")
+			} else {
+				sb.WriteString("</blockquote>")
+			}
+			inQuote = quoted
+		}
+		if quoted {
+			line = strings.TrimPrefix(line, "> ")
+		}
+		if line == "" {
+			sb.WriteString("<p><br></p>")
+		} else {
+			sb.WriteString("<p>" + html.EscapeString(line) + "</p>")
+		}
+	}
+	if inQuote {
+		sb.WriteString("</blockquote>")
+	}
+
+	return sb.String()
+}
@@ -2,8 +2,11 @@ package web
 
 import (
 	"lilmail/config"
+	"lilmail/handlers/api"
 	"lilmail/models"
 	"lilmail/storage"
+	"lilmail/utils"
+	"path/filepath"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
@@ -15,15 +18,17 @@ type SettingsHandler struct {
 	userStorage    *storage.UserStorage
 	accountStorage *storage.AccountStorage
 	labelStorage   *storage.LabelStorage
+	settings       *storage.SettingsStorage
 }
 
-func NewSettingsHandler(store *session.Store, cfg *config.Config, userStorage *storage.UserStorage, accountStorage *storage.AccountStorage, labelStorage *storage.LabelStorage) *SettingsHandler {
+func NewSettingsHandler(store *session.Store, cfg *config.Config, userStorage *storage.UserStorage, accountStorage *storage.AccountStorage, labelStorage *storage.LabelStorage, settingsStorage *storage.SettingsStorage) *SettingsHandler {
 	return &SettingsHandler{
 		store:          store,
 		config:         cfg,
 		userStorage:    userStorage,
 		accountStorage: accountStorage,
 		labelStorage:   labelStorage,
+		settings:       settingsStorage,
 	}
 }
 
@@ -60,11 +65,23 @@ func (h *SettingsHandler) ShowSettings(c *fiber.Ctx) error {
 	}
 
 	// Load user labels
-	labels, err := h.labelStorage.GetLabelsByUser(user.ID)
+	labels, err := h.labelStorage.GetLabelsByUser(userStr)
 	if err != nil {
 		labels = []models.Label{}
 	}
 
+	// Load notification preferences
+	settings, err := h.settings.GetSettings(userStr)
+	if err != nil {
+		settings = models.DefaultUserSettings(userStr)
+	}
+
+	// Folders offered as the default folder
+	var folders []*api.MailboxInfo
+	if err := utils.LoadFolderList(filepath.Join(h.config.Cache.Folder, userStr), &folders); err != nil {
+		folders = []*api.MailboxInfo{} // Only INBOX is offered
+	}
+
 	// Get session to retrieve current account ID
 	sess, err := h.store.Get(c)
 	var currentAccountID string
@@ -79,11 +96,11 @@ func (h *SettingsHandler) ShowSettings(c *fiber.Ctx) error {
 		"User":     user,
 		"Accounts": accounts,
 		"Labels":   labels,
-		"NotificationSettings": fiber.Map{
-			"Desktop":  false,
-			"NewEmail": false,
-		},
+		"NotificationSettings": settings,
+		"Preferences":      settings,
+		"Folders":          folders,
 		"CurrentAccountID": currentAccountID,
+		"AssistAvailable":  h.config.Assist.Enabled(),
 		"CSRFToken":        c.Locals("csrf"),
 	})
 }
@@ -103,6 +120,13 @@ func (h *SettingsHandler) UpdateGeneralSettings(c *fiber.Ctx) error {
 	// Get form values
 	language := c.FormValue("language")
 	theme := c.FormValue("theme")
+	timezone := c.FormValue("timezone")
+	if !utils.ValidTimezone(timezone) {
+		return c.Status(400).JSON(fiber.Map{"error": "Unknown time zone"})
+	}
+	if language = utils.SupportedLanguage(language); language == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Unknown language"})
+	}
 
 	// Load user
 	user, err := h.userStorage.GetUserByUsername(userStr)
@@ -113,12 +137,23 @@ func (h *SettingsHandler) UpdateGeneralSettings(c *fiber.Ctx) error {
 	// Update user settings
 	user.Language = language
 	user.Theme = theme
+	user.Timezone = timezone
 
 	// Save updated user
 	if err := h.userStorage.UpdateUser(user); err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Error saving settings"})
 	}
 
+	// Dates, the UI language and the theme follow what's kept in the session
+	if sess, err := h.store.Get(c); err == nil {
+		sess.Set("timezone", timezone)
+		sess.Set("language", language)
+		sess.Set("theme", theme)
+		if err := sess.Save(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Error saving settings"})
+		}
+	}
+
 	// Update language cookie
 	c.Cookie(&fiber.Cookie{
 		Name:  "lang",
@@ -0,0 +1,86 @@
+package web
+
+import (
+	"lilmail/handlers/api"
+	"lilmail/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SetSpamFilter trains the user's spam classifier when messages are marked
+// as spam or not spam
+func (h *EmailHandler) SetSpamFilter(spam *api.SpamFilter) {
+	h.spamFilter = spam
+}
+
+// HandleMarkSpam trains the spam classifier with a message and moves it to
+// the Junk folder
+func (h *EmailHandler) HandleMarkSpam(c *fiber.Ctx) error {
+	return h.markSpam(c, true)
+}
+
+// HandleMarkNotSpam trains the spam classifier with a message that is not
+// spam and moves it back to INBOX if it was in the Junk folder
+func (h *EmailHandler) HandleMarkNotSpam(c *fiber.Ctx) error {
+	return h.markSpam(c, false)
+}
+
+// markSpam trains the classifier with the message named in the route and
+// moves it to where mail of its kind belongs
+func (h *EmailHandler) markSpam(c *fiber.Ctx, spam bool) error {
+	emailID := c.Params("id")
+	if emailID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Email ID required"})
+	}
+
+	folder := c.Get("X-Folder")
+	if folder == "" {
+		folder = c.Query("folder", "INBOX")
+	}
+
+	client, err := h.auth.CreateMailClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error connecting to email server"})
+	}
+	defer client.Close()
+
+	email, err := client.FetchSingleMessage(folder, emailID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Email not found"})
+	}
+
+	username := api.GetSessionUser(c)
+	if err := h.spamFilter.Train(username, &email, spam); err != nil {
+		utils.Log.Error("Failed to train spam filter for %s: %v", username, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to train spam filter"})
+	}
+
+	junk, err := api.JunkFolder(client)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to find junk folder"})
+	}
+
+	target := ""
+	if spam && folder != junk {
+		target = junk
+	} else if !spam && folder == junk {
+		target = "INBOX"
+	}
+
+	if target != "" {
+		if err := client.MoveMessage(folder, target, emailID); err != nil {
+			utils.Log.Error("Failed to move %s to %s: %v", emailID, target, err)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to move email"})
+		}
+		if err := h.messageCache.DeleteMessage(cacheUserID(c), cacheAccountID(c), folder, emailID); err != nil {
+			utils.Log.Error("Error updating message cache: %v", err)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"spam":    spam,
+		"moved":   target != "",
+		"folder":  target,
+	})
+}
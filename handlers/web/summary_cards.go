@@ -0,0 +1,73 @@
+package web
+
+import (
+	"fmt"
+	"lilmail/utils"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// icsEscaper escapes text values of an iCalendar file
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// HandleCardCalendar serves one of a message's summary cards as an
+// iCalendar event, for the card's "add to calendar" action
+func (h *EmailHandler) HandleCardCalendar(c *fiber.Ctx) error {
+	folderName := c.Query("folder", "INBOX")
+	emailID := c.Params("id")
+	index, err := strconv.Atoi(c.Params("index"))
+	if emailID == "" || err != nil {
+		return c.Status(400).SendString("Email ID and card required")
+	}
+
+	client, err := h.auth.CreateMailClient(c)
+	if err != nil {
+		return c.Status(500).SendString("Error connecting to email server")
+	}
+	defer client.Close()
+
+	email, err := client.FetchSingleMessage(folderName, emailID)
+	if err != nil {
+		log.Printf("Error fetching email %s from folder %s: %v", emailID, folderName, err)
+		return c.Status(404).SendString("Email not found")
+	}
+
+	cards := utils.SummaryCards(email)
+	if index < 0 || index >= len(cards) || !cards[index].HasCalendar() {
+		return c.Status(404).SendString("Card not found")
+	}
+	card := cards[index]
+
+	end := card.End
+	if end.Before(card.Start) {
+		end = card.Start.Add(time.Hour)
+	}
+	lang, _ := c.Locals("lang").(string)
+	localizer := utils.GetLocalizer(lang)
+	description := card.URL
+	for _, field := range card.Fields {
+		description += "\n" + utils.T(localizer, field.Label) + ": " + field.Value
+	}
+
+	var ics strings.Builder
+	ics.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//lilmail//EN\r\nBEGIN:VEVENT\r\n")
+	fmt.Fprintf(&ics, "UID:%s-%d@lilmail\r\n", icsEscaper.Replace(email.MessageID+emailID), index)
+	fmt.Fprintf(&ics, "DTSTAMP:%s\r\n", time.Now().UTC().Format("20060102T150405Z"))
+	fmt.Fprintf(&ics, "DTSTART:%s\r\n", card.Start.UTC().Format("20060102T150405Z"))
+	fmt.Fprintf(&ics, "DTEND:%s\r\n", end.UTC().Format("20060102T150405Z"))
+	fmt.Fprintf(&ics, "SUMMARY:%s\r\n", icsEscaper.Replace(card.Title))
+	if card.Location != "" {
+		fmt.Fprintf(&ics, "LOCATION:%s\r\n", icsEscaper.Replace(card.Location))
+	}
+	fmt.Fprintf(&ics, "DESCRIPTION:%s\r\n", icsEscaper.Replace(strings.TrimSpace(description)))
+	ics.WriteString("END:VEVENT\r\nEND:VCALENDAR\r\n")
+
+	c.Set("Content-Type", "text/calendar; charset=utf-8")
+	c.Set("Content-Disposition", `attachment; filename="event.ics"`)
+	c.Set("Cache-Control", "private, no-store")
+	return c.SendString(ics.String())
+}
@@ -0,0 +1,188 @@
+package web
+
+import (
+	"lilmail/handlers/api"
+	"lilmail/models"
+	"lilmail/utils"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HandleThread returns the reply tree of a single cached thread as JSON.
+// Message bodies are left out unless their UID is listed in ?expand=, so
+// the threaded inbox only fetches the messages a user opens.
+func (h *EmailHandler) HandleThread(c *fiber.Ctx) error {
+	threadID, err := url.PathUnescape(c.Params("id"))
+	if err != nil || threadID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Thread ID required"})
+	}
+
+	thread, err := h.threadStorage.GetThread(threadID)
+	if err != nil || thread.UserID != cacheUserID(c) {
+		return c.Status(404).JSON(fiber.Map{"error": "Thread not found"})
+	}
+
+	folder := c.Query("folder", thread.Folder)
+	if folder == "" {
+		folder = "INBOX"
+	}
+
+	h.threadMutes.MarkMuted(api.GetSessionUser(c), []*models.EmailThread{thread})
+
+	expand := make(map[string]bool)
+	for _, id := range strings.Split(c.Query("expand"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			expand[id] = true
+		}
+	}
+
+	messages := make([]models.Email, len(thread.Messages))
+	copy(messages, thread.Messages)
+
+	if len(expand) > 0 {
+		client, err := h.auth.CreateMailClient(c)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Error connecting to email server"})
+		}
+		defer client.Close()
+
+		for i := range messages {
+			if !expand[messages[i].ID] {
+				continue
+			}
+			full, err := client.FetchSingleMessage(folder, messages[i].ID)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Error fetching email"})
+			}
+			// Keep the threading headers from the cached copy
+			full.References = messages[i].References
+			full.InReplyTo = messages[i].InReplyTo
+			full.MessageID = messages[i].MessageID
+			messages[i] = full
+		}
+	}
+
+	for i := range messages {
+		if !expand[messages[i].ID] {
+			messages[i].Body = ""
+			messages[i].HTML = ""
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"thread": fiber.Map{
+			"id":            thread.ID,
+			"subject":       thread.Subject,
+			"folder":        folder,
+			"participants":  thread.Participants,
+			"message_count": thread.MessageCount,
+			"unread":        thread.Unread,
+			"last_date":     thread.LastDate,
+			"muted":         thread.Muted,
+		},
+		"messages": models.BuildThreadTree(messages),
+	})
+}
+
+// HandleMuteThread mutes a cached thread: new replies to it are archived
+// without a notification until it is unmuted
+func (h *EmailHandler) HandleMuteThread(c *fiber.Ctx) error {
+	return h.setThreadMuted(c, true)
+}
+
+// HandleUnmuteThread unmutes a cached thread
+func (h *EmailHandler) HandleUnmuteThread(c *fiber.Ctx) error {
+	return h.setThreadMuted(c, false)
+}
+
+// setThreadMuted mutes or unmutes the thread named in the route
+func (h *EmailHandler) setThreadMuted(c *fiber.Ctx, muted bool) error {
+	threadID, err := url.PathUnescape(c.Params("id"))
+	if err != nil || threadID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Thread ID required"})
+	}
+
+	thread, err := h.threadStorage.GetThread(threadID)
+	if err != nil || thread.UserID != cacheUserID(c) {
+		return c.Status(404).JSON(fiber.Map{"error": "Thread not found"})
+	}
+
+	username := api.GetSessionUser(c)
+	if muted {
+		err = h.threadMutes.Mute(username, thread)
+	} else {
+		err = h.threadMutes.Unmute(username, thread)
+	}
+	if err != nil {
+		utils.Log.Error("Failed to update mute of thread %s: %v", threadID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update thread"})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"muted":   muted,
+	})
+}
+
+// loadThreadPage returns a page of threads for a folder, newest activity first.
+// Cached threads are used while the folder's UIDNEXT, HIGHESTMODSEQ and message
+// count match the state they were built from, and they reach past the requested
+// page or cover the whole folder. Otherwise the folder's threads are rebuilt
+// from a window of recent messages large enough for the page.
+func (h *EmailHandler) loadThreadPage(c *fiber.Ctx, userID, folder string, page, pageSize int) (*models.PaginatedThreads, error) {
+	client, err := h.auth.CreateMailClient(c)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	state, err := client.MailboxState(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	cachedState, err := h.threadStorage.GetFolderState(userID, folder)
+	if err != nil {
+		utils.Log.Warn("Failed to read thread cache state for %s: %v", folder, err)
+	}
+
+	if cachedState != nil && !cachedState.Changed(state) {
+		threads, err := h.threadStorage.GetThreadsByFolder(userID, folder)
+		if err == nil && len(threads) > 0 {
+			messages := 0
+			for _, t := range threads {
+				messages += len(t.Messages)
+			}
+			complete := uint32(messages) >= state.Messages
+			if complete || len(threads) > page*pageSize {
+				h.threadMutes.MarkMuted(api.GetSessionUser(c), threads)
+				return models.NewPaginatedThreads(threads, uint32(page), uint32(pageSize), complete), nil
+			}
+		}
+	}
+
+	threads, complete, err := client.FetchThreads(folder, uint32(page), uint32(pageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	// Thread IDs follow the root message, which can change as replies arrive
+	// or the window grows, so the folder's old threads are replaced wholesale
+	if err := h.threadStorage.DeleteThreadsByFolder(userID, folder); err != nil {
+		utils.Log.Warn("Failed to clear cached threads for %s: %v", folder, err)
+	}
+	for _, t := range threads {
+		t.UserID = userID
+		t.Folder = folder
+		h.threadStorage.SaveThread(t)
+	}
+	if err := h.threadStorage.SaveFolderState(userID, folder, state); err != nil {
+		utils.Log.Warn("Failed to save thread cache state for %s: %v", folder, err)
+	}
+
+	h.threadMutes.MarkMuted(api.GetSessionUser(c), threads)
+	return models.NewPaginatedThreads(threads, uint32(page), uint32(pageSize), complete), nil
+}
@@ -6,11 +6,13 @@ import (
 	"lilmail/handlers/api"
 	"lilmail/handlers/web"
 	"lilmail/middleware"
+	"lilmail/models"
 	"lilmail/storage"
 	"lilmail/utils"
 	"strings"
 	"time"
 
+	"github.com/emersion/go-imap"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/csrf"
@@ -25,18 +27,25 @@ import (
 
 var store *session.Store
 
+// sessionStorage backs store; the admin dashboard counts its sessions
+var sessionStorage *storage.FileStorage
+
 func init() {
 	// Initialize logger
 	utils.Log.Info("Initializing LilMail...")
 
+	// Let go-imap decode headers in charsets other than UTF-8 and Latin-1
+	imap.CharsetReader = utils.CharsetReader
+
 	// Create file storage
-	storage, err := storage.NewFileStorage("./sessions")
+	var err error
+	sessionStorage, err = storage.NewFileStorage("./sessions")
 	if err != nil {
 		utils.Log.Error("Failed to initialize session storage: %v", err)
 	}
 
 	store = session.New(session.Config{
-		Storage:        storage,
+		Storage:        sessionStorage,
 		Expiration:     24 * time.Hour,
 		CookieSecure:   false, // Set to true in production with HTTPS
 		CookieHTTPOnly: true,
@@ -97,13 +106,36 @@ func main() {
 		return utils.TPlural(utils.Localizer, messageID, count)
 	})
 
+	// Registered languages, for language selectors
+	engine.AddFunc("languages", utils.Languages)
+
 	// Date formatting function
 	engine.AddFunc("formatDate", func(t time.Time) string {
 		return t.Format("Jan 02, 2006 15:04")
 	})
 
+	// Formats a date in the user's time zone, passed as $.Timezone
+	engine.AddFunc("formatDateIn", func(t time.Time, timezone string) string {
+		return utils.InTimezone(t, timezone).Format("Jan 02, 2006 15:04")
+	})
+
+	// Formats a date for the request's language ($.Lang) and time zone
+	// ($.Timezone), relative when it is recent
+	engine.AddFunc("formatDateLocalized", utils.FormatDateLocalized)
+
+	// Formats a number with the digit grouping of $.Lang
+	engine.AddFunc("formatNumberLocalized", utils.FormatNumberLocalized)
+
 	// File size formatting function
-	engine.AddFunc("formatSize", func(size int64) string {
+	// Takes int as well, the type of message attachment sizes
+	engine.AddFunc("formatSize", func(value interface{}) string {
+		var size int64
+		switch v := value.(type) {
+		case int:
+			size = int64(v)
+		case int64:
+			size = v
+		}
 		const unit = 1024
 		if size < unit {
 			return fmt.Sprintf("%d B", size)
@@ -118,17 +150,33 @@ func main() {
 
 	engine.Reload(true)
 
+	// Initialize storage layers
+	db, err := storage.InitDB("./data")
+	if err != nil {
+		utils.Log.Error("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	// Runtime limits, editable by admins on top of config.toml
+	systemSettings := storage.NewSystemSettingsStorage(db, config.System)
+
 	// Initialize Fiber with template engine
 	app := fiber.New(fiber.Config{
 		Views:       engine,
 		ViewsLayout: "layouts/main", // Default layout
+		// Room for the largest attachment limit admins can set
+		BodyLimit: (models.MaxAttachmentLimitMB + 5) << 20,
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
 			
 			// Check for AppError
 			if appErr, ok := err.(*utils.AppError); ok {
 				code = appErr.Code
-				utils.Log.Error("Application error: %v", appErr)
+				logger := utils.Log
+				if username := api.GetSessionUser(c); username != "" {
+					logger = logger.WithField("user", username)
+				}
+				logger.Error("Application error: %v", appErr)
 			} else if e, ok := err.(*fiber.Error); ok {
 				code = e.Code
 			}
@@ -163,8 +211,22 @@ func main() {
 	// Add locale middleware
 	app.Use(middleware.LocaleMiddleware())
 
-	// Add rate limiting (100 requests per minute per IP)
-	app.Use(middleware.RateLimiter(100, time.Minute))
+	// Share rate limits and cached data between instances through Redis
+	limiter := middleware.NewMemoryLimiter()
+	if config.Redis.URL != "" {
+		redisClient, err := utils.NewRedisClient(config.Redis.URL)
+		if err != nil {
+			utils.Log.Error("Failed to connect to Redis, limits and caches stay local: %v", err)
+		} else {
+			utils.GlobalCache = utils.NewRedisCache(redisClient, config.Redis.Prefix)
+			limiter = middleware.NewRedisLimiter(redisClient, config.Redis.Prefix)
+		}
+	}
+
+	// Add rate limiting (requests per minute per IP, set by admins)
+	app.Use(middleware.RateLimiter(limiter, func() int {
+		return systemSettings.Current().RequestsPerMinute
+	}, time.Minute))
 
 	// Serve static files
 	app.Static("/assets", "./assets", fiber.Static{
@@ -172,15 +234,9 @@ func main() {
 		CacheDuration: 24 * time.Hour,
 	})
 
-	// Initialize storage layers
-	db, err := storage.InitDB("./data")
-	if err != nil {
-		utils.Log.Error("Failed to initialize database: %v", err)
-	}
-	defer db.Close()
-
 	accountStorage := storage.NewAccountStorage(db)
 	userStorage := storage.NewUserStorage(db)
+	messageCache := storage.NewMessageCacheStorage(db)
 
 	// Web handlers initialized later with NotificationHandler
 
@@ -190,32 +246,118 @@ func main() {
 	}
 
 	draftStorage := storage.NewDraftStorage("./data")
+	defer draftStorage.Flush()
 
-	labelStorage, err := storage.NewLabelStorage("./data")
+	labelStorage, err := storage.NewLabelStorage(db)
 	if err != nil {
 		utils.Log.Error("Failed to initialize label storage: %v", err)
 	}
 	defer labelStorage.Close()
 
 	// Initialize Notification Handler
-	notificationHandler := api.NewNotificationHandler(store)
+	notificationStorage := storage.NewNotificationStorage(db)
+	settingsStorage := storage.NewSettingsStorage(db)
+	notificationHandler := api.NewNotificationHandler(store, config, notificationStorage, settingsStorage)
+	preferencesHandler := api.NewPreferencesHandler(store, settingsStorage)
+	webhookStorage := storage.NewWebhookStorage(db)
+	webhookDispatcher := api.NewWebhookDispatcher(webhookStorage)
+	notificationHandler.SetWebhooks(webhookDispatcher)
+	webhookHandler := api.NewWebhookHandler(store, webhookStorage, webhookDispatcher)
+	shareStorage := storage.NewShareStorage(db)
+	shareHandler := api.NewShareHandler(store, config, shareStorage, systemSettings)
+	var largeFileHandler *api.LargeFileHandler
+	if config.LargeFiles.ThresholdMB > 0 {
+		if fileStore, err := storage.NewFileStore(config.LargeFiles); err != nil {
+			utils.Log.Error("Large file links are off: %v", err)
+		} else {
+			largeFileHandler = api.NewLargeFileHandler(config, storage.NewLargeFileStorage(db, fileStore))
+		}
+	}
+	noteHandler := api.NewNoteHandler(storage.NewNoteStorage(db))
+	snippetHandler := api.NewSnippetHandler(storage.NewSnippetStorage(db))
+	themeHandler := api.NewThemeHandler(store, storage.NewThemeStorage(db), userStorage)
+	idleManager := api.NewIdleManager(store, config, notificationHandler)
+	mailPoller := api.NewMailPoller(store, config, notificationHandler, idleManager)
+	labelRules := api.NewLabelRules(labelStorage)
+	idleManager.SetLabelRules(labelRules)
+	mailPoller.SetLabelRules(labelRules)
+	threadMutes := api.NewThreadMutes(threadStorage)
+	idleManager.SetThreadMutes(threadMutes)
+	mailPoller.SetThreadMutes(threadMutes)
+	spamFilter := api.NewSpamFilter(storage.NewSpamStorage(db), settingsStorage)
+	idleManager.SetSpamFilter(spamFilter)
+	mailPoller.SetSpamFilter(spamFilter)
+	preferencesHandler.SetSpamFilter(spamFilter)
+	digestScheduler := api.NewDigestScheduler(config, userStorage, accountStorage, settingsStorage, notificationHandler)
+	digestScheduler.Start()
+	adminHandler := api.NewAdminHandler(userStorage, accountStorage, sessionStorage, storage.NewUsageReporter(db, map[string]string{
+		"threads":  "./data/threads",
+		"drafts":   "./data/drafts",
+		"sessions": "./sessions",
+		"cache":    config.Cache.Folder,
+	}), notificationHandler, idleManager, mailPoller)
+	systemSettingsHandler := api.NewSystemSettingsHandler(systemSettings)
+	auditStorage := storage.NewAuditStorage(db)
+	// Keep the audit trail for 90 days
+	if err := auditStorage.Prune(time.Now().AddDate(0, 0, -90)); err != nil {
+		utils.Log.Error("Failed to prune audit log: %v", err)
+	}
+	logHandler := api.NewLogHandler(auditStorage)
+	sentRecipients := storage.NewSentRecipientStorage(db)
 
 	// Initialize API handlers
-	searchHandler := api.NewSearchHandler(store, config)
+	searchHandler := api.NewSearchHandler(store, config, labelStorage)
 	folderHandler := api.NewFolderHandler(store, config)
-	accountHandler := api.NewAccountHandler(store, config, accountStorage)
-	labelHandler := api.NewLabelHandler(store, labelStorage)
+	accountHandler := api.NewAccountHandler(store, config, accountStorage, userStorage, systemSettings)
+	labelHandler := api.NewLabelHandler(store, config, labelStorage)
 	i18nHandler := &api.I18nHandler{}
+	// Every way of sending mail goes through the mailer
+	mailer := api.NewMailer(store, config, systemSettings, userStorage, draftStorage, sentRecipients, notificationHandler)
+	sendHandler := api.NewSendHandler(mailer)
 
 	// Initialize web handlers
-	webAuthHandler := web.NewAuthHandler(store, config, userStorage, accountStorage)
-	webEmailHandler := web.NewEmailHandler(store, config, webAuthHandler, notificationHandler, threadStorage)
+	webAuthHandler := web.NewAuthHandler(store, config, userStorage, accountStorage, mailPoller, idleManager, notificationHandler, systemSettings, sessionStorage)
+	webEmailHandler := web.NewEmailHandler(store, config, webAuthHandler, notificationHandler, threadStorage, messageCache, labelRules, threadMutes, settingsStorage, labelStorage, systemSettings, draftStorage)
+	webAuthHandler.SetAudit(auditStorage)
+	webEmailHandler.SetSpamFilter(spamFilter)
+	webEmailHandler.SetSentRecipients(sentRecipients)
+	webEmailHandler.SetMailer(mailer)
+	assistant := api.NewAssistant(config)
+	webEmailHandler.SetAssistant(assistant)
+	preferencesHandler.SetAssistant(assistant)
 	webAdminHandler := web.NewAdminHandler(store, config, userStorage)
 
 	// Public routes
 	app.Get("/login", webAuthHandler.ShowLogin)
 	app.Post("/login", webAuthHandler.HandleLogin)
+	app.Get("/login/oauth", webAuthHandler.ShowOAuthLogin) // Sign-in with the OAuth provider, for XOAUTH2 servers
+	app.Get("/login/oauth/callback", webAuthHandler.HandleOAuthCallback)
 	app.Get("/logout", webAuthHandler.HandleLogout)
+	app.Get("/digest/unsubscribe", digestScheduler.HandleUnsubscribe)
+	app.Get("/themes.css", themeHandler.ThemeCSS) // Custom themes, also used by the login page
+	app.Get("/share/:token", shareHandler.HandleSharedEmail) // Messages shared by link
+	app.Get("/share/:token/attachments/:index", shareHandler.HandleSharedAttachment)
+	if largeFileHandler != nil {
+		app.Get("/files/:token", largeFileHandler.HandleDownload) // Attachments sent as links
+	}
+
+	// WebSocket notifications validate the session before the upgrade
+	app.Get("/ws", notificationHandler.WebSocketUpgrade, mailPoller.EnsureStarted, idleManager.Register, websocket.New(notificationHandler.HandleWebSocket))
+
+	// JSON API of mobile and native clients, answering with JSON errors
+	// rather than the login redirect, so it goes before the protected group
+	mobileHandler := api.NewMobileHandler(store, config, mailer)
+	v1 := app.Group("/api/v1", mobileHandler.Authenticate)
+	v1.Get("/folders", mobileHandler.Folders)
+	v1.Get("/messages", mobileHandler.Messages)
+	v1.Get("/messages/:id", mobileHandler.Message)
+	v1.Post("/send", mobileHandler.Send)
+
+	// GraphQL over the account and local stores, for dashboards
+	graphqlHandler := api.NewGraphQLHandler(store, config, labelStorage, draftStorage, sentRecipients)
+	v1.Get("/graphql", graphqlHandler.Schema)
+	v1.Post("/graphql", graphqlHandler.Query)
+	v1.All("/*", mobileHandler.NotFound)
 
 	// Protected routes group
 	protected := app.Group("", api.SessionMiddleware(store))
@@ -230,13 +372,13 @@ func main() {
 	}))
 
 	// Notification Routes
-	protected.Get("/events", notificationHandler.HandleSSE)
-	protected.Get("/ws", websocket.New(notificationHandler.HandleWebSocket))
+	protected.Get("/events", mailPoller.EnsureStarted, idleManager.Register, notificationHandler.HandleSSE)
 
 	//Main web routes
-	protected.Get("/", webEmailHandler.HandleInbox)          // Default to inbox
+	protected.Get("/", webEmailHandler.HandleHome)           // Default folder from settings
 	protected.Get("/inbox", webEmailHandler.HandleInbox)     // Explicit inbox route
 	protected.Get("/folder/:name", webEmailHandler.HandleFolder)
+	protected.Get("/compose", webEmailHandler.HandleCompose) // mailto: links from the browser
 	protected.Get("/drafts", func(c *fiber.Ctx) error {
 		username := c.Locals("username")
 		if username == nil {
@@ -253,12 +395,21 @@ func main() {
 	})
 
 	// Settings page
-	webSettingsHandler := web.NewSettingsHandler(store, config, userStorage, accountStorage, labelStorage)
+	webSettingsHandler := web.NewSettingsHandler(store, config, userStorage, accountStorage, labelStorage, settingsStorage)
 	protected.Get("/settings", webSettingsHandler.ShowSettings)
-	protected.Get("/admin/users", webAdminHandler.ShowUsers)
+
+	// Admin pages
+	adminPages := protected.Group("/admin", api.AdminMiddleware(userStorage))
+	adminPages.Get("/", webAdminHandler.ShowDashboard)
+	adminPages.Get("/users", webAdminHandler.ShowUsers)
+	adminPages.Get("/api-docs", webAdminHandler.ShowAPIDocs)
 	
-	webAttachmentHandler := web.NewAttachmentWebHandler(store, config, webAuthHandler)
+	webAttachmentHandler := web.NewAttachmentWebHandler(store, config, webAuthHandler, webEmailHandler, messageCache)
+	protected.Get("/email/:id/print", webEmailHandler.HandleEmailPrint)
+	protected.Get("/email/:id/pdf", webEmailHandler.HandleEmailPDF)
+	protected.Get("/thread/:id/pdf", webEmailHandler.HandleThreadPDF)
 	protected.Get("/attachments", webAttachmentHandler.HandleAttachments)
+	protected.Get("/contact", webEmailHandler.HandleContact)
 	
 	protected.Get("/labels", func(c *fiber.Ctx) error {
 		username := c.Locals("username")
@@ -280,37 +431,75 @@ func main() {
 	{
 		// Email routes
 		apiRoutes.Get("/email/:id", webEmailHandler.HandleEmailView)
+		apiRoutes.Get("/email/:id/body", webEmailHandler.HandleEmailBody)
+		apiRoutes.Get("/email/:id/headers", webEmailHandler.HandleEmailHeaders)
+		apiRoutes.Get("/email/:id/cards/:index/calendar", webEmailHandler.HandleCardCalendar)
+		apiRoutes.Get("/email/:id/suggest", webEmailHandler.HandleSuggest)
+		apiRoutes.Get("/thread/:id", webEmailHandler.HandleThread)
+		apiRoutes.Post("/thread/:id/mute", webEmailHandler.HandleMuteThread)
+		apiRoutes.Delete("/thread/:id/mute", webEmailHandler.HandleUnmuteThread)
 		apiRoutes.Delete("/email/:id", webEmailHandler.HandleDeleteEmail)
 		apiRoutes.Put("/email/:id/read", webEmailHandler.HandleMarkRead)
 		apiRoutes.Put("/email/:id/unread", webEmailHandler.HandleMarkUnread)
 		apiRoutes.Post("/email/:id/move", webEmailHandler.HandleMoveEmail)
+		apiRoutes.Post("/email/:id/spam", webEmailHandler.HandleMarkSpam)
+		apiRoutes.Post("/email/:id/not-spam", webEmailHandler.HandleMarkNotSpam)
+		apiRoutes.Post("/email/:id/block", webEmailHandler.HandleBlockSender)
 
 		// Attachment routes
 		attachmentHandler := api.NewAttachmentHandler(store, config)
+		apiRoutes.Get("/attachments/:email_id/inline/:cid", attachmentHandler.HandleInline)
 		apiRoutes.Get("/attachments/:email_id/:index/download", attachmentHandler.HandleDownload)
 		apiRoutes.Get("/attachments/:email_id/:index/preview", attachmentHandler.HandlePreview)
 
+		// Remote images of HTML messages
+		imageProxy := api.NewImageProxy()
+		apiRoutes.Get("/image-proxy", imageProxy.HandleImage)
+
+		// Sender pictures
+		avatarHandler := api.NewAvatarHandler(config)
+		apiRoutes.Get("/avatar", avatarHandler.HandleAvatar)
+
 		// Reply and forward routes
-		replyHandler := web.NewReplyHandler(store, config, webAuthHandler)
+		replyHandler := web.NewReplyHandler(store, config, webAuthHandler, settingsStorage, accountStorage)
+		apiRoutes.Get("/compose/init", replyHandler.HandleComposeInit)
+		apiRoutes.Post("/compose/validate", webEmailHandler.HandleValidateRecipients)
+		apiRoutes.Get("/compose/mailto", replyHandler.HandleMailto)
 		apiRoutes.Get("/reply/:id", replyHandler.HandleReply)
 		apiRoutes.Get("/replyall/:id", replyHandler.HandleReplyAll)
 		apiRoutes.Get("/forward/:id", replyHandler.HandleForward)
 
+		// OpenAPI document of these routes, read by Swagger UI at /admin/api-docs
+		apiRoutes.Get("/openapi.json", api.NewOpenAPIHandler(app).Spec)
+
 		// Folder routes
 		apiRoutes.Get("/folder/:name/emails", webEmailHandler.HandleFolderEmails)
 		apiRoutes.Post("/folder", folderHandler.CreateFolder)
 		apiRoutes.Delete("/folder/:name", folderHandler.DeleteFolder)
 		apiRoutes.Put("/folder", folderHandler.RenameFolder)
+		apiRoutes.Get("/folders/usage", folderHandler.MailboxUsage)
+
+		// Bulk cleanup routes
+		cleanupHandler := api.NewCleanupHandler(store, config)
+		apiRoutes.Post("/cleanup/preview", cleanupHandler.Preview)
+		apiRoutes.Post("/cleanup/run", cleanupHandler.Run)
+		apiRoutes.Get("/cleanup/duplicates", cleanupHandler.FindDuplicates)
+		apiRoutes.Post("/cleanup/duplicates", cleanupHandler.RemoveDuplicates)
 
 		// Composition routes
 		apiRoutes.Post("/compose", webEmailHandler.HandleComposeEmail)
+		apiRoutes.Post("/send", sendHandler.HandleSend)
 
 		// Search routes
+		apiRoutes.Get("/search", searchHandler.HandleSearch)
 		apiRoutes.Post("/search", searchHandler.HandleSearch)
 
 		// Account management routes
 		apiRoutes.Get("/accounts", accountHandler.GetAccounts)
 		apiRoutes.Post("/accounts", accountHandler.CreateAccount)
+		apiRoutes.Post("/accounts/test", accountHandler.TestAccount)
+		apiRoutes.Post("/accounts/graph", accountHandler.StartGraphLogin)
+		apiRoutes.Post("/accounts/graph/:id", accountHandler.FinishGraphLogin)
 		apiRoutes.Get("/accounts/:id", accountHandler.GetAccount)
 		apiRoutes.Put("/accounts/:id", accountHandler.UpdateAccount)
 		apiRoutes.Delete("/accounts/:id", accountHandler.DeleteAccount)
@@ -320,32 +509,113 @@ func main() {
 		// Label routes
 		apiRoutes.Get("/labels", labelHandler.GetLabels)
 		apiRoutes.Post("/labels", labelHandler.CreateLabel)
+		apiRoutes.Get("/labels/export", labelHandler.ExportLabels)
+		apiRoutes.Post("/labels/import", labelHandler.ImportLabels)
+		apiRoutes.Put("/labels/:id", labelHandler.UpdateLabel)
 		apiRoutes.Delete("/labels/:id", labelHandler.DeleteLabel)
+		apiRoutes.Post("/labels/:labelId/assign", labelHandler.BulkAssignLabel)
 		apiRoutes.Post("/emails/:emailId/labels/:labelId", labelHandler.AssignLabel)
 		apiRoutes.Delete("/emails/:emailId/labels/:labelId", labelHandler.RemoveLabel)
 		apiRoutes.Get("/emails/:emailId/labels", labelHandler.GetEmailLabels)
 
+		// Compose snippet routes
+		apiRoutes.Get("/snippets", snippetHandler.GetSnippets)
+		apiRoutes.Post("/snippets", snippetHandler.CreateSnippet)
+		apiRoutes.Put("/snippets/:id", snippetHandler.UpdateSnippet)
+		apiRoutes.Delete("/snippets/:id", snippetHandler.DeleteSnippet)
+
+		// Internal note routes
+		apiRoutes.Get("/notes", noteHandler.GetNotes)
+		apiRoutes.Post("/notes", noteHandler.CreateNote)
+		apiRoutes.Put("/notes/:id", noteHandler.UpdateNote)
+		apiRoutes.Delete("/notes/:id", noteHandler.DeleteNote)
+
+		// Share link routes
+		apiRoutes.Post("/email/:id/share", shareHandler.CreateShare)
+		apiRoutes.Get("/shares", shareHandler.GetShares)
+		apiRoutes.Delete("/shares/:id", shareHandler.RevokeShare)
+		if largeFileHandler != nil {
+			apiRoutes.Get("/files", largeFileHandler.GetFiles)
+			apiRoutes.Delete("/files/:id", largeFileHandler.DeleteFile)
+		}
+
+		// Webhook routes
+		apiRoutes.Get("/webhooks", webhookHandler.GetWebhooks)
+		apiRoutes.Post("/webhooks", webhookHandler.CreateWebhook)
+		apiRoutes.Delete("/webhooks/:id", webhookHandler.DeleteWebhook)
+		apiRoutes.Post("/webhooks/:id/test", webhookHandler.TestWebhook)
+
+		// Theme routes
+		apiRoutes.Get("/themes", themeHandler.GetThemes)
+		apiRoutes.Put("/theme", themeHandler.SetTheme)
+		apiRoutes.Post("/themes", themeHandler.CreateTheme)
+		apiRoutes.Delete("/themes/:id", themeHandler.DeleteTheme)
+
 		// i18n routes
 		apiRoutes.Get("/i18n/:lang", i18nHandler.GetTranslations)
 
 		// Draft routes
-		draftHandler := api.NewDraftHandler(store, draftStorage)
+		draftHandler := api.NewDraftHandler(store, draftStorage, userStorage, systemSettings, largeFileHandler)
 		apiRoutes.Get("/drafts", draftHandler.GetDrafts)
 		apiRoutes.Get("/drafts/:id", draftHandler.GetDraft)
 		apiRoutes.Post("/drafts", draftHandler.SaveDraft)
 		apiRoutes.Post("/drafts/autosave", draftHandler.AutoSave)
 		apiRoutes.Delete("/drafts/:id", draftHandler.DeleteDraft)
+		apiRoutes.Get("/drafts/:id/uploads", draftHandler.GetUploads)
+		apiRoutes.Post("/drafts/:id/uploads", draftHandler.CreateUpload)
+		apiRoutes.Get("/drafts/:id/uploads/:upload", draftHandler.GetUpload)
+		apiRoutes.Put("/drafts/:id/uploads/:upload/chunks/:index", draftHandler.UploadChunk)
+		apiRoutes.Post("/drafts/:id/uploads/:upload/complete", draftHandler.CompleteUpload)
+		apiRoutes.Post("/drafts/:id/uploads/:upload/link", draftHandler.LinkUpload)
+		apiRoutes.Delete("/drafts/:id/uploads/:upload", draftHandler.DeleteUpload)
 
 		// Settings routes
 		apiRoutes.Post("/settings/general", webSettingsHandler.UpdateGeneralSettings)
-
-		// User management routes
+		apiRoutes.Get("/settings/notifications", preferencesHandler.GetNotificationPreferences)
+		apiRoutes.Post("/settings/notifications", preferencesHandler.UpdateNotificationPreferences)
+		apiRoutes.Put("/settings/notifications", preferencesHandler.UpdateNotificationPreferences)
+		apiRoutes.Get("/settings/preferences", preferencesHandler.GetPreferences)
+		apiRoutes.Post("/settings/preferences", preferencesHandler.UpdatePreferences)
+		apiRoutes.Put("/settings/preferences", preferencesHandler.UpdatePreferences)
+		apiRoutes.Delete("/settings/preferences", preferencesHandler.ResetPreferences)
+		apiRoutes.Get("/settings/shortcuts", preferencesHandler.GetShortcuts)
+		apiRoutes.Put("/settings/shortcuts", preferencesHandler.UpdateShortcuts)
+		apiRoutes.Get("/settings/compose", preferencesHandler.GetComposePreferences)
+		apiRoutes.Put("/settings/compose", preferencesHandler.UpdateComposePreferences)
+		apiRoutes.Get("/settings/image-senders", preferencesHandler.GetImageSenders)
+		apiRoutes.Post("/settings/image-senders", preferencesHandler.AddImageSender)
+		apiRoutes.Delete("/settings/image-senders/:sender", preferencesHandler.RemoveImageSender)
+		apiRoutes.Get("/settings/blocked-senders", preferencesHandler.GetBlockedSenders)
+		apiRoutes.Post("/settings/blocked-senders", preferencesHandler.BlockSender)
+		apiRoutes.Delete("/settings/blocked-senders/:sender", preferencesHandler.UnblockSender)
+		apiRoutes.Get("/settings/spam", preferencesHandler.GetSpamPreferences)
+		apiRoutes.Put("/settings/spam", preferencesHandler.UpdateSpamPreferences)
+		apiRoutes.Delete("/settings/spam/training", preferencesHandler.ResetSpamFilter)
+		apiRoutes.Get("/settings/assist", preferencesHandler.GetAssistPreferences)
+		apiRoutes.Put("/settings/assist", preferencesHandler.UpdateAssistPreferences)
+		apiRoutes.Get("/config", preferencesHandler.GetClientConfig)
+
+		// Users can change their own password; the rest is admin only
 		userHandler := api.NewUserHandler(store, config, userStorage)
-		apiRoutes.Get("/users", userHandler.GetUsers)
-		apiRoutes.Put("/users/:id", userHandler.UpdateUser)
-		apiRoutes.Delete("/users/:id", userHandler.DeleteUser)
-		apiRoutes.Post("/users", userHandler.CreateUser)
 		apiRoutes.Put("/users/:id/password", userHandler.UpdatePassword)
+
+		// Admin routes
+		adminRoutes := apiRoutes.Group("/admin", api.AdminMiddleware(userStorage), api.AuditMiddleware(auditStorage))
+		adminRoutes.Get("/stats", adminHandler.GetStats)
+		adminRoutes.Get("/sessions", adminHandler.GetSessions)
+		adminRoutes.Get("/logs", logHandler.GetLogs)
+		adminRoutes.Get("/audit", logHandler.GetAudit)
+		adminRoutes.Get("/settings", systemSettingsHandler.GetSettings)
+		adminRoutes.Put("/settings", systemSettingsHandler.UpdateSettings)
+		adminRoutes.Delete("/settings", systemSettingsHandler.ResetSettings)
+		adminRoutes.Get("/users", userHandler.GetUsers)
+		adminRoutes.Post("/users", userHandler.CreateUser)
+		adminRoutes.Put("/users/:id", userHandler.UpdateUser)
+		adminRoutes.Put("/users/:id/role", userHandler.UpdateUser)
+		adminRoutes.Put("/users/:id/limits", userHandler.UpdateLimits)
+		adminRoutes.Delete("/users/:id/sessions", adminHandler.RevokeUserSessions)
+		adminRoutes.Delete("/users/:id", userHandler.DeleteUser)
+		adminRoutes.Put("/users/:id/password", userHandler.UpdatePassword)
 	}
 
 	// HTMX routes (partial template renders)
@@ -2,9 +2,9 @@ package middleware
 
 import (
 	"lilmail/utils"
-	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"golang.org/x/text/language"
 )
 
 // LocaleMiddleware detects and sets the user's locale
@@ -22,34 +22,46 @@ func LocaleMiddleware() fiber.Handler {
 
 		// 3. Try to get language from Accept-Language header
 		if lang == "" {
-			acceptLang := c.Get("Accept-Language")
-			if strings.HasPrefix(acceptLang, "ja") {
-				lang = "ja"
-			} else {
-				lang = "en"
-			}
+			lang = acceptedLanguage(c.Get("Accept-Language"))
 		}
 
-		// Default to English
-		if lang == "" {
-			lang = "en"
-		}
+		SetLocale(c, lang)
 
-		// Only allow supported languages
-		if lang != "en" && lang != "ja" {
-			lang = "en"
-		}
+		// Log the detected language
+		utils.Log.Debug("Locale detected: %s for path: %s", c.Locals("lang"), c.Path())
+
+		return c.Next()
+	}
+}
 
-		// Get localizer for this language
-		localizer := utils.GetLocalizer(lang)
+// SetLocale stores the localizer for lang in the context, falling back to
+// English for unsupported languages
+func SetLocale(c *fiber.Ctx, lang string) {
+	// Only allow registered languages
+	if lang = utils.SupportedLanguage(lang); lang == "" {
+		lang = "en"
+	}
 
-		// Store in context
-		c.Locals("localizer", localizer)
-		c.Locals("lang", lang)
+	// Get localizer for this language
+	localizer := utils.GetLocalizer(lang)
 
-		// Log the detected language
-		utils.Log.Debug("Locale detected: %s for path: %s", lang, c.Path())
+	// Store in context
+	c.Locals("localizer", localizer)
+	c.Locals("lang", lang)
+	c.Bind(fiber.Map{"Lang": lang})
+}
 
-		return c.Next()
+// acceptedLanguage returns the registered language the browser prefers
+// most, or "en"
+func acceptedLanguage(header string) string {
+	tags, _, err := language.ParseAcceptLanguage(header)
+	if err != nil {
+		return "en"
+	}
+	for _, tag := range tags {
+		if lang := utils.SupportedLanguage(tag.String()); lang != "" {
+			return lang
+		}
 	}
+	return "en"
 }
@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"lilmail/utils"
+	"strconv"
 	"sync"
 	"time"
 
@@ -8,52 +10,110 @@ import (
 	"golang.org/x/time/rate"
 )
 
-// RateLimiter creates a rate limiting middleware
-func RateLimiter(requests int, duration time.Duration) fiber.Handler {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
+// Limiter counts the requests of clients
+type Limiter interface {
+	// Allow records a request by key and reports whether it is within n
+	// requests per window
+	Allow(key string, n int, window time.Duration) bool
+}
+
+// RateLimiter creates a rate limiting middleware. The limit is read on
+// every request so it can be changed at runtime.
+func RateLimiter(limiter Limiter, requests func() int, duration time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		n := requests()
+		if n < 1 {
+			n = 1
+		}
+
+		if !limiter.Allow(c.IP(), n, duration) {
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": "Rate limit exceeded. Please try again later.",
+			})
+		}
+
+		return c.Next()
 	}
+}
+
+// memoryLimiter keeps a token bucket per client in this process
+type memoryLimiter struct {
+	clients map[string]*limitedClient
+	mu      sync.Mutex
+}
+
+type limitedClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
 
-	var (
-		clients = make(map[string]*client)
-		mu      sync.Mutex
-	)
+// NewMemoryLimiter creates a limiter for a single instance
+func NewMemoryLimiter() Limiter {
+	l := &memoryLimiter{clients: make(map[string]*limitedClient)}
 
 	// Cleanup old clients every 5 minutes
 	go func() {
 		for {
 			time.Sleep(5 * time.Minute)
-			mu.Lock()
-			for ip, c := range clients {
+			l.mu.Lock()
+			for ip, c := range l.clients {
 				if time.Since(c.lastSeen) > 10*time.Minute {
-					delete(clients, ip)
+					delete(l.clients, ip)
 				}
 			}
-			mu.Unlock()
+			l.mu.Unlock()
 		}
 	}()
 
-	return func(c *fiber.Ctx) error {
-		ip := c.IP()
-
-		mu.Lock()
-		cl, exists := clients[ip]
-		if !exists {
-			// Create new limiter: requests per duration
-			limiter := rate.NewLimiter(rate.Every(duration/time.Duration(requests)), requests)
-			cl = &client{limiter: limiter}
-			clients[ip] = cl
-		}
-		cl.lastSeen = time.Now()
-		mu.Unlock()
+	return l
+}
 
-		if !cl.limiter.Allow() {
-			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
-				"error": "Rate limit exceeded. Please try again later.",
-			})
-		}
+func (l *memoryLimiter) Allow(key string, n int, window time.Duration) bool {
+	limit := rate.Every(window / time.Duration(n))
 
-		return c.Next()
+	l.mu.Lock()
+	cl, exists := l.clients[key]
+	if !exists {
+		// Create new limiter: requests per duration
+		cl = &limitedClient{limiter: rate.NewLimiter(limit, n)}
+		l.clients[key] = cl
+	} else if cl.limiter.Burst() != n {
+		// The limit was changed since this client was last seen
+		cl.limiter.SetLimit(limit)
+		cl.limiter.SetBurst(n)
+	}
+	cl.lastSeen = time.Now()
+	l.mu.Unlock()
+
+	return cl.limiter.Allow()
+}
+
+// redisIncrScript counts a request in the current window of a key, starting
+// a window with the first request
+const redisIncrScript = `local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return n`
+
+// redisLimiter counts requests in fixed windows kept in Redis, so every
+// instance behind a load balancer enforces the same limit
+type redisLimiter struct {
+	client *utils.RedisClient
+	prefix string
+}
+
+// NewRedisLimiter creates a limiter shared by the instances using the same
+// Redis server and prefix
+func NewRedisLimiter(client *utils.RedisClient, prefix string) Limiter {
+	return &redisLimiter{client: client, prefix: prefix + "ratelimit:"}
+}
+
+func (l *redisLimiter) Allow(key string, n int, window time.Duration) bool {
+	reply, err := l.client.Do("EVAL", redisIncrScript, "1", l.prefix+key, strconv.FormatInt(window.Milliseconds(), 10))
+	if err != nil {
+		// Let requests through rather than take the app down with Redis
+		utils.Log.Warn("Rate limit check failed: %v", err)
+		return true
 	}
+	count, _ := reply.(int64)
+	return count <= int64(n)
 }
@@ -2,23 +2,75 @@ package models
 
 import "time"
 
+// Protocols an account's mail is read with
+const (
+	ProtocolIMAP = "imap"
+	ProtocolJMAP = "jmap"
+	ProtocolPOP3 = "pop3"
+	// ProtocolGraph reads a Microsoft 365 mailbox through Microsoft Graph
+	ProtocolGraph = "graph"
+	// ProtocolMaildir reads the user's Maildir on the lilmail host
+	ProtocolMaildir = "maildir"
+)
+
+// Ways an IMAP account logs in to its IMAP and SMTP servers
+const (
+	AuthPassword = "password"
+	// AuthXOAuth2 logs in over XOAUTH2 with access tokens of the OAuth
+	// refresh token kept as the account's password
+	AuthXOAuth2 = "xoauth2"
+)
+
 // Account represents an email account configuration
 type Account struct {
-	ID          string    `json:"id"`
-	UserID      string    `json:"user_id"`
-	Email       string    `json:"email"`
-	IMAPServer  string    `json:"imap_server"`
-	IMAPPort    int       `json:"imap_port"`
-	IMAPSSL     bool      `json:"imap_ssl"`
-	SMTPServer  string    `json:"smtp_server"`
-	SMTPPort    int       `json:"smtp_port"`
-	SMTPSSL     bool      `json:"smtp_ssl"`
-	Username    string    `json:"username"`
-	Password    string    `json:"-"` // Never expose in JSON
-	DisplayName string    `json:"display_name"`
-	IsDefault   bool      `json:"is_default"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID            string          `json:"id"`
+	UserID        string          `json:"user_id"`
+	Email         string          `json:"email"`
+	Protocol      string          `json:"protocol"` // ProtocolIMAP when empty
+	Auth          string          `json:"auth"`     // AuthPassword when empty
+	JMAPURL       string          `json:"jmap_url"` // JMAP session resource URL
+	POP3Server    string          `json:"pop3_server"`
+	POP3Port      int             `json:"pop3_port"`       // 995 (TLS) when zero
+	LeaveOnServer bool            `json:"leave_on_server"` // Keep downloaded mail on the POP3 server
+	IMAPServer    string          `json:"imap_server"`
+	IMAPPort      int             `json:"imap_port"`
+	IMAPSSL       bool            `json:"imap_ssl"`
+	SMTPServer    string          `json:"smtp_server"`
+	SMTPPort      int             `json:"smtp_port"`
+	SMTPSSL       bool            `json:"smtp_ssl"`
+	Username      string          `json:"username"`
+	Password      string          `json:"-"` // Never expose in JSON. The OAuth refresh token of Graph and XOAUTH2 accounts.
+	DisplayName   string          `json:"display_name"`
+	IsDefault     bool            `json:"is_default"`
+	Compose       ComposeSettings `json:"compose"` // Overrides the user's compose defaults for this account
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+// UsesJMAP reports whether the account's mail is read over JMAP
+func (a *Account) UsesJMAP() bool {
+	return a.Protocol == ProtocolJMAP
+}
+
+// UsesPOP3 reports whether the account's mail is downloaded over POP3
+func (a *Account) UsesPOP3() bool {
+	return a.Protocol == ProtocolPOP3
+}
+
+// UsesGraph reports whether the account's mail is read through Microsoft Graph
+func (a *Account) UsesGraph() bool {
+	return a.Protocol == ProtocolGraph
+}
+
+// UsesXOAuth2 reports whether the account logs in with an OAuth token
+// instead of its password
+func (a *Account) UsesXOAuth2() bool {
+	return a.Auth == AuthXOAuth2
+}
+
+// UsesMaildir reports whether the account's mail is read from a local Maildir
+func (a *Account) UsesMaildir() bool {
+	return a.Protocol == ProtocolMaildir
 }
 
 // AccountCredentials represents decrypted account credentials
@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// Audit event actions recorded outside the admin API
+const (
+	AuditLogin       = "login"
+	AuditLoginFailed = "login_failed"
+	AuditLogout      = "logout"
+)
+
+// AuditEvent records who did what, for admins investigating an incident
+type AuditEvent struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`             // Username of the actor
+	Action string    `json:"action"`           // e.g. "login" or "PUT /api/admin/settings"
+	Target string    `json:"target,omitempty"` // What the action was applied to
+	IP     string    `json:"ip,omitempty"`
+	Status int       `json:"status,omitempty"` // HTTP status of admin API calls
+}
+
+// AuditFilter selects audit events. Zero values match anything.
+type AuditFilter struct {
+	User   string
+	Action string
+	Since  time.Time
+	Until  time.Time
+}
+
+// Matches reports whether the event passes the filter
+func (f AuditFilter) Matches(event *AuditEvent) bool {
+	if f.User != "" && event.User != f.User {
+		return false
+	}
+	if f.Action != "" && event.Action != f.Action {
+		return false
+	}
+	if !f.Since.IsZero() && event.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && event.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
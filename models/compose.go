@@ -0,0 +1,70 @@
+package models
+
+import "fmt"
+
+// Compose formats
+const (
+	ComposeFormatHTML  = "html"
+	ComposeFormatPlain = "plain"
+)
+
+// Reply quote styles
+const (
+	QuoteStyleBottom = "bottom" // Reply on top, original quoted below it
+	QuoteStyleInline = "inline" // Original quoted first, reply written under or between it
+)
+
+// ComposeFonts are the fonts the editor offers; "" keeps the editor default
+var ComposeFonts = []string{"", "sans-serif", "serif", "monospace"}
+
+// ComposeSettings are the defaults the compose window opens with. On an
+// account, empty fields fall back to the user's settings.
+type ComposeSettings struct {
+	Format     string `json:"format,omitempty" form:"format"`
+	Font       string `json:"font,omitempty" form:"font"`
+	QuoteStyle string `json:"quote_style,omitempty" form:"quote_style"`
+}
+
+// DefaultComposeSettings returns the compose defaults of a new user
+func DefaultComposeSettings() ComposeSettings {
+	return ComposeSettings{
+		Format:     ComposeFormatHTML,
+		QuoteStyle: QuoteStyleBottom,
+	}
+}
+
+// Validate checks the fields that are set
+func (s ComposeSettings) Validate() error {
+	switch s.Format {
+	case "", ComposeFormatHTML, ComposeFormatPlain:
+	default:
+		return fmt.Errorf("unknown compose format %q", s.Format)
+	}
+
+	switch s.QuoteStyle {
+	case "", QuoteStyleBottom, QuoteStyleInline:
+	default:
+		return fmt.Errorf("unknown quote style %q", s.QuoteStyle)
+	}
+
+	for _, font := range ComposeFonts {
+		if s.Font == font {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown font %q", s.Font)
+}
+
+// Merge returns s with the fields set in override replacing its own
+func (s ComposeSettings) Merge(override ComposeSettings) ComposeSettings {
+	if override.Format != "" {
+		s.Format = override.Format
+	}
+	if override.Font != "" {
+		s.Font = override.Font
+	}
+	if override.QuoteStyle != "" {
+		s.QuoteStyle = override.QuoteStyle
+	}
+	return s
+}
@@ -2,16 +2,73 @@ package models
 
 import "time"
 
-// Draft represents a saved email draft
+// Draft represents a saved email draft. Revision counts its saves, so an
+// editor can tell when the draft has changed elsewhere.
 type Draft struct {
 	ID        string    `json:"id"`
 	UserID    string    `json:"user_id"`
+	AccountID string    `json:"account_id"`
 	To        string    `json:"to"`
 	Cc        string    `json:"cc"`
 	Bcc       string    `json:"bcc"`
 	Subject   string    `json:"subject"`
 	Body      string    `json:"body"`
 	IsHTML    bool      `json:"is_html"`
+	Revision  int       `json:"revision"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
+
+// SameContent reports whether two drafts hold the same message
+func (d *Draft) SameContent(other *Draft) bool {
+	return d.To == other.To && d.Cc == other.Cc && d.Bcc == other.Bcc &&
+		d.Subject == other.Subject && d.Body == other.Body && d.IsHTML == other.IsHTML
+}
+
+// DraftUpload is an attachment uploaded to a draft in chunks. Received
+// holds the SHA-256 of each chunk stored so far, so an interrupted upload
+// can carry on with the chunks that are missing.
+type DraftUpload struct {
+	ID          string         `json:"id"`
+	DraftID     string         `json:"draft_id"`
+	Filename    string         `json:"filename"`
+	ContentType string         `json:"content_type"`
+	Size        int64          `json:"size"`
+	ChunkSize   int64          `json:"chunk_size"`
+	Chunks      int            `json:"chunks"`
+	Received    map[int]string `json:"received"`
+	Checksum    string         `json:"checksum,omitempty"`
+	Complete    bool           `json:"complete"`
+	CreatedAt   time.Time      `json:"created_at"`
+}
+
+// ChunkLength is the size chunk index must have
+func (u *DraftUpload) ChunkLength(index int) int64 {
+	if index == u.Chunks-1 {
+		return u.Size - int64(index)*u.ChunkSize
+	}
+	return u.ChunkSize
+}
+
+// ReceivedBytes is how much of the file has been uploaded
+func (u *DraftUpload) ReceivedBytes() int64 {
+	if u.Complete {
+		return u.Size
+	}
+	var received int64
+	for index := range u.Received {
+		received += u.ChunkLength(index)
+	}
+	return received
+}
+
+// Missing lists the chunks not uploaded yet
+func (u *DraftUpload) Missing() []int {
+	missing := []int{}
+	for i := 0; i < u.Chunks; i++ {
+		if _, ok := u.Received[i]; !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
@@ -2,6 +2,8 @@ package models
 
 import (
 	"html/template"
+	"path"
+	"strings"
 	"time"
 )
 
@@ -13,11 +15,13 @@ type Email struct {
 	To              string        `json:"to"`
 	ToNames         []string      `json:"to_names"`
 	Cc              string        `json:"cc"`
+	ReplyTo         string        `json:"reply_to,omitempty"`
 	Subject         string        `json:"subject"`
 	Date            time.Time     `json:"date"`
 	Body            string        `json:"body"`
 	HTML            template.HTML `json:"html"`
 	Preview         string        `json:"preview"`
+	Snippet         template.HTML `json:"snippet,omitempty"` // Highlighted search match context
 	Flags           []string      `json:"flags"`
 	Attachments     []Attachment  `json:"attachments"`
 	HasAttachments  bool          `json:"has_attachments"`
@@ -27,15 +31,73 @@ type Email struct {
 	InReplyTo       string        `json:"in_reply_to"`
 	References      []string      `json:"references"`
 	ThreadID        string        `json:"thread_id"`
+	ListID          string        `json:"list_id,omitempty"` // List-Id header of mailing list mail
 	
 	// Labels
 	Labels          []Label       `json:"labels"`
+
+	// schema.org JSON-LD blocks found in the HTML body, for summary cards
+	StructuredData  []string      `json:"structured_data,omitempty"`
+
+	// Sender's standing with the user, see SenderKnown and SenderFirstTime
+	SenderStatus    string        `json:"sender_status,omitempty"`
+
+	// Set on search results spanning several folders
+	Folder          string        `json:"folder,omitempty"`    // Folder the message was fetched from
+	Locations       []string      `json:"locations,omitempty"` // Every folder holding a copy, if more than one
 }
 
+// Sender statuses of a message, from the user's correspondence with its sender
+const (
+	SenderKnown     = "known"      // The user has written to the sender
+	SenderFirstTime = "first_time" // No earlier message from the sender is known
+)
+
 // Attachment represents an email attachment
 type Attachment struct {
 	Filename    string `json:"filename"`
 	ContentType string `json:"content_type"`
+	Part        string `json:"part"` // IMAP section, e.g. "2.1"
 	Size        int    `json:"size"`
 	Content     []byte `json:"-"` // Excluded from JSON
 }
+
+// IndexedAttachment is an entry of the attachment index kept with the
+// message cache, enough to list an attachment without fetching its message
+type IndexedAttachment struct {
+	Folder       string    `json:"folder"`
+	EmailID      string    `json:"email_id"` // UID
+	Index        int       `json:"index"`    // Position among the message's attachments
+	Filename     string    `json:"filename"`
+	ContentType  string    `json:"content_type"`
+	Size         int       `json:"size"`
+	EmailSubject string    `json:"email_subject"`
+	EmailFrom    string    `json:"email_from"`
+	EmailDate    time.Time `json:"email_date"`
+}
+
+// Kinds of attachment previews
+const (
+	PreviewImage = "image"
+	PreviewPDF   = "pdf"
+	PreviewText  = "text"
+	PreviewCSV   = "csv"
+)
+
+// PreviewKind returns how the attachment can be previewed, or "" if it can't
+func (a Attachment) PreviewKind() string {
+	contentType := strings.ToLower(a.ContentType)
+	ext := strings.ToLower(path.Ext(a.Filename))
+
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return PreviewImage
+	case contentType == "application/pdf" || ext == ".pdf":
+		return PreviewPDF
+	case contentType == "text/csv" || ext == ".csv":
+		return PreviewCSV
+	case contentType == "text/plain" || ext == ".txt" || ext == ".log" || ext == ".md":
+		return PreviewText
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// HeaderField is a single message header, in the order it appears
+type HeaderField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ReceivedHop is one Received header: a server the message passed through.
+// Hops are listed in the order the message travelled, oldest first.
+type ReceivedHop struct {
+	From  string    `json:"from,omitempty"`
+	By    string    `json:"by,omitempty"`
+	With  string    `json:"with,omitempty"`
+	Date  time.Time `json:"date,omitempty"`
+	Delay int       `json:"delay"` // Seconds since the previous hop
+	Raw   string    `json:"raw"`
+}
+
+// MessagePart describes a MIME part of a message
+type MessagePart struct {
+	Part        string `json:"part"` // IMAP section, e.g. "2.1"
+	ContentType string `json:"content_type"`
+	Charset     string `json:"charset,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Disposition string `json:"disposition,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	Size        int    `json:"size"`
+}
+
+// MessageHeaders are a message's full headers and the delivery details
+// derived from them
+type MessageHeaders struct {
+	Headers               []HeaderField `json:"headers"`
+	Received              []ReceivedHop `json:"received"`
+	AuthenticationResults []string      `json:"authentication_results"`
+	Parts                 []MessagePart `json:"parts"`
+	Raw                   string        `json:"raw"`
+}
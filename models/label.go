@@ -1,11 +1,119 @@
 package models
 
+import (
+	"sort"
+	"strings"
+)
+
 // Label represents an email label/tag
 type Label struct {
-	ID      string `json:"id"`
-	UserID  string `json:"user_id"`
-	Name    string `json:"name"`
-	Color   string `json:"color"` // Hex code, e.g. "#FF0000"
+	ID          string      `json:"id"`
+	UserID      string      `json:"user_id"`
+	Name        string      `json:"name"`
+	Color       string      `json:"color"` // Hex code, e.g. "#FF0000"
+	Description string      `json:"description,omitempty"`
+	ParentID    string      `json:"parent_id,omitempty"` // Empty for top level labels
+	Rules       []LabelRule `json:"rules,omitempty"`     // Conditions for applying the label automatically
+}
+
+// LabelRule is a set of conditions that all have to match for a label to be
+// applied to incoming mail
+type LabelRule struct {
+	SenderDomain    string   `json:"sender_domain,omitempty"`    // e.g. "acme.com", also matches subdomains
+	SubjectKeywords []string `json:"subject_keywords,omitempty"` // Any keyword may match
+	ListID          string   `json:"list_id,omitempty"`          // Mailing list List-Id
+}
+
+// IsEmpty reports whether the rule has no conditions
+func (r LabelRule) IsEmpty() bool {
+	return r.SenderDomain == "" && len(r.SubjectKeywords) == 0 && r.ListID == ""
+}
+
+// Matches reports whether an email meets every condition of the rule. A rule
+// without conditions matches nothing.
+func (r LabelRule) Matches(email *Email) bool {
+	if r.IsEmpty() {
+		return false
+	}
+
+	if r.SenderDomain != "" {
+		domain := strings.ToLower(strings.TrimPrefix(r.SenderDomain, "@"))
+		at := strings.LastIndex(email.From, "@")
+		if at < 0 {
+			return false
+		}
+		from := strings.ToLower(email.From[at+1:])
+		if from != domain && !strings.HasSuffix(from, "."+domain) {
+			return false
+		}
+	}
+
+	if len(r.SubjectKeywords) > 0 {
+		subject := strings.ToLower(email.Subject)
+		found := false
+		for _, keyword := range r.SubjectKeywords {
+			if keyword != "" && strings.Contains(subject, strings.ToLower(keyword)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if r.ListID != "" && !strings.EqualFold(strings.Trim(r.ListID, "<>"), email.ListID) {
+		return false
+	}
+
+	return true
+}
+
+// LabelNode is a label placed in its hierarchy, with message counts
+type LabelNode struct {
+	Label
+	Path       string       `json:"path"`        // e.g. "Clients/Acme"
+	Depth      int          `json:"depth"`       // 0 for top level labels
+	Count      int          `json:"count"`       // Emails with this label
+	TotalCount int          `json:"total_count"` // Count including nested labels
+	Children   []*LabelNode `json:"children"`
+}
+
+// BuildLabelTree arranges labels by ParentID and rolls up the per-label
+// counts. Labels whose parent is missing are shown at the top level.
+func BuildLabelTree(labels []Label, counts map[string]int) []*LabelNode {
+	nodes := make(map[string]*LabelNode, len(labels))
+	for _, label := range labels {
+		nodes[label.ID] = &LabelNode{Label: label, Count: counts[label.ID], Children: []*LabelNode{}}
+	}
+
+	var roots []*LabelNode
+	for _, label := range labels {
+		node := nodes[label.ID]
+		if parent, ok := nodes[label.ParentID]; ok && label.ParentID != label.ID {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	var walk func(nodes []*LabelNode, prefix string, depth int) int
+	walk = func(nodes []*LabelNode, prefix string, depth int) int {
+		sort.Slice(nodes, func(i, j int) bool {
+			return strings.ToLower(nodes[i].Name) < strings.ToLower(nodes[j].Name)
+		})
+		total := 0
+		for _, node := range nodes {
+			node.Path = prefix + node.Name
+			node.Depth = depth
+			node.TotalCount = node.Count + walk(node.Children, node.Path+"/", depth+1)
+			total += node.TotalCount
+		}
+		return total
+	}
+	walk(roots, "", 0)
+
+	return roots
 }
 
 // EmailLabel represents a many-to-many relationship between emails and labels
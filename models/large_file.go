@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// LargeFile is a file sent as an expiring download link instead of as an
+// attachment. Key names it in the file store.
+type LargeFile struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	Key         string    `json:"-"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Downloads   int       `json:"downloads"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Active reports whether the file can still be downloaded
+func (f *LargeFile) Active() bool {
+	return time.Now().Before(f.ExpiresAt)
+}
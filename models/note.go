@@ -0,0 +1,30 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// Note is an internal note on a message. Notes are never emailed. A shared
+// note is visible to every user signed in to the same mailbox, others only
+// to their author.
+type Note struct {
+	ID         string    `json:"id"`
+	Mailbox    string    `json:"-"`           // Address of the mailbox the message is in
+	MessageKey string    `json:"message_key"` // See NoteKey
+	Author     string    `json:"author"`
+	Body       string    `json:"body"`
+	Shared     bool      `json:"shared"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// NoteKey identifies a message for its notes. The Message-ID is used when
+// there is one, so notes follow a message between folders and are the same
+// for everyone reading the mailbox; otherwise the folder and UID are.
+func NoteKey(email Email, folder string) string {
+	if email.MessageID != "" {
+		return "<" + strings.Trim(email.MessageID, "<>") + ">"
+	}
+	return folder + "/" + email.ID
+}
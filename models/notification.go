@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// Notification represents a real-time notification
+type Notification struct {
+	ID      string                 `json:"id"`
+	Seq     uint64                 `json:"seq"`  // Per-user increasing number, used as the SSE event ID
+	Type    string                 `json:"type"` // "new_email", "deleted", "status_change"
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data"`
+	Time    time.Time              `json:"time"`
+}
@@ -1,5 +1,7 @@
 package models
 
+import "sort"
+
 // PaginatedEmails represents a paginated list of emails
 type PaginatedEmails struct {
 	Emails      []Email `json:"emails"`
@@ -28,3 +30,65 @@ func NewPaginatedEmails(emails []Email, page, pageSize, totalEmails uint32) *Pag
 		HasPrev:     page > 1,
 	}
 }
+
+// PaginatedThreads represents a paginated list of threads, newest activity first
+type PaginatedThreads struct {
+	Threads      []*EmailThread `json:"threads"`
+	Page         uint32         `json:"page"`
+	PageSize     uint32         `json:"page_size"`
+	TotalPages   uint32         `json:"total_pages"`
+	TotalThreads uint32         `json:"total_threads"`
+	HasNext      bool           `json:"has_next"`
+	HasPrev      bool           `json:"has_prev"`
+}
+
+// NewPaginatedThreads sorts threads by last activity and returns the requested
+// page. complete reports whether threads covers the whole folder; if not, older
+// threads exist beyond the last known page.
+func NewPaginatedThreads(threads []*EmailThread, page, pageSize uint32, complete bool) *PaginatedThreads {
+	sorted := make([]*EmailThread, len(threads))
+	copy(sorted, threads)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LastDate.After(sorted[j].LastDate)
+	})
+
+	total := uint32(len(sorted))
+	totalPages := (total + pageSize - 1) / pageSize
+	if !complete && totalPages <= page {
+		totalPages = page + 1
+	}
+	if totalPages == 0 {
+		totalPages = 1
+	}
+
+	start := (page - 1) * pageSize
+	if start > total {
+		start = total
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+
+	return &PaginatedThreads{
+		Threads:      sorted[start:end],
+		Page:         page,
+		PageSize:     pageSize,
+		TotalPages:   totalPages,
+		TotalThreads: total,
+		HasNext:      page < totalPages,
+		HasPrev:      page > 1,
+	}
+}
+
+// PrevPage returns the number of the previous page
+func (p *PaginatedEmails) PrevPage() uint32 { return p.Page - 1 }
+
+// NextPage returns the number of the next page
+func (p *PaginatedEmails) NextPage() uint32 { return p.Page + 1 }
+
+// PrevPage returns the number of the previous page
+func (p *PaginatedThreads) PrevPage() uint32 { return p.Page - 1 }
+
+// NextPage returns the number of the next page
+func (p *PaginatedThreads) NextPage() uint32 { return p.Page + 1 }
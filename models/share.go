@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// SharedEmail is a read-only copy of a message that anyone with its link
+// can open until the link expires or is revoked. The copy is taken when the
+// link is created, so opening it needs no access to the mailbox.
+type SharedEmail struct {
+	ID          string             `json:"id"`
+	UserID      string             `json:"user_id"`
+	Folder      string             `json:"folder"`
+	EmailID     string             `json:"email_id"` // UID of the original
+	Email       Email              `json:"email"`
+	Attachments []SharedAttachment `json:"attachments,omitempty"` // Only if shared with attachments
+	ExpiresAt   time.Time          `json:"expires_at"`
+	Revoked     bool               `json:"revoked"`
+	Views       int                `json:"views"`
+	CreatedAt   time.Time          `json:"created_at"`
+}
+
+// SharedAttachment is an attachment copied into a shared message
+type SharedAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"`
+}
+
+// Active reports whether the link can still be opened
+func (s *SharedEmail) Active() bool {
+	return !s.Revoked && time.Now().Before(s.ExpiresAt)
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Snippet is a short piece of text a user can insert while composing, from
+// the snippet menu or by typing ";" and its shortcut followed by Tab
+type Snippet struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	Shortcut  string    `json:"shortcut,omitempty"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// SpamMinTraining is how many messages of each kind must be trained
+	// before the classifier gives a score
+	SpamMinTraining = 10
+	// SpamMaxTokens bounds a model's vocabulary; past it the rarest tokens
+	// are dropped
+	SpamMaxTokens = 50000
+)
+
+// SpamModel is a user's Naive Bayes spam classifier. It counts, for every
+// token, how many of the trained spam and non-spam messages contained it.
+type SpamModel struct {
+	SpamMessages int            `json:"spam_messages"`
+	HamMessages  int            `json:"ham_messages"`
+	Spam         map[string]int `json:"spam"`
+	Ham          map[string]int `json:"ham"`
+	// Trained records how each message was trained, by Message-ID, so a
+	// message can be retrained the other way without counting it twice
+	Trained map[string]bool `json:"trained"`
+}
+
+// NewSpamModel returns an untrained model
+func NewSpamModel() *SpamModel {
+	return &SpamModel{
+		Spam:    make(map[string]int),
+		Ham:     make(map[string]int),
+		Trained: make(map[string]bool),
+	}
+}
+
+// Ready reports whether enough messages were trained to score mail
+func (m *SpamModel) Ready() bool {
+	return m.SpamMessages >= SpamMinTraining && m.HamMessages >= SpamMinTraining
+}
+
+// Train counts the tokens of a message as spam or not spam. A message that
+// was trained the other way before is moved over; one trained the same way
+// is left alone. It reports whether the model changed.
+func (m *SpamModel) Train(key string, tokens []string, spam bool) bool {
+	if previous, ok := m.Trained[key]; ok && key != "" {
+		if previous == spam {
+			return false
+		}
+		m.count(tokens, previous, -1)
+	}
+
+	m.count(tokens, spam, 1)
+	if key != "" {
+		m.Trained[key] = spam
+	}
+	m.prune()
+	return true
+}
+
+// count adds delta to the message and token counts of one side
+func (m *SpamModel) count(tokens []string, spam bool, delta int) {
+	counts := m.Ham
+	if spam {
+		counts = m.Spam
+		m.SpamMessages += delta
+	} else {
+		m.HamMessages += delta
+	}
+
+	for _, token := range tokens {
+		counts[token] += delta
+		if counts[token] <= 0 {
+			delete(counts, token)
+		}
+	}
+}
+
+// Score returns the probability, from 0 to 1, that a message with the given
+// tokens is spam. Tokens the model has never seen are ignored.
+func (m *SpamModel) Score(tokens []string) float64 {
+	spamMessages := float64(m.SpamMessages)
+	hamMessages := float64(m.HamMessages)
+	if spamMessages == 0 || hamMessages == 0 {
+		return 0.5
+	}
+
+	// Log odds, starting from the share of trained mail that was spam
+	odds := math.Log(spamMessages) - math.Log(hamMessages)
+	for _, token := range tokens {
+		spam, ham := m.Spam[token], m.Ham[token]
+		if spam == 0 && ham == 0 {
+			continue
+		}
+		// Laplace smoothing keeps a token seen on one side only from
+		// deciding the score by itself
+		odds += math.Log((float64(spam)+1)/(spamMessages+2)) - math.Log((float64(ham)+1)/(hamMessages+2))
+	}
+	return 1 / (1 + math.Exp(-odds))
+}
+
+// prune drops the rarest tokens once the vocabulary outgrows SpamMaxTokens
+func (m *SpamModel) prune() {
+	total := len(m.Spam) + len(m.Ham)
+	if total <= SpamMaxTokens {
+		return
+	}
+
+	type tokenCount struct {
+		token string
+		count int
+	}
+	seen := make(map[string]int, total)
+	for token, n := range m.Spam {
+		seen[token] += n
+	}
+	for token, n := range m.Ham {
+		seen[token] += n
+	}
+	counts := make([]tokenCount, 0, len(seen))
+	for token, n := range seen {
+		counts = append(counts, tokenCount{token, n})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].count < counts[j].count })
+
+	// Drop down to three quarters so pruning doesn't run on every message
+	for _, tc := range counts {
+		if len(m.Spam)+len(m.Ham) <= SpamMaxTokens*3/4 {
+			break
+		}
+		delete(m.Spam, tc.token)
+		delete(m.Ham, tc.token)
+	}
+}
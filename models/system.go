@@ -0,0 +1,208 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// MaxAttachmentLimitMB is the highest attachment and message size admins
+// can allow. The HTTP body limit is sized from it.
+const MaxAttachmentLimitMB = 50
+
+// SystemSettings are the operational limits admins can change at runtime.
+// They start out as the [system] section of config.toml.
+type SystemSettings struct {
+	RequestsPerMinute   int       `json:"requests_per_minute"`
+	MaxAttachmentMB     int       `json:"max_attachment_mb"`  // Size of each attachment
+	MaxMessageMB        int       `json:"max_message_mb"`     // Size of a whole outgoing email
+	BlockedExtensions   []string  `json:"blocked_extensions"` // File extensions that can't be attached
+	AllowedServers      []string  `json:"allowed_servers"`    // IMAP/SMTP hosts users may add accounts for
+	DeniedServers       []string  `json:"denied_servers"`     // Hosts, IPs or CIDR ranges accounts may never use
+	RegistrationEnabled bool      `json:"registration_enabled"`
+	UpdatedAt           time.Time `json:"updated_at,omitempty"`
+	UpdatedBy           string    `json:"updated_by,omitempty"`
+}
+
+// Validate checks the limits are in range and normalizes the server lists
+func (s *SystemSettings) Validate() error {
+	if s.RequestsPerMinute < 1 {
+		return fmt.Errorf("requests per minute must be at least 1")
+	}
+	if s.MaxAttachmentMB < 1 || s.MaxAttachmentMB > MaxAttachmentLimitMB {
+		return fmt.Errorf("max attachment size must be between 1 and %d MB", MaxAttachmentLimitMB)
+	}
+	if s.MaxMessageMB < s.MaxAttachmentMB || s.MaxMessageMB > MaxAttachmentLimitMB {
+		return fmt.Errorf("max message size must be between the attachment size and %d MB", MaxAttachmentLimitMB)
+	}
+
+	extensions := make([]string, 0, len(s.BlockedExtensions))
+	for _, ext := range s.BlockedExtensions {
+		ext = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")
+		if ext == "" {
+			continue
+		}
+		if strings.ContainsAny(ext, " /\\.") {
+			return fmt.Errorf("invalid file extension %q", ext)
+		}
+		extensions = append(extensions, ext)
+	}
+	s.BlockedExtensions = extensions
+
+	allowed, err := normalizeServers(s.AllowedServers)
+	if err != nil {
+		return err
+	}
+	denied, err := normalizeServers(s.DeniedServers)
+	if err != nil {
+		return err
+	}
+	s.AllowedServers = allowed
+	s.DeniedServers = denied
+	return nil
+}
+
+// normalizeServers lowercases the entries of a server list, drops empty
+// ones and rejects anything that isn't a host, *.domain, IP or CIDR range
+func normalizeServers(list []string) ([]string, error) {
+	servers := make([]string, 0, len(list))
+	for _, server := range list {
+		server = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(server)), ".")
+		if server == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(server); err == nil {
+			servers = append(servers, server)
+			continue
+		}
+		if net.ParseIP(server) != nil {
+			servers = append(servers, server)
+			continue
+		}
+		if strings.ContainsAny(strings.TrimPrefix(server, "*."), " /:*") {
+			return nil, fmt.Errorf("invalid server %q", server)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// CheckServer returns an error when accounts may not connect to the host:
+// it is on the deny list, or there is an allow list it isn't on. IP and
+// CIDR entries are matched against the addresses the host resolves to.
+func (s *SystemSettings) CheckServer(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	if host == "" {
+		return fmt.Errorf("server is required")
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if needsAddresses(s.DeniedServers) || needsAddresses(s.AllowedServers) {
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			return fmt.Errorf("cannot resolve server %s", host)
+		}
+		ips = addrs
+	}
+
+	for _, pattern := range s.DeniedServers {
+		if serverMatches(pattern, host, ips) {
+			return fmt.Errorf("server %s is blocked on this instance", host)
+		}
+	}
+
+	if len(s.AllowedServers) == 0 {
+		return nil
+	}
+	for _, pattern := range s.AllowedServers {
+		if serverMatches(pattern, host, ips) {
+			return nil
+		}
+	}
+	return fmt.Errorf("server %s is not allowed on this instance", host)
+}
+
+// CheckAddress returns an error when an IP or CIDR entry of the deny list
+// matches an address a server resolved to. CheckServer checks servers by
+// name when accounts are saved; connections check the address they reach
+// with this, so the name can't be pointed somewhere else afterwards.
+func (s *SystemSettings) CheckAddress(ip net.IP) error {
+	for _, pattern := range s.DeniedServers {
+		if serverMatches(pattern, "", []net.IP{ip}) {
+			return fmt.Errorf("address %s is blocked on this instance", ip)
+		}
+	}
+	return nil
+}
+
+// needsAddresses reports whether a list has IP or CIDR entries
+func needsAddresses(list []string) bool {
+	for _, pattern := range list {
+		if strings.Contains(pattern, "/") || net.ParseIP(pattern) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func serverMatches(pattern, host string, ips []net.IP) bool {
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		for _, ip := range ips {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if patternIP := net.ParseIP(pattern); patternIP != nil {
+		for _, ip := range ips {
+			if patternIP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// MaxAttachmentBytes returns the attachment limit in bytes
+func (s *SystemSettings) MaxAttachmentBytes() int64 {
+	return int64(s.MaxAttachmentMB) << 20
+}
+
+// MaxMessageBytes returns the message size limit in bytes
+func (s *SystemSettings) MaxMessageBytes() int64 {
+	return int64(s.MaxMessageMB) << 20
+}
+
+// CheckAttachment returns an error naming the file when it is too large or
+// its extension is blocked
+func (s *SystemSettings) CheckAttachment(filename string, size int64) error {
+	if size > s.MaxAttachmentBytes() {
+		return fmt.Errorf("%s is larger than the %d MB attachment limit", filename, s.MaxAttachmentMB)
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(filename), "."))
+	for _, blocked := range s.BlockedExtensions {
+		if ext == blocked {
+			return fmt.Errorf("%s can't be attached: .%s files are blocked", filename, ext)
+		}
+	}
+	return nil
+}
+
+// CheckMessageSize returns an error when an outgoing email with its
+// attachments is over the message size limit
+func (s *SystemSettings) CheckMessageSize(size int64) error {
+	if size > s.MaxMessageBytes() {
+		return fmt.Errorf("the email with its attachments is larger than the %d MB limit", s.MaxMessageMB)
+	}
+	return nil
+}
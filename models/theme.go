@@ -0,0 +1,48 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ThemeAuto follows the browser's light/dark preference
+const ThemeAuto = "auto"
+
+// Theme is a color scheme applied through the data-theme attribute of the
+// page. Built-in themes live in main.css; custom ones are CSS custom
+// properties uploaded by an admin.
+type Theme struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	BuiltIn   bool              `json:"built_in"`
+	Variables map[string]string `json:"variables,omitempty"` // e.g. "--bg-primary": "#fdf6e3"
+	CreatedAt time.Time         `json:"created_at,omitempty"`
+}
+
+// BuiltinThemes are always available and can't be changed
+var BuiltinThemes = []*Theme{
+	{ID: "light", Name: "Light", BuiltIn: true},
+	{ID: "dark", Name: "Dark", BuiltIn: true},
+	{ID: "high-contrast", Name: "High contrast", BuiltIn: true},
+}
+
+// BuiltinTheme returns the built-in theme with the given ID, or nil
+func BuiltinTheme(id string) *Theme {
+	for _, theme := range BuiltinThemes {
+		if theme.ID == id {
+			return theme
+		}
+	}
+	return nil
+}
+
+var themeVariableName = regexp.MustCompile(`^--[a-z0-9-]+$`)
+
+// ValidThemeVariable reports whether a custom property can be written into
+// the theme stylesheet as is
+func ValidThemeVariable(name, value string) bool {
+	return themeVariableName.MatchString(name) &&
+		strings.TrimSpace(value) != "" &&
+		!strings.ContainsAny(value, ";{}<>\\\"'\n")
+}
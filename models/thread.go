@@ -1,6 +1,9 @@
 package models
 
-import "time"
+import (
+	"sort"
+	"time"
+)
 
 // Thread represents an email thread
 type EmailThread struct {
@@ -17,6 +20,7 @@ type EmailThread struct {
 	LatestDate   time.Time `json:"latest_date"`
 	Messages     []Email   `json:"messages"`
 	HasAttachment bool      `json:"has_attachment"`
+	Muted        bool      `json:"muted"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 }
@@ -30,4 +34,115 @@ type ThreadContainer struct {
 	IsDummy   bool
 }
 
+// ThreadNode is a message in a thread's reply tree
+type ThreadNode struct {
+	Email    Email         `json:"email"`
+	Children []*ThreadNode `json:"children"`
+}
+
+// BuildThreadTree arranges a thread's messages by who replied to whom.
+// Messages whose parent isn't in the thread become roots. Siblings are
+// ordered oldest first.
+func BuildThreadTree(messages []Email) []*ThreadNode {
+	nodes := make(map[string]*ThreadNode, len(messages))
+	ordered := make([]*ThreadNode, 0, len(messages))
+	for _, msg := range messages {
+		node := &ThreadNode{Email: msg, Children: []*ThreadNode{}}
+		ordered = append(ordered, node)
+		if msg.MessageID != "" {
+			nodes[msg.MessageID] = node
+		}
+	}
+
+	var roots []*ThreadNode
+	for _, node := range ordered {
+		var parent *ThreadNode
+		if p, ok := nodes[node.Email.InReplyTo]; ok && p != node {
+			parent = p
+		} else {
+			// Closest ancestor that is in the thread
+			refs := node.Email.References
+			for i := len(refs) - 1; i >= 0; i-- {
+				if p, ok := nodes[refs[i]]; ok && p != node {
+					parent = p
+					break
+				}
+			}
+		}
+
+		if parent != nil && !inThreadSubtree(node, parent) {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	var sortNodes func(nodes []*ThreadNode)
+	sortNodes = func(nodes []*ThreadNode) {
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].Email.Date.Before(nodes[j].Email.Date)
+		})
+		for _, node := range nodes {
+			sortNodes(node.Children)
+		}
+	}
+	sortNodes(roots)
+
+	return roots
+}
+
+// inThreadSubtree reports whether target is root or one of its descendants.
+// Attaching root under such a node would create a cycle.
+func inThreadSubtree(root, target *ThreadNode) bool {
+	if root == target {
+		return true
+	}
+	for _, child := range root.Children {
+		if inThreadSubtree(child, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// MailboxState holds the markers that change whenever a folder's contents do
+type MailboxState struct {
+	UIDValidity   uint32 `json:"uid_validity"`
+	UIDNext       uint32 `json:"uid_next"`
+	HighestModSeq uint64 `json:"highest_modseq"` // Zero without CONDSTORE
+	Messages      uint32 `json:"messages"`
+}
+
+// Changed reports whether the folder has changed since state was recorded.
+// Without CONDSTORE, flag changes go unnoticed but new and expunged
+// messages still show up in UIDNEXT and the message count.
+func (s *MailboxState) Changed(current *MailboxState) bool {
+	return s.UIDValidity != current.UIDValidity ||
+		s.UIDNext != current.UIDNext ||
+		s.HighestModSeq != current.HighestModSeq ||
+		s.Messages != current.Messages
+}
+
+// MutedThread is a conversation the user muted. MessageIDs holds the
+// Message-IDs seen in it and grows as replies arrive, so later replies that
+// only reference those are still recognised.
+type MutedThread struct {
+	ThreadID   string    `json:"thread_id"`
+	MessageIDs []string  `json:"message_ids"`
+	MutedAt    time.Time `json:"muted_at"`
+}
 
+// Matches reports whether email belongs to the muted conversation
+func (m *MutedThread) Matches(email *Email) bool {
+	for _, id := range m.MessageIDs {
+		if id == email.MessageID || id == email.InReplyTo {
+			return true
+		}
+		for _, ref := range email.References {
+			if id == ref {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// FolderUsage is how much of a mailbox one folder takes up
+type FolderUsage struct {
+	Folder          string        `json:"folder"`
+	Messages        uint32        `json:"messages"`
+	Unseen          uint32        `json:"unseen"`
+	Bytes           int64         `json:"bytes"`
+	AttachmentBytes int64         `json:"attachment_bytes"` // Zero where the backend can't tell
+	Largest         []MessageSize `json:"largest,omitempty"`
+}
+
+// MessageSize is one of the largest messages of a mailbox
+type MessageSize struct {
+	Folder  string    `json:"folder"`
+	UID     uint32    `json:"uid"`
+	Size    int64     `json:"size"`
+	Subject string    `json:"subject,omitempty"`
+	From    string    `json:"from,omitempty"`
+	Date    time.Time `json:"date"`
+}
+
+// MailboxUsage is the size report of a whole mailbox, largest folder first
+type MailboxUsage struct {
+	Folders         []FolderUsage `json:"folders"`
+	Messages        uint32        `json:"messages"`
+	Bytes           int64         `json:"bytes"`
+	AttachmentBytes int64         `json:"attachment_bytes"`
+	Largest         []MessageSize `json:"largest"`
+}
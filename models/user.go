@@ -1,6 +1,11 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
 
 // User represents a user in the multi-user system
 type User struct {
@@ -12,9 +17,31 @@ type User struct {
 	Role         string    `json:"role"` // "admin", "editor", "viewer"
 	Language     string    `json:"language"`
 	Theme        string    `json:"theme"`
+	Timezone     string    `json:"timezone,omitempty"` // IANA name, empty for server time
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	LastLoginAt  time.Time `json:"last_login_at,omitempty"`
+	KnownDevices []string  `json:"known_devices,omitempty"` // Fingerprints of devices the user has logged in from
+
+	Limits    UserLimits `json:"limits"`
+	SentDay   string     `json:"sent_day,omitempty"`   // Date (YYYY-MM-DD) SentToday counts messages for
+	SentToday int        `json:"sent_today,omitempty"` // Messages sent on SentDay, for MaxMessagesPerDay
+}
+
+// UserLimits are resource caps an admin can put on a user. Zero means
+// no limit.
+type UserLimits struct {
+	MaxAccounts       int `json:"max_accounts" form:"max_accounts"`
+	MaxDraftsMB       int `json:"max_drafts_mb" form:"max_drafts_mb"`
+	MaxMessagesPerDay int `json:"max_messages_per_day" form:"max_messages_per_day"`
+}
+
+// Validate rejects negative limits
+func (l UserLimits) Validate() error {
+	if l.MaxAccounts < 0 || l.MaxDraftsMB < 0 || l.MaxMessagesPerDay < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	return nil
 }
 
 // UserSettings represents user-specific settings
@@ -24,5 +51,208 @@ type UserSettings struct {
 	DefaultFolder       string `json:"default_folder"`
 	ShowPreview         bool   `json:"show_preview"`
 	AutoMarkAsRead      bool   `json:"auto_mark_as_read"`
-	EnableNotifications bool   `json:"enable_notifications"`
+	AutoMarkReadDelay   int    `json:"auto_mark_read_delay"` // Seconds a message stays open before it is marked read
+	EnableNotifications bool   `json:"enable_notifications"` // Master switch for in-app notifications
+
+	// Per-type notification preferences, only used while EnableNotifications is on
+	NotifyNewMail       bool `json:"notify_new_mail"`
+	NotifyStatusChanges bool `json:"notify_status_changes"`
+	NotifyDigests       bool `json:"notify_digests"`
+
+	// Unread digest email schedule
+	DigestFrequency string    `json:"digest_frequency"` // "off", "daily" or "weekly"
+	DigestHour      int       `json:"digest_hour"`      // Hour of day in the user's time zone to send at
+	LastDigestAt    time.Time `json:"last_digest_at,omitempty"`
+	DigestFailedAt  time.Time `json:"digest_failed_at,omitempty"` // Last failed send, retried at the next slot
+
+	// Keyboard shortcut overrides by action; missing actions use the defaults
+	Shortcuts map[string]string `json:"shortcuts,omitempty"`
+
+	// Compose window defaults, overridable per account
+	Compose ComposeSettings `json:"compose"`
+
+	// Remote images in HTML messages
+	BlockRemoteImages bool     `json:"block_remote_images"`     // Hold remote images until the reader loads them
+	ProxyRemoteImages bool     `json:"proxy_remote_images"`     // Load remote images through the image proxy
+	ImageSenders      []string `json:"image_senders,omitempty"` // Addresses or @domains whose images always load
+
+	// Local spam classifier, trained by marking messages as spam or not spam
+	SpamFilter   bool `json:"spam_filter"`    // Score new INBOX mail
+	SpamAutoMove bool `json:"spam_auto_move"` // Move mail the classifier is confident about to Junk
+
+	// Reply suggestions and summaries, which send messages to the server's
+	// configured language model
+	AssistEnabled bool `json:"assist_enabled"`
+
+	// Senders whose new mail is junked or deleted on arrival
+	BlockedSenders []BlockedSender `json:"blocked_senders,omitempty"`
+}
+
+// Actions taken on new mail from a blocked sender
+const (
+	BlockActionJunk   = "junk"   // Move it to the Junk folder
+	BlockActionDelete = "delete" // Delete it
+)
+
+// BlockedSender is a rule for new INBOX mail from an address like
+// "news@example.com" or a whole domain like "@example.com"
+type BlockedSender struct {
+	Sender    string    `json:"sender"`
+	Action    string    `json:"action"`
+	BlockedAt time.Time `json:"blocked_at"`
+}
+
+// BlockSender adds a rule for mail from sender, an address or @domain, or
+// changes the action of the rule already there
+func (s *UserSettings) BlockSender(sender, action string) (*BlockedSender, error) {
+	sender, err := NormalizeImageSender(sender)
+	if err != nil {
+		return nil, err
+	}
+	if action != BlockActionJunk && action != BlockActionDelete {
+		return nil, fmt.Errorf("invalid block action %q", action)
+	}
+
+	for i := range s.BlockedSenders {
+		if s.BlockedSenders[i].Sender == sender {
+			s.BlockedSenders[i].Action = action
+			return &s.BlockedSenders[i], nil
+		}
+	}
+	s.BlockedSenders = append(s.BlockedSenders, BlockedSender{
+		Sender:    sender,
+		Action:    action,
+		BlockedAt: time.Now(),
+	})
+	return &s.BlockedSenders[len(s.BlockedSenders)-1], nil
+}
+
+// UnblockSender removes the rule for sender and reports whether there was one
+func (s *UserSettings) UnblockSender(sender string) bool {
+	sender = strings.ToLower(strings.TrimSpace(sender))
+	for i := range s.BlockedSenders {
+		if s.BlockedSenders[i].Sender == sender {
+			s.BlockedSenders = append(s.BlockedSenders[:i], s.BlockedSenders[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// BlockedSenderFor returns the rule blocking mail from sender, or nil if the
+// sender isn't blocked. Address rules win over domain rules.
+func (s *UserSettings) BlockedSenderFor(sender string) *BlockedSender {
+	sender = strings.ToLower(strings.TrimSpace(sender))
+	if sender == "" {
+		return nil
+	}
+	var domainRule *BlockedSender
+	for i, blocked := range s.BlockedSenders {
+		if sender == blocked.Sender {
+			return &s.BlockedSenders[i]
+		}
+		if domainRule == nil && strings.HasPrefix(blocked.Sender, "@") && strings.HasSuffix(sender, blocked.Sender) {
+			domainRule = &s.BlockedSenders[i]
+		}
+	}
+	return domainRule
+}
+
+// DefaultShortcuts are the keys bound to each shortcut action
+var DefaultShortcuts = map[string]string{
+	"archive": "e",
+	"reply":   "r",
+	"next":    "j",
+	"prev":    "k",
+	"search":  "/",
+}
+
+var shortcutKey = regexp.MustCompile(`^((ctrl|alt|shift|meta)\+)*([a-z0-9]|[/?.,;'\[\]=-]|enter|escape|arrow(up|down|left|right))$`)
+
+// ValidShortcutKey reports whether key is a single key, optionally with
+// modifiers, like "j", "/" or "ctrl+enter"
+func ValidShortcutKey(key string) bool {
+	return shortcutKey.MatchString(key)
+}
+
+// ShortcutMap returns the key for every shortcut action, with the user's
+// overrides applied
+func (s *UserSettings) ShortcutMap() map[string]string {
+	shortcuts := make(map[string]string, len(DefaultShortcuts))
+	for action, key := range DefaultShortcuts {
+		shortcuts[action] = key
+		if custom, ok := s.Shortcuts[action]; ok && custom != "" {
+			shortcuts[action] = custom
+		}
+	}
+	return shortcuts
+}
+
+// NormalizeImageSender lowercases an image sender entry, which is either an
+// address like "news@example.com" or a whole domain like "@example.com"
+func NormalizeImageSender(sender string) (string, error) {
+	sender = strings.ToLower(strings.TrimSpace(sender))
+	at := strings.LastIndex(sender, "@")
+	if at < 0 || at == len(sender)-1 || strings.ContainsAny(sender, " ,;<>") {
+		return "", fmt.Errorf("invalid sender %q", sender)
+	}
+	return sender, nil
+}
+
+// AllowsImagesFrom reports whether remote images load right away in
+// messages from the sender
+func (s *UserSettings) AllowsImagesFrom(sender string) bool {
+	if !s.BlockRemoteImages {
+		return true
+	}
+	sender = strings.ToLower(strings.TrimSpace(sender))
+	if sender == "" {
+		return false
+	}
+	for _, allowed := range s.ImageSenders {
+		if sender == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(sender, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bounds of the EmailsPerPage setting
+const (
+	MinEmailsPerPage = 10
+	MaxEmailsPerPage = 200
+)
+
+// MaxAutoMarkReadDelay is the longest AutoMarkReadDelay in seconds
+const MaxAutoMarkReadDelay = 60
+
+// ClampEmailsPerPage brings a page size within the EmailsPerPage bounds
+func ClampEmailsPerPage(n int) int {
+	if n < MinEmailsPerPage {
+		return MinEmailsPerPage
+	}
+	if n > MaxEmailsPerPage {
+		return MaxEmailsPerPage
+	}
+	return n
+}
+
+// DefaultUserSettings returns the settings used until a user saves their own
+func DefaultUserSettings(userID string) *UserSettings {
+	return &UserSettings{
+		UserID:              userID,
+		EmailsPerPage:       50,
+		DefaultFolder:       "INBOX",
+		ShowPreview:         true,
+		AutoMarkReadDelay:   2,
+		EnableNotifications: true,
+		NotifyNewMail:       true,
+		NotifyStatusChanges: true,
+		NotifyDigests:       true,
+		DigestFrequency:     "off",
+		DigestHour:          8,
+		Compose:             DefaultComposeSettings(),
+		BlockRemoteImages:   true,
+		ProxyRemoteImages:   true,
+	}
 }
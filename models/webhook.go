@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Webhook events that can be subscribed to
+const (
+	WebhookEventNewEmail           = "new_email"
+	WebhookEventSendFailed         = "send_failed"
+	WebhookEventLoginFromNewDevice = "login_from_new_device"
+)
+
+// Webhook is a user-registered URL that receives event payloads
+type Webhook struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"` // HMAC signing key, only returned on creation
+	Events    []string  `json:"events"`           // Empty means all events
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Wants reports whether the webhook is subscribed to an event
+func (w *Webhook) Wants(event string) bool {
+	if !w.Active {
+		return false
+	}
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
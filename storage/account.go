@@ -22,6 +22,33 @@ type AccountStorage struct {
 	mu sync.RWMutex
 }
 
+// storedAccount is an account as it is saved. models.Account keeps the
+// password out of JSON, so the encrypted password is stored next to it.
+type storedAccount struct {
+	models.Account
+	EncryptedPassword string `json:"password"`
+}
+
+// decodeAccount reads a saved account and decrypts its password. Accounts
+// saved before passwords were kept load with an empty password, which the
+// next successful login fills in.
+func decodeAccount(data []byte, encryptionKey []byte) (*models.Account, error) {
+	var stored storedAccount
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+
+	account := stored.Account
+	if stored.EncryptedPassword != "" {
+		password, err := decrypt(stored.EncryptedPassword, encryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt password: %v", err)
+		}
+		account.Password = password
+	}
+	return &account, nil
+}
+
 // NewAccountStorage creates a new account storage instance
 func NewAccountStorage(db *bbolt.DB) *AccountStorage {
 	return &AccountStorage{
@@ -48,13 +75,12 @@ func (s *AccountStorage) CreateAccount(account *models.Account, encryptionKey []
 	}
 
 	// Create a copy with encrypted password for storage
-	storedAccount := *account
-	storedAccount.Password = encryptedPassword
+	stored := storedAccount{Account: *account, EncryptedPassword: encryptedPassword}
 
 	return s.db.Update(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte("Accounts"))
 		
-		data, err := json.Marshal(storedAccount)
+		data, err := json.Marshal(stored)
 		if err != nil {
 			return fmt.Errorf("failed to marshal account: %v", err)
 		}
@@ -65,7 +91,7 @@ func (s *AccountStorage) CreateAccount(account *models.Account, encryptionKey []
 
 // GetAccount retrieves an account by ID
 func (s *AccountStorage) GetAccount(accountID string, encryptionKey []byte) (*models.Account, error) {
-	var account models.Account
+	var account *models.Account
 
 	err := s.db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte("Accounts"))
@@ -73,21 +99,15 @@ func (s *AccountStorage) GetAccount(accountID string, encryptionKey []byte) (*mo
 		if data == nil {
 			return errors.New("account not found")
 		}
-		return json.Unmarshal(data, &account)
+		var err error
+		account, err = decodeAccount(data, encryptionKey)
+		return err
 	})
 
 	if err != nil {
 		return nil, err
 	}
-
-	// Decrypt password
-	decryptedPassword, err := decrypt(account.Password, encryptionKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt password: %v", err)
-	}
-	account.Password = decryptedPassword
-
-	return &account, nil
+	return account, nil
 }
 
 // GetAccountsByUser retrieves all accounts for a user (Scan)
@@ -97,19 +117,13 @@ func (s *AccountStorage) GetAccountsByUser(userID string, encryptionKey []byte)
 	err := s.db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte("Accounts"))
 		return b.ForEach(func(k, v []byte) error {
-			var account models.Account
-			if err := json.Unmarshal(v, &account); err != nil {
-				return nil // Skip corrupted
+			account, err := decodeAccount(v, encryptionKey)
+			if err != nil {
+				return nil // Skip corrupted and decryption errors
 			}
 			
 			if account.UserID == userID {
-				// Decrypt password
-				decryptedPassword, err := decrypt(account.Password, encryptionKey)
-				if err != nil {
-					return nil // Skip decryption errors
-				}
-				account.Password = decryptedPassword
-				accounts = append(accounts, &account)
+				accounts = append(accounts, account)
 			}
 			return nil
 		})
@@ -121,6 +135,28 @@ func (s *AccountStorage) GetAccountsByUser(userID string, encryptionKey []byte)
 	return accounts, nil
 }
 
+// CountAccountsByUser returns the number of accounts of each user ID
+func (s *AccountStorage) CountAccountsByUser() (map[string]int, error) {
+	counts := make(map[string]int)
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("Accounts"))
+		return b.ForEach(func(k, v []byte) error {
+			var account models.Account
+			if err := json.Unmarshal(v, &account); err != nil {
+				return nil // Skip corrupted
+			}
+			counts[account.UserID]++
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
 // UpdateAccount updates an existing account
 func (s *AccountStorage) UpdateAccount(account *models.Account, encryptionKey []byte) error {
 	return s.db.Update(func(tx *bbolt.Tx) error {
@@ -131,20 +167,23 @@ func (s *AccountStorage) UpdateAccount(account *models.Account, encryptionKey []
 		if existingData == nil {
 			return errors.New("account not found")
 		}
-		var existing models.Account
+		var existing storedAccount
 		json.Unmarshal(existingData, &existing)
 
 		// Create copy to store
-		toStore := *account
+		toStore := storedAccount{Account: *account}
 		toStore.CreatedAt = existing.CreatedAt
 		toStore.UpdatedAt = time.Now()
 
-		// Encrypt password
-		encryptedPassword, err := encrypt(account.Password, encryptionKey)
-		if err != nil {
-			return fmt.Errorf("failed to encrypt password: %v", err)
+		// Encrypt password, keeping the stored one if none was given
+		toStore.EncryptedPassword = existing.EncryptedPassword
+		if account.Password != "" {
+			encryptedPassword, err := encrypt(account.Password, encryptionKey)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt password: %v", err)
+			}
+			toStore.EncryptedPassword = encryptedPassword
 		}
-		toStore.Password = encryptedPassword
 
 		data, err := json.Marshal(toStore)
 		if err != nil {
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"lilmail/models"
+
+	"go.etcd.io/bbolt"
+)
+
+// attachmentsBucket holds a folder's attachment index next to its cached
+// messages. Keys are the message UID followed by the attachment index, so
+// they sort like the messages.
+const attachmentsBucket = "attachments"
+
+// attachmentKey is the index key of a message's index-th attachment
+func attachmentKey(uid uint32, index int) []byte {
+	key := make([]byte, 6)
+	binary.BigEndian.PutUint32(key, uid)
+	binary.BigEndian.PutUint16(key[4:], uint16(index))
+	return key
+}
+
+// indexAttachments replaces the index entries of a cached message
+func indexAttachments(fb *bbolt.Bucket, folder string, uid uint32, email models.Email) error {
+	ab, err := fb.CreateBucketIfNotExists([]byte(attachmentsBucket))
+	if err != nil {
+		return err
+	}
+	if err := unindexAttachments(ab, uid); err != nil {
+		return err
+	}
+
+	for i, att := range email.Attachments {
+		data, err := json.Marshal(models.IndexedAttachment{
+			Folder:       folder,
+			EmailID:      email.ID,
+			Index:        i,
+			Filename:     att.Filename,
+			ContentType:  att.ContentType,
+			Size:         att.Size,
+			EmailSubject: email.Subject,
+			EmailFrom:    email.From,
+			EmailDate:    email.Date,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal attachment: %v", err)
+		}
+		if err := ab.Put(attachmentKey(uid, i), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexAttachments drops the index entries of a message
+func unindexAttachments(ab *bbolt.Bucket, uid uint32) error {
+	if ab == nil {
+		return nil
+	}
+	prefix := uidKey(uid)
+	c := ab.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildAttachmentIndex indexes the messages of a folder cached before the
+// index existed
+func buildAttachmentIndex(fb *bbolt.Bucket, folder string) error {
+	if fb.Bucket([]byte(attachmentsBucket)) != nil {
+		return nil
+	}
+	if _, err := fb.CreateBucket([]byte(attachmentsBucket)); err != nil {
+		return err
+	}
+
+	mb := fb.Bucket([]byte(messagesBucket))
+	if mb == nil {
+		return nil
+	}
+	return mb.ForEach(func(k, v []byte) error {
+		var email models.Email
+		if err := json.Unmarshal(v, &email); err != nil {
+			return nil // Skip corrupted
+		}
+		return indexAttachments(fb, folder, binary.BigEndian.Uint32(k), email)
+	})
+}
+
+// GetAttachments returns a page of the attachments of a folder's cached
+// messages, newest message first, and the number of indexed attachments
+func (s *MessageCacheStorage) GetAttachments(userID, accountID, folder string, offset, limit int) ([]models.IndexedAttachment, int, error) {
+	var attachments []models.IndexedAttachment
+	count := 0
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		fb := folderBucket(tx, userID, accountID, folder)
+		if fb == nil {
+			return nil
+		}
+		ab := fb.Bucket([]byte(attachmentsBucket))
+		if ab == nil {
+			return nil
+		}
+
+		count = ab.Stats().KeyN
+
+		// Newest message first, but its attachments in order
+		var group []models.IndexedAttachment
+		var groupUID []byte
+		skipped := 0
+		flush := func() {
+			for i := len(group) - 1; i >= 0 && len(attachments) < limit; i-- {
+				if skipped < offset {
+					skipped++
+					continue
+				}
+				attachments = append(attachments, group[i])
+			}
+			group = group[:0]
+		}
+
+		c := ab.Cursor()
+		for k, v := c.Last(); k != nil && len(attachments) < limit; k, v = c.Prev() {
+			if groupUID != nil && !bytes.Equal(k[:4], groupUID) {
+				flush()
+			}
+			groupUID = append(groupUID[:0], k[:4]...)
+
+			var att models.IndexedAttachment
+			if err := json.Unmarshal(v, &att); err != nil {
+				continue // Skip corrupted
+			}
+			group = append(group, att)
+		}
+		flush()
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+	return attachments, count, nil
+}
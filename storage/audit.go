@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"lilmail/models"
+	"time"
+
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+)
+
+const auditBucket = "AuditLog"
+
+// AuditStorage keeps the audit trail using BoltDB. Keys start with the
+// event time so the bucket is in chronological order.
+type AuditStorage struct {
+	db *bbolt.DB
+}
+
+// NewAuditStorage creates a new audit storage instance
+func NewAuditStorage(db *bbolt.DB) *AuditStorage {
+	return &AuditStorage{
+		db: db,
+	}
+}
+
+// Record appends an event to the audit trail
+func (s *AuditStorage) Record(event *models.AuditEvent) error {
+	if event.ID == "" {
+		event.ID = uuid.New().String()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(auditBucket))
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to marshal audit event: %v", err)
+		}
+
+		key := event.Time.UTC().Format("2006-01-02T15:04:05.000000000Z") + "/" + event.ID
+		return b.Put([]byte(key), data)
+	})
+}
+
+// Query returns the page of events matching filter, newest first, and how
+// many events matched in total
+func (s *AuditStorage) Query(filter models.AuditFilter, offset, limit int) ([]*models.AuditEvent, int, error) {
+	events := []*models.AuditEvent{}
+	total := 0
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte(auditBucket)).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var event models.AuditEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				continue // Skip corrupted
+			}
+			if !filter.Since.IsZero() && event.Time.Before(filter.Since) {
+				break // Everything further back is older still
+			}
+			if !filter.Matches(&event) {
+				continue
+			}
+			if total >= offset && len(events) < limit {
+				events = append(events, &event)
+			}
+			total++
+		}
+		return nil
+	})
+
+	return events, total, err
+}
+
+// Prune deletes events older than before
+func (s *AuditStorage) Prune(before time.Time) error {
+	cutoff := []byte(before.UTC().Format("2006-01-02T15:04:05.000000000Z"))
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte(auditBucket)).Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(cutoff); k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
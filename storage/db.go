@@ -21,7 +21,7 @@ func InitDB(dataDir string) (*bbolt.DB, error) {
 
 	// Create buckets
 	err = db.Update(func(tx *bbolt.Tx) error {
-		buckets := []string{"Users", "Accounts", "UserEmails"} // Added UserEmails for index
+		buckets := []string{"Users", "Accounts", "UserEmails", messageCacheBucket, webhooksBucket, notificationsBucket, settingsBucket, themesBucket, systemSettingsBucket, auditBucket, sharesBucket, notesBucket, snippetsBucket, largeFilesBucket, spamBucket, sentRecipientsBucket} // Added UserEmails for index
 		for _, bucket := range buckets {
 			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
 				return fmt.Errorf("create bucket %s: %s", bucket, err)
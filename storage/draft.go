@@ -2,47 +2,176 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"lilmail/models"
+	"lilmail/utils"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// autosaveDelay is how long autosaved changes are held before being
+// written, so a burst of autosaves costs a single write
+const autosaveDelay = 2 * time.Second
+
+// ErrDraftRevision is returned by AutoSaveDraft when the draft has been
+// saved since the revision the editor started from
+var ErrDraftRevision = errors.New("draft has changed since it was loaded")
+
 // DraftStorage handles draft email persistence
 type DraftStorage struct {
 	baseDir string
+
+	mu sync.Mutex
+	// pending holds autosaved drafts not yet written, by file path
+	pending map[string]*models.Draft
 }
 
 // NewDraftStorage creates a new draft storage instance
 func NewDraftStorage(baseDir string) *DraftStorage {
 	return &DraftStorage{
 		baseDir: baseDir,
+		pending: make(map[string]*models.Draft),
 	}
 }
 
-// getDraftDir returns the drafts directory for a user
-func (ds *DraftStorage) getDraftDir(userID string) string {
-	return filepath.Join(ds.baseDir, "drafts", userID)
+// getDraftDir returns the drafts directory for a user's account.
+// Drafts created without an account are kept in a "default" namespace.
+func (ds *DraftStorage) getDraftDir(userID, accountID string) string {
+	if accountID == "" {
+		accountID = "default"
+	}
+	return filepath.Join(ds.baseDir, "drafts", userID, accountID)
 }
 
 // SaveDraft saves or updates a draft
-func (ds *DraftStorage) SaveDraft(userID, draftID string, draft *models.Draft) error {
-	dir := ds.getDraftDir(userID)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create draft directory: %w", err)
-	}
+func (ds *DraftStorage) SaveDraft(userID, accountID, draftID string, draft *models.Draft) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
 
 	// Generate new ID if not provided
 	if draftID == "" {
 		draftID = uuid.New().String()
 		draft.CreatedAt = time.Now()
+		draft.Revision = 1
+	} else if current, err := ds.currentDraft(userID, accountID, draftID); err == nil {
+		draft.CreatedAt = current.CreatedAt
+		draft.Revision = current.Revision + 1
 	}
 	draft.ID = draftID
 	draft.UserID = userID
+	draft.AccountID = accountID
+	draft.UpdatedAt = time.Now()
+
+	// An explicit save supersedes any autosave still waiting
+	delete(ds.pending, ds.draftPath(userID, accountID, draftID))
+
+	return ds.writeDraft(draft)
+}
+
+// AutoSaveDraft saves the editor's copy of a draft it loaded at revision.
+// Unchanged drafts are not saved again, and changes are held briefly so
+// that rapid autosaves are written once. It returns the stored draft, which
+// is the current one alongside ErrDraftRevision if the editor is behind.
+func (ds *DraftStorage) AutoSaveDraft(userID, accountID, draftID string, revision int, draft *models.Draft) (*models.Draft, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	// A new draft is written straight away so it shows up in the list
+	if draftID == "" {
+		draft.ID = uuid.New().String()
+		draft.UserID = userID
+		draft.AccountID = accountID
+		draft.CreatedAt = time.Now()
+		draft.UpdatedAt = draft.CreatedAt
+		draft.Revision = 1
+		if err := ds.writeDraft(draft); err != nil {
+			return nil, err
+		}
+		return draft, nil
+	}
+
+	current, err := ds.currentDraft(userID, accountID, draftID)
+	if err != nil {
+		return nil, err
+	}
+	if revision != current.Revision {
+		return current, ErrDraftRevision
+	}
+	if current.SameContent(draft) {
+		return current, nil
+	}
+
+	draft.ID = current.ID
+	draft.UserID = userID
+	draft.AccountID = accountID
+	draft.CreatedAt = current.CreatedAt
 	draft.UpdatedAt = time.Now()
+	draft.Revision = current.Revision + 1
+
+	path := ds.draftPath(userID, accountID, draftID)
+	if _, waiting := ds.pending[path]; !waiting {
+		time.AfterFunc(autosaveDelay, func() { ds.flushPending(path) })
+	}
+	ds.pending[path] = draft
+	return draft, nil
+}
+
+// Flush writes autosaved drafts that are still waiting
+func (ds *DraftStorage) Flush() {
+	ds.mu.Lock()
+	paths := make([]string, 0, len(ds.pending))
+	for path := range ds.pending {
+		paths = append(paths, path)
+	}
+	ds.mu.Unlock()
+
+	for _, path := range paths {
+		ds.flushPending(path)
+	}
+}
+
+// flushPending writes the autosaved draft waiting at path, if any
+func (ds *DraftStorage) flushPending(path string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	draft, ok := ds.pending[path]
+	if !ok {
+		return
+	}
+	delete(ds.pending, path)
+	if err := ds.writeDraft(draft); err != nil {
+		utils.Log.Error("Failed to autosave draft %s: %v", draft.ID, err)
+	}
+}
+
+// currentDraft returns the latest revision of a draft, which may still be
+// waiting to be written. The caller holds ds.mu.
+func (ds *DraftStorage) currentDraft(userID, accountID, draftID string) (*models.Draft, error) {
+	if draft, ok := ds.pending[ds.draftPath(userID, accountID, draftID)]; ok {
+		copied := *draft
+		return &copied, nil
+	}
+	return ds.readDraft(ds.draftPath(userID, accountID, draftID))
+}
+
+// draftPath is the file a draft is stored in
+func (ds *DraftStorage) draftPath(userID, accountID, draftID string) string {
+	return filepath.Join(ds.getDraftDir(userID, accountID), draftID+".json")
+}
+
+// writeDraft stores a draft in its file
+func (ds *DraftStorage) writeDraft(draft *models.Draft) error {
+	dir := ds.getDraftDir(draft.UserID, draft.AccountID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create draft directory: %w", err)
+	}
 
 	// Serialize draft
 	data, err := json.MarshalIndent(draft, "", "  ")
@@ -51,8 +180,7 @@ func (ds *DraftStorage) SaveDraft(userID, draftID string, draft *models.Draft) e
 	}
 
 	// Write to file
-	filePath := filepath.Join(dir, draftID+".json")
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
+	if err := os.WriteFile(ds.draftPath(draft.UserID, draft.AccountID, draft.ID), data, 0644); err != nil {
 		return fmt.Errorf("failed to write draft file: %w", err)
 	}
 
@@ -60,9 +188,14 @@ func (ds *DraftStorage) SaveDraft(userID, draftID string, draft *models.Draft) e
 }
 
 // GetDraft retrieves a specific draft
-func (ds *DraftStorage) GetDraft(userID, draftID string) (*models.Draft, error) {
-	filePath := filepath.Join(ds.getDraftDir(userID), draftID+".json")
-	
+func (ds *DraftStorage) GetDraft(userID, accountID, draftID string) (*models.Draft, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.currentDraft(userID, accountID, draftID)
+}
+
+// readDraft loads a draft from its file
+func (ds *DraftStorage) readDraft(filePath string) (*models.Draft, error) {
 	data, err := os.ReadFile(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -79,9 +212,9 @@ func (ds *DraftStorage) GetDraft(userID, draftID string) (*models.Draft, error)
 	return &draft, nil
 }
 
-// GetDrafts retrieves all drafts for a user
-func (ds *DraftStorage) GetDrafts(userID string) ([]*models.Draft, error) {
-	dir := ds.getDraftDir(userID)
+// GetDrafts retrieves all drafts for a user's account
+func (ds *DraftStorage) GetDrafts(userID, accountID string) ([]*models.Draft, error) {
+	dir := ds.getDraftDir(userID, accountID)
 	
 	// Create directory if it doesn't exist
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -100,7 +233,7 @@ func (ds *DraftStorage) GetDrafts(userID string) ([]*models.Draft, error) {
 		}
 
 		draftID := entry.Name()[:len(entry.Name())-5] // Remove .json extension
-		draft, err := ds.GetDraft(userID, draftID)
+		draft, err := ds.GetDraft(userID, accountID, draftID)
 		if err != nil {
 			continue // Skip invalid drafts
 		}
@@ -122,9 +255,13 @@ func (ds *DraftStorage) GetDrafts(userID string) ([]*models.Draft, error) {
 }
 
 // DeleteDraft deletes a draft
-func (ds *DraftStorage) DeleteDraft(userID, draftID string) error {
-	filePath := filepath.Join(ds.getDraftDir(userID), draftID+".json")
-	
+func (ds *DraftStorage) DeleteDraft(userID, accountID, draftID string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	filePath := ds.draftPath(userID, accountID, draftID)
+	delete(ds.pending, filePath)
+
 	if err := os.Remove(filePath); err != nil {
 		if os.IsNotExist(err) {
 			return fmt.Errorf("draft not found")
@@ -132,16 +269,81 @@ func (ds *DraftStorage) DeleteDraft(userID, draftID string) error {
 		return fmt.Errorf("failed to delete draft: %w", err)
 	}
 
+	// Attachments uploaded to the draft go with it
+	if err := os.RemoveAll(ds.uploadsDir(userID, accountID, draftID)); err != nil {
+		return fmt.Errorf("failed to delete draft uploads: %w", err)
+	}
+
 	return nil
 }
 
-// DeleteAllDrafts deletes all drafts for a user
+// DeleteAllDrafts deletes all drafts for a user across all accounts
 func (ds *DraftStorage) DeleteAllDrafts(userID string) error {
-	dir := ds.getDraftDir(userID)
-	
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	dir := filepath.Join(ds.baseDir, "drafts", userID)
+	for path := range ds.pending {
+		if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			delete(ds.pending, path)
+		}
+	}
+
 	if err := os.RemoveAll(dir); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to delete drafts: %w", err)
 	}
 
 	return nil
 }
+
+// ErrDraftQuota is returned by CheckQuota when saving a draft would take
+// the user over their drafts storage limit
+var ErrDraftQuota = errors.New("drafts storage limit reached")
+
+// Usage returns the bytes used by all of a user's drafts
+func (ds *DraftStorage) Usage(userID string) (int64, error) {
+	var total int64
+	dir := filepath.Join(ds.baseDir, "drafts", userID)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+
+	return total, err
+}
+
+// CheckQuota returns ErrDraftQuota if saving the draft over draftID would
+// take the user's drafts past maxBytes
+func (ds *DraftStorage) CheckQuota(userID, accountID, draftID string, draft *models.Draft, maxBytes int64) error {
+	usage, err := ds.Usage(userID)
+	if err != nil {
+		return err
+	}
+
+	// The draft being replaced no longer counts
+	if draftID != "" {
+		filePath := filepath.Join(ds.getDraftDir(userID, accountID), draftID+".json")
+		if info, err := os.Stat(filePath); err == nil {
+			usage -= info.Size()
+		}
+	}
+
+	data, err := json.MarshalIndent(draft, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal draft: %w", err)
+	}
+
+	if usage+int64(len(data)) > maxBytes {
+		return ErrDraftQuota
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"lilmail/models"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Chunked upload errors
+var (
+	ErrUploadChunk      = errors.New("chunk is out of range or the wrong size")
+	ErrUploadChecksum   = errors.New("checksum does not match")
+	ErrUploadIncomplete = errors.New("upload is missing chunks")
+)
+
+// uploadsDir holds the chunked uploads of a draft, next to its file, so
+// they go when the draft does
+func (ds *DraftStorage) uploadsDir(userID, accountID, draftID string) string {
+	return filepath.Join(ds.getDraftDir(userID, accountID), draftID+".uploads")
+}
+
+// uploadDir holds an upload's details, its chunks and, once complete, the
+// assembled file
+func (ds *DraftStorage) uploadDir(userID, accountID, draftID, uploadID string) string {
+	return filepath.Join(ds.uploadsDir(userID, accountID, draftID), uploadID)
+}
+
+// CreateUpload starts a chunked upload to a draft
+func (ds *DraftStorage) CreateUpload(userID, accountID, draftID string, upload *models.DraftUpload) error {
+	if _, err := uuid.Parse(draftID); err != nil {
+		return fmt.Errorf("draft not found")
+	}
+	if _, err := ds.GetDraft(userID, accountID, draftID); err != nil {
+		return err
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	upload.ID = uuid.New().String()
+	upload.DraftID = draftID
+	upload.Chunks = int((upload.Size + upload.ChunkSize - 1) / upload.ChunkSize)
+	upload.Received = make(map[int]string)
+	upload.CreatedAt = time.Now()
+
+	if err := os.MkdirAll(ds.uploadDir(userID, accountID, draftID, upload.ID), 0755); err != nil {
+		return fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	return ds.writeUpload(userID, accountID, upload)
+}
+
+// GetUpload retrieves the state of an upload
+func (ds *DraftStorage) GetUpload(userID, accountID, draftID, uploadID string) (*models.DraftUpload, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.readUpload(userID, accountID, draftID, uploadID)
+}
+
+// GetUploads lists the uploads of a draft
+func (ds *DraftStorage) GetUploads(userID, accountID, draftID string) ([]*models.DraftUpload, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	entries, err := os.ReadDir(ds.uploadsDir(userID, accountID, draftID))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read uploads directory: %w", err)
+	}
+
+	uploads := []*models.DraftUpload{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		upload, err := ds.readUpload(userID, accountID, draftID, entry.Name())
+		if err != nil {
+			continue // Skip invalid uploads
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, nil
+}
+
+// SaveChunk stores chunk index of an upload if it has the given SHA-256.
+// Sending a chunk again replaces it.
+func (ds *DraftStorage) SaveChunk(userID, accountID, draftID, uploadID string, index int, data []byte, checksum string) (*models.DraftUpload, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	upload, err := ds.readUpload(userID, accountID, draftID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Complete || index < 0 || index >= upload.Chunks || int64(len(data)) != upload.ChunkLength(index) {
+		return upload, ErrUploadChunk
+	}
+
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), checksum) {
+		return upload, ErrUploadChecksum
+	}
+
+	dir := ds.uploadDir(userID, accountID, draftID, uploadID)
+	if err := os.WriteFile(filepath.Join(dir, strconv.Itoa(index)+".part"), data, 0644); err != nil {
+		return upload, fmt.Errorf("failed to write chunk: %w", err)
+	}
+
+	upload.Received[index] = hex.EncodeToString(sum[:])
+	return upload, ds.writeUpload(userID, accountID, upload)
+}
+
+// CompleteUpload joins the chunks of an upload into its file. A non-empty
+// checksum is the SHA-256 the whole file must have.
+func (ds *DraftStorage) CompleteUpload(userID, accountID, draftID, uploadID, checksum string) (*models.DraftUpload, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	upload, err := ds.readUpload(userID, accountID, draftID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Complete {
+		return upload, nil
+	}
+	if len(upload.Missing()) > 0 {
+		return upload, ErrUploadIncomplete
+	}
+
+	dir := ds.uploadDir(userID, accountID, draftID, uploadID)
+	filePath := filepath.Join(dir, "file")
+	out, err := os.Create(filePath)
+	if err != nil {
+		return upload, fmt.Errorf("failed to create upload file: %w", err)
+	}
+	hash := sha256.New()
+	for i := 0; i < upload.Chunks; i++ {
+		part, err := os.Open(filepath.Join(dir, strconv.Itoa(i)+".part"))
+		if err != nil {
+			out.Close()
+			return upload, fmt.Errorf("failed to read chunk: %w", err)
+		}
+		_, err = io.Copy(io.MultiWriter(out, hash), part)
+		part.Close()
+		if err != nil {
+			out.Close()
+			return upload, fmt.Errorf("failed to join chunks: %w", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return upload, fmt.Errorf("failed to write upload file: %w", err)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if checksum != "" && !strings.EqualFold(sum, checksum) {
+		os.Remove(filePath)
+		return upload, ErrUploadChecksum
+	}
+
+	upload.Checksum = sum
+	upload.Complete = true
+	if err := ds.writeUpload(userID, accountID, upload); err != nil {
+		return upload, err
+	}
+	for i := 0; i < upload.Chunks; i++ {
+		os.Remove(filepath.Join(dir, strconv.Itoa(i)+".part"))
+	}
+	return upload, nil
+}
+
+// ReadUpload returns a completed upload and its content
+func (ds *DraftStorage) ReadUpload(userID, accountID, draftID, uploadID string) (*models.DraftUpload, []byte, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	upload, err := ds.readUpload(userID, accountID, draftID, uploadID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !upload.Complete {
+		return upload, nil, ErrUploadIncomplete
+	}
+
+	data, err := os.ReadFile(filepath.Join(ds.uploadDir(userID, accountID, draftID, uploadID), "file"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+	return upload, data, nil
+}
+
+// OpenUpload opens the file of a completed upload
+func (ds *DraftStorage) OpenUpload(userID, accountID, draftID, uploadID string) (*models.DraftUpload, *os.File, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	upload, err := ds.readUpload(userID, accountID, draftID, uploadID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !upload.Complete {
+		return upload, nil, ErrUploadIncomplete
+	}
+
+	f, err := os.Open(filepath.Join(ds.uploadDir(userID, accountID, draftID, uploadID), "file"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open upload: %w", err)
+	}
+	return upload, f, nil
+}
+
+// DeleteUpload removes an upload and its chunks
+func (ds *DraftStorage) DeleteUpload(userID, accountID, draftID, uploadID string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if _, err := ds.readUpload(userID, accountID, draftID, uploadID); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(ds.uploadDir(userID, accountID, draftID, uploadID)); err != nil {
+		return fmt.Errorf("failed to delete upload: %w", err)
+	}
+	return nil
+}
+
+// readUpload loads an upload's details. The caller holds ds.mu.
+func (ds *DraftStorage) readUpload(userID, accountID, draftID, uploadID string) (*models.DraftUpload, error) {
+	if _, err := uuid.Parse(draftID); err != nil {
+		return nil, fmt.Errorf("upload not found")
+	}
+	if _, err := uuid.Parse(uploadID); err != nil {
+		return nil, fmt.Errorf("upload not found")
+	}
+
+	data, err := os.ReadFile(filepath.Join(ds.uploadDir(userID, accountID, draftID, uploadID), "upload.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("upload not found")
+		}
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+
+	var upload models.DraftUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload: %w", err)
+	}
+	return &upload, nil
+}
+
+// writeUpload saves an upload's details. The caller holds ds.mu.
+func (ds *DraftStorage) writeUpload(userID, accountID string, upload *models.DraftUpload) error {
+	data, err := json.MarshalIndent(upload, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload: %w", err)
+	}
+
+	filePath := filepath.Join(ds.uploadDir(userID, accountID, upload.DraftID, upload.ID), "upload.json")
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write upload: %w", err)
+	}
+	return nil
+}
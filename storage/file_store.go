@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"lilmail/config"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileStore keeps the files users send as download links
+type FileStore interface {
+	Put(key string, r io.Reader, size int64, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// NewFileStore returns the file store the config names
+func NewFileStore(cfg config.LargeFilesConfig) (FileStore, error) {
+	client := &http.Client{Timeout: 30 * time.Minute}
+
+	switch cfg.Backend {
+	case "", "local":
+		if err := os.MkdirAll(cfg.Folder, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create large files folder: %w", err)
+		}
+		return &localFileStore{dir: cfg.Folder}, nil
+	case "s3":
+		if cfg.S3.Endpoint == "" || cfg.S3.Bucket == "" || cfg.S3.Region == "" {
+			return nil, fmt.Errorf("s3 endpoint, region and bucket are required")
+		}
+		return &s3FileStore{cfg: cfg.S3, client: client}, nil
+	case "webdav":
+		if cfg.WebDAV.URL == "" {
+			return nil, fmt.Errorf("webdav url is required")
+		}
+		return &webdavFileStore{cfg: cfg.WebDAV, client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown large files backend %q", cfg.Backend)
+}
+
+// localFileStore keeps files in a folder on disk
+type localFileStore struct {
+	dir string
+}
+
+func (s *localFileStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	f, err := os.OpenFile(filepath.Join(s.dir, key), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return f.Close()
+}
+
+func (s *localFileStore) Get(key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, key))
+}
+
+func (s *localFileStore) Delete(key string) error {
+	if err := os.Remove(filepath.Join(s.dir, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// webdavFileStore keeps files in a WebDAV folder
+type webdavFileStore struct {
+	cfg    config.WebDAVConfig
+	client *http.Client
+}
+
+func (s *webdavFileStore) do(method, key string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(s.cfg.URL, "/")+"/"+url.PathEscape(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+	}
+	if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	return s.client.Do(req)
+}
+
+func (s *webdavFileStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	resp, err := s.do(http.MethodPut, key, r, size, contentType)
+	if err != nil {
+		return err
+	}
+	return checkFileStoreResponse(resp, "webdav put")
+}
+
+func (s *webdavFileStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, checkFileStoreResponse(resp, "webdav get")
+	}
+	return resp.Body, nil
+}
+
+func (s *webdavFileStore) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil
+	}
+	return checkFileStoreResponse(resp, "webdav delete")
+}
+
+// s3FileStore keeps files in an S3 bucket, signing requests with AWS
+// Signature Version 4
+type s3FileStore struct {
+	cfg    config.S3Config
+	client *http.Client
+}
+
+func (s *s3FileStore) do(method, key string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimRight(s.cfg.Endpoint, "/") + "/" + s.cfg.Bucket + "/" + url.PathEscape(key))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	// The payload is streamed, so it is left out of the signature
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		"",
+		"host:" + u.Host + "\nx-amz-content-sha256:UNSIGNED-PAYLOAD\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := now.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	signingKey := []byte("AWS4" + s.cfg.SecretKey)
+	for _, part := range []string{now.Format("20060102"), s.cfg.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+	return s.client.Do(req)
+}
+
+func (s *s3FileStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	resp, err := s.do(http.MethodPut, key, r, size, contentType)
+	if err != nil {
+		return err
+	}
+	return checkFileStoreResponse(resp, "s3 put")
+}
+
+func (s *s3FileStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, checkFileStoreResponse(resp, "s3 get")
+	}
+	return resp.Body, nil
+}
+
+func (s *s3FileStore) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	return checkFileStoreResponse(resp, "s3 delete")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// checkFileStoreResponse closes resp, turning an unsuccessful status into
+// an error
+func checkFileStoreResponse(resp *http.Response, action string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s failed: %s: %s", action, resp.Status, strings.TrimSpace(string(body)))
+}
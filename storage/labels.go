@@ -1,11 +1,13 @@
 package storage
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"lilmail/models"
-	"os"
-	"path/filepath"
+	"lilmail/utils"
+	"net/url"
+	"strings"
 	"time"
 
 	"go.etcd.io/bbolt"
@@ -14,47 +16,69 @@ import (
 const (
 	labelBucket      = "labels"
 	emailLabelBucket = "email_labels"
+	labelCountBucket = "label_counts"
+	// labelEmailBucket indexes email_labels by label, keyed "labelID:emailID"
+	labelEmailBucket = "label_emails"
+
+	// orphanSweepInterval is how often associations to deleted labels are removed
+	orphanSweepInterval = 1 * time.Hour
 )
 
 // LabelStorage manages label data persistence using BoltDB
 type LabelStorage struct {
-	db *bbolt.DB
+	db   *bbolt.DB
+	stop chan struct{}
 }
 
-// NewLabelStorage creates a new label storage instance
-func NewLabelStorage(dataDir string) (*LabelStorage, error) {
-	// Ensure data directory exists
-	if err := os.MkdirAll(dataDir, 0700); err != nil {
-		return nil, fmt.Errorf("failed to create data directory: %v", err)
-	}
-
-	dbPath := filepath.Join(dataDir, "lilmail.db")
-	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
-	}
-
+// NewLabelStorage creates a new label storage instance on the shared
+// database
+func NewLabelStorage(db *bbolt.DB) (*LabelStorage, error) {
 	// Initialize buckets
-	err = db.Update(func(tx *bbolt.Tx) error {
+	err := db.Update(func(tx *bbolt.Tx) error {
 		if _, err := tx.CreateBucketIfNotExists([]byte(labelBucket)); err != nil {
 			return err
 		}
 		if _, err := tx.CreateBucketIfNotExists([]byte(emailLabelBucket)); err != nil {
 			return err
 		}
+		// Counts are kept up to date from here on; build them once for existing data
+		if tx.Bucket([]byte(labelCountBucket)) == nil {
+			if _, err := tx.CreateBucket([]byte(labelCountBucket)); err != nil {
+				return err
+			}
+			if err := rebuildLabelCounts(tx); err != nil {
+				return err
+			}
+		}
+		// Same for the by-label index
+		if tx.Bucket([]byte(labelEmailBucket)) == nil {
+			if _, err := tx.CreateBucket([]byte(labelEmailBucket)); err != nil {
+				return err
+			}
+			if err := rebuildLabelIndex(tx); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	if err != nil {
-		db.Close()
 		return nil, fmt.Errorf("failed to initialize buckets: %v", err)
 	}
 
-	return &LabelStorage{db: db}, nil
+	s := &LabelStorage{db: db, stop: make(chan struct{})}
+	go s.sweepLoop()
+
+	return s, nil
 }
 
-// Close closes the database connection
+// Close stops the orphan sweep. The database is shared and closed by its
+// owner. It is safe to call on a storage that failed to open.
 func (s *LabelStorage) Close() error {
-	return s.db.Close()
+	if s == nil {
+		return nil
+	}
+	close(s.stop)
+	return nil
 }
 
 // CreateLabel creates a new label
@@ -121,73 +145,206 @@ func (s *LabelStorage) GetLabel(id string) (*models.Label, error) {
 	return &label, nil
 }
 
-// DeleteLabel deletes a label
+// UpdateLabel overwrites an existing label. Email associations reference the
+// label by ID, so they are unaffected.
+func (s *LabelStorage) UpdateLabel(label *models.Label) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(labelBucket))
+
+		key := []byte(label.ID)
+		if b.Get(key) == nil {
+			return fmt.Errorf("label not found")
+		}
+
+		data, err := json.Marshal(label)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(key, data)
+	})
+}
+
+// DeleteLabel deletes a label along with its email associations
 func (s *LabelStorage) DeleteLabel(id string) error {
 	return s.db.Update(func(tx *bbolt.Tx) error {
-		// 1. Delete associated email_labels
-		// We need to scan all email_labels to find those with matching LabelID
-		// Since we don't have a secondary index, we must scan.
-		// For a large DB this is slow, but for a personal mail client it's acceptable.
-		// A better approach would be to maintain a reverse index or just leave them (lazy cleanup).
-		// Given the requirement to resolve TODOs, we will implement the cleanup.
-		
-		elb := tx.Bucket([]byte(emailLabelBucket))
-		if elb != nil {
-			c := elb.Cursor()
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				var el models.EmailLabel
-				if err := json.Unmarshal(v, &el); err == nil {
-					if el.LabelID == id {
-						c.Delete()
-					}
-				}
+		// 1. Delete associated email_labels, found through the by-label index
+		var emailIDs []string
+		c := tx.Bucket([]byte(labelEmailBucket)).Cursor()
+		prefix := []byte(id + ":")
+		for k, _ := c.Seek(prefix); k != nil && bytesHasPrefix(k, prefix); k, _ = c.Next() {
+			emailIDs = append(emailIDs, string(k[len(prefix):]))
+		}
+		for _, emailID := range emailIDs {
+			if err := deleteEmailLabel(tx, emailID, id); err != nil {
+				return err
 			}
 		}
 
-		// 2. Delete the label itself
+		// 2. Move nested labels up to the deleted label's parent
 		lb := tx.Bucket([]byte(labelBucket))
-		if lb != nil {
-			if err := lb.Delete([]byte(id)); err != nil {
+		var deleted models.Label
+		if data := lb.Get([]byte(id)); data != nil {
+			if err := json.Unmarshal(data, &deleted); err != nil {
 				return err
 			}
 		}
-		
-		return nil
+
+		var children []models.Label
+		err := lb.ForEach(func(k, v []byte) error {
+			var label models.Label
+			if err := json.Unmarshal(v, &label); err == nil && label.ParentID == id {
+				children = append(children, label)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			child.ParentID = deleted.ParentID
+			data, err := json.Marshal(child)
+			if err != nil {
+				return err
+			}
+			if err := lb.Put([]byte(child.ID), data); err != nil {
+				return err
+			}
+		}
+
+		// 3. Delete the label itself
+		if err := lb.Delete([]byte(id)); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(labelCountBucket)).Delete([]byte(id))
 	})
 }
 
 // AssignLabel assigns a label to an email
 func (s *LabelStorage) AssignLabel(emailID, labelID string) error {
 	return s.db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(emailLabelBucket))
-		
-		key := []byte(fmt.Sprintf("%s:%s", emailID, labelID))
-		el := models.EmailLabel{
-			EmailID: emailID,
-			LabelID: labelID,
-		}
-		
-		data, err := json.Marshal(el)
-		if err != nil {
-			return err
+		return putEmailLabel(tx, emailID, labelID)
+	})
+}
+
+// AssignLabelToEmails assigns a label to several emails in one transaction
+func (s *LabelStorage) AssignLabelToEmails(emailIDs []string, labelID string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		for _, emailID := range emailIDs {
+			if err := putEmailLabel(tx, emailID, labelID); err != nil {
+				return err
+			}
 		}
-		
-		return b.Put(key, data)
+		return nil
 	})
 }
 
 // RemoveLabel removes a label from an email
 func (s *LabelStorage) RemoveLabel(emailID, labelID string) error {
 	return s.db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(emailLabelBucket))
-		
-		key := []byte(fmt.Sprintf("%s:%s", emailID, labelID))
-		return b.Delete(key)
+		return deleteEmailLabel(tx, emailID, labelID)
+	})
+}
+
+// putEmailLabel stores an email-label association with its index entry and
+// count. Assigning a label twice is a no-op.
+func putEmailLabel(tx *bbolt.Tx, emailID, labelID string) error {
+	b := tx.Bucket([]byte(emailLabelBucket))
+
+	key := []byte(fmt.Sprintf("%s:%s", emailID, labelID))
+	if b.Get(key) != nil {
+		return nil
+	}
+
+	el := models.EmailLabel{
+		EmailID: emailID,
+		LabelID: labelID,
+	}
+	data, err := json.Marshal(el)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Put(key, data); err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte(labelEmailBucket)).Put([]byte(fmt.Sprintf("%s:%s", labelID, emailID)), []byte{}); err != nil {
+		return err
+	}
+	return adjustLabelCount(tx, labelID, 1)
+}
+
+// deleteEmailLabel removes an email-label association with its index entry
+// and count
+func deleteEmailLabel(tx *bbolt.Tx, emailID, labelID string) error {
+	b := tx.Bucket([]byte(emailLabelBucket))
+
+	key := []byte(fmt.Sprintf("%s:%s", emailID, labelID))
+	existed := b.Get(key) != nil
+	if err := b.Delete(key); err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte(labelEmailBucket)).Delete([]byte(fmt.Sprintf("%s:%s", labelID, emailID))); err != nil {
+		return err
+	}
+	if existed {
+		return adjustLabelCount(tx, labelID, -1)
+	}
+	return nil
+}
+
+// GetEmailIDsForLabel returns the IDs of the emails carrying a label
+func (s *LabelStorage) GetEmailIDsForLabel(labelID string) ([]string, error) {
+	var emailIDs []string
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte(labelEmailBucket)).Cursor()
+		prefix := []byte(labelID + ":")
+		for k, _ := c.Seek(prefix); k != nil && bytesHasPrefix(k, prefix); k, _ = c.Next() {
+			emailIDs = append(emailIDs, string(k[len(prefix):]))
+		}
+		return nil
 	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return emailIDs, nil
 }
 
-// GetLabelsForEmail retrieves all labels for a specific email
-func (s *LabelStorage) GetLabelsForEmail(emailID string) ([]models.Label, error) {
+// LabelEmailKey identifies a message in label associations. A UID is only
+// unique within one folder, so the key also holds the user the labels
+// belong to and the address of the account the folder is in.
+func LabelEmailKey(userID, account, folder, uid string) string {
+	return strings.Join([]string{
+		url.QueryEscape(userID),
+		url.QueryEscape(strings.ToLower(account)),
+		url.QueryEscape(folder),
+		url.QueryEscape(uid),
+	}, "/")
+}
+
+// ParseLabelEmailKey splits a key made by LabelEmailKey. ok is false for
+// keys of associations stored before they were scoped.
+func ParseLabelEmailKey(key string) (userID, account, folder, uid string, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 4 {
+		return "", "", "", "", false
+	}
+	for i, part := range parts {
+		unescaped, err := url.QueryUnescape(part)
+		if err != nil {
+			return "", "", "", "", false
+		}
+		parts[i] = unescaped
+	}
+	return parts[0], parts[1], parts[2], parts[3], true
+}
+
+// GetLabelsForEmail retrieves the labels of userID on the email with the
+// given key
+func (s *LabelStorage) GetLabelsForEmail(userID, emailID string) ([]models.Label, error) {
 	var labelIDs []string
 	
 	err := s.db.View(func(tx *bbolt.Tx) error {
@@ -211,7 +368,7 @@ func (s *LabelStorage) GetLabelsForEmail(emailID string) ([]models.Label, error)
 	var labels []models.Label
 	for _, id := range labelIDs {
 		l, err := s.GetLabel(id)
-		if err == nil {
+		if err == nil && l.UserID == userID {
 			labels = append(labels, *l)
 		}
 	}
@@ -219,6 +376,179 @@ func (s *LabelStorage) GetLabelsForEmail(emailID string) ([]models.Label, error)
 	return labels, nil
 }
 
+// CountEmailsByLabel returns the number of emails carrying each label
+func (s *LabelStorage) CountEmailsByLabel() (map[string]int, error) {
+	counts := make(map[string]int)
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(labelCountBucket))
+		return b.ForEach(func(k, v []byte) error {
+			if len(v) == 8 {
+				counts[string(k)] = int(binary.BigEndian.Uint64(v))
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// adjustLabelCount changes a label's email count by delta. It must be called
+// in the transaction that adds or removes the association.
+func adjustLabelCount(tx *bbolt.Tx, labelID string, delta int) error {
+	b := tx.Bucket([]byte(labelCountBucket))
+	key := []byte(labelID)
+
+	var count int64
+	if v := b.Get(key); len(v) == 8 {
+		count = int64(binary.BigEndian.Uint64(v))
+	}
+	count += int64(delta)
+	if count <= 0 {
+		return b.Delete(key)
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(count))
+	return b.Put(key, buf)
+}
+
+// rebuildLabelCounts recounts every label from the association bucket
+func rebuildLabelCounts(tx *bbolt.Tx) error {
+	counts := make(map[string]uint64)
+	err := tx.Bucket([]byte(emailLabelBucket)).ForEach(func(k, v []byte) error {
+		var el models.EmailLabel
+		if err := json.Unmarshal(v, &el); err == nil {
+			counts[el.LabelID]++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket([]byte(labelCountBucket))
+	for labelID, count := range counts {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, count)
+		if err := b.Put([]byte(labelID), buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildLabelIndex fills the by-label index from the association bucket
+func rebuildLabelIndex(tx *bbolt.Tx) error {
+	index := tx.Bucket([]byte(labelEmailBucket))
+	return tx.Bucket([]byte(emailLabelBucket)).ForEach(func(k, v []byte) error {
+		var el models.EmailLabel
+		if err := json.Unmarshal(v, &el); err != nil {
+			return nil
+		}
+		return index.Put([]byte(fmt.Sprintf("%s:%s", el.LabelID, el.EmailID)), []byte{})
+	})
+}
+
+// sweepLoop periodically removes orphaned associations
+func (s *LabelStorage) sweepLoop() {
+	ticker := time.NewTicker(orphanSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if removed, err := s.SweepOrphans(); err != nil {
+				utils.Log.Error("Label orphan sweep failed: %v", err)
+			} else if removed > 0 {
+				utils.Log.Info("Removed %d orphaned label associations", removed)
+			}
+		}
+	}
+}
+
+// SweepOrphans removes associations and index entries that point to labels
+// which no longer exist, e.g. left behind before deletes cleaned them up.
+// Associations keyed by a bare UID, from before keys named the account and
+// folder, can't be told apart from other messages with that UID and are
+// removed too. It returns the number of associations removed.
+func (s *LabelStorage) SweepOrphans() (int, error) {
+	removed := 0
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		labels := tx.Bucket([]byte(labelBucket))
+
+		var orphans []models.EmailLabel
+		err := tx.Bucket([]byte(emailLabelBucket)).ForEach(func(k, v []byte) error {
+			var el models.EmailLabel
+			if err := json.Unmarshal(v, &el); err != nil {
+				return nil
+			}
+			if _, _, _, _, ok := ParseLabelEmailKey(el.EmailID); !ok || labels.Get([]byte(el.LabelID)) == nil {
+				orphans = append(orphans, el)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, el := range orphans {
+			if err := deleteEmailLabel(tx, el.EmailID, el.LabelID); err != nil {
+				return err
+			}
+		}
+		removed = len(orphans)
+
+		// Index entries without an association
+		index := tx.Bucket([]byte(labelEmailBucket))
+		associations := tx.Bucket([]byte(emailLabelBucket))
+		var stale [][]byte
+		err = index.ForEach(func(k, v []byte) error {
+			labelID, emailID, found := strings.Cut(string(k), ":")
+			if !found || associations.Get([]byte(emailID+":"+labelID)) == nil {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := index.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		// Counts for labels that are gone
+		counts := tx.Bucket([]byte(labelCountBucket))
+		var gone [][]byte
+		err = counts.ForEach(func(k, v []byte) error {
+			if labels.Get(k) == nil {
+				gone = append(gone, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range gone {
+			if err := counts.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return removed, err
+}
+
 // Helper for prefix check
 func bytesHasPrefix(s, prefix []byte) bool {
 	return len(s) >= len(prefix) && string(s[0:len(prefix)]) == string(prefix)
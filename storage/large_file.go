@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"lilmail/models"
+	"lilmail/utils"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+)
+
+const largeFilesBucket = "LargeFiles"
+
+// LargeFileStorage keeps the files users send as download links, with
+// their details in BoltDB and their content in a FileStore
+type LargeFileStorage struct {
+	db    *bbolt.DB
+	files FileStore
+}
+
+// NewLargeFileStorage creates a new large file storage instance
+func NewLargeFileStorage(db *bbolt.DB, files FileStore) *LargeFileStorage {
+	return &LargeFileStorage{
+		db:    db,
+		files: files,
+	}
+}
+
+// CreateFile stores the content of a new large file
+func (s *LargeFileStorage) CreateFile(file *models.LargeFile, content io.Reader) error {
+	file.ID = uuid.New().String()
+	file.Key = file.ID
+	file.CreatedAt = time.Now()
+
+	if err := s.files.Put(file.Key, content, file.Size, file.ContentType); err != nil {
+		return fmt.Errorf("failed to store file: %w", err)
+	}
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		data, err := json.Marshal(file)
+		if err != nil {
+			return fmt.Errorf("failed to marshal file: %v", err)
+		}
+		return tx.Bucket([]byte(largeFilesBucket)).Put([]byte(file.ID), data)
+	})
+	if err != nil {
+		s.files.Delete(file.Key)
+	}
+	return err
+}
+
+// GetFile retrieves a large file's details by ID
+func (s *LargeFileStorage) GetFile(id string) (*models.LargeFile, error) {
+	var file models.LargeFile
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(largeFilesBucket)).Get([]byte(id))
+		if data == nil {
+			return errors.New("file not found")
+		}
+		return json.Unmarshal(data, &file)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// GetFilesByUser retrieves the files a user sent as links, newest first
+func (s *LargeFileStorage) GetFilesByUser(userID string) ([]*models.LargeFile, error) {
+	files := []*models.LargeFile{}
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(largeFilesBucket)).ForEach(func(k, v []byte) error {
+			var file models.LargeFile
+			if err := json.Unmarshal(v, &file); err != nil {
+				return nil // Skip corrupted
+			}
+			if file.UserID == userID {
+				files = append(files, &file)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].CreatedAt.After(files[j].CreatedAt)
+	})
+	return files, nil
+}
+
+// OpenFile opens the content of a large file and counts the download
+func (s *LargeFileStorage) OpenFile(file *models.LargeFile) (io.ReadCloser, error) {
+	content, err := s.files.Get(file.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(largeFilesBucket))
+		data := b.Get([]byte(file.ID))
+		if data == nil {
+			return nil
+		}
+		var stored models.LargeFile
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return err
+		}
+		stored.Downloads++
+		data, err := json.Marshal(&stored)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(file.ID), data)
+	})
+	if err != nil {
+		utils.Log.Warn("Failed to count download of file %s: %v", file.ID, err)
+	}
+	return content, nil
+}
+
+// DeleteFile removes a large file and its content
+func (s *LargeFileStorage) DeleteFile(file *models.LargeFile) error {
+	if err := s.files.Delete(file.Key); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(largeFilesBucket)).Delete([]byte(file.ID))
+	})
+}
+
+// DeleteExpired removes the files whose links have expired
+func (s *LargeFileStorage) DeleteExpired() error {
+	var expired []*models.LargeFile
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(largeFilesBucket)).ForEach(func(k, v []byte) error {
+			var file models.LargeFile
+			if err := json.Unmarshal(v, &file); err == nil && !file.Active() {
+				expired = append(expired, &file)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range expired {
+		if err := s.DeleteFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,568 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"lilmail/models"
+	"lilmail/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	messageCacheBucket = "MessageCache"
+	messagesBucket     = "messages"
+	folderMetaKey      = "meta"
+
+	// maxCachedMessages caps the number of messages kept per folder
+	maxCachedMessages = 500
+)
+
+// FolderCacheMeta tracks the sync state of a cached folder
+type FolderCacheMeta struct {
+	UIDValidity uint32    `json:"uid_validity"`
+	HighestUID  uint32    `json:"highest_uid"`
+	Total       uint32    `json:"total"` // Message count last reported by the server
+	SyncedAt    time.Time `json:"synced_at"`
+}
+
+// MessageCacheStorage keeps a cache of message headers and previews per
+// user and account so folder listings can be rendered without waiting on
+// IMAP
+type MessageCacheStorage struct {
+	db *bbolt.DB
+}
+
+// NewMessageCacheStorage creates a new message cache storage instance
+func NewMessageCacheStorage(db *bbolt.DB) *MessageCacheStorage {
+	if err := db.Update(dropUnscopedFolders); err != nil {
+		utils.Log.Warn("Failed to drop message cache folders without an account: %v", err)
+	}
+	return &MessageCacheStorage{
+		db: db,
+	}
+}
+
+// GetFolderMeta returns the sync state for a folder, or nil if it has never been cached
+func (s *MessageCacheStorage) GetFolderMeta(userID, accountID, folder string) (*FolderCacheMeta, error) {
+	var meta *FolderCacheMeta
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		fb := folderBucket(tx, userID, accountID, folder)
+		if fb == nil {
+			return nil
+		}
+		data := fb.Get([]byte(folderMetaKey))
+		if data == nil {
+			return nil
+		}
+		meta = &FolderCacheMeta{}
+		return json.Unmarshal(data, meta)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// SaveMessages stores message summaries for a folder and updates its sync state.
+// Bodies are not cached; only the fields needed to render a listing are kept.
+func (s *MessageCacheStorage) SaveMessages(userID, accountID, folder string, meta FolderCacheMeta, emails []models.Email) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		fb, err := createFolderBucket(tx, userID, accountID, folder)
+		if err != nil {
+			return err
+		}
+		mb, err := fb.CreateBucketIfNotExists([]byte(messagesBucket))
+		if err != nil {
+			return err
+		}
+
+		// Folders cached before the attachment index existed get it now
+		if err := buildAttachmentIndex(fb, folder); err != nil {
+			return err
+		}
+
+		for _, email := range emails {
+			uid, err := strconv.ParseUint(email.ID, 10, 32)
+			if err != nil {
+				continue
+			}
+
+			data, err := json.Marshal(summarizeEmail(email))
+			if err != nil {
+				return fmt.Errorf("failed to marshal message: %v", err)
+			}
+			if err := mb.Put(uidKey(uint32(uid)), data); err != nil {
+				return err
+			}
+			if err := indexAttachments(fb, folder, uint32(uid), email); err != nil {
+				return err
+			}
+
+			if uint32(uid) > meta.HighestUID {
+				meta.HighestUID = uint32(uid)
+			}
+		}
+
+		// Drop the oldest entries once the folder exceeds the cap
+		if excess := mb.Stats().KeyN - maxCachedMessages; excess > 0 {
+			c := mb.Cursor()
+			for k, _ := c.First(); k != nil && excess > 0; k, _ = c.First() {
+				if err := unindexAttachments(fb.Bucket([]byte(attachmentsBucket)), binary.BigEndian.Uint32(k)); err != nil {
+					return err
+				}
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				excess--
+			}
+		}
+
+		meta.SyncedAt = time.Now()
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return fmt.Errorf("failed to marshal folder meta: %v", err)
+		}
+		return fb.Put([]byte(folderMetaKey), data)
+	})
+}
+
+// GetMessages returns cached messages for a folder, newest first, along with
+// the number of messages held in the cache
+func (s *MessageCacheStorage) GetMessages(userID, accountID, folder string, offset, limit int) ([]models.Email, int, error) {
+	var emails []models.Email
+	count := 0
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		mb := messagesBucketFor(tx, userID, accountID, folder)
+		if mb == nil {
+			return nil
+		}
+
+		count = mb.Stats().KeyN
+
+		c := mb.Cursor()
+		skipped := 0
+		for k, v := c.Last(); k != nil && len(emails) < limit; k, v = c.Prev() {
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			var email models.Email
+			if err := json.Unmarshal(v, &email); err != nil {
+				continue // Skip corrupted
+			}
+			emails = append(emails, email)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+	return emails, count, nil
+}
+
+// CorrespondentDomains counts, across all cached folders of a user's
+// account, the messages each address domain appears in as sender or
+// recipient
+func (s *MessageCacheStorage) CorrespondentDomains(userID, accountID string) (map[string]int, error) {
+	domains := make(map[string]int)
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		ab := accountBucket(tx, userID, accountID)
+		if ab == nil {
+			return nil
+		}
+
+		return ab.ForEach(func(folder, v []byte) error {
+			if v != nil {
+				return nil // Not a folder bucket
+			}
+			mb := messagesBucketFor(tx, userID, accountID, string(folder))
+			if mb == nil {
+				return nil
+			}
+			return mb.ForEach(func(k, v []byte) error {
+				var email models.Email
+				if err := json.Unmarshal(v, &email); err != nil {
+					return nil // Skip corrupted
+				}
+
+				seen := make(map[string]bool)
+				for _, list := range []string{email.From, email.To, email.Cc} {
+					for _, addr := range strings.Split(list, ",") {
+						at := strings.LastIndex(addr, "@")
+						if at < 0 {
+							continue
+						}
+						domain := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(addr[at+1:]), ">"))
+						if domain != "" && !seen[domain] {
+							seen[domain] = true
+							domains[domain]++
+						}
+					}
+				}
+				return nil
+			})
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// SenderHistory goes through the cached folders of a user's account and
+// returns the addresses they wrote to, from messages sent by one of own, and
+// how many messages came from every other sender
+func (s *MessageCacheStorage) SenderHistory(userID, accountID string, own []string) (map[string]bool, map[string]int, error) {
+	sentTo := make(map[string]bool)
+	received := make(map[string]int)
+
+	self := make(map[string]bool, len(own))
+	for _, address := range own {
+		self[bareAddress(address)] = true
+	}
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		ab := accountBucket(tx, userID, accountID)
+		if ab == nil {
+			return nil
+		}
+
+		return ab.ForEach(func(folder, v []byte) error {
+			if v != nil {
+				return nil // Not a folder bucket
+			}
+			mb := messagesBucketFor(tx, userID, accountID, string(folder))
+			if mb == nil {
+				return nil
+			}
+			return mb.ForEach(func(k, v []byte) error {
+				var email models.Email
+				if err := json.Unmarshal(v, &email); err != nil {
+					return nil // Skip corrupted
+				}
+
+				from := bareAddress(email.From)
+				if !self[from] {
+					if from != "" {
+						received[from]++
+					}
+					return nil
+				}
+				for _, list := range []string{email.To, email.Cc} {
+					for _, addr := range strings.Split(list, ",") {
+						if addr = bareAddress(addr); addr != "" {
+							sentTo[addr] = true
+						}
+					}
+				}
+				return nil
+			})
+		})
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+	return sentTo, received, nil
+}
+
+// bareAddress returns the lower case address of "Name <address>" or a plain
+// address, or "" if s holds none
+func bareAddress(s string) string {
+	if start := strings.LastIndex(s, "<"); start >= 0 {
+		s = s[start+1:]
+		if end := strings.Index(s, ">"); end >= 0 {
+			s = s[:end]
+		}
+	}
+	s = strings.ToLower(strings.TrimSpace(s))
+	if !strings.Contains(s, "@") {
+		return ""
+	}
+	return s
+}
+
+// GetUIDRange returns the lowest and highest UIDs held in the cache for a folder
+func (s *MessageCacheStorage) GetUIDRange(userID, accountID, folder string) (uint32, uint32, error) {
+	var low, high uint32
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		mb := messagesBucketFor(tx, userID, accountID, folder)
+		if mb == nil {
+			return nil
+		}
+		c := mb.Cursor()
+		if k, _ := c.First(); k != nil {
+			low = binary.BigEndian.Uint32(k)
+		}
+		if k, _ := c.Last(); k != nil {
+			high = binary.BigEndian.Uint32(k)
+		}
+		return nil
+	})
+
+	return low, high, err
+}
+
+// SyncFlags reconciles cached messages against the flags reported by the server.
+// Cached messages missing from flags are treated as expunged and removed.
+func (s *MessageCacheStorage) SyncFlags(userID, accountID, folder string, flags map[uint32][]string) (int, int, error) {
+	updated, removed := 0, 0
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		mb := messagesBucketFor(tx, userID, accountID, folder)
+		if mb == nil {
+			return nil
+		}
+
+		changes := make(map[string][]byte)
+		mb.ForEach(func(k, v []byte) error {
+			serverFlags, ok := flags[binary.BigEndian.Uint32(k)]
+			if !ok {
+				changes[string(k)] = nil
+				return nil
+			}
+
+			var email models.Email
+			if err := json.Unmarshal(v, &email); err != nil {
+				changes[string(k)] = nil // Drop corrupted entries
+				return nil
+			}
+			if sameFlags(email.Flags, serverFlags) {
+				return nil
+			}
+			email.Flags = serverFlags
+			if data, err := json.Marshal(email); err == nil {
+				changes[string(k)] = data
+			}
+			return nil
+		})
+
+		ab := folderBucket(tx, userID, accountID, folder).Bucket([]byte(attachmentsBucket))
+		for k, data := range changes {
+			if data == nil {
+				if err := mb.Delete([]byte(k)); err != nil {
+					return err
+				}
+				if err := unindexAttachments(ab, binary.BigEndian.Uint32([]byte(k))); err != nil {
+					return err
+				}
+				removed++
+				continue
+			}
+			if err := mb.Put([]byte(k), data); err != nil {
+				return err
+			}
+			updated++
+		}
+		return nil
+	})
+
+	return updated, removed, err
+}
+
+// SetFlag adds or removes a flag on a cached message, if it is cached
+func (s *MessageCacheStorage) SetFlag(userID, accountID, folder, emailID, flag string, add bool) error {
+	uid, err := strconv.ParseUint(emailID, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid UID: %v", err)
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		mb := messagesBucketFor(tx, userID, accountID, folder)
+		if mb == nil {
+			return nil
+		}
+
+		data := mb.Get(uidKey(uint32(uid)))
+		if data == nil {
+			return nil
+		}
+		var email models.Email
+		if err := json.Unmarshal(data, &email); err != nil {
+			return err
+		}
+
+		flags := make([]string, 0, len(email.Flags)+1)
+		for _, f := range email.Flags {
+			if f != flag {
+				flags = append(flags, f)
+			}
+		}
+		if add {
+			flags = append(flags, flag)
+		}
+		email.Flags = flags
+
+		newData, err := json.Marshal(email)
+		if err != nil {
+			return err
+		}
+		return mb.Put(uidKey(uint32(uid)), newData)
+	})
+}
+
+// DeleteMessage removes a single message from the cache
+func (s *MessageCacheStorage) DeleteMessage(userID, accountID, folder, emailID string) error {
+	uid, err := strconv.ParseUint(emailID, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid UID: %v", err)
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		mb := messagesBucketFor(tx, userID, accountID, folder)
+		if mb == nil {
+			return nil
+		}
+		if err := unindexAttachments(folderBucket(tx, userID, accountID, folder).Bucket([]byte(attachmentsBucket)), uint32(uid)); err != nil {
+			return err
+		}
+		return mb.Delete(uidKey(uint32(uid)))
+	})
+}
+
+// ClearFolder drops all cached data for a folder
+func (s *MessageCacheStorage) ClearFolder(userID, accountID, folder string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		ab := accountBucket(tx, userID, accountID)
+		if ab == nil || ab.Bucket([]byte(folder)) == nil {
+			return nil
+		}
+		return ab.DeleteBucket([]byte(folder))
+	})
+}
+
+// ClearUser drops all cached data for a user
+func (s *MessageCacheStorage) ClearUser(userID string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(messageCacheBucket))
+		if b.Bucket([]byte(userID)) == nil {
+			return nil
+		}
+		return b.DeleteBucket([]byte(userID))
+	})
+}
+
+// cacheAccountKey is the bucket name of an account's cache. Sessions
+// without an account are kept in a "default" bucket.
+func cacheAccountKey(accountID string) []byte {
+	if accountID == "" {
+		accountID = "default"
+	}
+	return []byte(accountID)
+}
+
+// accountBucket returns the bucket for a user's account, or nil if it does not exist
+func accountBucket(tx *bbolt.Tx, userID, accountID string) *bbolt.Bucket {
+	ub := tx.Bucket([]byte(messageCacheBucket)).Bucket([]byte(userID))
+	if ub == nil {
+		return nil
+	}
+	return ub.Bucket(cacheAccountKey(accountID))
+}
+
+// folderBucket returns the bucket for a user's folder, or nil if it does not exist
+func folderBucket(tx *bbolt.Tx, userID, accountID, folder string) *bbolt.Bucket {
+	ab := accountBucket(tx, userID, accountID)
+	if ab == nil {
+		return nil
+	}
+	return ab.Bucket([]byte(folder))
+}
+
+// messagesBucketFor returns the message bucket for a user's folder, or nil if it does not exist
+func messagesBucketFor(tx *bbolt.Tx, userID, accountID, folder string) *bbolt.Bucket {
+	fb := folderBucket(tx, userID, accountID, folder)
+	if fb == nil {
+		return nil
+	}
+	return fb.Bucket([]byte(messagesBucket))
+}
+
+// createFolderBucket returns the bucket for a user's folder, creating it if needed
+func createFolderBucket(tx *bbolt.Tx, userID, accountID, folder string) (*bbolt.Bucket, error) {
+	ub, err := tx.Bucket([]byte(messageCacheBucket)).CreateBucketIfNotExists([]byte(userID))
+	if err != nil {
+		return nil, fmt.Errorf("create user cache bucket: %v", err)
+	}
+	ab, err := ub.CreateBucketIfNotExists(cacheAccountKey(accountID))
+	if err != nil {
+		return nil, fmt.Errorf("create account cache bucket: %v", err)
+	}
+	fb, err := ab.CreateBucketIfNotExists([]byte(folder))
+	if err != nil {
+		return nil, fmt.Errorf("create folder cache bucket: %v", err)
+	}
+	return fb, nil
+}
+
+// dropUnscopedFolders deletes folder buckets kept directly under a user,
+// from before the cache was split by account. Account buckets never hold
+// folder metadata themselves. The folders are fetched again on next use.
+func dropUnscopedFolders(tx *bbolt.Tx) error {
+	return tx.Bucket([]byte(messageCacheBucket)).ForEach(func(userID, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		ub := tx.Bucket([]byte(messageCacheBucket)).Bucket(userID)
+		var stale [][]byte
+		err := ub.ForEach(func(name, v []byte) error {
+			if v == nil && ub.Bucket(name).Get([]byte(folderMetaKey)) != nil {
+				stale = append(stale, append([]byte(nil), name...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range stale {
+			if err := ub.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// uidKey encodes a UID so that bucket keys sort in UID order
+func uidKey(uid uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uid)
+	return key
+}
+
+// sameFlags reports whether two flag lists contain the same flags
+func sameFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool, len(a))
+	for _, f := range a {
+		seen[f] = true
+	}
+	for _, f := range b {
+		if !seen[f] {
+			return false
+		}
+	}
+	return true
+}
+
+// summarizeEmail strips message content that is not needed for listings.
+// Attachment content is never serialized, so only the bodies are cleared.
+func summarizeEmail(email models.Email) models.Email {
+	email.Body = ""
+	email.HTML = ""
+	return email
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/models"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+)
+
+// notesBucket holds a bucket of notes per mailbox, keyed by note ID
+const notesBucket = "Notes"
+
+// NoteStorage keeps internal notes on messages using BoltDB
+type NoteStorage struct {
+	db *bbolt.DB
+}
+
+// NewNoteStorage creates a new note storage instance
+func NewNoteStorage(db *bbolt.DB) *NoteStorage {
+	return &NoteStorage{
+		db: db,
+	}
+}
+
+// GetNotes returns the notes on a message that a user can see, oldest first
+func (s *NoteStorage) GetNotes(mailbox, messageKey, username string) ([]*models.Note, error) {
+	notes := []*models.Note{}
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		mb := tx.Bucket([]byte(notesBucket)).Bucket([]byte(mailbox))
+		if mb == nil {
+			return nil
+		}
+		return mb.ForEach(func(k, v []byte) error {
+			var note models.Note
+			if err := json.Unmarshal(v, &note); err != nil {
+				return nil // Skip corrupted
+			}
+			if note.MessageKey == messageKey && (note.Shared || note.Author == username) {
+				notes = append(notes, &note)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(notes, func(i, j int) bool {
+		return notes[i].CreatedAt.Before(notes[j].CreatedAt)
+	})
+	return notes, nil
+}
+
+// GetNote retrieves a note of a mailbox by ID
+func (s *NoteStorage) GetNote(mailbox, id string) (*models.Note, error) {
+	var note models.Note
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		mb := tx.Bucket([]byte(notesBucket)).Bucket([]byte(mailbox))
+		if mb == nil {
+			return errors.New("note not found")
+		}
+		data := mb.Get([]byte(id))
+		if data == nil {
+			return errors.New("note not found")
+		}
+		return json.Unmarshal(data, &note)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+// SaveNote creates a note, or updates it if it has an ID
+func (s *NoteStorage) SaveNote(note *models.Note) error {
+	now := time.Now()
+	if note.ID == "" {
+		note.ID = uuid.New().String()
+		note.CreatedAt = now
+	}
+	note.UpdatedAt = now
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		mb, err := tx.Bucket([]byte(notesBucket)).CreateBucketIfNotExists([]byte(note.Mailbox))
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(note)
+		if err != nil {
+			return fmt.Errorf("failed to marshal note: %v", err)
+		}
+
+		return mb.Put([]byte(note.ID), data)
+	})
+}
+
+// DeleteNote deletes a note
+func (s *NoteStorage) DeleteNote(mailbox, id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		mb := tx.Bucket([]byte(notesBucket)).Bucket([]byte(mailbox))
+		if mb == nil {
+			return nil
+		}
+		return mb.Delete([]byte(id))
+	})
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"lilmail/models"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	notificationsBucket = "Notifications"
+
+	// maxStoredNotifications caps the replay buffer per user
+	maxStoredNotifications = 200
+	// notificationRetention is how long notifications stay available for replay
+	notificationRetention = 24 * time.Hour
+)
+
+// NotificationStorage keeps a per-user buffer of recent notifications so
+// clients can catch up on what they missed while disconnected
+type NotificationStorage struct {
+	db *bbolt.DB
+}
+
+// NewNotificationStorage creates a new notification storage instance
+func NewNotificationStorage(db *bbolt.DB) *NotificationStorage {
+	return &NotificationStorage{
+		db: db,
+	}
+}
+
+// Append stores a notification, assigning it the user's next sequence number
+func (s *NotificationStorage) Append(userID string, notification *models.Notification) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.Bucket([]byte(notificationsBucket)).CreateBucketIfNotExists([]byte(userID))
+		if err != nil {
+			return fmt.Errorf("create notification bucket: %v", err)
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		notification.Seq = seq
+
+		data, err := json.Marshal(notification)
+		if err != nil {
+			return fmt.Errorf("failed to marshal notification: %v", err)
+		}
+		if err := b.Put(seqKey(seq), data); err != nil {
+			return err
+		}
+
+		// Drop the oldest entries past the cap
+		if excess := b.Stats().KeyN - maxStoredNotifications; excess > 0 {
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && excess > 0; k, _ = c.First() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				excess--
+			}
+		}
+		return nil
+	})
+}
+
+// Since returns the user's notifications with a sequence number above seq,
+// oldest first. Notifications past the retention period are skipped.
+func (s *NotificationStorage) Since(userID string, seq uint64) ([]models.Notification, error) {
+	var notifications []models.Notification
+	cutoff := time.Now().Add(-notificationRetention)
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(notificationsBucket)).Bucket([]byte(userID))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(seqKey(seq + 1)); k != nil; k, v = c.Next() {
+			var notification models.Notification
+			if err := json.Unmarshal(v, &notification); err != nil {
+				continue // Skip corrupted
+			}
+			if notification.Time.Before(cutoff) {
+				continue
+			}
+			notifications = append(notifications, notification)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+// seqKey encodes a sequence number so that keys sort in order
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
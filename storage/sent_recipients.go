@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// sentRecipientsBucket holds, per user, the addresses they have sent mail to
+const sentRecipientsBucket = "SentRecipients"
+
+// SentRecipientStorage remembers who users have written to through lilmail,
+// which outlives the message cache's window of recent mail
+type SentRecipientStorage struct {
+	db *bbolt.DB
+}
+
+// NewSentRecipientStorage creates a new sent recipient storage instance
+func NewSentRecipientStorage(db *bbolt.DB) *SentRecipientStorage {
+	return &SentRecipientStorage{
+		db: db,
+	}
+}
+
+// GetRecipients returns the lower case addresses a user has sent mail to,
+// with when they last did
+func (s *SentRecipientStorage) GetRecipients(userID string) (map[string]time.Time, error) {
+	recipients := make(map[string]time.Time)
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(sentRecipientsBucket)).Get([]byte(userID))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &recipients)
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sent recipients: %v", err)
+	}
+	return recipients, nil
+}
+
+// AddRecipients records that a user sent mail to addresses just now
+func (s *SentRecipientStorage) AddRecipients(userID string, addresses []string) error {
+	if len(addresses) == 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(sentRecipientsBucket))
+
+		recipients := make(map[string]time.Time)
+		if data := b.Get([]byte(userID)); data != nil {
+			if err := json.Unmarshal(data, &recipients); err != nil {
+				return fmt.Errorf("failed to unmarshal sent recipients: %v", err)
+			}
+		}
+
+		now := time.Now()
+		for _, address := range addresses {
+			if address = strings.ToLower(strings.TrimSpace(address)); address != "" {
+				recipients[address] = now
+			}
+		}
+
+		data, err := json.Marshal(recipients)
+		if err != nil {
+			return fmt.Errorf("failed to marshal sent recipients: %v", err)
+		}
+		return b.Put([]byte(userID), data)
+	})
+}
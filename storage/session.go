@@ -5,6 +5,7 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 )
@@ -13,10 +14,28 @@ import (
 type FileStorage struct {
 	dir string
 	mu  sync.RWMutex
+
+	// byUser indexes the sessions tagged with Track by user ID
+	byUser map[string]map[string]bool
 }
 
 type sessionData struct {
-	Value     []byte    `json:"value"`
+	Value     []byte       `json:"value"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	Info      *SessionInfo `json:"info,omitempty"`
+}
+
+// SessionInfo describes who a session belongs to, for the admin sessions
+// view. Fiber's session values are opaque to the storage, so the login
+// handler tags sessions with it.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Username  string    `json:"username"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
 	ExpiresAt time.Time `json:"expires_at"`
 }
 
@@ -27,17 +46,68 @@ func NewFileStorage(directory string) (*FileStorage, error) {
 		return nil, err
 	}
 
-	return &FileStorage{
-		dir: directory,
-	}, nil
+	s := &FileStorage{
+		dir:    directory,
+		byUser: make(map[string]map[string]bool),
+	}
+	s.buildIndex()
+	return s, nil
+}
+
+// buildIndex fills the user index from the tagged session files
+func (s *FileStorage) buildIndex() {
+	s.eachSession(func(key string, data *sessionData) {
+		if data.Info != nil && data.Info.UserID != "" {
+			s.index(data.Info.UserID, key)
+		}
+	})
+}
+
+func (s *FileStorage) index(userID, key string) {
+	if s.byUser[userID] == nil {
+		s.byUser[userID] = make(map[string]bool)
+	}
+	s.byUser[userID][key] = true
+}
+
+func (s *FileStorage) unindex(key string) {
+	for userID, keys := range s.byUser {
+		if keys[key] {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(s.byUser, userID)
+			}
+			return
+		}
+	}
+}
+
+// eachSession calls fn with every readable session file
+func (s *FileStorage) eachSession(fn func(key string, data *sessionData)) {
+	dir, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+
+	for _, d := range dir {
+		name := d.Name()
+		if filepath.Ext(name) != ".session" {
+			continue
+		}
+		key := name[:len(name)-len(".session")]
+		data, err := s.readFile(key)
+		if err != nil {
+			continue // Skip unreadable
+		}
+		fn(key, data)
+	}
 }
 
 // Get retrieves session data from file
 func (s *FileStorage) Get(key string) ([]byte, error) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
-
 	data, err := s.readFile(key)
+	s.mu.RUnlock()
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return nil, nil // Return nil for non-existent keys
@@ -64,6 +134,12 @@ func (s *FileStorage) Set(key string, val []byte, exp time.Duration) error {
 		ExpiresAt: time.Now().Add(exp),
 	}
 
+	// Keep the owner of a tracked session across saves
+	if existing, err := s.readFile(key); err == nil && existing.Info != nil {
+		data.Info = existing.Info
+		data.Info.LastSeen = time.Now()
+	}
+
 	return s.writeFile(key, data)
 }
 
@@ -72,6 +148,12 @@ func (s *FileStorage) Delete(key string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	return s.delete(key)
+}
+
+func (s *FileStorage) delete(key string) error {
+	s.unindex(key)
+
 	path := s.getPath(key)
 	err := os.Remove(path)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
@@ -95,6 +177,7 @@ func (s *FileStorage) Reset() error {
 			os.Remove(filepath.Join(s.dir, d.Name()))
 		}
 	}
+	s.byUser = make(map[string]map[string]bool)
 
 	return nil
 }
@@ -134,3 +217,100 @@ func (s *FileStorage) writeFile(key string, data sessionData) error {
 
 	return os.WriteFile(s.getPath(key), jsonData, 0644)
 }
+
+// Count returns the number of sessions that haven't expired
+func (s *FileStorage) Count() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	dir, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	now := time.Now()
+	for _, d := range dir {
+		name := d.Name()
+		if filepath.Ext(name) != ".session" {
+			continue
+		}
+		data, err := s.readFile(name[:len(name)-len(".session")])
+		if err != nil {
+			continue // Skip unreadable
+		}
+		if now.Before(data.ExpiresAt) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Track tags a saved session with its owner so it shows up in the
+// admin sessions view and can be revoked per user
+func (s *FileStorage) Track(key string, info SessionInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.readFile(key)
+	if err != nil {
+		return err
+	}
+
+	info.ID = key
+	info.CreatedAt = time.Now()
+	info.LastSeen = info.CreatedAt
+	data.Info = &info
+
+	if err := s.writeFile(key, *data); err != nil {
+		return err
+	}
+	s.index(info.UserID, key)
+	return nil
+}
+
+// ListSessions returns the tracked sessions that haven't expired, most
+// recently active first
+func (s *FileStorage) ListSessions() []SessionInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var sessions []SessionInfo
+	now := time.Now()
+	for _, keys := range s.byUser {
+		for key := range keys {
+			data, err := s.readFile(key)
+			if err != nil || data.Info == nil || now.After(data.ExpiresAt) {
+				continue
+			}
+			info := *data.Info
+			info.ExpiresAt = data.ExpiresAt
+			sessions = append(sessions, info)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions
+}
+
+// DeleteUserSessions expires every session of a user and returns the
+// usernames they were logged in as
+func (s *FileStorage) DeleteUserSessions(userID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var usernames []string
+	seen := make(map[string]bool)
+	for key := range s.byUser[userID] {
+		if data, err := s.readFile(key); err == nil && data.Info != nil && !seen[data.Info.Username] {
+			seen[data.Info.Username] = true
+			usernames = append(usernames, data.Info.Username)
+		}
+		if err := s.delete(key); err != nil {
+			return usernames, err
+		}
+	}
+	return usernames, nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"lilmail/models"
+
+	"go.etcd.io/bbolt"
+)
+
+const settingsBucket = "UserSettings"
+
+// SettingsStorage manages per-user settings using BoltDB
+type SettingsStorage struct {
+	db *bbolt.DB
+}
+
+// NewSettingsStorage creates a new settings storage instance
+func NewSettingsStorage(db *bbolt.DB) *SettingsStorage {
+	return &SettingsStorage{
+		db: db,
+	}
+}
+
+// GetSettings returns a user's settings, or the defaults if none were saved
+func (s *SettingsStorage) GetSettings(userID string) (*models.UserSettings, error) {
+	settings := models.DefaultUserSettings(userID)
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(settingsBucket))
+		data := b.Get([]byte(userID))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, settings)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// SaveSettings stores a user's settings
+func (s *SettingsStorage) SaveSettings(settings *models.UserSettings) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(settingsBucket))
+
+		data, err := json.Marshal(settings)
+		if err != nil {
+			return fmt.Errorf("failed to marshal settings: %v", err)
+		}
+
+		return b.Put([]byte(settings.UserID), data)
+	})
+}
+
+// DeleteSettings removes a user's saved settings so the defaults apply again
+func (s *SettingsStorage) DeleteSettings(userID string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(settingsBucket)).Delete([]byte(userID))
+	})
+}
+
+// ListSettings returns the saved settings of every user
+func (s *SettingsStorage) ListSettings() ([]*models.UserSettings, error) {
+	var all []*models.UserSettings
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(settingsBucket))
+		return b.ForEach(func(k, v []byte) error {
+			settings := models.DefaultUserSettings(string(k))
+			if err := json.Unmarshal(v, settings); err != nil {
+				return nil // Skip corrupted
+			}
+			all = append(all, settings)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/models"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+)
+
+const sharesBucket = "Shares"
+
+// ShareStorage keeps the messages users share by link using BoltDB
+type ShareStorage struct {
+	db *bbolt.DB
+}
+
+// NewShareStorage creates a new share storage instance
+func NewShareStorage(db *bbolt.DB) *ShareStorage {
+	return &ShareStorage{
+		db: db,
+	}
+}
+
+// CreateShare saves a new shared message
+func (s *ShareStorage) CreateShare(share *models.SharedEmail) error {
+	if share.ID == "" {
+		share.ID = uuid.New().String()
+	}
+	share.CreatedAt = time.Now()
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(sharesBucket))
+
+		data, err := json.Marshal(share)
+		if err != nil {
+			return fmt.Errorf("failed to marshal share: %v", err)
+		}
+
+		return b.Put([]byte(share.ID), data)
+	})
+}
+
+// GetShare retrieves a shared message by ID
+func (s *ShareStorage) GetShare(id string) (*models.SharedEmail, error) {
+	var share models.SharedEmail
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(sharesBucket))
+		data := b.Get([]byte(id))
+		if data == nil {
+			return errors.New("share not found")
+		}
+		return json.Unmarshal(data, &share)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+// GetSharesByUser retrieves all messages a user shared, newest first
+func (s *ShareStorage) GetSharesByUser(userID string) ([]*models.SharedEmail, error) {
+	var shares []*models.SharedEmail
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(sharesBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var share models.SharedEmail
+			if err := json.Unmarshal(v, &share); err != nil {
+				return nil // Skip corrupted
+			}
+			if share.UserID == userID {
+				shares = append(shares, &share)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].CreatedAt.After(shares[j].CreatedAt)
+	})
+	return shares, nil
+}
+
+// RevokeShare stops a link from opening. The copy is dropped but the
+// record is kept so the user still sees the link as revoked.
+func (s *ShareStorage) RevokeShare(id string) error {
+	return s.update(id, func(share *models.SharedEmail) {
+		share.Revoked = true
+		share.Email.Body = ""
+		share.Email.HTML = ""
+		share.Attachments = nil
+	})
+}
+
+// RecordView counts an opening of a shared message
+func (s *ShareStorage) RecordView(id string) error {
+	return s.update(id, func(share *models.SharedEmail) {
+		share.Views++
+	})
+}
+
+// DeleteExpired removes shares that expired more than keep ago
+func (s *ShareStorage) DeleteExpired(keep time.Duration) error {
+	cutoff := time.Now().Add(-keep)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(sharesBucket))
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var share models.SharedEmail
+			if err := json.Unmarshal(v, &share); err != nil || share.ExpiresAt.Before(cutoff) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// update applies change to a stored share in a single transaction
+func (s *ShareStorage) update(id string, change func(*models.SharedEmail)) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(sharesBucket))
+		data := b.Get([]byte(id))
+		if data == nil {
+			return errors.New("share not found")
+		}
+
+		var share models.SharedEmail
+		if err := json.Unmarshal(data, &share); err != nil {
+			return err
+		}
+		change(&share)
+
+		data, err := json.Marshal(&share)
+		if err != nil {
+			return fmt.Errorf("failed to marshal share: %v", err)
+		}
+		return b.Put([]byte(id), data)
+	})
+}
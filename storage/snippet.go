@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/models"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+)
+
+// snippetsBucket holds a bucket of snippets per user, keyed by snippet ID
+const snippetsBucket = "Snippets"
+
+// ErrShortcutTaken means another of the user's snippets has the shortcut
+var ErrShortcutTaken = errors.New("shortcut is already used by another snippet")
+
+// SnippetStorage keeps users' compose snippets using BoltDB
+type SnippetStorage struct {
+	db *bbolt.DB
+}
+
+// NewSnippetStorage creates a new snippet storage instance
+func NewSnippetStorage(db *bbolt.DB) *SnippetStorage {
+	return &SnippetStorage{
+		db: db,
+	}
+}
+
+// GetSnippets returns a user's snippets sorted by name
+func (s *SnippetStorage) GetSnippets(userID string) ([]*models.Snippet, error) {
+	snippets := []*models.Snippet{}
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		ub := tx.Bucket([]byte(snippetsBucket)).Bucket([]byte(userID))
+		if ub == nil {
+			return nil
+		}
+		return ub.ForEach(func(k, v []byte) error {
+			var snippet models.Snippet
+			if err := json.Unmarshal(v, &snippet); err != nil {
+				return nil // Skip corrupted
+			}
+			snippets = append(snippets, &snippet)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(snippets, func(i, j int) bool {
+		return strings.ToLower(snippets[i].Name) < strings.ToLower(snippets[j].Name)
+	})
+	return snippets, nil
+}
+
+// GetSnippet retrieves one of a user's snippets
+func (s *SnippetStorage) GetSnippet(userID, id string) (*models.Snippet, error) {
+	var snippet models.Snippet
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		ub := tx.Bucket([]byte(snippetsBucket)).Bucket([]byte(userID))
+		if ub == nil {
+			return errors.New("snippet not found")
+		}
+		data := ub.Get([]byte(id))
+		if data == nil {
+			return errors.New("snippet not found")
+		}
+		return json.Unmarshal(data, &snippet)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return &snippet, nil
+}
+
+// SaveSnippet creates a snippet, or updates it if it has an ID. Shortcuts
+// must be unique among the user's snippets.
+func (s *SnippetStorage) SaveSnippet(snippet *models.Snippet) error {
+	now := time.Now()
+	if snippet.ID == "" {
+		snippet.ID = uuid.New().String()
+		snippet.CreatedAt = now
+	}
+	snippet.UpdatedAt = now
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		ub, err := tx.Bucket([]byte(snippetsBucket)).CreateBucketIfNotExists([]byte(snippet.UserID))
+		if err != nil {
+			return err
+		}
+
+		if snippet.Shortcut != "" {
+			err := ub.ForEach(func(k, v []byte) error {
+				var other models.Snippet
+				if json.Unmarshal(v, &other) == nil && other.ID != snippet.ID && other.Shortcut == snippet.Shortcut {
+					return ErrShortcutTaken
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		data, err := json.Marshal(snippet)
+		if err != nil {
+			return fmt.Errorf("failed to marshal snippet: %v", err)
+		}
+
+		return ub.Put([]byte(snippet.ID), data)
+	})
+}
+
+// DeleteSnippet deletes one of a user's snippets
+func (s *SnippetStorage) DeleteSnippet(userID, id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		ub := tx.Bucket([]byte(snippetsBucket)).Bucket([]byte(userID))
+		if ub == nil || ub.Get([]byte(id)) == nil {
+			return errors.New("snippet not found")
+		}
+		return ub.Delete([]byte(id))
+	})
+}
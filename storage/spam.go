@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"lilmail/models"
+
+	"go.etcd.io/bbolt"
+)
+
+// spamBucket holds each user's spam classifier, keyed by user ID
+const spamBucket = "SpamModels"
+
+// SpamStorage keeps per-user spam classifiers using BoltDB
+type SpamStorage struct {
+	db *bbolt.DB
+}
+
+// NewSpamStorage creates a new spam storage instance
+func NewSpamStorage(db *bbolt.DB) *SpamStorage {
+	return &SpamStorage{
+		db: db,
+	}
+}
+
+// GetModel returns a user's spam classifier, or an untrained one if the user
+// hasn't trained it yet
+func (s *SpamStorage) GetModel(userID string) (*models.SpamModel, error) {
+	model := models.NewSpamModel()
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(spamBucket)).Get([]byte(userID))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, model)
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to load spam model: %v", err)
+	}
+	return model, nil
+}
+
+// SaveModel stores a user's spam classifier
+func (s *SpamStorage) SaveModel(userID string, model *models.SpamModel) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		data, err := json.Marshal(model)
+		if err != nil {
+			return fmt.Errorf("failed to marshal spam model: %v", err)
+		}
+		return tx.Bucket([]byte(spamBucket)).Put([]byte(userID), data)
+	})
+}
+
+// DeleteModel forgets everything a user's spam classifier was trained on
+func (s *SpamStorage) DeleteModel(userID string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(spamBucket)).Delete([]byte(userID))
+	})
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"lilmail/config"
+	"lilmail/models"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const systemSettingsBucket = "SystemSettings"
+
+var systemSettingsKey = []byte("current")
+
+// SystemSettingsStorage keeps the admin overrides of the [system] config.
+// Settings are read on every request, so the current value is cached.
+type SystemSettingsStorage struct {
+	db       *bbolt.DB
+	defaults models.SystemSettings
+
+	mu      sync.RWMutex
+	current models.SystemSettings
+}
+
+// NewSystemSettingsStorage creates a system settings store that falls back
+// to the values from config.toml
+func NewSystemSettingsStorage(db *bbolt.DB, cfg config.SystemConfig) *SystemSettingsStorage {
+	s := &SystemSettingsStorage{
+		db: db,
+		defaults: models.SystemSettings{
+			RequestsPerMinute:   cfg.RequestsPerMinute,
+			MaxAttachmentMB:     cfg.MaxAttachmentMB,
+			MaxMessageMB:        cfg.MaxMessageMB,
+			BlockedExtensions:   cfg.BlockedExtensions,
+			AllowedServers:      cfg.AllowedServers,
+			DeniedServers:       cfg.DeniedServers,
+			RegistrationEnabled: cfg.RegistrationEnabled,
+		},
+	}
+	s.current = s.Defaults()
+
+	if saved, err := s.load(); err == nil && saved != nil {
+		s.current = *saved
+	}
+	return s
+}
+
+func (s *SystemSettingsStorage) load() (*models.SystemSettings, error) {
+	var settings *models.SystemSettings
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(systemSettingsBucket))
+		data := b.Get(systemSettingsKey)
+		if data == nil {
+			return nil
+		}
+		// Settings saved before a field existed keep its default
+		defaults := s.Defaults()
+		settings = &defaults
+		return json.Unmarshal(data, settings)
+	})
+	return settings, err
+}
+
+// Defaults returns the settings from config.toml
+func (s *SystemSettingsStorage) Defaults() models.SystemSettings {
+	defaults := s.defaults
+	defaults.AllowedServers = append([]string(nil), s.defaults.AllowedServers...)
+	defaults.DeniedServers = append([]string(nil), s.defaults.DeniedServers...)
+	defaults.BlockedExtensions = append([]string(nil), s.defaults.BlockedExtensions...)
+	return defaults
+}
+
+// Current returns the settings in effect
+func (s *SystemSettingsStorage) Current() models.SystemSettings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	current := s.current
+	current.AllowedServers = append([]string(nil), s.current.AllowedServers...)
+	current.DeniedServers = append([]string(nil), s.current.DeniedServers...)
+	current.BlockedExtensions = append([]string(nil), s.current.BlockedExtensions...)
+	return current
+}
+
+// Save validates and stores new settings, which apply right away
+func (s *SystemSettingsStorage) Save(settings models.SystemSettings, updatedBy string) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	settings.UpdatedAt = time.Now()
+	settings.UpdatedBy = updatedBy
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(systemSettingsBucket))
+
+		data, err := json.Marshal(settings)
+		if err != nil {
+			return fmt.Errorf("failed to marshal system settings: %v", err)
+		}
+
+		return b.Put(systemSettingsKey, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.current = settings
+	s.mu.Unlock()
+	return nil
+}
+
+// Reset drops the admin overrides and goes back to config.toml
+func (s *SystemSettingsStorage) Reset() error {
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(systemSettingsBucket)).Delete(systemSettingsKey)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.current = s.Defaults()
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/models"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+)
+
+const themesBucket = "Themes"
+
+// ThemeStorage manages admin-uploaded themes using BoltDB
+type ThemeStorage struct {
+	db *bbolt.DB
+}
+
+// NewThemeStorage creates a new theme storage instance
+func NewThemeStorage(db *bbolt.DB) *ThemeStorage {
+	return &ThemeStorage{
+		db: db,
+	}
+}
+
+// CreateTheme saves a new custom theme
+func (s *ThemeStorage) CreateTheme(theme *models.Theme) error {
+	if theme.ID == "" {
+		theme.ID = uuid.New().String()
+	}
+	theme.BuiltIn = false
+	theme.CreatedAt = time.Now()
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(themesBucket))
+
+		data, err := json.Marshal(theme)
+		if err != nil {
+			return fmt.Errorf("failed to marshal theme: %v", err)
+		}
+
+		return b.Put([]byte(theme.ID), data)
+	})
+}
+
+// GetTheme retrieves a custom theme by ID
+func (s *ThemeStorage) GetTheme(id string) (*models.Theme, error) {
+	var theme models.Theme
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(themesBucket))
+		data := b.Get([]byte(id))
+		if data == nil {
+			return errors.New("theme not found")
+		}
+		return json.Unmarshal(data, &theme)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return &theme, nil
+}
+
+// ListThemes returns the custom themes, oldest first
+func (s *ThemeStorage) ListThemes() ([]*models.Theme, error) {
+	var themes []*models.Theme
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(themesBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var theme models.Theme
+			if err := json.Unmarshal(v, &theme); err != nil {
+				return nil // Skip corrupted
+			}
+			themes = append(themes, &theme)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(themes, func(i, j int) bool {
+		return themes[i].CreatedAt.Before(themes[j].CreatedAt)
+	})
+	return themes, nil
+}
+
+// DeleteTheme deletes a custom theme
+func (s *ThemeStorage) DeleteTheme(id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(themesBucket))
+		return b.Delete([]byte(id))
+	})
+}
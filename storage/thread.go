@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -165,6 +167,105 @@ func (s *ThreadStorage) DeleteThreadsByFolder(userID, folder string) error {
 	return nil
 }
 
+// GetFolderState returns the mailbox state the folder's threads were built
+// from, or nil if none was recorded
+func (s *ThreadStorage) GetFolderState(userID, folder string) (*models.MailboxState, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, err := os.ReadFile(s.folderStatePath(userID, folder))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read folder state: %v", err)
+	}
+
+	var state models.MailboxState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal folder state: %v", err)
+	}
+
+	return &state, nil
+}
+
+// SaveFolderState records the mailbox state the folder's threads were built from
+func (s *ThreadStorage) SaveFolderState(userID, folder string, state *models.MailboxState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.folderStatePath(userID, folder)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create folder state directory: %v", err)
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal folder state: %v", err)
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
+
+// GetMutedThreads returns the conversations a user has muted
+func (s *ThreadStorage) GetMutedThreads(userID string) ([]models.MutedThread, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, err := os.ReadFile(s.sidecarPath("mutes", userID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read muted threads: %v", err)
+	}
+
+	var mutes []models.MutedThread
+	if err := json.Unmarshal(data, &mutes); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal muted threads: %v", err)
+	}
+
+	return mutes, nil
+}
+
+// SaveMutedThreads replaces the conversations a user has muted
+func (s *ThreadStorage) SaveMutedThreads(userID string, mutes []models.MutedThread) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.sidecarPath("mutes", userID)
+	if len(mutes) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete muted threads: %v", err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create muted threads directory: %v", err)
+	}
+
+	data, err := json.Marshal(mutes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal muted threads: %v", err)
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
+
+// folderStatePath returns the state file for a user's folder
+func (s *ThreadStorage) folderStatePath(userID, folder string) string {
+	return s.sidecarPath("state", userID+"\x00"+folder)
+}
+
+// sidecarPath returns the file for per-user data kept next to the threads.
+// These live in subdirectories so GetThreadsByFolder doesn't mistake them for
+// threads.
+func (s *ThreadStorage) sidecarPath(kind, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dataDir, kind, hex.EncodeToString(sum[:])+".json")
+}
+
 // saveThread saves thread to file (must be called with lock held)
 func (s *ThreadStorage) saveThread(thread *models.EmailThread) error {
 	threadPath := filepath.Join(s.dataDir, thread.ID+".json")
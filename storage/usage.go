@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"go.etcd.io/bbolt"
+)
+
+// StoreUsage is the disk space taken by one store
+type StoreUsage struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+	Items int    `json:"items"` // Keys for BoltDB buckets, files for directories
+}
+
+// UsageReporter measures the BoltDB buckets and the file-based stores
+type UsageReporter struct {
+	db   *bbolt.DB
+	dirs map[string]string // Store name to directory or file
+}
+
+// NewUsageReporter creates a usage reporter for the database and the named
+// directories
+func NewUsageReporter(db *bbolt.DB, dirs map[string]string) *UsageReporter {
+	return &UsageReporter{
+		db:   db,
+		dirs: dirs,
+	}
+}
+
+// Usage returns the size of every bucket and directory, largest first
+func (u *UsageReporter) Usage() ([]StoreUsage, error) {
+	var usage []StoreUsage
+
+	err := u.db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			store := StoreUsage{Name: "db:" + string(name)}
+			err := b.ForEach(func(k, v []byte) error {
+				store.Bytes += int64(len(k) + len(v))
+				store.Items++
+				return nil
+			})
+			usage = append(usage, store)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name, path := range u.dirs {
+		store := StoreUsage{Name: name}
+		err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil // Removed while walking
+			}
+			store.Bytes += info.Size()
+			store.Items++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, store)
+	}
+
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Bytes > usage[j].Bytes
+	})
+	return usage, nil
+}
@@ -179,6 +179,9 @@ func (s *UserStorage) UpdateUser(user *models.User) error {
 		if user.PasswordHash == "" {
 			user.PasswordHash = existing.PasswordHash
 		}
+		if user.KnownDevices == nil {
+			user.KnownDevices = existing.KnownDevices
+		}
 
 		// Check if email changed (need to update index)
 		if user.Email != existing.Email {
@@ -317,6 +320,109 @@ func (s *UserStorage) UpdateLastLogin(userID string) error {
 	})
 }
 
+// ErrDailySendLimit is returned by ReserveSend when the user has sent as
+// many messages today as their limit allows
+var ErrDailySendLimit = errors.New("daily sending limit reached")
+
+// ReserveSend counts an outgoing message against the user's daily limit,
+// or returns ErrDailySendLimit when there is none left
+func (s *UserStorage) ReserveSend(userID string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("Users"))
+		data := b.Get([]byte(userID))
+		if data == nil {
+			return errors.New("user not found")
+		}
+
+		var user models.User
+		if err := json.Unmarshal(data, &user); err != nil {
+			return err
+		}
+
+		today := time.Now().Format("2006-01-02")
+		if user.SentDay != today {
+			user.SentDay = today
+			user.SentToday = 0
+		}
+		if max := user.Limits.MaxMessagesPerDay; max > 0 && user.SentToday >= max {
+			return ErrDailySendLimit
+		}
+		user.SentToday++
+
+		newData, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(userID), newData)
+	})
+}
+
+// ReleaseSend gives back a message reserved with ReserveSend that wasn't
+// sent. Reservations from an earlier day were already reset.
+func (s *UserStorage) ReleaseSend(userID string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("Users"))
+		data := b.Get([]byte(userID))
+		if data == nil {
+			return errors.New("user not found")
+		}
+
+		var user models.User
+		if err := json.Unmarshal(data, &user); err != nil {
+			return err
+		}
+
+		if user.SentDay != time.Now().Format("2006-01-02") || user.SentToday == 0 {
+			return nil
+		}
+		user.SentToday--
+
+		newData, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(userID), newData)
+	})
+}
+
+// RecordDevice remembers a device fingerprint for a user and reports whether
+// it had not been seen before
+func (s *UserStorage) RecordDevice(userID, fingerprint string) (bool, error) {
+	isNew := false
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("Users"))
+		data := b.Get([]byte(userID))
+		if data == nil {
+			return errors.New("user not found")
+		}
+
+		var user models.User
+		if err := json.Unmarshal(data, &user); err != nil {
+			return err
+		}
+
+		for _, known := range user.KnownDevices {
+			if known == fingerprint {
+				return nil
+			}
+		}
+		isNew = true
+		user.KnownDevices = append(user.KnownDevices, fingerprint)
+
+		newData, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(userID), newData)
+	})
+
+	return isNew, err
+}
+
 // GenerateSecureToken generates a cryptographically secure random token
 func GenerateSecureToken(length int) (string, error) {
 	// Re-using the implementation from original file, but we need import crypto/rand
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/models"
+	"time"
+
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+)
+
+const webhooksBucket = "Webhooks"
+
+// WebhookStorage manages webhook registrations using BoltDB
+type WebhookStorage struct {
+	db *bbolt.DB
+}
+
+// NewWebhookStorage creates a new webhook storage instance
+func NewWebhookStorage(db *bbolt.DB) *WebhookStorage {
+	return &WebhookStorage{
+		db: db,
+	}
+}
+
+// CreateWebhook saves a new webhook
+func (s *WebhookStorage) CreateWebhook(webhook *models.Webhook) error {
+	if webhook.ID == "" {
+		webhook.ID = uuid.New().String()
+	}
+	webhook.CreatedAt = time.Now()
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(webhooksBucket))
+
+		data, err := json.Marshal(webhook)
+		if err != nil {
+			return fmt.Errorf("failed to marshal webhook: %v", err)
+		}
+
+		return b.Put([]byte(webhook.ID), data)
+	})
+}
+
+// GetWebhook retrieves a webhook by ID
+func (s *WebhookStorage) GetWebhook(id string) (*models.Webhook, error) {
+	var webhook models.Webhook
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(webhooksBucket))
+		data := b.Get([]byte(id))
+		if data == nil {
+			return errors.New("webhook not found")
+		}
+		return json.Unmarshal(data, &webhook)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// GetWebhooksByUser retrieves all webhooks for a user (Scan)
+func (s *WebhookStorage) GetWebhooksByUser(userID string) ([]*models.Webhook, error) {
+	var webhooks []*models.Webhook
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(webhooksBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var webhook models.Webhook
+			if err := json.Unmarshal(v, &webhook); err != nil {
+				return nil // Skip corrupted
+			}
+			if webhook.UserID == userID {
+				webhooks = append(webhooks, &webhook)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes a webhook
+func (s *WebhookStorage) DeleteWebhook(id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(webhooksBucket))
+		return b.Delete([]byte(id))
+	})
+}
@@ -0,0 +1,266 @@
+// Command openapidoc collects the documentation of HTTP handlers for the
+// OpenAPI document lilmail serves at /api/openapi.json.
+//
+// Every method taking a *fiber.Ctx and returning an error is a handler. Its
+// doc comment gives the summary (the first sentence) and description of the
+// operations routed to it, and the c.Query, c.QueryInt, c.QueryBool and
+// c.QueryFloat calls in its body the query parameters. Request bodies are
+// found from c.BodyParser (JSON or form) and c.MultipartForm or c.FormFile
+// calls. Routes and path parameters are read from the router at run time.
+//
+// Run it with go generate in handlers/api after changing handlers:
+//
+//	go generate ./handlers/api
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// doc is the documentation of a handler
+type doc struct {
+	summary     string
+	description string
+	query       []param
+	body        string // "", "json" or "multipart"
+}
+
+type param struct {
+	name, typ string
+}
+
+// queryTypes are the schema types of the query parameters read by each
+// fiber.Ctx method
+var queryTypes = map[string]string{
+	"Query":      "string",
+	"QueryInt":   "integer",
+	"QueryBool":  "boolean",
+	"QueryFloat": "number",
+}
+
+func main() {
+	out := flag.String("o", "openapi_docs.go", "file to write")
+	pkg := flag.String("pkg", "api", "package of the written file")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatal("usage: openapidoc [-o file] [-pkg name] dir...")
+	}
+
+	docs := make(map[string]doc)
+	for _, dir := range flag.Args() {
+		if err := collect(dir, docs); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	source, err := render(*pkg, docs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, source, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// collect reads the handlers of the Go package in dir
+func collect(dir string, docs map[string]doc) error {
+	fset := token.NewFileSet()
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+		if err != nil {
+			return err
+		}
+
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || fn.Body == nil {
+				continue
+			}
+			ctx := contextParam(fn)
+			if ctx == "" {
+				continue
+			}
+
+			d := doc{}
+			if fn.Doc != nil {
+				d.summary, d.description = splitDoc(fn.Name.Name, fn.Doc.Text())
+			}
+			d.query, d.body = inspectBody(fn.Body, ctx)
+			docs[file.Name.Name+"."+receiver(fn)+"."+fn.Name.Name] = d
+		}
+	}
+	return nil
+}
+
+// contextParam returns the name of the *fiber.Ctx parameter of a handler,
+// or "" if fn isn't one
+func contextParam(fn *ast.FuncDecl) string {
+	params, results := fn.Type.Params.List, fn.Type.Results
+	if len(params) != 1 || len(params[0].Names) != 1 || results == nil || len(results.List) != 1 {
+		return ""
+	}
+	if ident, ok := results.List[0].Type.(*ast.Ident); !ok || ident.Name != "error" {
+		return ""
+	}
+	star, ok := params[0].Type.(*ast.StarExpr)
+	if !ok {
+		return ""
+	}
+	sel, ok := star.X.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Ctx" {
+		return ""
+	}
+	if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "fiber" {
+		return ""
+	}
+	return params[0].Names[0].Name
+}
+
+// receiver names the receiver type as runtime function names do: (*T) or T
+func receiver(fn *ast.FuncDecl) string {
+	switch t := fn.Recv.List[0].Type.(type) {
+	case *ast.StarExpr:
+		if ident, ok := t.X.(*ast.Ident); ok {
+			return "(*" + ident.Name + ")"
+		}
+	case *ast.Ident:
+		return t.Name
+	}
+	return "?"
+}
+
+// splitDoc turns a doc comment into a summary, its first sentence without
+// the function name, and a description, the whole comment if it says more
+func splitDoc(name, text string) (string, string) {
+	var paragraphs []string
+	for _, p := range strings.Split(strings.TrimSpace(text), "\n\n") {
+		paragraphs = append(paragraphs, strings.Join(strings.Fields(p), " "))
+	}
+	description := strings.Join(paragraphs, "\n\n")
+
+	summary := paragraphs[0]
+	if i := strings.Index(summary, ". "); i >= 0 {
+		summary = summary[:i]
+	}
+	// A comment repeated by mistake
+	if i := strings.Index(summary, " "+name+" "); i > 0 {
+		summary = summary[:i]
+	}
+	summary = strings.TrimSuffix(summary, ".")
+
+	// The summary says it all
+	if strings.TrimSuffix(description, ".") == summary || len(paragraphs) == 1 && !strings.Contains(paragraphs[0], ". ") {
+		description = ""
+	}
+	if rest, ok := strings.CutPrefix(summary, name+" "); ok && rest != "" {
+		r := []rune(rest)
+		r[0] = unicode.ToUpper(r[0])
+		summary = string(r)
+	}
+	return summary, description
+}
+
+// inspectBody finds the query parameters and request body a handler reads
+func inspectBody(body *ast.BlockStmt, ctx string) ([]param, string) {
+	var query []param
+	seen := make(map[string]bool)
+	kind := ""
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if ident, ok := sel.X.(*ast.Ident); !ok || ident.Name != ctx {
+			return true
+		}
+
+		method := sel.Sel.Name
+		switch {
+		case method == "BodyParser":
+			if kind == "" {
+				kind = "json"
+			}
+		case method == "MultipartForm" || method == "FormFile":
+			kind = "multipart"
+		case queryTypes[method] != "" && len(call.Args) > 0:
+			lit, ok := call.Args[0].(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
+			}
+			name, err := strconv.Unquote(lit.Value)
+			if err != nil || seen[name] {
+				return true
+			}
+			seen[name] = true
+			query = append(query, param{name: name, typ: queryTypes[method]})
+		}
+		return true
+	})
+	return query, kind
+}
+
+// render writes the collected documentation as Go source
+func render(pkg string, docs map[string]doc) ([]byte, error) {
+	names := make([]string, 0, len(docs))
+	for name := range docs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by openapidoc from the handlers' doc comments; DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	b.WriteString("// openAPIDocs documents the handlers of HTTP routes by function name\n")
+	b.WriteString("var openAPIDocs = map[string]openAPIDoc{\n")
+	for _, name := range names {
+		d := docs[name]
+		fmt.Fprintf(&b, "%q: {\n", name)
+		if d.summary != "" {
+			fmt.Fprintf(&b, "Summary: %q,\n", d.summary)
+		}
+		if d.description != "" {
+			fmt.Fprintf(&b, "Description: %q,\n", d.description)
+		}
+		if len(d.query) > 0 {
+			b.WriteString("Query: []openAPIParam{")
+			for i, p := range d.query {
+				if i > 0 {
+					b.WriteString(", ")
+				}
+				fmt.Fprintf(&b, "{%q, %q}", p.name, p.typ)
+			}
+			b.WriteString("},\n")
+		}
+		if d.body != "" {
+			fmt.Fprintf(&b, "Body: %q,\n", d.body)
+		}
+		b.WriteString("},\n")
+	}
+	b.WriteString("}\n")
+	return format.Source(b.Bytes())
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// commonMailDomains are widely used mail providers whose names are often
+// mistyped, suggested even if the user has never written to them
+var commonMailDomains = []string{
+	"gmail.com", "googlemail.com", "yahoo.com", "outlook.com", "hotmail.com", "live.com",
+	"icloud.com", "me.com", "aol.com", "proton.me", "protonmail.com", "gmx.com",
+	"yahoo.co.jp", "docomo.ne.jp", "ezweb.ne.jp", "au.com", "softbank.ne.jp", "i.softbank.jp",
+}
+
+// SuggestDomain returns the domain an address's domain was probably meant
+// to be: a known or common mail domain one typo away from it. known counts
+// how often the user corresponds with each domain; the most used of several
+// candidates wins. It returns "" if the domain looks intended.
+func SuggestDomain(domain string, known map[string]int) string {
+	domain = strings.ToLower(domain)
+	if known[domain] > 0 {
+		return ""
+	}
+	for _, common := range commonMailDomains {
+		if domain == common {
+			return ""
+		}
+	}
+
+	best, bestCount := "", 0
+	consider := func(candidate string, count int) {
+		if candidate != domain && count > bestCount && isTypo(domain, candidate) {
+			best, bestCount = candidate, count
+		}
+	}
+	for candidate, count := range known {
+		consider(candidate, count)
+	}
+	if best == "" {
+		for _, common := range commonMailDomains {
+			consider(common, 1)
+		}
+	}
+	return best
+}
+
+// isTypo reports whether a differs from b by a single typing mistake: one
+// character added, dropped or changed, or two neighbors swapped
+func isTypo(a, b string) bool {
+	// Short domains are too often one edit apart by chance
+	if len(b) < 6 {
+		return false
+	}
+	if editDistance(a, b) == 1 {
+		return true
+	}
+
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) != len(rb) {
+		return false
+	}
+	for i := 0; i < len(ra)-1; i++ {
+		if ra[i] != rb[i] {
+			return ra[i] == rb[i+1] && ra[i+1] == rb[i] && string(ra[i+2:]) == string(rb[i+2:])
+		}
+	}
+	return false
+}
+
+// ErrNoMailServer means a domain can't receive mail
+var ErrNoMailServer = errors.New("domain has no mail server")
+
+// CheckMailServer looks up whether a domain can receive mail: it has MX
+// records, or failing that an address record (RFC 5321 implicit MX). A
+// null MX (RFC 7505) or a domain that doesn't exist gives ErrNoMailServer;
+// other errors mean the lookup itself failed.
+func CheckMailServer(ctx context.Context, domain string) error {
+	mxs, err := net.DefaultResolver.LookupMX(ctx, domain)
+	if err == nil && len(mxs) > 0 {
+		if len(mxs) == 1 && mxs[0].Host == "." {
+			return ErrNoMailServer
+		}
+		return nil
+	}
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	if _, err := net.DefaultResolver.LookupHost(ctx, domain); err != nil {
+		if isNotFound(err) {
+			return ErrNoMailServer
+		}
+		return err
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
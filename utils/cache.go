@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 // ss
@@ -59,3 +61,40 @@ func ClearCache(filePath string) error {
 	}
 	return nil
 }
+
+// folderListTTL is how long a folder list is kept in a cache shared by
+// instances; each sign in stores it again
+const folderListTTL = 24 * time.Hour
+
+// SaveFolderList caches the folder list of a user in their cache folder
+// and, when instances share GlobalCache, in it too
+func SaveFolderList(userCacheFolder string, folders interface{}) error {
+	if _, local := GlobalCache.(*MemoryCache); !local {
+		GlobalCache.Set(folderListKey(userCacheFolder), folders, folderListTTL)
+	}
+	return SaveCache(filepath.Join(userCacheFolder, "folders.json"), folders)
+}
+
+// LoadFolderList loads a folder list saved by SaveFolderList. The shared
+// copy comes first, as the user may have signed in on another instance.
+func LoadFolderList(userCacheFolder string, folders interface{}) error {
+	if _, local := GlobalCache.(*MemoryCache); !local {
+		if value, ok := GlobalCache.Get(folderListKey(userCacheFolder)); ok {
+			if data, err := json.Marshal(value); err == nil && json.Unmarshal(data, folders) == nil {
+				return nil
+			}
+		}
+	}
+	return LoadCache(filepath.Join(userCacheFolder, "folders.json"), folders)
+}
+
+// ClearFolderList removes the shared copy of a user's folder list
+func ClearFolderList(userCacheFolder string) {
+	if _, local := GlobalCache.(*MemoryCache); !local {
+		GlobalCache.Delete(folderListKey(userCacheFolder))
+	}
+}
+
+func folderListKey(userCacheFolder string) string {
+	return "folders:" + filepath.Base(userCacheFolder)
+}
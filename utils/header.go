@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// CharsetReader converts text in the named charset, like ISO-2022-JP or
+// Windows-1252, to UTF-8
+func CharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: CharsetReader}
+
+// DecodeHeader decodes RFC 2047 encoded-words such as =?UTF-8?B?...?= in a
+// header value. Values that can't be decoded are returned unchanged.
+func DecodeHeader(value string) string {
+	if !strings.Contains(value, "=?") {
+		return value
+	}
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
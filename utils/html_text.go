@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// blankLines matches the runs of empty lines HTMLToText squeezes to one
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// blockElements start on a line of their own
+var blockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "hr": true, "pre": true, "blockquote": true,
+	"ul": true, "ol": true, "li": true, "table": true, "tr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// HTMLToText renders HTML as readable plain text, for the text/plain part
+// of an email. Paragraphs and line breaks are kept, lists get bullets or
+// numbers, quotes are marked with "> " and links become numbered
+// footnotes.
+func HTMLToText(body string) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return body
+	}
+
+	t := &textConverter{}
+	text := t.children(doc, false)
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	text = strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+
+	if len(t.links) > 0 {
+		var notes strings.Builder
+		for i, link := range t.links {
+			fmt.Fprintf(&notes, "\n[%d] %s", i+1, link)
+		}
+		text += "\n\n" + notes.String()[1:]
+	}
+	return text
+}
+
+// textConverter collects the links of the document being converted
+type textConverter struct {
+	links []string
+}
+
+// children renders the children of n; pre keeps their whitespace
+func (t *textConverter) children(n *html.Node, pre bool) string {
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		t.node(&b, child, pre)
+	}
+	return b.String()
+}
+
+func (t *textConverter) node(b *strings.Builder, n *html.Node, pre bool) {
+	switch n.Type {
+	case html.TextNode:
+		if pre {
+			b.WriteString(n.Data)
+			return
+		}
+		text := strings.Join(strings.Fields(n.Data), " ")
+		if text == "" {
+			// Whitespace between blocks is layout, not text
+			if betweenBlocks(n) {
+				return
+			}
+			text = " "
+		} else {
+			if n.Data[0] == ' ' || n.Data[0] == '\n' || n.Data[0] == '\t' {
+				text = " " + text
+			}
+			if last := n.Data[len(n.Data)-1]; last == ' ' || last == '\n' || last == '\t' {
+				text += " "
+			}
+		}
+		if s := b.String(); s == "" || strings.HasSuffix(s, "\n") {
+			text = strings.TrimLeft(text, " ")
+		}
+		b.WriteString(text)
+		return
+	case html.ElementNode:
+	default:
+		b.WriteString(t.children(n, pre))
+		return
+	}
+
+	switch n.Data {
+	case "script", "style", "head", "title":
+	case "br":
+		b.WriteString("\n")
+	case "hr":
+		writeBlock(b, "----------", true)
+	case "p", "div", "tr":
+		writeBlock(b, strings.Trim(t.children(n, pre), " "), false)
+	case "h1", "h2", "h3", "h4", "h5", "h6", "table":
+		writeBlock(b, strings.Trim(t.children(n, pre), " "), true)
+	case "pre":
+		writeBlock(b, strings.Trim(t.children(n, true), "\n"), true)
+	case "blockquote":
+		writeBlock(b, prefixLines(strings.TrimSpace(t.children(n, pre)), "> ", "> "), true)
+	case "ul", "ol":
+		// Nested lists sit right under their item
+		writeBlock(b, t.list(n, pre), n.Parent == nil || n.Parent.Data != "li")
+	case "td", "th":
+		b.WriteString(strings.TrimSpace(t.children(n, pre)) + "  ")
+	case "img":
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			b.WriteString("[" + alt + "]")
+		}
+	case "a":
+		text := t.children(n, pre)
+		href := attr(n, "href")
+		label := strings.TrimSpace(text)
+		if href != "" && label != href && "mailto:"+label != href && !strings.HasPrefix(href, "#") {
+			t.links = append(t.links, href)
+			trailing := ""
+			if strings.HasSuffix(text, " ") {
+				trailing = " "
+			}
+			text = strings.TrimRight(text, " ") + fmt.Sprintf("[%d]", len(t.links)) + trailing
+		}
+		b.WriteString(text)
+	default:
+		b.WriteString(t.children(n, pre))
+	}
+}
+
+// list renders the items of a list, bulleted or numbered
+func (t *textConverter) list(n *html.Node, pre bool) string {
+	var items []string
+	number := 1
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode || child.Data != "li" {
+			continue
+		}
+		marker := "* "
+		if n.Data == "ol" {
+			marker = fmt.Sprintf("%d. ", number)
+			number++
+		}
+		item := strings.TrimSpace(blankLines.ReplaceAllString(t.children(child, pre), "\n\n"))
+		items = append(items, prefixLines(item, marker, strings.Repeat(" ", len(marker))))
+	}
+	return strings.Join(items, "\n")
+}
+
+// writeBlock writes s on lines of its own, with blank lines around it if
+// spaced
+func writeBlock(b *strings.Builder, s string, spaced bool) {
+	newlines := 1
+	if spaced {
+		newlines = 2
+	}
+	endLines(b, newlines)
+	b.WriteString(s)
+	endLines(b, newlines)
+}
+
+// endLines ends what has been written with at least n newlines
+func endLines(b *strings.Builder, n int) {
+	written := b.String()
+	if written == "" {
+		return
+	}
+	for have := len(written) - len(strings.TrimRight(written, "\n")); have < n; have++ {
+		b.WriteString("\n")
+	}
+}
+
+// prefixLines puts first before the first line of s and rest before the
+// others
+func prefixLines(s, first, rest string) string {
+	lines := strings.Split(s, "\n")
+	for i := range lines {
+		if i == 0 {
+			lines[i] = first + lines[i]
+		} else {
+			lines[i] = rest + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// betweenBlocks reports whether a text node sits next to a block element
+func betweenBlocks(n *html.Node) bool {
+	for _, sibling := range []*html.Node{n.PrevSibling, n.NextSibling} {
+		if sibling == nil || (sibling.Type == html.ElementNode && blockElements[sibling.Data]) {
+			return true
+		}
+	}
+	return false
+}
+
+// attr returns the value of an element's attribute
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -1,9 +1,19 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
 	"github.com/BurntSushi/toml"
 	"github.com/nicksnyder/go-i18n/v2/i18n"
 	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+	"golang.org/x/text/message"
 )
 
 var (
@@ -11,23 +21,87 @@ var (
 	Bundle *i18n.Bundle
 	// Localizer is the default localizer
 	Localizer *i18n.Localizer
+
+	// catalogs holds the messages of each language for the browser
+	catalogs = make(map[string]*Catalog)
 )
 
-// InitI18n initializes the i18n system
+// Catalog is every message of a language as JSON, for client-side
+// translations, with the validators of HTTP caching
+type Catalog struct {
+	JSON         []byte
+	ETag         string
+	LastModified time.Time
+}
+
+// LanguageOption is a language users can pick, named in itself
+type LanguageOption struct {
+	Code string
+	Name string
+}
+
+// InitI18n initializes the i18n system, registering a language for every
+// locales/active.<lang>.toml file
 func InitI18n() error {
 	Bundle = i18n.NewBundle(language.English)
 	Bundle.RegisterUnmarshalFunc("toml", toml.Unmarshal)
 
-	// Load English locale file
-	_, err := Bundle.LoadMessageFile("locales/active.en.toml")
+	paths, err := filepath.Glob("locales/active.*.toml")
 	if err != nil {
-		Log.Warn("Failed to load English locale: %v", err)
+		return err
 	}
 
-	// Load Japanese locale file
-	_, err = Bundle.LoadMessageFile("locales/active.ja.toml")
-	if err != nil {
-		Log.Warn("Failed to load Japanese locale: %v", err)
+	messages := make(map[string]map[string]string)
+	modified := make(map[string]time.Time)
+	for _, path := range paths {
+		file, err := Bundle.LoadMessageFile(path)
+		if err != nil {
+			Log.Warn("Failed to load locale %s: %v", path, err)
+			continue
+		}
+
+		lang := file.Tag.String()
+		if messages[lang] == nil {
+			messages[lang] = make(map[string]string)
+		}
+		for _, m := range file.Messages {
+			text := m.Other
+			if text == "" {
+				text = m.One
+			}
+			messages[lang][m.ID] = text
+		}
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(modified[lang]) {
+			modified[lang] = info.ModTime()
+		}
+	}
+
+	// Catalogs fall back to English for messages not translated yet, as
+	// the server side does
+	english := language.English.String()
+	for lang, translated := range messages {
+		merged := make(map[string]string, len(messages[english]))
+		for id, text := range messages[english] {
+			merged[id] = text
+		}
+		for id, text := range translated {
+			merged[id] = text
+		}
+
+		data, err := json.Marshal(merged)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		lastModified := modified[lang]
+		if modified[english].After(lastModified) {
+			lastModified = modified[english]
+		}
+		catalogs[lang] = &Catalog{
+			JSON:         data,
+			ETag:         `"` + hex.EncodeToString(sum[:8]) + `"`,
+			LastModified: lastModified,
+		}
 	}
 
 	// Set default localizer to English
@@ -45,6 +119,49 @@ func GetLocalizer(lang string) *i18n.Localizer {
 	return i18n.NewLocalizer(Bundle, lang)
 }
 
+// SupportedLanguage returns the registered language matching lang, either
+// exactly or by its base language as "ja" for "ja-JP", or "" if none does
+func SupportedLanguage(lang string) string {
+	tag, err := language.Parse(lang)
+	if err != nil || Bundle == nil {
+		return ""
+	}
+
+	base, _ := tag.Base()
+	match := ""
+	for _, registered := range Bundle.LanguageTags() {
+		if registered == tag {
+			return registered.String()
+		}
+		if registeredBase, _ := registered.Base(); registeredBase == base && match == "" {
+			match = registered.String()
+		}
+	}
+	return match
+}
+
+// Languages lists the registered languages, named in themselves
+func Languages() []LanguageOption {
+	if Bundle == nil {
+		return nil
+	}
+
+	var options []LanguageOption
+	for _, tag := range Bundle.LanguageTags() {
+		options = append(options, LanguageOption{Code: tag.String(), Name: display.Self.Name(tag)})
+	}
+	sort.Slice(options, func(i, j int) bool {
+		return options[i].Code < options[j].Code
+	})
+	return options
+}
+
+// GetCatalog returns the catalog of a registered language
+func GetCatalog(lang string) (*Catalog, bool) {
+	catalog, ok := catalogs[lang]
+	return catalog, ok
+}
+
 // T translates a message ID
 func T(localizer *i18n.Localizer, messageID string) string {
 	msg, err := localizer.Localize(&i18n.LocalizeConfig{
@@ -85,3 +202,40 @@ func TPlural(localizer *i18n.Localizer, messageID string, count int) string {
 	}
 	return msg
 }
+
+// FormatDateLocalized formats t for lang in the given time zone. Dates within
+// the last week are relative ("2 hours ago"); older ones use the locale's
+// date_format layout.
+func FormatDateLocalized(t time.Time, lang, timezone string) string {
+	localizer := GetLocalizer(lang)
+	t = InTimezone(t, timezone)
+
+	elapsed := time.Since(t)
+	switch {
+	case elapsed < 0:
+		// Clock skew or a future Date header; fall through to the full date
+	case elapsed < time.Minute:
+		return T(localizer, "time_just_now")
+	case elapsed < time.Hour:
+		return TPlural(localizer, "time_minutes_ago", int(elapsed/time.Minute))
+	case elapsed < 24*time.Hour:
+		return TPlural(localizer, "time_hours_ago", int(elapsed/time.Hour))
+	case elapsed < 7*24*time.Hour:
+		return TPlural(localizer, "time_days_ago", int(elapsed/(24*time.Hour)))
+	}
+
+	layout := T(localizer, "date_format")
+	if layout == "date_format" {
+		layout = "Jan 02, 2006 15:04"
+	}
+	return t.Format(layout)
+}
+
+// FormatNumberLocalized formats n with the digit grouping of lang
+func FormatNumberLocalized(n int, lang string) string {
+	tag, err := language.Parse(lang)
+	if err != nil {
+		tag = language.English
+	}
+	return message.NewPrinter(tag).Sprintf("%d", n)
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -81,6 +83,7 @@ func (l *Logger) formatMessage(level LogLevel, format string, v ...interface{})
 func (l *Logger) Debug(format string, v ...interface{}) {
 	if l.shouldLog(DEBUG) {
 		l.Println(l.formatMessage(DEBUG, format, v...))
+		recentLogs.add(l.entry(DEBUG, format, v...))
 	}
 }
 
@@ -88,6 +91,7 @@ func (l *Logger) Debug(format string, v ...interface{}) {
 func (l *Logger) Info(format string, v ...interface{}) {
 	if l.shouldLog(INFO) {
 		l.Println(l.formatMessage(INFO, format, v...))
+		recentLogs.add(l.entry(INFO, format, v...))
 	}
 }
 
@@ -95,14 +99,32 @@ func (l *Logger) Info(format string, v ...interface{}) {
 func (l *Logger) Warn(format string, v ...interface{}) {
 	if l.shouldLog(WARN) {
 		l.Println(l.formatMessage(WARN, format, v...))
+		recentLogs.add(l.entry(WARN, format, v...))
 	}
 }
 
 // Error logs an error message
 func (l *Logger) Error(format string, v ...interface{}) {
+	entry := l.entry(ERROR, format, v...)
 	if l.shouldLog(ERROR) {
 		l.Println(l.formatMessage(ERROR, format, v...))
+		recentLogs.add(entry)
 	}
+	recentErrors.add(entry)
+}
+
+// entry builds the in-memory copy of a log message. A "user" field set
+// with WithField is kept so logs can be filtered by user.
+func (l *Logger) entry(level LogLevel, format string, v ...interface{}) LogEntry {
+	entry := LogEntry{
+		Time:    time.Now(),
+		Level:   level.String(),
+		Message: fmt.Sprintf(format, v...),
+	}
+	if user, ok := l.fields["user"]; ok {
+		entry.User = fmt.Sprint(user)
+	}
+	return entry
 }
 
 // WithFields returns a new logger with the specified fields
@@ -136,5 +158,108 @@ func (l *Logger) SetLevel(level LogLevel) {
 	l.level = level
 }
 
+// LogEntry is a logged message kept in memory for the admin pages
+type LogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	User    string    `json:"user,omitempty"`
+}
+
+// recentErrorsSize is how many errors RecentErrors remembers
+const recentErrorsSize = 50
+
+// recentLogsSize is how many messages of any level QueryLogs can search
+const recentLogsSize = 2000
+
+// logRing keeps the last few entries
+type logRing struct {
+	mu      sync.Mutex
+	size    int
+	entries []LogEntry
+}
+
+var (
+	recentErrors = &logRing{size: recentErrorsSize}
+	recentLogs   = &logRing{size: recentLogsSize}
+)
+
+func (r *logRing) add(entry LogEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries = append(r.entries, entry)
+	if len(r.entries) > r.size {
+		r.entries = r.entries[len(r.entries)-r.size:]
+	}
+}
+
+// RecentErrors returns the last errors logged, newest first
+func RecentErrors() []LogEntry {
+	recentErrors.mu.Lock()
+	defer recentErrors.mu.Unlock()
+
+	entries := make([]LogEntry, len(recentErrors.entries))
+	for i, entry := range recentErrors.entries {
+		entries[len(entries)-1-i] = entry
+	}
+	return entries
+}
+
+// LogFilter selects log entries for QueryLogs. Zero values match anything.
+type LogFilter struct {
+	Level string // Minimum level, e.g. "WARN"
+	User  string
+	Since time.Time
+	Until time.Time
+}
+
+// ParseLogLevel returns the level with the given name
+func ParseLogLevel(name string) (LogLevel, bool) {
+	for _, level := range []LogLevel{DEBUG, INFO, WARN, ERROR} {
+		if strings.EqualFold(level.String(), name) {
+			return level, true
+		}
+	}
+	return DEBUG, false
+}
+
+// QueryLogs returns the page of recent log entries matching filter, newest
+// first, and how many entries matched in total
+func QueryLogs(filter LogFilter, offset, limit int) ([]LogEntry, int) {
+	minLevel, _ := ParseLogLevel(filter.Level)
+
+	recentLogs.mu.Lock()
+	defer recentLogs.mu.Unlock()
+
+	matched := []LogEntry{}
+	for i := len(recentLogs.entries) - 1; i >= 0; i-- {
+		entry := recentLogs.entries[i]
+		if level, _ := ParseLogLevel(entry.Level); level < minLevel {
+			continue
+		}
+		if filter.User != "" && entry.User != filter.User {
+			continue
+		}
+		if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && entry.Time.After(filter.Until) {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+
+	total := len(matched)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return matched[offset:end], total
+}
+
 // Global logger instance
 var Log = NewLogger(INFO)
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// maxMailtoLength caps the length of a mailto URL we will parse
+const maxMailtoLength = 16 * 1024
+
+// ErrInvalidMailto means a URL is not a mailto: link
+var ErrInvalidMailto = errors.New("not a mailto link")
+
+// MailtoLink holds the fields of a mailto: URL that prefill a message
+type MailtoLink struct {
+	To      []string
+	Cc      []string
+	Bcc     []string
+	Subject string
+	Body    string
+}
+
+// ParseMailto parses a mailto: URL (RFC 6068). Addresses may come from the
+// path and repeated to, cc and bcc fields; other header fields are ignored,
+// since a link must not be able to set arbitrary headers. Unlike a form
+// query, "+" is a literal plus sign.
+func ParseMailto(raw string) (*MailtoLink, error) {
+	raw = strings.TrimSpace(raw)
+	if len(raw) > maxMailtoLength {
+		return nil, ErrInvalidMailto
+	}
+	scheme, rest, ok := strings.Cut(raw, ":")
+	if !ok || !strings.EqualFold(scheme, "mailto") {
+		return nil, ErrInvalidMailto
+	}
+
+	path, query, _ := strings.Cut(rest, "?")
+	to, err := url.PathUnescape(path)
+	if err != nil {
+		return nil, ErrInvalidMailto
+	}
+
+	link := &MailtoLink{To: mailtoAddresses(to)}
+	if query == "" {
+		return link, nil
+	}
+
+	for _, field := range strings.Split(query, "&") {
+		name, value, _ := strings.Cut(field, "=")
+		name, err := url.PathUnescape(name)
+		if err != nil {
+			return nil, ErrInvalidMailto
+		}
+		value, err = url.PathUnescape(value)
+		if err != nil {
+			return nil, ErrInvalidMailto
+		}
+
+		switch strings.ToLower(name) {
+		case "to":
+			link.To = append(link.To, mailtoAddresses(value)...)
+		case "cc":
+			link.Cc = append(link.Cc, mailtoAddresses(value)...)
+		case "bcc":
+			link.Bcc = append(link.Bcc, mailtoAddresses(value)...)
+		case "subject":
+			link.Subject = strings.Join(strings.Fields(value), " ")
+		case "body":
+			link.Body = strings.ReplaceAll(value, "\r\n", "\n")
+		}
+	}
+
+	return link, nil
+}
+
+// mailtoAddresses splits a comma separated mailto address list
+func mailtoAddresses(list string) []string {
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
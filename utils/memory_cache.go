@@ -8,6 +8,15 @@ import (
 	"time"
 )
 
+// Cache stores values with an expiration. MemoryCache keeps them in this
+// process; RedisCache shares them between instances, handing values back
+// as decoded JSON rather than the types they were set with.
+type Cache interface {
+	Set(key string, value interface{}, ttl time.Duration)
+	Get(key string) (interface{}, bool)
+	Delete(key string)
+}
+
 // CacheItem represents a cached item with expiration
 type CacheItem struct {
 	Value      interface{} `json:"value"`
@@ -202,5 +211,5 @@ func (c *MemoryCache) deleteFromDisk(key string) {
 	os.Remove(filePath)
 }
 
-// Global cache instance
-var GlobalCache = NewMemoryCache("./cache/data")
+// Global cache instance, replaced by a RedisCache when Redis is configured
+var GlobalCache Cache = NewMemoryCache("./cache/data")
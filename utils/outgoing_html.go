@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"golang.org/x/net/html"
+)
+
+// OutgoingPolicy is what composed HTML may keep when it is sent. Scripts,
+// style sheets, forms and embedded content are dropped, since mail clients
+// block or mangle them, and styles are kept to those clients render.
+var OutgoingPolicy *bluemonday.Policy
+
+func init() {
+	OutgoingPolicy = bluemonday.UGCPolicy()
+
+	OutgoingPolicy.AllowElements("p", "br", "div", "span", "h1", "h2", "h3", "h4", "h5", "h6", "hr")
+	OutgoingPolicy.AllowElements("strong", "b", "em", "i", "u", "s", "strike", "sub", "sup", "code", "pre")
+	OutgoingPolicy.AllowElements("ul", "ol", "li", "blockquote", "a", "img")
+	OutgoingPolicy.AllowElements("table", "thead", "tbody", "tfoot", "tr", "th", "td")
+
+	OutgoingPolicy.AllowAttrs("href", "title").OnElements("a")
+	OutgoingPolicy.AllowAttrs("src", "alt", "title", "width", "height").OnElements("img")
+	OutgoingPolicy.AllowAttrs("colspan", "rowspan").OnElements("td", "th")
+	OutgoingPolicy.AllowStyles("color", "background-color", "font-family", "font-size", "font-weight",
+		"font-style", "text-decoration", "text-align", "padding", "padding-left", "margin", "margin-left",
+		"border", "border-left", "border-collapse", "white-space", "direction", "width", "max-width", "height").Globally()
+
+	// Images pasted into the editor are inline data URIs
+	OutgoingPolicy.AllowDataURIImages()
+	OutgoingPolicy.RequireParseableURLs(true)
+	OutgoingPolicy.AllowURLSchemes("http", "https", "mailto", "cid")
+}
+
+// editorClassStyles are the inline styles of the classes the editor marks
+// formatting with, which recipients don't have the style sheet for
+var editorClassStyles = map[string]string{
+	"ql-align-center":   "text-align: center",
+	"ql-align-right":    "text-align: right",
+	"ql-align-justify":  "text-align: justify",
+	"ql-size-small":     "font-size: 0.75em",
+	"ql-size-large":     "font-size: 1.5em",
+	"ql-size-huge":      "font-size: 2.5em",
+	"ql-font-serif":     "font-family: Georgia, 'Times New Roman', serif",
+	"ql-font-monospace": "font-family: Monaco, 'Courier New', monospace",
+	"ql-direction-rtl":  "direction: rtl",
+	"ql-syntax":         "background-color: #f5f5f5; padding: 8px; white-space: pre-wrap; font-family: monospace",
+}
+
+// elementStyles are the styles elements get when they have none, so they
+// look the same in clients with odd defaults
+var elementStyles = map[string]string{
+	"blockquote": "margin: 0 0 0 0.8ex; border-left: 1px solid #ccc; padding-left: 1ex",
+	"pre":        "background-color: #f5f5f5; padding: 8px; white-space: pre-wrap; font-family: monospace",
+	"img":        "max-width: 100%",
+}
+
+// PrepareOutgoingHTML turns HTML from the compose editor into a complete
+// document fit to send: unclosed tags are closed, the editor's classes
+// become inline styles and anything mail clients can't take is removed.
+func PrepareOutgoingHTML(body string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse HTML: %w", err)
+	}
+	inlineEditorStyles(doc)
+
+	var buf bytes.Buffer
+	if content := findElement(doc, "body"); content != nil {
+		for child := content.FirstChild; child != nil; child = child.NextSibling {
+			if err := html.Render(&buf, child); err != nil {
+				return "", fmt.Errorf("failed to render HTML: %w", err)
+			}
+		}
+	}
+
+	return "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"></head><body>" +
+		OutgoingPolicy.Sanitize(buf.String()) + "</body></html>", nil
+}
+
+// inlineEditorStyles replaces editor classes under n with inline styles
+func inlineEditorStyles(n *html.Node) {
+	if n.Type == html.ElementNode {
+		var styles []string
+		attrs := n.Attr[:0]
+		style := ""
+		for _, attr := range n.Attr {
+			switch attr.Key {
+			case "class":
+				for _, class := range strings.Fields(attr.Val) {
+					if s, ok := editorClassStyles[class]; ok {
+						styles = append(styles, s)
+					} else if level, ok := strings.CutPrefix(class, "ql-indent-"); ok {
+						styles = append(styles, "padding-left: "+indentEm(level))
+					}
+				}
+			case "style":
+				style = attr.Val
+			default:
+				attrs = append(attrs, attr)
+			}
+		}
+		if style == "" && len(styles) == 0 {
+			style = elementStyles[n.Data]
+		}
+		if style != "" {
+			styles = append([]string{strings.TrimSuffix(strings.TrimSpace(style), ";")}, styles...)
+		}
+		if len(styles) > 0 {
+			attrs = append(attrs, html.Attribute{Key: "style", Val: strings.Join(styles, "; ")})
+		}
+		n.Attr = attrs
+	}
+
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		inlineEditorStyles(child)
+	}
+}
+
+// indentEm is the padding of an editor indent level
+func indentEm(level string) string {
+	switch level {
+	case "1", "2", "3", "4", "5", "6", "7", "8":
+		return fmt.Sprintf("%dem", 3*int(level[0]-'0'))
+	}
+	return "0"
+}
+
+// findElement returns the first element named tag in n
+func findElement(n *html.Node, tag string) *html.Node {
+	if n.Type == html.ElementNode && n.Data == tag {
+		return n
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if found := findElement(child, tag); found != nil {
+			return found
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pdfConverters are the headless browsers, in order of preference, that
+// can print an HTML page to PDF
+var pdfConverters = []string{"chromium", "chromium-browser", "google-chrome"}
+
+// pdfTimeout bounds the time a conversion may take
+const pdfTimeout = 30 * time.Second
+
+// ErrNoPDFConverter means no headless browser is installed to render PDFs
+var ErrNoPDFConverter = errors.New("no PDF converter is installed")
+
+// HTMLToPDF prints a standalone HTML page to PDF with a headless browser.
+// The page is loaded from a file, so it must not depend on anything it
+// would have to fetch.
+func HTMLToPDF(page []byte) ([]byte, error) {
+	var converter string
+	for _, name := range pdfConverters {
+		if path, err := exec.LookPath(name); err == nil {
+			converter = path
+			break
+		}
+	}
+	if converter == "" {
+		return nil, ErrNoPDFConverter
+	}
+
+	dir, err := os.MkdirTemp("", "lilmail-pdf-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "page.html")
+	if err := os.WriteFile(input, page, 0600); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pdfTimeout)
+	defer cancel()
+
+	output := filepath.Join(dir, "page.pdf")
+	cmd := exec.CommandContext(ctx, converter,
+		"--headless", "--disable-gpu", "--no-pdf-header-footer",
+		"--user-data-dir="+filepath.Join(dir, "profile"),
+		"--print-to-pdf="+output,
+		"file://"+input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %v: %s", filepath.Base(converter), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return os.ReadFile(output)
+}
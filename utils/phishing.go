@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"fmt"
+	"lilmail/models"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/idna"
+)
+
+// Kinds of phishing warnings
+const (
+	WarningDisplayName = "display_name" // Display name names another domain
+	WarningLookalike   = "lookalike"    // Sender domain imitates a contact's
+	WarningLinkText    = "link_text"    // Link text shows another domain than it opens
+	WarningReplyTo     = "reply_to"     // Replies go to another domain
+)
+
+// maxLinkWarnings caps the mismatched links reported for one message
+const maxLinkWarnings = 3
+
+// PhishingWarning is a sign a message may be spoofed or phishing
+type PhishingWarning struct {
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+// domainPattern matches things that look like a domain name in text
+var domainPattern = regexp.MustCompile(`(?i)\b(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}\b`)
+
+// confusables maps characters often swapped in look-alike domains to the
+// letter they imitate
+var confusables = strings.NewReplacer(
+	"rn", "m", "vv", "w", "0", "o", "1", "l", "5", "s", "3", "e",
+	"а", "a", "е", "e", "о", "o", "р", "p", "с", "c", "х", "x", "у", "y", "і", "i", "ӏ", "l",
+)
+
+// CheckPhishing looks for signs of spoofing in a message: a display name
+// naming another domain, a sender domain imitating one of the contactDomains,
+// links whose text shows another domain than they open, and a Reply-To on
+// another domain than From. htmlBody is the message's sanitized HTML.
+func CheckPhishing(email models.Email, htmlBody string, contactDomains map[string]bool) []PhishingWarning {
+	var warnings []PhishingWarning
+
+	fromDomain := addressDomain(email.From)
+	if fromDomain == "" {
+		return nil
+	}
+
+	// "PayPal Support <someone@example.net>" style display names
+	for _, named := range domainPattern.FindAllString(email.FromName, -1) {
+		named = strings.ToLower(named)
+		if !relatedDomains(named, fromDomain) {
+			warnings = append(warnings, PhishingWarning{
+				Kind:   WarningDisplayName,
+				Detail: fmt.Sprintf("The sender's name mentions %s, but the message is from %s", named, fromDomain),
+			})
+			break
+		}
+	}
+
+	if !contactDomains[fromDomain] {
+		for contact := range contactDomains {
+			if looksAlike(fromDomain, contact) {
+				warnings = append(warnings, PhishingWarning{
+					Kind:   WarningLookalike,
+					Detail: fmt.Sprintf("%s looks like %s, which you correspond with", displayDomain(fromDomain), contact),
+				})
+				break
+			}
+		}
+	}
+
+	if replyDomain := addressDomain(email.ReplyTo); replyDomain != "" && !relatedDomains(replyDomain, fromDomain) {
+		warnings = append(warnings, PhishingWarning{
+			Kind:   WarningReplyTo,
+			Detail: fmt.Sprintf("Replies go to %s instead of the sender %s", email.ReplyTo, email.From),
+		})
+	}
+
+	for i, link := range mismatchedLinks(htmlBody) {
+		if i == maxLinkWarnings {
+			break
+		}
+		warnings = append(warnings, link)
+	}
+
+	return warnings
+}
+
+// addressDomain returns the lowercased domain of an email address
+func addressDomain(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(address[at+1:])), ">")
+}
+
+// relatedDomains reports whether two domains are the same or one is a
+// subdomain of the other
+func relatedDomains(a, b string) bool {
+	a = strings.TrimPrefix(a, "www.")
+	b = strings.TrimPrefix(b, "www.")
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+// displayDomain shows punycode domains in the characters they render as
+func displayDomain(domain string) string {
+	if unicode, err := idna.ToUnicode(domain); err == nil && unicode != domain {
+		return fmt.Sprintf("%s (%s)", unicode, domain)
+	}
+	return domain
+}
+
+// looksAlike reports whether a domain imitates another: they read the same
+// once confusable characters are swapped, or differ by a single edit
+func looksAlike(domain, contact string) bool {
+	if relatedDomains(domain, contact) {
+		return false
+	}
+	if unicode, err := idna.ToUnicode(domain); err == nil {
+		domain = unicode
+	}
+	if confusables.Replace(domain) == confusables.Replace(contact) {
+		return true
+	}
+	// Short domains are too often one edit apart by chance
+	return len(contact) >= 6 && editDistance(domain, contact) == 1
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// mismatchedLinks finds links whose text is a URL or domain other than the
+// one the link opens
+func mismatchedLinks(htmlBody string) []PhishingWarning {
+	var warnings []PhishingWarning
+
+	var href string
+	var text strings.Builder
+	inLink := false
+
+	z := html.NewTokenizer(strings.NewReader(htmlBody))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		token := z.Token()
+
+		switch {
+		case tt == html.StartTagToken && token.Data == "a":
+			inLink = true
+			href = ""
+			text.Reset()
+			for _, attr := range token.Attr {
+				if attr.Key == "href" {
+					href = attr.Val
+				}
+			}
+		case tt == html.TextToken && inLink:
+			text.WriteString(token.Data)
+		case tt == html.EndTagToken && token.Data == "a" && inLink:
+			inLink = false
+			if warning, ok := linkMismatch(strings.TrimSpace(text.String()), href); ok {
+				warnings = append(warnings, warning)
+			}
+		}
+	}
+
+	return warnings
+}
+
+func linkMismatch(text, href string) (PhishingWarning, bool) {
+	target, err := url.Parse(href)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+		return PhishingWarning{}, false
+	}
+
+	// Only link text that is itself a URL or domain claims a destination
+	shown := text
+	if strings.ContainsAny(shown, " \t\n") {
+		return PhishingWarning{}, false
+	}
+	if !strings.Contains(shown, "://") {
+		shown = "https://" + shown
+	}
+	shownURL, err := url.Parse(shown)
+	if err != nil || !domainPattern.MatchString(shownURL.Hostname()) {
+		return PhishingWarning{}, false
+	}
+
+	shownHost := strings.ToLower(shownURL.Hostname())
+	targetHost := strings.ToLower(target.Hostname())
+	if relatedDomains(shownHost, targetHost) {
+		return PhishingWarning{}, false
+	}
+
+	return PhishingWarning{
+		Kind:   WarningLinkText,
+		Detail: fmt.Sprintf("A link showing %s opens %s", shownHost, displayDomain(targetHost)),
+	}, true
+}
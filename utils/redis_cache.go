@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// RedisCache is a Cache kept in Redis, shared by every instance using the
+// same server and prefix. Values are stored as JSON. Failures of Redis are
+// logged and treated as misses, so the app keeps working without it.
+type RedisCache struct {
+	client *RedisClient
+	prefix string
+}
+
+// NewRedisCache creates a cache storing its keys under prefix
+func NewRedisCache(client *RedisClient, prefix string) *RedisCache {
+	return &RedisCache{client: client, prefix: prefix + "cache:"}
+}
+
+// Set stores a value in cache with expiration
+func (c *RedisCache) Set(key string, value interface{}, ttl time.Duration) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		Log.Error("Failed to encode cache entry %s: %v", key, err)
+		return
+	}
+
+	args := []string{"SET", c.prefix + key, string(data)}
+	if ms := ttl.Milliseconds(); ms > 0 {
+		args = append(args, "PX", strconv.FormatInt(ms, 10))
+	}
+	if _, err := c.client.Do(args...); err != nil {
+		Log.Warn("Failed to cache %s in Redis: %v", key, err)
+	}
+}
+
+// Get retrieves a value from cache, decoded from JSON
+func (c *RedisCache) Get(key string) (interface{}, bool) {
+	reply, err := c.client.Do("GET", c.prefix+key)
+	if err != nil {
+		Log.Warn("Failed to read %s from Redis: %v", key, err)
+		return nil, false
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, false
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// Delete removes an item from cache
+func (c *RedisCache) Delete(key string) {
+	if _, err := c.client.Do("DEL", c.prefix+key); err != nil {
+		Log.Warn("Failed to delete %s from Redis: %v", key, err)
+	}
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// ImageProxyPath is the endpoint remote images are loaded through when
+// proxying is on
+const ImageProxyPath = "/api/image-proxy"
+
+// cssURLPattern matches url(...) references in style attributes
+var cssURLPattern = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s]*))\s*\)`)
+
+// ProxyImageURL returns the proxy URL a remote image is loaded through
+func ProxyImageURL(src string) string {
+	return ImageProxyPath + "?url=" + url.QueryEscape(src)
+}
+
+// isRemoteURL reports whether a URL loads from another server
+func isRemoteURL(src string) bool {
+	src = strings.ToLower(strings.TrimSpace(src))
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") || strings.HasPrefix(src, "//")
+}
+
+// RewriteRemoteImages rewrites the remote images of sanitized HTML so they
+// don't load behind the reader's back. Blocked images keep the URL to load
+// them from in data-remote-src (and blocked backgrounds their style in
+// data-remote-style) for the viewer's "load images" action. With proxy set
+// the URLs point at the image proxy instead of the remote server. It returns
+// the new HTML and how many images were blocked.
+func RewriteRemoteImages(htmlBody string, block, proxy bool) (string, int) {
+	loadURL := func(src string) string {
+		if strings.HasPrefix(src, "//") {
+			src = "https:" + src
+		}
+		if proxy {
+			return ProxyImageURL(src)
+		}
+		return src
+	}
+
+	var out strings.Builder
+	blocked := 0
+
+	z := html.NewTokenizer(strings.NewReader(htmlBody))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		token := z.Token()
+
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken {
+			attrs := make([]html.Attribute, 0, len(token.Attr))
+			for _, attr := range token.Attr {
+				switch {
+				case attr.Key == "src" && token.Data == "img" && isRemoteURL(attr.Val):
+					if block {
+						attrs = append(attrs, html.Attribute{Key: "data-remote-src", Val: loadURL(attr.Val)})
+						blocked++
+						continue
+					}
+					attr.Val = loadURL(attr.Val)
+
+				case attr.Key == "style" && cssURLPattern.MatchString(attr.Val):
+					remote := false
+					loaded := cssURLPattern.ReplaceAllStringFunc(attr.Val, func(match string) string {
+						groups := cssURLPattern.FindStringSubmatch(match)
+						src := groups[1] + groups[2] + groups[3]
+						if !isRemoteURL(src) {
+							return match
+						}
+						remote = true
+						return `url("` + loadURL(src) + `")`
+					})
+					if !remote {
+						break
+					}
+					if block {
+						attrs = append(attrs, html.Attribute{Key: "data-remote-style", Val: loaded})
+						attr.Val = cssURLPattern.ReplaceAllStringFunc(attr.Val, func(match string) string {
+							groups := cssURLPattern.FindStringSubmatch(match)
+							if isRemoteURL(groups[1] + groups[2] + groups[3]) {
+								return "none"
+							}
+							return match
+						})
+						blocked++
+					} else {
+						attr.Val = loaded
+					}
+				}
+				attrs = append(attrs, attr)
+			}
+			token.Attr = attrs
+		}
+
+		out.WriteString(token.String())
+	}
+
+	return out.String(), blocked
+}
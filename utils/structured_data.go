@@ -0,0 +1,310 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Limits on the JSON-LD kept from a message
+const (
+	maxJSONLDBlocks = 10
+	maxJSONLDBytes  = 64 << 10
+)
+
+// ExtractJSONLD returns the schema.org JSON-LD blocks of an HTML body, which
+// senders embed in <script type="application/ld+json"> for mail clients to
+// show flight, parcel and order details from
+func ExtractJSONLD(htmlBody string) []string {
+	var blocks []string
+
+	z := html.NewTokenizer(strings.NewReader(htmlBody))
+	inJSONLD := false
+	for len(blocks) < maxJSONLDBlocks {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		switch tt {
+		case html.StartTagToken:
+			token := z.Token()
+			inJSONLD = token.Data == "script" && strings.EqualFold(strings.TrimSpace(tokenAttr(token, "type")), "application/ld+json")
+		case html.TextToken:
+			if inJSONLD {
+				block := strings.TrimSpace(string(z.Text()))
+				if len(block) <= maxJSONLDBytes && json.Valid([]byte(block)) {
+					blocks = append(blocks, block)
+				}
+			}
+		default:
+			inJSONLD = false
+		}
+	}
+
+	return blocks
+}
+
+// tokenAttr returns the value of a tag's attribute, or "" if it has none
+func tokenAttr(token html.Token, key string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// ldNode is an object of JSON-LD
+type ldNode map[string]interface{}
+
+// jsonLDCards builds the cards for the reservations, parcels, orders and
+// events described by a message's JSON-LD blocks
+func jsonLDCards(blocks []string) []SummaryCard {
+	var cards []SummaryCard
+	for _, block := range blocks {
+		var data interface{}
+		if err := json.Unmarshal([]byte(block), &data); err != nil {
+			continue
+		}
+		for _, node := range ldNodes(data) {
+			cards = append(cards, ldCards(node)...)
+		}
+	}
+	return cards
+}
+
+// ldNodes returns the top level objects of a JSON-LD block, which is an
+// object, an array of them or an object with a @graph of them
+func ldNodes(data interface{}) []ldNode {
+	switch v := data.(type) {
+	case []interface{}:
+		var nodes []ldNode
+		for _, item := range v {
+			nodes = append(nodes, ldNodes(item)...)
+		}
+		return nodes
+	case map[string]interface{}:
+		if graph, ok := v["@graph"]; ok {
+			return ldNodes(graph)
+		}
+		return []ldNode{v}
+	}
+	return nil
+}
+
+// ldCards returns the cards for one JSON-LD object
+func ldCards(n ldNode) []SummaryCard {
+	switch t := n.typ(); {
+	case t == "FlightReservation":
+		flight := n.obj("reservationFor")
+		departure := flight.obj("departureAirport")
+		arrival := flight.obj("arrivalAirport")
+
+		number := flight.str("flightNumber")
+		if airline := flight.obj("airline").str("iataCode"); airline != "" && !strings.HasPrefix(number, airline) {
+			number = airline + " " + number
+		}
+		card := SummaryCard{
+			Kind:     CardFlight,
+			Title:    strings.TrimSpace(number + " " + airportName(departure) + " → " + airportName(arrival)),
+			Start:    ldTime(flight.str("departureTime")),
+			End:      ldTime(flight.str("arrivalTime")),
+			Location: departure.str("name"),
+			URL:      n.link("url"),
+		}
+		card.addField("card_confirmation", n.str("reservationNumber"))
+		card.addField("card_departure", formatLDTime(card.Start))
+		card.addField("card_arrival", formatLDTime(card.End))
+		card.addField("card_passenger", n.obj("underName").str("name"))
+		return []SummaryCard{card}
+
+	case t == "LodgingReservation":
+		lodging := n.obj("reservationFor")
+		card := SummaryCard{
+			Kind:     CardLodging,
+			Title:    lodging.str("name"),
+			Start:    ldTime(firstNonEmpty(n.str("checkinTime"), n.str("checkinDate"))),
+			End:      ldTime(firstNonEmpty(n.str("checkoutTime"), n.str("checkoutDate"))),
+			Location: ldAddress(lodging, "address"),
+			URL:      n.link("url"),
+		}
+		card.addField("card_confirmation", n.str("reservationNumber"))
+		card.addField("card_check_in", formatLDTime(card.Start))
+		card.addField("card_check_out", formatLDTime(card.End))
+		card.addField("card_address", card.Location)
+		return []SummaryCard{card}
+
+	case t == "EventReservation":
+		cards := ldCards(n.obj("reservationFor"))
+		for i := range cards {
+			cards[i].addField("card_confirmation", n.str("reservationNumber"))
+			if cards[i].URL == "" {
+				cards[i].URL = n.link("url")
+			}
+		}
+		return cards
+
+	case t == "Event" || strings.HasSuffix(t, "Event"):
+		place := n.obj("location")
+		location := place.str("name")
+		if address := ldAddress(place, "address"); address != "" {
+			location = strings.TrimSpace(location + " " + address)
+		}
+		card := SummaryCard{
+			Kind:     CardEvent,
+			Title:    n.str("name"),
+			Start:    ldTime(n.str("startDate")),
+			End:      ldTime(n.str("endDate")),
+			Location: location,
+			URL:      n.link("url"),
+		}
+		card.addField("card_when", formatLDTime(card.Start))
+		card.addField("card_where", location)
+		return []SummaryCard{card}
+
+	case t == "ParcelDelivery":
+		carrierName := firstNonEmpty(n.obj("carrier").str("name"), n.obj("provider").str("name"))
+		card := SummaryCard{
+			Kind:     CardParcel,
+			Title:    firstNonEmpty(n.obj("itemShipped").str("name"), carrierName),
+			TrackURL: n.link("trackingUrl"),
+		}
+		card.addField("card_tracking_number", n.str("trackingNumber"))
+		card.addField("card_carrier", carrierName)
+		card.addField("card_expected_arrival", formatLDTime(ldTime(n.str("expectedArrivalUntil"))))
+		return []SummaryCard{card}
+
+	case t == "Order":
+		card := SummaryCard{
+			Kind:  CardOrder,
+			Title: firstNonEmpty(n.obj("merchant").str("name"), n.obj("seller").str("name")),
+			URL:   n.link("url"),
+		}
+		card.addField("card_order_number", n.str("orderNumber"))
+		if price := firstNonEmpty(n.str("price"), n.obj("totalPaymentDue").str("price"), n.obj("priceSpecification").str("price")); price != "" {
+			currency := firstNonEmpty(n.str("priceCurrency"), n.obj("totalPaymentDue").str("priceCurrency"), n.obj("priceSpecification").str("priceCurrency"))
+			card.addField("card_total", strings.TrimSpace(price+" "+currency))
+		}
+		cards := []SummaryCard{card}
+		if delivery := n.obj("orderDelivery"); delivery != nil {
+			delivery["@type"] = "ParcelDelivery"
+			cards = append(cards, ldCards(delivery)...)
+		}
+		return cards
+	}
+	return nil
+}
+
+// typ returns the node's schema.org type without the vocabulary URL
+func (n ldNode) typ() string {
+	t := n.str("@type")
+	if i := strings.LastIndexAny(t, "/:"); i >= 0 {
+		t = t[i+1:]
+	}
+	return t
+}
+
+// obj returns the object under key, or the first one of an array of them.
+// It returns nil if there is none, which str and obj treat as empty.
+func (n ldNode) obj(key string) ldNode {
+	switch v := n[key].(type) {
+	case map[string]interface{}:
+		return v
+	case []interface{}:
+		if len(v) > 0 {
+			if first, ok := v[0].(map[string]interface{}); ok {
+				return first
+			}
+		}
+	}
+	return nil
+}
+
+// str returns the text under key: a string or number, the first of an array
+// of them, or the name of an object
+func (n ldNode) str(key string) string {
+	switch v := n[key].(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		if len(v) > 0 {
+			return ldNode{key: v[0]}.str(key)
+		}
+	case map[string]interface{}:
+		return ldNode(v).str("name")
+	}
+	return ""
+}
+
+// link returns the URL under key if it is a web address
+func (n ldNode) link(key string) string {
+	u, err := url.Parse(n.str(key))
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+// airportName returns an airport's IATA code, or its name if it has none
+func airportName(airport ldNode) string {
+	return firstNonEmpty(airport.str("iataCode"), airport.str("name"))
+}
+
+// ldAddress returns the address under key of n as one line, whether it is
+// a PostalAddress or plain text
+func ldAddress(n ldNode, key string) string {
+	address := n.obj(key)
+	if address == nil {
+		return n.str(key)
+	}
+	var parts []string
+	for _, key := range []string{"streetAddress", "addressLocality", "addressRegion", "postalCode", "addressCountry"} {
+		if part := address.str(key); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ldTimeLayouts are the date formats accepted in JSON-LD, most precise first
+var ldTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// ldTime parses a JSON-LD date or date and time, returning the zero time if
+// it can't be parsed
+func ldTime(s string) time.Time {
+	for _, layout := range ldTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// formatLDTime formats a time on a card in the time zone the sender gave it
+// in, which for flights and hotels is the local time there
+func formatLDTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// firstNonEmpty returns the first of values that isn't empty
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"fmt"
+	"lilmail/models"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Kinds of summary cards
+const (
+	CardFlight  = "flight"
+	CardParcel  = "parcel"
+	CardOrder   = "order"
+	CardEvent   = "event"
+	CardLodging = "lodging"
+)
+
+// maxSummaryCards caps the cards shown for one message
+const maxSummaryCards = 5
+
+// SummaryCard is a flight, parcel, order or booking found in a message, shown
+// above its body with actions like tracking the parcel
+type SummaryCard struct {
+	Kind     string      `json:"kind"`
+	Title    string      `json:"title,omitempty"`
+	Fields   []CardField `json:"fields,omitempty"`
+	TrackURL string      `json:"track_url,omitempty"` // Carrier page following a parcel
+	URL      string      `json:"url,omitempty"`       // Sender's page for the order or booking
+	Start    time.Time   `json:"start"`               // Set when the card can be added to a calendar
+	End      time.Time   `json:"end"`
+	Location string      `json:"location,omitempty"`
+}
+
+// CardField is a value on a summary card under a label, which is a message ID
+type CardField struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// HasCalendar reports whether the card is for something with a start time
+func (c SummaryCard) HasCalendar() bool {
+	return !c.Start.IsZero()
+}
+
+// addField adds a field to the card if value isn't empty
+func (c *SummaryCard) addField(label, value string) {
+	if value = strings.TrimSpace(value); value != "" {
+		c.Fields = append(c.Fields, CardField{Label: label, Value: value})
+	}
+}
+
+// carrier is a parcel carrier whose tracking numbers can be found in text
+type carrier struct {
+	name     string
+	keywords []string       // One must appear in the message; none for numbers that can't be mistaken
+	number   *regexp.Regexp // The number is its first group
+	trackURL string         // Tracking page, with %s for the number
+}
+
+// carriers are the parcel carriers tracking numbers are looked for from
+var carriers = []carrier{
+	{"UPS", nil, regexp.MustCompile(`\b(1Z[0-9A-Z]{16})\b`), "https://www.ups.com/track?tracknum=%s"},
+	{"USPS", []string{"usps"}, regexp.MustCompile(`\b(9[2-5]\d{20})\b`), "https://tools.usps.com/go/TrackConfirmAction?tLabels=%s"},
+	{"FedEx", []string{"fedex"}, regexp.MustCompile(`\b(\d{12}|\d{15})\b`), "https://www.fedex.com/fedextrack/?trknbr=%s"},
+	{"日本郵便", nil, regexp.MustCompile(`\b([A-Z]{2}\d{9}JP)\b`), "https://trackings.post.japanpost.jp/services/srv/search/direct?reqCodeNo1=%s"},
+	{"日本郵便", []string{"ゆうパック", "日本郵便", "ゆうパケット"}, jpTrackingNumber, "https://trackings.post.japanpost.jp/services/srv/search/direct?reqCodeNo1=%s"},
+	{"ヤマト運輸", []string{"ヤマト", "クロネコ"}, jpTrackingNumber, "https://jizen.kuronekoyamato.co.jp/jizen/servlet/crjz.b.NQ0010?id=%s"},
+	{"佐川急便", []string{"佐川"}, jpTrackingNumber, "https://k2k.sagawa-exp.co.jp/p/web/okurijosearch.do?okurijoNo=%s"},
+}
+
+// jpTrackingNumber matches the 12 digit slip numbers of Japanese carriers.
+// They look like phone numbers, so only ones labelled as slip numbers count.
+var jpTrackingNumber = regexp.MustCompile(`(?:伝票番号|お?問い?合わ?せ番号|追跡番号)\s*[:：]?\s*(\d{4}-?\d{4}-?\d{4})\b`)
+
+// Patterns for messages without structured data
+var (
+	orderNumberPattern  = regexp.MustCompile(`(?i:order\s*(?:number|no\.?|#|id)|ご?注文番号)\s*[:：#]?\s*([A-Za-z0-9][A-Za-z0-9-]{3,})`)
+	orderTotalPattern   = regexp.MustCompile(`(?i:order total|grand total|total|ご?請求金額|お支払い?金額|合計金額|合計)\s*[:：]?\s*([$€£¥￥]\s?\d[\d,]*(?:\.\d{2})?|\d[\d,]*\s?円)`)
+	flightNumberPattern = regexp.MustCompile(`(?i:flight(?:\s*(?:number|no\.?))?|便名)\s*[:：#]?\s*([A-Z]{2}|[A-Z]\d|\d[A-Z])\s?(\d{1,4})\b`)
+	confirmationPattern = regexp.MustCompile(`(?i:confirmation\s*(?:code|number)|booking\s*reference|record\s*locator|予約番号|確認番号)\s*[:：#]?\s*([A-Z0-9]{5,8})\b`)
+)
+
+// SummaryCards returns the cards for a message: from the schema.org data
+// the sender embedded where there is any, else from tracking numbers, order
+// numbers and flight numbers found in its text
+func SummaryCards(email models.Email) []SummaryCard {
+	cards := jsonLDCards(email.StructuredData)
+	if len(cards) == 0 {
+		text := email.Body
+		if text == "" && email.HTML != "" {
+			text = HTMLToText(string(email.HTML))
+		}
+		cards = textCards(email, email.Subject+"\n"+text)
+	}
+
+	if len(cards) > maxSummaryCards {
+		cards = cards[:maxSummaryCards]
+	}
+	return cards
+}
+
+// textCards looks for parcels, an order and a flight in a message's text
+func textCards(email models.Email, text string) []SummaryCard {
+	var cards []SummaryCard
+	lower := strings.ToLower(text)
+
+	seen := make(map[string]bool)
+	for _, c := range carriers {
+		if len(c.keywords) > 0 && !containsAny(lower, c.keywords) {
+			continue
+		}
+		for _, match := range c.number.FindAllStringSubmatch(text, maxSummaryCards) {
+			number := strings.ReplaceAll(match[1], "-", "")
+			if seen[number] {
+				continue
+			}
+			seen[number] = true
+
+			card := SummaryCard{Kind: CardParcel, Title: c.name, TrackURL: fmt.Sprintf(c.trackURL, number)}
+			card.addField("card_tracking_number", number)
+			cards = append(cards, card)
+		}
+	}
+
+	if match := orderNumberPattern.FindStringSubmatch(text); match != nil && strings.ContainsAny(match[1], "0123456789") {
+		card := SummaryCard{Kind: CardOrder, Title: senderTitle(email)}
+		card.addField("card_order_number", match[1])
+		if total := orderTotalPattern.FindStringSubmatch(text); total != nil {
+			card.addField("card_total", total[1])
+		}
+		cards = append(cards, card)
+	}
+
+	if match := flightNumberPattern.FindStringSubmatch(text); match != nil {
+		card := SummaryCard{Kind: CardFlight, Title: match[1] + " " + match[2]}
+		if confirmation := confirmationPattern.FindStringSubmatch(text); confirmation != nil {
+			card.addField("card_confirmation", confirmation[1])
+		}
+		cards = append(cards, card)
+	}
+
+	return cards
+}
+
+// senderTitle names the sender of a message for a card title
+func senderTitle(email models.Email) string {
+	if email.FromName != "" {
+		return email.FromName
+	}
+	return addressDomain(email.From)
+}
+
+// containsAny reports whether s contains any of the words
+func containsAny(s string, words []string) bool {
+	for _, word := range words {
+		if strings.Contains(s, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -65,6 +65,12 @@ func (tb *ThreadBuilder) BuildThreads(emails []*models.Email) []*models.EmailThr
 		}
 	}
 	
+	// Step 2a: Drop containers for messages that weren't fetched
+	tb.rootSet = pruneEmptyContainers(tb.rootSet, nil)
+	
+	// Step 2b: Merge roots that share a subject, for replies that lost their headers
+	tb.groupBySubject()
+	
 	// Step 3: Group into threads
 	threads := tb.groupThreads()
 	
@@ -76,6 +82,146 @@ func (tb *ThreadBuilder) BuildThreads(emails []*models.Email) []*models.EmailThr
 	return threads
 }
 
+// pruneEmptyContainers is step 4 of JWZ. Containers without a message stand
+// for referenced messages outside the fetch window: empty ones are dropped
+// and their children take their place, except that a root with several
+// children is kept so the siblings stay in one thread. It returns the
+// containers that replace the given ones under parent (nil for the root set).
+func pruneEmptyContainers(containers []*ThreadContainer, parent *ThreadContainer) []*ThreadContainer {
+	var result []*ThreadContainer
+	for _, container := range containers {
+		container.Children = pruneEmptyContainers(container.Children, container)
+
+		switch {
+		case container.Message == nil && len(container.Children) == 0:
+			// Nothing left in it
+		case container.Message == nil && (parent != nil || len(container.Children) == 1):
+			// Promote the children
+			for _, child := range container.Children {
+				child.Parent = parent
+				result = append(result, child)
+			}
+		default:
+			result = append(result, container)
+		}
+	}
+	return result
+}
+
+// groupBySubject is step 5 of JWZ: roots with the same normalized subject
+// are gathered into one thread. A reply ("Re: ...") goes under the root
+// that isn't a reply; otherwise they become siblings under a dummy container.
+func (tb *ThreadBuilder) groupBySubject() {
+	subjects := make(map[string]*ThreadContainer)
+
+	// The root set comes from a map; go oldest first so the result is stable
+	sort.SliceStable(tb.rootSet, func(i, j int) bool {
+		return containerDate(tb.rootSet[i]).Before(containerDate(tb.rootSet[j]))
+	})
+
+	// Pick one container per subject, preferring dummies and non-replies
+	for _, root := range tb.rootSet {
+		subject := containerSubject(root)
+		if subject == "" {
+			continue
+		}
+		normalized := NormalizeSubject(subject)
+		if normalized == "" {
+			continue
+		}
+
+		existing, ok := subjects[normalized]
+		if !ok ||
+			(root.Message == nil && existing.Message != nil) ||
+			(existing.Message != nil && isReplySubject(containerSubject(existing)) && !isReplySubject(subject)) {
+			subjects[normalized] = root
+		}
+	}
+
+	var merged []*ThreadContainer
+	for _, root := range tb.rootSet {
+		if root.Parent != nil {
+			// Already moved under a dummy created for an earlier root
+			continue
+		}
+		subject := containerSubject(root)
+		normalized := NormalizeSubject(subject)
+		target, ok := subjects[normalized]
+		if subject == "" || normalized == "" || !ok || target == root {
+			merged = append(merged, root)
+			continue
+		}
+
+		switch {
+		case target.Message == nil && root.Message == nil:
+			// Both dummies: move the children over
+			for _, child := range root.Children {
+				child.Parent = target
+				target.Children = append(target.Children, child)
+			}
+		case target.Message == nil:
+			// The dummy collects everything with its subject
+			root.Parent = target
+			target.Children = append(target.Children, root)
+		case !isReplySubject(containerSubject(target)) && isReplySubject(subject):
+			root.Parent = target
+			target.Children = append(target.Children, root)
+		default:
+			// Neither is a reply to the other; put both under a new dummy
+			dummy := &ThreadContainer{Children: []*ThreadContainer{target, root}}
+			target.Parent = dummy
+			root.Parent = dummy
+			subjects[normalized] = dummy
+			// Take target's place in the root set
+			replaced := false
+			for i, r := range merged {
+				if r == target {
+					merged[i] = dummy
+					replaced = true
+				}
+			}
+			if !replaced {
+				merged = append(merged, dummy)
+			}
+		}
+	}
+
+	tb.rootSet = merged
+}
+
+// containerSubject returns the subject of a container's message, or of its
+// first child's for dummy containers
+func containerSubject(container *ThreadContainer) string {
+	if container.Message != nil {
+		return container.Message.Subject
+	}
+	for _, child := range container.Children {
+		if child.Message != nil {
+			return child.Message.Subject
+		}
+	}
+	return ""
+}
+
+// containerDate returns the date of a container's message, or of its first
+// child's for dummy containers
+func containerDate(container *ThreadContainer) time.Time {
+	if container.Message != nil {
+		return container.Message.Date
+	}
+	for _, child := range container.Children {
+		if child.Message != nil {
+			return child.Message.Date
+		}
+	}
+	return time.Time{}
+}
+
+// isReplySubject reports whether a subject carries a Re:/Fwd: style prefix
+func isReplySubject(subject string) bool {
+	return NormalizeSubject(subject) != strings.ToLower(strings.TrimSpace(subject))
+}
+
 // getContainer retrieves or creates a container for a message ID
 func (tb *ThreadBuilder) getContainer(messageID string) *ThreadContainer {
 	if messageID == "" {
@@ -190,12 +336,21 @@ func cleanSubject(subject string) string {
 	return subject
 }
 
-// generateThreadID generates a unique thread ID
+// generateThreadID generates a unique thread ID. Dummy roots are named after
+// their first message.
 func generateThreadID(root *ThreadContainer) string {
 	if root.Message != nil && root.Message.MessageID != "" {
 		return root.Message.MessageID
 	}
-	return time.Now().Format("20060102150405")
+	for _, child := range root.Children {
+		if id := generateThreadID(child); id != "" {
+			return id
+		}
+	}
+	if root.Parent == nil {
+		return time.Now().Format("20060102150405")
+	}
+	return ""
 }
 
 // hasFlag checks if a flag exists in the flags slice
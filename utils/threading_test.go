@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"lilmail/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+// msg returns a container holding a message named id
+func msg(id string, children ...*ThreadContainer) *ThreadContainer {
+	return link(&ThreadContainer{Message: &models.Email{MessageID: id}}, children)
+}
+
+// dummy returns a container for a message that wasn't fetched
+func dummy(children ...*ThreadContainer) *ThreadContainer {
+	return link(&ThreadContainer{}, children)
+}
+
+func link(container *ThreadContainer, children []*ThreadContainer) *ThreadContainer {
+	container.Children = children
+	for _, child := range children {
+		child.Parent = container
+	}
+	return container
+}
+
+// subjectMsg returns a root container holding a message with a subject,
+// dated minutes after a fixed time
+func subjectMsg(id, subject string, minutes int) *ThreadContainer {
+	date := time.Date(2024, 1, 1, 0, minutes, 0, 0, time.UTC)
+	return &ThreadContainer{Message: &models.Email{MessageID: id, Subject: subject, Date: date}}
+}
+
+// shape renders containers as "a(b c)", with "_" for dummies, and checks
+// that every child points back at its parent
+func shape(t *testing.T, containers []*ThreadContainer, parent *ThreadContainer) string {
+	t.Helper()
+	var parts []string
+	for _, container := range containers {
+		if container.Parent != parent {
+			t.Errorf("container %s has the wrong parent", shape(t, []*ThreadContainer{container}, container.Parent))
+		}
+		name := "_"
+		if container.Message != nil {
+			name = container.Message.MessageID
+		}
+		if len(container.Children) > 0 {
+			name += "(" + shape(t, container.Children, container) + ")"
+		}
+		parts = append(parts, name)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestPruneEmptyContainers(t *testing.T) {
+	tests := []struct {
+		name  string
+		roots []*ThreadContainer
+		want  string
+	}{
+		{
+			name:  "missing parent promoted",
+			roots: []*ThreadContainer{msg("a", dummy(msg("b"), msg("c")))},
+			want:  "a(b c)",
+		},
+		{
+			name:  "dummy root with one child replaced by it",
+			roots: []*ThreadContainer{dummy(msg("a", msg("b")))},
+			want:  "a(b)",
+		},
+		{
+			name:  "dummy root with several children kept",
+			roots: []*ThreadContainer{dummy(msg("a"), msg("b"))},
+			want:  "_(a b)",
+		},
+		{
+			name:  "nested dummies under a root collapse into it",
+			roots: []*ThreadContainer{dummy(dummy(msg("a")), dummy(msg("b")))},
+			want:  "_(a b)",
+		},
+		{
+			name:  "chain of dummies collapses to the message",
+			roots: []*ThreadContainer{dummy(dummy(dummy(msg("a", msg("b")))))},
+			want:  "a(b)",
+		},
+		{
+			name:  "empty dummies dropped",
+			roots: []*ThreadContainer{dummy(), msg("a", dummy(dummy()))},
+			want:  "a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shape(t, pruneEmptyContainers(tt.roots, nil), nil)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupBySubject(t *testing.T) {
+	tests := []struct {
+		name  string
+		roots []*ThreadContainer
+		want  string
+	}{
+		{
+			name:  "reply goes under the original",
+			roots: []*ThreadContainer{subjectMsg("b", "Re: Lunch", 2), subjectMsg("a", "Lunch", 1)},
+			want:  "a(b)",
+		},
+		{
+			name:  "forward goes under the original",
+			roots: []*ThreadContainer{subjectMsg("a", "Lunch", 1), subjectMsg("b", "Fwd: lunch", 2)},
+			want:  "a(b)",
+		},
+		{
+			name:  "stacked and mixed case prefixes",
+			roots: []*ThreadContainer{subjectMsg("a", "Lunch", 1), subjectMsg("b", "RE: Fw: Lunch", 2), subjectMsg("c", "re: re: Lunch", 3)},
+			want:  "a(b c)",
+		},
+		{
+			name:  "replies without the original become siblings",
+			roots: []*ThreadContainer{subjectMsg("a", "Re: Lunch", 1), subjectMsg("b", "Fwd: Lunch", 2)},
+			want:  "_(a b)",
+		},
+		{
+			name:  "same subject without prefixes become siblings",
+			roots: []*ThreadContainer{subjectMsg("a", "Lunch", 1), subjectMsg("b", "Lunch", 2)},
+			want:  "_(a b)",
+		},
+		{
+			name:  "dummy root collects the subject",
+			roots: []*ThreadContainer{dummy(subjectMsg("a", "Re: Lunch", 1), subjectMsg("b", "Re: Lunch", 2)), subjectMsg("c", "Re: Lunch", 3)},
+			want:  "_(a b c)",
+		},
+		{
+			name:  "different subjects stay apart",
+			roots: []*ThreadContainer{subjectMsg("a", "Lunch", 1), subjectMsg("b", "Re: Dinner", 2)},
+			want:  "a b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := NewThreadBuilder()
+			tb.rootSet = tt.roots
+			tb.groupBySubject()
+			if got := shape(t, tb.rootSet, nil); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildThreadsPromotesMissingParent(t *testing.T) {
+	// Both reply to a message outside the fetch window
+	emails := []*models.Email{
+		{MessageID: "<b@x>", Subject: "Re: Plan", InReplyTo: "<a@x>", References: []string{"<a@x>"}, Date: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)},
+		{MessageID: "<c@x>", Subject: "Re: Plan", InReplyTo: "<a@x>", References: []string{"<a@x>"}, Date: time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{MessageID: "<d@x>", Subject: "Other", Date: time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)},
+	}
+
+	threads := NewThreadBuilder().BuildThreads(emails)
+	if len(threads) != 2 {
+		t.Fatalf("got %d threads, want 2", len(threads))
+	}
+	if threads[0].MessageCount != 2 || threads[0].Subject != "Plan" {
+		t.Errorf("got thread %q with %d messages, want Plan with 2", threads[0].Subject, threads[0].MessageCount)
+	}
+	if threads[0].ID != "<b@x>" {
+		t.Errorf("got thread ID %q, want the first message's", threads[0].ID)
+	}
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// locations caches loaded time zones by name
+var locations sync.Map
+
+// InTimezone converts t to the named IANA time zone. An empty or unknown
+// name leaves t in server time.
+func InTimezone(t time.Time, name string) time.Time {
+	if name == "" {
+		return t
+	}
+	if loc, ok := locations.Load(name); ok {
+		return t.In(loc.(*time.Location))
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return t
+	}
+	locations.Store(name, loc)
+	return t.In(loc)
+}
+
+// ValidTimezone reports whether name is empty (server time) or a known IANA
+// time zone
+func ValidTimezone(name string) bool {
+	if name == "" {
+		return true
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
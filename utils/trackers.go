@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// trackerDomains are hosts that serve open tracking pixels for mail
+// trackers and bulk senders. Subdomains match too.
+var trackerDomains = []string{
+	"mailtrack.io", "mltrk.io", "yesware.com", "bananatag.com", "getnotify.com",
+	"mixmax.com", "streak.com", "mailfoogae.appspot.com", "superhuman.com",
+	"sidekickopen01.com", "emltrk.com", "list-manage.com", "mandrillapp.com",
+	"ct.sendgrid.net", "awstrack.me", "pixel.watch",
+}
+
+// trackerPaths are URL paths that open tracking pixels are served from
+var trackerPaths = []string{
+	"/track/open", "/tracking/open", "/wf/open", "/open.php", "/open.aspx", "/open.gif", "/pixel.gif",
+}
+
+// StripTrackers removes tracking pixels from sanitized HTML: remote images
+// no bigger than 1x1 and images loaded from known tracker domains or
+// tracking paths. It returns the new HTML and how many images were removed.
+func StripTrackers(htmlBody string) (string, int) {
+	var out strings.Builder
+	removed := 0
+
+	z := html.NewTokenizer(strings.NewReader(htmlBody))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		token := z.Token()
+
+		if (tt == html.StartTagToken || tt == html.SelfClosingTagToken) && token.Data == "img" && isTrackingImage(token.Attr) {
+			removed++
+			continue
+		}
+		out.WriteString(token.String())
+	}
+
+	return out.String(), removed
+}
+
+// isTrackingImage reports whether the attributes of an img tag make it a
+// tracking pixel
+func isTrackingImage(attrs []html.Attribute) bool {
+	var src string
+	width, height := -1, -1
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "src":
+			src = attr.Val
+		case "width":
+			width = pixelSize(attr.Val)
+		case "height":
+			height = pixelSize(attr.Val)
+		}
+	}
+	if !isRemoteURL(src) {
+		return false
+	}
+
+	// A remote image too small to see is there to report the message was opened
+	if width >= 0 && width <= 1 && height >= 0 && height <= 1 {
+		return true
+	}
+
+	if strings.HasPrefix(src, "//") {
+		src = "https:" + src
+	}
+	u, err := url.Parse(strings.TrimSpace(src))
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range trackerDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	path := strings.ToLower(u.Path)
+	for _, tracker := range trackerPaths {
+		if strings.Contains(path, tracker) {
+			return true
+		}
+	}
+	return false
+}
+
+// pixelSize parses a width or height attribute like "1" or "1px", returning
+// -1 if it isn't a plain pixel size
+func pixelSize(value string) int {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(strings.ToLower(value)), "px"))
+	if err != nil {
+		return -1
+	}
+	return n
+}